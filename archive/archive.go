@@ -0,0 +1,298 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package archive exports keys as signed, timestamped bundles for long-term
+// preservation, and verifies them.
+//
+// A bundle is a gzipped tar file containing the keys in binary OpenPGP packet
+// format, split across files of at most FileKeys keys each, followed by a
+// JSON manifest listing the SHA-256 digest of each file and an Ed25519
+// signature of the manifest. Each manifest may record the digest of the
+// previous bundle's manifest, forming a verifiable chain of bundles.
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+	"gopkg.in/hockeypuck/openpgp.v1"
+)
+
+const (
+	// ManifestName and SignatureName are the names of the manifest and its
+	// signature within a bundle.
+	ManifestName  = "manifest.json"
+	SignatureName = "manifest.json.sig"
+
+	// FileKeys is the most keys written to each file in a bundle.
+	FileKeys = 10000
+
+	manifestVersion = 1
+)
+
+// Manifest describes the contents of a bundle.
+type Manifest struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Origin  string    `json:"origin,omitempty"`
+	Domain  string    `json:"domain,omitempty"`
+	Keys    int       `json:"keys"`
+	Files   []File    `json:"files"`
+
+	// Previous is the digest of the manifest of the previous bundle in a
+	// chain, if any.
+	Previous string `json:"previous,omitempty"`
+	// PublicKey is the Ed25519 key which signs the manifest.
+	PublicKey []byte `json:"publicKey"`
+}
+
+// File describes a file of keys in a bundle.
+type File struct {
+	Name   string `json:"name"`
+	Keys   int    `json:"keys"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Digest returns the hex-encoded SHA-256 digest of the manifest, for
+// chaining the next bundle to it.
+func (m *Manifest) Digest() (string, error) {
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+type exporter struct {
+	origin   string
+	domain   string
+	previous string
+}
+
+type Option func(*exporter) error
+
+// Origin records the name of the keyserver the keys were exported from.
+func Origin(name string) Option {
+	return func(e *exporter) error {
+		e.origin = name
+		return nil
+	}
+}
+
+// Domain exports only keys with a user ID at the given email domain.
+func Domain(domain string) Option {
+	return func(e *exporter) error {
+		e.domain = storage.NormalizeDomain(domain)
+		return nil
+	}
+}
+
+// Previous chains the bundle to the previous bundle in a series.
+func Previous(m *Manifest) Option {
+	return func(e *exporter) error {
+		digest, err := m.Digest()
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		e.previous = digest
+		return nil
+	}
+}
+
+func (e *exporter) match(key *openpgp.PrimaryKey) bool {
+	if e.domain == "" {
+		return true
+	}
+	for _, uid := range key.UserIDs {
+		if storage.EmailDomain(uid.Keywords) == e.domain {
+			return true
+		}
+	}
+	return false
+}
+
+// Export writes a bundle of the keys in st to w, signed with key, and returns
+// its manifest.
+func Export(w io.Writer, st storage.Queryer, key ed25519.PrivateKey, options ...Option) (*Manifest, error) {
+	var e exporter
+	for _, option := range options {
+		err := option(&e)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	m := &Manifest{
+		Version:   manifestVersion,
+		Created:   time.Now().UTC(),
+		Origin:    e.origin,
+		Domain:    e.domain,
+		Previous:  e.previous,
+		PublicKey: key.Public().(ed25519.PublicKey),
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	var buf bytes.Buffer
+	var n int
+	var werr error
+	flush := func() {
+		if n == 0 || werr != nil {
+			return
+		}
+		f := File{Name: fmt.Sprintf("keys-%05d.pgp", len(m.Files)), Keys: n}
+		werr = writeFile(tw, f.Name, buf.Bytes(), m.Created)
+		f.Size = int64(buf.Len())
+		sum := sha256.Sum256(buf.Bytes())
+		f.SHA256 = hex.EncodeToString(sum[:])
+		m.Files = append(m.Files, f)
+		m.Keys += n
+		buf.Reset()
+		n = 0
+	}
+	err := storage.ForEachKey(st, func(key *openpgp.PrimaryKey) {
+		if werr != nil || !e.match(key) {
+			return
+		}
+		werr = openpgp.WritePackets(&buf, key)
+		n++
+		if n >= FileKeys {
+			flush()
+		}
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	flush()
+	if werr != nil {
+		return nil, errgo.Mask(werr)
+	}
+
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	err = writeFile(tw, ManifestName, manifest, m.Created)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	err = writeFile(tw, SignatureName, ed25519.Sign(key, manifest), m.Created)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	err = tw.Close()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	err = gz.Close()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return m, nil
+}
+
+func writeFile(tw *tar.Writer, name string, contents []byte, modTime time.Time) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(contents)),
+		ModTime: modTime,
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	_, err = tw.Write(contents)
+	return errgo.Mask(err)
+}
+
+// Verify reads the bundle in r, checking that its manifest is signed by pub
+// and that every file matches the manifest, and returns the manifest.
+func Verify(r io.Reader, pub ed25519.PublicKey) (*Manifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	digests := map[string]string{}
+	sizes := map[string]int64{}
+	var manifest, sig []byte
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		switch hdr.Name {
+		case ManifestName:
+			manifest, err = ioutil.ReadAll(tr)
+		case SignatureName:
+			sig, err = ioutil.ReadAll(tr)
+		default:
+			h := sha256.New()
+			sizes[hdr.Name], err = io.Copy(h, tr)
+			digests[hdr.Name] = hex.EncodeToString(h.Sum(nil))
+		}
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	if manifest == nil || sig == nil {
+		return nil, errgo.New("bundle has no signed manifest")
+	}
+	if !ed25519.Verify(pub, manifest, sig) {
+		return nil, errgo.New("manifest signature is invalid")
+	}
+
+	var m Manifest
+	err = json.Unmarshal(manifest, &m)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if m.Version != manifestVersion {
+		return nil, errgo.Newf("unsupported manifest version %d", m.Version)
+	}
+	for _, f := range m.Files {
+		digest, ok := digests[f.Name]
+		if !ok {
+			return nil, errgo.Newf("file %q is missing", f.Name)
+		}
+		if digest != f.SHA256 || sizes[f.Name] != f.Size {
+			return nil, errgo.Newf("file %q does not match the manifest", f.Name)
+		}
+		delete(digests, f.Name)
+	}
+	for name := range digests {
+		return nil, errgo.Newf("file %q is not in the manifest", name)
+	}
+	return &m, nil
+}
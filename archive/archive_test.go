@@ -0,0 +1,83 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	stdtesting "testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/hockeypuck/testing"
+	"gopkg.in/hockeypuck/openpgp.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/storage/mock"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type ArchiveSuite struct {
+	storage *mock.Storage
+}
+
+var _ = gc.Suite(&ArchiveSuite{})
+
+func (s *ArchiveSuite) SetUpTest(c *gc.C) {
+	s.storage = mock.NewStorage(
+		mock.ModifiedSince(func(time.Time) ([]string, error) {
+			return []string{"accd0e320f1cb163a2aa9305257f384b1fc8ef01"}, nil
+		}),
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")).MustParse(), nil
+		}),
+	)
+}
+
+func (s *ArchiveSuite) TestExportVerify(c *gc.C) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, gc.IsNil)
+
+	var bundle bytes.Buffer
+	m, err := Export(&bundle, s.storage, priv, Origin("keys.example.com"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(m.Keys, gc.Equals, 1)
+	c.Assert(m.Files, gc.HasLen, 1)
+
+	verified, err := Verify(bytes.NewReader(bundle.Bytes()), pub)
+	c.Assert(err, gc.IsNil)
+	c.Assert(verified.Origin, gc.Equals, "keys.example.com")
+	c.Assert(verified.Files, gc.DeepEquals, m.Files)
+
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, gc.IsNil)
+	_, err = Verify(bytes.NewReader(bundle.Bytes()), otherPub)
+	c.Assert(err, gc.ErrorMatches, "manifest signature is invalid")
+
+	// Chained bundles record the digest of their predecessor.
+	var next bytes.Buffer
+	m2, err := Export(&next, s.storage, priv, Previous(m), Domain("Example.ORG"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(m2.Keys, gc.Equals, 0)
+	c.Assert(m2.Domain, gc.Equals, "example.org")
+	digest, err := m.Digest()
+	c.Assert(err, gc.IsNil)
+	c.Assert(m2.Previous, gc.Equals, digest)
+}
@@ -0,0 +1,229 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package audit compares the keys served by several HKP keyservers, to
+// verify that members of a pool are consistent with each other.
+package audit
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/crypto/openpgp/armor"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/hockeypuck/openpgp.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/cryptoprovider"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+)
+
+// Response is what a single keyserver returned for a fingerprint.
+type Response struct {
+	Server string
+	Err    error
+	Found  bool
+
+	// MD5 is the SKS digest of the key served, which does not depend on
+	// packet order.
+	MD5     string
+	Packets int
+
+	// Missing counts packets served by other keyservers but not this one.
+	Missing int
+
+	packets map[string]bool
+}
+
+// Result compares the responses for a single fingerprint.
+type Result struct {
+	Fingerprint string
+	Responses   []*Response
+}
+
+// Divergent returns whether the keyservers disagree about the key.
+func (r *Result) Divergent() bool {
+	var first *Response
+	for _, resp := range r.Responses {
+		if resp.Err != nil {
+			continue
+		}
+		if first == nil {
+			first = resp
+		} else if resp.Found != first.Found || resp.MD5 != first.MD5 {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Result) String() string {
+	var parts []string
+	for _, resp := range r.Responses {
+		switch {
+		case resp.Err != nil:
+			parts = append(parts, fmt.Sprintf("%s: error: %v", resp.Server, resp.Err))
+		case !resp.Found:
+			parts = append(parts, fmt.Sprintf("%s: not found", resp.Server))
+		default:
+			parts = append(parts, fmt.Sprintf("%s: md5=%s packets=%d missing=%d",
+				resp.Server, resp.MD5, resp.Packets, resp.Missing))
+		}
+	}
+	return fmt.Sprintf("%s: %s", r.Fingerprint, strings.Join(parts, "; "))
+}
+
+// Auditor fetches keys from several keyservers and compares them.
+type Auditor struct {
+	servers []string
+	client  *http.Client
+	crypto  cryptoprovider.Provider
+}
+
+type Option func(*Auditor)
+
+// Client sets the HTTP client used to query keyservers.
+func Client(client *http.Client) Option {
+	return func(a *Auditor) { a.client = client }
+}
+
+// CryptoProvider sets the provider of the hash function used to compare
+// packets. The default is cryptoprovider.Default.
+func CryptoProvider(cp cryptoprovider.Provider) Option {
+	return func(a *Auditor) { a.crypto = cp }
+}
+
+// NewAuditor returns an Auditor comparing the given keyservers, specified
+// as base URLs such as "https://keys.example.com".
+func NewAuditor(servers []string, options ...Option) *Auditor {
+	a := &Auditor{
+		servers: servers,
+		client:  http.DefaultClient,
+		crypto:  cryptoprovider.Default,
+	}
+	for _, option := range options {
+		option(a)
+	}
+	return a
+}
+
+// Audit compares the keys served for each fingerprint.
+func (a *Auditor) Audit(fingerprints []string) []*Result {
+	var results []*Result
+	for _, fp := range fingerprints {
+		results = append(results, a.AuditKey(fp))
+	}
+	return results
+}
+
+// AuditKey compares the key served by each keyserver for fingerprint.
+func (a *Auditor) AuditKey(fingerprint string) *Result {
+	result := &Result{Fingerprint: strings.ToLower(strings.TrimPrefix(fingerprint, "0x"))}
+	all := map[string]bool{}
+	for _, server := range a.servers {
+		resp := a.fetch(server, result.Fingerprint)
+		for k := range resp.packets {
+			all[k] = true
+		}
+		result.Responses = append(result.Responses, resp)
+	}
+	for _, resp := range result.Responses {
+		if resp.Err != nil {
+			continue
+		}
+		for k := range all {
+			if !resp.packets[k] {
+				resp.Missing++
+			}
+		}
+	}
+	return result
+}
+
+func (a *Auditor) fetch(server, fingerprint string) *Response {
+	resp := &Response{Server: server, packets: map[string]bool{}}
+	u := fmt.Sprintf("%s/pks/lookup?op=get&options=mr&search=%s",
+		strings.TrimSuffix(server, "/"), url.QueryEscape("0x"+fingerprint))
+	httpResp, err := a.client.Get(u)
+	if err != nil {
+		resp.Err = errgo.Mask(err)
+		return resp
+	}
+	defer httpResp.Body.Close()
+	switch httpResp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return resp
+	default:
+		resp.Err = errgo.Newf("HTTP %d", httpResp.StatusCode)
+		return resp
+	}
+
+	block, err := armor.Decode(httpResp.Body)
+	if err != nil {
+		resp.Err = errgo.Mask(err)
+		return resp
+	}
+	buf, err := ioutil.ReadAll(block.Body)
+	if err != nil {
+		resp.Err = errgo.Mask(err)
+		return resp
+	}
+	keys, err := readKeys(buf)
+	if err != nil {
+		resp.Err = errgo.Mask(err)
+		return resp
+	}
+	for _, key := range keys {
+		if key.RFingerprint != openpgp.Reverse(fingerprint) {
+			continue
+		}
+		resp.Found = true
+		resp.MD5 = key.MD5
+		for _, pkt := range storage.Packets(key) {
+			h, err := a.crypto.Hash(crypto.SHA256)
+			if err != nil {
+				resp.Err = errgo.Mask(err)
+				return resp
+			}
+			h.Write(pkt.Packet)
+			resp.packets[string(h.Sum(nil))] = true
+		}
+		resp.Packets = len(resp.packets)
+	}
+	return resp
+}
+
+func readKeys(buf []byte) ([]*openpgp.PrimaryKey, error) {
+	var result []*openpgp.PrimaryKey
+	for readKey := range openpgp.ReadKeys(bytes.NewReader(buf)) {
+		if readKey.Error != nil {
+			return nil, errgo.Mask(readKey.Error)
+		}
+		err := openpgp.DropDuplicates(readKey.PrimaryKey)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		result = append(result, readKey.PrimaryKey)
+	}
+	return result, nil
+}
@@ -0,0 +1,89 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package audit_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	stdtesting "testing"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/hockeypuck/testing"
+
+	"gopkg.in/hockeypuck/hkp.v1/audit"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type AuditSuite struct {
+	servers []*httptest.Server
+}
+
+var _ = gc.Suite(&AuditSuite{})
+
+const aliceFingerprint = "10fe8cf1b483f7525039aa2a361bc1f023e0dcca"
+
+func (s *AuditSuite) serve(name string) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if name == "" {
+			http.NotFound(w, r)
+			return
+		}
+		f := testing.MustInput(name)
+		defer f.Close()
+		io.Copy(w, f)
+	}))
+	s.servers = append(s.servers, srv)
+	return srv.URL
+}
+
+func (s *AuditSuite) TearDownTest(c *gc.C) {
+	for _, srv := range s.servers {
+		srv.Close()
+	}
+	s.servers = nil
+}
+
+func (s *AuditSuite) TestConsistent(c *gc.C) {
+	a := audit.NewAuditor([]string{s.serve("alice_signed.asc"), s.serve("alice_signed.asc")})
+	results := a.Audit([]string{aliceFingerprint})
+	c.Assert(results, gc.HasLen, 1)
+	c.Assert(results[0].Divergent(), gc.Equals, false, gc.Commentf("%v", results[0]))
+	for _, resp := range results[0].Responses {
+		c.Assert(resp.Err, gc.IsNil)
+		c.Assert(resp.Found, gc.Equals, true)
+		c.Assert(resp.Missing, gc.Equals, 0)
+	}
+}
+
+func (s *AuditSuite) TestDivergent(c *gc.C) {
+	a := audit.NewAuditor([]string{s.serve("alice_signed.asc"), s.serve("alice_unsigned.asc")})
+	result := a.AuditKey("0x" + aliceFingerprint)
+	c.Assert(result.Divergent(), gc.Equals, true)
+	c.Assert(result.Responses[0].Missing, gc.Equals, 0)
+	c.Assert(result.Responses[1].Missing > 0, gc.Equals, true)
+}
+
+func (s *AuditSuite) TestNotFound(c *gc.C) {
+	a := audit.NewAuditor([]string{s.serve("alice_signed.asc"), s.serve("")})
+	result := a.AuditKey(aliceFingerprint)
+	c.Assert(result.Divergent(), gc.Equals, true)
+	c.Assert(result.Responses[1].Found, gc.Equals, false)
+}
@@ -0,0 +1,76 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// Principals authenticates submitters bearing the given tokens in an
+// "Authorization: Bearer" header as the principals which they are mapped
+// to, by principal name. Authenticated principals may submit keys to a
+// mirror, and are held to their UploadQuotas, if configured.
+func Principals(tokens map[string]string) HandlerOption {
+	return func(h *Handler) error {
+		for name, token := range tokens {
+			if name == "" || token == "" {
+				return errgo.Newf("invalid principal %q", name)
+			}
+			h.principals = append(h.principals, principal{
+				name:  name,
+				token: sha256.Sum256([]byte(token)),
+			})
+		}
+		return nil
+	}
+}
+
+// principal is an authenticated submitter.
+type principal struct {
+	name  string
+	token [sha256.Size]byte
+}
+
+// bearerToken returns the SHA-256 digest of the bearer token in r, if any.
+func bearerToken(r *http.Request) ([sha256.Size]byte, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return [sha256.Size]byte{}, false
+	}
+	return sha256.Sum256([]byte(strings.TrimPrefix(auth, "Bearer "))), true
+}
+
+// principal returns the name of the principal authenticated by r, or the
+// empty string if none is.
+func (h *Handler) principal(r *http.Request) string {
+	sum, ok := bearerToken(r)
+	if !ok {
+		return ""
+	}
+	for _, p := range h.principals {
+		if subtle.ConstantTimeCompare(sum[:], p.token[:]) == 1 {
+			return p.name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,115 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/hockeypuck/openpgp.v1"
+)
+
+// CacheControl enables conditional lookups. Keys served by get, hget, index
+// and vindex are given an ETag computed from their digests, and a
+// Last-Modified time from when their keyrings were last updated, so that
+// clients and caches revalidating with If-None-Match or If-Modified-Since
+// receive 304 Not Modified rather than the keys rendered again. The
+// Cache-Control header of each operation's responses is set from policies,
+// such as "public, max-age=3600" for OperationGet.
+//
+// Last-Modified is not available for lookups limited by SearchBudget, which
+// fetch keys without their keyring records.
+func CacheControl(policies map[Operation]string) HandlerOption {
+	return func(h *Handler) error {
+		h.cacheControl = map[Operation]string{}
+		for op, policy := range policies {
+			h.cacheControl[op] = policy
+		}
+		return nil
+	}
+}
+
+// lookupETag returns the ETag of the response to l serving keys. It covers
+// the digests of keys and the parts of l which change how they are
+// rendered.
+func lookupETag(l *Lookup, keys []*openpgp.PrimaryKey) string {
+	var opts []string
+	for opt, ok := range l.Options {
+		if ok {
+			opts = append(opts, string(opt))
+		}
+	}
+	sort.Strings(opts)
+
+	hash := sha256.New()
+	hash.Write([]byte(string(l.Op) + "\n" + strings.Join(opts, ",") + "\n" + l.Lang + "\n"))
+	for _, key := range keys {
+		hash.Write([]byte(key.SHA256 + key.MD5 + "\n"))
+	}
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+}
+
+// notModified sets the caching headers of the response to l serving keys,
+// and responds with 304 Not Modified if the client's cached copy is still
+// current. It returns whether it has done so.
+func (h *Handler) notModified(w http.ResponseWriter, l *Lookup, keys []*openpgp.PrimaryKey) bool {
+	if h.cacheControl == nil {
+		return false
+	}
+	etag := lookupETag(l, keys)
+	w.Header().Set("ETag", etag)
+	if !l.modified.IsZero() {
+		w.Header().Set("Last-Modified", l.modified.UTC().Format(http.TimeFormat))
+	}
+	if policy, ok := h.cacheControl[l.Op]; ok {
+		w.Header().Set("Cache-Control", policy)
+	}
+
+	if inm := l.header.Get("If-None-Match"); inm != "" {
+		// If-None-Match takes precedence over If-Modified-Since.
+		if !etagMatch(inm, etag) {
+			return false
+		}
+	} else if ims := l.header.Get("If-Modified-Since"); ims != "" && !l.modified.IsZero() {
+		t, err := http.ParseTime(ims)
+		if err != nil || l.modified.Truncate(time.Second).After(t) {
+			return false
+		}
+	} else {
+		return false
+	}
+	w.Header().Del("Content-Type")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatch returns whether the If-None-Match header value inm matches etag,
+// by weak comparison.
+func etagMatch(inm, etag string) bool {
+	for _, candidate := range strings.Split(inm, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
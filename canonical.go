@@ -0,0 +1,100 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"bytes"
+	"sort"
+
+	"gopkg.in/hockeypuck/openpgp.v1"
+)
+
+// CanonicalKey returns a copy of key with its user IDs, user attributes,
+// subkeys, signatures and unparsed packets in a canonical order, so that
+// serializing it yields the same bytes regardless of the order in which
+// packets were received and stored. Packet contents are not modified.
+func CanonicalKey(key *openpgp.PrimaryKey) *openpgp.PrimaryKey {
+	result := *key
+	result.PublicKey = canonicalPublicKey(&key.PublicKey)
+
+	result.UserIDs = make([]*openpgp.UserID, len(key.UserIDs))
+	for i, uid := range key.UserIDs {
+		c := *uid
+		c.Signatures = canonicalSignatures(uid.Signatures)
+		c.Others = canonicalPackets(uid.Others)
+		result.UserIDs[i] = &c
+	}
+	sort.SliceStable(result.UserIDs, func(i, j int) bool {
+		return bytes.Compare(result.UserIDs[i].Packet.Packet, result.UserIDs[j].Packet.Packet) < 0
+	})
+
+	result.UserAttributes = make([]*openpgp.UserAttribute, len(key.UserAttributes))
+	for i, uat := range key.UserAttributes {
+		c := *uat
+		c.Signatures = canonicalSignatures(uat.Signatures)
+		c.Others = canonicalPackets(uat.Others)
+		result.UserAttributes[i] = &c
+	}
+	sort.SliceStable(result.UserAttributes, func(i, j int) bool {
+		return bytes.Compare(result.UserAttributes[i].Packet.Packet, result.UserAttributes[j].Packet.Packet) < 0
+	})
+
+	result.SubKeys = make([]*openpgp.SubKey, len(key.SubKeys))
+	for i, subKey := range key.SubKeys {
+		result.SubKeys[i] = &openpgp.SubKey{PublicKey: canonicalPublicKey(&subKey.PublicKey)}
+	}
+	sort.SliceStable(result.SubKeys, func(i, j int) bool {
+		return bytes.Compare(result.SubKeys[i].Packet.Packet, result.SubKeys[j].Packet.Packet) < 0
+	})
+	return &result
+}
+
+// CanonicalKeys returns canonical copies of keys, ordered by fingerprint.
+func CanonicalKeys(keys []*openpgp.PrimaryKey) []*openpgp.PrimaryKey {
+	result := make([]*openpgp.PrimaryKey, len(keys))
+	for i, key := range keys {
+		result[i] = CanonicalKey(key)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].RFingerprint < result[j].RFingerprint
+	})
+	return result
+}
+
+func canonicalPublicKey(pk *openpgp.PublicKey) openpgp.PublicKey {
+	result := *pk
+	result.Signatures = canonicalSignatures(pk.Signatures)
+	result.Others = canonicalPackets(pk.Others)
+	return result
+}
+
+func canonicalSignatures(sigs []*openpgp.Signature) []*openpgp.Signature {
+	result := append([]*openpgp.Signature(nil), sigs...)
+	sort.SliceStable(result, func(i, j int) bool {
+		return bytes.Compare(result[i].Packet.Packet, result[j].Packet.Packet) < 0
+	})
+	return result
+}
+
+func canonicalPackets(pkts []*openpgp.Packet) []*openpgp.Packet {
+	result := append([]*openpgp.Packet(nil), pkts...)
+	sort.SliceStable(result, func(i, j int) bool {
+		return bytes.Compare(result[i].Packet, result[j].Packet) < 0
+	})
+	return result
+}
@@ -0,0 +1,58 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"bytes"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/hockeypuck/testing"
+	"gopkg.in/hockeypuck/openpgp.v1"
+)
+
+type CanonicalSuite struct{}
+
+var _ = gc.Suite(&CanonicalSuite{})
+
+func mustWritePackets(c *gc.C, key *openpgp.PrimaryKey) []byte {
+	var buf bytes.Buffer
+	err := openpgp.WritePackets(&buf, key)
+	c.Assert(err, gc.IsNil)
+	return buf.Bytes()
+}
+
+func (s *CanonicalSuite) TestSignatureOrder(c *gc.C) {
+	key1 := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")).MustParse()[0]
+	key2 := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")).MustParse()[0]
+	c.Assert(len(key2.UserIDs[0].Signatures) > 1, gc.Equals, true)
+
+	// Reverse the order of the user ID signatures in one copy.
+	sigs := key2.UserIDs[0].Signatures
+	for i, j := 0, len(sigs)-1; i < j; i, j = i+1, j-1 {
+		sigs[i], sigs[j] = sigs[j], sigs[i]
+	}
+	c.Assert(mustWritePackets(c, key1), gc.Not(gc.DeepEquals), mustWritePackets(c, key2))
+
+	canon1 := mustWritePackets(c, CanonicalKey(key1))
+	c.Assert(canon1, gc.DeepEquals, mustWritePackets(c, CanonicalKey(key2)))
+	c.Assert(canon1, gc.DeepEquals, mustWritePackets(c, CanonicalKey(CanonicalKey(key1))))
+
+	// The original key is not modified.
+	c.Assert(key2.UserIDs[0].Signatures[0], gc.Equals, sigs[0])
+}
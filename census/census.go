@@ -0,0 +1,197 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package census periodically computes aggregate statistics about the keys in
+// storage, such as the distribution of algorithms, key sizes and creation
+// years, and publishes them over HTTP.
+package census
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/tomb.v2"
+
+	"gopkg.in/hockeypuck/hkp.v1/privacy"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+	log "gopkg.in/hockeypuck/logrus.v0"
+	"gopkg.in/hockeypuck/openpgp.v1"
+)
+
+// DefaultInterval is how often a Job takes a census by default.
+const DefaultInterval = 24 * time.Hour
+
+// Census is an aggregate description of the keys in storage.
+type Census struct {
+	Keys    int `json:"keys"`
+	SubKeys int `json:"subKeys"`
+
+	// Algorithms counts primary keys by algorithm name.
+	Algorithms map[string]int `json:"algorithms"`
+	// KeySizes counts primary keys by algorithm and size, such as
+	// "RSA/4096".
+	KeySizes map[string]int `json:"keySizes"`
+	// CreationYears counts primary keys by the year they were created.
+	CreationYears map[int]int `json:"creationYears"`
+
+	// Started and Finished are when the census was taken.
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+// New returns an empty census.
+func New() *Census {
+	return &Census{
+		Algorithms:    map[string]int{},
+		KeySizes:      map[string]int{},
+		CreationYears: map[int]int{},
+	}
+}
+
+// Add counts key in the census.
+func (c *Census) Add(key *openpgp.PrimaryKey) {
+	c.Keys++
+	c.SubKeys += len(key.SubKeys)
+	name := openpgp.AlgorithmName(key.Algorithm)
+	c.Algorithms[name]++
+	c.KeySizes[fmt.Sprintf("%s/%d", name, key.BitLen)]++
+	if !key.Creation.IsZero() {
+		c.CreationYears[key.Creation.UTC().Year()]++
+	}
+}
+
+// Take takes a census of all keys in st.
+func Take(st storage.Queryer) (*Census, error) {
+	c := New()
+	c.Started = time.Now().UTC()
+	err := storage.ForEachKey(st, c.Add)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	c.Finished = time.Now().UTC()
+	return c, nil
+}
+
+// Job periodically takes a census of storage, and serves the latest one
+// over HTTP.
+type Job struct {
+	storage  storage.Queryer
+	interval time.Duration
+	noise    *privacy.Noise
+
+	mu     sync.Mutex
+	latest *Census
+
+	t tomb.Tomb
+}
+
+// NewJob returns a Job taking a census of st.
+func NewJob(st storage.Queryer) *Job {
+	return &Job{
+		storage:  st,
+		interval: DefaultInterval,
+	}
+}
+
+// SetInterval sets how often a census is taken once started.
+func (j *Job) SetInterval(d time.Duration) {
+	j.interval = d
+}
+
+// SetNoise perturbs the counts in each census taken with noise, so that
+// published censuses do not reveal individual keys.
+func (j *Job) SetNoise(noise *privacy.Noise) {
+	j.noise = noise
+}
+
+// AddNoise perturbs the counts in the census with noise.
+func (c *Census) AddNoise(noise *privacy.Noise) {
+	c.Keys = noise.Count(c.Keys)
+	c.SubKeys = noise.Count(c.SubKeys)
+	noise.Counts(c.Algorithms)
+	noise.Counts(c.KeySizes)
+	for year, n := range c.CreationYears {
+		c.CreationYears[year] = noise.Count(n)
+	}
+}
+
+// Run takes a census now, replacing the latest one if it succeeds.
+func (j *Job) Run() error {
+	c, err := Take(j.storage)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	log.Infof("census of %d keys took %v", c.Keys, c.Finished.Sub(c.Started))
+	c.AddNoise(j.noise)
+	j.mu.Lock()
+	j.latest = c
+	j.mu.Unlock()
+	return nil
+}
+
+// Latest returns the latest census, or nil if none has been taken yet.
+func (j *Job) Latest() *Census {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.latest
+}
+
+// Start takes a census in the background immediately and then periodically
+// until Stop is called.
+func (j *Job) Start() {
+	j.t.Go(j.run)
+}
+
+func (j *Job) run() error {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for {
+		err := j.Run()
+		if err != nil {
+			log.Errorf("census failed: %v", err)
+		}
+		select {
+		case <-j.t.Dying():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop stops taking a census.
+func (j *Job) Stop() {
+	j.t.Kill(nil)
+	j.t.Wait()
+}
+
+// ServeHTTP responds with the latest census as JSON, or 503 Service
+// Unavailable if none has been taken yet.
+func (j *Job) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c := j.Latest()
+	if c == nil {
+		http.Error(w, "census not yet available", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Last-Modified", c.Finished.Format(http.TimeFormat))
+	enc := json.NewEncoder(w)
+	enc.Encode(c)
+}
@@ -0,0 +1,66 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package census
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	stdtesting "testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/hockeypuck/testing"
+	"gopkg.in/hockeypuck/openpgp.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/storage/mock"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type CensusSuite struct{}
+
+var _ = gc.Suite(&CensusSuite{})
+
+func (s *CensusSuite) TestJob(c *gc.C) {
+	st := mock.NewStorage(
+		mock.ModifiedSince(func(time.Time) ([]string, error) {
+			return []string{"accd0e320f1cb163a2aa9305257f384b1fc8ef01"}, nil
+		}),
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")).MustParse(), nil
+		}),
+	)
+	job := NewJob(st)
+
+	w := httptest.NewRecorder()
+	job.ServeHTTP(w, httptest.NewRequest("GET", "/pks/census", nil))
+	c.Assert(w.Code, gc.Equals, http.StatusServiceUnavailable)
+
+	c.Assert(job.Run(), gc.IsNil)
+	w = httptest.NewRecorder()
+	job.ServeHTTP(w, httptest.NewRequest("GET", "/pks/census", nil))
+	c.Assert(w.Code, gc.Equals, http.StatusOK)
+	var census Census
+	c.Assert(json.NewDecoder(w.Body).Decode(&census), gc.IsNil)
+	c.Assert(census.Keys, gc.Equals, 1)
+	c.Assert(census.Algorithms, gc.HasLen, 1)
+	c.Assert(census.KeySizes, gc.HasLen, 1)
+	c.Assert(census.CreationYears, gc.HasLen, 1)
+}
@@ -0,0 +1,226 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package clock provides the time to code which measures, schedules or
+// retains things by it, so that embedders and tests can control time.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and makes timers.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After returns a channel which receives the time once d has elapsed.
+	After(d time.Duration) <-chan time.Time
+
+	// NewTimer returns a Timer which fires once d has elapsed.
+	NewTimer(d time.Duration) Timer
+
+	// NewTicker returns a Ticker which fires every d, which must be
+	// positive.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is like a time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker is like a time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real is the system clock.
+var Real Clock = realClock{}
+
+// Since returns the time elapsed on c since t.
+func Since(c Clock, t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTimer(d time.Duration) Timer         { return realTimer{time.NewTimer(d)} }
+func (realClock) NewTicker(d time.Duration) Ticker       { return realTicker{time.NewTicker(d)} }
+
+type realTimer struct{ *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+
+type realTicker struct{ *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// Fake is a clock which only moves when it is advanced, for tests. Its
+// timers and tickers fire during Advance, in order, each seeing Now as the
+// time it was due.
+type Fake struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters map[*fakeTimer]bool
+}
+
+var _ Clock = (*Fake)(nil)
+
+// NewFake returns a Fake clock set to now.
+func NewFake(now time.Time) *Fake {
+	f := &Fake{now: now, waiters: map[*fakeTimer]bool{}}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+// Now implements Clock.
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// After implements Clock.
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	return f.NewTimer(d).C()
+}
+
+// NewTimer implements Clock.
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{clock: f, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// NewTicker implements Clock.
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	t := &fakeTimer{clock: f, c: make(chan time.Time, 1), period: d}
+	t.Reset(d)
+	return fakeTicker{t}
+}
+
+// Advance moves the clock forward by d, firing the timers and tickers due
+// by then.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	end := f.now.Add(d)
+	for {
+		due := f.due(end)
+		if len(due) == 0 {
+			break
+		}
+		t := due[0]
+		f.now = t.at
+		t.fire()
+	}
+	f.now = end
+}
+
+// due returns the timers due by end, earliest first. f.mu must be held.
+func (f *Fake) due(end time.Time) []*fakeTimer {
+	var result []*fakeTimer
+	for t := range f.waiters {
+		if !t.at.After(end) {
+			result = append(result, t)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].at.Before(result[j].at) })
+	return result
+}
+
+// Waiters returns the number of timers and tickers which have yet to fire
+// or be stopped.
+func (f *Fake) Waiters() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.waiters)
+}
+
+// BlockUntil waits until there are at least n timers and tickers which have
+// yet to fire or be stopped, such as to know that goroutines under test are
+// waiting for the clock to be advanced.
+func (f *Fake) BlockUntil(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.waiters) < n {
+		f.cond.Wait()
+	}
+}
+
+type fakeTimer struct {
+	clock  *Fake
+	c      chan time.Time
+	at     time.Time
+	period time.Duration
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+// fire sends the time on the timer's channel, dropping it if the last one
+// has not been received, as time.Timer does. t.clock.mu must be held.
+func (t *fakeTimer) fire() {
+	select {
+	case t.c <- t.at:
+	default:
+	}
+	if t.period > 0 {
+		t.at = t.at.Add(t.period)
+	} else {
+		delete(t.clock.waiters, t)
+	}
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.clock.waiters[t]
+	delete(t.clock.waiters, t)
+	return active
+}
+
+type fakeTicker struct{ *fakeTimer }
+
+func (t fakeTicker) Stop() { t.fakeTimer.Stop() }
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	f := t.clock
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	active := f.waiters[t]
+	t.at = f.now.Add(d)
+	if d <= 0 && t.period == 0 {
+		delete(f.waiters, t)
+		t.fire()
+		return active
+	}
+	f.waiters[t] = true
+	f.cond.Broadcast()
+	return active
+}
@@ -0,0 +1,109 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package clock
+
+import (
+	"testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type ClockSuite struct{}
+
+var _ = gc.Suite(&ClockSuite{})
+
+var epoch = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func received(ch <-chan time.Time) (time.Time, bool) {
+	select {
+	case t := <-ch:
+		return t, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func (s *ClockSuite) TestTimer(c *gc.C) {
+	f := NewFake(epoch)
+	timer := f.NewTimer(time.Minute)
+	c.Assert(f.Waiters(), gc.Equals, 1)
+
+	f.Advance(59 * time.Second)
+	_, ok := received(timer.C())
+	c.Assert(ok, gc.Equals, false)
+
+	f.Advance(2 * time.Second)
+	t, ok := received(timer.C())
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(t, gc.Equals, epoch.Add(time.Minute))
+	c.Assert(f.Now(), gc.Equals, epoch.Add(61*time.Second))
+	c.Assert(f.Waiters(), gc.Equals, 0)
+
+	c.Assert(timer.Reset(time.Second), gc.Equals, false)
+	c.Assert(timer.Stop(), gc.Equals, true)
+	f.Advance(time.Hour)
+	_, ok = received(timer.C())
+	c.Assert(ok, gc.Equals, false)
+
+	_, ok = received(f.After(0))
+	c.Assert(ok, gc.Equals, true)
+}
+
+func (s *ClockSuite) TestTicker(c *gc.C) {
+	f := NewFake(epoch)
+	ticker := f.NewTicker(time.Hour)
+	var fired []time.Time
+	for i := 0; i < 3; i++ {
+		f.Advance(time.Hour)
+		t, ok := received(ticker.C())
+		c.Assert(ok, gc.Equals, true)
+		fired = append(fired, t)
+	}
+	c.Assert(fired, gc.DeepEquals, []time.Time{
+		epoch.Add(time.Hour), epoch.Add(2 * time.Hour), epoch.Add(3 * time.Hour)})
+
+	// Ticks are dropped if they are not received, as with time.Ticker.
+	f.Advance(5 * time.Hour)
+	t, ok := received(ticker.C())
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(t, gc.Equals, epoch.Add(4*time.Hour))
+	_, ok = received(ticker.C())
+	c.Assert(ok, gc.Equals, false)
+
+	ticker.Stop()
+	c.Assert(f.Waiters(), gc.Equals, 0)
+}
+
+func (s *ClockSuite) TestBlockUntil(c *gc.C) {
+	f := NewFake(epoch)
+	done := make(chan time.Time)
+	go func() {
+		done <- <-f.After(time.Minute)
+	}()
+	f.BlockUntil(1)
+	f.Advance(time.Minute)
+	select {
+	case t := <-done:
+		c.Assert(t, gc.Equals, epoch.Add(time.Minute))
+	case <-time.After(5 * time.Second):
+		c.Fatal("timer did not fire")
+	}
+}
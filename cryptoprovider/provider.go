@@ -0,0 +1,91 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package cryptoprovider abstracts the cryptographic primitives used by the
+// keyserver, so that deployments requiring FIPS-validated modules can
+// restrict them to approved algorithms.
+//
+// OpenPGP signature verification is performed by
+// gopkg.in/hockeypuck/openpgp.v1 with the standard library crypto packages,
+// which a BoringCrypto build replaces with the validated module. MD5 is only
+// used for SKS key digests, which identify keys in the recon protocol and are
+// not relied upon for security, so it is not provided here.
+package cryptoprovider
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"hash"
+
+	"gopkg.in/errgo.v1"
+)
+
+// Provider supplies cryptographic primitives.
+type Provider interface {
+	// Hash returns a new hash.Hash computing h.
+	Hash(h crypto.Hash) (hash.Hash, error)
+	// AEAD returns an authenticated cipher using key.
+	AEAD(key []byte) (cipher.AEAD, error)
+}
+
+// Standard provides primitives from the Go standard library.
+type Standard struct{}
+
+func (Standard) Hash(h crypto.Hash) (hash.Hash, error) {
+	if !h.Available() {
+		return nil, errgo.Newf("hash function #%d is not available", h)
+	}
+	return h.New(), nil
+}
+
+// AEAD returns AES-GCM using key, which must be 128, 192 or 256 bits.
+func (Standard) AEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return aead, nil
+}
+
+// FIPSHashes are the hash functions approved by FIPS 180-4.
+var FIPSHashes = []crypto.Hash{crypto.SHA224, crypto.SHA256, crypto.SHA384, crypto.SHA512}
+
+// Restricted limits the hash functions of a Provider to those given.
+type Restricted struct {
+	Provider
+	Hashes []crypto.Hash
+}
+
+func (r Restricted) Hash(h crypto.Hash) (hash.Hash, error) {
+	for _, allowed := range r.Hashes {
+		if h == allowed {
+			return r.Provider.Hash(h)
+		}
+	}
+	return nil, errgo.Newf("hash function #%d is not allowed", h)
+}
+
+// Default is the Provider used unless another is configured. In BoringCrypto
+// builds running in FIPS mode, it is restricted to FIPSHashes.
+var Default Provider = Standard{}
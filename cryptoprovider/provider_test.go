@@ -0,0 +1,56 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package cryptoprovider
+
+import (
+	"crypto"
+	"encoding/hex"
+	"testing"
+
+	gc "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type ProviderSuite struct{}
+
+var _ = gc.Suite(&ProviderSuite{})
+
+func (s *ProviderSuite) TestStandard(c *gc.C) {
+	h, err := Standard{}.Hash(crypto.SHA256)
+	c.Assert(err, gc.IsNil)
+	h.Write([]byte("abc"))
+	c.Assert(hex.EncodeToString(h.Sum(nil)), gc.Equals,
+		"ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad")
+
+	aead, err := Standard{}.AEAD(make([]byte, 32))
+	c.Assert(err, gc.IsNil)
+	c.Assert(aead.NonceSize(), gc.Equals, 12)
+	_, err = Standard{}.AEAD(make([]byte, 7))
+	c.Assert(err, gc.NotNil)
+}
+
+func (s *ProviderSuite) TestRestricted(c *gc.C) {
+	p := Restricted{Provider: Standard{}, Hashes: FIPSHashes}
+	_, err := p.Hash(crypto.SHA512)
+	c.Assert(err, gc.IsNil)
+	_, err = p.Hash(crypto.MD5)
+	c.Assert(err, gc.ErrorMatches, "hash function #2 is not allowed")
+	_, err = p.AEAD(make([]byte, 16))
+	c.Assert(err, gc.IsNil)
+}
@@ -0,0 +1,130 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package diskspace monitors free disk space, so that a server can stop
+// writing before a full disk corrupts its databases.
+package diskspace
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/tomb.v2"
+
+	log "gopkg.in/hockeypuck/logrus.v0"
+)
+
+// ErrLowDiskSpace is the cause of errors returned by Monitor.ReadOnly while
+// free disk space is below the threshold.
+var ErrLowDiskSpace = errors.New("low disk space")
+
+// DefaultInterval is how often a Monitor checks free space by default.
+const DefaultInterval = time.Minute
+
+// Monitor periodically checks the free space on the filesystems containing
+// a set of paths, such as the prefix tree and storage directories, and
+// reports when any falls below a threshold.
+type Monitor struct {
+	paths    []string
+	minFree  uint64
+	interval time.Duration
+
+	mu  sync.Mutex
+	err error
+
+	t tomb.Tomb
+}
+
+// NewMonitor returns a Monitor which enters read-only mode when fewer than
+// minFree bytes are available on the filesystem of any of paths.
+func NewMonitor(minFree uint64, paths ...string) *Monitor {
+	return &Monitor{
+		paths:    paths,
+		minFree:  minFree,
+		interval: DefaultInterval,
+	}
+}
+
+// SetInterval sets how often free space is checked once started.
+func (m *Monitor) SetInterval(d time.Duration) {
+	m.interval = d
+}
+
+// Check checks free space now, updating the read-only state.
+func (m *Monitor) Check() {
+	var lowErr error
+	for _, path := range m.paths {
+		free, err := FreeSpace(path)
+		if err != nil {
+			// Failing to measure free space should not stop the
+			// server from writing.
+			log.Warningf("cannot check free space on %q: %v", path, err)
+			continue
+		}
+		if free < m.minFree {
+			lowErr = errgo.WithCausef(nil, ErrLowDiskSpace,
+				"%d bytes free on %q, below the minimum of %d; writes are disabled", free, path, m.minFree)
+			break
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if lowErr != nil && m.err == nil {
+		log.Errorf("entering read-only mode: %v", lowErr)
+	} else if lowErr == nil && m.err != nil {
+		log.Infof("disk space recovered, leaving read-only mode")
+	}
+	m.err = lowErr
+}
+
+// ReadOnly returns an error with cause ErrLowDiskSpace if writes should be
+// refused because disk space is low, or nil otherwise. It is suitable for
+// use as a write guard.
+func (m *Monitor) ReadOnly() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// Start checks free space immediately and then periodically until Stop is
+// called.
+func (m *Monitor) Start() {
+	m.Check()
+	m.t.Go(m.run)
+}
+
+func (m *Monitor) run() error {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.t.Dying():
+			return nil
+		case <-ticker.C:
+			m.Check()
+		}
+	}
+}
+
+// Stop stops checking free space.
+func (m *Monitor) Stop() {
+	m.t.Kill(nil)
+	m.t.Wait()
+}
@@ -0,0 +1,50 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package diskspace
+
+import (
+	"math"
+	"testing"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type DiskSpaceSuite struct{}
+
+var _ = gc.Suite(&DiskSpaceSuite{})
+
+func (s *DiskSpaceSuite) TestFreeSpace(c *gc.C) {
+	free, err := FreeSpace(c.MkDir())
+	c.Assert(err, gc.IsNil)
+	c.Assert(free > 0, gc.Equals, true)
+}
+
+func (s *DiskSpaceSuite) TestMonitor(c *gc.C) {
+	dir := c.MkDir()
+	m := NewMonitor(0, dir)
+	m.Check()
+	c.Assert(m.ReadOnly(), gc.IsNil)
+
+	m = NewMonitor(math.MaxUint64, dir)
+	m.Start()
+	defer m.Stop()
+	c.Assert(errgo.Cause(m.ReadOnly()), gc.Equals, ErrLowDiskSpace)
+}
@@ -0,0 +1,184 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/privacy"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+	"gopkg.in/hockeypuck/openpgp.v1"
+)
+
+// DomainStats summarizes the keys with user IDs at an email domain.
+type DomainStats struct {
+	Domain string `json:"domain"`
+	Keys   int    `json:"keys"`
+
+	// Fresh counts keys which are neither expired nor revoked.
+	Fresh   int `json:"fresh"`
+	Expired int `json:"expired"`
+	Revoked int `json:"revoked"`
+
+	// Algorithms counts keys by primary key algorithm and size, such as
+	// "RSA/4096".
+	Algorithms map[string]int `json:"algorithms"`
+
+	// Updated is when the statistics were computed.
+	Updated time.Time `json:"updated"`
+}
+
+// domainStatsCache periodically computes statistics for every domain by
+// scanning all keys in storage, and limits how often each client may query
+// them.
+type domainStatsCache struct {
+	ttl     time.Duration
+	clients *intervalLimiter
+
+	mu      sync.Mutex
+	updated time.Time
+	domains map[string]*DomainStats
+}
+
+// DomainStatistics serves per-domain key statistics at /pks/domainstats.
+// Statistics are computed by scanning all keys at most once every ttl, and
+// each client may query them at most once every perClient.
+func DomainStatistics(ttl, perClient time.Duration) HandlerOption {
+	return func(h *Handler) error {
+		h.domainStats = &domainStatsCache{
+			ttl:     ttl,
+			clients: newIntervalLimiter(perClient),
+		}
+		return nil
+	}
+}
+
+// get returns the statistics for domain, rescanning storage if the cached
+// statistics are older than the TTL. Noise is added once per scan, so that
+// repeated queries cannot average it away.
+func (c *domainStatsCache) get(st storage.Storage, domain string, noise *privacy.Noise) (*DomainStats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.domains == nil || time.Since(c.updated) >= c.ttl {
+		domains, err := scanDomainStats(st)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		for _, ds := range domains {
+			ds.addNoise(noise)
+		}
+		c.domains, c.updated = domains, time.Now()
+	}
+	ds, ok := c.domains[domain]
+	if !ok {
+		ds = &DomainStats{Domain: domain, Algorithms: map[string]int{}, Updated: c.updated}
+		if noise != nil {
+			// Absent domains are perturbed too, and remembered,
+			// so that they are indistinguishable from rare ones.
+			ds.addNoise(noise)
+			c.domains[domain] = ds
+		}
+	}
+	return ds, nil
+}
+
+func (ds *DomainStats) addNoise(noise *privacy.Noise) {
+	ds.Keys = noise.Count(ds.Keys)
+	ds.Fresh = noise.Count(ds.Fresh)
+	ds.Expired = noise.Count(ds.Expired)
+	ds.Revoked = noise.Count(ds.Revoked)
+	noise.Counts(ds.Algorithms)
+}
+
+func scanDomainStats(st storage.Storage) (map[string]*DomainStats, error) {
+	now := time.Now()
+	result := map[string]*DomainStats{}
+	err := storage.ForEachKey(st, func(key *openpgp.PrimaryKey) {
+		addDomainStats(result, key, now)
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return result, nil
+}
+
+// addDomainStats counts key once for each distinct domain among its user
+// IDs.
+func addDomainStats(result map[string]*DomainStats, key *openpgp.PrimaryKey, now time.Time) {
+	domains := map[string]bool{}
+	for _, uid := range key.UserIDs {
+		if domain := storage.EmailDomain(uid.Keywords); domain != "" {
+			domains[domain] = true
+		}
+	}
+	if len(domains) == 0 {
+		return
+	}
+
+	selfsigs := key.SelfSigs()
+	_, revoked := selfsigs.RevokedSince()
+	expiresAt, expires := selfsigs.ExpiresAt()
+	algorithm := fmt.Sprintf("%s/%d", openpgp.AlgorithmName(key.Algorithm), key.BitLen)
+	for domain := range domains {
+		ds, ok := result[domain]
+		if !ok {
+			ds = &DomainStats{Domain: domain, Algorithms: map[string]int{}, Updated: now}
+			result[domain] = ds
+		}
+		ds.Keys++
+		switch {
+		case revoked:
+			ds.Revoked++
+		case expires && !expiresAt.IsZero() && expiresAt.Before(now):
+			ds.Expired++
+		default:
+			ds.Fresh++
+		}
+		ds.Algorithms[algorithm]++
+	}
+}
+
+// DomainStats responds with the key statistics for the domain given by the
+// domain parameter.
+func (h *Handler) DomainStats(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	domain := strings.ToLower(strings.TrimSpace(r.FormValue("domain")))
+	if domain == "" {
+		httpError(w, http.StatusBadRequest, errgo.New("missing required parameter: domain"))
+		return
+	}
+	if ok, _ := h.domainStats.clients.allow(h.ClientIP(r).String(), time.Now()); !ok {
+		httpError(w, http.StatusTooManyRequests, errgo.New("too many requests"))
+		return
+	}
+	ds, err := h.domainStats.get(h.storage, domain, h.statsNoise)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, errgo.Mask(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(ds)
+}
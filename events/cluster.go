@@ -0,0 +1,142 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	log "gopkg.in/hockeypuck/logrus.v0"
+	"gopkg.in/tomb.v2"
+
+	"gopkg.in/hockeypuck/hkp.v1/clock"
+)
+
+// Transport carries events between the nodes of a cluster, such as a
+// message bus or stream.
+type Transport interface {
+	// Send publishes an encoded event to every node, including this one.
+	Send(ctx context.Context, msg []byte) error
+
+	// Receive returns the next encoded event sent by any node, blocking
+	// until one is available or ctx is done.
+	Receive(ctx context.Context) ([]byte, error)
+
+	// Close releases the transport's connections.
+	Close() error
+}
+
+// clusterRetryInterval is how long a cluster waits to receive events again
+// after its transport fails.
+var clusterRetryInterval = 5 * time.Second
+
+// clusterMessage is an event sent between cluster nodes.
+type clusterMessage struct {
+	Node  string `json:"node"`
+	Event Event  `json:"event"`
+}
+
+// Cluster shares key changes between several frontends sharing one storage
+// backend. Storage notifies each node only of the changes it makes itself,
+// so a Cluster forwards these to the other nodes over a Transport, and
+// publishes theirs on the local bus. Subscribers of the bus, such as the
+// recon peer's prefix tree, key caches and statistics, so see every change
+// made to storage.
+type Cluster struct {
+	node      string
+	bus       *Bus
+	transport Transport
+	clock     clock.Clock
+
+	t tomb.Tomb
+}
+
+// NewCluster returns a Cluster sharing the changes published on bus with
+// the other nodes connected to transport. Each node must be given a unique
+// name.
+func NewCluster(node string, bus *Bus, transport Transport) *Cluster {
+	c := &Cluster{node: node, bus: bus, transport: transport, clock: clock.Real}
+	bus.Subscribe("cluster", SubscriberFunc(c.send), OnOverflow(Block))
+	return c
+}
+
+// send forwards the events of changes made by this node to the others.
+func (c *Cluster) send(ev Event) error {
+	if ev.Origin != "" {
+		return nil
+	}
+	buf, err := json.Marshal(&clusterMessage{Node: c.node, Event: ev})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(c.transport.Send(context.Background(), buf))
+}
+
+// SetClock sets the clock by which c waits to retry receiving changes after
+// the transport fails. It must be called before Start.
+func (c *Cluster) SetClock(clk clock.Clock) {
+	c.clock = clk
+}
+
+// Start receives the changes made by other nodes.
+func (c *Cluster) Start() {
+	c.t.Go(c.receive)
+}
+
+// Stop stops receiving changes and closes the transport.
+func (c *Cluster) Stop() error {
+	c.t.Kill(nil)
+	err := c.t.Wait()
+	if cerr := c.transport.Close(); cerr != nil && err == nil {
+		err = errgo.Mask(cerr)
+	}
+	return err
+}
+
+func (c *Cluster) receive() error {
+	ctx := c.t.Context(nil)
+	for {
+		buf, err := c.transport.Receive(ctx)
+		if ctx.Err() != nil {
+			return nil
+		} else if err != nil {
+			log.Warningf("cannot receive cluster event: %v", errgo.Details(err))
+			select {
+			case <-c.t.Dying():
+				return nil
+			case <-c.clock.After(clusterRetryInterval):
+			}
+			continue
+		}
+		var msg clusterMessage
+		err = json.Unmarshal(buf, &msg)
+		if err != nil {
+			log.Warningf("invalid cluster event: %v", err)
+			continue
+		}
+		if msg.Node == c.node || msg.Node == "" {
+			continue
+		}
+		err = c.bus.PublishFrom(msg.Node, msg.Event.KeyChange())
+		if err != nil {
+			log.Errorf("cannot publish event %d from node %q: %v", msg.Event.Seq, msg.Node, errgo.Details(err))
+		}
+	}
+}
@@ -0,0 +1,345 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package events distributes the key changes notified by storage to several
+// subscribers, such as the recon peer, webhooks, metrics and an audit log,
+// each with its own buffer so that a slow subscriber cannot hold up key
+// insertion.
+package events
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	log "gopkg.in/hockeypuck/logrus.v0"
+
+	"gopkg.in/hockeypuck/hkp.v1/clock"
+	"gopkg.in/hockeypuck/hkp.v1/metrics"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+)
+
+// Types of events.
+const (
+	TypeAdded     = "added"
+	TypeReplaced  = "replaced"
+	TypeRemoved   = "removed"
+	TypeUnchanged = "unchanged"
+	TypeOther     = "other"
+)
+
+// Event is a key change notified by storage.
+type Event struct {
+	// Seq numbers the events published by a bus, starting at 1.
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+
+	// Origin is the cluster node which made the change, or empty if it
+	// was made by this one.
+	Origin string `json:"origin,omitempty"`
+
+	// Insert and Remove are the digests of the keys added to and removed
+	// from storage.
+	Insert []string `json:"insert,omitempty"`
+	Remove []string `json:"remove,omitempty"`
+
+	Change storage.KeyChange `json:"-"`
+}
+
+// NewEvent returns an event describing change, without a sequence number,
+// made now.
+func NewEvent(change storage.KeyChange) Event {
+	return NewEventAt(change, time.Now())
+}
+
+// NewEventAt returns an event describing change, without a sequence
+// number, made at t.
+func NewEventAt(change storage.KeyChange, t time.Time) Event {
+	return Event{
+		Time:   t.UTC(),
+		Type:   changeType(change),
+		Insert: change.InsertDigests(),
+		Remove: change.RemoveDigests(),
+		Change: change,
+	}
+}
+
+// KeyChange returns the key change described by the event, such as one
+// decoded from another process.
+func (ev *Event) KeyChange() storage.KeyChange {
+	switch {
+	case ev.Type == TypeAdded && len(ev.Insert) == 1:
+		return storage.KeyAdded{Digest: ev.Insert[0]}
+	case ev.Type == TypeReplaced && len(ev.Insert) == 1 && len(ev.Remove) == 1:
+		return storage.KeyReplaced{OldDigest: ev.Remove[0], NewDigest: ev.Insert[0]}
+	case ev.Type == TypeRemoved && len(ev.Remove) == 1:
+		return storage.KeyRemoved{Digest: ev.Remove[0]}
+	case ev.Type == TypeUnchanged:
+		return storage.KeyNotChanged{}
+	}
+	return digestsChanged{insert: ev.Insert, remove: ev.Remove}
+}
+
+// digestsChanged is a key change of another type, known only by its
+// digests.
+type digestsChanged struct {
+	insert, remove []string
+}
+
+func (dc digestsChanged) InsertDigests() []string { return dc.insert }
+func (dc digestsChanged) RemoveDigests() []string { return dc.remove }
+
+func changeType(change storage.KeyChange) string {
+	switch change.(type) {
+	case storage.KeyAdded:
+		return TypeAdded
+	case storage.KeyReplaced:
+		return TypeReplaced
+	case storage.KeyRemoved:
+		return TypeRemoved
+	case storage.KeyNotChanged:
+		return TypeUnchanged
+	}
+	return TypeOther
+}
+
+// Subscriber handles the events published by a bus.
+type Subscriber interface {
+	HandleEvent(ev Event) error
+}
+
+// SubscriberFunc adapts a function to a Subscriber.
+type SubscriberFunc func(ev Event) error
+
+func (f SubscriberFunc) HandleEvent(ev Event) error {
+	return f(ev)
+}
+
+// KeyChangeFunc adapts a storage.Notifier callback, such as the recon
+// peer's, to a Subscriber.
+func KeyChangeFunc(f func(storage.KeyChange) error) Subscriber {
+	return SubscriberFunc(func(ev Event) error {
+		return f(ev.Change)
+	})
+}
+
+// Overflow decides what happens to events published to a subscriber whose
+// buffer is full.
+type Overflow int
+
+const (
+	// Drop discards the event, so that publishing is never held up.
+	Drop Overflow = iota
+	// Block waits for the subscriber to make room, holding up publishing
+	// and so key insertion, for subscribers which must see every event.
+	Block
+)
+
+// DefaultBuffer is the number of events buffered for a subscriber by
+// default.
+const DefaultBuffer = 1000
+
+type subscription struct {
+	name     string
+	sub      Subscriber
+	sync     bool
+	overflow Overflow
+	queue    chan Event
+	done     chan struct{}
+}
+
+// SubscribeOption configures how events are delivered to a subscriber.
+type SubscribeOption func(*subscription)
+
+// Buffer sets the number of events buffered for the subscriber. The
+// default is DefaultBuffer.
+func Buffer(n int) SubscribeOption {
+	return func(s *subscription) { s.queue = make(chan Event, n) }
+}
+
+// OnOverflow sets what happens to events when the subscriber's buffer is
+// full. The default is Drop.
+func OnOverflow(o Overflow) SubscribeOption {
+	return func(s *subscription) { s.overflow = o }
+}
+
+// Synchronous delivers events to the subscriber as they are published,
+// rather than from its buffer, and fails publishing if it returns an error.
+func Synchronous() SubscribeOption {
+	return func(s *subscription) { s.sync = true }
+}
+
+// Bus publishes key changes to subscribers. Each subscriber receives events
+// in order from its own buffer, so that a slow or failing subscriber delays
+// only itself.
+type Bus struct {
+	mu     sync.Mutex
+	seq    uint64
+	subs   []*subscription
+	closed bool
+	clock  clock.Clock
+}
+
+// NewBus returns a new event bus.
+func NewBus() *Bus {
+	return &Bus{clock: clock.Real}
+}
+
+// SetClock sets the clock by which events are timestamped.
+func (b *Bus) SetClock(c clock.Clock) {
+	b.mu.Lock()
+	b.clock = c
+	b.mu.Unlock()
+}
+
+// Attach publishes the key changes notified by st.
+func (b *Bus) Attach(st storage.Notifier) {
+	st.Subscribe(b.Publish)
+}
+
+// Subscribe delivers the events published from now on to sub. The name
+// identifies the subscriber in logs and metrics.
+func (b *Bus) Subscribe(name string, sub Subscriber, options ...SubscribeOption) {
+	s := &subscription{
+		name:  name,
+		sub:   sub,
+		queue: make(chan Event, DefaultBuffer),
+		done:  make(chan struct{}),
+	}
+	for _, option := range options {
+		option(s)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs = append(b.subs, s)
+	if s.sync {
+		close(s.done)
+	} else {
+		go s.run()
+	}
+}
+
+func (s *subscription) run() {
+	defer close(s.done)
+	for ev := range s.queue {
+		s.deliver(ev)
+	}
+}
+
+func (s *subscription) deliver(ev Event) error {
+	err := s.sub.HandleEvent(ev)
+	if err != nil {
+		log.Warningf("event subscriber %q failed to handle event %d: %v", s.name, ev.Seq, errgo.Details(err))
+		metrics.EventDelivered(s.name, metrics.ResultError)
+		return errgo.Notef(err, "event subscriber %q", s.name)
+	}
+	metrics.EventDelivered(s.name, metrics.ResultOK)
+	return nil
+}
+
+// Publish delivers change to every subscriber. It returns the first error
+// of a synchronous subscriber, if any; the errors of others are only
+// logged.
+func (b *Bus) Publish(change storage.KeyChange) error {
+	return b.PublishFrom("", change)
+}
+
+// PublishFrom delivers change made by the cluster node origin to every
+// subscriber, as Publish.
+func (b *Bus) PublishFrom(origin string, change storage.KeyChange) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errgo.New("event bus is closed")
+	}
+	b.seq++
+	ev := NewEventAt(change, b.clock.Now())
+	ev.Seq, ev.Origin = b.seq, origin
+	var result error
+	for _, s := range b.subs {
+		switch {
+		case s.sync:
+			err := s.deliver(ev)
+			if err != nil && result == nil {
+				result = err
+			}
+		case s.overflow == Block:
+			s.queue <- ev
+		default:
+			select {
+			case s.queue <- ev:
+			default:
+				log.Warningf("event subscriber %q is behind, dropped event %d", s.name, ev.Seq)
+				metrics.EventDelivered(s.name, metrics.ResultDropped)
+			}
+		}
+	}
+	return result
+}
+
+// Close stops publishing, and waits for subscribers to handle the events
+// already buffered.
+func (b *Bus) Close() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	subs := b.subs
+	b.mu.Unlock()
+	for _, s := range subs {
+		if !s.sync {
+			close(s.queue)
+		}
+		<-s.done
+	}
+}
+
+// Metrics records events as key changes from source, for changes made by
+// sources which do not record them themselves.
+func Metrics(source string) Subscriber {
+	return SubscriberFunc(func(ev Event) error {
+		metrics.KeyChanged(source, ev.Change)
+		return nil
+	})
+}
+
+// AuditLog writes events to an io.Writer as JSON, one per line.
+type AuditLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewAuditLog returns an AuditLog writing to w.
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{w: w}
+}
+
+func (a *AuditLog) HandleEvent(ev Event) error {
+	buf, err := json.Marshal(ev)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.w.Write(append(buf, '\n'))
+	return errgo.Mask(err)
+}
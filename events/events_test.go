@@ -0,0 +1,400 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package events
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/clock"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+	"gopkg.in/hockeypuck/hkp.v1/storage/mock"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type EventsSuite struct{}
+
+var _ = gc.Suite(&EventsSuite{})
+
+func (s *EventsSuite) TestPublish(c *gc.C) {
+	st := mock.NewStorage()
+	bus := NewBus()
+	bus.Attach(st)
+
+	var changes []storage.KeyChange
+	bus.Subscribe("recon", KeyChangeFunc(func(change storage.KeyChange) error {
+		changes = append(changes, change)
+		return nil
+	}), Synchronous())
+	var audit bytes.Buffer
+	bus.Subscribe("audit", NewAuditLog(&audit))
+
+	c.Assert(st.Notify(storage.KeyAdded{Digest: "decafbad"}), gc.IsNil)
+	c.Assert(st.Notify(storage.KeyReplaced{OldDigest: "decafbad", NewDigest: "deadbeef"}), gc.IsNil)
+	c.Assert(changes, gc.HasLen, 2)
+	bus.Close()
+
+	dec := json.NewDecoder(&audit)
+	var events []Event
+	for dec.More() {
+		var ev Event
+		c.Assert(dec.Decode(&ev), gc.IsNil)
+		ev.Time = ev.Time.UTC()
+		events = append(events, ev)
+	}
+	c.Assert(events, gc.HasLen, 2)
+	c.Assert(events[0].Seq, gc.Equals, uint64(1))
+	c.Assert(events[0].Type, gc.Equals, TypeAdded)
+	c.Assert(events[0].Insert, gc.DeepEquals, []string{"decafbad"})
+	c.Assert(events[1].Seq, gc.Equals, uint64(2))
+	c.Assert(events[1].Type, gc.Equals, TypeReplaced)
+	c.Assert(events[1].Remove, gc.DeepEquals, []string{"decafbad"})
+
+	c.Assert(bus.Publish(storage.KeyNotChanged{}), gc.ErrorMatches, "event bus is closed")
+}
+
+func (s *EventsSuite) TestSynchronousError(c *gc.C) {
+	bus := NewBus()
+	defer bus.Close()
+	var delivered int
+	bus.Subscribe("failing", SubscriberFunc(func(Event) error {
+		return errgo.New("prefix tree unavailable")
+	}), Synchronous())
+	bus.Subscribe("counting", SubscriberFunc(func(Event) error {
+		delivered++
+		return nil
+	}), Synchronous())
+	err := bus.Publish(storage.KeyAdded{Digest: "decafbad"})
+	c.Assert(err, gc.ErrorMatches, `event subscriber "failing": prefix tree unavailable`)
+	c.Assert(delivered, gc.Equals, 1)
+}
+
+func (s *EventsSuite) TestSlowSubscriber(c *gc.C) {
+	bus := NewBus()
+	started, release := make(chan bool), make(chan bool)
+	var seqs []uint64
+	bus.Subscribe("slow", SubscriberFunc(func(ev Event) error {
+		if ev.Seq == 1 {
+			started <- true
+			<-release
+		}
+		seqs = append(seqs, ev.Seq)
+		return nil
+	}), Buffer(1))
+
+	// Publishing is not held up by the slow subscriber; events beyond its
+	// buffer are dropped.
+	c.Assert(bus.Publish(storage.KeyAdded{Digest: "01"}), gc.IsNil)
+	<-started
+	c.Assert(bus.Publish(storage.KeyAdded{Digest: "02"}), gc.IsNil)
+	c.Assert(bus.Publish(storage.KeyAdded{Digest: "03"}), gc.IsNil)
+	close(release)
+	bus.Close()
+	c.Assert(seqs, gc.DeepEquals, []uint64{1, 2})
+}
+
+func (s *EventsSuite) TestBusClock(c *gc.C) {
+	now := time.Date(2026, 3, 10, 12, 30, 0, 0, time.UTC)
+	bus := NewBus()
+	bus.SetClock(clock.NewFake(now))
+	var received []Event
+	bus.Subscribe("sync", SubscriberFunc(func(ev Event) error {
+		received = append(received, ev)
+		return nil
+	}), Synchronous())
+	c.Assert(bus.Publish(storage.KeyAdded{Digest: "decafbad"}), gc.IsNil)
+	bus.Close()
+	c.Assert(received, gc.HasLen, 1)
+	c.Assert(received[0].Time, gc.Equals, now)
+}
+
+func (s *EventsSuite) TestWebhook(c *gc.C) {
+	received := make(chan Event, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev Event
+		c.Check(json.NewDecoder(r.Body).Decode(&ev), gc.IsNil)
+		received <- ev
+	}))
+	defer srv.Close()
+
+	bus := NewBus()
+	bus.Subscribe("webhook", &Webhook{URL: srv.URL})
+	c.Assert(bus.Publish(storage.KeyRemoved{Digest: "decafbad"}), gc.IsNil)
+	bus.Close()
+	ev := <-received
+	c.Assert(ev.Type, gc.Equals, TypeRemoved)
+	c.Assert(ev.Remove, gc.DeepEquals, []string{"decafbad"})
+
+	failing := httptest.NewServer(http.NotFoundHandler())
+	defer failing.Close()
+	err := (&Webhook{URL: failing.URL}).HandleEvent(ev)
+	c.Assert(err, gc.ErrorMatches, `webhook .* responded "404 Not Found"`)
+}
+
+func (s *EventsSuite) TestWebhookDelivery(c *gc.C) {
+	secret := []byte("s3cret")
+	var attempts int
+	var payloads []WebhookPayload
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		body, err := ioutil.ReadAll(r.Body)
+		c.Check(err, gc.IsNil)
+		c.Check(r.Header.Get(WebhookSignatureHeader), gc.Equals, WebhookSignature(secret, body))
+		c.Check(r.Header.Get(WebhookEventHeader), gc.Equals, TypeAdded)
+		c.Check(r.Header.Get(WebhookDeliveryHeader), gc.Equals, "1")
+		if attempts == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		var payload WebhookPayload
+		c.Check(json.Unmarshal(body, &payload), gc.IsNil)
+		payloads = append(payloads, payload)
+	}))
+	defer srv.Close()
+
+	st := mock.NewStorage(mock.MatchMD5(func([]string) ([]string, error) {
+		return []string{"10fe8cf1b483f7525039aa2a361bb4f5d1d8ba71"}, nil
+	}))
+	wh := &Webhook{
+		URL:        srv.URL,
+		Secret:     secret,
+		Types:      []string{TypeAdded, TypeReplaced},
+		Retries:    2,
+		RetryDelay: time.Millisecond,
+		Storage:    st,
+	}
+	c.Assert(wh.HandleEvent(Event{Seq: 1, Type: TypeAdded, Insert: []string{"decafbad"}}), gc.IsNil)
+	wh.Wait()
+	c.Assert(attempts, gc.Equals, 2)
+	c.Assert(payloads, gc.HasLen, 1)
+	c.Assert(payloads[0].Insert, gc.DeepEquals, []string{"decafbad"})
+	c.Assert(payloads[0].Fingerprints, gc.DeepEquals, []string{"17ab8d1d5f4bb163a2aa9305257f384b1fc8ef01"})
+
+	// Events of other types are not posted.
+	c.Assert(wh.HandleEvent(Event{Seq: 2, Type: TypeRemoved, Remove: []string{"decafbad"}}), gc.IsNil)
+	c.Assert(attempts, gc.Equals, 2)
+
+	// Client errors are not retried.
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		http.Error(w, "no", http.StatusBadRequest)
+	}))
+	defer rejecting.Close()
+	wh.URL = rejecting.URL
+	err := wh.HandleEvent(Event{Seq: 3, Type: TypeAdded})
+	c.Assert(err, gc.ErrorMatches, `webhook .* responded "400 Bad Request"`)
+	c.Assert(attempts, gc.Equals, 3)
+}
+
+func (s *EventsSuite) TestWebhookRetriesInBackground(c *gc.C) {
+	attempts := make(chan bool, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts <- true
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	clk := clock.NewFake(time.Now())
+	wh := &Webhook{URL: srv.URL, Retries: 1, Clock: clk}
+	// Delivery returns once the first attempt fails, without waiting to
+	// retry.
+	c.Assert(wh.HandleEvent(Event{Seq: 1, Type: TypeAdded}), gc.IsNil)
+	<-attempts
+	clk.BlockUntil(1)
+	clk.Advance(DefaultWebhookRetryDelay)
+	wh.Wait()
+	c.Assert(attempts, gc.HasLen, 1)
+}
+
+// memoryTransport delivers messages to every transport of a hub.
+type memoryTransport struct {
+	hub *[]*memoryTransport
+	ch  chan []byte
+}
+
+func newMemoryHub(n int) []*memoryTransport {
+	hub := &[]*memoryTransport{}
+	for i := 0; i < n; i++ {
+		*hub = append(*hub, &memoryTransport{hub: hub, ch: make(chan []byte, 10)})
+	}
+	return *hub
+}
+
+func (t *memoryTransport) Send(ctx context.Context, msg []byte) error {
+	for _, peer := range *t.hub {
+		peer.ch <- msg
+	}
+	return nil
+}
+
+func (t *memoryTransport) Receive(ctx context.Context) ([]byte, error) {
+	select {
+	case msg := <-t.ch:
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (t *memoryTransport) Close() error { return nil }
+
+func (s *EventsSuite) TestCluster(c *gc.C) {
+	transports := newMemoryHub(2)
+	received := make([]chan Event, 2)
+	var buses []*Bus
+	var clusters []*Cluster
+	for i, name := range []string{"alpha", "beta"} {
+		ch := make(chan Event, 10)
+		received[i] = ch
+		bus := NewBus()
+		bus.Subscribe("test", SubscriberFunc(func(ev Event) error {
+			ch <- ev
+			return nil
+		}))
+		cluster := NewCluster(name, bus, transports[i])
+		cluster.Start()
+		buses, clusters = append(buses, bus), append(clusters, cluster)
+	}
+
+	c.Assert(buses[0].Publish(storage.KeyReplaced{OldDigest: "decafbad", NewDigest: "deadbeef"}), gc.IsNil)
+	ev := <-received[0]
+	c.Assert(ev.Origin, gc.Equals, "")
+	ev = <-received[1]
+	c.Assert(ev.Origin, gc.Equals, "alpha")
+	c.Assert(ev.Change, gc.Equals, storage.KeyReplaced{OldDigest: "decafbad", NewDigest: "deadbeef"})
+
+	// Changes received from other nodes are not sent on again.
+	for i := range clusters {
+		c.Assert(clusters[i].Stop(), gc.IsNil)
+		buses[i].Close()
+	}
+	c.Assert(received[0], gc.HasLen, 0)
+	c.Assert(received[1], gc.HasLen, 0)
+}
+
+// fakeRedis serves the Redis stream commands used by RedisStream.
+type fakeRedis struct {
+	mu      sync.Mutex
+	entries [][2]string
+	l       net.Listener
+}
+
+func newFakeRedis(c *gc.C) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gc.IsNil)
+	f := &fakeRedis{l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		reply, err := readRedisReply(r)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range reply.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+		f.mu.Lock()
+		switch args[0] {
+		case "XADD":
+			id := fmt.Sprintf("%d-0", len(f.entries)+1)
+			f.entries = append(f.entries, [2]string{id, args[len(args)-1]})
+			fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(id), id)
+		case "XREVRANGE":
+			if len(f.entries) == 0 {
+				fmt.Fprintf(conn, "*0\r\n")
+			} else {
+				f.writeEntries(conn, f.entries[len(f.entries)-1:])
+			}
+		case "XREAD":
+			var after int
+			fmt.Sscanf(args[len(args)-1], "%d-0", &after)
+			if after >= len(f.entries) {
+				fmt.Fprintf(conn, "*-1\r\n")
+			} else {
+				fmt.Fprintf(conn, "*1\r\n*2\r\n$%d\r\n%s\r\n", len(args[6]), args[6])
+				f.writeEntries(conn, f.entries[after:])
+			}
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command\r\n")
+		}
+		f.mu.Unlock()
+	}
+}
+
+func (f *fakeRedis) writeEntries(w io.Writer, entries [][2]string) {
+	fmt.Fprintf(w, "*%d\r\n", len(entries))
+	for _, e := range entries {
+		fmt.Fprintf(w, "*2\r\n$%d\r\n%s\r\n*2\r\n$5\r\nevent\r\n$%d\r\n%s\r\n", len(e[0]), e[0], len(e[1]), e[1])
+	}
+}
+
+func (s *EventsSuite) TestRedisStream(c *gc.C) {
+	defer func(d time.Duration) { redisBlock = d }(redisBlock)
+	redisBlock = 10 * time.Millisecond
+	f := newFakeRedis(c)
+	defer f.l.Close()
+
+	sender := &RedisStream{Addr: f.l.Addr().String()}
+	defer sender.Close()
+	c.Assert(sender.Send(context.Background(), []byte("before")), gc.IsNil)
+
+	receiver := &RedisStream{Addr: f.l.Addr().String()}
+	defer receiver.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	_, err := receiver.Receive(ctx)
+	cancel()
+	c.Assert(errgo.Cause(err), gc.Equals, context.DeadlineExceeded)
+
+	// Only events sent once the receiver has started are received.
+	c.Assert(sender.Send(context.Background(), []byte(`{"node":"alpha"}`)), gc.IsNil)
+	c.Assert(sender.Send(context.Background(), []byte(`{"node":"beta"}`)), gc.IsNil)
+	for _, want := range []string{`{"node":"alpha"}`, `{"node":"beta"}`} {
+		msg, err := receiver.Receive(context.Background())
+		c.Assert(err, gc.IsNil)
+		c.Assert(string(msg), gc.Equals, want)
+	}
+}
@@ -0,0 +1,312 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package events
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+const (
+	// DefaultRedisStream is the key of the Redis stream used by default.
+	DefaultRedisStream = "hockeypuck:events"
+
+	// DefaultRedisMaxLen is the approximate number of events kept in the
+	// Redis stream by default.
+	DefaultRedisMaxLen = 100000
+)
+
+// redisBlock is how long a read of the stream waits for events before
+// checking whether the receiver has been cancelled.
+var redisBlock = time.Second
+
+// RedisStream is a Transport over a Redis stream, which every node of a
+// cluster appends its events to and reads the others' from.
+type RedisStream struct {
+	// Addr is the host:port of the Redis server.
+	Addr string
+	// Password authenticates to the server, if set.
+	Password string
+	// Stream is the key of the stream. If empty, DefaultRedisStream is
+	// used.
+	Stream string
+	// MaxLen caps the length of the stream, approximately. If zero,
+	// DefaultRedisMaxLen is used.
+	MaxLen int
+
+	sendMu sync.Mutex
+	sender *redisConn
+
+	// Reads of the stream block, so they are made on their own connection.
+	recvMu   sync.Mutex
+	receiver *redisConn
+	lastID   string
+	pending  [][]byte
+}
+
+var _ Transport = (*RedisStream)(nil)
+
+func (rs *RedisStream) stream() string {
+	if rs.Stream == "" {
+		return DefaultRedisStream
+	}
+	return rs.Stream
+}
+
+func (rs *RedisStream) Send(ctx context.Context, msg []byte) error {
+	rs.sendMu.Lock()
+	defer rs.sendMu.Unlock()
+	maxLen := rs.MaxLen
+	if maxLen == 0 {
+		maxLen = DefaultRedisMaxLen
+	}
+	var err error
+	if rs.sender == nil {
+		rs.sender, err = dialRedis(ctx, rs.Addr, rs.Password)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	_, err = rs.sender.do("XADD", rs.stream(), "MAXLEN", "~", strconv.Itoa(maxLen), "*", "event", string(msg))
+	if err != nil {
+		rs.sender.close()
+		rs.sender = nil
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+func (rs *RedisStream) Receive(ctx context.Context) ([]byte, error) {
+	rs.recvMu.Lock()
+	defer rs.recvMu.Unlock()
+	for len(rs.pending) == 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		err := rs.read(ctx)
+		if err != nil {
+			if rs.receiver != nil {
+				rs.receiver.close()
+				rs.receiver = nil
+			}
+			return nil, errgo.Mask(err)
+		}
+	}
+	msg := rs.pending[0]
+	rs.pending = rs.pending[1:]
+	return msg, nil
+}
+
+// read reads the events appended to the stream since the last read, waiting
+// up to redisBlock for some.
+func (rs *RedisStream) read(ctx context.Context) error {
+	var err error
+	if rs.receiver == nil {
+		rs.receiver, err = dialRedis(ctx, rs.Addr, rs.Password)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if rs.lastID == "" {
+		// Events appended before this node started are not replayed.
+		reply, err := rs.receiver.do("XREVRANGE", rs.stream(), "+", "-", "COUNT", "1")
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		rs.lastID = "0-0"
+		if entries, ok := reply.([]interface{}); ok && len(entries) > 0 {
+			id, _, err := redisEntry(entries[0])
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			rs.lastID = id
+		}
+	}
+	block := strconv.FormatInt(int64(redisBlock/time.Millisecond), 10)
+	reply, err := rs.receiver.do("XREAD", "COUNT", "100", "BLOCK", block, "STREAMS", rs.stream(), rs.lastID)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	streams, _ := reply.([]interface{})
+	for _, s := range streams {
+		stream, ok := s.([]interface{})
+		if !ok || len(stream) != 2 {
+			return errgo.Newf("unexpected XREAD reply %v", reply)
+		}
+		entries, _ := stream[1].([]interface{})
+		for _, entry := range entries {
+			id, fields, err := redisEntry(entry)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			rs.lastID = id
+			if msg, ok := fields["event"]; ok {
+				rs.pending = append(rs.pending, msg)
+			}
+		}
+	}
+	return nil
+}
+
+func (rs *RedisStream) Close() error {
+	rs.sendMu.Lock()
+	if rs.sender != nil {
+		rs.sender.close()
+		rs.sender = nil
+	}
+	rs.sendMu.Unlock()
+	rs.recvMu.Lock()
+	if rs.receiver != nil {
+		rs.receiver.close()
+		rs.receiver = nil
+	}
+	rs.recvMu.Unlock()
+	return nil
+}
+
+// redisEntry returns the ID and fields of a stream entry.
+func redisEntry(v interface{}) (string, map[string][]byte, error) {
+	entry, ok := v.([]interface{})
+	if !ok || len(entry) != 2 {
+		return "", nil, errgo.Newf("unexpected stream entry %v", v)
+	}
+	id, ok := entry[0].([]byte)
+	if !ok {
+		return "", nil, errgo.Newf("unexpected stream entry ID %v", entry[0])
+	}
+	values, _ := entry[1].([]interface{})
+	fields := map[string][]byte{}
+	for i := 0; i+1 < len(values); i += 2 {
+		k, _ := values[i].([]byte)
+		v, _ := values[i+1].([]byte)
+		fields[string(k)] = v
+	}
+	return string(id), fields, nil
+}
+
+// redisTimeout limits how long a Redis command may take, beyond any time
+// it blocks for.
+var redisTimeout = 10 * time.Second
+
+// redisConn is a connection to a Redis server speaking RESP.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// redisError is an error reply from a Redis server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func dialRedis(ctx context.Context, addr, password string) (*redisConn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if password != "" {
+		_, err = c.do("AUTH", password)
+		if err != nil {
+			c.close()
+			return nil, errgo.Mask(err)
+		}
+	}
+	return c, nil
+}
+
+// do sends a command and returns its reply: a string, an int64, a []byte,
+// a []interface{} of replies, or nil.
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout + redisBlock))
+	buf := []byte(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		buf = append(buf, fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)...)
+	}
+	_, err := c.conn.Write(buf)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	reply, err := readRedisReply(c.r)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return reply, nil
+}
+
+func (c *redisConn) close() {
+	c.conn.Close()
+}
+
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errgo.Newf("invalid reply %q", line)
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, redisError(line)
+	case ':':
+		n, err := strconv.ParseInt(line, 10, 64)
+		return n, errgo.Mask(err)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		} else if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		} else if n < 0 {
+			return nil, nil
+		}
+		result := make([]interface{}, n)
+		for i := range result {
+			result[i], err = readRedisReply(r)
+			if err != nil {
+				return nil, errgo.Mask(err, errgo.Any)
+			}
+		}
+		return result, nil
+	}
+	return nil, errgo.Newf("invalid reply %q", line)
+}
@@ -0,0 +1,240 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	log "gopkg.in/hockeypuck/logrus.v0"
+	"gopkg.in/hockeypuck/openpgp.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/clock"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+)
+
+// Headers of webhook requests.
+const (
+	// WebhookEventHeader is the type of the event posted.
+	WebhookEventHeader = "X-Hockeypuck-Event"
+	// WebhookDeliveryHeader is the sequence number of the event posted,
+	// the same for each attempt to deliver it.
+	WebhookDeliveryHeader = "X-Hockeypuck-Delivery"
+	// WebhookSignatureHeader is the HMAC-SHA256 of the request body with
+	// the webhook's secret, as "sha256=" and the hex digest.
+	WebhookSignatureHeader = "X-Hockeypuck-Signature"
+)
+
+const (
+	// DefaultWebhookRetryDelay is how long a webhook waits before retrying
+	// a failed delivery by default. The delay doubles with each retry.
+	DefaultWebhookRetryDelay = time.Second
+
+	// DefaultWebhookTimeout limits each webhook request, unless the
+	// webhook has its own Client.
+	DefaultWebhookTimeout = 10 * time.Second
+
+	// maxWebhookRetries is how many deliveries a webhook retries at once.
+	// Deliveries which fail while as many are being retried are dropped.
+	maxWebhookRetries = 100
+)
+
+// webhookClient makes webhook requests, unless the webhook has its own
+// Client.
+var webhookClient = &http.Client{Timeout: DefaultWebhookTimeout}
+
+// WebhookPayload is the JSON body posted by a Webhook.
+type WebhookPayload struct {
+	Event
+
+	// Fingerprints are the fingerprints of the keys inserted, if the
+	// webhook can look them up in storage.
+	Fingerprints []string `json:"fingerprints,omitempty"`
+}
+
+// Webhook posts events as JSON to a URL, so that downstream systems such as
+// monitors and caches can react to key changes as they happen. Subscribe a
+// Webhook for each URL to notify.
+type Webhook struct {
+	URL string
+	// Client is used to make requests. If nil, a client which times out
+	// after DefaultWebhookTimeout is used.
+	Client *http.Client
+
+	// Secret, if set, signs each request with WebhookSignatureHeader, so
+	// that the receiver can verify it was sent by this keyserver.
+	Secret []byte
+
+	// Types are the types of events posted, such as TypeAdded and
+	// TypeReplaced. If empty, events of every type are posted.
+	Types []string
+
+	// Retries is how many times a failed delivery is retried, waiting
+	// RetryDelay, or DefaultWebhookRetryDelay if zero, at first. Requests
+	// refused by the receiver with a client error are not retried.
+	// Deliveries are retried in the background, so that later events are
+	// not held up; their failures are logged.
+	Retries    int
+	RetryDelay time.Duration
+	// Clock times the delay between retries. If nil, clock.Real is used.
+	Clock clock.Clock
+
+	// Storage, if set, is used to look up the fingerprints of the keys
+	// inserted.
+	Storage storage.Queryer
+
+	mu       sync.Mutex
+	retrying int
+	wg       sync.WaitGroup
+}
+
+func (wh *Webhook) wants(ev Event) bool {
+	if len(wh.Types) == 0 {
+		return true
+	}
+	for _, t := range wh.Types {
+		if t == ev.Type {
+			return true
+		}
+	}
+	return false
+}
+
+func (wh *Webhook) HandleEvent(ev Event) error {
+	if !wh.wants(ev) {
+		return nil
+	}
+	payload := &WebhookPayload{Event: ev}
+	if wh.Storage != nil && len(ev.Insert) > 0 {
+		rfps, err := storage.MatchMD5Context(context.Background(), wh.Storage, ev.Insert)
+		if err != nil {
+			log.Warningf("cannot look up fingerprints for webhook %q: %v", wh.URL, err)
+		}
+		for _, rfp := range rfps {
+			payload.Fingerprints = append(payload.Fingerprints, openpgp.Reverse(rfp))
+		}
+	}
+	buf, err := json.Marshal(payload)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+
+	retry, err := wh.post(ev, buf)
+	if err == nil {
+		return nil
+	} else if !retry || wh.Retries <= 0 {
+		return errgo.Mask(err)
+	}
+
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	if wh.retrying >= maxWebhookRetries {
+		return errgo.Notef(err, "too many deliveries being retried")
+	}
+	wh.retrying++
+	wh.wg.Add(1)
+	go func() {
+		defer wh.wg.Done()
+		err := wh.retry(ev, buf, err)
+		if err != nil {
+			log.Warningf("webhook %q failed to deliver event %d: %v", wh.URL, ev.Seq, errgo.Details(err))
+		}
+		wh.mu.Lock()
+		wh.retrying--
+		wh.mu.Unlock()
+	}()
+	return nil
+}
+
+// retry retries the delivery of ev, which failed with err, until it
+// succeeds or fails Retries more times.
+func (wh *Webhook) retry(ev Event, body []byte, err error) error {
+	delay := wh.RetryDelay
+	if delay == 0 {
+		delay = DefaultWebhookRetryDelay
+	}
+	for attempt := 0; attempt < wh.Retries; attempt++ {
+		log.Debugf("retrying webhook %q in %v: %v", wh.URL, delay, err)
+		<-wh.clock().After(delay)
+		delay *= 2
+		var retry bool
+		retry, err = wh.post(ev, body)
+		if err == nil || !retry {
+			break
+		}
+	}
+	return errgo.Mask(err)
+}
+
+// Wait waits for the deliveries being retried to finish.
+func (wh *Webhook) Wait() {
+	wh.wg.Wait()
+}
+
+func (wh *Webhook) clock() clock.Clock {
+	if wh.Clock == nil {
+		return clock.Real
+	}
+	return wh.Clock
+}
+
+// post makes one attempt to deliver ev, returning whether it may be retried
+// if it fails.
+func (wh *Webhook) post(ev Event, body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, ev.Type)
+	req.Header.Set(WebhookDeliveryHeader, strconv.FormatUint(ev.Seq, 10))
+	if len(wh.Secret) > 0 {
+		req.Header.Set(WebhookSignatureHeader, WebhookSignature(wh.Secret, body))
+	}
+	client := wh.Client
+	if client == nil {
+		client = webhookClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, errgo.Mask(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, errgo.Newf("webhook %q responded %q", wh.URL, resp.Status)
+	}
+	return false, nil
+}
+
+// WebhookSignature returns the signature of a webhook request body with
+// secret, as sent in WebhookSignatureHeader.
+func WebhookSignature(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,446 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package forge imports the OpenPGP keys which members of GitHub
+// organizations or GitLab groups have published to their profiles, so that
+// an organization's keyserver can serve its developers' keys.
+package forge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/tomb.v2"
+
+	"gopkg.in/hockeypuck/hkp.v1/metrics"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+	log "gopkg.in/hockeypuck/logrus.v0"
+	"gopkg.in/hockeypuck/openpgp.v1"
+)
+
+const (
+	// DefaultGitHubURL and DefaultGitLabURL are the API base URLs of
+	// github.com and gitlab.com.
+	DefaultGitHubURL = "https://api.github.com"
+	DefaultGitLabURL = "https://gitlab.com/api/v4"
+
+	// DefaultInterval is how often an Importer imports keys by default.
+	DefaultInterval = 24 * time.Hour
+
+	// Source identifies key changes made by an Importer in metrics.
+	Source = "forge"
+)
+
+// perPage is the number of results requested per page from the forge APIs.
+const perPage = 100
+
+// Forge lists the members of organizations on a code hosting service, and
+// the armored OpenPGP keys they have published.
+type Forge interface {
+	// Name identifies the forge in logs, such as its API URL.
+	Name() string
+	// Members returns the members of org.
+	Members(ctx context.Context, org string) ([]string, error)
+	// Keys returns the armored keys published by member.
+	Keys(ctx context.Context, member string) ([]string, error)
+}
+
+type api struct {
+	url    string
+	client *http.Client
+	header http.Header
+}
+
+func newAPI(baseURL string, client *http.Client) api {
+	if client == nil {
+		client = &http.Client{Timeout: time.Minute}
+	}
+	return api{
+		url:    strings.TrimSuffix(baseURL, "/"),
+		client: client,
+		header: http.Header{},
+	}
+}
+
+// get decodes the JSON response to a GET request for path into v.
+func (a *api) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequest("GET", a.url+path, nil)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for k, vs := range a.header {
+		req.Header[k] = vs
+	}
+	resp, err := a.client.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return errgo.Mask(ctx.Err(), errgo.Any)
+		}
+		return errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errgo.Newf("%s%s responded %q", a.url, path, resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return errgo.Notef(err, "invalid response from %s%s", a.url, path)
+	}
+	return nil
+}
+
+// pages calls f with the path of each page of results for path, until it
+// returns fewer than perPage results.
+func (a *api) pages(ctx context.Context, path string, f func(path string) (int, error)) error {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	for page := 1; ; page++ {
+		n, err := f(fmt.Sprintf("%s%sper_page=%d&page=%d", path, sep, perPage, page))
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		if n < perPage {
+			return nil
+		}
+	}
+}
+
+// GitHub lists members of GitHub organizations and their GPG keys.
+type GitHub struct {
+	api
+}
+
+// NewGitHub returns a GitHub using the API at baseURL, such as
+// DefaultGitHubURL or that of a GitHub Enterprise server. The token is
+// required to list private organization members, and may be empty. If
+// client is nil, a client with a one minute timeout is used.
+func NewGitHub(baseURL, token string, client *http.Client) *GitHub {
+	g := &GitHub{newAPI(baseURL, client)}
+	g.header.Set("Accept", "application/vnd.github+json")
+	if token != "" {
+		g.header.Set("Authorization", "token "+token)
+	}
+	return g
+}
+
+func (g *GitHub) Name() string { return g.url }
+
+func (g *GitHub) Members(ctx context.Context, org string) ([]string, error) {
+	var members []string
+	err := g.pages(ctx, "/orgs/"+url.PathEscape(org)+"/members", func(path string) (int, error) {
+		var page []struct {
+			Login string `json:"login"`
+		}
+		err := g.get(ctx, path, &page)
+		if err != nil {
+			return 0, errgo.Mask(err, errgo.Any)
+		}
+		for _, m := range page {
+			members = append(members, m.Login)
+		}
+		return len(page), nil
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return members, nil
+}
+
+func (g *GitHub) Keys(ctx context.Context, member string) ([]string, error) {
+	var keys []string
+	err := g.pages(ctx, "/users/"+url.PathEscape(member)+"/gpg_keys", func(path string) (int, error) {
+		var page []struct {
+			RawKey string `json:"raw_key"`
+		}
+		err := g.get(ctx, path, &page)
+		if err != nil {
+			return 0, errgo.Mask(err, errgo.Any)
+		}
+		for _, k := range page {
+			if k.RawKey != "" {
+				keys = append(keys, k.RawKey)
+			}
+		}
+		return len(page), nil
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return keys, nil
+}
+
+// GitLab lists members of GitLab groups and their GPG keys. Members are
+// identified by their numeric user ID.
+type GitLab struct {
+	api
+}
+
+// NewGitLab returns a GitLab using the API at baseURL, such as
+// DefaultGitLabURL or that of a self-managed instance. The token is
+// required to list the members of private groups, and may be empty. If
+// client is nil, a client with a one minute timeout is used.
+func NewGitLab(baseURL, token string, client *http.Client) *GitLab {
+	g := &GitLab{newAPI(baseURL, client)}
+	if token != "" {
+		g.header.Set("Private-Token", token)
+	}
+	return g
+}
+
+func (g *GitLab) Name() string { return g.url }
+
+func (g *GitLab) Members(ctx context.Context, group string) ([]string, error) {
+	var members []string
+	err := g.pages(ctx, "/groups/"+url.PathEscape(group)+"/members/all", func(path string) (int, error) {
+		var page []struct {
+			ID int `json:"id"`
+		}
+		err := g.get(ctx, path, &page)
+		if err != nil {
+			return 0, errgo.Mask(err, errgo.Any)
+		}
+		for _, m := range page {
+			members = append(members, fmt.Sprint(m.ID))
+		}
+		return len(page), nil
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return members, nil
+}
+
+func (g *GitLab) Keys(ctx context.Context, member string) ([]string, error) {
+	var keys []string
+	err := g.pages(ctx, "/users/"+url.PathEscape(member)+"/gpg_keys", func(path string) (int, error) {
+		var page []struct {
+			Key string `json:"key"`
+		}
+		err := g.get(ctx, path, &page)
+		if err != nil {
+			return 0, errgo.Mask(err, errgo.Any)
+		}
+		for _, k := range page {
+			if k.Key != "" {
+				keys = append(keys, k.Key)
+			}
+		}
+		return len(page), nil
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return keys, nil
+}
+
+// Result summarizes an import.
+type Result struct {
+	Members int `json:"members"`
+
+	// Fetched counts the keys published by members.
+	Fetched   int `json:"fetched"`
+	Inserted  int `json:"inserted"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+
+	// Failed counts organizations and members whose keys could not be
+	// listed, and keys which could not be parsed.
+	Failed int `json:"failed"`
+
+	// Started and Finished are when the import ran.
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+func (r *Result) String() string {
+	return fmt.Sprintf("members=%d fetched=%d inserted=%d updated=%d unchanged=%d failed=%d",
+		r.Members, r.Fetched, r.Inserted, r.Updated, r.Unchanged, r.Failed)
+}
+
+// Importer periodically imports the keys published by the members of
+// organizations on a forge into storage.
+type Importer struct {
+	forge    Forge
+	storage  storage.Storage
+	orgs     []string
+	interval time.Duration
+
+	mu     sync.Mutex
+	latest *Result
+
+	t tomb.Tomb
+}
+
+// NewImporter returns an Importer of the keys of members of orgs on f into
+// st.
+func NewImporter(f Forge, st storage.Storage, orgs []string) *Importer {
+	return &Importer{
+		forge:    f,
+		storage:  st,
+		orgs:     orgs,
+		interval: DefaultInterval,
+	}
+}
+
+// SetInterval sets how often keys are imported once started.
+func (im *Importer) SetInterval(d time.Duration) {
+	im.interval = d
+}
+
+// Run imports keys now. Requests which fail and keys which cannot be parsed
+// are counted in the result; an error is returned only if storage fails or
+// ctx is done.
+func (im *Importer) Run(ctx context.Context) (*Result, error) {
+	result := &Result{Started: time.Now().UTC()}
+	seen := map[string]bool{}
+	for _, org := range im.orgs {
+		members, err := im.forge.Members(ctx, org)
+		if ctx.Err() != nil {
+			return nil, errgo.Mask(ctx.Err(), errgo.Any)
+		} else if err != nil {
+			log.Warningf("cannot list members of %q on %s: %v", org, im.forge.Name(), err)
+			result.Failed++
+			continue
+		}
+		for _, member := range members {
+			if seen[member] {
+				continue
+			}
+			seen[member] = true
+			result.Members++
+			err = im.importMember(ctx, result, member)
+			if err != nil {
+				return nil, errgo.Mask(err, errgo.Any)
+			}
+		}
+	}
+	result.Finished = time.Now().UTC()
+
+	log.Infof("import from %s: %v", im.forge.Name(), result)
+	im.mu.Lock()
+	im.latest = result
+	im.mu.Unlock()
+	return result, nil
+}
+
+func (im *Importer) importMember(ctx context.Context, result *Result, member string) error {
+	armored, err := im.forge.Keys(ctx, member)
+	if ctx.Err() != nil {
+		return errgo.Mask(ctx.Err(), errgo.Any)
+	} else if err != nil {
+		log.Warningf("cannot list keys of %q on %s: %v", member, im.forge.Name(), err)
+		result.Failed++
+		return nil
+	}
+	for _, text := range armored {
+		keys, err := readArmorKeys(text)
+		if err != nil {
+			log.Warningf("invalid key of %q on %s: %v", member, im.forge.Name(), err)
+			result.Failed++
+			continue
+		}
+		for _, key := range keys {
+			result.Fetched++
+			_, err := storage.DropDuplicates(key)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			change, err := storage.UpsertKeyContext(ctx, im.storage, key)
+			if err != nil {
+				metrics.StorageError("upsert")
+				return errgo.Mask(err, errgo.Any)
+			}
+			metrics.KeyChanged(Source, change)
+			switch change.(type) {
+			case storage.KeyAdded:
+				result.Inserted++
+			case storage.KeyReplaced:
+				result.Updated++
+			default:
+				result.Unchanged++
+			}
+		}
+	}
+	return nil
+}
+
+func readArmorKeys(text string) ([]*openpgp.PrimaryKey, error) {
+	readKeys, err := openpgp.ReadArmorKeys(strings.NewReader(text))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var keys []*openpgp.PrimaryKey
+	for readKey := range readKeys {
+		if readKey.Error != nil {
+			return nil, errgo.Mask(readKey.Error)
+		}
+		keys = append(keys, readKey.PrimaryKey)
+	}
+	return keys, nil
+}
+
+// Latest returns the result of the latest import, or nil if none has
+// completed yet.
+func (im *Importer) Latest() *Result {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	return im.latest
+}
+
+// Start imports keys in the background immediately and then periodically
+// until Stop is called.
+func (im *Importer) Start() {
+	im.t.Go(im.run)
+}
+
+func (im *Importer) run() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-im.t.Dying()
+		cancel()
+	}()
+
+	ticker := time.NewTicker(im.interval)
+	defer ticker.Stop()
+	for {
+		_, err := im.Run(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Errorf("import from %s failed: %v", im.forge.Name(), err)
+		}
+		select {
+		case <-im.t.Dying():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop stops importing keys.
+func (im *Importer) Stop() {
+	im.t.Kill(nil)
+	im.t.Wait()
+}
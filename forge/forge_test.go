@@ -0,0 +1,117 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package forge
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	stdtesting "testing"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/hockeypuck/testing"
+	"gopkg.in/hockeypuck/openpgp.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+	"gopkg.in/hockeypuck/hkp.v1/storage/mock"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type ForgeSuite struct{}
+
+var _ = gc.Suite(&ForgeSuite{})
+
+func aliceKey(c *gc.C) string {
+	armored, err := ioutil.ReadAll(testing.MustInput("alice_signed.asc"))
+	c.Assert(err, gc.IsNil)
+	return string(armored)
+}
+
+func newStorage() *mock.Storage {
+	return mock.NewStorage(mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+		return nil, storage.ErrKeyNotFound
+	}))
+}
+
+func (s *ForgeSuite) TestGitHub(c *gc.C) {
+	alice := aliceKey(c)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/orgs/acme/members", func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Header.Get("Authorization"), gc.Equals, "token secret")
+		c.Check(r.URL.Query().Get("page"), gc.Equals, "1")
+		json.NewEncoder(w).Encode([]map[string]string{{"login": "alice"}})
+	})
+	mux.HandleFunc("/users/alice/gpg_keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]map[string]interface{}{
+			{"raw_key": alice},
+			{"raw_key": nil},
+		})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	st := newStorage()
+	im := NewImporter(NewGitHub(srv.URL, "secret", nil), st, []string{"acme", "acme", "missing"})
+	c.Assert(im.Latest(), gc.IsNil)
+	result, err := im.Run(context.Background())
+	c.Assert(err, gc.IsNil)
+	c.Assert(result.Members, gc.Equals, 1)
+	c.Assert(result.Fetched, gc.Equals, 1)
+	c.Assert(result.Inserted, gc.Equals, 1)
+	c.Assert(result.Failed, gc.Equals, 1)
+	c.Assert(im.Latest(), gc.Equals, result)
+	c.Assert(st.MethodCount("Insert"), gc.Equals, 1)
+}
+
+func (s *ForgeSuite) TestGitLab(c *gc.C) {
+	alice := aliceKey(c)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/groups/", func(w http.ResponseWriter, r *http.Request) {
+		// Group paths are escaped into a single path segment.
+		c.Check(r.URL.EscapedPath(), gc.Equals, "/groups/acme%2Fdev/members/all")
+		c.Check(r.Header.Get("Private-Token"), gc.Equals, "secret")
+		json.NewEncoder(w).Encode([]map[string]interface{}{{"id": 42, "username": "alice"}})
+	})
+	mux.HandleFunc("/users/42/gpg_keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]map[string]interface{}{{"id": 1, "key": alice}})
+	})
+	mux.HandleFunc("/users/43/gpg_keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]map[string]interface{}{{"id": 2, "key": "not a key"}})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	gl := NewGitLab(srv.URL+"/", "secret", nil)
+	members, err := gl.Members(context.Background(), "acme/dev")
+	c.Assert(err, gc.IsNil)
+	c.Assert(members, gc.DeepEquals, []string{"42"})
+
+	st := newStorage()
+	result, err := NewImporter(gl, st, []string{"acme/dev"}).Run(context.Background())
+	c.Assert(err, gc.IsNil)
+	c.Assert(result.Members, gc.Equals, 1)
+	c.Assert(result.Inserted, gc.Equals, 1)
+
+	im := NewImporter(gl, st, nil)
+	c.Assert(im.importMember(context.Background(), result, "43"), gc.IsNil)
+	c.Assert(result.Failed, gc.Equals, 1)
+}
@@ -0,0 +1,206 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// firstHeaderValue returns the first of a comma-separated list of values in
+// header key, as appended by a chain of proxies.
+func firstHeaderValue(r *http.Request, key string) string {
+	v := r.Header.Get(key)
+	if i := strings.Index(v, ","); i >= 0 {
+		v = v[:i]
+	}
+	return strings.TrimSpace(v)
+}
+
+// BaseURL returns the public URL under which the HKP service is reached by
+// the client, taking into account X-Forwarded-Proto, X-Forwarded-Host and
+// X-Forwarded-Prefix headers set by a reverse proxy, and the handler's path
+// prefix.
+func BaseURL(r *http.Request, prefix string) *url.URL {
+	u := &url.URL{
+		Scheme: "http",
+		Host:   r.Host,
+		Path:   prefix,
+	}
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	if proto := firstHeaderValue(r, "X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		u.Scheme = proto
+	}
+	if host := firstHeaderValue(r, "X-Forwarded-Host"); host != "" {
+		u.Host = host
+	}
+	if fwdPrefix := firstHeaderValue(r, "X-Forwarded-Prefix"); fwdPrefix != "" {
+		u.Path = "/" + strings.Trim(fwdPrefix, "/") + prefix
+	}
+	return u
+}
+
+// normalizePathPrefix returns prefix with a leading slash and no trailing
+// slash, or the empty string for the root.
+func normalizePathPrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
+// TrustedProxies contains the network ranges of reverse proxies whose
+// forwarding headers are trusted.
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses CIDR ranges or single IP addresses of trusted
+// reverse proxies.
+func ParseTrustedProxies(cidrs []string) (TrustedProxies, error) {
+	nets, err := parseNetworks(cidrs)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid proxy address")
+	}
+	return TrustedProxies(nets), nil
+}
+
+// parseNetworks parses CIDR ranges or single IP addresses, which are taken
+// as networks containing only themselves.
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errgo.Newf("invalid address %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		result = append(result, ipnet)
+	}
+	return result, nil
+}
+
+// Trusted returns whether ip is a trusted proxy.
+func (tp TrustedProxies) Trusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range tp {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the IP address of the client which originated r. The
+// Forwarded or X-Forwarded-For headers are only consulted when the request
+// was received from a trusted proxy, and only as far back along the chain
+// of proxies as they remain trusted.
+func (tp TrustedProxies) ClientIP(r *http.Request) net.IP {
+	ip := remoteIP(r)
+	if !tp.Trusted(ip) {
+		return ip
+	}
+	hops := forwardedFor(r)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseNodeIP(hops[i])
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !tp.Trusted(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// BaseURL returns the public URL of the HKP service like the BaseURL
+// function, ignoring forwarding headers unless r was received from a trusted
+// proxy.
+func (tp TrustedProxies) BaseURL(r *http.Request, prefix string) *url.URL {
+	if !tp.Trusted(remoteIP(r)) {
+		return BaseURL(&http.Request{Host: r.Host, TLS: r.TLS, Header: http.Header{}}, prefix)
+	}
+	return BaseURL(r, prefix)
+}
+
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// forwardedFor returns the chain of client addresses recorded by proxies,
+// from the RFC 7239 Forwarded header if present, otherwise from
+// X-Forwarded-For. The originating client is first.
+func forwardedFor(r *http.Request) []string {
+	var result []string
+	if fwds := r.Header["Forwarded"]; len(fwds) > 0 {
+		for _, fwd := range fwds {
+			for _, elem := range strings.Split(fwd, ",") {
+				for _, pair := range strings.Split(elem, ";") {
+					pair = strings.TrimSpace(pair)
+					if len(pair) > 4 && strings.EqualFold(pair[:4], "for=") {
+						result = append(result, pair[4:])
+					}
+				}
+			}
+		}
+		return result
+	}
+	for _, xff := range r.Header["X-Forwarded-For"] {
+		for _, hop := range strings.Split(xff, ",") {
+			result = append(result, strings.TrimSpace(hop))
+		}
+	}
+	return result
+}
+
+// parseNodeIP parses the IP address from a forwarded node identifier, which
+// may be quoted and include a port, as in "[2001:db8::1]:4711".
+func parseNodeIP(node string) net.IP {
+	node = strings.Trim(node, `"`)
+	if strings.HasPrefix(node, "[") {
+		if i := strings.Index(node, "]"); i > 0 {
+			node = node[1:i]
+		}
+	} else if strings.Count(node, ":") == 1 {
+		node = node[:strings.Index(node, ":")]
+	}
+	return net.ParseIP(node)
+}
@@ -0,0 +1,165 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"container/list"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/hockeypuck/openpgp.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/sks"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+)
+
+// KeyUpdate describes when this server last received an update for a key,
+// and from which source: sks.SourceAdd if it was submitted to this server,
+// or sks.SourceRecon if it arrived otherwise, such as from a recon partner.
+type KeyUpdate struct {
+	Time   time.Time
+	Source string
+}
+
+// KeyFreshness remembers when the most recently updated keys, up to size,
+// were last updated and from which source, so that clients and monitors can
+// reason about propagation delay. Lookups serving keys report the most
+// recent update among them in the X-HKP-Key-Updated and X-HKP-Key-Source
+// headers, and JSON output reports the update of each key.
+//
+// Updates are remembered from when the server starts. For keys updated
+// before then, or forgotten since, X-HKP-Key-Updated is set from storage
+// where lookups fetch keyring records, as with CacheControl, and the source
+// is not reported.
+func KeyFreshness(size int) HandlerOption {
+	return func(h *Handler) error {
+		h.freshness = &freshness{
+			size:    size,
+			entries: map[string]*list.Element{},
+			order:   list.New(),
+		}
+		return nil
+	}
+}
+
+// freshness is a bounded record of key updates, by digest. The oldest
+// updates are forgotten first.
+type freshness struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type freshnessEntry struct {
+	digest string
+	update KeyUpdate
+}
+
+// record records an update of the key with digest. Updates already
+// recorded are only replaced if override is set, so that a key submitted
+// to this server is not later attributed to the notification of the same
+// change.
+func (f *freshness) record(digest string, update KeyUpdate, override bool) {
+	digest = strings.ToLower(digest)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if elem, ok := f.entries[digest]; ok {
+		if override {
+			elem.Value.(*freshnessEntry).update = update
+			f.order.MoveToBack(elem)
+		}
+		return
+	}
+	f.entries[digest] = f.order.PushBack(&freshnessEntry{digest: digest, update: update})
+	for f.order.Len() > f.size {
+		oldest := f.order.Front()
+		delete(f.entries, oldest.Value.(*freshnessEntry).digest)
+		f.order.Remove(oldest)
+	}
+}
+
+// added records the change made by a key submitted to this server.
+func (f *freshness) added(change storage.KeyChange) {
+	for _, digest := range change.InsertDigests() {
+		f.record(digest, KeyUpdate{Time: time.Now(), Source: sks.SourceAdd}, true)
+	}
+}
+
+// observe records a change notified by storage, which was not necessarily
+// made by this server.
+func (f *freshness) observe(change storage.KeyChange) error {
+	for _, digest := range change.InsertDigests() {
+		f.record(digest, KeyUpdate{Time: time.Now(), Source: sks.SourceRecon}, false)
+	}
+	return nil
+}
+
+// lookup returns the recorded update of key, if any.
+func (f *freshness) lookup(key *openpgp.PrimaryKey) (KeyUpdate, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	elem, ok := f.entries[strings.ToLower(key.MD5)]
+	if !ok {
+		return KeyUpdate{}, false
+	}
+	return elem.Value.(*freshnessEntry).update, true
+}
+
+// describe returns when key was last updated, in RFC 3339 format, and from
+// which source, if recorded.
+func (f *freshness) describe(key *openpgp.PrimaryKey) (string, string) {
+	update, ok := f.lookup(key)
+	if !ok {
+		return "", ""
+	}
+	return update.Time.UTC().Format(time.RFC3339), update.Source
+}
+
+// setKeyFreshness reports the most recent update among keys served in
+// response to l.
+func (h *Handler) setKeyFreshness(w http.ResponseWriter, l *Lookup, keys []*openpgp.PrimaryKey) {
+	if h.freshness == nil {
+		return
+	}
+	var latest KeyUpdate
+	var unrecorded bool
+	for _, key := range keys {
+		update, ok := h.freshness.lookup(key)
+		if !ok {
+			unrecorded = true
+		} else if update.Time.After(latest.Time) {
+			latest = update
+		}
+	}
+	if unrecorded && l.modified.After(latest.Time) {
+		// Updates are recorded by digest, so a recorded update is of the
+		// key as served. Otherwise, the keyring records are consulted.
+		latest = KeyUpdate{Time: l.modified}
+	}
+	if latest.Time.IsZero() {
+		return
+	}
+	w.Header().Set("X-HKP-Key-Updated", latest.Time.UTC().Format(http.TimeFormat))
+	if latest.Source != "" {
+		w.Header().Set("X-HKP-Key-Source", latest.Source)
+	}
+}
@@ -19,9 +19,12 @@ package hkp
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"path/filepath"
@@ -33,6 +36,15 @@ import (
 	"gopkg.in/errgo.v1"
 
 	"gopkg.in/hockeypuck/conflux.v2/recon"
+	"gopkg.in/hockeypuck/hkp.v1/census"
+	"gopkg.in/hockeypuck/hkp.v1/events"
+	"gopkg.in/hockeypuck/hkp.v1/maintenance"
+	"gopkg.in/hockeypuck/hkp.v1/metrics"
+	"gopkg.in/hockeypuck/hkp.v1/privacy"
+	"gopkg.in/hockeypuck/hkp.v1/proof"
+	"gopkg.in/hockeypuck/hkp.v1/search"
+	"gopkg.in/hockeypuck/hkp.v1/seed"
+	"gopkg.in/hockeypuck/hkp.v1/sigindex"
 	"gopkg.in/hockeypuck/hkp.v1/sks"
 	"gopkg.in/hockeypuck/hkp.v1/storage"
 	log "gopkg.in/hockeypuck/logrus.v0"
@@ -46,12 +58,24 @@ const (
 )
 
 func httpError(w http.ResponseWriter, statusCode int, err error) {
-	if statusCode != http.StatusNotFound {
+	if statusCode != http.StatusNotFound && statusCode != http.StatusTooManyRequests {
 		log.Errorf("HTTP %d: %v", statusCode, errgo.Details(err))
 	}
 	http.Error(w, http.StatusText(statusCode), statusCode)
 }
 
+// localizedError responds like httpError, with the status text translated
+// into lang.
+func (h *Handler) localizedError(w http.ResponseWriter, lang string, statusCode int, err error) {
+	if statusCode != http.StatusNotFound && statusCode != http.StatusTooManyRequests {
+		log.Errorf("HTTP %d: %v", statusCode, errgo.Details(err))
+	}
+	if lang != "" {
+		w.Header().Set("Content-Language", lang)
+	}
+	http.Error(w, h.localizer.Translate(lang, http.StatusText(statusCode)), statusCode)
+}
+
 type Handler struct {
 	storage storage.Storage
 
@@ -60,6 +84,67 @@ type Handler struct {
 
 	statsTemplate *template.Template
 	statsFunc     func() (interface{}, error)
+
+	localizer *Localizer
+
+	packetFunc    func(storage.PacketCounts)
+	changeFunc    func(storage.KeyChange)
+	rejectFunc    func(error)
+	policies      []PolicyFunc
+	limits        *storage.PacketLimits
+	stripUnhashed bool
+	writeGuard    func() error
+	mirror        *mirror
+	principals    []principal
+	quotas        *quotas
+	banner        func() string
+	parseMode     storage.ParseMode
+
+	armorHeaders map[string]string
+	canonical    bool
+
+	pathPrefix string
+	proxies    TrustedProxies
+	caps       *sks.Capabilities
+	metrics    bool
+	sshKeys    bool
+
+	domainStats *domainStatsCache
+	census      http.Handler
+	sigIndex    *sigindex.Index
+	statsNoise  *privacy.Noise
+
+	robots   []byte
+	crawlers []*crawlerThrottle
+
+	honeypots *honeypots
+	verifier  *verifier
+
+	wkdDomains map[string]bool
+	proofs     *proof.Checker
+
+	seed        *seed.Job
+	seedClients *intervalLimiter
+	rateLimits  map[string]*tokenBuckets
+
+	takedowns    *takedowns
+	deleted      *sks.Peer
+	healthChecks map[string]HealthCheck
+	horizons     []Horizon
+	searchBudget time.Duration
+	maxHashQuery int64
+	cacheControl map[Operation]string
+	keyCache     *keyCache
+	freshness    *freshness
+	idempotency  *idempotency
+	events       *events.Bus
+
+	queryStats      *queryStats
+	queriesObserved bool
+
+	searchIndex search.Indexer
+	fuzzy       *storage.FuzzyOptions
+	uids        storage.UIDPipeline
 }
 
 type HandlerOption func(h *Handler) error
@@ -120,9 +205,304 @@ func StatsFunc(f func() (interface{}, error)) HandlerOption {
 	}
 }
 
+// PacketCountFunc registers f to be called with the number of packets
+// accepted and dropped for each key submitted through /pks/add.
+func PacketCountFunc(f func(storage.PacketCounts)) HandlerOption {
+	return func(h *Handler) error {
+		h.packetFunc = f
+		return nil
+	}
+}
+
+// KeyChangeFunc registers f to be called with the change made to storage by
+// each key submitted through /pks/add, such as for attributing it in
+// statistics with sks.Peer.UpdateSource.
+func KeyChangeFunc(f func(storage.KeyChange)) HandlerOption {
+	return func(h *Handler) error {
+		h.changeFunc = f
+		return nil
+	}
+}
+
+// RejectFunc registers f to be called with the reason each key submitted
+// through /pks/add is refused by policy, such as for counting rejections in
+// statistics with sks.Peer.UpdateRejected.
+func RejectFunc(f func(error)) HandlerOption {
+	return func(h *Handler) error {
+		h.rejectFunc = f
+		return nil
+	}
+}
+
+// WriteGuard registers f to be called before keys submitted through /pks/add
+// are written. If it returns an error, such as from
+// diskspace.Monitor.ReadOnly when disk space is low, the submission is
+// refused as unavailable. Several write guards may be registered, and
+// submissions are refused if any returns an error.
+func WriteGuard(f func() error) HandlerOption {
+	return func(h *Handler) error {
+		if prev := h.writeGuard; prev != nil {
+			h.writeGuard = func() error {
+				if err := prev(); err != nil {
+					return err
+				}
+				return f()
+			}
+		} else {
+			h.writeGuard = f
+		}
+		return nil
+	}
+}
+
+// MaintenanceMode refuses submissions while m is enabled, as with
+// WriteGuard, and shows its message as a banner on HTML pages: index
+// templates may show {{.Query.Banner}}, and the SKSStats page shows it
+// above its statistics. Recon recovery is refused by registering
+// m.ReadOnly with sks.WriteGuard.
+func MaintenanceMode(m *maintenance.Mode) HandlerOption {
+	return func(h *Handler) error {
+		h.banner = m.Banner
+		return WriteGuard(m.ReadOnly)(h)
+	}
+}
+
+// KeyParseMode sets how submitted keys containing unparseable packets are
+// handled. The default is storage.ParsePermissive.
+func KeyParseMode(m storage.ParseMode) HandlerOption {
+	return func(h *Handler) error {
+		h.parseMode = m
+		return nil
+	}
+}
+
+// PacketLimits enforces limits on the packets of submitted keys, to
+// mitigate certificate flooding. Keys exceeding them are refused, or
+// truncated if l.Mode is storage.LimitTruncate.
+func PacketLimits(l storage.PacketLimits) HandlerOption {
+	return func(h *Handler) error {
+		h.limits = &l
+		return nil
+	}
+}
+
+// StripUnhashedSubpackets strips the unhashed subpackets which do not
+// identify the issuer from the signatures of submitted keys, with
+// storage.StripUnhashed, before they are merged.
+func StripUnhashedSubpackets() HandlerOption {
+	return func(h *Handler) error {
+		h.stripUnhashed = true
+		return nil
+	}
+}
+
+// ArmorHeaders sets the armor headers, such as Comment and Version, emitted
+// in op=get responses. An empty map omits armor headers entirely. If not set,
+// the openpgp package defaults are used.
+func ArmorHeaders(headers map[string]string) HandlerOption {
+	return func(h *Handler) error {
+		h.armorHeaders = map[string]string{}
+		for k, v := range headers {
+			h.armorHeaders[k] = v
+		}
+		return nil
+	}
+}
+
+// CanonicalOutput serializes keys in op=get and hashquery responses in a
+// canonical packet order, so that the same stored key is served
+// byte-identically across servers and restarts. Unless ArmorHeaders is also
+// given, armor headers are omitted.
+func CanonicalOutput() HandlerOption {
+	return func(h *Handler) error {
+		h.canonical = true
+		return nil
+	}
+}
+
+// PathPrefix registers the HKP endpoints under prefix, such as "/hkp", for
+// deployments behind a reverse proxy which does not strip it.
+func PathPrefix(prefix string) HandlerOption {
+	return func(h *Handler) error {
+		h.pathPrefix = normalizePathPrefix(prefix)
+		return nil
+	}
+}
+
+// AdvertiseCapabilities serves caps at /pks/capabilities, so that recon
+// partners can adapt their hashquery requests to this server. Compressed
+// hashquery requests are always accepted.
+func AdvertiseCapabilities(caps sks.Capabilities) HandlerOption {
+	return func(h *Handler) error {
+		h.caps = &caps
+		return nil
+	}
+}
+
+// MaxHashQuerySize limits hashquery request bodies to n bytes. Larger
+// requests are refused with 413 Request Entity Too Large, so that partners
+// retry with smaller chunks. The default is DefaultMaxHashQuerySize.
+func MaxHashQuerySize(n int64) HandlerOption {
+	return func(h *Handler) error {
+		if n <= 0 {
+			return errgo.Newf("invalid maximum hashquery size %d", n)
+		}
+		h.maxHashQuery = n
+		return nil
+	}
+}
+
+// TrustProxies sets the network ranges, in CIDR notation, of reverse proxies
+// whose Forwarded and X-Forwarded-* headers are honored when determining the
+// client IP address and public URL of a request.
+func TrustProxies(cidrs ...string) HandlerOption {
+	return func(h *Handler) error {
+		proxies, err := ParseTrustedProxies(cidrs)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		h.proxies = proxies
+		return nil
+	}
+}
+
+// StatsNoise perturbs the per-domain statistics served at /pks/domainstats
+// with noise, so that they do not reveal individual keys.
+func StatsNoise(noise *privacy.Noise) HandlerOption {
+	return func(h *Handler) error {
+		h.statsNoise = noise
+		return nil
+	}
+}
+
+// PublishCensus serves the latest census taken by job at /pks/census.
+func PublishCensus(job *census.Job) HandlerOption {
+	return func(h *Handler) error {
+		h.census = job
+		return nil
+	}
+}
+
+// PublishSignatureIndex answers signed-by and who-signed queries from ix at
+// /pks/signatures, and flags certifications by keys which ix knows to be
+// revoked in JSON output.
+func PublishSignatureIndex(ix *sigindex.Index) HandlerOption {
+	return func(h *Handler) error {
+		h.sigIndex = ix
+		return nil
+	}
+}
+
+// ExposeMetrics serves live Prometheus metrics at /metrics.
+func ExposeMetrics() HandlerOption {
+	return func(h *Handler) error {
+		h.metrics = true
+		return nil
+	}
+}
+
+// VerifyProofs verifies the identity proofs claimed by keys with c, and
+// includes their status in JSON index responses.
+func VerifyProofs(c *proof.Checker) HandlerOption {
+	return func(h *Handler) error {
+		h.proofs = c
+		return nil
+	}
+}
+
+// SearchBudget limits the time spent fetching the keys matching a lookup to
+// d. Keys found once it has passed are served as partial results, with the
+// X-HKP-Truncated: true response header, rather than leaving the client to
+// time out with nothing.
+func SearchBudget(d time.Duration) HandlerOption {
+	return func(h *Handler) error {
+		h.searchBudget = d
+		return nil
+	}
+}
+
+// searchEngineIndex is the index reported in query statistics for searches
+// routed to an external search engine.
+const searchEngineIndex = "search_engine"
+
+// SearchEngine routes keyword searches made with op=index and op=vindex to
+// ix, such as a search.Elasticsearch for fuzzy and typo-tolerant matching,
+// or a search.Memory for substring matching. Keys should be mirrored into it
+// with search.Mirror or search.MirrorEvents. Key ID and fingerprint searches, and op=get, are
+// still served from storage.
+func SearchEngine(ix search.Indexer) HandlerOption {
+	return func(h *Handler) error {
+		h.searchIndex = ix
+		return nil
+	}
+}
+
+// FuzzySearch enables approximate matching of names with opts, for op=index
+// and op=vindex keyword searches which find nothing exactly, unless made with
+// exact=on. Such results are marked with the X-HKP-Approximate: true response
+// header. The storage backend must implement storage.FuzzyMatcher.
+func FuzzySearch(opts storage.FuzzyOptions) HandlerOption {
+	return func(h *Handler) error {
+		if _, ok := h.storage.(storage.FuzzyMatcher); !ok {
+			return errgo.New("storage does not support fuzzy matching")
+		}
+		h.fuzzy = &opts
+		return nil
+	}
+}
+
+// UIDNormalization normalizes keyword searches with p before they are
+// matched, and user IDs with p when deciding whether they match a search. If
+// the storage backend implements storage.UIDNormalizing, it indexes user IDs
+// with p too. The default is storage.DefaultUIDPipeline, and searches are
+// passed to storage as given.
+func UIDNormalization(p storage.UIDPipeline) HandlerOption {
+	return func(h *Handler) error {
+		h.uids = p
+		if n, ok := h.storage.(storage.UIDNormalizing); ok {
+			n.SetUIDPipeline(p)
+		}
+		return nil
+	}
+}
+
+// writeRefused responds to a write refused by a write guard with err. The
+// message of a maintenance mode is shown to the client.
+func (h *Handler) writeRefused(w http.ResponseWriter, lang string, err error) {
+	if errgo.Cause(err) == maintenance.ErrMaintenance {
+		log.Debugf("write refused: %v", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	h.localizedError(w, lang, http.StatusServiceUnavailable, errgo.Mask(err))
+}
+
+// bannerText returns the banner to show on HTML pages, if any.
+func (h *Handler) bannerText() string {
+	if h.banner == nil {
+		return ""
+	}
+	return h.banner()
+}
+
+// ClientIP returns the IP address of the client which originated r, as
+// reported by trusted proxies.
+func (h *Handler) ClientIP(r *http.Request) net.IP {
+	return h.proxies.ClientIP(r)
+}
+
+// Localization translates human-facing responses using l.
+func Localization(l *Localizer) HandlerOption {
+	return func(h *Handler) error {
+		h.localizer = l
+		return nil
+	}
+}
+
 func NewHandler(storage storage.Storage, options ...HandlerOption) (*Handler, error) {
 	h := &Handler{
-		storage: storage,
+		storage:      storage,
+		maxHashQuery: DefaultMaxHashQuerySize,
 	}
 	for _, option := range options {
 		err := option(h)
@@ -130,21 +510,116 @@ func NewHandler(storage storage.Storage, options ...HandlerOption) (*Handler, er
 			return nil, errgo.Mask(err)
 		}
 	}
+	h.observeQueries()
+	if h.keyCache != nil {
+		h.subscribe("keycache", h.keyCache.invalidate)
+	}
+	if h.freshness != nil {
+		h.subscribe("freshness", h.freshness.observe)
+	}
 	return h, nil
 }
 
+// EventBus receives the key changes which invalidate cached keys from b,
+// rather than directly from storage, so that changes made by the other
+// nodes of an events.Cluster are seen.
+func EventBus(b *events.Bus) HandlerOption {
+	return func(h *Handler) error {
+		h.events = b
+		return nil
+	}
+}
+
+// subscribe registers f to be called with key changes, from the event bus
+// if configured, or otherwise from storage.
+func (h *Handler) subscribe(name string, f func(storage.KeyChange) error) {
+	if h.events != nil {
+		h.events.Subscribe(name, events.KeyChangeFunc(f), events.OnOverflow(events.Block))
+		return
+	}
+	h.storage.Subscribe(f)
+}
+
 func (h *Handler) Register(r *httprouter.Router) {
-	r.GET("/pks/lookup", h.Lookup)
-	r.POST("/pks/add", h.Add)
-	r.POST("/pks/hashquery", h.HashQuery)
+	r.GET(h.pathPrefix+"/pks/lookup", h.rateLimited(EndpointLookup, h.Lookup))
+	r.POST(h.pathPrefix+"/pks/add", h.rateLimited(EndpointAdd, h.Add))
+	r.POST(h.pathPrefix+"/pks/hashquery", h.rateLimited(EndpointHashquery, h.HashQuery))
+	if h.caps != nil {
+		r.GET(h.pathPrefix+sks.CapabilitiesPath, h.Capabilities)
+	}
+	if h.robots != nil {
+		r.GET("/robots.txt", h.Robots)
+	}
+	if h.domainStats != nil {
+		r.GET(h.pathPrefix+"/pks/domainstats", h.DomainStats)
+	}
+	if h.census != nil {
+		r.Handler("GET", h.pathPrefix+"/pks/census", h.census)
+	}
+	if h.sigIndex != nil {
+		r.Handler("GET", h.pathPrefix+"/pks/signatures", h.sigIndex)
+	}
+	if h.seed != nil {
+		r.GET(h.pathPrefix+"/pks/seed", h.Seed)
+		r.HandlerFunc("GET", h.pathPrefix+"/pks/seed/manifest", h.seed.ServeManifest)
+	}
+	if h.metrics {
+		r.Handler("GET", h.pathPrefix+"/metrics", metrics.Handler())
+	}
+	if h.queryStats != nil {
+		r.GET(h.pathPrefix+"/pks/debug/queries", h.QueryStats)
+	}
+	if h.healthChecks != nil {
+		r.GET(h.pathPrefix+"/healthz", h.Healthz)
+		r.GET(h.pathPrefix+"/readyz", h.Readyz)
+	}
+	if h.sshKeys {
+		r.GET(h.pathPrefix+"/pks/ssh", h.SSHKeys)
+	}
+	if h.wkdDomains != nil {
+		r.GET(wkdPath+"*path", h.WKD)
+	}
+	if h.verifier != nil {
+		r.POST(h.pathPrefix+"/vks/v1/upload", h.rateLimited(EndpointVKS, h.VKSUpload))
+		r.POST(h.pathPrefix+"/vks/v1/request-verify", h.rateLimited(EndpointVKS, h.VKSRequestVerify))
+		r.GET(h.pathPrefix+"/vks/v1/verify", h.VKSVerify)
+		if h.verifier.certs != nil {
+			r.POST(h.pathPrefix+"/x509/v1/upload", h.rateLimited(EndpointVKS, h.X509Upload))
+			r.GET(h.pathPrefix+"/x509/v1/verify", h.X509Verify)
+			r.GET(h.pathPrefix+"/x509/v1/lookup", h.X509Lookup)
+		}
+	}
+}
+
+func (h *Handler) Capabilities(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(h.caps)
 }
 
 func (h *Handler) Lookup(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	lang := h.localizer.Negotiate(r.Header.Get("Accept-Language"))
+	if throttled, wait := h.throttle(r); throttled {
+		w.Header().Set("Retry-After", retryAfter(wait))
+		h.localizedError(w, lang, http.StatusTooManyRequests,
+			errgo.Newf("crawler %q throttled", r.UserAgent()))
+		return
+	}
 	l, err := ParseLookup(r)
 	if err != nil {
-		httpError(w, http.StatusBadRequest, err)
+		h.localizedError(w, lang, http.StatusBadRequest, err)
 		return
 	}
+	l.Lang = lang
+	l.localizer = h.localizer
+	l.BaseURL = h.proxies.BaseURL(r, h.pathPrefix)
+	l.ClientIP = h.ClientIP(r)
+	l.uids = h.uids
+	l.Banner = h.bannerText()
+	l.header = r.Header
+	if h.searchBudget > 0 {
+		l.deadline = time.Now().Add(h.searchBudget)
+	}
 	switch l.Op {
 	case OperationGet, OperationHGet:
 		h.get(w, l)
@@ -155,36 +630,81 @@ func (h *Handler) Lookup(w http.ResponseWriter, r *http.Request, _ httprouter.Pa
 	case OperationStats:
 		h.stats(w, l)
 	default:
-		httpError(w, http.StatusNotFound, errgo.Newf("operation not found: %v", l.Op))
+		h.localizedError(w, l.Lang, http.StatusNotFound, errgo.Newf("operation not found: %v", l.Op))
 		return
 	}
 }
 
+// HashQuery serves the keys matching SKS digests requested by a recon
+// partner, in the SKS hashquery wire format: the number of keys, each key's
+// length-prefixed binary packets, and a terminating CRLF.
 func (h *Handler) HashQuery(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	hq, err := ParseHashQuery(r)
-	if err != nil {
+	start := time.Now()
+	// One byte more than the limit is let through, so that the parser
+	// detects an oversized body.
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxHashQuery+1)
+	hq, err := ParseHashQueryMax(r, h.maxHashQuery)
+	if errgo.Cause(err) == ErrHashQueryTooLarge {
+		// Partners retry with smaller chunks.
+		httpError(w, http.StatusRequestEntityTooLarge, errgo.Mask(err))
+		return
+	} else if err != nil {
 		httpError(w, http.StatusBadRequest, errgo.Mask(err))
 		return
 	}
+	if h.caps != nil && h.caps.MaxChunkSize > 0 && len(hq.Digests) > h.caps.MaxChunkSize {
+		// Partners retry with smaller chunks.
+		httpError(w, http.StatusRequestEntityTooLarge, errgo.Newf(
+			"hashquery of %d digests exceeds maximum of %d", len(hq.Digests), h.caps.MaxChunkSize))
+		return
+	}
 	var result []*openpgp.PrimaryKey
+	seen := map[string]bool{}
 	for _, digest := range hq.Digests {
-		rfps, err := h.storage.MatchMD5([]string{digest})
-		if err != nil {
+		rfps, err := storage.MatchMD5Context(r.Context(), h.storage, []string{digest})
+		if r.Context().Err() != nil {
+			// The partner has gone away.
+			return
+		} else if err != nil {
 			log.Errorf("error resolving hashquery digest %q", digest)
+			metrics.StorageError("match_md5")
 			continue
 		}
-		keys, err := h.storage.FetchKeys(rfps)
-		if err != nil {
+		keys, err := storage.FetchKeysContext(r.Context(), h.storage, rfps)
+		if r.Context().Err() != nil {
+			return
+		} else if err != nil {
 			log.Errorf("error fetching hashquery key %q", digest)
+			metrics.StorageError("fetch")
 			continue
 		}
-		result = append(result, keys...)
+		for _, key := range keys {
+			// Only return keys with the digest requested, which partners
+			// verify.
+			if !strings.EqualFold(key.MD5, digest) || seen[key.RFingerprint] {
+				continue
+			}
+			// Keys taken down are not gossiped.
+			if h.takedowns.key(key) != nil {
+				continue
+			}
+			seen[key.RFingerprint] = true
+			result = append(result, key)
+		}
+	}
+
+	if h.canonical {
+		result = CanonicalKeys(result)
 	}
 
 	w.Header().Set("Content-Type", "pgp/keys")
 
 	// Write the number of keys
 	err = recon.WriteInt(w, len(result))
+	if err != nil {
+		log.Errorf("error writing hashquery key count: %v", err)
+		return
+	}
 	for _, key := range result {
 		// Write each key in binary packet format, prefixed with length
 		err = writeHashqueryKey(w, key)
@@ -199,6 +719,7 @@ func (h *Handler) HashQuery(w http.ResponseWriter, r *http.Request, _ httprouter
 	if err != nil {
 		log.Errorf("error writing hashquery terminator: %v", err)
 	}
+	metrics.Hashquery(metrics.RoleServer, start, len(result))
 }
 
 func writeHashqueryKey(w http.ResponseWriter, key *openpgp.PrimaryKey) error {
@@ -219,69 +740,287 @@ func writeHashqueryKey(w http.ResponseWriter, key *openpgp.PrimaryKey) error {
 }
 
 func (h *Handler) resolve(l *Lookup) ([]string, error) {
-	if l.Op == OperationHGet {
-		return h.storage.MatchMD5([]string{l.Search})
+	start := time.Now()
+	var shape string
+	var rfps []string
+	var err error
+	keyID := openpgp.Reverse(strings.ToLower(strings.TrimPrefix(l.Search, "0x")))
+	search := h.uids.Normalize(l.Search)
+	switch {
+	case l.Op == OperationHGet:
+		shape = storage.ShapeMD5
+		rfps, err = h.storage.MatchMD5([]string{l.Search})
+	case strings.HasPrefix(l.Search, "0x") &&
+		(len(keyID) == shortKeyIDLen || len(keyID) == longKeyIDLen || len(keyID) == fingerprintKeyIDLen):
+		shape = storage.KeyIDShape(keyID)
+		rfps, err = h.storage.Resolve([]string{keyID})
+	case h.searchIndex != nil && (l.Op == OperationIndex || l.Op == OperationVIndex):
+		ctx := context.Background()
+		if !l.deadline.IsZero() {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, l.deadline)
+			defer cancel()
+		}
+		rfps, err = h.searchIndex.Search(ctx, search)
+		if err != nil && ctx.Err() != nil {
+			log.Infof("%s %q: search budget exhausted while searching", l.Op, l.Search)
+			l.Truncated = true
+			return nil, nil
+		} else if err == nil {
+			h.observeQuery(storage.QueryStat{
+				Shape:    storage.KeywordShape(search),
+				Index:    searchEngineIndex,
+				Rows:     len(rfps),
+				Duration: time.Since(start),
+			})
+		}
+		return rfps, err
+	default:
+		shape = storage.KeywordShape(search)
+		rfps, err = h.matchKeyword(search)
+		if err == nil && len(rfps) == 0 && h.fuzzy != nil && !l.Exact && shape == storage.ShapeKeyword &&
+			(l.Op == OperationIndex || l.Op == OperationVIndex) {
+			rfps, err = h.storage.(storage.FuzzyMatcher).MatchFuzzy([]string{search}, *h.fuzzy)
+			l.Approximate = len(rfps) > 0
+		}
+	}
+	if err == nil && !h.queriesObserved {
+		h.observeQuery(storage.QueryStat{Shape: shape, Rows: len(rfps), Duration: time.Since(start)})
 	}
-	if strings.HasPrefix(l.Search, "0x") {
-		keyID := openpgp.Reverse(strings.ToLower(l.Search[2:]))
-		switch len(keyID) {
-		case shortKeyIDLen, longKeyIDLen, fingerprintKeyIDLen:
-			return h.storage.Resolve([]string{keyID})
+	return rfps, err
+}
+
+// matchKeyword matches search in storage. Email addresses at
+// internationalized domains are also matched with the domain in its other
+// form, Unicode or punycode.
+func (h *Handler) matchKeyword(search string) ([]string, error) {
+	searches := storage.EmailSearches(search)
+	if len(searches) == 1 {
+		return h.storage.MatchKeyword(searches)
+	}
+	var result []string
+	seen := map[string]bool{}
+	for _, s := range searches {
+		rfps, err := h.storage.MatchKeyword([]string{s})
+		if err != nil {
+			return nil, err
+		}
+		for _, rfp := range rfps {
+			if !seen[rfp] {
+				seen[rfp] = true
+				result = append(result, rfp)
+			}
 		}
 	}
-	return h.storage.MatchKeyword([]string{l.Search})
+	return result, nil
 }
 
 func (h *Handler) keys(l *Lookup) ([]*openpgp.PrimaryKey, error) {
+	if td := h.takedowns.match(l); td != nil {
+		return nil, errgo.WithCausef(nil, &withheldError{td}, "%s %q", l.Op, l.Search)
+	}
 	rfps, err := h.resolve(l)
 	if err != nil {
+		metrics.StorageError("resolve")
+		return nil, err
+	}
+	keys, err := h.fetchKeys(l, rfps)
+	if err != nil {
+		metrics.StorageError("fetch")
 		return nil, err
 	}
-	return h.storage.FetchKeys(rfps)
+	keys, td := h.takedowns.filter(keys)
+	if td != nil && len(keys) == 0 {
+		return nil, errgo.WithCausef(nil, &withheldError{td}, "%s %q", l.Op, l.Search)
+	}
+	if h.honeypots != nil {
+		h.honeypots.check(l, keys)
+	}
+	hz := h.horizon(l.ClientIP)
+	if h.verifier != nil && (hz == nil || !hz.Unverified) {
+		keys, err = h.verifier.strip(l, keys)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	if hz != nil {
+		keys = hz.hide(l, keys)
+	}
+	return keys, nil
+}
+
+// searchChunkSize is the number of keys fetched at a time by a lookup with a
+// search budget.
+var searchChunkSize = 100
+
+// fetchKeys fetches the keys with the given RFingerprints, other than those
+// in the key cache. If l has a deadline, they are fetched in chunks until it
+// passes, and l is marked truncated if any were not fetched.
+func (h *Handler) fetchKeys(l *Lookup, rfps []string) ([]*openpgp.PrimaryKey, error) {
+	var cached []*storage.Keyring
+	if h.keyCache != nil {
+		cached, rfps = h.keyCache.get(rfps)
+	}
+	if l.deadline.IsZero() && (h.cacheControl != nil || h.keyCache != nil) {
+		// Conditional lookups need to know when the keys were updated,
+		// and cached keys are kept with their keyrings.
+		var keyrings []*storage.Keyring
+		if len(rfps) > 0 {
+			var err error
+			keyrings, err = h.storage.FetchKeyrings(rfps)
+			if err != nil {
+				return nil, err
+			}
+			if h.keyCache != nil {
+				h.keyCache.add(keyrings...)
+			}
+		}
+		keyrings = append(cached, keyrings...)
+		keys := make([]*openpgp.PrimaryKey, len(keyrings))
+		for i, kr := range keyrings {
+			keys[i] = kr.PrimaryKey
+			if kr.MTime.After(l.modified) {
+				l.modified = kr.MTime
+			}
+		}
+		return keys, nil
+	} else if l.deadline.IsZero() {
+		return h.storage.FetchKeys(rfps)
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), l.deadline)
+	defer cancel()
+	var result []*openpgp.PrimaryKey
+	for _, kr := range cached {
+		result = append(result, kr.PrimaryKey)
+	}
+	for len(rfps) > 0 {
+		n := searchChunkSize
+		if n > len(rfps) {
+			n = len(rfps)
+		}
+		keys, err := storage.FetchKeysContext(ctx, h.storage, rfps[:n])
+		if err == nil {
+			result = append(result, keys...)
+			rfps = rfps[n:]
+		} else if ctx.Err() == nil {
+			return nil, err
+		}
+		if ctx.Err() != nil && len(rfps) > 0 {
+			log.Infof("%s %q: search budget exhausted, %d keys not fetched", l.Op, l.Search, len(rfps))
+			l.Truncated = true
+			break
+		}
+	}
+	return result, nil
+}
+
+// setTruncated flags the response to l if its results are incomplete or
+// approximate.
+func setTruncated(w http.ResponseWriter, l *Lookup) {
+	if l.Truncated {
+		w.Header().Set("X-HKP-Truncated", "true")
+	}
+	if l.Approximate {
+		w.Header().Set("X-HKP-Approximate", "true")
+	}
 }
 
 func (h *Handler) get(w http.ResponseWriter, l *Lookup) {
 	keys, err := h.keys(l)
-	if err != nil {
-		httpError(w, http.StatusInternalServerError, errgo.Mask(err))
+	if td, ok := withheld(err); ok {
+		h.writeTakedown(w, l, td)
+		return
+	} else if err != nil {
+		h.localizedError(w, l.Lang, http.StatusInternalServerError, errgo.Mask(err))
 		return
 	}
+	setTruncated(w, l)
 	if len(keys) == 0 {
-		httpError(w, http.StatusNotFound, errgo.New("not found"))
+		h.localizedError(w, l.Lang, http.StatusNotFound, errgo.New("not found"))
+		return
+	}
+	h.setKeyFreshness(w, l, keys)
+	if h.notModified(w, l, keys) {
 		return
 	}
 
 	w.Header().Set("Content-Type", "text/plain")
-	err = openpgp.WriteArmoredPackets(w, keys)
+	if h.canonical {
+		keys = CanonicalKeys(keys)
+	}
+	if h.armorHeaders != nil {
+		err = writeArmoredKeys(w, keys, h.armorHeaders)
+	} else if h.canonical {
+		err = writeArmoredKeys(w, keys, map[string]string{})
+	} else {
+		err = openpgp.WriteArmoredPackets(w, keys)
+	}
 	if err != nil {
 		log.Errorf("get %q: error writing armored keys: %v", l.Search, err)
 	}
 }
 
+// writeArmoredKeys writes keys as an armored public key block with the given
+// armor headers.
+func writeArmoredKeys(w io.Writer, keys []*openpgp.PrimaryKey, headers map[string]string) error {
+	armw, err := armor.Encode(w, armorPublicKeyType, headers)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, key := range keys {
+		err = openpgp.WritePackets(armw, key)
+		if err != nil {
+			armw.Close()
+			return errgo.Mask(err)
+		}
+	}
+	return errgo.Mask(armw.Close())
+}
+
 func (h *Handler) index(w http.ResponseWriter, l *Lookup, f IndexFormat) {
 	keys, err := h.keys(l)
-	if err != nil {
-		httpError(w, http.StatusInternalServerError, errgo.Mask(err))
+	if td, ok := withheld(err); ok {
+		h.writeTakedown(w, l, td)
+		return
+	} else if err != nil {
+		h.localizedError(w, l.Lang, http.StatusInternalServerError, errgo.Mask(err))
 		return
 	}
+	setTruncated(w, l)
 	if len(keys) == 0 {
-		httpError(w, http.StatusNotFound, errgo.New("not found"))
+		h.localizedError(w, l.Lang, http.StatusNotFound, errgo.New("not found"))
+		return
+	}
+	h.setKeyFreshness(w, l, keys)
+	if h.notModified(w, l, keys) {
 		return
 	}
 
-	if l.Options[OptionMachineReadable] {
+	switch {
+	case l.Options[OptionMachineReadable] && l.Options[OptionJSON]:
+		f = &MRJSONFormat{Proofs: h.proofs, Certifiers: h.revokedCertifiers(), freshness: h.freshness}
+	case l.Options[OptionMachineReadable]:
 		f = mrFormat
-	} else if l.Options[OptionJSON] || f == nil {
-		f = jsonFormat
+	case l.Options[OptionJSON] || f == nil:
+		f = &JSONFormat{Proofs: h.proofs, Certifiers: h.revokedCertifiers(), freshness: h.freshness}
 	}
 
 	err = f.Write(w, l, keys)
 	if err != nil {
-		httpError(w, http.StatusInternalServerError, errgo.Mask(err))
+		h.localizedError(w, l.Lang, http.StatusInternalServerError, errgo.Mask(err))
 		return
 	}
 }
 
+// revokedCertifiers returns the source of revoked certifiers to flag in
+// JSON output, if any.
+func (h *Handler) revokedCertifiers() RevokedCertifiers {
+	if h.sigIndex == nil {
+		return nil
+	}
+	return h.sigIndex
+}
+
 func (h *Handler) indexJSON(w http.ResponseWriter, keys []*openpgp.PrimaryKey) {
 	w.Header().Set("Content-Type", "application/json")
 	enc := json.NewEncoder(w)
@@ -306,13 +1045,13 @@ type StatsResponse struct {
 
 func (h *Handler) stats(w http.ResponseWriter, l *Lookup) {
 	if h.statsFunc == nil {
-		httpError(w, http.StatusBadRequest, errgo.New("stats not configured"))
+		h.localizedError(w, l.Lang, http.StatusBadRequest, errgo.New("stats not configured"))
 		fmt.Fprintln(w, "stats not configured")
 		return
 	}
 	data, err := h.statsFunc()
 	if err != nil {
-		httpError(w, http.StatusInternalServerError, errgo.Mask(err))
+		h.localizedError(w, l.Lang, http.StatusInternalServerError, errgo.Mask(err))
 		return
 	}
 
@@ -322,7 +1061,7 @@ func (h *Handler) stats(w http.ResponseWriter, l *Lookup) {
 		err = json.NewEncoder(w).Encode(data)
 	}
 	if err != nil {
-		httpError(w, http.StatusInternalServerError, errgo.Mask(err))
+		h.localizedError(w, l.Lang, http.StatusInternalServerError, errgo.Mask(err))
 	}
 }
 
@@ -332,36 +1071,112 @@ type AddResponse struct {
 	Ignored  []string `json:"ignored"`
 }
 
+// upsertKey merges key, submitted in r, into storage, checking the key as
+// merged with checkMerged. If it is refused or cannot be stored, the error is
+// written to w and false is returned.
+func (h *Handler) upsertKey(w http.ResponseWriter, r *http.Request, lang string,
+	key *openpgp.PrimaryKey) (storage.KeyChange, bool) {
+	var refused error
+	check := func(merged *openpgp.PrimaryKey) error {
+		refused = h.checkMerged(merged, r)
+		return refused
+	}
+	change, err := storage.UpsertKeyChecked(r.Context(), h.storage, key, check)
+	if refused != nil {
+		h.refuseKey(w, r, refused)
+		return nil, false
+	} else if err != nil {
+		metrics.StorageError("upsert")
+		h.localizedError(w, lang, http.StatusInternalServerError, errgo.Mask(err))
+		return nil, false
+	}
+	return change, true
+}
+
 func (h *Handler) Add(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	lang := h.localizer.Negotiate(r.Header.Get("Accept-Language"))
+	if h.refuseMirrored(w, r, lang) {
+		return
+	}
+	if h.writeGuard != nil {
+		if err := h.writeGuard(); err != nil {
+			h.writeRefused(w, lang, err)
+			return
+		}
+	}
 	add, err := ParseAdd(r)
 	if err != nil {
-		httpError(w, http.StatusBadRequest, errgo.Mask(err))
+		h.localizedError(w, lang, http.StatusBadRequest, errgo.Mask(err))
 		return
 	}
 
-	// Check and decode the armor
-	armorBlock, err := armor.Decode(bytes.NewBufferString(add.Keytext))
-	if err != nil {
-		httpError(w, http.StatusBadRequest, errgo.Mask(err))
+	keydata := add.Keydata
+	if len(keydata) == 0 {
+		// Check and decode the armor
+		keydata, err = DecodeKeytext(add.Keytext)
+		if err != nil {
+			h.localizedError(w, lang, http.StatusBadRequest, errgo.Mask(err))
+			return
+		}
+	}
+	done, ok := h.beginAdd(w, r, lang, keydata)
+	if !ok {
 		return
 	}
+	var completed *AddResponse
+	defer func() { done(completed) }()
+	counted, ok := h.reserveQuota(w, r, lang, len(keydata))
+	if !ok {
+		return
+	}
+	// Keys stored are charged even if a later key is refused or cannot be
+	// stored, so that partial failures do not get around the quota.
+	var stored int
+	defer func() {
+		if completed == nil {
+			counted(stored)
+		}
+	}()
 
 	var result AddResponse
-	for readKey := range openpgp.ReadKeys(armorBlock.Body) {
+	for readKey := range openpgp.ReadKeys(bytes.NewBuffer(keydata)) {
 		if readKey.Error != nil {
-			httpError(w, http.StatusBadRequest, errgo.Mask(err))
+			h.localizedError(w, lang, http.StatusBadRequest, errgo.Mask(readKey.Error))
+			return
+		}
+		err := h.parseMode.Check(readKey.PrimaryKey)
+		if err != nil {
+			if h.rejectFunc != nil {
+				h.rejectFunc(err)
+			}
+			h.localizedError(w, lang, http.StatusBadRequest, errgo.Mask(err))
 			return
 		}
-		err := openpgp.DropDuplicates(readKey.PrimaryKey)
+		pc, err := storage.DropDuplicates(readKey.PrimaryKey)
 		if err != nil {
-			httpError(w, http.StatusInternalServerError, errgo.Mask(err))
+			h.localizedError(w, lang, http.StatusInternalServerError, errgo.Mask(err))
 			return
 		}
-		change, err := storage.UpsertKey(h.storage, readKey.PrimaryKey)
+		err = h.checkPolicy(readKey.PrimaryKey, r, &pc)
 		if err != nil {
-			httpError(w, http.StatusInternalServerError, errgo.Mask(err))
+			h.refuseKey(w, r, err)
 			return
 		}
+		if h.packetFunc != nil {
+			h.packetFunc(pc)
+		}
+		change, ok := h.upsertKey(w, r, lang, readKey.PrimaryKey)
+		if !ok {
+			return
+		}
+		stored++
+		metrics.KeyChanged(sks.SourceAdd, change)
+		if h.freshness != nil {
+			h.freshness.added(change)
+		}
+		if h.changeFunc != nil {
+			h.changeFunc(change)
+		}
 
 		fp := readKey.PrimaryKey.QualifiedFingerprint()
 		switch change.(type) {
@@ -374,8 +1189,10 @@ func (h *Handler) Add(w http.ResponseWriter, r *http.Request, _ httprouter.Param
 		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	enc := json.NewEncoder(w)
-	enc.Encode(&result)
+	log.Infof("add from %v: inserted=%d updated=%d ignored=%d", h.ClientIP(r),
+		len(result.Inserted), len(result.Updated), len(result.Ignored))
+
+	counted(stored)
+	completed = &result
+	writeAddResponse(w, &result)
 }
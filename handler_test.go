@@ -19,21 +19,48 @@ package hkp
 
 import (
 	"bytes"
+	"container/list"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"math/big"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
 	stdtesting "testing"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
 
 	"github.com/hockeypuck/testing"
+	"gopkg.in/hockeypuck/conflux.v2/recon"
 	"gopkg.in/hockeypuck/openpgp.v1"
 
+	"gopkg.in/hockeypuck/hkp.v1/jsonhkp"
+	"gopkg.in/hockeypuck/hkp.v1/maintenance"
+	"gopkg.in/hockeypuck/hkp.v1/search"
+	"gopkg.in/hockeypuck/hkp.v1/seed"
+	"gopkg.in/hockeypuck/hkp.v1/sks"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+	"gopkg.in/hockeypuck/hkp.v1/storage/mem"
 	"gopkg.in/hockeypuck/hkp.v1/storage/mock"
+	"gopkg.in/hockeypuck/hkp.v1/vks"
 )
 
 func Test(t *stdtesting.T) { gc.TestingT(t) }
@@ -150,6 +177,63 @@ uid:alice <alice@example.com>:1345589945::
 `)
 }
 
+func (s *HandlerSuite) TestIndexAliceMRJSON(c *gc.C) {
+	res, err := http.Get(fmt.Sprintf("%s/pks/lookup?op=index&options=mr,json&search=0x23e0dcca", s.srv.URL))
+	c.Assert(err, gc.IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(res.Header.Get("Content-Type"), gc.Equals, "application/json")
+
+	var result []*jsonhkp.KeyMetadata
+	err = json.NewDecoder(res.Body).Decode(&result)
+	c.Assert(err, gc.IsNil)
+	c.Assert(result, gc.HasLen, 1)
+	c.Assert(result[0].Fingerprint, gc.Equals, "10fe8cf1b483f7525039aa2a361bc1f023e0dcca")
+	c.Assert(result[0].BitLength, gc.Equals, 2048)
+	c.Assert(result[0].Creation, gc.Equals, "2012-08-21T22:59:05Z")
+	c.Assert(result[0].NeverExpires, gc.Equals, true)
+	c.Assert(result[0].Revoked, gc.Equals, false)
+	c.Assert(result[0].UserIDs, gc.HasLen, 1)
+	c.Assert(result[0].UserIDs[0].UserID, gc.Equals, "alice <alice@example.com>")
+}
+
+// allRevoked reports every certifier as revoked.
+type allRevoked struct{}
+
+func (allRevoked) RevokedCertifier(string) (time.Time, bool) {
+	return time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), true
+}
+
+func (s *HandlerSuite) TestJSONRevokedCertifiers(c *gc.C) {
+	keys := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")).MustParse()
+	w := httptest.NewRecorder()
+	err := (&JSONFormat{Certifiers: allRevoked{}}).Write(w, &Lookup{}, keys)
+	c.Assert(err, gc.IsNil)
+
+	var result []*jsonhkp.PrimaryKey
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &result), gc.IsNil)
+	c.Assert(result, gc.HasLen, 1)
+	var flagged int
+	for _, sig := range result[0].AllSignatures() {
+		if strings.EqualFold(sig.IssuerKeyID, result[0].LongKeyID) {
+			c.Assert(sig.IssuerRevoked, gc.Equals, false)
+		} else {
+			c.Assert(sig.IssuerRevoked, gc.Equals, true)
+			c.Assert(sig.IssuerRevocation, gc.Equals, "2020-01-02T03:04:05Z")
+			flagged++
+		}
+	}
+	c.Assert(flagged > 0, gc.Equals, true)
+
+	w = httptest.NewRecorder()
+	err = (&MRJSONFormat{Certifiers: allRevoked{}}).Write(w, &Lookup{}, keys)
+	c.Assert(err, gc.IsNil)
+	var metas []*jsonhkp.KeyMetadata
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &metas), gc.IsNil)
+	c.Assert(metas, gc.HasLen, 1)
+	c.Assert(metas[0].RevokedCertifiers, gc.Not(gc.HasLen), 0)
+}
+
 func (s *HandlerSuite) TestBadOp(c *gc.C) {
 	for _, op := range []string{"", "?op=explode"} {
 		res, err := http.Get(s.srv.URL + "/pks/lookup" + op)
@@ -185,3 +269,1705 @@ func (s *HandlerSuite) TestAdd(c *gc.C) {
 	c.Assert(err, gc.IsNil)
 	c.Assert(addRes.Ignored, gc.HasLen, 1)
 }
+
+func (s *HandlerSuite) TestAddBadKeytext(c *gc.C) {
+	l := NewLocalizer("en")
+	l.AddCatalog("de", Catalog{"Bad Request": "Ungültige Anfrage"})
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, Localization(l))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	req, err := http.NewRequest("POST", srv.URL+"/pks/add", strings.NewReader(url.Values{
+		"keytext": []string{"not a key"},
+	}.Encode()))
+	c.Assert(err, gc.IsNil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept-Language", "de")
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, gc.IsNil)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+	c.Assert(res.Header.Get("Content-Language"), gc.Equals, "de")
+	c.Assert(string(body), gc.Equals, "Ungültige Anfrage\n")
+}
+
+func (s *HandlerSuite) TestAddKeyfile(c *gc.C) {
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_unsigned.asc"))
+	c.Assert(err, gc.IsNil)
+	keydata, err := DecodeKeytext(string(keytext))
+	c.Assert(err, gc.IsNil)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("keyfile", "alice.gpg")
+	c.Assert(err, gc.IsNil)
+	_, err = fw.Write(keydata)
+	c.Assert(err, gc.IsNil)
+	c.Assert(mw.Close(), gc.IsNil)
+
+	res, err := http.Post(s.srv.URL+"/pks/add", mw.FormDataContentType(), &body)
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	defer res.Body.Close()
+	doc, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, gc.IsNil)
+
+	var addRes AddResponse
+	err = json.Unmarshal(doc, &addRes)
+	c.Assert(err, gc.IsNil)
+	c.Assert(addRes.Ignored, gc.HasLen, 1)
+}
+
+func (s *HandlerSuite) TestAddPreservesUnknownPackets(c *gc.C) {
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_unsigned.asc"))
+	c.Assert(err, gc.IsNil)
+	keydata, err := DecodeKeytext(string(keytext))
+	c.Assert(err, gc.IsNil)
+	// New-format packet with private/experimental tag 60.
+	experimental := []byte{0xfc, 0x05, 'h', 'e', 'l', 'l', 'o'}
+	keydata = append(keydata, experimental...)
+
+	var stored []*openpgp.PrimaryKey
+	st := mock.NewStorage(
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return nil, storage.ErrKeyNotFound
+		}),
+		mock.Insert(func(keys []*openpgp.PrimaryKey) (int, error) {
+			stored = append(stored, keys...)
+			return len(keys), nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(st)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("keyfile", "alice.gpg")
+	c.Assert(err, gc.IsNil)
+	_, err = fw.Write(keydata)
+	c.Assert(err, gc.IsNil)
+	c.Assert(mw.Close(), gc.IsNil)
+
+	res, err := http.Post(srv.URL+"/pks/add", mw.FormDataContentType(), &body)
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+
+	c.Assert(stored, gc.HasLen, 1)
+	var out bytes.Buffer
+	err = openpgp.WritePackets(&out, stored[0])
+	c.Assert(err, gc.IsNil)
+	c.Assert(bytes.Contains(out.Bytes(), experimental), gc.Equals, true)
+}
+
+func (s *HandlerSuite) TestGetArmorHeaders(c *gc.C) {
+	for _, t := range []struct {
+		headers map[string]string
+		header  string
+	}{
+		{map[string]string{"Comment": "Example keyserver"}, "Comment: Example keyserver\n\n"},
+		{map[string]string{}, "-----BEGIN PGP PUBLIC KEY BLOCK-----\n\n"},
+	} {
+		r := httprouter.New()
+		handler, err := NewHandler(s.storage, ArmorHeaders(t.headers))
+		c.Assert(err, gc.IsNil)
+		handler.Register(r)
+		srv := httptest.NewServer(r)
+
+		res, err := http.Get(srv.URL + "/pks/lookup?op=get&search=0x23e0dcca")
+		c.Assert(err, gc.IsNil)
+		armor, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		srv.Close()
+		c.Assert(err, gc.IsNil)
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+		c.Assert(strings.Contains(string(armor), t.header), gc.Equals, true, gc.Commentf("%s", armor))
+
+		keys := openpgp.MustReadArmorKeys(bytes.NewBuffer(armor)).MustParse()
+		c.Assert(keys, gc.HasLen, 1)
+	}
+}
+
+func (s *HandlerSuite) TestAddKeyChangeFunc(c *gc.C) {
+	var changes []storage.KeyChange
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, KeyChangeFunc(func(kc storage.KeyChange) {
+		changes = append(changes, kc)
+	}))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_unsigned.asc"))
+	c.Assert(err, gc.IsNil)
+	res, err := http.PostForm(srv.URL+"/pks/add", url.Values{
+		"keytext": []string{string(keytext)},
+	})
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(changes, gc.HasLen, 1)
+	_, ok := changes[0].(storage.KeyNotChanged)
+	c.Assert(ok, gc.Equals, true)
+}
+
+func (s *HandlerSuite) TestAddWriteGuard(c *gc.C) {
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, WriteGuard(func() error {
+		return errgo.New("low disk space")
+	}))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_unsigned.asc"))
+	c.Assert(err, gc.IsNil)
+	res, err := http.PostForm(srv.URL+"/pks/add", url.Values{
+		"keytext": []string{string(keytext)},
+	})
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusServiceUnavailable)
+	c.Assert(s.storage.MethodCount("Insert"), gc.Equals, 0)
+}
+
+func (s *HandlerSuite) TestAddSubmissionPolicy(c *gc.C) {
+	var rejected []error
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage,
+		RejectFunc(func(err error) { rejected = append(rejected, err) }),
+		SubmissionPolicy(func(key *openpgp.PrimaryKey, req *http.Request) error {
+			c.Check(req.URL.Path, gc.Equals, "/pks/add")
+			return RefuseKey(http.StatusUnprocessableEntity, "no keys for %s today", key.UserIDs[0].Keywords)
+		}))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_unsigned.asc"))
+	c.Assert(err, gc.IsNil)
+	res, err := http.PostForm(srv.URL+"/pks/add", url.Values{
+		"keytext": []string{string(keytext)},
+	})
+	c.Assert(err, gc.IsNil)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusUnprocessableEntity)
+	c.Assert(string(body), gc.Matches, "no keys for alice.* today\n")
+	c.Assert(rejected, gc.HasLen, 1)
+	c.Assert(s.storage.MethodCount("Insert"), gc.Equals, 0)
+	c.Assert(s.storage.MethodCount("Update"), gc.Equals, 0)
+}
+
+func (s *HandlerSuite) TestSubmissionPolicies(c *gc.C) {
+	sig := &openpgp.Signature{}
+	key := &openpgp.PrimaryKey{
+		PublicKey: openpgp.PublicKey{Signatures: []*openpgp.Signature{sig}},
+		UserIDs: []*openpgp.UserID{
+			{Keywords: "Alice <alice@example.com>", Signatures: []*openpgp.Signature{sig, sig}},
+			{Keywords: "Alice <alice@xn--bcher-kva.example>", Signatures: []*openpgp.Signature{sig}},
+		},
+		UserAttributes: []*openpgp.UserAttribute{{Signatures: []*openpgp.Signature{sig}}},
+		SubKeys:        []*openpgp.SubKey{{PublicKey: openpgp.PublicKey{Signatures: []*openpgp.Signature{sig}}}},
+	}
+	status := func(err error) int {
+		if err == nil {
+			return http.StatusOK
+		}
+		return err.(*PolicyError).Status
+	}
+
+	c.Assert(status(MaxSignatures(6)(key, nil)), gc.Equals, http.StatusOK)
+	err := MaxSignatures(5)(key, nil)
+	c.Assert(err, gc.ErrorMatches, "key has 6 signatures, more than the 5 allowed")
+	c.Assert(status(err), gc.Equals, http.StatusUnprocessableEntity)
+
+	c.Assert(status(MaxUserAttributes(1)(key, nil)), gc.Equals, http.StatusOK)
+	c.Assert(status(MaxUserAttributes(0)(key, nil)), gc.Equals, http.StatusUnprocessableEntity)
+
+	c.Assert(status(AllowedDomains("Example.com", "bücher.example")(key, nil)), gc.Equals, http.StatusOK)
+	err = AllowedDomains("example.com")(key, nil)
+	c.Assert(err, gc.ErrorMatches, `user ID "Alice <alice@xn--bcher-kva.example>" is not at an allowed domain`)
+	c.Assert(status(err), gc.Equals, http.StatusForbidden)
+	c.Assert(status(AllowedDomains("example.com")(&openpgp.PrimaryKey{}, nil)), gc.Equals, http.StatusForbidden)
+}
+
+// aliceHalves returns alice's signed key, and two parts of it which are
+// merged back into the whole: one without subkeys, and one without
+// third-party signatures.
+func aliceHalves() (*openpgp.PrimaryKey, []*openpgp.PrimaryKey) {
+	readAlice := func() *openpgp.PrimaryKey {
+		return openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")).MustParse()[0]
+	}
+	certified := readAlice()
+	certified.SubKeys = nil
+	selfSigned := readAlice()
+	for _, uid := range selfSigned.UserIDs {
+		var sigs []*openpgp.Signature
+		for _, sig := range uid.Signatures {
+			if sig.RIssuerKeyID == selfSigned.RKeyID {
+				sigs = append(sigs, sig)
+			}
+		}
+		uid.Signatures = sigs
+	}
+	return readAlice(), []*openpgp.PrimaryKey{certified, selfSigned}
+}
+
+// addKeys submits each of keys to srv, returning the status of each
+// response.
+func addKeys(c *gc.C, srv *httptest.Server, keys []*openpgp.PrimaryKey) []int {
+	var statuses []int
+	for _, key := range keys {
+		var keytext bytes.Buffer
+		c.Assert(openpgp.WriteArmoredPackets(&keytext, []*openpgp.PrimaryKey{key}), gc.IsNil)
+		res, err := http.PostForm(srv.URL+"/pks/add", url.Values{
+			"keytext": []string{keytext.String()},
+		})
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		statuses = append(statuses, res.StatusCode)
+	}
+	return statuses
+}
+
+func (s *HandlerSuite) TestAddLimitsMergedKey(c *gc.C) {
+	full, halves := aliceHalves()
+	size, err := storage.KeySize(full)
+	c.Assert(err, gc.IsNil)
+	// Neither half of the key is over the limit, but their union is.
+	for _, key := range halves {
+		n, err := storage.KeySize(key)
+		c.Assert(err, gc.IsNil)
+		c.Assert(n < size, gc.Equals, true)
+	}
+
+	st := mem.NewStorage()
+	r := httprouter.New()
+	handler, err := NewHandler(st, PacketLimits(storage.PacketLimits{MaxKeySize: size - 1}))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	statuses := addKeys(c, srv, halves)
+	c.Assert(statuses, gc.DeepEquals, []int{http.StatusOK, http.StatusUnprocessableEntity})
+
+	keys, err := st.FetchKeys([]string{full.RFingerprint})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	stored, err := storage.KeySize(keys[0])
+	c.Assert(err, gc.IsNil)
+	c.Assert(stored < size, gc.Equals, true)
+}
+
+func (s *HandlerSuite) TestAddPolicyMergedKey(c *gc.C) {
+	full, halves := aliceHalves()
+	n := countSignatures(full)
+	// Neither half of the key has too many signatures, but their union does.
+	for _, key := range halves {
+		c.Assert(countSignatures(key) < n, gc.Equals, true)
+	}
+
+	st := mem.NewStorage()
+	r := httprouter.New()
+	handler, err := NewHandler(st, SubmissionPolicy(MaxSignatures(n-1)))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	statuses := addKeys(c, srv, halves)
+	c.Assert(statuses, gc.DeepEquals, []int{http.StatusOK, http.StatusUnprocessableEntity})
+
+	keys, err := st.FetchKeys([]string{full.RFingerprint})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(countSignatures(keys[0]) < n, gc.Equals, true)
+}
+
+func (s *HandlerSuite) TestMaintenanceMode(c *gc.C) {
+	var m maintenance.Mode
+	m.Enable("Storage upgrade until 18:00 UTC")
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, MaintenanceMode(&m))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_unsigned.asc"))
+	c.Assert(err, gc.IsNil)
+	res, err := http.PostForm(srv.URL+"/pks/add", url.Values{
+		"keytext": []string{string(keytext)},
+	})
+	c.Assert(err, gc.IsNil)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusServiceUnavailable)
+	c.Assert(string(body), gc.Matches, "(?s).*Storage upgrade until 18:00 UTC.*")
+	c.Assert(s.storage.MethodCount("Insert"), gc.Equals, 0)
+	c.Assert(handler.bannerText(), gc.Equals, "Storage upgrade until 18:00 UTC")
+
+	res, err = http.Get(srv.URL + "/pks/lookup?op=get&search=alice@example.com")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Not(gc.Equals), http.StatusServiceUnavailable)
+
+	resp := NewSKSStatsResponse(SKSStatsInfo{}, sks.NewStats(), nil)
+	resp.Banner = handler.bannerText()
+	var buf bytes.Buffer
+	c.Assert(sksStatsTemplate.Execute(&buf, resp), gc.IsNil)
+	c.Assert(buf.String(), gc.Matches, `(?s).*<p class="banner">Storage upgrade until 18:00 UTC</p>.*`)
+
+	m.Disable()
+	c.Assert(handler.bannerText(), gc.Equals, "")
+	res, err = http.PostForm(srv.URL+"/pks/add", url.Values{
+		"keytext": []string{string(keytext)},
+	})
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Not(gc.Equals), http.StatusServiceUnavailable)
+}
+
+func (s *HandlerSuite) TestConditionalGet(c *gc.C) {
+	mtime := time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC)
+	st := mock.NewStorage(
+		mock.Resolve(func([]string) ([]string, error) {
+			return []string{"accd0e320f1cb163a2aa9305257f384b1fc8ef01"}, nil
+		}),
+		mock.FetchKeyrings(func([]string) ([]*storage.Keyring, error) {
+			var keyrings []*storage.Keyring
+			for _, key := range openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")).MustParse() {
+				keyrings = append(keyrings, &storage.Keyring{PrimaryKey: key, MTime: mtime})
+			}
+			return keyrings, nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(st, CacheControl(map[Operation]string{
+		OperationGet: "public, max-age=3600",
+	}))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	get := func(op string, header map[string]string) *http.Response {
+		req, err := http.NewRequest("GET", srv.URL+"/pks/lookup?op="+op+"&search=0x44A2D1DB", nil)
+		c.Assert(err, gc.IsNil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		return res
+	}
+	res := get("get", nil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	etag := res.Header.Get("ETag")
+	c.Assert(etag, gc.Matches, `"[0-9a-f]{32}"`)
+	c.Assert(res.Header.Get("Last-Modified"), gc.Equals, "Wed, 04 Mar 2026 05:06:07 GMT")
+	c.Assert(res.Header.Get("Cache-Control"), gc.Equals, "public, max-age=3600")
+
+	res = get("get", map[string]string{"If-None-Match": etag})
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotModified)
+	res = get("get", map[string]string{"If-None-Match": `"stale", W/` + etag})
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotModified)
+	res = get("get", map[string]string{"If-None-Match": `"stale"`})
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	res = get("get", map[string]string{"If-Modified-Since": "Wed, 04 Mar 2026 05:06:07 GMT"})
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotModified)
+	res = get("get", map[string]string{"If-Modified-Since": "Wed, 04 Mar 2026 05:06:06 GMT"})
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+
+	// Other operations render the same keys differently, and have no
+	// Cache-Control policy configured.
+	res = get("index", map[string]string{"If-None-Match": etag})
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(res.Header.Get("ETag"), gc.Not(gc.Equals), etag)
+	c.Assert(res.Header.Get("Cache-Control"), gc.Equals, "")
+	c.Assert(st.MethodCount("FetchKeys"), gc.Equals, 0)
+}
+
+func (s *HandlerSuite) TestKeyCacheWarmUp(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "popularity.json")
+	err := ioutil.WriteFile(path, []byte(`[{"rfingerprint":"bbbb","count":5},{"rfingerprint":"aaaa","count":1}]`), 0600)
+	c.Assert(err, gc.IsNil)
+
+	st := mock.NewStorage(
+		mock.FetchKeyrings(func(rfps []string) ([]*storage.Keyring, error) {
+			var keyrings []*storage.Keyring
+			for _, rfp := range rfps {
+				key := &openpgp.PrimaryKey{MD5: "md5-" + rfp}
+				key.RFingerprint = rfp
+				keyrings = append(keyrings, &storage.Keyring{PrimaryKey: key})
+			}
+			return keyrings, nil
+		}),
+	)
+	handler, err := NewHandler(st, KeyCache(1, path))
+	c.Assert(err, gc.IsNil)
+	n, err := handler.WarmUp(context.Background())
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	c.Assert(st.MethodCount("FetchKeyrings"), gc.Equals, 1)
+	c.Assert(st.Calls[0].Args, gc.DeepEquals, []interface{}{[]string{"bbbb"}})
+
+	// The most popular key is served from the cache.
+	keys, err := handler.fetchKeys(&Lookup{}, []string{"bbbb"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].RFingerprint, gc.Equals, "bbbb")
+	c.Assert(st.MethodCount("FetchKeyrings"), gc.Equals, 1)
+
+	// Changed keys are fetched again.
+	c.Assert(st.Notify(storage.KeyReplaced{OldDigest: "MD5-BBBB", NewDigest: "md5-cccc"}), gc.IsNil)
+	_, err = handler.fetchKeys(&Lookup{}, []string{"bbbb"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(st.MethodCount("FetchKeyrings"), gc.Equals, 2)
+
+	c.Assert(handler.PopularKeys(0), gc.DeepEquals, []KeyPopularity{
+		{RFingerprint: "bbbb", Count: 7},
+		{RFingerprint: "aaaa", Count: 1},
+	})
+	c.Assert(handler.SavePopularity(), gc.IsNil)
+	handler, err = NewHandler(mock.NewStorage(), KeyCache(1, path))
+	c.Assert(err, gc.IsNil)
+	c.Assert(handler.PopularKeys(1), gc.DeepEquals, []KeyPopularity{{RFingerprint: "bbbb", Count: 7}})
+}
+
+func (s *HandlerSuite) TestDomainStats(c *gc.C) {
+	st := mock.NewStorage(
+		mock.ModifiedSince(func(time.Time) ([]string, error) {
+			return []string{"accd0e320f1cb163a2aa9305257f384b1fc8ef01"}, nil
+		}),
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")).MustParse(), nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(st, DomainStatistics(time.Hour, time.Minute))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/pks/domainstats?domain=Example.com")
+	c.Assert(err, gc.IsNil)
+	var ds DomainStats
+	err = json.NewDecoder(res.Body).Decode(&ds)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(ds.Domain, gc.Equals, "example.com")
+	c.Assert(ds.Keys, gc.Equals, 1)
+	c.Assert(ds.Fresh+ds.Expired+ds.Revoked, gc.Equals, 1)
+	c.Assert(ds.Algorithms, gc.HasLen, 1)
+
+	// Clients are rate limited.
+	res, err = http.Get(srv.URL + "/pks/domainstats?domain=example.org")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusTooManyRequests)
+	c.Assert(st.MethodCount("ModifiedSince"), gc.Equals, 1)
+}
+
+func (s *HandlerSuite) TestEmailDomain(c *gc.C) {
+	for uid, domain := range map[string]string{
+		"alice <alice@example.com>":        "example.com",
+		"Bob Smith <bob@Mail.EXAMPLE.org>": "mail.example.org",
+		"carol@example.net":                "example.net",
+		"Dave (no email)":                  "",
+		"eve <eve@>":                       "",
+	} {
+		c.Check(storage.EmailDomain(uid), gc.Equals, domain, gc.Commentf("%q", uid))
+	}
+	c.Check(storage.EmailAddress("Bob Smith <bob@Mail.EXAMPLE.org>"), gc.Equals, "bob@mail.example.org")
+	c.Check(storage.EmailAddress("Dave (no email)"), gc.Equals, "")
+}
+
+type recordingMailer []string
+
+func (m *recordingMailer) Mail(to []string, subject, body string) error {
+	*m = append(*m, body)
+	return nil
+}
+
+func (s *HandlerSuite) TestVerifyingKeyserver(c *gc.C) {
+	alice := func([]string) ([]string, error) {
+		return []string{"accd0e320f1cb163a2aa9305257f384b1fc8ef01"}, nil
+	}
+	st := mock.NewStorage(
+		mock.Resolve(alice),
+		mock.MatchKeyword(alice),
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")).MustParse(), nil
+		}),
+	)
+	var mails recordingMailer
+	r := httprouter.New()
+	handler, err := NewHandler(st, VerifyingKeyserver(vks.NewMemoryStore(),
+		vks.NewTokens([]byte(strings.Repeat("k", 32)), time.Hour), &mails))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	lookup := func(search string) (int, []*jsonhkp.KeyMetadata) {
+		res, err := http.Get(srv.URL + "/pks/lookup?op=index&options=mr,json&search=" + url.QueryEscape(search))
+		c.Assert(err, gc.IsNil)
+		defer res.Body.Close()
+		var keys []*jsonhkp.KeyMetadata
+		if res.StatusCode == http.StatusOK {
+			c.Assert(json.NewDecoder(res.Body).Decode(&keys), gc.IsNil)
+		}
+		return res.StatusCode, keys
+	}
+	vksPost := func(path string, req interface{}) *vks.UploadResponse {
+		body, err := json.Marshal(req)
+		c.Assert(err, gc.IsNil)
+		res, err := http.Post(srv.URL+path, "application/json", bytes.NewReader(body))
+		c.Assert(err, gc.IsNil)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+		var resp vks.UploadResponse
+		c.Assert(json.NewDecoder(res.Body).Decode(&resp), gc.IsNil)
+		return &resp
+	}
+
+	// Unverified user IDs are stripped, and cannot be searched for.
+	code, keys := lookup("0x23e0dcca")
+	c.Assert(code, gc.Equals, http.StatusOK)
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].UserIDs, gc.HasLen, 0)
+	code, _ = lookup("alice@example.com")
+	c.Assert(code, gc.Equals, http.StatusNotFound)
+
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_signed.asc"))
+	c.Assert(err, gc.IsNil)
+	resp := vksPost("/vks/v1/upload", &vks.UploadRequest{Keytext: string(keytext)})
+	c.Assert(resp.KeyFpr, gc.Equals, "10FE8CF1B483F7525039AA2A361BC1F023E0DCCA")
+	c.Assert(resp.Status, gc.DeepEquals, map[string]string{"alice@example.com": vks.StatusUnpublished})
+
+	resp = vksPost("/vks/v1/request-verify", &vks.VerifyRequest{
+		Token:     resp.Token,
+		Addresses: []string{"alice@example.com", "mallory@example.com"},
+	})
+	c.Assert(resp.Status, gc.DeepEquals, map[string]string{"alice@example.com": vks.StatusPending})
+	c.Assert(mails, gc.HasLen, 1)
+	// Repeated requests do not send more verification emails.
+	resp = vksPost("/vks/v1/request-verify", &vks.VerifyRequest{
+		Token:     resp.Token,
+		Addresses: []string{"alice@example.com"},
+	})
+	c.Assert(resp.Status, gc.DeepEquals, map[string]string{"alice@example.com": vks.StatusPending})
+	c.Assert(mails, gc.HasLen, 1)
+	link := regexp.MustCompile(`http\S+/vks/v1/verify\?token=\S+`).FindString(mails[0])
+	c.Assert(link, gc.Not(gc.Equals), "")
+
+	res, err := http.Get(link)
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	res, err = http.Get(srv.URL + "/vks/v1/verify?token=forged")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+
+	code, keys = lookup("alice@example.com")
+	c.Assert(code, gc.Equals, http.StatusOK)
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].UserIDs, gc.HasLen, 1)
+	c.Assert(keys[0].UserIDs[0].UserID, gc.Equals, "alice <alice@example.com>")
+}
+
+func selfSignedCert(c *gc.C, emails ...string) []byte {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, gc.IsNil)
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(1),
+		Subject:        pkix.Name{CommonName: "alice"},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		EmailAddresses: emails,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	c.Assert(err, gc.IsNil)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func (s *HandlerSuite) TestX509Certificates(c *gc.C) {
+	_, err := NewHandler(s.storage, X509Certificates(vks.NewMemoryStore()))
+	c.Assert(err, gc.ErrorMatches, "X.509 certificates require a verifying keyserver")
+
+	var mails recordingMailer
+	store := vks.NewMemoryStore()
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage,
+		VerifyingKeyserver(store, vks.NewTokens([]byte(strings.Repeat("k", 32)), time.Hour), &mails),
+		X509Certificates(store))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	lookup := func() (int, []byte) {
+		res, err := http.Get(srv.URL + "/x509/v1/lookup?email=Alice%40example.com")
+		c.Assert(err, gc.IsNil)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		c.Assert(err, gc.IsNil)
+		return res.StatusCode, body
+	}
+
+	certPEM := selfSignedCert(c, "alice@example.com")
+	res, err := http.Post(srv.URL+"/x509/v1/upload", "application/x-pem-file", bytes.NewReader(certPEM))
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	var resp vks.CertUploadResponse
+	c.Assert(json.NewDecoder(res.Body).Decode(&resp), gc.IsNil)
+	res.Body.Close()
+	c.Assert(resp.Status, gc.DeepEquals, map[string]string{"alice@example.com": vks.StatusPending})
+	c.Assert(mails, gc.HasLen, 1)
+
+	// Each address is sent verification emails at most once per interval.
+	res, err = http.Post(srv.URL+"/x509/v1/upload", "application/x-pem-file",
+		bytes.NewReader(selfSignedCert(c, "alice@example.com")))
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(json.NewDecoder(res.Body).Decode(&resp), gc.IsNil)
+	res.Body.Close()
+	c.Assert(resp.Status, gc.DeepEquals, map[string]string{"alice@example.com": vks.StatusPending})
+	c.Assert(mails, gc.HasLen, 1)
+
+	// Certificates are not served until their addresses are verified.
+	code, _ := lookup()
+	c.Assert(code, gc.Equals, http.StatusNotFound)
+
+	// Tokens for OpenPGP keys cannot verify certificates.
+	link := regexp.MustCompile(`http\S+/x509/v1/verify\?token=\S+`).FindString(mails[0])
+	c.Assert(link, gc.Not(gc.Equals), "")
+	res, err = http.Get(strings.Replace(link, "/x509/", "/vks/", 1))
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+
+	res, err = http.Get(link)
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+
+	code, body := lookup()
+	c.Assert(code, gc.Equals, http.StatusOK)
+	c.Assert(string(body), gc.Equals, string(certPEM))
+
+	res, err = http.Post(srv.URL+"/x509/v1/upload", "application/x-pem-file", bytes.NewReader(selfSignedCert(c)))
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+}
+
+func (s *HandlerSuite) TestSeedSnapshots(c *gc.C) {
+	_, key, err := ed25519.GenerateKey(nil)
+	c.Assert(err, gc.IsNil)
+	job := seed.NewJob(s.storage, c.MkDir(), key)
+	c.Assert(job.Run(), gc.IsNil)
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, SeedSnapshots(job, time.Hour))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	get := func(rng string) *http.Response {
+		req, err := http.NewRequest("GET", srv.URL+"/pks/seed", nil)
+		c.Assert(err, gc.IsNil)
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		return res
+	}
+	c.Assert(get("").StatusCode, gc.Equals, http.StatusOK)
+	res := get("")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusTooManyRequests)
+	c.Assert(res.Header.Get("Retry-After"), gc.Not(gc.Equals), "")
+	c.Assert(get("bytes=0-").StatusCode, gc.Equals, http.StatusTooManyRequests)
+
+	// Resuming a download is not limited.
+	c.Assert(get("bytes=5-").StatusCode, gc.Equals, http.StatusPartialContent)
+
+	res, err = http.Get(srv.URL + "/pks/seed/manifest")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+}
+
+func hashqueryBody(c *gc.C, digests ...string) *bytes.Buffer {
+	var body bytes.Buffer
+	c.Assert(recon.WriteInt(&body, len(digests)), gc.IsNil)
+	for _, digest := range digests {
+		buf, err := hex.DecodeString(digest)
+		c.Assert(err, gc.IsNil)
+		c.Assert(recon.WriteInt(&body, len(buf)), gc.IsNil)
+		body.Write(buf)
+	}
+	return &body
+}
+
+func (s *HandlerSuite) TestHashQuery(c *gc.C) {
+	alice := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")).MustParse()[0]
+	st := mock.NewStorage(
+		mock.MatchMD5(func([]string) ([]string, error) {
+			return []string{alice.RFingerprint}, nil
+		}),
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return []*openpgp.PrimaryKey{alice}, nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(st, AdvertiseCapabilities(sks.Capabilities{MaxChunkSize: 3}))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	// Keys which do not have the requested digest are not returned, and
+	// keys are not repeated.
+	res, err := http.Post(srv.URL+"/pks/hashquery", "sks/hashquery",
+		hashqueryBody(c, alice.MD5, alice.MD5, "00000000000000000000000000000000"))
+	c.Assert(err, gc.IsNil)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	buf := bytes.NewBuffer(body)
+	n, err := recon.ReadInt(buf)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	keyLen, err := recon.ReadInt(buf)
+	c.Assert(err, gc.IsNil)
+	var keys []*openpgp.PrimaryKey
+	for readKey := range openpgp.ReadKeys(bytes.NewReader(buf.Next(keyLen))) {
+		c.Assert(readKey.Error, gc.IsNil)
+		keys = append(keys, readKey.PrimaryKey)
+	}
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].MD5, gc.Equals, alice.MD5)
+	c.Assert(buf.Bytes(), gc.DeepEquals, []byte("\r\n"))
+
+	// Requests larger than the advertised maximum are rejected.
+	res, err = http.Post(srv.URL+"/pks/hashquery", "sks/hashquery",
+		hashqueryBody(c, alice.MD5, alice.MD5, alice.MD5, alice.MD5))
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusRequestEntityTooLarge)
+}
+
+func (s *HandlerSuite) TestHashQueryMaxSize(c *gc.C) {
+	st := mock.NewStorage()
+	r := httprouter.New()
+	handler, err := NewHandler(st, MaxHashQuerySize(64))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	// Bodies larger than the limit are refused without being read in full.
+	res, err := http.Post(srv.URL+"/pks/hashquery", "sks/hashquery", bytes.NewReader(make([]byte, 1<<20)))
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusRequestEntityTooLarge)
+	c.Assert(st.MethodCount("MatchMD5"), gc.Equals, 0)
+
+	res, err = http.Post(srv.URL+"/pks/hashquery", "sks/hashquery",
+		hashqueryBody(c, "00000000000000000000000000000000"))
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+
+	_, err = NewHandler(st, MaxHashQuerySize(0))
+	c.Assert(err, gc.ErrorMatches, "invalid maximum hashquery size 0")
+}
+
+func (s *HandlerSuite) TestRobots(c *gc.C) {
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, PathPrefix("/hkp"), RobotsTxt(DefaultRobots),
+		ThrottleCrawlers(CrawlerPolicy{UserAgent: "examplebot", Interval: time.Hour}))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/robots.txt")
+	c.Assert(err, gc.IsNil)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(string(body), gc.Equals, DefaultRobots)
+
+	get := func(ua string) *http.Response {
+		req, err := http.NewRequest("GET", srv.URL+"/hkp/pks/lookup?op=index&search=alice", nil)
+		c.Assert(err, gc.IsNil)
+		req.Header.Set("User-Agent", ua)
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		return res
+	}
+	c.Assert(get("Mozilla/5.0 (compatible; ExampleBot/1.0)").StatusCode, gc.Equals, http.StatusOK)
+	res = get("Mozilla/5.0 (compatible; ExampleBot/1.0)")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusTooManyRequests)
+	c.Assert(res.Header.Get("Retry-After"), gc.Not(gc.Equals), "")
+	c.Assert(get("gnupg/2.2").StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(get("gnupg/2.2").StatusCode, gc.Equals, http.StatusOK)
+}
+
+func (s *HandlerSuite) TestHoneypots(c *gc.C) {
+	var hits []HoneypotHit
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, Honeypots(
+		[]string{"0x10FE8CF1B483F7525039AA2A361BC1F023E0DCCA"},
+		func(hit HoneypotHit) { hits = append(hits, hit) }))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/pks/lookup?op=index&search=example.com")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(hits, gc.HasLen, 1)
+	c.Assert(hits[0].Fingerprint, gc.Equals, "10fe8cf1b483f7525039aa2a361bc1f023e0dcca")
+	c.Assert(hits[0].Op, gc.Equals, OperationIndex)
+	c.Assert(hits[0].Search, gc.Equals, "example.com")
+	c.Assert(handler.HoneypotHits(hits[0].ClientIP), gc.Equals, 1)
+	c.Assert(handler.HoneypotHits(net.ParseIP("192.0.2.1")), gc.Equals, 0)
+}
+
+func (s *HandlerSuite) TestTakedowns(c *gc.C) {
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, Takedowns([]Takedown{{
+		Fingerprint: "0x10FE8CF1B483F7525039AA2A361BC1F023E0DCCA",
+		Reason:      "court-order",
+		Authority:   "https://court.example.com/",
+		Message:     "Withheld by order of the court.",
+	}}))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	get := func(query string) (*http.Response, []byte) {
+		res, err := http.Get(srv.URL + "/pks/lookup?" + query)
+		c.Assert(err, gc.IsNil)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		c.Assert(err, gc.IsNil)
+		return res, body
+	}
+
+	res, body := get("op=get&search=0x23e0dcca")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusUnavailableForLegalReasons)
+	c.Assert(res.Header.Get("Link"), gc.Equals, `<https://court.example.com/>; rel="blocked-by"`)
+	c.Assert(string(body), gc.Matches, "(?s).*Withheld by order of the court.*")
+
+	res, body = get("op=index&options=mr,json&search=alice")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusUnavailableForLegalReasons)
+	var resp TakedownResponse
+	c.Assert(json.Unmarshal(body, &resp), gc.IsNil)
+	c.Assert(resp.Reason, gc.Equals, "court-order")
+	c.Assert(resp.Authority, gc.Equals, "https://court.example.com/")
+
+	// Keys taken down cannot be submitted again.
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_signed.asc"))
+	c.Assert(err, gc.IsNil)
+	res, err = http.PostForm(srv.URL+"/pks/add", url.Values{
+		"keytext": []string{string(keytext)},
+	})
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusUnavailableForLegalReasons)
+	c.Assert(s.storage.MethodCount("Insert"), gc.Equals, 0)
+	c.Assert(s.storage.MethodCount("Update"), gc.Equals, 0)
+
+	_, err = NewHandler(s.storage, Takedowns([]Takedown{{Fingerprint: "0x23e0dcca"}}))
+	c.Assert(err, gc.ErrorMatches, `takedown of .* requires a reason`)
+}
+
+func (s *HandlerSuite) TestHealthChecks(c *gc.C) {
+	var reconErr error
+	st := mock.NewStorage(mock.MatchMD5(func([]string) ([]string, error) {
+		return nil, errgo.New("connection refused")
+	}))
+	check := func(st storage.Storage, path string) (int, *HealthResponse) {
+		r := httprouter.New()
+		handler, err := NewHandler(st, HealthChecks(map[string]HealthCheck{
+			"recon": func(context.Context) error { return reconErr },
+		}))
+		c.Assert(err, gc.IsNil)
+		handler.Register(r)
+		srv := httptest.NewServer(r)
+		defer srv.Close()
+		res, err := http.Get(srv.URL + path)
+		c.Assert(err, gc.IsNil)
+		defer res.Body.Close()
+		var resp HealthResponse
+		c.Assert(json.NewDecoder(res.Body).Decode(&resp), gc.IsNil)
+		return res.StatusCode, &resp
+	}
+
+	code, resp := check(s.storage, "/readyz")
+	c.Assert(code, gc.Equals, http.StatusOK)
+	c.Assert(resp, gc.DeepEquals, &HealthResponse{Status: HealthOK, Checks: map[string]*HealthStatus{
+		"storage": {Status: HealthOK},
+		"recon":   {Status: HealthOK},
+	}})
+
+	// A failing subsystem makes the node unready, but still alive.
+	reconErr = errgo.New("recon is stopped")
+	code, resp = check(s.storage, "/readyz")
+	c.Assert(code, gc.Equals, http.StatusServiceUnavailable)
+	c.Assert(resp.Checks["recon"], gc.DeepEquals, &HealthStatus{Status: HealthFail, Error: "recon is stopped"})
+	code, _ = check(s.storage, "/healthz")
+	c.Assert(code, gc.Equals, http.StatusOK)
+
+	// Unreachable storage fails both.
+	code, resp = check(st, "/healthz")
+	c.Assert(code, gc.Equals, http.StatusServiceUnavailable)
+	c.Assert(resp.Checks["storage"].Error, gc.Equals, "connection refused")
+}
+
+func (s *HandlerSuite) TestSplitHorizon(c *gc.C) {
+	alice := func([]string) ([]string, error) {
+		return []string{"accd0e320f1cb163a2aa9305257f384b1fc8ef01"}, nil
+	}
+	st := mock.NewStorage(
+		mock.Resolve(alice),
+		mock.MatchKeyword(alice),
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")).MustParse(), nil
+		}),
+	)
+	handler, err := NewHandler(st,
+		VerifyingKeyserver(vks.NewMemoryStore(), vks.NewTokens([]byte(strings.Repeat("k", 32)), time.Hour), nil),
+		SplitHorizon([]Horizon{{
+			Name:       "internal",
+			Networks:   []string{"10.0.0.0/8"},
+			Unverified: true,
+		}, {
+			Name:        "partner",
+			Networks:    []string{"192.0.2.1"},
+			Unverified:  true,
+			HideDomains: []string{"example.com"},
+		}}))
+	c.Assert(err, gc.IsNil)
+
+	keys := func(ip, search string) []*openpgp.PrimaryKey {
+		keys, err := handler.keys(&Lookup{Op: OperationIndex, Search: search, ClientIP: net.ParseIP(ip)})
+		c.Assert(err, gc.IsNil)
+		return keys
+	}
+	// Internal clients see unverified user IDs, external clients do not.
+	c.Assert(keys("10.1.2.3", "alice"), gc.HasLen, 1)
+	c.Assert(keys("10.1.2.3", "alice")[0].UserIDs, gc.HasLen, 1)
+	c.Assert(keys("198.51.100.1", "alice"), gc.HasLen, 0)
+
+	// User IDs at hidden domains are neither served nor searchable.
+	c.Assert(keys("192.0.2.1", "alice"), gc.HasLen, 0)
+	found := keys("192.0.2.1", "0x23e0dcca")
+	c.Assert(found, gc.HasLen, 1)
+	c.Assert(found[0].UserIDs, gc.HasLen, 0)
+
+	_, err = NewHandler(st, SplitHorizon([]Horizon{{Name: "bad", Networks: []string{"10.0.0.0/33"}}}))
+	c.Assert(err, gc.ErrorMatches, `invalid network in horizon "bad": .*`)
+}
+
+func (s *HandlerSuite) TestSearchBudget(c *gc.C) {
+	defer func(n int) { searchChunkSize = n }(searchChunkSize)
+	searchChunkSize = 1
+	st := mock.NewStorage(
+		mock.MatchKeyword(func([]string) ([]string, error) {
+			return []string{"a", "b", "c"}, nil
+		}),
+		mock.FetchKeys(func(rfps []string) ([]*openpgp.PrimaryKey, error) {
+			// The first chunk takes longer than the whole budget.
+			time.Sleep(30 * time.Millisecond)
+			return []*openpgp.PrimaryKey{{PublicKey: openpgp.PublicKey{RFingerprint: rfps[0]}}}, nil
+		}),
+	)
+	handler, err := NewHandler(st, SearchBudget(10*time.Millisecond))
+	c.Assert(err, gc.IsNil)
+
+	l := &Lookup{Op: OperationIndex, Search: "alice", deadline: time.Now().Add(10 * time.Millisecond)}
+	keys, err := handler.keys(l)
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].RFingerprint, gc.Equals, "a")
+	c.Assert(l.Truncated, gc.Equals, true)
+	c.Assert(st.MethodCount("FetchKeys"), gc.Equals, 1)
+
+	// Without a deadline, all keys are fetched at once.
+	l = &Lookup{Op: OperationIndex, Search: "alice"}
+	_, err = handler.keys(l)
+	c.Assert(err, gc.IsNil)
+	c.Assert(l.Truncated, gc.Equals, false)
+	c.Assert(st.MethodCount("FetchKeys"), gc.Equals, 2)
+}
+
+// slowIndexer is a search engine which answers no searches before their
+// context is done.
+type slowIndexer struct {
+	search.Indexer
+}
+
+func (slowIndexer) Search(ctx context.Context, query string) ([]string, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (s *HandlerSuite) TestSearchBudgetSearchEngine(c *gc.C) {
+	handler, err := NewHandler(s.storage, SearchBudget(10*time.Millisecond), SearchEngine(slowIndexer{}))
+	c.Assert(err, gc.IsNil)
+	l := &Lookup{Op: OperationIndex, Search: "alice", deadline: time.Now().Add(10 * time.Millisecond)}
+	rfps, err := handler.resolve(l)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+	c.Assert(l.Truncated, gc.Equals, true)
+}
+
+func (s *HandlerSuite) TestQueryStatistics(c *gc.C) {
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, QueryStatistics())
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	for _, query := range []string{"op=get&search=0x23e0dcca", "op=get&search=0x23e0dcca", "op=index&search=alice%40example.com"} {
+		res, err := http.Get(srv.URL + "/pks/lookup?" + query)
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+	}
+
+	res, err := http.Get(srv.URL + "/pks/debug/queries")
+	c.Assert(err, gc.IsNil)
+	defer res.Body.Close()
+	var stats []QueryShapeStats
+	c.Assert(json.NewDecoder(res.Body).Decode(&stats), gc.IsNil)
+	counts := map[string]int{}
+	for _, stat := range stats {
+		c.Assert(stat.Index, gc.Equals, "")
+		counts[stat.Shape] = stat.Count
+	}
+	c.Assert(counts, gc.DeepEquals, map[string]int{
+		storage.ShapeShortKeyID: 2,
+		storage.ShapeEmail:      1,
+	})
+}
+
+// fakeSearchEngine records queries and matches every key.
+type fakeSearchEngine struct {
+	queries []string
+}
+
+func (*fakeSearchEngine) Index(context.Context, []*search.Document) error { return nil }
+func (*fakeSearchEngine) Remove(context.Context, []string) error          { return nil }
+func (e *fakeSearchEngine) Search(_ context.Context, query string) ([]string, error) {
+	e.queries = append(e.queries, query)
+	return []string{"accd0e320f1cb163a2aa9305257f384b1fc8ef01"}, nil
+}
+
+func (s *HandlerSuite) TestSearchEngine(c *gc.C) {
+	engine := &fakeSearchEngine{}
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, SearchEngine(engine))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	for _, query := range []string{"op=index&search=alcie", "op=get&search=alice"} {
+		res, err := http.Get(srv.URL + "/pks/lookup?" + query)
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+	}
+	// Only index searches are routed to the search engine.
+	c.Assert(engine.queries, gc.DeepEquals, []string{"alcie"})
+	c.Assert(s.storage.MethodCount("MatchKeyword"), gc.Equals, 1)
+}
+
+func (s *HandlerSuite) TestFuzzySearch(c *gc.C) {
+	const uid = "Alice Lovelace <alice@example.com>"
+	c.Assert(storage.FuzzyOptions{}.Match("alise lovelace", uid), gc.Equals, true)
+	c.Assert(storage.FuzzyOptions{}.Match("bob", uid), gc.Equals, false)
+	c.Assert(storage.FuzzyOptions{}.Match("loveless", uid), gc.Equals, false)
+	c.Assert(storage.FuzzyOptions{Phonetic: true}.Match("loveless", uid), gc.Equals, true)
+
+	st := mock.NewStorage(
+		mock.MatchFuzzy(func(search []string, opts storage.FuzzyOptions) ([]string, error) {
+			if opts.Match(search[0], uid) {
+				return []string{"accd0e320f1cb163a2aa9305257f384b1fc8ef01"}, nil
+			}
+			return nil, nil
+		}),
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")).MustParse(), nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(st, FuzzySearch(storage.FuzzyOptions{}))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/pks/lookup?op=index&options=mr&search=alise")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.Header.Get("X-HKP-Approximate"), gc.Equals, "true")
+	c.Assert(st.MethodCount("MatchFuzzy"), gc.Equals, 1)
+
+	// Exact searches and key retrievals are never approximate.
+	for _, query := range []string{"op=index&exact=on&search=alise", "op=get&search=alise"} {
+		res, err := http.Get(srv.URL + "/pks/lookup?" + query)
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+		c.Assert(res.Header.Get("X-HKP-Approximate"), gc.Equals, "")
+	}
+	c.Assert(st.MethodCount("MatchFuzzy"), gc.Equals, 1)
+	c.Assert(st.MethodCount("MatchKeyword"), gc.Equals, 3)
+}
+
+func (s *HandlerSuite) TestIDNEmailSearch(c *gc.C) {
+	res, err := http.Get(s.srv.URL + "/pks/lookup?op=index&search=alice@b%C3%BCcher.de")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	// The address is searched for with its domain in both forms.
+	var searches []string
+	for _, call := range s.storage.Calls {
+		if call.Name == "MatchKeyword" {
+			searches = append(searches, call.Args[0].([]string)...)
+		}
+	}
+	c.Assert(searches, gc.DeepEquals, []string{"alice@bücher.de", "alice@xn--bcher-kva.de"})
+}
+
+func (s *HandlerSuite) TestUIDNormalization(c *gc.C) {
+	_, err := storage.ParseUIDPipeline("fold-case", "soundex")
+	c.Assert(err, gc.ErrorMatches, `unknown user ID normalization step "soundex"`)
+	p, err := storage.ParseUIDPipeline("fold-case", "whitespace", "strip-comments", "rfc2822")
+	c.Assert(err, gc.IsNil)
+	c.Assert(p.Normalize(`"Alice  Lovelace" (work) <Alice@Example.com>`), gc.Equals, "alice lovelace <alice@example.com>")
+	c.Assert(p.Contains("Alice (work) <alice@example.com>", "ALICE <alice@example.com>"), gc.Equals, true)
+	c.Assert(storage.DefaultUIDPipeline.Contains("Alice (work) <alice@example.com>", "ALICE <alice@example.com>"), gc.Equals, false)
+
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, UIDNormalization(p))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/pks/lookup?op=index&search=" + url.QueryEscape("  Alice   LOVELACE "))
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	var searches []string
+	for _, call := range s.storage.Calls {
+		if call.Name == "MatchKeyword" {
+			searches = append(searches, call.Args[0].([]string)...)
+		}
+	}
+	c.Assert(searches, gc.DeepEquals, []string{"alice lovelace"})
+}
+
+func (s *HandlerSuite) TestSKSStats(c *gc.C) {
+	stats := sks.NewStats()
+	stats.Total = 42
+	thisHour := time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC)
+	stats.Hourly[thisHour] = &sks.LoadStat{Inserted: 2, Updated: 1}
+	stats.Daily[thisHour.Truncate(24*time.Hour)] = &sks.LoadStat{Inserted: 5}
+	stats.Peers["pgp.example.org"] = &sks.PeerStat{Recovered: 7}
+	resp := NewSKSStatsResponse(SKSStatsInfo{
+		Hostname:  "keys.example.com",
+		Version:   "2.1.0",
+		HTTPAddr:  ":11371",
+		ReconAddr: ":11370",
+	}, stats, recon.PartnerMap{
+		"peer": {HTTPAddr: "pgp.example.org:11371", ReconAddr: "pgp.example.org:11370"},
+	})
+	c.Assert(resp.Peers, gc.HasLen, 1)
+	c.Assert(resp.Peers[0].Stats.Recovered, gc.Equals, 7)
+
+	var buf bytes.Buffer
+	c.Assert(sksStatsTemplate.Execute(&buf, resp), gc.IsNil)
+	for _, s := range []string{
+		"<tr><td>Hostname:</td><td>keys.example.com</td></tr>",
+		"<tr><td>Version:</td><td>2.1.0</td></tr>",
+		"<tr><td>HTTP port:</td><td>11371</td></tr>",
+		"<tr><td>Recon port:</td><td>11370</td></tr>",
+		"<tr><td>pgp.example.org 11370</td></tr>",
+		"<p>Total number of keys: 42</p>",
+		"<tr><td>2026-01-02 03</td><td>2</td><td>1</td></tr>",
+		"<tr><td>2026-01-02</td><td>5</td><td>0</td></tr>",
+	} {
+		c.Assert(strings.Contains(buf.String(), s), gc.Equals, true, gc.Commentf("%s", s))
+	}
+
+	out, err := json.Marshal(resp)
+	c.Assert(err, gc.IsNil)
+	var doc map[string]interface{}
+	c.Assert(json.Unmarshal(out, &doc), gc.IsNil)
+	c.Assert(doc["numkeys"], gc.Equals, 42.0)
+	c.Assert(doc["software"], gc.Equals, "Hockeypuck")
+}
+
+func (s *HandlerSuite) TestRateLimits(c *gc.C) {
+	_, err := NewHandler(s.storage, RateLimits(map[string]RateLimit{"stats": {Rate: 1, Burst: 1}}))
+	c.Assert(err, gc.ErrorMatches, `cannot rate limit unknown endpoint "stats"`)
+
+	tb := newTokenBuckets(RateLimit{Rate: 2, Burst: 2})
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		ok, _ := tb.allow("192.0.2.1", now)
+		c.Assert(ok, gc.Equals, true)
+	}
+	ok, wait := tb.allow("192.0.2.1", now)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(wait, gc.Equals, 500*time.Millisecond)
+	ok, _ = tb.allow("192.0.2.2", now)
+	c.Assert(ok, gc.Equals, true)
+	ok, _ = tb.allow("192.0.2.1", now.Add(wait))
+	c.Assert(ok, gc.Equals, true)
+
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, RateLimits(map[string]RateLimit{
+		EndpointLookup: {Rate: 0.1, Burst: 2},
+	}))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	for i := 0; i < 3; i++ {
+		res, err := http.Get(srv.URL + "/pks/lookup?op=get&search=0x23e0dcca")
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		if i < 2 {
+			c.Assert(res.StatusCode, gc.Not(gc.Equals), http.StatusTooManyRequests)
+		} else {
+			c.Assert(res.StatusCode, gc.Equals, http.StatusTooManyRequests)
+			c.Assert(res.Header.Get("Retry-After"), gc.Equals, "10")
+		}
+	}
+	// Other endpoints are not limited.
+	res, err := http.Post(srv.URL+"/pks/hashquery", "sks/hashquery", bytes.NewReader(nil))
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Not(gc.Equals), http.StatusTooManyRequests)
+
+	// The verifying keyserver's endpoints share a limit.
+	var mails recordingMailer
+	r = httprouter.New()
+	handler, err = NewHandler(s.storage,
+		RateLimits(map[string]RateLimit{EndpointVKS: {Rate: 0.1, Burst: 1}}),
+		VerifyingKeyserver(vks.NewMemoryStore(), vks.NewTokens([]byte(strings.Repeat("k", 32)), time.Hour), &mails))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	vksSrv := httptest.NewServer(r)
+	defer vksSrv.Close()
+	for i, path := range []string{"/vks/v1/upload", "/vks/v1/request-verify"} {
+		res, err := http.Post(vksSrv.URL+path, "application/json", strings.NewReader("{}"))
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		if i == 0 {
+			c.Assert(res.StatusCode, gc.Not(gc.Equals), http.StatusTooManyRequests)
+		} else {
+			c.Assert(res.StatusCode, gc.Equals, http.StatusTooManyRequests)
+		}
+	}
+}
+
+func (s *HandlerSuite) TestIntervalLimiter(c *gc.C) {
+	l := newIntervalLimiter(time.Minute)
+	now := time.Now()
+	ok, _ := l.allow("192.0.2.1", now)
+	c.Assert(ok, gc.Equals, true)
+	ok, wait := l.allow("192.0.2.1", now.Add(20*time.Second))
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(wait, gc.Equals, 40*time.Second)
+	ok, _ = l.allow("192.0.2.2", now.Add(30*time.Second))
+	c.Assert(ok, gc.Equals, true)
+
+	// Clients are allowed again after the interval, before they are pruned.
+	ok, _ = l.allow("192.0.2.1", now.Add(time.Minute))
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(l.last, gc.HasLen, 2)
+
+	// Clients are pruned at most once per interval.
+	ok, _ = l.allow("192.0.2.3", now.Add(90*time.Second))
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(l.last, gc.HasLen, 3)
+	ok, _ = l.allow("192.0.2.3", now.Add(3*time.Minute))
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(l.last, gc.HasLen, 1)
+}
+
+func (s *HandlerSuite) TestKeyFreshness(c *gc.C) {
+	f := &freshness{size: 2, entries: map[string]*list.Element{}, order: list.New()}
+	f.observe(storage.KeyAdded{Digest: "AAAA"})
+	f.added(storage.KeyAdded{Digest: "aaaa"})
+	update, ok := f.lookup(&openpgp.PrimaryKey{MD5: "aaaa"})
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(update.Source, gc.Equals, sks.SourceAdd)
+
+	// Notification of a change submitted to this server does not replace
+	// its source.
+	f.observe(storage.KeyAdded{Digest: "aaaa"})
+	update, _ = f.lookup(&openpgp.PrimaryKey{MD5: "aaaa"})
+	c.Assert(update.Source, gc.Equals, sks.SourceAdd)
+
+	f.observe(storage.KeyReplaced{OldDigest: "aaaa", NewDigest: "bbbb"})
+	f.observe(storage.KeyAdded{Digest: "cccc"})
+	_, ok = f.lookup(&openpgp.PrimaryKey{MD5: "aaaa"})
+	c.Assert(ok, gc.Equals, false)
+	update, ok = f.lookup(&openpgp.PrimaryKey{MD5: "bbbb"})
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(update.Source, gc.Equals, sks.SourceRecon)
+
+	keys := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")).MustParse()
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, KeyFreshness(10))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/pks/lookup?op=get&search=0x23e0dcca")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.Header.Get("X-HKP-Key-Source"), gc.Equals, "")
+
+	updated := time.Now().Add(-time.Hour).Truncate(time.Second)
+	handler.freshness.record(keys[0].MD5, KeyUpdate{Time: updated, Source: sks.SourceRecon}, false)
+	res, err = http.Get(srv.URL + "/pks/lookup?op=get&search=0x23e0dcca")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(res.Header.Get("X-HKP-Key-Updated"), gc.Equals, updated.UTC().Format(http.TimeFormat))
+	c.Assert(res.Header.Get("X-HKP-Key-Source"), gc.Equals, sks.SourceRecon)
+
+	res, err = http.Get(srv.URL + "/pks/lookup?op=index&options=mr,json&search=0x23e0dcca")
+	c.Assert(err, gc.IsNil)
+	var meta []*jsonhkp.KeyMetadata
+	err = json.NewDecoder(res.Body).Decode(&meta)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(meta, gc.HasLen, 1)
+	c.Assert(meta[0].Updated, gc.Equals, updated.UTC().Format(time.RFC3339))
+	c.Assert(meta[0].UpdateSource, gc.Equals, sks.SourceRecon)
+}
+
+func (s *HandlerSuite) TestIdempotencyKeys(c *gc.C) {
+	_, err := NewHandler(s.storage, IdempotencyKeys(0, time.Hour))
+	c.Assert(err, gc.ErrorMatches, `invalid idempotency key size 0 or TTL 1h0m0s`)
+
+	m := &idempotency{size: 2, ttl: time.Hour, entries: map[string]*list.Element{}, order: list.New()}
+	now := time.Now()
+	result, err := m.begin("a", []byte("alice"), now)
+	c.Assert(err, gc.IsNil)
+	c.Assert(result, gc.IsNil)
+	_, err = m.begin("a", []byte("alice"), now)
+	c.Assert(err, gc.Equals, errIdempotencyInProgress)
+	_, err = m.begin("a", []byte("bob"), now)
+	c.Assert(err, gc.Equals, errIdempotencyMismatch)
+
+	// Failed submissions may be retried.
+	m.end("a", nil, now)
+	_, err = m.begin("a", []byte("alice"), now)
+	c.Assert(err, gc.IsNil)
+	m.end("a", &AddResponse{Ignored: []string{"alice"}}, now)
+	result, err = m.begin("a", []byte("alice"), now)
+	c.Assert(err, gc.IsNil)
+	c.Assert(result, gc.DeepEquals, &AddResponse{Ignored: []string{"alice"}})
+
+	// Results expire.
+	result, err = m.begin("a", []byte("alice"), now.Add(time.Hour))
+	c.Assert(err, gc.IsNil)
+	c.Assert(result, gc.IsNil)
+
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_unsigned.asc"))
+	c.Assert(err, gc.IsNil)
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, IdempotencyKeys(10, time.Hour))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	add := func(key, keytext string) *http.Response {
+		req, err := http.NewRequest("POST", srv.URL+"/pks/add", strings.NewReader(url.Values{
+			"keytext": []string{keytext},
+		}.Encode()))
+		c.Assert(err, gc.IsNil)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Idempotency-Key", key)
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, gc.IsNil)
+		return res
+	}
+
+	for i := 0; i < 2; i++ {
+		res := add("retried", string(keytext))
+		var addRes AddResponse
+		err = json.NewDecoder(res.Body).Decode(&addRes)
+		res.Body.Close()
+		c.Assert(err, gc.IsNil)
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+		c.Assert(addRes.Ignored, gc.HasLen, 1)
+		c.Assert(res.Header.Get("Idempotent-Replayed") == "true", gc.Equals, i > 0)
+	}
+	c.Assert(s.storage.MethodCount("FetchKeys"), gc.Equals, 1)
+
+	keytext, err = ioutil.ReadAll(testing.MustInput("alice_signed.asc"))
+	c.Assert(err, gc.IsNil)
+	res := add("retried", string(keytext))
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusUnprocessableEntity)
+	res = add(strings.Repeat("x", maxIdempotencyKeyLen+1), string(keytext))
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+}
+
+func (s *HandlerSuite) TestMirrorMode(c *gc.C) {
+	_, err := NewHandler(s.storage, MirrorMode(""))
+	c.Assert(err, gc.ErrorMatches, "empty mirror token")
+
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, MirrorMode("peer"))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	add := func(token, keytext string) *http.Response {
+		req, err := http.NewRequest("POST", srv.URL+"/pks/add", strings.NewReader(url.Values{
+			"keytext": []string{keytext},
+		}.Encode()))
+		c.Assert(err, gc.IsNil)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		return res
+	}
+
+	for _, token := range []string{"", "stranger"} {
+		res := add(token, "")
+		c.Assert(res.StatusCode, gc.Equals, http.StatusForbidden)
+	}
+	c.Assert(s.storage.MethodCount("FetchKeys"), gc.Equals, 0)
+
+	// Mirrors still serve recon partners.
+	res, err := http.Post(srv.URL+"/pks/hashquery", "sks/hashquery", bytes.NewReader(nil))
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Not(gc.Equals), http.StatusForbidden)
+
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_unsigned.asc"))
+	c.Assert(err, gc.IsNil)
+	res = add("peer", string(keytext))
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+}
+
+func (s *HandlerSuite) TestUploadQuotas(c *gc.C) {
+	_, err := NewHandler(s.storage, UploadQuotas(UploadQuota{}))
+	c.Assert(err, gc.ErrorMatches, `invalid upload quota .*`)
+	_, err = NewHandler(s.storage, Principals(map[string]string{"alice": ""}))
+	c.Assert(err, gc.ErrorMatches, `invalid principal "alice"`)
+
+	handler, err := NewHandler(s.storage, Principals(map[string]string{"alice": "secret"}),
+		UploadQuotas(UploadQuota{Keys: 2, Bytes: 100}))
+	c.Assert(err, gc.IsNil)
+	req, err := http.NewRequest("POST", "/pks/add", nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(handler.principal(req), gc.Equals, "")
+	req.Header.Set("Authorization", "Bearer wrong")
+	c.Assert(handler.principal(req), gc.Equals, "")
+	req.Header.Set("Authorization", "Bearer secret")
+	c.Assert(handler.principal(req), gc.Equals, "alice")
+
+	q := handler.quotas
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	u, ok := q.reserve("alice", 60, now)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(u, gc.Equals, quotaUsage{bytes: 60})
+	_, ok = q.reserve("alice", 60, now)
+	c.Assert(ok, gc.Equals, false)
+	_, ok = q.reserve("bob", 60, now)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(q.count("alice", 2, now), gc.Equals, quotaUsage{keys: 2, bytes: 60})
+	_, ok = q.reserve("alice", 1, now)
+	c.Assert(ok, gc.Equals, false)
+
+	w := httptest.NewRecorder()
+	q.setHeaders(w, quotaUsage{keys: 2, bytes: 60}, now)
+	c.Assert(w.Header().Get("X-Upload-Quota-Keys-Remaining"), gc.Equals, "0")
+	c.Assert(w.Header().Get("X-Upload-Quota-Bytes-Remaining"), gc.Equals, "40")
+	c.Assert(w.Header().Get("X-Upload-Quota-Reset"), gc.Equals, "Sat, 17 Oct 2026 00:00:00 GMT")
+
+	// Quotas reset daily.
+	u, ok = q.reserve("alice", 1, now.Add(12*time.Hour))
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(u, gc.Equals, quotaUsage{bytes: 1})
+
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_unsigned.asc"))
+	c.Assert(err, gc.IsNil)
+	r := httprouter.New()
+	handler, err = NewHandler(s.storage, Principals(map[string]string{"alice": "secret"}),
+		UploadQuotas(UploadQuota{Keys: 1}))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	for i, status := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req, err := http.NewRequest("POST", srv.URL+"/pks/add", strings.NewReader(url.Values{
+			"keytext": []string{string(keytext)},
+		}.Encode()))
+		c.Assert(err, gc.IsNil)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer secret")
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, status, gc.Commentf("submission %d", i))
+		c.Assert(res.Header.Get("X-Upload-Quota-Keys-Remaining"), gc.Equals, "0")
+	}
+}
+
+func (s *HandlerSuite) TestUploadQuotasPartialFailure(c *gc.C) {
+	// The first key is stored, and the second cannot be.
+	var inserted int
+	st := mock.NewStorage(
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return nil, storage.ErrKeyNotFound
+		}),
+		mock.Insert(func(keys []*openpgp.PrimaryKey) (int, error) {
+			inserted++
+			if inserted > 1 {
+				return 0, errgo.New("storage is full")
+			}
+			return len(keys), nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(st, Principals(map[string]string{"alice": "secret"}),
+		UploadQuotas(UploadQuota{Keys: 1}))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_unsigned.asc"))
+	c.Assert(err, gc.IsNil)
+	keydata, err := DecodeKeytext(string(keytext))
+	c.Assert(err, gc.IsNil)
+	keydata = append(keydata, keydata...)
+	add := func() int {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, err := mw.CreateFormFile("keyfile", "alice.gpg")
+		c.Assert(err, gc.IsNil)
+		_, err = fw.Write(keydata)
+		c.Assert(err, gc.IsNil)
+		c.Assert(mw.Close(), gc.IsNil)
+		req, err := http.NewRequest("POST", srv.URL+"/pks/add", &body)
+		c.Assert(err, gc.IsNil)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Header.Set("Authorization", "Bearer secret")
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	c.Assert(add(), gc.Equals, http.StatusInternalServerError)
+	// The key stored was charged, so the quota is used up.
+	c.Assert(add(), gc.Equals, http.StatusTooManyRequests)
+	c.Assert(inserted, gc.Equals, 2)
+}
+
+func (s *HandlerSuite) TestUploadQuotasVKS(c *gc.C) {
+	var mails recordingMailer
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, Principals(map[string]string{"alice": "secret"}),
+		UploadQuotas(UploadQuota{Bytes: 1}),
+		VerifyingKeyserver(vks.NewMemoryStore(), vks.NewTokens([]byte(strings.Repeat("k", 32)), time.Hour), &mails))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_unsigned.asc"))
+	c.Assert(err, gc.IsNil)
+	body, err := json.Marshal(&vks.UploadRequest{Keytext: string(keytext)})
+	c.Assert(err, gc.IsNil)
+	req, err := http.NewRequest("POST", srv.URL+"/vks/v1/upload", bytes.NewReader(body))
+	c.Assert(err, gc.IsNil)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer secret")
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusTooManyRequests)
+	c.Assert(s.storage.MethodCount("Insert"), gc.Equals, 0)
+	c.Assert(s.storage.MethodCount("Update"), gc.Equals, 0)
+}
+
+func (s *HandlerSuite) TestSubmit(c *gc.C) {
+	handler, err := NewHandler(s.storage)
+	c.Assert(err, gc.IsNil)
+	_, err = handler.Submit(context.Background(), "not a key")
+	c.Assert(err, gc.NotNil)
+	se, ok := errgo.Cause(err).(*SubmitError)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(se.Status, gc.Equals, http.StatusBadRequest)
+	c.Assert(se.Temporary(), gc.Equals, false)
+
+	handler, err = NewHandler(s.storage, MirrorMode())
+	c.Assert(err, gc.IsNil)
+	_, err = handler.Submit(context.Background(), "not a key")
+	c.Assert(errgo.Cause(err).(*SubmitError).Status, gc.Equals, http.StatusForbidden)
+
+	c.Assert((&AddResponse{Inserted: []string{"0x01"}, Ignored: []string{"0x02"}}).String(),
+		gc.Equals, "inserted 0x01\nignored 0x02")
+
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_unsigned.asc"))
+	c.Assert(err, gc.IsNil)
+	handler, err = NewHandler(s.storage)
+	c.Assert(err, gc.IsNil)
+	result, err := handler.Submit(context.Background(), string(keytext))
+	c.Assert(err, gc.IsNil)
+	c.Assert(result.Ignored, gc.HasLen, 1)
+}
@@ -0,0 +1,141 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+	log "gopkg.in/hockeypuck/logrus.v0"
+)
+
+// HealthCheck returns why a subsystem is unhealthy, or nil if it is healthy,
+// such as sks.Peer.CheckPrefixTree.
+type HealthCheck func(ctx context.Context) error
+
+// healthCheckTimeout limits how long each health check may take.
+const healthCheckTimeout = 5 * time.Second
+
+const (
+	HealthOK   = "ok"
+	HealthFail = "fail"
+)
+
+// HealthStatus is the status of a single subsystem.
+type HealthStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// HealthResponse is the response to a health or readiness probe.
+type HealthResponse struct {
+	Status string                   `json:"status"`
+	Checks map[string]*HealthStatus `json:"checks"`
+}
+
+// HealthChecks serves /healthz and /readyz, which check storage
+// connectivity and each of the given subsystems, such as "ptree" and
+// "recon".
+//
+// Both respond with the status of every subsystem. /readyz responds 503
+// Service Unavailable if any subsystem is failing, so that load balancers
+// take the node out of rotation. /healthz only does so if storage is
+// unreachable, as other subsystems recover on their own and restarting the
+// process would not help.
+func HealthChecks(checks map[string]HealthCheck) HandlerOption {
+	return func(h *Handler) error {
+		h.healthChecks = map[string]HealthCheck{
+			"storage": func(ctx context.Context) error {
+				return storage.Ping(ctx, h.storage)
+			},
+		}
+		for name, check := range checks {
+			h.healthChecks[name] = check
+		}
+		return nil
+	}
+}
+
+// checkHealth runs every health check concurrently, and returns their
+// statuses.
+func (h *Handler) checkHealth(ctx context.Context) map[string]*HealthStatus {
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result, len(h.healthChecks))
+	for name, check := range h.healthChecks {
+		go func(name string, check HealthCheck) {
+			ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			defer cancel()
+			results <- result{name, check(ctx)}
+		}(name, check)
+	}
+	statuses := map[string]*HealthStatus{}
+	for range h.healthChecks {
+		r := <-results
+		if r.err != nil {
+			statuses[r.name] = &HealthStatus{Status: HealthFail, Error: r.err.Error()}
+		} else {
+			statuses[r.name] = &HealthStatus{Status: HealthOK}
+		}
+	}
+	return statuses
+}
+
+func (h *Handler) Healthz(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	statuses := h.checkHealth(r.Context())
+	h.writeHealth(w, statuses, statuses["storage"].Status == HealthOK)
+}
+
+func (h *Handler) Readyz(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	statuses := h.checkHealth(r.Context())
+	ok := true
+	for _, status := range statuses {
+		if status.Status != HealthOK {
+			ok = false
+		}
+	}
+	h.writeHealth(w, statuses, ok)
+}
+
+func (h *Handler) writeHealth(w http.ResponseWriter, statuses map[string]*HealthStatus, ok bool) {
+	resp := &HealthResponse{Status: HealthOK, Checks: statuses}
+	code := http.StatusOK
+	if !ok {
+		resp.Status, code = HealthFail, http.StatusServiceUnavailable
+		var failing []string
+		for name, status := range statuses {
+			if status.Status != HealthOK {
+				failing = append(failing, name+": "+status.Error)
+			}
+		}
+		sort.Strings(failing)
+		log.Warningf("health check failed: %v", failing)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
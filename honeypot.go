@@ -0,0 +1,102 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "gopkg.in/hockeypuck/logrus.v0"
+	"gopkg.in/hockeypuck/openpgp.v1"
+)
+
+// HoneypotHit records a lookup which returned a honeypot key.
+type HoneypotHit struct {
+	Time        time.Time
+	ClientIP    net.IP
+	Op          Operation
+	Search      string
+	Fingerprint string
+}
+
+// honeypots detects lookups of planted keys. Honeypot keys have user IDs
+// published nowhere else, such as addresses at a domain only listed in
+// keyserver results, so clients which find them are likely harvesting
+// addresses.
+type honeypots struct {
+	fingerprints map[string]bool
+	hitFunc      func(HoneypotHit)
+
+	mu      sync.Mutex
+	flagged map[string]int
+}
+
+// Honeypots flags clients whose lookups return any of the keys with the given
+// fingerprints. Each hit is logged and passed to f, if not nil.
+func Honeypots(fingerprints []string, f func(HoneypotHit)) HandlerOption {
+	return func(h *Handler) error {
+		hp := &honeypots{
+			fingerprints: map[string]bool{},
+			hitFunc:      f,
+			flagged:      map[string]int{},
+		}
+		for _, fp := range fingerprints {
+			fp = strings.ToLower(strings.Replace(strings.TrimPrefix(fp, "0x"), " ", "", -1))
+			hp.fingerprints[fp] = true
+		}
+		h.honeypots = hp
+		return nil
+	}
+}
+
+// check flags the client of l if keys contains a honeypot key.
+func (hp *honeypots) check(l *Lookup, keys []*openpgp.PrimaryKey) {
+	for _, key := range keys {
+		fp := key.Fingerprint()
+		if !hp.fingerprints[fp] {
+			continue
+		}
+		hit := HoneypotHit{
+			Time:        time.Now(),
+			ClientIP:    l.ClientIP,
+			Op:          l.Op,
+			Search:      l.Search,
+			Fingerprint: fp,
+		}
+		log.Warningf("honeypot key %s returned to %v for %s %q", fp, l.ClientIP, l.Op, l.Search)
+		hp.mu.Lock()
+		hp.flagged[l.ClientIP.String()]++
+		hp.mu.Unlock()
+		if hp.hitFunc != nil {
+			hp.hitFunc(hit)
+		}
+	}
+}
+
+// HoneypotHits returns how many times the client at ip has been returned
+// honeypot keys, so that operators can block likely scrapers.
+func (h *Handler) HoneypotHits(ip net.IP) int {
+	if h.honeypots == nil {
+		return 0
+	}
+	h.honeypots.mu.Lock()
+	defer h.honeypots.mu.Unlock()
+	return h.honeypots.flagged[ip.String()]
+}
@@ -0,0 +1,134 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+	"gopkg.in/hockeypuck/openpgp.v1"
+)
+
+// Horizon is the view of the keyserver offered to clients on some networks,
+// for deployments serving both internal and external clients.
+type Horizon struct {
+	Name string `json:"name"`
+
+	// Networks lists the CIDR ranges or single IP addresses of clients in
+	// this horizon.
+	Networks []string `json:"networks"`
+
+	// Unverified serves every user ID of a verifying keyserver, not only
+	// those whose addresses have been verified.
+	Unverified bool `json:"unverified,omitempty"`
+
+	// HideDomains lists email domains whose user IDs are not served, and
+	// cannot be searched for.
+	HideDomains []string `json:"hideDomains,omitempty"`
+
+	nets        []*net.IPNet
+	hideDomains map[string]bool
+}
+
+// LoadHorizons reads horizons from a JSON file containing an array of
+// Horizon objects.
+func LoadHorizons(path string) ([]Horizon, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	var result []Horizon
+	err = json.Unmarshal(buf, &result)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot parse horizons in %q", path)
+	}
+	return result, nil
+}
+
+// SplitHorizon serves clients according to the first of horizons whose
+// networks contain the client's address, as reported by trusted proxies.
+// Clients in no horizon are served as usual. Recon partners are always
+// served complete keys.
+func SplitHorizon(horizons []Horizon) HandlerOption {
+	return func(h *Handler) error {
+		for i := range horizons {
+			hz := &horizons[i]
+			nets, err := parseNetworks(hz.Networks)
+			if err != nil {
+				return errgo.Notef(err, "invalid network in horizon %q", hz.Name)
+			}
+			hz.nets = nets
+			hz.hideDomains = map[string]bool{}
+			for _, domain := range hz.HideDomains {
+				hz.hideDomains[storage.NormalizeDomain(strings.TrimPrefix(domain, "@"))] = true
+			}
+		}
+		h.horizons = horizons
+		return nil
+	}
+}
+
+// horizon returns the horizon of the client at ip, or nil if there is none.
+func (h *Handler) horizon(ip net.IP) *Horizon {
+	if ip == nil {
+		return nil
+	}
+	for i := range h.horizons {
+		for _, ipnet := range h.horizons[i].nets {
+			if ipnet.Contains(ip) {
+				return &h.horizons[i]
+			}
+		}
+	}
+	return nil
+}
+
+// hide returns keys without the user IDs at hidden domains. As with a
+// verifying keyserver, keys found by a keyword search are omitted unless the
+// search matches a user ID which is served.
+func (hz *Horizon) hide(l *Lookup, keys []*openpgp.PrimaryKey) []*openpgp.PrimaryKey {
+	if len(hz.hideDomains) == 0 {
+		return keys
+	}
+	search := strings.ToLower(l.Search)
+	byID := strings.HasPrefix(search, "0x") || l.Op == OperationHGet
+	var result []*openpgp.PrimaryKey
+	for _, key := range keys {
+		served := *key
+		served.UserIDs = nil
+		matched := byID
+		for _, uid := range key.UserIDs {
+			if hz.hideDomains[storage.EmailDomain(uid.Keywords)] {
+				continue
+			}
+			served.UserIDs = append(served.UserIDs, uid)
+			if l.matchesUserID(uid.Keywords) {
+				matched = true
+			}
+		}
+		if matched {
+			result = append(result, &served)
+		}
+	}
+	return result
+}
@@ -0,0 +1,146 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// Catalog maps English source messages to their translation in a single
+// language.
+type Catalog map[string]string
+
+// Localizer translates human-facing messages into the language preferred by
+// the client. A nil *Localizer is valid and leaves all messages untranslated.
+type Localizer struct {
+	defaultLang string
+	catalogs    map[string]Catalog
+}
+
+// NewLocalizer returns a new Localizer which falls back to defaultLang when
+// none of the languages accepted by a client are available.
+func NewLocalizer(defaultLang string) *Localizer {
+	return &Localizer{
+		defaultLang: strings.ToLower(defaultLang),
+		catalogs:    map[string]Catalog{},
+	}
+}
+
+// AddCatalog adds translations for the given language tag, such as "de" or
+// "pt-br". Messages are merged with any already added for that language.
+func (l *Localizer) AddCatalog(lang string, c Catalog) {
+	lang = strings.ToLower(lang)
+	catalog, ok := l.catalogs[lang]
+	if !ok {
+		catalog = Catalog{}
+		l.catalogs[lang] = catalog
+	}
+	for k, v := range c {
+		catalog[k] = v
+	}
+}
+
+// LoadCatalogs adds message catalogs from all JSON files in dir. Each file
+// must be named for its language tag, such as "de.json", and contain an
+// object mapping source messages to translations.
+func (l *Localizer) LoadCatalogs(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		var c Catalog
+		err = json.NewDecoder(f).Decode(&c)
+		f.Close()
+		if err != nil {
+			return errgo.Notef(err, "cannot decode message catalog %q", path)
+		}
+		l.AddCatalog(strings.TrimSuffix(filepath.Base(path), ".json"), c)
+	}
+	return nil
+}
+
+type acceptedLang struct {
+	tag string
+	q   float64
+}
+
+// Negotiate returns the best available language for an Accept-Language
+// header value, or the default language if none of them are available.
+func (l *Localizer) Negotiate(acceptLanguage string) string {
+	if l == nil {
+		return ""
+	}
+	var accepted []acceptedLang
+	for _, field := range strings.Split(acceptLanguage, ",") {
+		parts := strings.Split(field, ";")
+		al := acceptedLang{tag: strings.ToLower(strings.TrimSpace(parts[0])), q: 1}
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					al.q = q
+				}
+			}
+		}
+		if al.tag != "" && al.q > 0 {
+			accepted = append(accepted, al)
+		}
+	}
+	sort.SliceStable(accepted, func(i, j int) bool { return accepted[i].q > accepted[j].q })
+
+	for _, al := range accepted {
+		if _, ok := l.catalogs[al.tag]; ok {
+			return al.tag
+		}
+		if i := strings.Index(al.tag, "-"); i > 0 {
+			if _, ok := l.catalogs[al.tag[:i]]; ok {
+				return al.tag[:i]
+			}
+		}
+	}
+	return l.defaultLang
+}
+
+// Translate returns msg translated into lang, or msg itself if there is no
+// translation. If args are given, the translated message is used as a format
+// string.
+func (l *Localizer) Translate(lang, msg string, args ...interface{}) string {
+	if l != nil {
+		if t, ok := l.catalogs[lang][msg]; ok {
+			msg = t
+		}
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
@@ -0,0 +1,60 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	gc "gopkg.in/check.v1"
+)
+
+type LocalizerSuite struct {
+	l *Localizer
+}
+
+var _ = gc.Suite(&LocalizerSuite{})
+
+func (s *LocalizerSuite) SetUpTest(c *gc.C) {
+	s.l = NewLocalizer("en")
+	s.l.AddCatalog("de", Catalog{"Not Found": "Nicht gefunden"})
+	s.l.AddCatalog("pt-BR", Catalog{"Not Found": "Não encontrado"})
+}
+
+func (s *LocalizerSuite) TestNegotiate(c *gc.C) {
+	for _, t := range []struct {
+		accept, lang string
+	}{
+		{"", "en"},
+		{"fr", "en"},
+		{"de", "de"},
+		{"de-AT", "de"},
+		{"pt-br, de;q=0.5", "pt-br"},
+		{"fr;q=0.9, de;q=0.5, pt-BR;q=0.8", "pt-br"},
+		{"de;q=0, en", "en"},
+	} {
+		c.Check(s.l.Negotiate(t.accept), gc.Equals, t.lang, gc.Commentf("%q", t.accept))
+	}
+}
+
+func (s *LocalizerSuite) TestTranslate(c *gc.C) {
+	c.Assert(s.l.Translate("de", "Not Found"), gc.Equals, "Nicht gefunden")
+	c.Assert(s.l.Translate("en", "Not Found"), gc.Equals, "Not Found")
+	c.Assert(s.l.Translate("de", "%d keys", 3), gc.Equals, "3 keys")
+
+	var nilLocalizer *Localizer
+	c.Assert(nilLocalizer.Negotiate("de"), gc.Equals, "")
+	c.Assert(nilLocalizer.Translate("de", "Not Found"), gc.Equals, "Not Found")
+}
@@ -0,0 +1,185 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+const (
+	// idempotencyKeyHeader is the request header by which clients identify
+	// submissions which they may retry.
+	idempotencyKeyHeader = "Idempotency-Key"
+
+	// idempotentReplayedHeader is set on responses replaying the result of
+	// an earlier submission.
+	idempotentReplayedHeader = "Idempotent-Replayed"
+
+	// maxIdempotencyKeyLen is the length of the longest idempotency key
+	// accepted.
+	maxIdempotencyKeyLen = 255
+)
+
+var (
+	errIdempotencyInProgress = errgo.New("a submission with this idempotency key is in progress")
+	errIdempotencyMismatch   = errgo.New("idempotency key was used for a different submission")
+)
+
+// IdempotencyKeys remembers the results of up to size key submissions made
+// with an Idempotency-Key header for ttl, so that retried submissions, such
+// as from flaky mobile clients or queue-based submitters, are answered with
+// the original result instead of being merged again. Responses replaying a
+// result have the Idempotent-Replayed header set.
+//
+// Only successful submissions are remembered, so that those which failed
+// may be retried. A key reused for a different submission is refused with
+// 422 Unprocessable Entity, and one reused while its submission is in
+// progress with 409 Conflict.
+func IdempotencyKeys(size int, ttl time.Duration) HandlerOption {
+	return func(h *Handler) error {
+		if size <= 0 || ttl <= 0 {
+			return errgo.Newf("invalid idempotency key size %d or TTL %v", size, ttl)
+		}
+		h.idempotency = &idempotency{
+			size:    size,
+			ttl:     ttl,
+			entries: map[string]*list.Element{},
+			order:   list.New(),
+		}
+		return nil
+	}
+}
+
+// idempotency is a bounded record of the results of key submissions, by
+// idempotency key. The oldest are forgotten first.
+type idempotency struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type idempotencyEntry struct {
+	key string
+	// digest is the SHA-256 digest of the keys submitted.
+	digest [sha256.Size]byte
+	// result is nil while the submission is in progress.
+	result  *AddResponse
+	expires time.Time
+}
+
+// begin starts a submission of keydata with key at now. If it has been
+// made before, its result is returned.
+func (m *idempotency) begin(key string, keydata []byte, now time.Time) (*AddResponse, error) {
+	digest := sha256.Sum256(keydata)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if elem, ok := m.entries[key]; ok {
+		entry := elem.Value.(*idempotencyEntry)
+		switch {
+		case entry.result != nil && !now.Before(entry.expires):
+			m.order.Remove(elem)
+			delete(m.entries, key)
+		case entry.digest != digest:
+			return nil, errIdempotencyMismatch
+		case entry.result == nil:
+			return nil, errIdempotencyInProgress
+		default:
+			return entry.result, nil
+		}
+	}
+	m.entries[key] = m.order.PushBack(&idempotencyEntry{key: key, digest: digest})
+	for m.order.Len() > m.size {
+		oldest := m.order.Front()
+		delete(m.entries, oldest.Value.(*idempotencyEntry).key)
+		m.order.Remove(oldest)
+	}
+	return nil, nil
+}
+
+// end completes the submission begun with key at now. If it failed, result
+// is nil and the submission may be retried.
+func (m *idempotency) end(key string, result *AddResponse, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	elem, ok := m.entries[key]
+	if !ok {
+		return
+	}
+	if result == nil {
+		m.order.Remove(elem)
+		delete(m.entries, key)
+		return
+	}
+	entry := elem.Value.(*idempotencyEntry)
+	entry.result = result
+	entry.expires = now.Add(m.ttl)
+}
+
+// beginAdd begins the submission of keydata in r, if it has an idempotency
+// key. If it returns false, the response has been written, either refusing
+// the submission or replaying its earlier result. Otherwise, the returned
+// function must be called with the result of the submission, or nil if it
+// failed.
+func (h *Handler) beginAdd(w http.ResponseWriter, r *http.Request, lang string, keydata []byte) (func(*AddResponse), bool) {
+	key := r.Header.Get(idempotencyKeyHeader)
+	if h.idempotency == nil || key == "" {
+		return func(*AddResponse) {}, true
+	}
+	if len(key) > maxIdempotencyKeyLen {
+		h.localizedError(w, lang, http.StatusBadRequest, errgo.Newf("idempotency key longer than %d", maxIdempotencyKeyLen))
+		return nil, false
+	}
+	result, err := h.idempotency.begin(key, keydata, time.Now())
+	switch errgo.Cause(err) {
+	case nil:
+	case errIdempotencyMismatch:
+		h.localizedError(w, lang, http.StatusUnprocessableEntity, errgo.Mask(err, errgo.Any))
+		return nil, false
+	case errIdempotencyInProgress:
+		h.localizedError(w, lang, http.StatusConflict, errgo.Mask(err, errgo.Any))
+		return nil, false
+	default:
+		h.localizedError(w, lang, http.StatusInternalServerError, errgo.Mask(err))
+		return nil, false
+	}
+	if result != nil {
+		w.Header().Set(idempotentReplayedHeader, "true")
+		writeAddResponse(w, result)
+		return nil, false
+	}
+	return func(result *AddResponse) {
+		h.idempotency.end(key, result, time.Now())
+	}, true
+}
+
+func writeAddResponse(w http.ResponseWriter, result *AddResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	enc.Encode(result)
+}
@@ -107,6 +107,15 @@ type PrimaryKey struct {
 	SubKeys   []*SubKey        `json:"subKeys,omitempty"`
 	UserIDs   []*UserID        `json:"userIDs,omitempty"`
 	UserAttrs []*UserAttribute `json:"userAttrs,omitempty"`
+
+	// Proofs are the identity proofs claimed by the key, if they were
+	// verified by the server.
+	Proofs []*Proof `json:"proofs,omitempty"`
+
+	// Updated is when the server last received an update for the key,
+	// and UpdateSource how, such as "add" or "recon", if known.
+	Updated      string `json:"updated,omitempty"`
+	UpdateSource string `json:"updateSource,omitempty"`
 }
 
 func NewPrimaryKeys(froms []*openpgp.PrimaryKey) []*PrimaryKey {
@@ -135,6 +144,22 @@ func NewPrimaryKey(from *openpgp.PrimaryKey) *PrimaryKey {
 	return to
 }
 
+// AllSignatures returns the signatures on the key, its subkeys, user IDs and
+// user attributes.
+func (pk *PrimaryKey) AllSignatures() []*Signature {
+	result := append([]*Signature(nil), pk.Signatures...)
+	for _, subKey := range pk.SubKeys {
+		result = append(result, subKey.Signatures...)
+	}
+	for _, uid := range pk.UserIDs {
+		result = append(result, uid.Signatures...)
+	}
+	for _, uat := range pk.UserAttrs {
+		result = append(result, uat.Signatures...)
+	}
+	return result
+}
+
 func (pk *PrimaryKey) Serialize(w io.Writer) error {
 	packets := pk.packets()
 	for _, packet := range packets {
@@ -226,6 +251,12 @@ type Signature struct {
 	Expiration   string  `json:"expiration,omitempty"`
 	NeverExpires bool    `json:"neverExpires,omitempty"`
 	Packet       *Packet `json:"packet,omitempty"`
+
+	// IssuerRevoked is set if the server knows the issuer of this
+	// third-party signature to have been revoked, and IssuerRevocation is
+	// when, if known. Clients may discount such certifications.
+	IssuerRevoked    bool   `json:"issuerRevoked,omitempty"`
+	IssuerRevocation string `json:"issuerRevocation,omitempty"`
 }
 
 func NewSignature(from *openpgp.Signature) *Signature {
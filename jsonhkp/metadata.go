@@ -0,0 +1,124 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package jsonhkp
+
+import (
+	"time"
+
+	"gopkg.in/hockeypuck/openpgp.v1"
+)
+
+// KeyMetadata summarizes a key without its packets, for clients such as web
+// frontends which only display keys. Validity is determined from the key's
+// self-signatures, as in the HKP machine-readable index format.
+type KeyMetadata struct {
+	Fingerprint  string            `json:"fingerprint"`
+	LongKeyID    string            `json:"longKeyID"`
+	Algorithm    algorithm         `json:"algorithm"`
+	BitLength    int               `json:"bitLength"`
+	Creation     string            `json:"creation,omitempty"`
+	Expiration   string            `json:"expiration,omitempty"`
+	NeverExpires bool              `json:"neverExpires,omitempty"`
+	Expired      bool              `json:"expired,omitempty"`
+	Revoked      bool              `json:"revoked,omitempty"`
+	Revocation   string            `json:"revocation,omitempty"`
+	UserIDs      []*UserIDMetadata `json:"userIDs,omitempty"`
+	Proofs       []*Proof          `json:"proofs,omitempty"`
+
+	// RevokedCertifiers are the long key IDs of third parties which
+	// certified the key and which the server knows to have been revoked.
+	RevokedCertifiers []string `json:"revokedCertifiers,omitempty"`
+
+	// Updated is when the server last received an update for the key,
+	// and UpdateSource how, such as "add" or "recon", if known.
+	Updated      string `json:"updated,omitempty"`
+	UpdateSource string `json:"updateSource,omitempty"`
+}
+
+// Proof is the verification status of an identity proof claimed by a key.
+type Proof struct {
+	URI      string `json:"uri"`
+	Verified bool   `json:"verified"`
+	Error    string `json:"error,omitempty"`
+	Checked  string `json:"checked,omitempty"`
+}
+
+// UserIDMetadata summarizes a user ID with a valid self-signature.
+type UserIDMetadata struct {
+	UserID       string `json:"userID"`
+	Creation     string `json:"creation,omitempty"`
+	Expiration   string `json:"expiration,omitempty"`
+	NeverExpires bool   `json:"neverExpires,omitempty"`
+	Expired      bool   `json:"expired,omitempty"`
+}
+
+// NewKeyMetadata returns the metadata of each key with a valid
+// self-signature, as of now.
+func NewKeyMetadata(froms []*openpgp.PrimaryKey, now time.Time) []*KeyMetadata {
+	result := []*KeyMetadata{}
+	for _, from := range froms {
+		selfsigs := from.SelfSigs()
+		if !selfsigs.Valid() {
+			continue
+		}
+		to := &KeyMetadata{
+			Fingerprint: from.Fingerprint(),
+			LongKeyID:   from.KeyID(),
+			Algorithm: algorithm{
+				Name: openpgp.AlgorithmName(from.Algorithm),
+				Code: from.Algorithm,
+			},
+			BitLength: from.BitLen,
+		}
+		if !from.Creation.IsZero() {
+			to.Creation = from.Creation.UTC().Format(time.RFC3339)
+		}
+		to.Expiration, to.NeverExpires, to.Expired = expiration(selfsigs, now)
+		if revokedAt, ok := selfsigs.RevokedSince(); ok {
+			to.Revoked = true
+			if !revokedAt.IsZero() {
+				to.Revocation = revokedAt.UTC().Format(time.RFC3339)
+			}
+		}
+		for _, uid := range from.UserIDs {
+			uidSigs := uid.SelfSigs(from)
+			validSince, ok := uidSigs.ValidSince()
+			if !ok {
+				continue
+			}
+			uidTo := &UserIDMetadata{
+				UserID:   uid.Keywords,
+				Creation: validSince.UTC().Format(time.RFC3339),
+			}
+			uidTo.Expiration, uidTo.NeverExpires, uidTo.Expired = expiration(uidSigs, now)
+			to.UserIDs = append(to.UserIDs, uidTo)
+		}
+		result = append(result, to)
+	}
+	return result
+}
+
+// expiration returns the formatted expiration time of self-signatures, or
+// whether they never expire, and whether they have expired as of now.
+func expiration(selfsigs *openpgp.SelfSigs, now time.Time) (string, bool, bool) {
+	expiresAt, ok := selfsigs.ExpiresAt()
+	if !ok || expiresAt.IsZero() {
+		return "", true, false
+	}
+	return expiresAt.UTC().Format(time.RFC3339), false, expiresAt.Before(now)
+}
@@ -0,0 +1,250 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/errgo.v1"
+	log "gopkg.in/hockeypuck/logrus.v0"
+
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+)
+
+// KeyPopularity is the number of times a key has been looked up.
+type KeyPopularity struct {
+	RFingerprint string `json:"rfingerprint"`
+	Count        int    `json:"count"`
+}
+
+// keyCache is a least-recently-used cache of the keyrings served by
+// lookups, which also counts how often each key is requested so that the
+// most popular keys can be preloaded after a restart.
+type keyCache struct {
+	size int
+	path string
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	digests map[string]string
+	lru     *list.List
+	counts  map[string]int
+}
+
+// KeyCache caches up to size of the keyrings most recently served by
+// lookups, so that popular keys are not fetched from storage every time.
+// Cached keys are dropped when storage, or the EventBus if configured,
+// notifies that they have changed.
+//
+// If path is not empty, the number of times each key is requested is read
+// from it, and written back with SavePopularity, so that WarmUp can preload
+// the most requested keys when the server restarts.
+func KeyCache(size int, path string) HandlerOption {
+	return func(h *Handler) error {
+		c := &keyCache{
+			size:    size,
+			path:    path,
+			entries: map[string]*list.Element{},
+			digests: map[string]string{},
+			lru:     list.New(),
+			counts:  map[string]int{},
+		}
+		if path != "" {
+			err := c.load()
+			if err != nil {
+				return errgo.Mask(err)
+			}
+		}
+		h.keyCache = c
+		return nil
+	}
+}
+
+// load reads the popularity of keys saved at c.path, if any.
+func (c *keyCache) load() error {
+	buf, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errgo.Notef(err, "cannot read key popularity %q", c.path)
+	}
+	var pops []KeyPopularity
+	err = json.Unmarshal(buf, &pops)
+	if err != nil {
+		return errgo.Notef(err, "cannot read key popularity %q", c.path)
+	}
+	for _, pop := range pops {
+		c.counts[pop.RFingerprint] += pop.Count
+	}
+	return nil
+}
+
+// get returns the cached keyrings with the given RFingerprints, and the
+// RFingerprints of those which are not cached. Each is counted as requested.
+func (c *keyCache) get(rfps []string) ([]*storage.Keyring, []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var hits []*storage.Keyring
+	var misses []string
+	for _, rfp := range rfps {
+		c.counts[rfp]++
+		if e, ok := c.entries[rfp]; ok {
+			c.lru.MoveToFront(e)
+			hits = append(hits, e.Value.(*storage.Keyring))
+		} else {
+			misses = append(misses, rfp)
+		}
+	}
+	return hits, misses
+}
+
+// add caches keyrings, evicting the least recently used if full.
+func (c *keyCache) add(keyrings ...*storage.Keyring) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, kr := range keyrings {
+		if e, ok := c.entries[kr.RFingerprint]; ok {
+			c.remove(e)
+		}
+		c.entries[kr.RFingerprint] = c.lru.PushFront(kr)
+		c.digests[strings.ToLower(kr.MD5)] = kr.RFingerprint
+	}
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *keyCache) remove(e *list.Element) {
+	kr := c.lru.Remove(e).(*storage.Keyring)
+	delete(c.entries, kr.RFingerprint)
+	delete(c.digests, strings.ToLower(kr.MD5))
+}
+
+// invalidate drops the cached keys which have been replaced or removed.
+func (c *keyCache) invalidate(change storage.KeyChange) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, digest := range change.RemoveDigests() {
+		rfp, ok := c.digests[strings.ToLower(digest)]
+		if !ok {
+			continue
+		}
+		if e, ok := c.entries[rfp]; ok {
+			c.remove(e)
+		}
+	}
+	return nil
+}
+
+// popular returns the n most requested keys, most popular first. If n is
+// not positive, all keys are returned.
+func (c *keyCache) popular(n int) []KeyPopularity {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := make([]KeyPopularity, 0, len(c.counts))
+	for rfp, count := range c.counts {
+		result = append(result, KeyPopularity{RFingerprint: rfp, Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].RFingerprint < result[j].RFingerprint
+	})
+	if n > 0 && len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+// keyPopularityLimit is the number of keys whose popularity is saved, as a
+// multiple of the cache size.
+const keyPopularityLimit = 10
+
+// PopularKeys returns the n keys most requested by lookups, including those
+// recorded before the server restarted, if KeyCache is configured.
+func (h *Handler) PopularKeys(n int) []KeyPopularity {
+	if h.keyCache == nil {
+		return nil
+	}
+	return h.keyCache.popular(n)
+}
+
+// SavePopularity writes the number of times the most popular keys have been
+// requested to the path given to KeyCache, replacing the file so that a
+// crash while writing leaves the previous one intact.
+func (h *Handler) SavePopularity() error {
+	if h.keyCache == nil || h.keyCache.path == "" {
+		return nil
+	}
+	c := h.keyCache
+	buf, err := json.Marshal(c.popular(c.size * keyPopularityLimit))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	tmp := c.path + ".tmp"
+	err = ioutil.WriteFile(tmp, buf, 0600)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(os.Rename(tmp, c.path))
+}
+
+// warmUpBatchSize is the number of keys fetched at a time by WarmUp.
+var warmUpBatchSize = 100
+
+// WarmUp preloads the key cache with the most requested keys, so that a
+// restarted server does not present a cold cache to the pool. It returns the
+// number of keys loaded. It should be called at startup, before or while
+// serving lookups, and does nothing if KeyCache is not configured.
+func (h *Handler) WarmUp(ctx context.Context) (int, error) {
+	if h.keyCache == nil {
+		return 0, nil
+	}
+	c := h.keyCache
+	var rfps []string
+	for _, pop := range c.popular(c.size) {
+		rfps = append(rfps, pop.RFingerprint)
+	}
+	var n int
+	for len(rfps) > 0 {
+		if err := ctx.Err(); err != nil {
+			return n, errgo.Mask(err, errgo.Any)
+		}
+		batch := rfps
+		if len(batch) > warmUpBatchSize {
+			batch = batch[:warmUpBatchSize]
+		}
+		rfps = rfps[len(batch):]
+		keyrings, err := h.storage.FetchKeyrings(batch)
+		if err != nil {
+			return n, errgo.Mask(err)
+		}
+		c.add(keyrings...)
+		n += len(keyrings)
+	}
+	log.Infof("key cache warmed up with %d popular keys", n)
+	return n, nil
+}
@@ -0,0 +1,163 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"fmt"
+	"html"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+const (
+	armorPublicKeyType = "PGP PUBLIC KEY BLOCK"
+
+	armorHeaderPrefix    = "-----BEGIN PGP "
+	armorTailPrefix      = "-----END PGP "
+	armorPublicKeyHeader = "-----BEGIN " + armorPublicKeyType + "-----"
+	armorPublicKeyTail   = "-----END " + armorPublicKeyType + "-----"
+)
+
+// KeytextError describes where submitted keytext could not be decoded.
+type KeytextError struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *KeytextError) Error() string {
+	if e.Column > 0 {
+		return fmt.Sprintf("keytext line %d, column %d: %s", e.Line, e.Column, e.Message)
+	}
+	return fmt.Sprintf("keytext line %d: %s", e.Line, e.Message)
+}
+
+// normalizeLineEndings converts CRLF and bare CR line endings to LF, and
+// strips trailing whitespace from each line.
+func normalizeLineEndings(s string) string {
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	s = strings.Replace(s, "\r", "\n", -1)
+	lines := strings.Split(s, "\n")
+	for i := range lines {
+		lines[i] = strings.TrimRight(lines[i], " \t")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// keytextCandidates returns the keytext as submitted, followed by
+// interpretations of it that undo common ways armor gets mangled when pasted
+// from web pages (HTML entities) or email (quoted-printable).
+func keytextCandidates(keytext string) []string {
+	keytext = normalizeLineEndings(keytext)
+	candidates := []string{keytext}
+	if strings.Contains(keytext, "&") {
+		candidates = append(candidates, html.UnescapeString(keytext))
+	}
+	if strings.Contains(keytext, "=3D") {
+		qp, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(keytext)))
+		if err == nil {
+			candidates = append(candidates, normalizeLineEndings(string(qp)))
+		}
+	}
+	return candidates
+}
+
+// DecodeKeytext returns the binary OpenPGP packet data contained in an armored
+// keytext submission. If the keytext cannot be recovered, the error returned
+// is a *KeytextError locating the problem.
+func DecodeKeytext(keytext string) ([]byte, error) {
+	candidates := keytextCandidates(keytext)
+	for _, candidate := range candidates {
+		block, err := armor.Decode(strings.NewReader(candidate))
+		if err != nil {
+			continue
+		}
+		// The armor checksum is only verified once the body is fully read.
+		buf, err := ioutil.ReadAll(block.Body)
+		if err != nil {
+			continue
+		}
+		return buf, nil
+	}
+	return nil, checkKeytext(candidates[0])
+}
+
+func isRadix64(r rune) bool {
+	return r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' ||
+		r == '+' || r == '/' || r == '='
+}
+
+func notRadix64(r rune) bool {
+	return !isRadix64(r)
+}
+
+// checkKeytext scans normalized keytext for the first structural defect in
+// its armor, returning a *KeytextError describing it.
+func checkKeytext(keytext string) error {
+	lines := strings.Split(keytext, "\n")
+	i := 0
+	for i < len(lines) && !strings.HasPrefix(lines[i], armorHeaderPrefix) {
+		i++
+	}
+	if i == len(lines) {
+		return &KeytextError{Line: 1, Message: fmt.Sprintf("armor header line %q not found", armorPublicKeyHeader)}
+	}
+	if lines[i] != armorPublicKeyHeader {
+		return &KeytextError{Line: i + 1, Message: fmt.Sprintf("unexpected armor header line %q", lines[i])}
+	}
+
+	// Armor headers are terminated by a blank line.
+	for i++; i < len(lines) && lines[i] != ""; i++ {
+		if !strings.Contains(lines[i], ": ") {
+			return &KeytextError{Line: i + 1, Message: "expected armor header or blank line"}
+		}
+	}
+
+	checksumLine := 0
+	for i++; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.HasPrefix(line, armorTailPrefix):
+			if line != armorPublicKeyTail {
+				return &KeytextError{Line: i + 1, Message: fmt.Sprintf("unexpected armor tail line %q", line)}
+			}
+			if checksumLine > 0 {
+				return &KeytextError{Line: checksumLine, Message: "checksum mismatch"}
+			}
+			return &KeytextError{Line: i + 1, Message: "corrupt radix-64 data"}
+		case checksumLine > 0:
+			return &KeytextError{Line: i + 1, Message: "expected armor tail line after checksum"}
+		case strings.HasPrefix(line, "="):
+			if len(line) != 5 || strings.IndexFunc(line[1:], notRadix64) >= 0 {
+				return &KeytextError{Line: i + 1, Message: "malformed checksum"}
+			}
+			checksumLine = i + 1
+		default:
+			if col := strings.IndexFunc(line, notRadix64); col >= 0 {
+				r, _ := utf8.DecodeRuneInString(line[col:])
+				return &KeytextError{Line: i + 1, Column: utf8.RuneCountInString(line[:col]) + 1,
+					Message: fmt.Sprintf("invalid character %q", r)}
+			}
+		}
+	}
+	return &KeytextError{Line: len(lines), Message: fmt.Sprintf("armor tail line %q not found", armorPublicKeyTail)}
+}
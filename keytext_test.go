@@ -0,0 +1,91 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"strings"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/hockeypuck/testing"
+)
+
+type KeytextSuite struct {
+	keytext string
+	keydata []byte
+}
+
+var _ = gc.Suite(&KeytextSuite{})
+
+func (s *KeytextSuite) SetUpTest(c *gc.C) {
+	buf, err := ioutil.ReadAll(testing.MustInput("alice_unsigned.asc"))
+	c.Assert(err, gc.IsNil)
+	s.keytext = string(buf)
+	s.keydata, err = DecodeKeytext(s.keytext)
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.keydata, gc.Not(gc.HasLen), 0)
+}
+
+func (s *KeytextSuite) TestCRLF(c *gc.C) {
+	keydata, err := DecodeKeytext(strings.Replace(s.keytext, "\n", "\r\n", -1))
+	c.Assert(err, gc.IsNil)
+	c.Assert(keydata, gc.DeepEquals, s.keydata)
+}
+
+func (s *KeytextSuite) TestQuotedPrintable(c *gc.C) {
+	var buf bytes.Buffer
+	w := quotedprintable.NewWriter(&buf)
+	_, err := w.Write([]byte(s.keytext))
+	c.Assert(err, gc.IsNil)
+	c.Assert(w.Close(), gc.IsNil)
+
+	keydata, err := DecodeKeytext(buf.String())
+	c.Assert(err, gc.IsNil)
+	c.Assert(keydata, gc.DeepEquals, s.keydata)
+}
+
+func (s *KeytextSuite) TestHTMLEscaped(c *gc.C) {
+	keydata, err := DecodeKeytext(strings.Replace(s.keytext, "=", "&#61;", -1))
+	c.Assert(err, gc.IsNil)
+	c.Assert(keydata, gc.DeepEquals, s.keydata)
+}
+
+func (s *KeytextSuite) TestErrorLocation(c *gc.C) {
+	lines := strings.Split(s.keytext, "\n")
+	// Corrupt the third character of the first line of radix-64 data.
+	i := 0
+	for lines[i] != "" {
+		i++
+	}
+	i++
+	lines[i] = lines[i][:2] + "!" + lines[i][3:]
+
+	_, err := DecodeKeytext(strings.Join(lines, "\n"))
+	c.Assert(err, gc.FitsTypeOf, &KeytextError{})
+	c.Assert(err.(*KeytextError).Line, gc.Equals, i+1)
+	c.Assert(err.(*KeytextError).Column, gc.Equals, 3)
+}
+
+func (s *KeytextSuite) TestMissingArmor(c *gc.C) {
+	_, err := DecodeKeytext("sus llaves aqui")
+	c.Assert(err, gc.FitsTypeOf, &KeytextError{})
+	c.Assert(err.(*KeytextError).Line, gc.Equals, 1)
+}
@@ -0,0 +1,103 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package maintenance provides a read-only maintenance mode, toggled by
+// operators during planned storage maintenance, in which writes and recon
+// recovery are refused while lookups remain available.
+package maintenance
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	log "gopkg.in/hockeypuck/logrus.v0"
+)
+
+// ErrMaintenance is the cause of errors returned by Mode.ReadOnly while
+// maintenance mode is enabled.
+var ErrMaintenance = errors.New("read-only for maintenance")
+
+// DefaultMessage is shown while maintenance mode is enabled without a
+// message of its own.
+const DefaultMessage = "This keyserver is read-only for maintenance. Lookups are still available."
+
+// Status describes the maintenance mode.
+type Status struct {
+	Enabled bool      `json:"enabled"`
+	Message string    `json:"message,omitempty"`
+	Since   time.Time `json:"since"`
+}
+
+// Mode is a read-only maintenance mode. The zero value is disabled and ready
+// to use.
+type Mode struct {
+	mu     sync.Mutex
+	status Status
+}
+
+// Enable enters maintenance mode, showing message to users. If message is
+// empty, DefaultMessage is shown.
+func (m *Mode) Enable(message string) {
+	if message == "" {
+		message = DefaultMessage
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.status.Enabled {
+		m.status.Since = time.Now().UTC()
+		log.Infof("entering maintenance mode: %s", message)
+	}
+	m.status.Enabled = true
+	m.status.Message = message
+}
+
+// Disable leaves maintenance mode.
+func (m *Mode) Disable() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.status.Enabled {
+		log.Infof("leaving maintenance mode")
+	}
+	m.status = Status{}
+}
+
+// Status returns the current maintenance mode.
+func (m *Mode) Status() Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+// Banner returns the message to show on HTML pages, or "" if maintenance
+// mode is disabled.
+func (m *Mode) Banner() string {
+	return m.Status().Message
+}
+
+// ReadOnly returns an error with cause ErrMaintenance and the configured
+// message if maintenance mode is enabled, or nil otherwise. It is suitable
+// for use as a write guard, such as with hkp.WriteGuard and sks.WriteGuard.
+func (m *Mode) ReadOnly() error {
+	status := m.Status()
+	if !status.Enabled {
+		return nil
+	}
+	return errgo.WithCausef(nil, ErrMaintenance, "%s", status.Message)
+}
@@ -0,0 +1,51 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package maintenance
+
+import (
+	"testing"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type MaintenanceSuite struct{}
+
+var _ = gc.Suite(&MaintenanceSuite{})
+
+func (s *MaintenanceSuite) TestMode(c *gc.C) {
+	var m Mode
+	c.Assert(m.ReadOnly(), gc.IsNil)
+	c.Assert(m.Banner(), gc.Equals, "")
+
+	m.Enable("")
+	c.Assert(errgo.Cause(m.ReadOnly()), gc.Equals, ErrMaintenance)
+	c.Assert(m.Banner(), gc.Equals, DefaultMessage)
+	since := m.Status().Since
+	c.Assert(since.IsZero(), gc.Equals, false)
+
+	m.Enable("Storage migration until 12:00 UTC")
+	c.Assert(m.ReadOnly(), gc.ErrorMatches, "Storage migration until 12:00 UTC")
+	c.Assert(m.Status().Since, gc.Equals, since)
+
+	m.Disable()
+	c.Assert(m.ReadOnly(), gc.IsNil)
+	c.Assert(m.Status(), gc.Equals, Status{})
+}
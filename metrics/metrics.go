@@ -0,0 +1,236 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package metrics exports live Prometheus metrics for key updates, hashquery
+// requests, recon and storage.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+)
+
+const namespace = "hkp"
+
+// Roles of hashquery requests: those served to recon partners, and those
+// made to partners to recover keys.
+const (
+	RoleServer = "server"
+	RoleClient = "client"
+)
+
+// Results of recon rounds and event deliveries.
+const (
+	ResultOK      = "ok"
+	ResultError   = "error"
+	ResultSkipped = "skipped"
+	ResultDropped = "dropped"
+)
+
+var (
+	keysChanged = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "keys_changed_total",
+		Help:      "Keys changed, by source and whether they were inserted, updated, unchanged or removed.",
+	}, []string{"source", "change"})
+
+	hashqueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "hashquery_duration_seconds",
+		Help:      "Latency of hashquery requests, served or made to recon partners.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"role"})
+
+	hashqueryKeys = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "hashquery_keys",
+		Help:      "Number of keys returned by hashquery requests.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+	}, []string{"role"})
+
+	reconRounds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "recon_rounds_total",
+		Help:      "Recon rounds which found keys to recover, by result.",
+	}, []string{"result"})
+
+	reconDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "recon_recovery_duration_seconds",
+		Help:      "Time taken to recover keys found by a recon round.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	})
+
+	digestsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "recon_digests_dropped_total",
+		Help:      "Digests no longer requested from a partner after repeated recovery failures.",
+	})
+
+	digestsDiverged = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "recon_digests_diverged_total",
+		Help:      "Recovered keys stored with a digest other than the one requested, once merged.",
+	})
+
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "query_duration_seconds",
+		Help:      "Latency of search queries, by the type of term and the index used.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"shape", "index"})
+
+	queryRows = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "query_rows",
+		Help:      "Rows scanned by search queries, by the type of term and the index used.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+	}, []string{"shape", "index"})
+
+	storageErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "storage_errors_total",
+		Help:      "Storage operations which failed, by operation.",
+	}, []string{"op"})
+
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_rate_limited_total",
+		Help:      "Requests refused for exceeding a client rate limit, by endpoint.",
+	}, []string{"endpoint"})
+
+	eventsDelivered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_delivered_total",
+		Help:      "Key change events delivered to subscribers, by subscriber and result.",
+	}, []string{"subscriber", "result"})
+
+	writeQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "recon_write_queue_keys",
+		Help:      "Recovered keys waiting to be merged into storage.",
+	})
+
+	unhashedStripped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "unhashed_subpackets_stripped_total",
+		Help:      "Signatures from which unhashed subpackets were stripped, by the source of the key.",
+	}, []string{"source"})
+)
+
+// Registry contains all the metrics exported by this package.
+var Registry = prometheus.NewRegistry()
+
+func init() {
+	Registry.MustRegister(keysChanged, hashqueryDuration, hashqueryKeys,
+		reconRounds, reconDuration, digestsDropped, digestsDiverged, queryDuration, queryRows,
+		storageErrors, rateLimited, eventsDelivered, unhashedStripped, writeQueueDepth)
+}
+
+// Handler returns an HTTP handler exposing the metrics in the Prometheus
+// text format, for serving at /metrics.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// KeyChanged records a key change from source.
+func KeyChanged(source string, kc storage.KeyChange) {
+	var change string
+	switch kc.(type) {
+	case storage.KeyAdded:
+		change = "inserted"
+	case storage.KeyReplaced:
+		change = "updated"
+	case storage.KeyNotChanged:
+		change = "unchanged"
+	case storage.KeyRemoved:
+		change = "removed"
+	default:
+		return
+	}
+	keysChanged.WithLabelValues(source, change).Inc()
+}
+
+// Hashquery records a hashquery request in role which started at start and
+// returned nkeys keys.
+func Hashquery(role string, start time.Time, nkeys int) {
+	hashqueryDuration.WithLabelValues(role).Observe(time.Since(start).Seconds())
+	hashqueryKeys.WithLabelValues(role).Observe(float64(nkeys))
+}
+
+// ReconRound records the result of recovering keys found by a recon round
+// which started at start.
+func ReconRound(result string, start time.Time) {
+	reconRounds.WithLabelValues(result).Inc()
+	if result != ResultSkipped {
+		reconDuration.Observe(time.Since(start).Seconds())
+	}
+}
+
+// DigestDropped records a digest dropped after repeated recovery failures.
+func DigestDropped() {
+	digestsDropped.Inc()
+}
+
+// DigestDiverged records a recovered key stored with a digest other than the
+// one requested.
+func DigestDiverged() {
+	digestsDiverged.Inc()
+}
+
+// StorageError records a failed storage operation.
+func StorageError(op string) {
+	storageErrors.WithLabelValues(op).Inc()
+}
+
+// RateLimited records a request to endpoint refused by a rate limit.
+func RateLimited(endpoint string) {
+	rateLimited.WithLabelValues(endpoint).Inc()
+}
+
+// EventDelivered records the result of delivering a key change event to
+// subscriber.
+func EventDelivered(subscriber, result string) {
+	eventsDelivered.WithLabelValues(subscriber, result).Inc()
+}
+
+// WriteQueueDepth records the number of recovered keys waiting to be merged
+// into storage.
+func WriteQueueDepth(n int) {
+	writeQueueDepth.Set(float64(n))
+}
+
+// UnhashedStripped records n signatures of a key from source from which
+// unhashed subpackets were stripped.
+func UnhashedStripped(source string, n int) {
+	unhashedStripped.WithLabelValues(source).Add(float64(n))
+}
+
+// Query records the execution of a search query.
+func Query(stat storage.QueryStat) {
+	index := stat.Index
+	if index == "" {
+		index = "unknown"
+	}
+	queryDuration.WithLabelValues(stat.Shape, index).Observe(stat.Duration.Seconds())
+	queryRows.WithLabelValues(stat.Shape, index).Observe(float64(stat.Rows))
+}
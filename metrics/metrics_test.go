@@ -0,0 +1,66 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type MetricsSuite struct{}
+
+var _ = gc.Suite(&MetricsSuite{})
+
+func (s *MetricsSuite) TestHandler(c *gc.C) {
+	KeyChanged("add", storage.KeyAdded{Digest: "decafbad"})
+	KeyChanged("add", storage.KeyNotChanged{})
+	Hashquery(RoleServer, time.Now(), 3)
+	ReconRound(ResultOK, time.Now())
+	StorageError("upsert")
+	RateLimited("lookup")
+	EventDelivered("webhook", ResultDropped)
+	Query(storage.QueryStat{Shape: storage.ShapeEmail, Index: "keywords_idx", Rows: 12, Duration: time.Millisecond})
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	c.Assert(w.Code, gc.Equals, 200)
+	body, err := ioutil.ReadAll(w.Body)
+	c.Assert(err, gc.IsNil)
+	for _, m := range []string{
+		`hkp_keys_changed_total{change="inserted",source="add"} 1`,
+		`hkp_keys_changed_total{change="unchanged",source="add"} 1`,
+		`hkp_hashquery_duration_seconds_count{role="server"} 1`,
+		`hkp_hashquery_keys_sum{role="server"} 3`,
+		`hkp_recon_rounds_total{result="ok"} 1`,
+		`hkp_storage_errors_total{op="upsert"} 1`,
+		`hkp_requests_rate_limited_total{endpoint="lookup"} 1`,
+		`hkp_events_delivered_total{result="dropped",subscriber="webhook"} 1`,
+		`hkp_query_rows_sum{index="keywords_idx",shape="email"} 12`,
+	} {
+		c.Check(string(body), gc.Matches, "(?s).*"+regexp.QuoteMeta(m)+".*")
+	}
+}
@@ -0,0 +1,84 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+
+	"gopkg.in/errgo.v1"
+	log "gopkg.in/hockeypuck/logrus.v0"
+)
+
+// MirrorMode runs the server as a replication-only mirror, which serves
+// lookups and stays in sync with its recon partners, but does not accept
+// public submissions. Keys submitted through /pks/add, and uploads for
+// verification if configured, are refused as forbidden unless they bear
+// one of tokens in an "Authorization: Bearer" header, such as when pushed
+// by trusted peers, or authenticate as one of the Principals. Without
+// either, all submissions are refused.
+//
+// Recon and /pks/hashquery are unaffected, so the mirror continues to
+// fetch keys from its partners and to serve them keys.
+func MirrorMode(tokens ...string) HandlerOption {
+	return func(h *Handler) error {
+		m := &mirror{}
+		for _, token := range tokens {
+			if token == "" {
+				return errgo.New("empty mirror token")
+			}
+			m.tokens = append(m.tokens, sha256.Sum256([]byte(token)))
+		}
+		h.mirror = m
+		return nil
+	}
+}
+
+// mirror authorizes submissions to a mirror.
+type mirror struct {
+	tokens [][sha256.Size]byte
+}
+
+// authorized returns whether r bears one of the mirror's tokens.
+func (m *mirror) authorized(r *http.Request) bool {
+	sum, ok := bearerToken(r)
+	if !ok {
+		return false
+	}
+	for _, token := range m.tokens {
+		if subtle.ConstantTimeCompare(sum[:], token[:]) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// refuseMirrored refuses the submission r, returning true, if the server
+// is a mirror and r is not authorized to submit keys to it.
+func (h *Handler) refuseMirrored(w http.ResponseWriter, r *http.Request, lang string) bool {
+	if h.mirror == nil || h.mirror.authorized(r) || h.principal(r) != "" {
+		return false
+	}
+	log.Debugf("submission from %v refused by mirror", h.ClientIP(r))
+	if lang != "" {
+		w.Header().Set("Content-Language", lang)
+	}
+	http.Error(w, h.localizer.Translate(lang, "This server is a mirror and does not accept submissions."), http.StatusForbidden)
+	return true
+}
@@ -0,0 +1,121 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package notify delivers operational notifications, such as activity
+// digests and alerts, to server operators, and email to key owners.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// Notifier delivers a message to operators.
+type Notifier interface {
+	Notify(subject, body string) error
+}
+
+// Mailer sends email messages to arbitrary recipients, such as key owners.
+type Mailer interface {
+	Mail(to []string, subject, body string) error
+}
+
+// Webhook posts messages as JSON to a URL. The payload's "text" field is
+// understood by Slack and compatible incoming webhooks.
+type Webhook struct {
+	URL string
+	// Client is used to make requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// WebhookMessage is the JSON payload posted by a Webhook.
+type WebhookMessage struct {
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+	Text    string `json:"text"`
+}
+
+func (wh *Webhook) Notify(subject, body string) error {
+	msg := &WebhookMessage{
+		Subject: subject,
+		Body:    body,
+		Text:    subject + "\n\n" + body,
+	}
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	client := wh.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Post(wh.URL, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errgo.Newf("webhook %q responded %q", wh.URL, resp.Status)
+	}
+	return nil
+}
+
+// Email sends messages by SMTP.
+type Email struct {
+	// Addr is the host:port of the SMTP server.
+	Addr string
+	// Auth authenticates to the SMTP server, if set.
+	Auth smtp.Auth
+	From string
+	To   []string
+}
+
+func (e *Email) Notify(subject, body string) error {
+	return errgo.Mask(e.Mail(e.To, subject, body))
+}
+
+// Mail sends a message to the given recipients rather than to e.To.
+func (e *Email) Mail(to []string, subject, body string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return errgo.Mask(smtp.SendMail(e.Addr, e.Auth, e.From, to, msg.Bytes()))
+}
+
+// Multi delivers messages to several notifiers, returning the first error
+// encountered after trying all of them.
+type Multi []Notifier
+
+func (m Multi) Notify(subject, body string) error {
+	var result error
+	for _, n := range m {
+		err := n.Notify(subject, body)
+		if err != nil && result == nil {
+			result = errgo.Mask(err)
+		}
+	}
+	return result
+}
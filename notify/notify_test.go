@@ -0,0 +1,58 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package notify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	gc "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type NotifySuite struct{}
+
+var _ = gc.Suite(&NotifySuite{})
+
+func (s *NotifySuite) TestWebhook(c *gc.C) {
+	var msgs []WebhookMessage
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg WebhookMessage
+		err := json.NewDecoder(r.Body).Decode(&msg)
+		c.Check(err, gc.IsNil)
+		msgs = append(msgs, msg)
+	}))
+	defer srv.Close()
+
+	err := (&Webhook{URL: srv.URL}).Notify("Keyserver activity", "Keys inserted: 1")
+	c.Assert(err, gc.IsNil)
+	c.Assert(msgs, gc.DeepEquals, []WebhookMessage{{
+		Subject: "Keyserver activity",
+		Body:    "Keys inserted: 1",
+		Text:    "Keyserver activity\n\nKeys inserted: 1",
+	}})
+
+	failing := httptest.NewServer(http.NotFoundHandler())
+	defer failing.Close()
+	err = Multi{&Webhook{URL: failing.URL}, &Webhook{URL: srv.URL}}.Notify("x", "y")
+	c.Assert(err, gc.ErrorMatches, `webhook .* responded "404 Not Found"`)
+	c.Assert(msgs, gc.HasLen, 2)
+}
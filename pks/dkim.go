@@ -0,0 +1,379 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pks
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// dkimSignatureHeader is the header field carrying DKIM signatures.
+const dkimSignatureHeader = "DKIM-Signature"
+
+// DKIMVerifier verifies the DKIM signatures of messages, as specified by
+// RFC 6376 and RFC 8463. Signatures must use rsa-sha256 or ed25519-sha256,
+// and must sign the whole body, without the l= tag.
+type DKIMVerifier struct {
+	// LookupTXT looks up the DNS TXT records publishing signing keys. If
+	// nil, net.LookupTXT is used.
+	LookupTXT func(name string) ([]string, error)
+
+	// Now returns the time against which signature expiry is checked. If
+	// nil, time.Now is used.
+	Now func() time.Time
+}
+
+// Verify returns the signing domains of the valid DKIM signatures on msg,
+// which must use CRLF line endings. An error is only returned if msg
+// cannot be parsed; invalid signatures are ignored.
+func (v *DKIMVerifier) Verify(msg []byte) ([]string, error) {
+	headers, body, err := splitMessage(msg)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var domains []string
+	for _, field := range headers {
+		if !strings.EqualFold(field.name, dkimSignatureHeader) {
+			continue
+		}
+		domain, err := v.verify(field, headers, body)
+		if err != nil {
+			continue
+		}
+		domains = append(domains, domain)
+	}
+	return domains, nil
+}
+
+// headerField is a raw message header field.
+type headerField struct {
+	name string
+	// raw is the field as it appears in the message, including its
+	// trailing CRLF.
+	raw string
+}
+
+// value returns the unfolded value of the field.
+func (f headerField) value() string {
+	value := f.raw[strings.IndexByte(f.raw, ':')+1:]
+	return strings.NewReplacer("\r\n", "").Replace(value)
+}
+
+// splitMessage splits msg into its header fields and its body.
+func splitMessage(msg []byte) ([]headerField, []byte, error) {
+	var fields []headerField
+	for len(msg) > 0 {
+		if bytes.HasPrefix(msg, []byte("\r\n")) {
+			return fields, msg[2:], nil
+		}
+		end := 0
+		for {
+			i := bytes.Index(msg[end:], []byte("\r\n"))
+			if i < 0 {
+				return nil, nil, errgo.New("unterminated header field")
+			}
+			end += i + 2
+			if end == len(msg) || (msg[end] != ' ' && msg[end] != '\t') {
+				break
+			}
+		}
+		raw := string(msg[:end])
+		colon := strings.IndexByte(raw, ':')
+		if colon <= 0 {
+			return nil, nil, errgo.Newf("invalid header field %q", raw)
+		}
+		fields = append(fields, headerField{name: strings.TrimRight(raw[:colon], " \t"), raw: raw})
+		msg = msg[end:]
+	}
+	return fields, nil, nil
+}
+
+// parseTags parses a DKIM tag list, such as "v=1; a=rsa-sha256".
+func parseTags(s string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, spec := range strings.Split(s, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		eq := strings.IndexByte(spec, '=')
+		if eq < 0 {
+			return nil, errgo.Newf("invalid tag %q", spec)
+		}
+		name := strings.TrimSpace(spec[:eq])
+		if _, ok := tags[name]; ok {
+			return nil, errgo.Newf("duplicate tag %q", name)
+		}
+		tags[name] = strings.TrimSpace(spec[eq+1:])
+	}
+	return tags, nil
+}
+
+// stripWhitespace removes folding whitespace from base64 tag values.
+func stripWhitespace(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// verify verifies the DKIM signature in sig, returning its signing domain.
+func (v *DKIMVerifier) verify(sig headerField, headers []headerField, body []byte) (string, error) {
+	tags, err := parseTags(sig.value())
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	for _, name := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if tags[name] == "" {
+			return "", errgo.Newf("missing tag %q", name)
+		}
+	}
+	if tags["v"] != "1" {
+		return "", errgo.Newf("unsupported version %q", tags["v"])
+	}
+	if _, ok := tags["l"]; ok {
+		// Text appended after a body length limit would be unsigned.
+		return "", errgo.New("body length limits are not supported")
+	}
+	if x, ok := tags["x"]; ok {
+		expires, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return "", errgo.Newf("invalid expiry %q", x)
+		}
+		now := time.Now
+		if v.Now != nil {
+			now = v.Now
+		}
+		if now().Unix() > expires {
+			return "", errgo.New("signature expired")
+		}
+	}
+	signed := strings.Split(tags["h"], ":")
+	from := false
+	for i := range signed {
+		signed[i] = strings.TrimSpace(signed[i])
+		from = from || strings.EqualFold(signed[i], "From")
+	}
+	if !from {
+		return "", errgo.New("From is not signed")
+	}
+	headerCanon, bodyCanon := "simple", "simple"
+	if c, ok := tags["c"]; ok {
+		parts := strings.SplitN(c, "/", 2)
+		headerCanon = parts[0]
+		if len(parts) == 2 {
+			bodyCanon = parts[1]
+		}
+	}
+
+	canonBody, err := canonicalBody(body, bodyCanon)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	bh, err := base64.StdEncoding.DecodeString(stripWhitespace(tags["bh"]))
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	bodyHash := sha256.Sum256(canonBody)
+	if !bytes.Equal(bh, bodyHash[:]) {
+		return "", errgo.New("body hash mismatch")
+	}
+
+	data, err := signedData(sig, headers, signed, headerCanon)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	b, err := base64.StdEncoding.DecodeString(stripWhitespace(tags["b"]))
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	key, err := v.lookupKey(tags["s"], tags["d"])
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	hash := sha256.Sum256(data)
+	switch tags["a"] {
+	case "rsa-sha256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return "", errgo.New("key is not an RSA key")
+		}
+		err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], b)
+		if err != nil {
+			return "", errgo.Mask(err)
+		}
+	case "ed25519-sha256":
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return "", errgo.New("key is not an Ed25519 key")
+		}
+		if !ed25519.Verify(pub, hash[:], b) {
+			return "", errgo.New("invalid signature")
+		}
+	default:
+		return "", errgo.Newf("unsupported algorithm %q", tags["a"])
+	}
+	return strings.ToLower(tags["d"]), nil
+}
+
+// signedData returns the canonicalized header fields signed by sig, which
+// are followed by sig itself without its signature.
+func signedData(sig headerField, headers []headerField, signed []string, canon string) ([]byte, error) {
+	var data bytes.Buffer
+	used := map[int]bool{}
+	for _, name := range signed {
+		// Fields are signed from the bottom up, and fields signed which
+		// are not present are ignored.
+		for i := len(headers) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(headers[i].name, name) {
+				continue
+			}
+			used[i] = true
+			field, err := canonicalHeader(headers[i], canon)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			data.WriteString(field)
+			break
+		}
+	}
+	field, err := canonicalHeader(headerField{name: sig.name, raw: removeSignature(sig.raw)}, canon)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	data.WriteString(strings.TrimSuffix(field, "\r\n"))
+	return data.Bytes(), nil
+}
+
+// removeSignature empties the value of the b= tag in a DKIM-Signature
+// header field.
+func removeSignature(raw string) string {
+	colon := strings.IndexByte(raw, ':')
+	specs := strings.Split(raw[colon+1:], ";")
+	for i, spec := range specs {
+		eq := strings.IndexByte(spec, '=')
+		if eq >= 0 && strings.TrimSpace(spec[:eq]) == "b" {
+			specs[i] = spec[:eq+1]
+			if strings.HasSuffix(spec, "\r\n") {
+				specs[i] += "\r\n"
+			}
+		}
+	}
+	return raw[:colon+1] + strings.Join(specs, ";")
+}
+
+// canonicalHeader canonicalizes a header field.
+func canonicalHeader(field headerField, canon string) (string, error) {
+	switch canon {
+	case "simple":
+		return field.raw, nil
+	case "relaxed":
+		value := strings.Join(strings.Fields(field.value()), " ")
+		return strings.ToLower(field.name) + ":" + value + "\r\n", nil
+	}
+	return "", errgo.Newf("unsupported header canonicalization %q", canon)
+}
+
+// canonicalBody canonicalizes a message body.
+func canonicalBody(body []byte, canon string) ([]byte, error) {
+	lines := strings.Split(string(body), "\r\n")
+	switch canon {
+	case "simple":
+	case "relaxed":
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(strings.Join(strings.FieldsFunc(line, isWSP), " "), " ")
+			if len(line) > 0 && isWSP(rune(line[0])) && lines[i] != "" {
+				lines[i] = " " + lines[i]
+			}
+		}
+	default:
+		return nil, errgo.Newf("unsupported body canonicalization %q", canon)
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		if canon == "relaxed" {
+			return nil, nil
+		}
+		return []byte("\r\n"), nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n"), nil
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// lookupKey looks up the public key published for selector in domain.
+func (v *DKIMVerifier) lookupKey(selector, domain string) (crypto.PublicKey, error) {
+	lookupTXT := v.LookupTXT
+	if lookupTXT == nil {
+		lookupTXT = net.LookupTXT
+	}
+	txts, err := lookupTXT(selector + "._domainkey." + domain)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(txts) != 1 {
+		return nil, errgo.Newf("%d key records for %q in %q", len(txts), selector, domain)
+	}
+	tags, err := parseTags(txts[0])
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if ver, ok := tags["v"]; ok && ver != "DKIM1" {
+		return nil, errgo.Newf("unsupported key version %q", ver)
+	}
+	p, err := base64.StdEncoding.DecodeString(stripWhitespace(tags["p"]))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(p) == 0 {
+		return nil, errgo.Newf("key %q in %q revoked", selector, domain)
+	}
+	switch k := tags["k"]; k {
+	case "", "rsa":
+		key, err := x509.ParsePKIXPublicKey(p)
+		if err != nil {
+			key, err = x509.ParsePKCS1PublicKey(p)
+		}
+		return key, errgo.Mask(err)
+	case "ed25519":
+		if len(p) != ed25519.PublicKeySize {
+			return nil, errgo.Newf("invalid Ed25519 key %q in %q", selector, domain)
+		}
+		return ed25519.PublicKey(p), nil
+	default:
+		return nil, errgo.Newf("unsupported key type %q", k)
+	}
+}
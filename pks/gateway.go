@@ -0,0 +1,408 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pks
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	log "gopkg.in/hockeypuck/logrus.v0"
+	"gopkg.in/tomb.v2"
+
+	"gopkg.in/hockeypuck/hkp.v1/notify"
+)
+
+// ErrRejected is the cause of errors returned by Gateway.Deliver for
+// messages which are refused, and should not be delivered again.
+var ErrRejected = errgo.New("message rejected")
+
+const (
+	armorBegin = "-----BEGIN PGP PUBLIC KEY BLOCK-----"
+	armorEnd   = "-----END PGP PUBLIC KEY BLOCK-----"
+
+	// maxMessageSize is the size of the largest message accepted.
+	maxMessageSize = 8 << 20
+)
+
+// Receiver receives email messages for a Gateway.
+type Receiver interface {
+	// Receive calls deliver with each message received, in RFC 5322 form,
+	// until ctx is done. Messages for which deliver returns an error
+	// which does not have ErrRejected as its cause should be delivered
+	// again later.
+	Receive(ctx context.Context, deliver func(msg []byte) error) error
+}
+
+// Verifier verifies the signatures of messages, such as a DKIMVerifier.
+type Verifier interface {
+	// Verify returns the domains which validly signed msg.
+	Verify(msg []byte) ([]string, error)
+}
+
+// SubmitFunc submits keytext, such as with hkp.Handler.Submit, returning
+// a summary of the keys changed. Errors with a cause having a Temporary
+// method returning false are reported to the sender as a rejection, and
+// others cause the message to be delivered again later.
+type SubmitFunc func(ctx context.Context, keytext string) (string, error)
+
+// Gateway accepts keys mailed to a submission address, mirroring the
+// classic pgp-public-keys@ email interface. Messages must have the subject
+// "ADD", like those to classic PKS servers, and a valid DKIM signature by
+// the domain of their sender, or a parent domain of it. The armored keys
+// in their body, or in its MIME parts, are submitted together.
+type Gateway struct {
+	// Receiver receives messages.
+	Receiver Receiver
+	// Verifier verifies the DKIM signatures of messages. If nil, a
+	// DKIMVerifier is used.
+	Verifier Verifier
+	// Submit submits the keys received.
+	Submit SubmitFunc
+	// Domains lists the sender domains from which keys are accepted, if
+	// not from any domain.
+	Domains []string
+	// Mailer replies to senders with the result of their submission, if
+	// set. Messages are only replied to if their sender was verified, so
+	// that forged senders are not sent replies.
+	Mailer notify.Mailer
+
+	t tomb.Tomb
+}
+
+// Start receives messages in the background until Stop is called.
+func (g *Gateway) Start() {
+	g.t.Go(func() error {
+		ctx := g.t.Context(context.Background())
+		err := g.Receiver.Receive(ctx, func(msg []byte) error {
+			return g.Deliver(ctx, msg)
+		})
+		if err != nil && ctx.Err() == nil {
+			log.Errorf("email gateway failed: %v", err)
+			return errgo.Mask(err, errgo.Any)
+		}
+		return nil
+	})
+}
+
+// Stop stops receiving messages.
+func (g *Gateway) Stop() error {
+	g.t.Kill(nil)
+	return g.t.Wait()
+}
+
+// Deliver submits the keys in msg, if it is accepted.
+func (g *Gateway) Deliver(ctx context.Context, msg []byte) error {
+	msg = crlf(msg)
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		return errgo.WithCausef(err, ErrRejected, "invalid message")
+	}
+	sender, err := singleAddress(m.Header)
+	if err != nil {
+		return errgo.WithCausef(err, ErrRejected, "invalid sender")
+	}
+	domain := strings.ToLower(sender[strings.LastIndexByte(sender, '@')+1:])
+	if !g.acceptsDomain(domain) {
+		return errgo.WithCausef(nil, ErrRejected, "sender %q not accepted", sender)
+	}
+	verifier := g.Verifier
+	if verifier == nil {
+		verifier = &DKIMVerifier{}
+	}
+	signers, err := verifier.Verify(msg)
+	if err != nil {
+		return errgo.WithCausef(err, ErrRejected, "cannot verify message from %q", sender)
+	}
+	if !aligned(domain, signers) {
+		return errgo.WithCausef(nil, ErrRejected, "message from %q not signed by its domain", sender)
+	}
+
+	if subject := strings.TrimSpace(m.Header.Get("Subject")); !strings.EqualFold(subject, "ADD") {
+		return g.reject(sender, errgo.Newf("unsupported command %q", subject))
+	}
+	keytext, err := extractKeytext(m.Header, m.Body)
+	if err != nil {
+		return g.reject(sender, errgo.Mask(err))
+	}
+	summary, err := g.Submit(ctx, keytext)
+	if isTemporary(err) {
+		return errgo.Notef(err, "cannot submit keys from %q", sender)
+	} else if err != nil {
+		return g.reject(sender, errgo.Mask(err, errgo.Any))
+	}
+	log.Infof("keys from %q submitted by email: %s", sender, summary)
+	g.reply(sender, "Your keys have been submitted.\n\n"+summary+"\n")
+	return nil
+}
+
+// reject rejects a message from a verified sender, replying with why.
+func (g *Gateway) reject(sender string, err error) error {
+	g.reply(sender, fmt.Sprintf("Your keys could not be submitted:\n\n%v\n", err))
+	return errgo.WithCausef(err, ErrRejected, "message from %q rejected", sender)
+}
+
+func (g *Gateway) reply(sender, body string) {
+	if g.Mailer == nil {
+		return
+	}
+	err := g.Mailer.Mail([]string{sender}, "Re: ADD", body)
+	if err != nil {
+		log.Warningf("cannot reply to %q: %v", sender, err)
+	}
+}
+
+func (g *Gateway) acceptsDomain(domain string) bool {
+	if len(g.Domains) == 0 {
+		return true
+	}
+	for _, d := range g.Domains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// aligned returns whether domain, or a parent domain of it, is one of
+// signers, as with relaxed DMARC alignment.
+func aligned(domain string, signers []string) bool {
+	for _, signer := range signers {
+		signer = strings.ToLower(signer)
+		if domain == signer || strings.HasSuffix(domain, "."+signer) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTemporary returns whether err may not recur, such as a storage
+// failure, so that the message should be delivered again.
+func isTemporary(err error) bool {
+	if err == nil {
+		return false
+	}
+	if t, ok := errgo.Cause(err).(interface {
+		Temporary() bool
+	}); ok {
+		return t.Temporary()
+	}
+	return errgo.Cause(err) == context.Canceled || errgo.Cause(err) == context.DeadlineExceeded
+}
+
+// singleAddress returns the email address in the From header field, of
+// which there must be exactly one containing exactly one address, as
+// signatures are verified against the last From field and senders are read
+// from the first.
+func singleAddress(header mail.Header) (string, error) {
+	if n := len(header["From"]); n != 1 {
+		return "", errgo.Newf("%d From fields", n)
+	}
+	addrs, err := mail.ParseAddressList(header.Get("From"))
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	if len(addrs) != 1 {
+		return "", errgo.Newf("%d senders", len(addrs))
+	}
+	return addrs[0].Address, nil
+}
+
+// crlf converts the line endings of msg to CRLF, as messages read from
+// files may have bare LF line endings.
+func crlf(msg []byte) []byte {
+	if !bytes.Contains(msg, []byte("\n")) || bytes.Count(msg, []byte("\r\n")) == bytes.Count(msg, []byte("\n")) {
+		return msg
+	}
+	msg = bytes.Replace(msg, []byte("\r\n"), []byte("\n"), -1)
+	return bytes.Replace(msg, []byte("\n"), []byte("\r\n"), -1)
+}
+
+// extractKeytext returns the armored key blocks in a message body, or in
+// its MIME parts.
+func extractKeytext(header textHeader, body io.Reader) (string, error) {
+	var blocks []string
+	err := walkParts(header, body, func(text string) {
+		for {
+			begin := strings.Index(text, armorBegin)
+			if begin < 0 {
+				return
+			}
+			end := strings.Index(text[begin:], armorEnd)
+			if end < 0 {
+				return
+			}
+			end += begin + len(armorEnd)
+			blocks = append(blocks, text[begin:end])
+			text = text[end:]
+		}
+	})
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	if len(blocks) == 0 {
+		return "", errgo.New("no armored public keys found")
+	}
+	return strings.Join(blocks, "\n"), nil
+}
+
+// textHeader is implemented by mail.Header and textproto.MIMEHeader.
+type textHeader interface {
+	Get(key string) string
+}
+
+// walkParts calls f with the decoded text of each part of a body.
+func walkParts(header textHeader, body io.Reader, f func(text string)) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return errgo.Mask(err)
+			}
+			err = walkParts(part.Header, part, f)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+		}
+	}
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, &newlineStripper{r: body})
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(body, maxMessageSize))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	f(string(buf))
+	return nil
+}
+
+// newlineStripper removes line breaks from base64 text.
+type newlineStripper struct {
+	r io.Reader
+}
+
+func (s *newlineStripper) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	j := 0
+	for _, c := range p[:n] {
+		if c != '\r' && c != '\n' {
+			p[j] = c
+			j++
+		}
+	}
+	return j, err
+}
+
+// Maildir receives messages delivered to a maildir, such as by a local
+// mail transfer agent. Messages are moved from new to cur once delivered
+// or rejected.
+type Maildir struct {
+	// Dir is the maildir, containing the new and cur directories.
+	Dir string
+	// Interval is how often new messages are checked for. If zero, they
+	// are checked for every minute.
+	Interval time.Duration
+}
+
+// Receive implements Receiver.
+func (md *Maildir) Receive(ctx context.Context, deliver func(msg []byte) error) error {
+	for _, sub := range []string{"new", "cur", "tmp"} {
+		err := os.MkdirAll(filepath.Join(md.Dir, sub), 0700)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	interval := md.Interval
+	if interval == 0 {
+		interval = time.Minute
+	}
+	for {
+		err := md.receive(ctx, deliver)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (md *Maildir) receive(ctx context.Context, deliver func(msg []byte) error) error {
+	dir := filepath.Join(md.Dir, "new")
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	for _, info := range infos {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, info.Name())
+		var err error
+		if info.Size() > maxMessageSize {
+			err = errgo.WithCausef(nil, ErrRejected, "message %q is %d bytes", info.Name(), info.Size())
+		} else {
+			var msg []byte
+			msg, err = ioutil.ReadFile(path)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			err = deliver(msg)
+		}
+		if err != nil && errgo.Cause(err) != ErrRejected {
+			log.Warningf("cannot deliver message %q, will retry: %v", info.Name(), err)
+			continue
+		} else if err != nil {
+			log.Infof("message %q rejected: %v", info.Name(), err)
+		}
+		err = os.Rename(path, filepath.Join(md.Dir, "cur", info.Name()+":2,S"))
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
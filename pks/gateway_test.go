@@ -0,0 +1,310 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pks
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type GatewaySuite struct{}
+
+var _ = gc.Suite(&GatewaySuite{})
+
+const testKeytext = armorBegin + "\r\n\r\nmQINBFake\r\n" + armorEnd
+
+// signDKIM returns msg with a DKIM signature added by signer, as selector
+// in domain.
+func signDKIM(c *gc.C, msg, algorithm, domain, selector string, signer crypto.Signer) string {
+	return signDKIMTags(c, msg, "", algorithm, domain, selector, signer)
+}
+
+// signDKIMTags is like signDKIM, adding the extra tags to the signature.
+func signDKIMTags(c *gc.C, msg, tags, algorithm, domain, selector string, signer crypto.Signer) string {
+	headers, body, err := splitMessage([]byte(msg))
+	c.Assert(err, gc.IsNil)
+	canonBody, err := canonicalBody(body, "relaxed")
+	c.Assert(err, gc.IsNil)
+	bh := sha256.Sum256(canonBody)
+	sig := headerField{
+		name: dkimSignatureHeader,
+		raw: dkimSignatureHeader + ": v=1; a=" + algorithm + "; c=relaxed/relaxed; d=" + domain +
+			"; s=" + selector + ";" + tags + "\r\n\th=From:Subject; bh=" + base64.StdEncoding.EncodeToString(bh[:]) + "; b=\r\n",
+	}
+	data, err := signedData(sig, headers, []string{"From", "Subject"}, "relaxed")
+	c.Assert(err, gc.IsNil)
+	hash := sha256.Sum256(data)
+	var b []byte
+	if _, ok := signer.(ed25519.PrivateKey); ok {
+		b, err = signer.Sign(rand.Reader, hash[:], crypto.Hash(0))
+	} else {
+		b, err = signer.Sign(rand.Reader, hash[:], crypto.SHA256)
+	}
+	c.Assert(err, gc.IsNil)
+	return strings.TrimSuffix(sig.raw, "\r\n") + base64.StdEncoding.EncodeToString(b) + "\r\n" + msg
+}
+
+func testMessage(from string) string {
+	return "From: " + from + "\r\n" +
+		"To: pgp-public-keys@keys.example.net\r\n" +
+		"Subject: ADD\r\n" +
+		"\r\n" +
+		testKeytext + "\r\n"
+}
+
+func (s *GatewaySuite) TestCanonicalization(c *gc.C) {
+	// The example of RFC 6376 section 3.4.5.
+	msg := []byte("A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n")
+	headers, body, err := splitMessage(msg)
+	c.Assert(err, gc.IsNil)
+	c.Assert(headers, gc.HasLen, 2)
+	var relaxed []string
+	for _, field := range headers {
+		canon, err := canonicalHeader(field, "relaxed")
+		c.Assert(err, gc.IsNil)
+		relaxed = append(relaxed, canon)
+	}
+	c.Assert(strings.Join(relaxed, ""), gc.Equals, "a:X\r\nb:Y Z\r\n")
+	canon, err := canonicalBody(body, "relaxed")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(canon), gc.Equals, " C\r\nD E\r\n")
+	canon, err = canonicalBody(body, "simple")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(canon), gc.Equals, " C \r\nD \t E\r\n")
+	canon, err = canonicalBody(nil, "simple")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(canon), gc.Equals, "\r\n")
+}
+
+func (s *GatewaySuite) TestDKIMVerifier(c *gc.C) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, gc.IsNil)
+	rsaPub, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	c.Assert(err, gc.IsNil)
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, gc.IsNil)
+	records := map[string]string{
+		"rsa._domainkey.example.com": "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(rsaPub),
+		"ed._domainkey.example.org":  "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPub),
+		"old._domainkey.example.com": "v=DKIM1; p=",
+	}
+	v := &DKIMVerifier{LookupTXT: func(name string) ([]string, error) {
+		if record, ok := records[name]; ok {
+			return []string{record}, nil
+		}
+		return nil, errgo.Newf("no record for %q", name)
+	}}
+
+	msg := signDKIM(c, testMessage("alice@example.com"), "rsa-sha256", "example.com", "rsa", rsaKey)
+	msg = signDKIM(c, msg, "ed25519-sha256", "example.org", "ed", edKey)
+	domains, err := v.Verify([]byte(msg))
+	c.Assert(err, gc.IsNil)
+	c.Assert(domains, gc.DeepEquals, []string{"example.org", "example.com"})
+
+	// Tampering with the body or signed headers invalidates signatures.
+	domains, err = v.Verify([]byte(strings.Replace(msg, "mQINBFake", "mQINBEvil", 1)))
+	c.Assert(err, gc.IsNil)
+	c.Assert(domains, gc.HasLen, 0)
+	domains, err = v.Verify([]byte(strings.Replace(msg, "From: alice@", "From: mallory@", 1)))
+	c.Assert(err, gc.IsNil)
+	c.Assert(domains, gc.HasLen, 0)
+	// Unsigned headers may be changed.
+	domains, err = v.Verify([]byte(strings.Replace(msg, "To: pgp-", "To:  pgp-", 1)))
+	c.Assert(err, gc.IsNil)
+	c.Assert(domains, gc.HasLen, 2)
+
+	// Body length limits are refused, as text could be appended to the
+	// signed body.
+	msg = testMessage("alice@example.com")
+	_, body, err := splitMessage([]byte(msg))
+	c.Assert(err, gc.IsNil)
+	canonBody, err := canonicalBody(body, "relaxed")
+	c.Assert(err, gc.IsNil)
+	msg = signDKIMTags(c, msg, fmt.Sprintf(" l=%d;", len(canonBody)), "rsa-sha256", "example.com", "rsa", rsaKey)
+	domains, err = v.Verify([]byte(msg))
+	c.Assert(err, gc.IsNil)
+	c.Assert(domains, gc.HasLen, 0)
+
+	// Revoked keys do not verify.
+	msg = signDKIM(c, testMessage("alice@example.com"), "rsa-sha256", "example.com", "old", rsaKey)
+	domains, err = v.Verify([]byte(msg))
+	c.Assert(err, gc.IsNil)
+	c.Assert(domains, gc.HasLen, 0)
+}
+
+// fakeVerifier reports messages as signed by its domains.
+type fakeVerifier []string
+
+func (v fakeVerifier) Verify([]byte) ([]string, error) { return v, nil }
+
+// fakeMailer records replies.
+type fakeMailer struct {
+	to   []string
+	body []string
+}
+
+func (m *fakeMailer) Mail(to []string, subject, body string) error {
+	m.to = append(m.to, to...)
+	m.body = append(m.body, body)
+	return nil
+}
+
+// temporaryError is a temporary submission failure.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "storage unavailable" }
+func (temporaryError) Temporary() bool { return true }
+
+func (s *GatewaySuite) TestDeliver(c *gc.C) {
+	var submitted []string
+	var submitErr error
+	mailer := &fakeMailer{}
+	g := &Gateway{
+		Verifier: fakeVerifier{"example.com"},
+		Submit: func(ctx context.Context, keytext string) (string, error) {
+			if submitErr != nil {
+				return "", submitErr
+			}
+			submitted = append(submitted, keytext)
+			return "inserted 0x0123", nil
+		},
+		Mailer: mailer,
+	}
+	ctx := context.Background()
+
+	err := g.Deliver(ctx, []byte(strings.Replace(testMessage("alice@mail.example.com"), "\r\n", "\n", -1)))
+	c.Assert(err, gc.IsNil)
+	c.Assert(submitted, gc.DeepEquals, []string{testKeytext})
+	c.Assert(mailer.to, gc.DeepEquals, []string{"alice@mail.example.com"})
+
+	// Senders must be verified, and are not replied to otherwise.
+	err = g.Deliver(ctx, []byte(testMessage("mallory@example.net")))
+	c.Assert(errgo.Cause(err), gc.Equals, ErrRejected)
+	c.Assert(err, gc.ErrorMatches, `message from "mallory@example.net" not signed by its domain`)
+	c.Assert(mailer.to, gc.HasLen, 1)
+
+	err = g.Deliver(ctx, []byte(strings.Replace(testMessage("alice@example.com"), "Subject: ADD", "Subject: INDEX", 1)))
+	c.Assert(errgo.Cause(err), gc.Equals, ErrRejected)
+	c.Assert(mailer.body[1], gc.Matches, `(?s).*unsupported command "INDEX".*`)
+
+	// Keys may be attached.
+	msg := "From: alice@example.com\r\n" +
+		"Subject: ADD\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=xyz\r\n" +
+		"\r\n" +
+		"--xyz\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Here is my key.\r\n" +
+		"--xyz\r\n" +
+		"Content-Type: application/pgp-keys\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64.StdEncoding.EncodeToString([]byte(testKeytext)) + "\r\n" +
+		"--xyz--\r\n"
+	err = g.Deliver(ctx, []byte(msg))
+	c.Assert(err, gc.IsNil)
+	c.Assert(submitted, gc.DeepEquals, []string{testKeytext, testKeytext})
+
+	// Temporary failures are delivered again.
+	submitErr = errgo.Mask(temporaryError{}, errgo.Any)
+	err = g.Deliver(ctx, []byte(testMessage("alice@example.com")))
+	c.Assert(err, gc.NotNil)
+	c.Assert(errgo.Cause(err), gc.Not(gc.Equals), ErrRejected)
+
+	// The sender must be the only From field, which is the one signed.
+	err = g.Deliver(ctx, []byte("From: mallory@example.net\r\n"+testMessage("alice@example.com")))
+	c.Assert(errgo.Cause(err), gc.Equals, ErrRejected)
+	c.Assert(err, gc.ErrorMatches, `invalid sender: 2 From fields`)
+
+	g.Domains = []string{"example.org"}
+	err = g.Deliver(ctx, []byte(testMessage("alice@example.com")))
+	c.Assert(err, gc.ErrorMatches, `sender "alice@example.com" not accepted`)
+}
+
+func (s *GatewaySuite) TestMaildir(c *gc.C) {
+	dir := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(dir, "new"), 0700), gc.IsNil)
+	for _, name := range []string{"1.accepted", "2.rejected", "3.retried"} {
+		err := ioutil.WriteFile(filepath.Join(dir, "new", name), []byte(name), 0600)
+		c.Assert(err, gc.IsNil)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var delivered []string
+	md := &Maildir{Dir: dir, Interval: time.Hour}
+	err := md.Receive(ctx, func(msg []byte) error {
+		delivered = append(delivered, string(msg))
+		cancel()
+		switch string(msg) {
+		case "2.rejected":
+			return errgo.WithCausef(nil, ErrRejected, "")
+		case "3.retried":
+			return errgo.New("try again")
+		}
+		return nil
+	})
+	c.Assert(err, gc.IsNil)
+	// Delivery stops once ctx is done.
+	c.Assert(delivered, gc.DeepEquals, []string{"1.accepted"})
+
+	ctx = context.Background()
+	ctx, cancel = context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	err = md.Receive(ctx, func(msg []byte) error {
+		delivered = append(delivered, string(msg))
+		switch string(msg) {
+		case "2.rejected":
+			return errgo.WithCausef(nil, ErrRejected, "")
+		case "3.retried":
+			return errgo.New("try again")
+		}
+		return nil
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(delivered, gc.DeepEquals, []string{"1.accepted", "2.rejected", "3.retried"})
+	names := func(sub string) []string {
+		infos, err := ioutil.ReadDir(filepath.Join(dir, sub))
+		c.Assert(err, gc.IsNil)
+		var result []string
+		for _, info := range infos {
+			result = append(result, info.Name())
+		}
+		return result
+	}
+	c.Assert(names("new"), gc.DeepEquals, []string{"3.retried"})
+	c.Assert(names("cur"), gc.DeepEquals, []string{"1.accepted:2,S", "2.rejected:2,S"})
+}
@@ -0,0 +1,432 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	log "gopkg.in/hockeypuck/logrus.v0"
+	"gopkg.in/hockeypuck/openpgp.v1"
+	"gopkg.in/tomb.v2"
+
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+)
+
+const (
+	// mailSyncSubject is the subject of SKS mailsync messages.
+	mailSyncSubject = "incremental"
+
+	// keyserverSentHeader identifies the keyserver which sent a mailsync
+	// message, so that keyservers do not send keys back to it.
+	keyserverSentHeader = "X-Keyserver-Sent"
+
+	// DefaultMaxBatch is the most keys sent to a partner in one message,
+	// unless configured.
+	DefaultMaxBatch = 100
+
+	// DefaultFlushInterval is how often pending keys are sent to partners,
+	// unless configured.
+	DefaultFlushInterval = time.Minute
+
+	// maxPending is the most keys queued for a partner. Beyond it, the
+	// oldest are dropped, so that an unreachable partner does not consume
+	// unbounded memory; recon is expected to catch it up.
+	maxPending = 100000
+)
+
+// MailSyncConfig configures synchronization with SKS mailsync partners.
+type MailSyncConfig struct {
+	// From is the sender address of messages to partners.
+	From string `toml:"from"`
+	// Partners are the mailsync addresses of partners, to which key
+	// changes are sent, and from which they are accepted.
+	Partners []string `toml:"partners"`
+	// AcceptFrom lists further sender addresses from which key changes
+	// are accepted.
+	AcceptFrom []string   `toml:"acceptFrom"`
+	SMTP       SMTPConfig `toml:"smtp"`
+	// Hostname identifies this keyserver in messages sent. If empty, the
+	// host name is used.
+	Hostname string `toml:"hostname"`
+	// MaxBatch is the most keys sent in one message.
+	MaxBatch int `toml:"maxBatch"`
+	// FlushInterval is how often pending keys are sent, such as "1m".
+	FlushInterval string `toml:"flushInterval"`
+}
+
+// MailSync emails key changes to SKS mailsync partners as they are
+// notified by storage, batching them into incremental update messages, and
+// accepts the incremental updates sent by partners. Messages which cannot
+// be sent are retried, with backoff, while the keys remain queued.
+type MailSync struct {
+	config        MailSyncConfig
+	storage       storage.Storage
+	submit        SubmitFunc
+	flushInterval time.Duration
+	accept        map[string]bool
+
+	// verifier verifies the DKIM signatures of incremental updates.
+	verifier Verifier
+
+	// send sends msg to the partner at addr.
+	send func(addr string, msg []byte) error
+
+	mu       sync.Mutex
+	partners map[string]*mailSyncPartner
+
+	t tomb.Tomb
+}
+
+// mailSyncPartner holds the keys pending for a partner.
+type mailSyncPartner struct {
+	addr string
+	// pending holds the digests of the keys to send, oldest first, and
+	// queued the same as a set.
+	pending []string
+	queued  map[string]bool
+
+	failures int
+	// retry is when sending may next be attempted after a failure.
+	retry time.Time
+}
+
+// NewMailSync returns a MailSync of the keys in st. Key changes are queued
+// for partners once it is created, and sent once it is started. Keys
+// received from partners are submitted with submit, such as with
+// hkp.Handler.Submit, so that they pass through the same policies as keys
+// submitted directly.
+func NewMailSync(st storage.Storage, submit SubmitFunc, config MailSyncConfig) (*MailSync, error) {
+	if config.From == "" || len(config.Partners) == 0 {
+		return nil, errgo.New("mailsync requires a sender and partners")
+	}
+	if config.SMTP.Host == "" {
+		config.SMTP.Host = DefaultSMTPHost
+	}
+	if config.Hostname == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		config.Hostname = hostname
+	}
+	if config.MaxBatch <= 0 {
+		config.MaxBatch = DefaultMaxBatch
+	}
+	ms := &MailSync{
+		config:        config,
+		storage:       st,
+		submit:        submit,
+		flushInterval: DefaultFlushInterval,
+		verifier:      &DKIMVerifier{},
+		accept:        map[string]bool{},
+		partners:      map[string]*mailSyncPartner{},
+	}
+	if config.FlushInterval != "" {
+		d, err := time.ParseDuration(config.FlushInterval)
+		if err != nil || d <= 0 {
+			return nil, errgo.Newf("invalid mailsync flush interval %q", config.FlushInterval)
+		}
+		ms.flushInterval = d
+	}
+	auth, err := newSMTPAuth(config.SMTP)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	ms.send = func(addr string, msg []byte) error {
+		return smtp.SendMail(config.SMTP.Host, auth, config.From, []string{addr}, msg)
+	}
+	for _, addr := range config.Partners {
+		ms.partners[addr] = &mailSyncPartner{addr: addr, queued: map[string]bool{}}
+		ms.accept[strings.ToLower(addr)] = true
+	}
+	for _, addr := range config.AcceptFrom {
+		ms.accept[strings.ToLower(addr)] = true
+	}
+	st.Subscribe(ms.observe)
+	return ms, nil
+}
+
+// observe queues the keys changed for every partner.
+func (ms *MailSync) observe(change storage.KeyChange) error {
+	digests := change.InsertDigests()
+	if len(digests) == 0 {
+		return nil
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for _, p := range ms.partners {
+		for _, digest := range digests {
+			p.queue(strings.ToLower(digest))
+		}
+	}
+	return nil
+}
+
+func (p *mailSyncPartner) queue(digest string) {
+	if p.queued[digest] {
+		return
+	}
+	p.queued[digest] = true
+	p.pending = append(p.pending, digest)
+	if len(p.pending) > maxPending {
+		log.Warningf("dropping key %q queued for mailsync partner %q", p.pending[0], p.addr)
+		delete(p.queued, p.pending[0])
+		p.pending = p.pending[1:]
+	}
+}
+
+// unqueue removes digests from the queues of all partners, so that keys
+// received by mailsync are not sent back.
+func (ms *MailSync) unqueue(digests []string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for _, p := range ms.partners {
+		for _, digest := range digests {
+			delete(p.queued, strings.ToLower(digest))
+		}
+		pending := p.pending[:0]
+		for _, digest := range p.pending {
+			if p.queued[digest] {
+				pending = append(pending, digest)
+			}
+		}
+		p.pending = pending
+	}
+}
+
+// Pending returns the number of keys queued for each partner.
+func (ms *MailSync) Pending() map[string]int {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	result := map[string]int{}
+	for addr, p := range ms.partners {
+		result[addr] = len(p.pending)
+	}
+	return result
+}
+
+// Start sends queued keys to partners in the background until Stop is
+// called.
+func (ms *MailSync) Start() {
+	ms.t.Go(ms.run)
+}
+
+// Stop stops sending keys to partners. Keys still queued are not sent.
+func (ms *MailSync) Stop() error {
+	ms.t.Kill(nil)
+	return ms.t.Wait()
+}
+
+func (ms *MailSync) run() error {
+	ticker := time.NewTicker(ms.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ms.t.Dying():
+			return nil
+		case <-ticker.C:
+		}
+		ms.Flush(time.Now())
+	}
+}
+
+// Flush sends the keys queued for each partner, in batches, unless sending
+// to it failed recently.
+func (ms *MailSync) Flush(now time.Time) {
+	ms.mu.Lock()
+	var partners []*mailSyncPartner
+	for _, p := range ms.partners {
+		partners = append(partners, p)
+	}
+	ms.mu.Unlock()
+	for _, p := range partners {
+		err := ms.flush(p, now)
+		if err != nil {
+			log.Errorf("cannot send keys to mailsync partner %q: %v", p.addr, err)
+		}
+	}
+}
+
+func (ms *MailSync) flush(p *mailSyncPartner, now time.Time) error {
+	for {
+		ms.mu.Lock()
+		if len(p.pending) == 0 || now.Before(p.retry) {
+			ms.mu.Unlock()
+			return nil
+		}
+		n := len(p.pending)
+		if n > ms.config.MaxBatch {
+			n = ms.config.MaxBatch
+		}
+		batch := append([]string(nil), p.pending[:n]...)
+		ms.mu.Unlock()
+
+		err := ms.sendBatch(p.addr, batch)
+		ms.mu.Lock()
+		if err != nil {
+			p.failures++
+			backoff := ms.flushInterval << uint(p.failures)
+			if limit := maxDelay * time.Minute; backoff > limit || backoff <= 0 {
+				backoff = limit
+			}
+			p.retry = now.Add(backoff)
+			ms.mu.Unlock()
+			return errgo.Mask(err)
+		}
+		p.failures = 0
+		for _, digest := range batch {
+			delete(p.queued, digest)
+		}
+		pending := p.pending[:0]
+		for _, digest := range p.pending {
+			if p.queued[digest] {
+				pending = append(pending, digest)
+			}
+		}
+		p.pending = pending
+		ms.mu.Unlock()
+	}
+}
+
+// sendBatch sends the current keys with the given digests to the partner
+// at addr. Keys which have since been replaced or removed are skipped, as
+// their replacements are queued too.
+func (ms *MailSync) sendBatch(addr string, digests []string) error {
+	rfps, err := ms.storage.MatchMD5(digests)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	keyrings, err := ms.storage.FetchKeyrings(rfps)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	wanted := map[string]bool{}
+	for _, digest := range digests {
+		wanted[digest] = true
+	}
+	var keys []*openpgp.PrimaryKey
+	for _, kr := range keyrings {
+		if wanted[strings.ToLower(kr.MD5)] {
+			keys = append(keys, kr.PrimaryKey)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	msg, err := ms.message(addr, keys)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	log.Debugf("sending %d keys to mailsync partner %q", len(keys), addr)
+	return errgo.Mask(ms.send(addr, msg), errgo.Any)
+}
+
+// message returns an SKS incremental update message of keys to addr.
+func (ms *MailSync) message(addr string, keys []*openpgp.PrimaryKey) ([]byte, error) {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", ms.config.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", addr)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mailSyncSubject)
+	fmt.Fprintf(&msg, "%s: %s\r\n", keyserverSentHeader, ms.config.Hostname)
+	fmt.Fprintf(&msg, "Content-Type: application/pgp-keys\r\n\r\n")
+	var armored bytes.Buffer
+	err := openpgp.WriteArmoredPackets(&armored, keys)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	msg.Write(crlf(armored.Bytes()))
+	return msg.Bytes(), nil
+}
+
+// Deliver submits the keys in an incremental update message sent by a
+// partner. It may be used with a Receiver, such as a Maildir. Messages
+// which are not incremental updates from partners, with a DKIM signature by
+// the partner's domain, are rejected.
+func (ms *MailSync) Deliver(ctx context.Context, msg []byte) error {
+	msg = crlf(msg)
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		return errgo.WithCausef(err, ErrRejected, "invalid message")
+	}
+	if subject := strings.TrimSpace(m.Header.Get("Subject")); !strings.EqualFold(subject, mailSyncSubject) {
+		return errgo.WithCausef(nil, ErrRejected, "not an incremental update: %q", subject)
+	}
+	sent := strings.TrimSpace(m.Header.Get(keyserverSentHeader))
+	if sent == "" {
+		return errgo.WithCausef(nil, ErrRejected, "incremental update without %s", keyserverSentHeader)
+	} else if strings.EqualFold(sent, ms.config.Hostname) {
+		return errgo.WithCausef(nil, ErrRejected, "incremental update sent by this keyserver")
+	}
+	sender, err := singleAddress(m.Header)
+	if err != nil {
+		return errgo.WithCausef(err, ErrRejected, "invalid sender")
+	}
+	if !ms.accept[strings.ToLower(sender)] {
+		return errgo.WithCausef(nil, ErrRejected, "incremental update from %q, not a partner", sender)
+	}
+	signers, err := ms.verifier.Verify(msg)
+	if err != nil {
+		return errgo.WithCausef(err, ErrRejected, "cannot verify incremental update from %q", sender)
+	}
+	domain := strings.ToLower(sender[strings.LastIndexByte(sender, '@')+1:])
+	if !aligned(domain, signers) {
+		return errgo.WithCausef(nil, ErrRejected, "incremental update from %q not signed by its domain", sender)
+	}
+	keytext, err := extractKeytext(m.Header, m.Body)
+	if err != nil {
+		return errgo.WithCausef(err, ErrRejected, "invalid incremental update from %q", sender)
+	}
+	readKeys, err := openpgp.ReadArmorKeys(strings.NewReader(keytext))
+	if err != nil {
+		return errgo.WithCausef(err, ErrRejected, "invalid incremental update from %q", sender)
+	}
+	var rfps []string
+	for readKey := range readKeys {
+		if readKey.Error == nil {
+			rfps = append(rfps, readKey.PrimaryKey.RFingerprint)
+		}
+	}
+
+	summary, err := ms.submit(ctx, keytext)
+	if isTemporary(err) {
+		return errgo.Notef(err, "cannot submit incremental update from %q", sender)
+	} else if err != nil {
+		return errgo.WithCausef(err, ErrRejected, "incremental update from %q refused", sender)
+	}
+	// Keys received from partners are not sent back to them.
+	keys, err := ms.storage.FetchKeys(rfps)
+	if err != nil {
+		log.Warningf("cannot unqueue incremental update from %q: %v", sender, err)
+	}
+	var digests []string
+	for _, key := range keys {
+		digests = append(digests, key.MD5)
+	}
+	ms.unqueue(digests)
+	log.Infof("incremental update from %q (%s): %s", sender, sent, summary)
+	return nil
+}
@@ -0,0 +1,191 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pks
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/hockeypuck/testing"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/hockeypuck/openpgp.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+	"gopkg.in/hockeypuck/hkp.v1/storage/mock"
+)
+
+type MailSyncSuite struct{}
+
+var _ = gc.Suite(&MailSyncSuite{})
+
+var testMailSyncConfig = MailSyncConfig{
+	From:          "pgp-public-keys@keys.example.net",
+	Partners:      []string{"pgp-public-keys@sks.example.com", "pgp-public-keys@sks.example.org"},
+	SMTP:          SMTPConfig{Host: "localhost:25"},
+	Hostname:      "keys.example.net",
+	MaxBatch:      2,
+	FlushInterval: "1m",
+}
+
+// refuseSubmit is a SubmitFunc for tests which submit no keys.
+func refuseSubmit(context.Context, string) (string, error) {
+	return "", errgo.New("unexpected submission")
+}
+
+func (s *MailSyncSuite) TestNewMailSync(c *gc.C) {
+	_, err := NewMailSync(mock.NewStorage(), refuseSubmit, MailSyncConfig{From: "keys@example.net"})
+	c.Assert(err, gc.ErrorMatches, "mailsync requires a sender and partners")
+	config := testMailSyncConfig
+	config.FlushInterval = "soon"
+	_, err = NewMailSync(mock.NewStorage(), refuseSubmit, config)
+	c.Assert(err, gc.ErrorMatches, `invalid mailsync flush interval "soon"`)
+}
+
+func (s *MailSyncSuite) TestQueue(c *gc.C) {
+	var matchErr error
+	st := mock.NewStorage(mock.MatchMD5(func([]string) ([]string, error) {
+		return nil, matchErr
+	}))
+	ms, err := NewMailSync(st, refuseSubmit, testMailSyncConfig)
+	c.Assert(err, gc.IsNil)
+	var sent int
+	ms.send = func(string, []byte) error {
+		sent++
+		return nil
+	}
+
+	c.Assert(st.Notify(storage.KeyAdded{Digest: "AAAA"}), gc.IsNil)
+	c.Assert(st.Notify(storage.KeyReplaced{OldDigest: "aaaa", NewDigest: "bbbb"}), gc.IsNil)
+	c.Assert(st.Notify(storage.KeyAdded{Digest: "aaaa"}), gc.IsNil)
+	c.Assert(st.Notify(storage.KeyRemoved{Digest: "cccc"}), gc.IsNil)
+	c.Assert(ms.Pending(), gc.DeepEquals, map[string]int{
+		"pgp-public-keys@sks.example.com": 2,
+		"pgp-public-keys@sks.example.org": 2,
+	})
+	ms.unqueue([]string{"BBBB"})
+	c.Assert(ms.Pending()["pgp-public-keys@sks.example.com"], gc.Equals, 1)
+
+	// Failures are retried with backoff.
+	now := time.Now()
+	matchErr = errgo.New("storage unavailable")
+	ms.Flush(now)
+	c.Assert(ms.Pending()["pgp-public-keys@sks.example.com"], gc.Equals, 1)
+	matchErr = nil
+	ms.Flush(now.Add(time.Minute))
+	c.Assert(ms.Pending()["pgp-public-keys@sks.example.com"], gc.Equals, 1)
+	ms.Flush(now.Add(2 * time.Minute))
+	// Keys no longer stored are not sent.
+	c.Assert(ms.Pending()["pgp-public-keys@sks.example.com"], gc.Equals, 0)
+	c.Assert(sent, gc.Equals, 0)
+}
+
+func (s *MailSyncSuite) TestDeliverRejected(c *gc.C) {
+	st := mock.NewStorage()
+	var submitErr error
+	ms, err := NewMailSync(st, func(context.Context, string) (string, error) {
+		return "", submitErr
+	}, testMailSyncConfig)
+	c.Assert(err, gc.IsNil)
+	ms.verifier = fakeVerifier{"example.com"}
+	msg := func(from, subject, sent string) []byte {
+		return []byte("From: " + from + "\r\nSubject: " + subject + "\r\n" +
+			keyserverSentHeader + ": " + sent + "\r\n\r\n" + testKeytext + "\r\n")
+	}
+	for _, test := range []struct {
+		msg []byte
+		err string
+	}{{
+		msg(testMailSyncConfig.Partners[0], "ADD", "sks.example.com"),
+		`not an incremental update: "ADD"`,
+	}, {
+		msg(testMailSyncConfig.Partners[0], "incremental", "keys.example.net"),
+		`incremental update sent by this keyserver`,
+	}, {
+		msg("mallory@example.com", "incremental", "sks.example.com"),
+		`incremental update from "mallory@example.com", not a partner`,
+	}, {
+		msg(testMailSyncConfig.Partners[1], "incremental", "sks.example.org"),
+		`incremental update from "pgp-public-keys@sks.example.org" not signed by its domain`,
+	}, {
+		[]byte("From: mallory@example.net\r\n" + string(msg(testMailSyncConfig.Partners[0], "incremental", "sks.example.com"))),
+		`invalid sender: 2 From fields`,
+	}} {
+		err := ms.Deliver(context.Background(), test.msg)
+		c.Check(errgo.Cause(err), gc.Equals, ErrRejected)
+		c.Check(err, gc.ErrorMatches, test.err)
+	}
+	c.Assert(st.MethodCount("Insert"), gc.Equals, 0)
+
+	// Keys refused by submission policies are rejected, and temporary
+	// failures are delivered again.
+	partnerMsg := msg(testMailSyncConfig.Partners[0], "incremental", "sks.example.com")
+	submitErr = errgo.New("key refused")
+	err = ms.Deliver(context.Background(), partnerMsg)
+	c.Assert(errgo.Cause(err), gc.Equals, ErrRejected)
+	c.Assert(err, gc.ErrorMatches, `incremental update from "pgp-public-keys@sks.example.com" refused: key refused`)
+	submitErr = errgo.Mask(temporaryError{}, errgo.Any)
+	err = ms.Deliver(context.Background(), partnerMsg)
+	c.Assert(err, gc.NotNil)
+	c.Assert(errgo.Cause(err), gc.Not(gc.Equals), ErrRejected)
+}
+
+func (s *MailSyncSuite) TestSync(c *gc.C) {
+	keys := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")).MustParse()
+	c.Assert(keys, gc.HasLen, 1)
+	st := mock.NewStorage(
+		mock.MatchMD5(func([]string) ([]string, error) {
+			return []string{keys[0].RFingerprint}, nil
+		}),
+		mock.FetchKeyrings(func([]string) ([]*storage.Keyring, error) {
+			return []*storage.Keyring{{PrimaryKey: keys[0]}}, nil
+		}),
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return keys, nil
+		}),
+	)
+	var submitted []string
+	ms, err := NewMailSync(st, func(ctx context.Context, keytext string) (string, error) {
+		submitted = append(submitted, keytext)
+		return "updated 1 key", st.Notify(storage.KeyAdded{Digest: keys[0].MD5})
+	}, testMailSyncConfig)
+	c.Assert(err, gc.IsNil)
+	ms.verifier = fakeVerifier{"example.com"}
+	sent := map[string]string{}
+	ms.send = func(addr string, msg []byte) error {
+		sent[addr] = string(msg)
+		return nil
+	}
+	c.Assert(st.Notify(storage.KeyAdded{Digest: keys[0].MD5}), gc.IsNil)
+	ms.Flush(time.Now())
+	c.Assert(sent, gc.HasLen, 2)
+	msg := sent["pgp-public-keys@sks.example.org"]
+	c.Assert(msg, gc.Matches, `(?s).*\r\nSubject: incremental\r\n.*`)
+	c.Assert(msg, gc.Matches, `(?s).*\r\nX-Keyserver-Sent: keys.example.net\r\n.*`)
+	c.Assert(strings.Contains(msg, armorBegin), gc.Equals, true)
+
+	// Incremental updates from partners are submitted.
+	msg = strings.Replace(msg, "From: pgp-public-keys@keys.example.net", "From: pgp-public-keys@sks.example.com", 1)
+	msg = strings.Replace(msg, "keys.example.net", "sks.example.com", -1)
+	err = ms.Deliver(context.Background(), []byte(msg))
+	c.Assert(err, gc.IsNil)
+	c.Assert(submitted, gc.HasLen, 1)
+	// Keys received from partners are not sent back to them.
+	c.Assert(ms.Pending()["pgp-public-keys@sks.example.com"], gc.Equals, 0)
+}
@@ -91,18 +91,10 @@ func NewSender(hkpStorage storage.Storage, pksStorage Storage, config *Config) (
 	}
 
 	var err error
-	authHost := sender.config.SMTP.Host
-	if parts := strings.Split(authHost, ":"); len(parts) >= 1 {
-		// Strip off the port, use only the hostname for auth
-		authHost, _, err = net.SplitHostPort(authHost)
-		if err != nil {
-			return nil, errgo.Mask(err)
-		}
+	sender.smtpAuth, err = newSMTPAuth(sender.config.SMTP)
+	if err != nil {
+		return nil, errgo.Mask(err)
 	}
-	sender.smtpAuth = smtp.PlainAuth(
-		sender.config.SMTP.ID,
-		sender.config.SMTP.User,
-		sender.config.SMTP.Password, authHost)
 
 	err = sender.initStatus()
 	if err != nil {
@@ -111,6 +103,20 @@ func NewSender(hkpStorage storage.Storage, pksStorage Storage, config *Config) (
 	return sender, nil
 }
 
+// newSMTPAuth returns the authentication configured for an SMTP server.
+func newSMTPAuth(config SMTPConfig) (smtp.Auth, error) {
+	var err error
+	authHost := config.Host
+	if parts := strings.Split(authHost, ":"); len(parts) >= 1 {
+		// Strip off the port, use only the hostname for auth
+		authHost, _, err = net.SplitHostPort(authHost)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	return smtp.PlainAuth(config.ID, config.User, config.Password, authHost), nil
+}
+
 func (sender *Sender) initStatus() error {
 	for _, emailAddr := range sender.config.To {
 		err := sender.pksStorage.Init(emailAddr)
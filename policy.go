@@ -0,0 +1,225 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	log "gopkg.in/hockeypuck/logrus.v0"
+	"gopkg.in/hockeypuck/openpgp.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/metrics"
+	"gopkg.in/hockeypuck/hkp.v1/sks"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+)
+
+// PolicyFunc decides whether a key submitted in req may be stored, returning
+// the reason if not. A PolicyError sets the status of the response;
+// otherwise the submission is refused as a bad request.
+type PolicyFunc func(key *openpgp.PrimaryKey, req *http.Request) error
+
+// PolicyError is a reason for refusing a submitted key, with the HTTP status
+// to respond with.
+type PolicyError struct {
+	Status int
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return e.Reason
+}
+
+// RefuseKey returns a PolicyError refusing a key with the given status and
+// reason.
+func RefuseKey(status int, format string, args ...interface{}) error {
+	return &PolicyError{Status: status, Reason: fmt.Sprintf(format, args...)}
+}
+
+// SubmissionPolicy registers policies deciding whether keys submitted
+// through /pks/add and the verifying upload API may be stored. Policies are
+// checked in the order registered, after duplicate packets are dropped,
+// unhashed subpackets are stripped and packet limits are enforced, and the
+// first refusal is returned to the client. They are checked again on the
+// key as merged with the key stored, so that a key cannot be built up past
+// them through several submissions. Several may be registered.
+func SubmissionPolicy(policies ...PolicyFunc) HandlerOption {
+	return func(h *Handler) error {
+		h.policies = append(h.policies, policies...)
+		return nil
+	}
+}
+
+// checkPolicy returns why key, submitted in r, is refused by policy, if it
+// is. Keys taken down or deleted are refused outright. Otherwise, unhashed
+// subpackets are stripped and packet limits enforced before the policies
+// are checked, and packets dropped are counted in pc.
+//
+// Unhashed subpackets are not covered by signatures, so anyone may pad
+// them. They are stripped before the limits are enforced, so that padding
+// counts neither towards MaxKeySize nor the notation limits, and cannot
+// cause legitimate signatures to be truncated in its place. They need not
+// be stripped again after merging, since the key stored was stripped when
+// it was submitted or recovered.
+func (h *Handler) checkPolicy(key *openpgp.PrimaryKey, r *http.Request,
+	pc *storage.PacketCounts) error {
+	if td := h.takedowns.key(key); td != nil {
+		return RefuseKey(http.StatusUnavailableForLegalReasons, "key %s withheld for legal reasons: %s",
+			key.Fingerprint(), td.Reason)
+	}
+	if h.deleted != nil && h.deleted.KeyBlocked(key) {
+		return RefuseKey(http.StatusGone, "key %s has been deleted", key.Fingerprint())
+	}
+	if h.stripUnhashed {
+		n, err := storage.StripUnhashed(key)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if n > 0 {
+			metrics.UnhashedStripped(sks.SourceAdd, n)
+		}
+	}
+	if h.limits != nil {
+		lc, err := h.limits.Enforce(key)
+		if err != nil {
+			return errgo.Mask(err, errgo.Is(storage.ErrLimitExceeded))
+		}
+		pc.Accepted = lc.Accepted
+		pc.Dropped += lc.Dropped
+	}
+	for _, policy := range h.policies {
+		if err := policy(key, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkMerged returns why key, submitted in r and merged with the key
+// stored, is refused, if it is. Packet limits are enforced and policies
+// checked again, since the merged key may exceed them even though neither
+// the key submitted nor the key stored does. In storage.LimitTruncate mode,
+// packets of the key stored may be dropped too.
+func (h *Handler) checkMerged(key *openpgp.PrimaryKey, r *http.Request) error {
+	if h.limits != nil {
+		_, err := h.limits.Enforce(key)
+		if err != nil {
+			return errgo.Mask(err, errgo.Is(storage.ErrLimitExceeded))
+		}
+	}
+	for _, policy := range h.policies {
+		if err := policy(key, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refuseKey responds to a submission refused by policy with err.
+func (h *Handler) refuseKey(w http.ResponseWriter, r *http.Request, err error) {
+	if h.rejectFunc != nil {
+		h.rejectFunc(err)
+	}
+	status := http.StatusBadRequest
+	if pe, ok := errgo.Cause(err).(*PolicyError); ok && pe.Status != 0 {
+		status = pe.Status
+	} else if errgo.Cause(err) == storage.ErrLimitExceeded {
+		status = http.StatusUnprocessableEntity
+	}
+	log.Infof("key from %v refused by policy: %v", h.ClientIP(r), err)
+	http.Error(w, err.Error(), status)
+}
+
+// MaxKeySize refuses keys larger than n bytes, as stored.
+func MaxKeySize(n int) PolicyFunc {
+	return func(key *openpgp.PrimaryKey, _ *http.Request) error {
+		size, err := storage.KeySize(key)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if size > n {
+			return RefuseKey(http.StatusRequestEntityTooLarge,
+				"key is %d bytes, more than the %d allowed", size, n)
+		}
+		return nil
+	}
+}
+
+// MaxUserAttributes refuses keys with more than n user attributes, such as
+// photo IDs.
+func MaxUserAttributes(n int) PolicyFunc {
+	return func(key *openpgp.PrimaryKey, _ *http.Request) error {
+		if len(key.UserAttributes) > n {
+			return RefuseKey(http.StatusUnprocessableEntity,
+				"key has %d user attributes, more than the %d allowed", len(key.UserAttributes), n)
+		}
+		return nil
+	}
+}
+
+// MaxSignatures refuses keys with more than n signatures in total, such as
+// keys flooded with certifications.
+func MaxSignatures(n int) PolicyFunc {
+	return func(key *openpgp.PrimaryKey, _ *http.Request) error {
+		count := countSignatures(key)
+		if count > n {
+			return RefuseKey(http.StatusUnprocessableEntity,
+				"key has %d signatures, more than the %d allowed", count, n)
+		}
+		return nil
+	}
+}
+
+func countSignatures(key *openpgp.PrimaryKey) int {
+	count := len(key.Signatures)
+	for _, uid := range key.UserIDs {
+		count += len(uid.Signatures)
+	}
+	for _, uat := range key.UserAttributes {
+		count += len(uat.Signatures)
+	}
+	for _, subKey := range key.SubKeys {
+		count += len(subKey.Signatures)
+	}
+	return count
+}
+
+// AllowedDomains refuses keys unless every user ID has an email address at
+// one of domains, such as for a keyserver serving a single organization.
+// Internationalized domains match in either Unicode or punycode form.
+func AllowedDomains(domains ...string) PolicyFunc {
+	allowed := map[string]bool{}
+	for _, domain := range domains {
+		allowed[storage.NormalizeDomain(domain)] = true
+	}
+	return func(key *openpgp.PrimaryKey, _ *http.Request) error {
+		if len(key.UserIDs) == 0 {
+			return RefuseKey(http.StatusForbidden, "key has no user IDs")
+		}
+		for _, uid := range key.UserIDs {
+			email := storage.EmailAddress(uid.Keywords)
+			at := strings.LastIndex(email, "@")
+			if at < 0 || !allowed[storage.NormalizeDomain(email[at+1:])] {
+				return RefuseKey(http.StatusForbidden, "user ID %q is not at an allowed domain", uid.Keywords)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,93 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package privacy adds noise to published statistics, so that aggregate
+// counts can be shared without revealing whether any individual key or
+// lookup contributed to them.
+package privacy
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"math"
+)
+
+// Noise perturbs counts with the Laplace mechanism and then rounds them. A
+// nil or zero Noise leaves counts unchanged.
+type Noise struct {
+	// Epsilon is the privacy budget spent on each count. Laplace noise with
+	// scale 1/Epsilon is added; smaller values add more noise. Zero adds
+	// none.
+	Epsilon float64
+
+	// Round rounds noisy counts to the nearest multiple of Round, if it is
+	// greater than one.
+	Round int
+}
+
+// Count returns n perturbed by the noise, never less than zero.
+func (z *Noise) Count(n int) int {
+	if z == nil {
+		return n
+	}
+	x := float64(n)
+	if z.Epsilon > 0 {
+		x += laplace(1 / z.Epsilon)
+	}
+	if z.Round > 1 {
+		x = math.Floor(x/float64(z.Round)+0.5) * float64(z.Round)
+	} else {
+		x = math.Floor(x + 0.5)
+	}
+	if x < 0 {
+		return 0
+	}
+	return int(x)
+}
+
+// Counts perturbs each count in m in place.
+func (z *Noise) Counts(m map[string]int) {
+	for k, n := range m {
+		m[k] = z.Count(n)
+	}
+}
+
+// laplace returns a sample from the Laplace distribution centered on zero
+// with the given scale.
+func laplace(scale float64) float64 {
+	// u is uniform in (-0.5, 0.5).
+	u := uniform() - 0.5
+	if u < 0 {
+		return scale * math.Log(1+2*u)
+	}
+	return -scale * math.Log(1-2*u)
+}
+
+// uniform returns a cryptographically random float64 in (0, 1), so that the
+// noise cannot be predicted and subtracted.
+func uniform() float64 {
+	var buf [8]byte
+	for {
+		if _, err := rand.Read(buf[:]); err != nil {
+			panic("privacy: cannot read random bytes: " + err.Error())
+		}
+		f := float64(binary.BigEndian.Uint64(buf[:])>>11) / (1 << 53)
+		if f > 0 {
+			return f
+		}
+	}
+}
@@ -0,0 +1,60 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package privacy
+
+import (
+	"testing"
+
+	gc "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type PrivacySuite struct{}
+
+var _ = gc.Suite(&PrivacySuite{})
+
+func (s *PrivacySuite) TestCount(c *gc.C) {
+	var none *Noise
+	c.Assert(none.Count(42), gc.Equals, 42)
+	c.Assert((&Noise{}).Count(42), gc.Equals, 42)
+	c.Assert((&Noise{Round: 10}).Count(42), gc.Equals, 40)
+	c.Assert((&Noise{Round: 10}).Count(45), gc.Equals, 50)
+
+	// Noise is unbiased, so the mean of many samples is close to the
+	// true count, but samples vary.
+	noise := &Noise{Epsilon: 1}
+	sum, distinct := 0, map[int]bool{}
+	for i := 0; i < 10000; i++ {
+		n := noise.Count(1000)
+		sum += n
+		distinct[n] = true
+	}
+	mean := float64(sum) / 10000
+	c.Assert(mean > 999 && mean < 1001, gc.Equals, true, gc.Commentf("mean %v", mean))
+	c.Assert(len(distinct) > 1, gc.Equals, true)
+
+	// Counts are never negative.
+	for i := 0; i < 100; i++ {
+		c.Assert((&Noise{Epsilon: 0.1}).Count(0) >= 0, gc.Equals, true)
+	}
+
+	m := map[string]int{"RSA/4096": 42}
+	(&Noise{Round: 10}).Counts(m)
+	c.Assert(m, gc.DeepEquals, map[string]int{"RSA/4096": 40})
+}
@@ -0,0 +1,367 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package proof verifies identity proofs claimed by OpenPGP keys, in the
+// style of Keyoxide and Keybase. A key claims an identity with a notation
+// on a user ID self-signature, whose value is a URI such as
+// "dns:example.com?type=TXT" or "https://example.com/.well-known/openpgp".
+// The claim is proven when the resource at the URI refers back to the key's
+// fingerprint, as "openpgp4fpr:<fingerprint>".
+package proof
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/openpgp/packet"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/hockeypuck/openpgp.v1"
+)
+
+// Notation names under which keys claim identity proofs.
+const (
+	NotationAriadne  = "proof@ariadne.id"
+	NotationMetacode = "proof@metacode.biz"
+)
+
+const (
+	// subpacketNotation is the notation data signature subpacket type
+	// (RFC 4880, Section 5.2.3.16).
+	subpacketNotation = 20
+
+	// sigPositiveCert is the highest of the user ID certification
+	// signature types, 0x10 to 0x13 (RFC 4880, Section 5.2.1).
+	sigGenericCert  = 0x10
+	sigPositiveCert = 0x13
+)
+
+// ErrNotProven is the cause of verification errors when the resource
+// claimed does not refer back to the key.
+var ErrNotProven = errgo.New("proof does not refer to key")
+
+// Verifier verifies claims of a single URI scheme.
+type Verifier interface {
+	// Verify returns nil if the resource at uri refers to the key with
+	// the given fingerprint, or an error with cause ErrNotProven if it
+	// does not.
+	Verify(ctx context.Context, uri *url.URL, fingerprint string) error
+}
+
+// Result is the outcome of verifying a claim.
+type Result struct {
+	URI      string
+	Verified bool
+	Err      error
+	Checked  time.Time
+}
+
+// Notation is a name and value from a notation data subpacket.
+type Notation struct {
+	Name  string
+	Value string
+}
+
+// Notations returns the notations in the hashed subpackets of a version 4
+// signature packet. Unhashed notations are ignored, since anyone may add
+// them.
+func Notations(buf []byte) ([]Notation, error) {
+	op, err := packet.NewOpaqueReader(bytes.NewReader(buf)).Next()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	body := op.Contents
+	if len(body) < 6 || body[0] != 4 {
+		return nil, errgo.New("not a version 4 signature")
+	}
+	hashedLen := int(body[4])<<8 | int(body[5])
+	if len(body) < 6+hashedLen {
+		return nil, errgo.New("truncated hashed subpackets")
+	}
+	subpackets, err := packet.OpaqueSubpackets(body[6 : 6+hashedLen])
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var result []Notation
+	for _, sp := range subpackets {
+		if sp.SubType&0x7f != subpacketNotation {
+			continue
+		}
+		// Flags, then the name and value lengths.
+		c := sp.Contents
+		if len(c) < 8 {
+			return nil, errgo.New("truncated notation")
+		}
+		nameLen := int(c[4])<<8 | int(c[5])
+		valueLen := int(c[6])<<8 | int(c[7])
+		if len(c) < 8+nameLen+valueLen {
+			return nil, errgo.New("truncated notation")
+		}
+		result = append(result, Notation{
+			Name:  string(c[8 : 8+nameLen]),
+			Value: string(c[8+nameLen : 8+nameLen+valueLen]),
+		})
+	}
+	return result, nil
+}
+
+// Claims returns the proof URIs claimed by the latest self-certification of
+// each user ID of key, sorted and without duplicates. Signatures are not
+// verified; keys in storage were checked when they were merged.
+func Claims(key *openpgp.PrimaryKey) []string {
+	claims := map[string]bool{}
+	for _, uid := range key.UserIDs {
+		var latest *openpgp.Signature
+		for _, sig := range uid.Signatures {
+			if sig.RIssuerKeyID != key.RKeyID || sig.SigType < sigGenericCert || sig.SigType > sigPositiveCert {
+				continue
+			}
+			if latest == nil || sig.Creation.After(latest.Creation) {
+				latest = sig
+			}
+		}
+		if latest == nil {
+			continue
+		}
+		notations, err := Notations(latest.Packet.Packet)
+		if err != nil {
+			continue
+		}
+		for _, n := range notations {
+			if n.Name == NotationAriadne || n.Name == NotationMetacode {
+				claims[n.Value] = true
+			}
+		}
+	}
+	var result []string
+	for claim := range claims {
+		result = append(result, claim)
+	}
+	sort.Strings(result)
+	return result
+}
+
+const (
+	// DefaultTTL is how long verification results are cached by default.
+	DefaultTTL = time.Hour
+
+	// DefaultTimeout limits how long each verification may take by default.
+	DefaultTimeout = 10 * time.Second
+
+	// DefaultMaxClaims is how many claims of each key are verified by
+	// default.
+	DefaultMaxClaims = 10
+
+	// DefaultCacheSize is how many verification results are cached by
+	// default.
+	DefaultCacheSize = 10000
+
+	// concurrency limits how many verifications run at once.
+	concurrency = 4
+
+	// maxChecking limits how many verifications may be outstanding, so that
+	// a burst of lookups cannot queue unbounded work. Claims beyond it are
+	// verified on a later lookup.
+	maxChecking = 1000
+)
+
+var (
+	// ErrPending is the cause of the error in results of claims which have
+	// not yet been verified.
+	ErrPending = errgo.New("proof not yet verified")
+
+	// ErrTooManyClaims is the cause of the error in results of claims
+	// beyond the most verified for each key.
+	ErrTooManyClaims = errgo.New("too many proofs claimed")
+)
+
+// Checker verifies the claims of keys with the Verifier registered for each
+// URI scheme. Claims are verified in the background and their results
+// cached, so that lookups neither wait for nor repeatedly query the claimed
+// resources.
+type Checker struct {
+	ttl       time.Duration
+	timeout   time.Duration
+	maxClaims int
+	size      int
+	verifiers map[string]Verifier
+	sem       chan struct{}
+
+	mu    sync.Mutex
+	cache map[string]*list.Element
+	// order holds the cached results, least recently used first.
+	order *list.List
+	// checking holds the claims being verified.
+	checking map[string]bool
+	wg       sync.WaitGroup
+}
+
+type cacheEntry struct {
+	key    string
+	result *Result
+}
+
+// NewChecker returns a Checker which verifies "dns" claims with DNS and
+// "https" claims with HTTPS, using the default resolver and an HTTP client
+// which only connects to public addresses.
+func NewChecker() *Checker {
+	c := &Checker{
+		ttl:       DefaultTTL,
+		timeout:   DefaultTimeout,
+		maxClaims: DefaultMaxClaims,
+		size:      DefaultCacheSize,
+		verifiers: map[string]Verifier{},
+		sem:       make(chan struct{}, concurrency),
+		cache:     map[string]*list.Element{},
+		order:     list.New(),
+		checking:  map[string]bool{},
+	}
+	c.Register("dns", &DNS{})
+	c.Register("https", &HTTPS{})
+	return c
+}
+
+// Register verifies claims with the given URI scheme using v, replacing any
+// Verifier already registered for it.
+func (c *Checker) Register(scheme string, v Verifier) {
+	c.verifiers[strings.ToLower(scheme)] = v
+}
+
+// SetTTL sets how long verification results are cached.
+func (c *Checker) SetTTL(ttl time.Duration) {
+	c.ttl = ttl
+}
+
+// SetTimeout limits how long each verification may take.
+func (c *Checker) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+// SetMaxClaims limits how many claims of each key are verified.
+func (c *Checker) SetMaxClaims(n int) {
+	c.maxClaims = n
+}
+
+// SetCacheSize limits how many verification results are cached.
+func (c *Checker) SetCacheSize(size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size = size
+	c.evict()
+}
+
+// Check returns the cached result of verifying each claim of key, without
+// waiting for claims to be verified. Claims not yet verified, or whose
+// results have expired, are verified in the background; until then, they
+// are reported with an error with cause ErrPending, or with their expired
+// result. Claims with schemes for which no Verifier is registered are
+// reported as unverified.
+func (c *Checker) Check(ctx context.Context, key *openpgp.PrimaryKey) []*Result {
+	fp := strings.ToLower(key.Fingerprint())
+	now := time.Now()
+	var result []*Result
+	for i, claim := range Claims(key) {
+		if i >= c.maxClaims {
+			result = append(result, &Result{
+				URI: claim,
+				Err: errgo.WithCausef(nil, ErrTooManyClaims, "only %d proofs are verified", c.maxClaims),
+			})
+			continue
+		}
+		result = append(result, c.cached(fp, claim, now))
+	}
+	return result
+}
+
+// cached returns the cached result of verifying claim, verifying it in the
+// background if it is missing or expired.
+func (c *Checker) cached(fp, claim string, now time.Time) *Result {
+	cacheKey := fp + " " + claim
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.cache[cacheKey]
+	if ok {
+		c.order.MoveToBack(elem)
+		r := elem.Value.(*cacheEntry).result
+		if now.Sub(r.Checked) >= c.ttl {
+			c.schedule(cacheKey, fp, claim)
+		}
+		return r
+	}
+	c.schedule(cacheKey, fp, claim)
+	return &Result{URI: claim, Err: ErrPending}
+}
+
+// schedule verifies claim in the background, unless it is already being
+// verified or too many verifications are outstanding. c.mu must be held.
+func (c *Checker) schedule(cacheKey, fp, claim string) {
+	if c.checking[cacheKey] || len(c.checking) >= maxChecking {
+		return
+	}
+	c.checking[cacheKey] = true
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.sem <- struct{}{}
+		r := c.check(fp, claim)
+		<-c.sem
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.checking, cacheKey)
+		if elem, ok := c.cache[cacheKey]; ok {
+			elem.Value.(*cacheEntry).result = r
+			c.order.MoveToBack(elem)
+		} else {
+			c.cache[cacheKey] = c.order.PushBack(&cacheEntry{key: cacheKey, result: r})
+		}
+		c.evict()
+	}()
+}
+
+// evict removes the least recently used results beyond the cache size.
+// c.mu must be held.
+func (c *Checker) evict() {
+	for c.order.Len() > c.size {
+		oldest := c.order.Front()
+		delete(c.cache, oldest.Value.(*cacheEntry).key)
+		c.order.Remove(oldest)
+	}
+}
+
+// check verifies claim.
+func (c *Checker) check(fp, claim string) *Result {
+	r := &Result{URI: claim, Checked: time.Now()}
+	uri, err := url.Parse(claim)
+	if err != nil {
+		r.Err = errgo.Mask(err)
+	} else if v, ok := c.verifiers[strings.ToLower(uri.Scheme)]; !ok {
+		r.Err = errgo.Newf("unsupported proof scheme %q", uri.Scheme)
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		r.Err = v.Verify(ctx, uri, fp)
+		cancel()
+		r.Verified = r.Err == nil
+	}
+	return r
+}
@@ -0,0 +1,216 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package proof
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/hockeypuck/openpgp.v1"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type ProofSuite struct{}
+
+var _ = gc.Suite(&ProofSuite{})
+
+const testFingerprint = "10fe8cf1b483f7525039aa2a361bc1f023e0dcca"
+
+func notationSubpacket(name, value string) []byte {
+	body := []byte{subpacketNotation, 0x80, 0, 0, 0,
+		byte(len(name) >> 8), byte(len(name)), byte(len(value) >> 8), byte(len(value))}
+	body = append(body, name...)
+	body = append(body, value...)
+	return append([]byte{byte(len(body))}, body...)
+}
+
+// sigPacket returns a version 4 certification signature packet with the
+// given hashed and unhashed subpackets.
+func sigPacket(hashed, unhashed []byte) []byte {
+	body := []byte{4, sigPositiveCert, 1, 8, byte(len(hashed) >> 8), byte(len(hashed))}
+	body = append(body, hashed...)
+	body = append(body, byte(len(unhashed)>>8), byte(len(unhashed)))
+	body = append(body, unhashed...)
+	body = append(body, 0xab, 0xcd, 0, 1, 1)
+	return append([]byte{0xc2, byte(len(body))}, body...)
+}
+
+func claimSig(issuer string, creation time.Time, claim string) *openpgp.Signature {
+	return &openpgp.Signature{
+		Packet:       openpgp.Packet{Tag: 2, Packet: sigPacket(notationSubpacket(NotationAriadne, claim), nil)},
+		SigType:      sigPositiveCert,
+		RIssuerKeyID: issuer,
+		Creation:     creation,
+	}
+}
+
+func (s *ProofSuite) TestNotations(c *gc.C) {
+	buf := sigPacket(notationSubpacket(NotationAriadne, "dns:example.com?type=TXT"),
+		notationSubpacket(NotationAriadne, "https://evil.example.com/"))
+	notations, err := Notations(buf)
+	c.Assert(err, gc.IsNil)
+	c.Assert(notations, gc.DeepEquals, []Notation{{NotationAriadne, "dns:example.com?type=TXT"}})
+
+	_, err = Notations([]byte{0xc2, 1, 3})
+	c.Assert(err, gc.NotNil)
+}
+
+func (s *ProofSuite) TestClaims(c *gc.C) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	key := &openpgp.PrimaryKey{
+		PublicKey: openpgp.PublicKey{RKeyID: "cdab"},
+		UserIDs: []*openpgp.UserID{{
+			Keywords: "alice <alice@example.com>",
+			Signatures: []*openpgp.Signature{
+				claimSig("cdab", t0, "https://old.example.com/"),
+				claimSig("cdab", t0.Add(time.Hour), "dns:example.com?type=TXT"),
+				claimSig("ef01", t0.Add(2*time.Hour), "https://third-party.example.com/"),
+			},
+		}, {
+			Keywords: "alice <alice@example.org>",
+			Signatures: []*openpgp.Signature{
+				claimSig("cdab", t0, "dns:example.com?type=TXT"),
+			},
+		}},
+	}
+	c.Assert(Claims(key), gc.DeepEquals, []string{"dns:example.com?type=TXT"})
+}
+
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return r[name], nil
+}
+
+func (s *ProofSuite) TestDNS(c *gc.C) {
+	d := &DNS{Resolver: fakeResolver{
+		"example.com": {"v=spf1 -all", "openpgp4fpr:" + testFingerprint},
+		"example.org": {"v=spf1 -all"},
+	}}
+	uri, err := url.Parse("dns:example.com?type=TXT")
+	c.Assert(err, gc.IsNil)
+	c.Assert(d.Verify(context.Background(), uri, testFingerprint), gc.IsNil)
+
+	uri, err = url.Parse("dns:example.org?type=TXT")
+	c.Assert(err, gc.IsNil)
+	err = d.Verify(context.Background(), uri, testFingerprint)
+	c.Assert(errgo.Cause(err), gc.Equals, ErrNotProven)
+}
+
+func (s *ProofSuite) TestHTTPS(c *gc.C) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/.well-known/openpgp" {
+			fmt.Fprintf(w, "openpgp4fpr:%s\n", "10FE8CF1B483F7525039AA2A361BC1F023E0DCCA")
+			return
+		}
+		fmt.Fprintln(w, "nothing to see here")
+	}))
+	defer srv.Close()
+	h := &HTTPS{Client: srv.Client()}
+
+	uri, err := url.Parse(srv.URL + "/.well-known/openpgp")
+	c.Assert(err, gc.IsNil)
+	c.Assert(h.Verify(context.Background(), uri, testFingerprint), gc.IsNil)
+
+	uri, err = url.Parse(srv.URL + "/elsewhere")
+	c.Assert(err, gc.IsNil)
+	err = h.Verify(context.Background(), uri, testFingerprint)
+	c.Assert(errgo.Cause(err), gc.Equals, ErrNotProven)
+
+	// By default, only public addresses are connected to.
+	h = &HTTPS{}
+	uri, err = url.Parse(srv.URL + "/.well-known/openpgp")
+	c.Assert(err, gc.IsNil)
+	err = h.Verify(context.Background(), uri, testFingerprint)
+	c.Assert(err, gc.ErrorMatches, `.*refusing to connect to non-public address 127\.0\.0\.1`)
+	for _, addr := range []string{"10.0.0.1:443", "169.254.169.254:80", "[::1]:443", "[fe80::1]:443", "0.0.0.0:443"} {
+		c.Check(refuseNonPublic("tcp", addr, nil), gc.NotNil, gc.Commentf("%s", addr))
+	}
+	c.Assert(refuseNonPublic("tcp", "93.184.216.34:443", nil), gc.IsNil)
+}
+
+type countingVerifier int
+
+func (v *countingVerifier) Verify(ctx context.Context, uri *url.URL, fingerprint string) error {
+	*v++
+	return nil
+}
+
+func (s *ProofSuite) TestChecker(c *gc.C) {
+	key := &openpgp.PrimaryKey{
+		PublicKey: openpgp.PublicKey{RKeyID: "cdab"},
+		UserIDs: []*openpgp.UserID{{
+			Signatures: []*openpgp.Signature{
+				claimSig("cdab", time.Now(), "test:alice"),
+			},
+		}, {
+			Signatures: []*openpgp.Signature{
+				claimSig("cdab", time.Now(), "gopher:alice"),
+			},
+		}},
+	}
+	var count countingVerifier
+	checker := NewChecker()
+	checker.Register("test", &count)
+
+	// Claims are verified in the background.
+	results := checker.Check(context.Background(), key)
+	c.Assert(results, gc.HasLen, 2)
+	c.Assert(errgo.Cause(results[0].Err), gc.Equals, ErrPending)
+	c.Assert(errgo.Cause(results[1].Err), gc.Equals, ErrPending)
+	checker.wg.Wait()
+	results = checker.Check(context.Background(), key)
+	c.Assert(results, gc.HasLen, 2)
+	c.Assert(results[0].URI, gc.Equals, "gopher:alice")
+	c.Assert(results[0].Verified, gc.Equals, false)
+	c.Assert(results[0].Err, gc.ErrorMatches, `unsupported proof scheme "gopher"`)
+	c.Assert(results[1].URI, gc.Equals, "test:alice")
+	c.Assert(results[1].Verified, gc.Equals, true)
+	c.Assert(int(count), gc.Equals, 1)
+
+	// Results are cached until they expire, and then served until they
+	// are verified again.
+	checker.Check(context.Background(), key)
+	checker.wg.Wait()
+	c.Assert(int(count), gc.Equals, 1)
+	checker.SetTTL(0)
+	results = checker.Check(context.Background(), key)
+	c.Assert(results[1].Verified, gc.Equals, true)
+	checker.wg.Wait()
+	c.Assert(int(count), gc.Equals, 2)
+
+	// The cache is bounded.
+	checker.SetCacheSize(1)
+	c.Assert(checker.order.Len(), gc.Equals, 1)
+
+	// Only so many claims of each key are verified.
+	checker.SetMaxClaims(1)
+	results = checker.Check(context.Background(), key)
+	c.Assert(results, gc.HasLen, 2)
+	c.Assert(errgo.Cause(results[1].Err), gc.Equals, ErrTooManyClaims)
+	checker.wg.Wait()
+}
@@ -0,0 +1,169 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package proof
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+const (
+	// maxProofSize limits how much of a proof document is read.
+	maxProofSize = 1 << 20
+
+	// maxRedirects limits how many redirects are followed to a proof
+	// document.
+	maxRedirects = 3
+)
+
+// publicClient fetches proof documents from public addresses only, so that
+// keys cannot claim URLs which make the server request internal services.
+// Every connection is checked as it is dialed, including those following
+// redirects, and proxies are not used as they would connect on its behalf.
+var publicClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: DefaultTimeout,
+			Control: refuseNonPublic,
+		}).DialContext,
+		TLSHandshakeTimeout:   DefaultTimeout,
+		ResponseHeaderTimeout: DefaultTimeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       time.Minute,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return errgo.Newf("stopped after %d redirects", maxRedirects)
+		}
+		if req.URL.Scheme != "https" {
+			return errgo.Newf("refusing redirect to %s", req.URL)
+		}
+		return nil
+	},
+}
+
+// refuseNonPublic refuses connections to loopback, private, link-local,
+// multicast and unspecified addresses. It is a net.Dialer Control function,
+// called with the resolved address of each connection.
+func refuseNonPublic(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errgo.Newf("invalid address %q", address)
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return errgo.Newf("refusing to connect to non-public address %s", ip)
+	}
+	return nil
+}
+
+// refersTo returns whether text refers to the key with the given
+// fingerprint.
+func refersTo(text, fingerprint string) bool {
+	return strings.Contains(strings.ToLower(text), "openpgp4fpr:"+strings.ToLower(fingerprint))
+}
+
+// Resolver looks up DNS TXT records. It is satisfied by *net.Resolver.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// DNS verifies claims such as "dns:example.com?type=TXT", which are proven
+// by a TXT record on the domain.
+type DNS struct {
+	// Resolver looks up records; if nil, net.DefaultResolver is used.
+	Resolver Resolver
+}
+
+func (d *DNS) Verify(ctx context.Context, uri *url.URL, fingerprint string) error {
+	if t := uri.Query().Get("type"); t != "" && !strings.EqualFold(t, "TXT") {
+		return errgo.Newf("unsupported DNS record type %q", t)
+	}
+	domain := uri.Opaque
+	if domain == "" {
+		domain = uri.Host
+	}
+	if domain == "" {
+		return errgo.New("missing domain")
+	}
+	var resolver Resolver = net.DefaultResolver
+	if d.Resolver != nil {
+		resolver = d.Resolver
+	}
+	records, err := resolver.LookupTXT(ctx, domain)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, record := range records {
+		if refersTo(record, fingerprint) {
+			return nil
+		}
+	}
+	return errgo.WithCausef(nil, ErrNotProven, "no TXT record on %s refers to key", domain)
+}
+
+// HTTPS verifies claims such as "https://example.com/.well-known/openpgp",
+// which are proven by a document at the URL.
+type HTTPS struct {
+	// Client fetches documents; if nil, a client which only connects to
+	// public addresses is used.
+	Client *http.Client
+}
+
+func (h *HTTPS) Verify(ctx context.Context, uri *url.URL, fingerprint string) error {
+	req, err := http.NewRequest("GET", uri.String(), nil)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if !strings.EqualFold(uri.Scheme, "https") {
+		return errgo.Newf("unsupported scheme %q", uri.Scheme)
+	}
+	client := h.Client
+	if client == nil {
+		client = publicClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errgo.Newf("%s responded %q", uri, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxProofSize))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if !refersTo(string(body), fingerprint) {
+		return errgo.WithCausef(nil, ErrNotProven, "%s does not refer to key", uri)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+
+	"gopkg.in/hockeypuck/hkp.v1/metrics"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+)
+
+// QueryShapeStats summarizes the search queries of one shape which used one
+// index, so that operators can tell which search patterns need new indexes.
+type QueryShapeStats struct {
+	Shape string `json:"shape"`
+	Index string `json:"index,omitempty"`
+	Count int    `json:"count"`
+
+	Rows    int `json:"rows"`
+	MaxRows int `json:"maxRows"`
+
+	TotalSeconds float64 `json:"totalSeconds"`
+	MeanSeconds  float64 `json:"meanSeconds"`
+	MaxSeconds   float64 `json:"maxSeconds"`
+}
+
+type queryShapeKey struct {
+	shape, index string
+}
+
+// queryStats accumulates statistics of search queries by shape and index.
+type queryStats struct {
+	mu     sync.Mutex
+	shapes map[queryShapeKey]*QueryShapeStats
+}
+
+// QueryStatistics accumulates statistics of search queries by the type of
+// term searched for and the index used, and serves them at
+// /pks/debug/queries. Indexes are only known if storage implements
+// storage.QueryObserver. Query statistics are always exported as metrics.
+func QueryStatistics() HandlerOption {
+	return func(h *Handler) error {
+		h.queryStats = &queryStats{shapes: map[queryShapeKey]*QueryShapeStats{}}
+		return nil
+	}
+}
+
+func (qs *queryStats) add(stat storage.QueryStat) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	k := queryShapeKey{stat.Shape, stat.Index}
+	s, ok := qs.shapes[k]
+	if !ok {
+		s = &QueryShapeStats{Shape: stat.Shape, Index: stat.Index}
+		qs.shapes[k] = s
+	}
+	s.Count++
+	s.Rows += stat.Rows
+	if stat.Rows > s.MaxRows {
+		s.MaxRows = stat.Rows
+	}
+	secs := stat.Duration.Seconds()
+	s.TotalSeconds += secs
+	s.MeanSeconds = s.TotalSeconds / float64(s.Count)
+	if secs > s.MaxSeconds {
+		s.MaxSeconds = secs
+	}
+}
+
+// list returns the statistics of each query shape, those taking the most
+// time in total first.
+func (qs *queryStats) list() []QueryShapeStats {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	result := make([]QueryShapeStats, 0, len(qs.shapes))
+	for _, s := range qs.shapes {
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].TotalSeconds != result[j].TotalSeconds {
+			return result[i].TotalSeconds > result[j].TotalSeconds
+		}
+		return result[i].Shape+result[i].Index < result[j].Shape+result[j].Index
+	})
+	return result
+}
+
+// observeQueries subscribes to the query statistics reported by storage, if
+// it can report them. Otherwise, the handler times queries itself.
+func (h *Handler) observeQueries() {
+	if obs, ok := h.storage.(storage.QueryObserver); ok {
+		obs.ObserveQueries(h.observeQuery)
+		h.queriesObserved = true
+	}
+}
+
+func (h *Handler) observeQuery(stat storage.QueryStat) {
+	metrics.Query(stat)
+	if h.queryStats != nil {
+		h.queryStats.add(stat)
+	}
+}
+
+// QueryStats responds with the statistics of search queries by shape.
+func (h *Handler) QueryStats(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(h.queryStats.list())
+}
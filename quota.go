@@ -0,0 +1,166 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	log "gopkg.in/hockeypuck/logrus.v0"
+)
+
+// UploadQuota limits how much each principal may submit per day. Zero
+// limits are not enforced.
+type UploadQuota struct {
+	// Keys is the number of keys which may be submitted.
+	Keys int
+	// Bytes is the total size of the key material which may be submitted.
+	Bytes int64
+}
+
+// UploadQuotas holds each of the Principals to quota, so that a single
+// compromised token cannot flood the server. Quotas reset at midnight UTC,
+// and are counted by each server separately. Submissions by principals are
+// refused as too many requests once either quota is used up, and responses
+// to them report their quota in headers:
+//
+//	X-Upload-Quota-Keys-Limit, X-Upload-Quota-Keys-Remaining
+//	X-Upload-Quota-Bytes-Limit, X-Upload-Quota-Bytes-Remaining
+//	X-Upload-Quota-Reset
+//
+// Quotas apply to /pks/add, the verifying upload API and X.509 certificate
+// uploads. The size of a submission is counted before it is merged, and its
+// keys as they are stored, so that the last submission permitted may exceed
+// the key quota. Submissions which are not authenticated are not limited by
+// quotas.
+func UploadQuotas(quota UploadQuota) HandlerOption {
+	return func(h *Handler) error {
+		if quota.Keys < 0 || quota.Bytes < 0 || (quota.Keys == 0 && quota.Bytes == 0) {
+			return errgo.Newf("invalid upload quota %+v", quota)
+		}
+		h.quotas = &quotas{limit: quota, used: map[string]*quotaUsage{}}
+		return nil
+	}
+}
+
+// quotas counts the uploads of principals against their daily quota.
+type quotas struct {
+	limit UploadQuota
+
+	mu sync.Mutex
+	// day is when the quotas were last reset.
+	day  time.Time
+	used map[string]*quotaUsage
+}
+
+type quotaUsage struct {
+	keys  int
+	bytes int64
+}
+
+// usage returns the quota used by principal at now. q.mu must be held.
+func (q *quotas) usage(principal string, now time.Time) *quotaUsage {
+	if day := now.UTC().Truncate(24 * time.Hour); !day.Equal(q.day) {
+		q.day = day
+		q.used = map[string]*quotaUsage{}
+	}
+	u, ok := q.used[principal]
+	if !ok {
+		u = &quotaUsage{}
+		q.used[principal] = u
+	}
+	return u
+}
+
+// reserve counts a submission of size bytes by principal at now, unless
+// the principal's quota is used up. It returns the quota used afterwards,
+// and whether the submission is permitted.
+func (q *quotas) reserve(principal string, size int64, now time.Time) (quotaUsage, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.usage(principal, now)
+	if (q.limit.Keys > 0 && u.keys >= q.limit.Keys) || (q.limit.Bytes > 0 && u.bytes+size > q.limit.Bytes) {
+		return *u, false
+	}
+	u.bytes += size
+	return *u, true
+}
+
+// count counts keys submitted by principal at now, returning the quota
+// used afterwards.
+func (q *quotas) count(principal string, keys int, now time.Time) quotaUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.usage(principal, now)
+	u.keys += keys
+	return *u
+}
+
+// setHeaders reports the quota remaining after u at now.
+func (q *quotas) setHeaders(w http.ResponseWriter, u quotaUsage, now time.Time) {
+	if q.limit.Keys > 0 {
+		w.Header().Set("X-Upload-Quota-Keys-Limit", strconv.Itoa(q.limit.Keys))
+		remaining := q.limit.Keys - u.keys
+		if remaining < 0 {
+			remaining = 0
+		}
+		w.Header().Set("X-Upload-Quota-Keys-Remaining", strconv.Itoa(remaining))
+	}
+	if q.limit.Bytes > 0 {
+		w.Header().Set("X-Upload-Quota-Bytes-Limit", strconv.FormatInt(q.limit.Bytes, 10))
+		remaining := q.limit.Bytes - u.bytes
+		if remaining < 0 {
+			remaining = 0
+		}
+		w.Header().Set("X-Upload-Quota-Bytes-Remaining", strconv.FormatInt(remaining, 10))
+	}
+	w.Header().Set("X-Upload-Quota-Reset", q.reset(now).Format(http.TimeFormat))
+}
+
+// reset returns when quotas used at now are reset.
+func (q *quotas) reset(now time.Time) time.Time {
+	return now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+}
+
+// reserveQuota counts the submission of size bytes in r against the quota
+// of the principal it authenticates, if any. If it returns false, the
+// submission has been refused. Otherwise, the returned function must be
+// called with the number of keys stored, even if the submission then fails,
+// and before the response is written if it succeeds.
+func (h *Handler) reserveQuota(w http.ResponseWriter, r *http.Request, lang string, size int) (func(keys int), bool) {
+	principal := h.principal(r)
+	if h.quotas == nil || principal == "" {
+		return func(int) {}, true
+	}
+	now := time.Now()
+	u, ok := h.quotas.reserve(principal, int64(size), now)
+	h.quotas.setHeaders(w, u, now)
+	if !ok {
+		log.Warningf("upload quota of principal %q used up", principal)
+		w.Header().Set("Retry-After", retryAfter(h.quotas.reset(now).Sub(now)))
+		h.localizedError(w, lang, http.StatusTooManyRequests, errgo.Newf("upload quota of %q used up", principal))
+		return nil, false
+	}
+	return func(keys int) {
+		now := time.Now()
+		h.quotas.setHeaders(w, h.quotas.count(principal, keys, now), now)
+	}, true
+}
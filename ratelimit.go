@@ -0,0 +1,186 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/metrics"
+)
+
+// intervalLimiter allows each client at most one request per interval.
+type intervalLimiter struct {
+	interval time.Duration
+
+	mu     sync.Mutex
+	last   map[string]time.Time
+	pruned time.Time
+}
+
+func newIntervalLimiter(interval time.Duration) *intervalLimiter {
+	return &intervalLimiter{
+		interval: interval,
+		last:     map[string]time.Time{},
+	}
+}
+
+// allow returns whether client may make a request at now. If not, it also
+// returns how long the client must wait.
+func (l *intervalLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.pruned) >= l.interval {
+		for k, last := range l.last {
+			if now.Sub(last) >= l.interval {
+				delete(l.last, k)
+			}
+		}
+		l.pruned = now
+	}
+	if last, ok := l.last[client]; ok && now.Sub(last) < l.interval {
+		return false, l.interval - now.Sub(last)
+	}
+	l.last[client] = now
+	return true, 0
+}
+
+// Endpoints which may be rate limited with RateLimits.
+const (
+	EndpointAdd       = "add"
+	EndpointLookup    = "lookup"
+	EndpointHashquery = "hashquery"
+	// EndpointVKS is the verifying keyserver's upload and verification
+	// request endpoints, including X.509 certificate uploads, which send
+	// verification emails.
+	EndpointVKS = "vks"
+)
+
+// RateLimit is a token bucket: each client may make Burst requests at once,
+// and Rate more requests per second after that.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimits limits the requests each client IP address may make to the
+// given endpoints, such as EndpointLookup. Requests exceeding the limit are
+// refused with 429 Too Many Requests and a Retry-After header. Endpoints
+// without a limit are not limited.
+func RateLimits(limits map[string]RateLimit) HandlerOption {
+	return func(h *Handler) error {
+		h.rateLimits = map[string]*tokenBuckets{}
+		for endpoint, limit := range limits {
+			switch endpoint {
+			case EndpointAdd, EndpointLookup, EndpointHashquery, EndpointVKS:
+			default:
+				return errgo.Newf("cannot rate limit unknown endpoint %q", endpoint)
+			}
+			if limit.Rate <= 0 || limit.Burst < 1 {
+				return errgo.Newf("invalid rate limit %+v for %q", limit, endpoint)
+			}
+			h.rateLimits[endpoint] = newTokenBuckets(limit)
+		}
+		return nil
+	}
+}
+
+// rateLimited returns handle limited by the rate limit of endpoint, if any.
+func (h *Handler) rateLimited(endpoint string, handle httprouter.Handle) httprouter.Handle {
+	buckets, ok := h.rateLimits[endpoint]
+	if !ok {
+		return handle
+	}
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		if ok, wait := buckets.allow(h.ClientIP(r).String(), time.Now()); !ok {
+			metrics.RateLimited(endpoint)
+			w.Header().Set("Retry-After", retryAfter(wait))
+			lang := h.localizer.Negotiate(r.Header.Get("Accept-Language"))
+			h.localizedError(w, lang, http.StatusTooManyRequests, errgo.Newf("%s rate limit exceeded", endpoint))
+			return
+		}
+		handle(w, r, params)
+	}
+}
+
+// tokenBucketIdle is how often full token buckets are discarded.
+const tokenBucketIdle = time.Minute
+
+// tokenBuckets rate limits each client with a token bucket.
+type tokenBuckets struct {
+	limit RateLimit
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBuckets(limit RateLimit) *tokenBuckets {
+	return &tokenBuckets{
+		limit:   limit,
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// refill adds the tokens accrued by b since its last request, up to the
+// burst size.
+func (tb *tokenBuckets) refill(b *tokenBucket, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * tb.limit.Rate
+	if burst := float64(tb.limit.Burst); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
+
+// allow returns whether client may make a request at now. If not, it also
+// returns how long the client must wait.
+func (tb *tokenBuckets) allow(client string, now time.Time) (bool, time.Duration) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if now.Sub(tb.pruned) >= tokenBucketIdle {
+		// Full buckets are no different from new ones.
+		for k, b := range tb.buckets {
+			tb.refill(b, now)
+			if b.tokens >= float64(tb.limit.Burst) {
+				delete(tb.buckets, k)
+			}
+		}
+		tb.pruned = now
+	}
+	b, ok := tb.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: float64(tb.limit.Burst), last: now}
+		tb.buckets[client] = b
+	}
+	tb.refill(b, now)
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / tb.limit.Rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
@@ -0,0 +1,236 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package reminder emails key owners before their keys or subkeys expire,
+// so that they can extend the expiration date and upload the key again in
+// time.
+package reminder
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/tomb.v2"
+
+	"gopkg.in/hockeypuck/hkp.v1/clock"
+	"gopkg.in/hockeypuck/hkp.v1/notify"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+	log "gopkg.in/hockeypuck/logrus.v0"
+	"gopkg.in/hockeypuck/openpgp.v1"
+)
+
+// DefaultInterval is how often a Service scans storage by default.
+const DefaultInterval = 24 * time.Hour
+
+// DefaultLeadTimes are how long before expiration reminders are sent by
+// default.
+var DefaultLeadTimes = []time.Duration{30 * 24 * time.Hour, 7 * 24 * time.Hour}
+
+// Verifier returns the email addresses of a key's owner which have been
+// verified, such as by a confirmation email. Reminders are only sent to
+// verified addresses, since anyone may upload a key with any user ID.
+type Verifier interface {
+	VerifiedAddresses(fingerprint string) ([]string, error)
+}
+
+// Expiring describes a key or subkey which expires soon.
+type Expiring struct {
+	Fingerprint string
+	SubKey      bool
+	Expires     time.Time
+}
+
+// Service periodically scans storage for keys which expire soon, and emails
+// their owners' verified addresses. Reminders already sent are remembered
+// in memory, so each is sent once per lead time unless the service is
+// restarted.
+type Service struct {
+	storage   storage.Queryer
+	mailer    notify.Mailer
+	verifier  Verifier
+	leadTimes []time.Duration
+	interval  time.Duration
+	clock     clock.Clock
+
+	mu   sync.Mutex
+	sent map[string]bool
+
+	t tomb.Tomb
+}
+
+// New returns a Service reminding the owners of keys in st by email sent
+// with m.
+func New(st storage.Queryer, m notify.Mailer, v Verifier) *Service {
+	s := &Service{
+		storage:  st,
+		mailer:   m,
+		verifier: v,
+		interval: DefaultInterval,
+		clock:    clock.Real,
+		sent:     map[string]bool{},
+	}
+	s.SetLeadTimes(DefaultLeadTimes)
+	return s
+}
+
+// SetInterval sets how often storage is scanned once started.
+func (s *Service) SetInterval(d time.Duration) {
+	s.interval = d
+}
+
+// SetClock sets the clock by which storage is scanned once started.
+func (s *Service) SetClock(c clock.Clock) {
+	s.clock = c
+}
+
+// SetLeadTimes sets how long before expiration reminders are sent.
+func (s *Service) SetLeadTimes(leadTimes []time.Duration) {
+	s.leadTimes = append([]time.Duration(nil), leadTimes...)
+	sort.Slice(s.leadTimes, func(i, j int) bool { return s.leadTimes[i] < s.leadTimes[j] })
+}
+
+// leadTime returns the shortest lead time within which expires falls, or
+// false if it is further away than all of them.
+func (s *Service) leadTime(now, expires time.Time) (time.Duration, bool) {
+	until := expires.Sub(now)
+	for _, lead := range s.leadTimes {
+		if until <= lead {
+			return lead, true
+		}
+	}
+	return 0, false
+}
+
+// due returns the primary key and subkeys of key which expire within a lead
+// time for which no reminder has been sent yet.
+func (s *Service) due(key *openpgp.PrimaryKey, now time.Time) ([]Expiring, []string) {
+	if _, revoked := key.SelfSigs().RevokedSince(); revoked {
+		return nil, nil
+	}
+	if !key.Expiration.IsZero() && !key.Expiration.After(now) {
+		// The whole key has expired; its subkeys are unusable.
+		return nil, nil
+	}
+	var result []Expiring
+	var sentKeys []string
+	check := func(pk *openpgp.PublicKey, subKey bool) {
+		if pk.Expiration.IsZero() || !pk.Expiration.After(now) {
+			return
+		}
+		lead, ok := s.leadTime(now, pk.Expiration)
+		if !ok {
+			return
+		}
+		sentKey := fmt.Sprintf("%s/%d/%v", pk.RFingerprint, pk.Expiration.Unix(), lead)
+		if s.sent[sentKey] {
+			return
+		}
+		result = append(result, Expiring{Fingerprint: pk.Fingerprint(), SubKey: subKey, Expires: pk.Expiration})
+		sentKeys = append(sentKeys, sentKey)
+	}
+	check(&key.PublicKey, false)
+	for _, subKey := range key.SubKeys {
+		check(&subKey.PublicKey, true)
+	}
+	return result, sentKeys
+}
+
+// Run scans storage now, sending reminders for keys which expire within a
+// lead time of now. It returns the number of reminders sent. Keys whose
+// owners cannot be reminded are logged and skipped.
+func (s *Service) Run(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var reminded int
+	err := storage.ForEachKey(s.storage, func(key *openpgp.PrimaryKey) {
+		expiring, sentKeys := s.due(key, now)
+		if len(expiring) == 0 {
+			return
+		}
+		fp := key.Fingerprint()
+		to, err := s.verifier.VerifiedAddresses(fp)
+		if err != nil {
+			log.Warningf("cannot find verified addresses for key %s: %v", fp, err)
+			return
+		}
+		if len(to) == 0 {
+			return
+		}
+		err = s.mailer.Mail(to, fmt.Sprintf("Your OpenPGP key %s expires soon", fp), body(fp, expiring))
+		if err != nil {
+			log.Warningf("cannot remind owner of key %s: %v", fp, err)
+			return
+		}
+		for _, sentKey := range sentKeys {
+			s.sent[sentKey] = true
+		}
+		reminded++
+	})
+	if err != nil {
+		return reminded, errgo.Mask(err)
+	}
+	if reminded > 0 {
+		log.Infof("sent %d key expiration reminders", reminded)
+	}
+	return reminded, nil
+}
+
+func body(fp string, expiring []Expiring) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Parts of your OpenPGP key %s expire soon:\n\n", fp)
+	for _, e := range expiring {
+		kind := "primary key"
+		if e.SubKey {
+			kind = "subkey"
+		}
+		fmt.Fprintf(&buf, "  %s %s expires %s\n", kind, e.Fingerprint, e.Expires.UTC().Format(time.RFC1123))
+	}
+	fmt.Fprintf(&buf, "\nTo keep using your key, extend its expiration date and upload it to this keyserver again.\n")
+	return buf.String()
+}
+
+// Start scans storage in the background immediately and then periodically
+// until Stop is called.
+func (s *Service) Start() {
+	s.t.Go(s.run)
+}
+
+func (s *Service) run() error {
+	ticker := s.clock.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		_, err := s.Run(s.clock.Now())
+		if err != nil {
+			log.Errorf("key expiration reminders failed: %v", err)
+		}
+		select {
+		case <-s.t.Dying():
+			return nil
+		case <-ticker.C():
+		}
+	}
+}
+
+// Stop stops sending reminders.
+func (s *Service) Stop() {
+	s.t.Kill(nil)
+	s.t.Wait()
+}
@@ -0,0 +1,107 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package reminder
+
+import (
+	stdtesting "testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"gopkg.in/hockeypuck/openpgp.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/storage/mock"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type ReminderSuite struct{}
+
+var _ = gc.Suite(&ReminderSuite{})
+
+type mail struct {
+	to            []string
+	subject, body string
+}
+
+type fakeMailer []mail
+
+func (m *fakeMailer) Mail(to []string, subject, body string) error {
+	*m = append(*m, mail{to, subject, body})
+	return nil
+}
+
+type fakeVerifier map[string][]string
+
+func (v fakeVerifier) VerifiedAddresses(fp string) ([]string, error) {
+	return v[fp], nil
+}
+
+func (s *ReminderSuite) TestRun(c *gc.C) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	key := &openpgp.PrimaryKey{
+		PublicKey: openpgp.PublicKey{
+			RFingerprint: "accd0e320f1cb163a2aa9305257f384b1fc8ef01",
+			Expiration:   now.Add(20 * 24 * time.Hour),
+		},
+		SubKeys: []*openpgp.SubKey{{PublicKey: openpgp.PublicKey{
+			RFingerprint: "0123456789abcdef0123456789abcdef01234567",
+			Expiration:   now.Add(5 * 24 * time.Hour),
+		}}},
+	}
+	unverified := &openpgp.PrimaryKey{
+		PublicKey: openpgp.PublicKey{
+			RFingerprint: "fedcba9876543210fedcba9876543210fedcba98",
+			Expiration:   now.Add(24 * time.Hour),
+		},
+	}
+	st := mock.NewStorage(
+		mock.ModifiedSince(func(time.Time) ([]string, error) {
+			return []string{key.RFingerprint, unverified.RFingerprint}, nil
+		}),
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return []*openpgp.PrimaryKey{key, unverified}, nil
+		}),
+	)
+	var mails fakeMailer
+	svc := New(st, &mails, fakeVerifier{
+		key.Fingerprint(): {"alice@example.com"},
+	})
+
+	n, err := svc.Run(now)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	c.Assert(mails, gc.HasLen, 1)
+	c.Assert(mails[0].to, gc.DeepEquals, []string{"alice@example.com"})
+	c.Assert(mails[0].subject, gc.Equals, "Your OpenPGP key "+key.Fingerprint()+" expires soon")
+	c.Assert(mails[0].body, gc.Matches, "(?s).*primary key "+key.Fingerprint()+" expires.*")
+	c.Assert(mails[0].body, gc.Matches, "(?s).*subkey "+key.SubKeys[0].Fingerprint()+" expires.*")
+
+	// Reminders are sent once per lead time.
+	n, err = svc.Run(now.Add(time.Hour))
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+
+	// Once within the next lead time, the primary key is due again. The
+	// subkey has expired.
+	n, err = svc.Run(now.Add(14 * 24 * time.Hour))
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	c.Assert(mails, gc.HasLen, 2)
+	c.Assert(mails[1].body, gc.Not(gc.Matches), "(?s).*subkey.*")
+}
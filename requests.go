@@ -19,14 +19,21 @@ package hkp
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/hex"
+	"io"
 	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"gopkg.in/errgo.v1"
 
 	"gopkg.in/hockeypuck/conflux.v2/recon"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
 )
 
 // Operation enumerates the supported HKP operations (op parameter) in the request.
@@ -80,6 +87,56 @@ type Lookup struct {
 	Fingerprint bool
 	Exact       bool
 	Hash        bool
+
+	// Lang is the language negotiated for human-facing responses.
+	Lang      string
+	localizer *Localizer
+
+	// BaseURL is the public URL of the HKP service as seen by the client,
+	// for constructing links in responses.
+	BaseURL *url.URL
+
+	// ClientIP is the address of the client, as reported by trusted
+	// proxies.
+	ClientIP net.IP
+
+	// Truncated is set if the search ran out of time before all matching
+	// keys were fetched, so that the results are incomplete.
+	Truncated bool
+
+	// Approximate is set if nothing matched the search exactly, and the
+	// keys found are fuzzy matches for it.
+	Approximate bool
+
+	// Banner is an operator notice to show on HTML pages, such as during
+	// maintenance.
+	Banner string
+
+	// deadline is when the search must stop fetching keys, if not zero.
+	deadline time.Time
+
+	// uids normalizes user IDs and the search to decide whether they match.
+	uids storage.UIDPipeline
+
+	// header is the header of the request, for conditional lookups.
+	header http.Header
+
+	// modified is when the keys found were last updated, if known.
+	modified time.Time
+}
+
+// matchesUserID returns whether the search matches the user ID uid.
+func (l *Lookup) matchesUserID(uid string) bool {
+	if l.uids == nil {
+		return storage.UserIDContains(uid, l.Search)
+	}
+	return l.uids.Contains(uid, l.Search)
+}
+
+// T translates msg into the language negotiated for the lookup. It is
+// intended for use in HTML templates.
+func (l *Lookup) T(msg string, args ...interface{}) string {
+	return l.localizer.Translate(l.Lang, msg, args...)
 }
 
 func ParseLookup(req *http.Request) (*Lookup, error) {
@@ -118,9 +175,16 @@ func ParseLookup(req *http.Request) (*Lookup, error) {
 	return &l, nil
 }
 
+// maxKeyfileSize limits the size of key material uploaded as a file to
+// /pks/add.
+const maxKeyfileSize = 32 << 20
+
 // Add represents a valid /pks/add request content, parameters and options.
 type Add struct {
 	Keytext string
+	// Keydata contains binary key material, when uploaded unarmored as a
+	// multipart file.
+	Keydata []byte
 	Options OptionSet
 }
 
@@ -131,13 +195,24 @@ func ParseAdd(req *http.Request) (*Add, error) {
 
 	var add Add
 	// Parse the URL query parameters
-	err := req.ParseForm()
+	var err error
+	if isMultipart(req) {
+		err = req.ParseMultipartForm(maxKeyfileSize)
+	} else {
+		err = req.ParseForm()
+	}
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
 
 	add.Keytext = req.Form.Get("keytext")
-	if add.Keytext == "" {
+	if add.Keytext == "" && req.MultipartForm != nil {
+		err = parseKeyfile(req, &add)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	if add.Keytext == "" && len(add.Keydata) == 0 {
 		return nil, errgo.Newf("missing required parameter: keytext")
 	}
 
@@ -146,19 +221,81 @@ func ParseAdd(req *http.Request) (*Add, error) {
 	return &add, nil
 }
 
+func isMultipart(req *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// parseKeyfile reads key material uploaded as the keyfile part of a multipart
+// form. Armored uploads are treated as keytext, anything else as binary
+// OpenPGP packets.
+func parseKeyfile(req *http.Request, add *Add) error {
+	f, _, err := req.FormFile("keyfile")
+	if err == http.ErrMissingFile {
+		return nil
+	} else if err != nil {
+		return errgo.Mask(err)
+	}
+	defer f.Close()
+
+	buf, err := ioutil.ReadAll(io.LimitReader(f, maxKeyfileSize+1))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if len(buf) > maxKeyfileSize {
+		return errgo.Newf("keyfile exceeds maximum size of %d bytes", maxKeyfileSize)
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(buf), []byte(armorHeaderPrefix)) {
+		add.Keytext = string(buf)
+	} else {
+		add.Keydata = buf
+	}
+	return nil
+}
+
 type HashQuery struct {
 	Digests []string
 }
 
+// DefaultMaxHashQuerySize limits the size of hashquery request bodies by
+// default. It allows tens of thousands of digests, many more than partners
+// request at once.
+const DefaultMaxHashQuerySize = 1 << 20
+
+// ErrHashQueryTooLarge is the cause of errors parsing hashquery requests
+// larger than allowed.
+var ErrHashQueryTooLarge = errgo.New("hashquery request too large")
+
+// ParseHashQuery parses a hashquery request of at most
+// DefaultMaxHashQuerySize bytes.
 func ParseHashQuery(req *http.Request) (*HashQuery, error) {
+	return ParseHashQueryMax(req, DefaultMaxHashQuerySize)
+}
+
+// ParseHashQueryMax parses a hashquery request whose body is at most max
+// bytes, both as sent and after decompression.
+func ParseHashQueryMax(req *http.Request, max int64) (*HashQuery, error) {
 	if req.Method != "POST" {
 		return nil, errgo.Newf("invalid HTTP method: %s", req.Method)
 	}
 
 	defer req.Body.Close()
-	buf, err := ioutil.ReadAll(req.Body)
+	buf, err := readHashQuery(req.Body, max)
 	if err != nil {
-		return nil, err
+		return nil, errgo.Mask(err, errgo.Is(ErrHashQueryTooLarge))
+	}
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(bytes.NewReader(buf))
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		defer gz.Close()
+		// A small compressed body can expand enormously, so the limit
+		// applies to the decompressed body too.
+		buf, err = readHashQuery(gz, max)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(ErrHashQueryTooLarge))
+		}
 	}
 	r := bytes.NewBuffer(buf)
 
@@ -169,14 +306,22 @@ func ParseHashQuery(req *http.Request) (*HashQuery, error) {
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	// Each digest is at least its length prefix, so a larger count cannot
+	// be satisfied by the request body.
+	if n < 0 || n > r.Len()/4 {
+		return nil, errgo.Newf("invalid hashquery digest count %d", n)
+	}
 	hq.Digests = make([]string, n)
 	for i := 0; i < n; i++ {
 		hashlen, err := recon.ReadInt(r)
 		if err != nil {
 			return nil, errgo.Mask(err)
 		}
+		if hashlen < 0 || hashlen > r.Len() {
+			return nil, errgo.Newf("invalid hashquery digest length %d", hashlen)
+		}
 		hash := make([]byte, hashlen)
-		_, err = r.Read(hash)
+		_, err = io.ReadFull(r, hash)
 		if err != nil {
 			return nil, errgo.Mask(err)
 		}
@@ -185,3 +330,16 @@ func ParseHashQuery(req *http.Request) (*HashQuery, error) {
 
 	return &hq, nil
 }
+
+// readHashQuery reads r, failing with ErrHashQueryTooLarge if it holds more
+// than max bytes.
+func readHashQuery(r io.Reader, max int64) ([]byte, error) {
+	buf, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if int64(len(buf)) > max {
+		return nil, errgo.WithCausef(nil, ErrHashQueryTooLarge, "hashquery exceeds %d bytes", max)
+	}
+	return buf, nil
+}
@@ -19,10 +19,15 @@ package hkp
 
 import (
 	"bytes"
+	"compress/gzip"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 
 	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/hockeypuck/conflux.v2/recon"
 )
 
 /*
@@ -158,3 +163,97 @@ func (s *RequestsSuite) TestAddMissingKey(c *gc.C) {
 	// error without keytext
 	c.Assert(err, gc.NotNil)
 }
+
+func (s *RequestsSuite) TestAddKeyfile(c *gc.C) {
+	// uploading binary key material as a file
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("keyfile", "alice.gpg")
+	c.Assert(err, gc.IsNil)
+	_, err = fw.Write([]byte{0x99, 0x01, 0x0d})
+	c.Assert(err, gc.IsNil)
+	c.Assert(mw.Close(), gc.IsNil)
+
+	req, err := http.NewRequest("POST", "/pks/add", &body)
+	c.Assert(err, gc.IsNil)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	add, err := ParseAdd(req)
+	c.Assert(err, gc.IsNil)
+	c.Assert(add.Keytext, gc.Equals, "")
+	c.Assert(add.Keydata, gc.DeepEquals, []byte{0x99, 0x01, 0x0d})
+}
+
+func (s *RequestsSuite) TestBaseURL(c *gc.C) {
+	req, err := http.NewRequest("GET", "http://10.0.0.1:11371/pks/lookup?op=index&search=alice", nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(BaseURL(req, "").String(), gc.Equals, "http://10.0.0.1:11371")
+	c.Assert(BaseURL(req, "/hkp").String(), gc.Equals, "http://10.0.0.1:11371/hkp")
+
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "keys.example.com, 10.0.0.2")
+	req.Header.Set("X-Forwarded-Prefix", "/keyserver/")
+	c.Assert(BaseURL(req, "").String(), gc.Equals, "https://keys.example.com/keyserver")
+	c.Assert(BaseURL(req, "/hkp").String(), gc.Equals, "https://keys.example.com/keyserver/hkp")
+}
+
+func (s *RequestsSuite) TestClientIP(c *gc.C) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	c.Assert(err, gc.IsNil)
+
+	req, err := http.NewRequest("GET", "http://keys.example.com/pks/lookup?op=index&search=alice", nil)
+	c.Assert(err, gc.IsNil)
+	req.RemoteAddr = "198.51.100.7:4711"
+	req.Header.Set("X-Forwarded-For", "203.0.113.5")
+	req.Header.Set("X-Forwarded-Host", "evil.example.com")
+	// Untrusted peers cannot spoof forwarding headers.
+	c.Assert(proxies.ClientIP(req).String(), gc.Equals, "198.51.100.7")
+	c.Assert(proxies.BaseURL(req, "").String(), gc.Equals, "http://keys.example.com")
+
+	req.RemoteAddr = "10.1.2.3:4711"
+	req.Header.Set("X-Forwarded-For", "203.0.113.5, 198.51.100.7, 192.0.2.1")
+	c.Assert(proxies.ClientIP(req).String(), gc.Equals, "198.51.100.7")
+	c.Assert(proxies.BaseURL(req, "").String(), gc.Equals, "http://evil.example.com")
+
+	req.Header.Set("Forwarded", `for="[2001:db8::1]:4711";proto=https, for=192.0.2.1`)
+	c.Assert(proxies.ClientIP(req).String(), gc.Equals, "2001:db8::1")
+
+	_, err = ParseTrustedProxies([]string{"not-an-address"})
+	c.Assert(err, gc.NotNil)
+}
+
+func (s *RequestsSuite) TestHashQueryGzip(c *gc.C) {
+	var body bytes.Buffer
+	c.Assert(recon.WriteInt(&body, 1), gc.IsNil)
+	c.Assert(recon.WriteInt(&body, 2), gc.IsNil)
+	body.Write([]byte{0xca, 0xfe})
+
+	var gzbody bytes.Buffer
+	gz := gzip.NewWriter(&gzbody)
+	_, err := gz.Write(body.Bytes())
+	c.Assert(err, gc.IsNil)
+	c.Assert(gz.Close(), gc.IsNil)
+
+	req, err := http.NewRequest("POST", "/pks/hashquery", &gzbody)
+	c.Assert(err, gc.IsNil)
+	req.Header.Set("Content-Encoding", "gzip")
+	hq, err := ParseHashQuery(req)
+	c.Assert(err, gc.IsNil)
+	c.Assert(hq.Digests, gc.DeepEquals, []string{"cafe"})
+}
+
+func (s *RequestsSuite) TestHashQueryGzipTooLarge(c *gc.C) {
+	// A megabyte of zeros compresses to about a kilobyte.
+	var gzbody bytes.Buffer
+	gz := gzip.NewWriter(&gzbody)
+	_, err := gz.Write(make([]byte, 1<<20))
+	c.Assert(err, gc.IsNil)
+	c.Assert(gz.Close(), gc.IsNil)
+	c.Assert(gzbody.Len() < 64<<10, gc.Equals, true)
+
+	req, err := http.NewRequest("POST", "/pks/hashquery", &gzbody)
+	c.Assert(err, gc.IsNil)
+	req.Header.Set("Content-Encoding", "gzip")
+	_, err = ParseHashQueryMax(req, 64<<10)
+	c.Assert(errgo.Cause(err), gc.Equals, ErrHashQueryTooLarge)
+	c.Assert(err, gc.ErrorMatches, "hashquery exceeds 65536 bytes")
+}
@@ -0,0 +1,113 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/errgo.v1"
+)
+
+// DefaultRobots asks crawlers not to index key lookups, which are expensive
+// to serve and of little use in search results.
+const DefaultRobots = "User-agent: *\nDisallow: /pks/\n"
+
+// RobotsTxt serves text at /robots.txt. Crawlers only look for it at the root
+// of a site, so it is served there regardless of PathPrefix.
+func RobotsTxt(text string) HandlerOption {
+	return func(h *Handler) error {
+		h.robots = []byte(text)
+		return nil
+	}
+}
+
+// RobotsFile serves the contents of the file at path at /robots.txt, like
+// RobotsTxt.
+func RobotsFile(path string) HandlerOption {
+	return func(h *Handler) error {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		h.robots = buf
+		return nil
+	}
+}
+
+// CrawlerPolicy throttles lookups made by crawlers identifying themselves
+// with a user agent containing UserAgent, ignoring case. Each crawler client
+// may make at most one lookup per Interval.
+type CrawlerPolicy struct {
+	UserAgent string
+	Interval  time.Duration
+}
+
+type crawlerThrottle struct {
+	userAgent string
+	limiter   *intervalLimiter
+}
+
+// ThrottleCrawlers applies policies to lookups. The first policy matching a
+// request's user agent applies; requests matching none are not throttled.
+func ThrottleCrawlers(policies ...CrawlerPolicy) HandlerOption {
+	return func(h *Handler) error {
+		for _, p := range policies {
+			if p.UserAgent == "" || p.Interval <= 0 {
+				return errgo.Newf("invalid crawler policy %+v", p)
+			}
+			h.crawlers = append(h.crawlers, &crawlerThrottle{
+				userAgent: strings.ToLower(p.UserAgent),
+				limiter:   newIntervalLimiter(p.Interval),
+			})
+		}
+		return nil
+	}
+}
+
+// throttle returns whether a lookup in r should be refused because it comes
+// from a crawler exceeding its policy, and if so how long it should wait.
+func (h *Handler) throttle(r *http.Request) (bool, time.Duration) {
+	ua := strings.ToLower(r.UserAgent())
+	if ua == "" {
+		return false, 0
+	}
+	for _, ct := range h.crawlers {
+		if strings.Contains(ua, ct.userAgent) {
+			ok, wait := ct.limiter.allow(h.ClientIP(r).String(), time.Now())
+			return !ok, wait
+		}
+	}
+	return false, 0
+}
+
+// Robots serves the configured robots.txt.
+func (h *Handler) Robots(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(h.robots)
+}
+
+// retryAfter formats d as a Retry-After header value, in whole seconds.
+func retryAfter(d time.Duration) string {
+	return fmt.Sprintf("%d", int(math.Ceil(d.Seconds())))
+}
@@ -0,0 +1,189 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package search
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// DefaultLimit is the maximum number of keys returned by a search by
+// default.
+const DefaultLimit = 100
+
+// Elasticsearch indexes keys with the Elasticsearch REST API, which is also
+// implemented by OpenSearch.
+type Elasticsearch struct {
+	// URL is the URL of the index, such as "http://localhost:9200/keys".
+	URL string
+
+	// Client makes requests to the search engine. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+
+	// Limit is the maximum number of keys returned by a search. If zero,
+	// DefaultLimit is used.
+	Limit int
+}
+
+var _ Indexer = (*Elasticsearch)(nil)
+
+// elasticsearchMapping indexes user IDs as text for fuzzy matching, and
+// identifiers as exact keywords.
+const elasticsearchMapping = `{
+	"mappings": {
+		"properties": {
+			"rfingerprint": {"type": "keyword"},
+			"fingerprint": {"type": "keyword"},
+			"keyid": {"type": "keyword"},
+			"md5": {"type": "keyword"},
+			"uids": {"type": "text"},
+			"emails": {"type": "text", "fields": {"exact": {"type": "keyword"}}},
+			"created": {"type": "date"}
+		}
+	}
+}`
+
+// CreateIndex creates the index with the mappings used for keys.
+func (es *Elasticsearch) CreateIndex(ctx context.Context) error {
+	_, err := es.do(ctx, "PUT", "", "application/json", strings.NewReader(elasticsearchMapping))
+	return errgo.Mask(err)
+}
+
+func (es *Elasticsearch) Index(ctx context.Context, docs []*Document) error {
+	if len(docs) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, doc := range docs {
+		action := map[string]interface{}{"index": map[string]string{"_id": doc.RFingerprint}}
+		if err := enc.Encode(action); err != nil {
+			return errgo.Mask(err)
+		}
+		if err := enc.Encode(doc); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	body, err := es.do(ctx, "POST", "/_bulk", "application/x-ndjson", &buf)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var resp struct {
+		Errors bool `json:"errors"`
+	}
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if resp.Errors {
+		return errgo.Newf("bulk index of %d documents failed", len(docs))
+	}
+	return nil
+}
+
+func (es *Elasticsearch) Remove(ctx context.Context, digests []string) error {
+	if len(digests) == 0 {
+		return nil
+	}
+	query, err := json.Marshal(map[string]interface{}{
+		"query": map[string]interface{}{
+			"terms": map[string]interface{}{"md5": digests},
+		},
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	_, err = es.do(ctx, "POST", "/_delete_by_query", "application/json", bytes.NewReader(query))
+	return errgo.Mask(err)
+}
+
+func (es *Elasticsearch) Search(ctx context.Context, query string) ([]string, error) {
+	limit := es.Limit
+	if limit == 0 {
+		limit = DefaultLimit
+	}
+	req, err := json.Marshal(map[string]interface{}{
+		"size":    limit,
+		"_source": false,
+		"query": map[string]interface{}{
+			"multi_match": map[string]interface{}{
+				"query":     query,
+				"fields":    []string{"uids", "emails", "emails.exact^4"},
+				"fuzziness": "AUTO",
+			},
+		},
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	body, err := es.do(ctx, "POST", "/_search", "application/json", bytes.NewReader(req))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var resp struct {
+		Hits struct {
+			Hits []struct {
+				ID string `json:"_id"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var result []string
+	for _, hit := range resp.Hits.Hits {
+		result = append(result, hit.ID)
+	}
+	return result, nil
+}
+
+// do makes a request to path under the index URL, and returns the response
+// body if it succeeded.
+func (es *Elasticsearch) do(ctx context.Context, method, path, contentType string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(es.URL, "/")+path, body)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	client := es.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, errgo.Newf("%s %s: %s", method, req.URL.Path, resp.Status)
+	}
+	return respBody, nil
+}
@@ -0,0 +1,259 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package search
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+)
+
+// trigramLen is the length of the substrings by which the user IDs in a
+// Memory index are looked up.
+const trigramLen = 3
+
+// Memory is a search index kept in memory, for user ID substring and email
+// address search without an external search engine. It should be populated
+// with Reindex when the server starts, and kept up to date with Mirror.
+//
+// Searches for an email address match it exactly, ignoring case. Other
+// searches match user IDs containing them, ignoring case. Email matches are
+// returned first, then the others in RFingerprint order.
+type Memory struct {
+	// Limit is the maximum number of keys returned by a search. If zero,
+	// DefaultLimit is used.
+	Limit int
+
+	mu       sync.RWMutex
+	docs     map[string]*memoryDoc
+	digests  map[string]string
+	emails   map[string]map[string]bool
+	trigrams map[string]map[string]bool
+}
+
+var _ Indexer = (*Memory)(nil)
+
+// memoryDoc is a document in a Memory index, with its user IDs lower-cased
+// for matching.
+type memoryDoc struct {
+	md5     string
+	userIDs []string
+	emails  []string
+}
+
+// NewMemory returns an empty Memory index.
+func NewMemory() *Memory {
+	return &Memory{
+		docs:     map[string]*memoryDoc{},
+		digests:  map[string]string{},
+		emails:   map[string]map[string]bool{},
+		trigrams: map[string]map[string]bool{},
+	}
+}
+
+// Len returns the number of keys in the index.
+func (m *Memory) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.docs)
+}
+
+// Index implements Indexer.
+func (m *Memory) Index(_ context.Context, docs []*Document) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, doc := range docs {
+		rfp := strings.ToLower(doc.RFingerprint)
+		m.remove(rfp)
+		md := &memoryDoc{md5: strings.ToLower(doc.MD5)}
+		for _, uid := range doc.UserIDs {
+			uid = strings.ToLower(uid)
+			md.userIDs = append(md.userIDs, uid)
+			for _, t := range trigrams(uid) {
+				addPosting(m.trigrams, t, rfp)
+			}
+		}
+		for _, email := range doc.Emails {
+			email = strings.ToLower(email)
+			md.emails = append(md.emails, email)
+			addPosting(m.emails, email, rfp)
+		}
+		m.docs[rfp] = md
+		if md.md5 != "" {
+			m.digests[md.md5] = rfp
+		}
+	}
+	return nil
+}
+
+// Remove implements Indexer.
+func (m *Memory) Remove(_ context.Context, digests []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, digest := range digests {
+		if rfp, ok := m.digests[strings.ToLower(digest)]; ok {
+			m.remove(rfp)
+		}
+	}
+	return nil
+}
+
+// remove removes the document of the key rfp, if any. m.mu must be held.
+func (m *Memory) remove(rfp string) {
+	md, ok := m.docs[rfp]
+	if !ok {
+		return
+	}
+	for _, uid := range md.userIDs {
+		for _, t := range trigrams(uid) {
+			removePosting(m.trigrams, t, rfp)
+		}
+	}
+	for _, email := range md.emails {
+		removePosting(m.emails, email, rfp)
+	}
+	if m.digests[md.md5] == rfp {
+		delete(m.digests, md.md5)
+	}
+	delete(m.docs, rfp)
+}
+
+// Search implements Indexer.
+func (m *Memory) Search(_ context.Context, query string) ([]string, error) {
+	query = strings.ToLower(strings.TrimSpace(query))
+	if query == "" {
+		return nil, nil
+	}
+	limit := m.Limit
+	if limit == 0 {
+		limit = DefaultLimit
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var result []string
+	seen := map[string]bool{}
+	if email := storage.EmailAddress(query); email != "" {
+		for _, search := range storage.EmailSearches(email) {
+			for _, rfp := range sortedPostings(m.emails[strings.ToLower(search)]) {
+				if !seen[rfp] {
+					seen[rfp] = true
+					result = append(result, rfp)
+				}
+			}
+		}
+	}
+	for _, rfp := range m.candidates(query) {
+		if len(result) >= limit {
+			break
+		}
+		if !seen[rfp] && m.docs[rfp].contains(query) {
+			seen[rfp] = true
+			result = append(result, rfp)
+		}
+	}
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+// candidates returns the keys which may have a user ID containing query, in
+// RFingerprint order: those with all of its trigrams, or every key if it is
+// too short to have any. m.mu must be held.
+func (m *Memory) candidates(query string) []string {
+	ts := trigrams(query)
+	if len(ts) == 0 {
+		rfps := make([]string, 0, len(m.docs))
+		for rfp := range m.docs {
+			rfps = append(rfps, rfp)
+		}
+		sort.Strings(rfps)
+		return rfps
+	}
+	// Intersect the postings from the rarest trigram.
+	sort.Slice(ts, func(i, j int) bool { return len(m.trigrams[ts[i]]) < len(m.trigrams[ts[j]]) })
+	var result []string
+	for rfp := range m.trigrams[ts[0]] {
+		all := true
+		for _, t := range ts[1:] {
+			if !m.trigrams[t][rfp] {
+				all = false
+				break
+			}
+		}
+		if all {
+			result = append(result, rfp)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (md *memoryDoc) contains(query string) bool {
+	for _, uid := range md.userIDs {
+		if strings.Contains(uid, query) {
+			return true
+		}
+	}
+	return false
+}
+
+// trigrams returns the distinct substrings of s of trigramLen runes.
+func trigrams(s string) []string {
+	runes := []rune(s)
+	var result []string
+	seen := map[string]bool{}
+	for i := 0; i+trigramLen <= len(runes); i++ {
+		t := string(runes[i : i+trigramLen])
+		if !seen[t] {
+			seen[t] = true
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+func addPosting(index map[string]map[string]bool, term, rfp string) {
+	postings, ok := index[term]
+	if !ok {
+		postings = map[string]bool{}
+		index[term] = postings
+	}
+	postings[rfp] = true
+}
+
+func removePosting(index map[string]map[string]bool, term, rfp string) {
+	postings := index[term]
+	delete(postings, rfp)
+	if len(postings) == 0 {
+		delete(index, term)
+	}
+}
+
+func sortedPostings(postings map[string]bool) []string {
+	result := make([]string, 0, len(postings))
+	for rfp := range postings {
+		result = append(result, rfp)
+	}
+	sort.Strings(result)
+	return result
+}
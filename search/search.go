@@ -0,0 +1,183 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package search mirrors key user IDs and fingerprints into a search index:
+// an external search engine, such as Elasticsearch or OpenSearch, for fuzzy
+// and typo-tolerant keyword search at scale, or an index kept in memory for
+// user ID substring and email address search.
+package search
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/events"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+	log "gopkg.in/hockeypuck/logrus.v0"
+	"gopkg.in/hockeypuck/openpgp.v1"
+)
+
+// Document is the data about a key mirrored into a search engine.
+type Document struct {
+	RFingerprint string    `json:"rfingerprint"`
+	Fingerprint  string    `json:"fingerprint"`
+	KeyID        string    `json:"keyid"`
+	MD5          string    `json:"md5"`
+	UserIDs      []string  `json:"uids"`
+	Emails       []string  `json:"emails"`
+	Created      time.Time `json:"created"`
+}
+
+// NewDocument returns the document mirroring key.
+func NewDocument(key *openpgp.PrimaryKey) *Document {
+	doc := &Document{
+		RFingerprint: key.RFingerprint,
+		Fingerprint:  key.Fingerprint(),
+		KeyID:        key.KeyID(),
+		MD5:          key.MD5,
+		Created:      key.Creation,
+	}
+	for _, uid := range key.UserIDs {
+		doc.UserIDs = append(doc.UserIDs, uid.Keywords)
+		if email := storage.EmailAddress(uid.Keywords); email != "" {
+			// Index both forms of an internationalized domain.
+			doc.Emails = append(doc.Emails, storage.EmailSearches(email)...)
+		}
+	}
+	return doc
+}
+
+// Indexer is implemented by search engines which mirror keys.
+type Indexer interface {
+	// Index adds or replaces the documents of keys, identified by their
+	// RFingerprints.
+	Index(ctx context.Context, docs []*Document) error
+
+	// Remove removes the documents of keys with the given digests.
+	Remove(ctx context.Context, digests []string) error
+
+	// Search returns the RFingerprints of the keys best matching query,
+	// best match first.
+	Search(ctx context.Context, query string) ([]string, error)
+}
+
+// Mirror keeps ix up to date with the keys changed in st. Failures to update
+// the index are logged rather than failing the change to storage; Reindex
+// repairs the index afterwards.
+func Mirror(st storage.Storage, ix Indexer) {
+	st.Subscribe(func(change storage.KeyChange) error {
+		err := update(context.Background(), st, ix, change)
+		if err != nil {
+			log.Warningf("cannot update search index: %v", errgo.Details(err))
+		}
+		return nil
+	})
+}
+
+// MirrorEvents is like Mirror, but keeps ix up to date with the key changes
+// published on bus, which include those made on other cluster nodes. Keys
+// are fetched from q.
+func MirrorEvents(bus *events.Bus, q storage.Queryer, ix Indexer) {
+	bus.Subscribe("search", events.KeyChangeFunc(func(change storage.KeyChange) error {
+		err := update(context.Background(), q, ix, change)
+		if err != nil {
+			log.Warningf("cannot update search index: %v", errgo.Details(err))
+		}
+		return nil
+	}), events.OnOverflow(events.Block))
+}
+
+func update(ctx context.Context, st storage.Queryer, ix Indexer, change storage.KeyChange) error {
+	if removed := change.RemoveDigests(); len(removed) > 0 {
+		if _, replaced := change.(storage.KeyReplaced); !replaced {
+			// Replaced keys are re-indexed under the same ID.
+			err := ix.Remove(ctx, lower(removed))
+			if err != nil {
+				return errgo.Mask(err)
+			}
+		}
+	}
+	inserted := change.InsertDigests()
+	if len(inserted) == 0 {
+		return nil
+	}
+	rfps, err := storage.MatchMD5Context(ctx, st, inserted)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	keys, err := storage.FetchKeysContext(ctx, st, rfps)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(ix.Index(ctx, documents(keys)))
+}
+
+// reindexBatchSize is the number of documents indexed at a time by Reindex.
+const reindexBatchSize = 500
+
+// Reindex mirrors every key in st into ix, such as to populate a new index.
+func Reindex(ctx context.Context, st storage.Storage, ix Indexer) (int, error) {
+	var batch []*Document
+	var n int
+	var indexErr error
+	err := storage.ForEachKey(st, func(key *openpgp.PrimaryKey) {
+		if indexErr != nil {
+			return
+		}
+		batch = append(batch, NewDocument(key))
+		if len(batch) >= reindexBatchSize {
+			indexErr = ix.Index(ctx, batch)
+			if indexErr == nil {
+				n += len(batch)
+			}
+			batch = nil
+		}
+	})
+	if err != nil {
+		return n, errgo.Mask(err)
+	}
+	if indexErr != nil {
+		return n, errgo.Mask(indexErr)
+	}
+	if len(batch) > 0 {
+		err = ix.Index(ctx, batch)
+		if err != nil {
+			return n, errgo.Mask(err)
+		}
+		n += len(batch)
+	}
+	return n, nil
+}
+
+func documents(keys []*openpgp.PrimaryKey) []*Document {
+	var result []*Document
+	for _, key := range keys {
+		result = append(result, NewDocument(key))
+	}
+	return result
+}
+
+func lower(ss []string) []string {
+	result := make([]string, len(ss))
+	for i, s := range ss {
+		result[i] = strings.ToLower(s)
+	}
+	return result
+}
@@ -0,0 +1,205 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package search
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	stdtesting "testing"
+
+	gc "gopkg.in/check.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/events"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+	"gopkg.in/hockeypuck/hkp.v1/storage/mock"
+	"gopkg.in/hockeypuck/openpgp.v1"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type SearchSuite struct{}
+
+var _ = gc.Suite(&SearchSuite{})
+
+// memoryIndexer records the documents indexed and removed.
+type memoryIndexer struct {
+	docs    map[string]*Document
+	removed []string
+}
+
+func (ix *memoryIndexer) Index(_ context.Context, docs []*Document) error {
+	for _, doc := range docs {
+		ix.docs[doc.RFingerprint] = doc
+	}
+	return nil
+}
+
+func (ix *memoryIndexer) Remove(_ context.Context, digests []string) error {
+	ix.removed = append(ix.removed, digests...)
+	return nil
+}
+
+func (ix *memoryIndexer) Search(context.Context, string) ([]string, error) {
+	return nil, nil
+}
+
+func (s *SearchSuite) TestMirror(c *gc.C) {
+	key := &openpgp.PrimaryKey{PublicKey: openpgp.PublicKey{RFingerprint: "accd0e320f1cb163a2aa9305257f384b1fc8ef01"}, MD5: "cafebabe"}
+	st := mock.NewStorage(
+		mock.MatchMD5(func([]string) ([]string, error) {
+			return []string{key.RFingerprint}, nil
+		}),
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return []*openpgp.PrimaryKey{key}, nil
+		}),
+	)
+	ix := &memoryIndexer{docs: map[string]*Document{}}
+	Mirror(st, ix)
+
+	c.Assert(st.Notify(storage.KeyAdded{Digest: "cafebabe"}), gc.IsNil)
+	c.Assert(ix.docs, gc.HasLen, 1)
+	c.Assert(ix.docs[key.RFingerprint].MD5, gc.Equals, "cafebabe")
+
+	// Replaced keys are re-indexed, not removed.
+	c.Assert(st.Notify(storage.KeyReplaced{OldDigest: "decafbad", NewDigest: "cafebabe"}), gc.IsNil)
+	c.Assert(ix.removed, gc.HasLen, 0)
+
+	c.Assert(st.Notify(storage.KeyRemoved{Digest: "CAFEBABE"}), gc.IsNil)
+	c.Assert(ix.removed, gc.DeepEquals, []string{"cafebabe"})
+}
+
+func (s *SearchSuite) TestElasticsearch(c *gc.C) {
+	var bulk []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/keys/_bulk":
+			c.Check(r.Header.Get("Content-Type"), gc.Equals, "application/x-ndjson")
+			scanner := bufio.NewScanner(r.Body)
+			for scanner.Scan() {
+				var line map[string]interface{}
+				c.Check(json.Unmarshal(scanner.Bytes(), &line), gc.IsNil)
+				bulk = append(bulk, line)
+			}
+			w.Write([]byte(`{"errors": false}`))
+		case "/keys/_search":
+			var req map[string]interface{}
+			c.Check(json.NewDecoder(r.Body).Decode(&req), gc.IsNil)
+			c.Check(req["size"], gc.Equals, float64(DefaultLimit))
+			w.Write([]byte(`{"hits": {"hits": [{"_id": "accd0e32"}, {"_id": "decafbad"}]}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	es := &Elasticsearch{URL: srv.URL + "/keys/"}
+
+	err := es.Index(context.Background(), []*Document{{
+		RFingerprint: "accd0e32",
+		UserIDs:      []string{"alice <alice@example.com>"},
+		Emails:       []string{"alice@example.com"},
+	}})
+	c.Assert(err, gc.IsNil)
+	c.Assert(bulk, gc.HasLen, 2)
+	c.Assert(bulk[0], gc.DeepEquals, map[string]interface{}{"index": map[string]interface{}{"_id": "accd0e32"}})
+	c.Assert(bulk[1]["emails"], gc.DeepEquals, []interface{}{"alice@example.com"})
+
+	rfps, err := es.Search(context.Background(), "alcie")
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{"accd0e32", "decafbad"})
+
+	err = es.Remove(context.Background(), []string{"cafebabe"})
+	c.Assert(err, gc.ErrorMatches, `POST /keys/_delete_by_query: 404 Not Found`)
+}
+
+func (s *SearchSuite) TestMemory(c *gc.C) {
+	ix := NewMemory()
+	err := ix.Index(context.Background(), []*Document{{
+		RFingerprint: "bbbb",
+		MD5:          "B5",
+		UserIDs:      []string{"Alice Liddell <alice@example.com>"},
+		Emails:       []string{"alice@example.com"},
+	}, {
+		RFingerprint: "aaaa",
+		MD5:          "a5",
+		UserIDs:      []string{"Malice Aforethought <m@example.org>"},
+		Emails:       []string{"m@example.org"},
+	}})
+	c.Assert(err, gc.IsNil)
+	c.Assert(ix.Len(), gc.Equals, 2)
+
+	for _, test := range []struct {
+		query string
+		rfps  []string
+	}{
+		{"alice", []string{"aaaa", "bbbb"}},
+		{"LIDDELL", []string{"bbbb"}},
+		{"li", []string{"aaaa", "bbbb"}},
+		{"ice lid", []string{"bbbb"}},
+		{"bob", nil},
+		// Email matches come first.
+		{"Alice@Example.com", []string{"bbbb"}},
+		{"example.", []string{"aaaa", "bbbb"}},
+	} {
+		rfps, err := ix.Search(context.Background(), test.query)
+		c.Assert(err, gc.IsNil)
+		c.Check(rfps, gc.DeepEquals, test.rfps, gc.Commentf("%q", test.query))
+	}
+
+	ix.Limit = 1
+	rfps, err := ix.Search(context.Background(), "alice")
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{"aaaa"})
+
+	// Reindexing a key replaces its user IDs.
+	err = ix.Index(context.Background(), []*Document{{RFingerprint: "BBBB", MD5: "b6", UserIDs: []string{"Bob"}}})
+	c.Assert(err, gc.IsNil)
+	ix.Limit = 0
+	rfps, err = ix.Search(context.Background(), "liddell")
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+
+	err = ix.Remove(context.Background(), []string{"A5", "b5"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(ix.Len(), gc.Equals, 1)
+	rfps, err = ix.Search(context.Background(), "bob")
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{"bbbb"})
+}
+
+func (s *SearchSuite) TestMirrorEvents(c *gc.C) {
+	key := &openpgp.PrimaryKey{PublicKey: openpgp.PublicKey{RFingerprint: "accd0e32"}, MD5: "cafebabe"}
+	st := mock.NewStorage(
+		mock.MatchMD5(func([]string) ([]string, error) {
+			return []string{key.RFingerprint}, nil
+		}),
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return []*openpgp.PrimaryKey{key}, nil
+		}),
+	)
+	bus := events.NewBus()
+	ix := &memoryIndexer{docs: map[string]*Document{}}
+	MirrorEvents(bus, st, ix)
+
+	c.Assert(bus.PublishFrom("node2", storage.KeyAdded{Digest: "cafebabe"}), gc.IsNil)
+	bus.Close()
+	c.Assert(ix.docs, gc.HasLen, 1)
+	c.Assert(ix.docs[key.RFingerprint].MD5, gc.Equals, "cafebabe")
+}
@@ -0,0 +1,62 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/seed"
+)
+
+// SeedSnapshots serves the latest snapshot exported by job at /pks/seed,
+// and its manifest at /pks/seed/manifest, so that new keyservers may seed
+// their storage before joining the network. Each client may start a
+// download at most once every perClient; interrupted downloads may be
+// resumed with range requests at any time.
+func SeedSnapshots(job *seed.Job, perClient time.Duration) HandlerOption {
+	return func(h *Handler) error {
+		h.seed = job
+		h.seedClients = newIntervalLimiter(perClient)
+		return nil
+	}
+}
+
+// resumesDownload returns whether r requests the remainder of a partial
+// download.
+func resumesDownload(r *http.Request) bool {
+	rng := r.Header.Get("Range")
+	return strings.HasPrefix(rng, "bytes=") && !strings.HasPrefix(rng, "bytes=0-")
+}
+
+// Seed responds with the latest seed snapshot, limiting how often each
+// client may start downloading it.
+func (h *Handler) Seed(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !resumesDownload(r) {
+		if ok, wait := h.seedClients.allow(h.ClientIP(r).String(), time.Now()); !ok {
+			w.Header().Set("Retry-After", retryAfter(wait))
+			httpError(w, http.StatusTooManyRequests, errgo.New("too many requests"))
+			return
+		}
+	}
+	h.seed.ServeHTTP(w, r)
+}
@@ -0,0 +1,242 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package seed periodically exports a snapshot of all keys in storage as an
+// archive bundle, which new keyservers may download to seed their storage
+// before reconciling the remainder with their recon partners.
+package seed
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/tomb.v2"
+
+	"gopkg.in/hockeypuck/hkp.v1/archive"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+	log "gopkg.in/hockeypuck/logrus.v0"
+)
+
+// DefaultInterval is how often a Job exports a snapshot by default.
+const DefaultInterval = 7 * 24 * time.Hour
+
+// Filename is the name of the snapshot bundle within a Job's directory.
+const Filename = "seed.tar.gz"
+
+// Snapshot describes an exported snapshot.
+type Snapshot struct {
+	Path     string
+	Manifest *archive.Manifest
+	// Digest is the digest of the manifest, which identifies the
+	// snapshot to clients resuming a download.
+	Digest  string
+	ModTime time.Time
+}
+
+// Job periodically exports a snapshot of storage to a directory, and serves
+// the latest one over HTTP.
+type Job struct {
+	storage  storage.Queryer
+	dir      string
+	key      ed25519.PrivateKey
+	origin   string
+	interval time.Duration
+
+	mu     sync.Mutex
+	latest *Snapshot
+
+	t tomb.Tomb
+}
+
+// NewJob returns a Job exporting snapshots of st to dir, signed with key.
+func NewJob(st storage.Queryer, dir string, key ed25519.PrivateKey) *Job {
+	return &Job{
+		storage:  st,
+		dir:      dir,
+		key:      key,
+		interval: DefaultInterval,
+	}
+}
+
+// SetInterval sets how often a snapshot is exported once started.
+func (j *Job) SetInterval(d time.Duration) {
+	j.interval = d
+}
+
+// SetOrigin records the name of this keyserver in snapshot manifests.
+func (j *Job) SetOrigin(origin string) {
+	j.origin = origin
+}
+
+func (j *Job) path() string {
+	return filepath.Join(j.dir, Filename)
+}
+
+// Run exports a snapshot now, replacing the latest one if it succeeds.
+// Downloads of the previous snapshot in progress are unaffected.
+func (j *Job) Run() error {
+	start := time.Now()
+	tmp := j.path() + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer os.Remove(tmp)
+	m, err := archive.Export(f, j.storage, j.key, archive.Origin(j.origin))
+	if err != nil {
+		f.Close()
+		return errgo.Mask(err)
+	}
+	err = f.Close()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	// Replace the snapshot while holding the lock, so that it is never
+	// served with the ETag of its predecessor.
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	err = os.Rename(tmp, j.path())
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	err = j.setLatest(m)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	log.Infof("seed snapshot of %d keys took %v", m.Keys, time.Since(start))
+	return nil
+}
+
+// load restores the latest snapshot from a previous run, if it is intact.
+func (j *Job) load() error {
+	f, err := os.Open(j.path())
+	if err != nil {
+		return errgo.Mask(err, os.IsNotExist)
+	}
+	defer f.Close()
+	m, err := archive.Verify(f, j.key.Public().(ed25519.PublicKey))
+	if err != nil {
+		return errgo.Notef(err, "invalid snapshot %q", j.path())
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return errgo.Mask(j.setLatest(m))
+}
+
+// setLatest records the snapshot at the job's path, with manifest m. The
+// caller must hold j.mu.
+func (j *Job) setLatest(m *archive.Manifest) error {
+	fi, err := os.Stat(j.path())
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	digest, err := m.Digest()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	j.latest = &Snapshot{Path: j.path(), Manifest: m, Digest: digest, ModTime: fi.ModTime()}
+	return nil
+}
+
+// Latest returns the latest snapshot, or nil if none has been exported yet.
+func (j *Job) Latest() *Snapshot {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.latest
+}
+
+// Start exports a snapshot in the background and then periodically until
+// Stop is called. A snapshot left by a previous run is served in the
+// meantime, and is not replaced until it is older than the interval.
+func (j *Job) Start() {
+	j.t.Go(j.run)
+}
+
+func (j *Job) run() error {
+	wait := time.Duration(0)
+	err := j.load()
+	if err != nil && !os.IsNotExist(errgo.Cause(err)) {
+		log.Warningf("cannot load seed snapshot: %v", err)
+	} else if s := j.Latest(); s != nil {
+		wait = j.interval - time.Since(s.Manifest.Created)
+	}
+	for {
+		select {
+		case <-j.t.Dying():
+			return nil
+		case <-time.After(wait):
+		}
+		err := j.Run()
+		if err != nil {
+			log.Errorf("seed snapshot failed: %v", err)
+		}
+		wait = j.interval
+	}
+}
+
+// Stop stops exporting snapshots.
+func (j *Job) Stop() {
+	j.t.Kill(nil)
+	j.t.Wait()
+}
+
+// ServeHTTP responds with the latest snapshot, or 503 Service Unavailable
+// if none has been exported yet. Range requests are supported, so that
+// interrupted downloads may be resumed; the ETag identifies the snapshot so
+// that clients resuming with If-Range restart if it has been replaced.
+func (j *Job) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	j.mu.Lock()
+	s := j.latest
+	var f *os.File
+	var err error
+	if s != nil {
+		f, err = os.Open(s.Path)
+	}
+	j.mu.Unlock()
+	if s == nil {
+		http.Error(w, "seed snapshot not yet available", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Errorf("cannot open seed snapshot: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("ETag", `"`+s.Digest+`"`)
+	http.ServeContent(w, r, Filename, s.ModTime, f)
+}
+
+// ServeManifest responds with the manifest of the latest snapshot as JSON,
+// so that clients may check its size and age before downloading it.
+func (j *Job) ServeManifest(w http.ResponseWriter, r *http.Request) {
+	s := j.Latest()
+	if s == nil {
+		http.Error(w, "seed snapshot not yet available", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", `"`+s.Digest+`"`)
+	json.NewEncoder(w).Encode(s.Manifest)
+}
@@ -0,0 +1,103 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package seed
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	stdtesting "testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/hockeypuck/testing"
+	"gopkg.in/hockeypuck/openpgp.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/archive"
+	"gopkg.in/hockeypuck/hkp.v1/storage/mock"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type SeedSuite struct{}
+
+var _ = gc.Suite(&SeedSuite{})
+
+func (s *SeedSuite) TestJob(c *gc.C) {
+	st := mock.NewStorage(
+		mock.ModifiedSince(func(time.Time) ([]string, error) {
+			return []string{"accd0e320f1cb163a2aa9305257f384b1fc8ef01"}, nil
+		}),
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")).MustParse(), nil
+		}),
+	)
+	pub, key, err := ed25519.GenerateKey(nil)
+	c.Assert(err, gc.IsNil)
+	dir := c.MkDir()
+	job := NewJob(st, dir, key)
+
+	w := httptest.NewRecorder()
+	job.ServeHTTP(w, httptest.NewRequest("GET", "/pks/seed", nil))
+	c.Assert(w.Code, gc.Equals, http.StatusServiceUnavailable)
+
+	c.Assert(job.Run(), gc.IsNil)
+	w = httptest.NewRecorder()
+	job.ServeHTTP(w, httptest.NewRequest("GET", "/pks/seed", nil))
+	c.Assert(w.Code, gc.Equals, http.StatusOK)
+	bundle := w.Body.Bytes()
+	m, err := archive.Verify(bytes.NewReader(bundle), pub)
+	c.Assert(err, gc.IsNil)
+	c.Assert(m.Keys, gc.Equals, 1)
+	etag := w.Header().Get("ETag")
+	c.Assert(etag, gc.Equals, `"`+job.Latest().Digest+`"`)
+
+	// Interrupted downloads may be resumed.
+	req := httptest.NewRequest("GET", "/pks/seed", nil)
+	req.Header.Set("Range", "bytes=10-")
+	req.Header.Set("If-Range", etag)
+	w = httptest.NewRecorder()
+	job.ServeHTTP(w, req)
+	c.Assert(w.Code, gc.Equals, http.StatusPartialContent)
+	c.Assert(w.Body.Bytes(), gc.DeepEquals, bundle[10:])
+
+	// Unless the snapshot has been replaced since.
+	req.Header.Set("If-Range", `"stale"`)
+	w = httptest.NewRecorder()
+	job.ServeHTTP(w, req)
+	c.Assert(w.Code, gc.Equals, http.StatusOK)
+
+	w = httptest.NewRecorder()
+	job.ServeManifest(w, httptest.NewRequest("GET", "/pks/seed/manifest", nil))
+	c.Assert(w.Code, gc.Equals, http.StatusOK)
+	var manifest archive.Manifest
+	c.Assert(json.NewDecoder(w.Body).Decode(&manifest), gc.IsNil)
+	c.Assert(manifest.Keys, gc.Equals, 1)
+
+	// A snapshot left by a previous run is served after a restart.
+	restarted := NewJob(st, dir, key)
+	c.Assert(restarted.load(), gc.IsNil)
+	c.Assert(restarted.Latest().Digest, gc.Equals, job.Latest().Digest)
+	files, err := ioutil.ReadDir(dir)
+	c.Assert(err, gc.IsNil)
+	c.Assert(files, gc.HasLen, 1)
+}
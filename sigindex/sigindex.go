@@ -0,0 +1,399 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package sigindex maintains an index of third-party signatures, from the
+// key ID of each certifying key to the keys it has signed, and publishes it
+// over HTTP for signed-by and who-signed queries. It supports revocation
+// impact analysis and web of trust tooling without scanning storage.
+//
+// The index also tracks which certifying keys have been revoked, so that
+// their certifications on other keys can be flagged to clients without
+// changing the keys' packets.
+package sigindex
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/events"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+	log "gopkg.in/hockeypuck/logrus.v0"
+	"gopkg.in/hockeypuck/openpgp.v1"
+)
+
+// Lengths of long key IDs and fingerprints, in hex.
+const (
+	keyIDLen       = 16
+	fingerprintLen = 40
+)
+
+// Index maps the key IDs of certifying keys to the keys they have signed.
+// Keys are identified by their RFingerprints and key IDs are reversed, as
+// in storage. An Index should be populated with Load when the server
+// starts, and kept up to date with Mirror or MirrorEvents.
+type Index struct {
+	mu sync.RWMutex
+	// keys holds the indexed keys, by RFingerprint.
+	keys map[string]*entry
+	// signed holds the RFingerprints of the keys signed by each signer.
+	signed map[string]map[string]bool
+	// keyIDs holds the RFingerprints of the keys with each key ID.
+	keyIDs map[string]map[string]bool
+	// digests holds the RFingerprints of the keys with each digest.
+	digests map[string]string
+	// revoked holds when each revoked key was revoked, by reversed key ID.
+	revoked map[string]time.Time
+}
+
+type entry struct {
+	md5     string
+	signers []string
+	revoked bool
+}
+
+// New returns an empty Index.
+func New() *Index {
+	return &Index{
+		keys:    map[string]*entry{},
+		signed:  map[string]map[string]bool{},
+		keyIDs:  map[string]map[string]bool{},
+		digests: map[string]string{},
+		revoked: map[string]time.Time{},
+	}
+}
+
+// Len returns the number of keys in the index.
+func (ix *Index) Len() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return len(ix.keys)
+}
+
+// Add adds or replaces the third-party signatures of keys. Signatures on
+// the primary key, user IDs and user attributes are indexed; those issued
+// by the key itself are not. Keys which are revoked are recorded as revoked
+// certifiers.
+func (ix *Index) Add(keys ...*openpgp.PrimaryKey) {
+	for _, key := range keys {
+		revokedAt, revoked := key.SelfSigs().RevokedSince()
+		ix.add(key, revokedAt, revoked)
+	}
+}
+
+func (ix *Index) add(key *openpgp.PrimaryKey, revokedAt time.Time, revoked bool) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	rfp := strings.ToLower(key.RFingerprint)
+	_, wasRevoked := ix.revoked[rKeyID(rfp)]
+	ix.remove(rfp)
+	e := &entry{md5: strings.ToLower(key.MD5), signers: signers(key), revoked: revoked}
+	for _, signer := range e.signers {
+		addPosting(ix.signed, signer, rfp)
+	}
+	addPosting(ix.keyIDs, rKeyID(rfp), rfp)
+	ix.keys[rfp] = e
+	if e.md5 != "" {
+		ix.digests[e.md5] = rfp
+	}
+	if revoked {
+		ix.revoked[rKeyID(rfp)] = revokedAt
+		if n := len(ix.signed[rKeyID(rfp)]); !wasRevoked && n > 0 {
+			log.Infof("certifier %s is revoked, flagging its certifications of %d keys",
+				openpgp.Reverse(rfp), n)
+		}
+	}
+}
+
+// Remove removes the keys with the given digests.
+func (ix *Index) Remove(digests ...string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	for _, digest := range digests {
+		if rfp, ok := ix.digests[strings.ToLower(digest)]; ok {
+			ix.remove(rfp)
+		}
+	}
+}
+
+// remove removes the key rfp, if any. ix.mu must be held.
+func (ix *Index) remove(rfp string) {
+	e, ok := ix.keys[rfp]
+	if !ok {
+		return
+	}
+	for _, signer := range e.signers {
+		removePosting(ix.signed, signer, rfp)
+	}
+	removePosting(ix.keyIDs, rKeyID(rfp), rfp)
+	if e.revoked {
+		delete(ix.revoked, rKeyID(rfp))
+	}
+	if ix.digests[e.md5] == rfp {
+		delete(ix.digests, e.md5)
+	}
+	delete(ix.keys, rfp)
+}
+
+// SignedBy returns the fingerprints of the keys signed by the key with the
+// given key ID or fingerprint, in order.
+func (ix *Index) SignedBy(id string) ([]string, error) {
+	rfp, err := parseID(id)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return fingerprints(ix.signed[rKeyID(rfp)]), nil
+}
+
+// RevokedCertifier returns when the key with the given key ID or
+// fingerprint was revoked, if it is a revoked key in the index.
+func (ix *Index) RevokedCertifier(id string) (time.Time, bool) {
+	rfp, err := parseID(id)
+	if err != nil {
+		return time.Time{}, false
+	}
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	revokedAt, ok := ix.revoked[rKeyID(rfp)]
+	return revokedAt, ok
+}
+
+// WhoSigned returns the key IDs of the third-party signers of the keys with
+// the given key ID or fingerprint, by fingerprint.
+func (ix *Index) WhoSigned(id string) (map[string][]string, error) {
+	rfp, err := parseID(id)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	result := map[string][]string{}
+	for keyRFP := range ix.keyIDs[rKeyID(rfp)] {
+		if len(rfp) > keyIDLen && keyRFP != rfp {
+			continue
+		}
+		var keyIDs []string
+		for _, signer := range ix.keys[keyRFP].signers {
+			keyIDs = append(keyIDs, openpgp.Reverse(signer))
+		}
+		sort.Strings(keyIDs)
+		result[openpgp.Reverse(keyRFP)] = keyIDs
+	}
+	return result, nil
+}
+
+// signers returns the distinct reversed key IDs of the third-party signers
+// of key.
+func signers(key *openpgp.PrimaryKey) []string {
+	seen := map[string]bool{}
+	var result []string
+	add := func(sigs []*openpgp.Signature) {
+		for _, sig := range sigs {
+			signer := strings.ToLower(sig.RIssuerKeyID)
+			if signer == "" || signer == strings.ToLower(key.RKeyID) || seen[signer] {
+				continue
+			}
+			seen[signer] = true
+			result = append(result, signer)
+		}
+	}
+	add(key.Signatures)
+	for _, uid := range key.UserIDs {
+		add(uid.Signatures)
+	}
+	for _, uat := range key.UserAttributes {
+		add(uat.Signatures)
+	}
+	return result
+}
+
+// parseID returns the reversed form of a hex key ID or fingerprint, with an
+// optional 0x prefix.
+func parseID(id string) (string, error) {
+	id = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(id), "0x"))
+	if _, err := hex.DecodeString(id); err != nil || (len(id) != keyIDLen && len(id) != fingerprintLen) {
+		return "", errgo.Newf("invalid key ID or fingerprint %q", id)
+	}
+	return openpgp.Reverse(id), nil
+}
+
+// rKeyID returns the reversed long key ID of a key from its RFingerprint.
+func rKeyID(rfp string) string {
+	if len(rfp) < keyIDLen {
+		return rfp
+	}
+	return rfp[:keyIDLen]
+}
+
+func fingerprints(rfps map[string]bool) []string {
+	result := []string{}
+	for rfp := range rfps {
+		result = append(result, openpgp.Reverse(rfp))
+	}
+	sort.Strings(result)
+	return result
+}
+
+func addPosting(postings map[string]map[string]bool, k, rfp string) {
+	set, ok := postings[k]
+	if !ok {
+		set = map[string]bool{}
+		postings[k] = set
+	}
+	set[rfp] = true
+}
+
+func removePosting(postings map[string]map[string]bool, k, rfp string) {
+	set := postings[k]
+	delete(set, rfp)
+	if len(set) == 0 {
+		delete(postings, k)
+	}
+}
+
+// Load adds every key in q to ix, returning the number of keys indexed.
+func (ix *Index) Load(q storage.Queryer) (int, error) {
+	var n int
+	err := storage.ForEachKey(q, func(key *openpgp.PrimaryKey) {
+		ix.Add(key)
+		n++
+	})
+	return n, errgo.Mask(err)
+}
+
+// Mirror keeps ix up to date with the keys changed in st. Failures to update
+// the index are logged rather than failing the change to storage.
+func (ix *Index) Mirror(st storage.Storage) {
+	st.Subscribe(func(change storage.KeyChange) error {
+		ix.update(context.Background(), st, change)
+		return nil
+	})
+}
+
+// MirrorEvents is like Mirror, but keeps ix up to date with the key changes
+// published on bus, which include those made on other cluster nodes. Keys
+// are fetched from q.
+func (ix *Index) MirrorEvents(bus *events.Bus, q storage.Queryer) {
+	bus.Subscribe("sigindex", events.KeyChangeFunc(func(change storage.KeyChange) error {
+		ix.update(context.Background(), q, change)
+		return nil
+	}), events.OnOverflow(events.Block))
+}
+
+func (ix *Index) update(ctx context.Context, q storage.Queryer, change storage.KeyChange) {
+	ix.Remove(change.RemoveDigests()...)
+	inserted := change.InsertDigests()
+	if len(inserted) == 0 {
+		return
+	}
+	rfps, err := storage.MatchMD5Context(ctx, q, inserted)
+	if err != nil {
+		log.Warningf("cannot update signature index: %v", errgo.Details(err))
+		return
+	}
+	keys, err := storage.FetchKeysContext(ctx, q, rfps)
+	if err != nil {
+		log.Warningf("cannot update signature index: %v", errgo.Details(err))
+		return
+	}
+	ix.Add(keys...)
+}
+
+// SignedByResponse is the response to a signed-by query.
+type SignedByResponse struct {
+	// Signer is the key ID or fingerprint queried.
+	Signer string `json:"signer"`
+	// Revocation is when the signer was revoked, if it was, in RFC 3339
+	// format.
+	Revocation string `json:"revocation,omitempty"`
+	// Keys are the fingerprints of the keys it has signed.
+	Keys []string `json:"keys"`
+}
+
+// WhoSignedResponse is the response to a who-signed query.
+type WhoSignedResponse struct {
+	// Keys holds the key IDs of the third-party signers of the keys
+	// matching the query, by fingerprint.
+	Keys map[string][]string `json:"keys"`
+	// Revoked holds when those signers which have been revoked were
+	// revoked, in RFC 3339 format or empty if unknown, by key ID.
+	Revoked map[string]string `json:"revoked,omitempty"`
+}
+
+// ServeHTTP answers queries of the form
+//
+//	GET /pks/signatures?op=signedby&search=0x...
+//	GET /pks/signatures?op=whosigned&search=0x...
+//
+// where search is a long key ID or fingerprint, responding with a
+// SignedByResponse or WhoSignedResponse as JSON.
+func (ix *Index) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	search := r.FormValue("search")
+	var resp interface{}
+	var err error
+	switch r.FormValue("op") {
+	case "signedby":
+		var keys []string
+		keys, err = ix.SignedBy(search)
+		sbr := &SignedByResponse{Signer: search, Keys: keys}
+		if revokedAt, ok := ix.RevokedCertifier(search); ok {
+			sbr.Revocation = formatTime(revokedAt)
+		}
+		resp = sbr
+	case "whosigned":
+		var keys map[string][]string
+		keys, err = ix.WhoSigned(search)
+		wsr := &WhoSignedResponse{Keys: keys}
+		for _, keyIDs := range keys {
+			for _, keyID := range keyIDs {
+				if revokedAt, ok := ix.RevokedCertifier(keyID); ok {
+					if wsr.Revoked == nil {
+						wsr.Revoked = map[string]string{}
+					}
+					wsr.Revoked[keyID] = formatTime(revokedAt)
+				}
+			}
+		}
+		resp = wsr
+	default:
+		http.Error(w, "op must be signedby or whosigned", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(resp)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
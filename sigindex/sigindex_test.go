@@ -0,0 +1,146 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sigindex
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	stdtesting "testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/hockeypuck/openpgp.v1"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type SigIndexSuite struct{}
+
+var _ = gc.Suite(&SigIndexSuite{})
+
+const (
+	aliceFP = "10fe8cf1b483f7525039aa2a361bc1f023e0dcca"
+	bobFP   = "accd0e320f1cb163a2aa9305257f384b1fc8ef01"
+	carolFP = "0123456789abcdef0123456789abcdef01234567"
+)
+
+// signedKey returns a key with the fingerprint fp and a user ID signed by
+// itself and the keys with the given fingerprints.
+func signedKey(fp, md5 string, signerFPs ...string) *openpgp.PrimaryKey {
+	key := &openpgp.PrimaryKey{MD5: md5}
+	key.RFingerprint = openpgp.Reverse(fp)
+	key.RKeyID = key.RFingerprint[:keyIDLen]
+	uid := &openpgp.UserID{Keywords: fp}
+	for _, signerFP := range append([]string{fp}, signerFPs...) {
+		uid.Signatures = append(uid.Signatures, &openpgp.Signature{RIssuerKeyID: openpgp.Reverse(signerFP)[:keyIDLen]})
+	}
+	key.UserIDs = []*openpgp.UserID{uid}
+	return key
+}
+
+func (s *SigIndexSuite) TestIndex(c *gc.C) {
+	ix := New()
+	ix.Add(signedKey(aliceFP, "aa", bobFP, carolFP), signedKey(carolFP, "cc", bobFP))
+	c.Assert(ix.Len(), gc.Equals, 2)
+
+	signed, err := ix.SignedBy("0x" + bobFP)
+	c.Assert(err, gc.IsNil)
+	c.Assert(signed, gc.DeepEquals, []string{carolFP, aliceFP})
+	signed, err = ix.SignedBy(bobFP[24:])
+	c.Assert(err, gc.IsNil)
+	c.Assert(signed, gc.HasLen, 2)
+	signed, err = ix.SignedBy(aliceFP)
+	c.Assert(err, gc.IsNil)
+	c.Assert(signed, gc.HasLen, 0)
+
+	signers, err := ix.WhoSigned(aliceFP[24:])
+	c.Assert(err, gc.IsNil)
+	c.Assert(signers, gc.DeepEquals, map[string][]string{
+		aliceFP: {bobFP[24:], carolFP[24:]},
+	})
+
+	_, err = ix.SignedBy("0xdecafbad")
+	c.Assert(err, gc.ErrorMatches, `invalid key ID or fingerprint "decafbad"`)
+
+	// Replaced keys are re-indexed, and removed keys are dropped.
+	ix.Remove("CC")
+	ix.Add(signedKey(aliceFP, "ab", carolFP))
+	signed, err = ix.SignedBy(bobFP)
+	c.Assert(err, gc.IsNil)
+	c.Assert(signed, gc.HasLen, 0)
+	signed, err = ix.SignedBy(carolFP)
+	c.Assert(err, gc.IsNil)
+	c.Assert(signed, gc.DeepEquals, []string{aliceFP})
+	c.Assert(ix.Len(), gc.Equals, 1)
+}
+
+func (s *SigIndexSuite) TestServeHTTP(c *gc.C) {
+	ix := New()
+	ix.Add(signedKey(aliceFP, "aa", bobFP))
+
+	w := httptest.NewRecorder()
+	ix.ServeHTTP(w, httptest.NewRequest("GET", "/pks/signatures?op=signedby&search=0x"+bobFP, nil))
+	c.Assert(w.Code, gc.Equals, http.StatusOK)
+	var signedBy SignedByResponse
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &signedBy), gc.IsNil)
+	c.Assert(signedBy.Keys, gc.DeepEquals, []string{aliceFP})
+
+	w = httptest.NewRecorder()
+	ix.ServeHTTP(w, httptest.NewRequest("GET", "/pks/signatures?op=whosigned&search=0x"+aliceFP, nil))
+	c.Assert(w.Code, gc.Equals, http.StatusOK)
+	var whoSigned WhoSignedResponse
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &whoSigned), gc.IsNil)
+	c.Assert(whoSigned.Keys, gc.DeepEquals, map[string][]string{aliceFP: {bobFP[24:]}})
+
+	w = httptest.NewRecorder()
+	ix.ServeHTTP(w, httptest.NewRequest("GET", "/pks/signatures?op=index&search=0x"+aliceFP, nil))
+	c.Assert(w.Code, gc.Equals, http.StatusBadRequest)
+}
+
+func (s *SigIndexSuite) TestRevokedCertifier(c *gc.C) {
+	ix := New()
+	ix.Add(signedKey(aliceFP, "aa", bobFP))
+	_, ok := ix.RevokedCertifier(bobFP)
+	c.Assert(ok, gc.Equals, false)
+
+	revokedAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	ix.add(signedKey(bobFP, "bb"), revokedAt, true)
+	at, ok := ix.RevokedCertifier(bobFP[24:])
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(at, gc.Equals, revokedAt)
+
+	w := httptest.NewRecorder()
+	ix.ServeHTTP(w, httptest.NewRequest("GET", "/pks/signatures?op=whosigned&search=0x"+aliceFP, nil))
+	c.Assert(w.Code, gc.Equals, http.StatusOK)
+	var whoSigned WhoSignedResponse
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &whoSigned), gc.IsNil)
+	c.Assert(whoSigned.Revoked, gc.DeepEquals, map[string]string{bobFP[24:]: "2020-01-02T03:04:05Z"})
+
+	w = httptest.NewRecorder()
+	ix.ServeHTTP(w, httptest.NewRequest("GET", "/pks/signatures?op=signedby&search="+bobFP, nil))
+	var signedBy SignedByResponse
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &signedBy), gc.IsNil)
+	c.Assert(signedBy.Revocation, gc.Equals, "2020-01-02T03:04:05Z")
+	c.Assert(signedBy.Keys, gc.DeepEquals, []string{aliceFP})
+
+	// Revocations are forgotten with the revoked key.
+	ix.Remove("bb")
+	_, ok = ix.RevokedCertifier(bobFP)
+	c.Assert(ok, gc.Equals, false)
+}
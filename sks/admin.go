@@ -0,0 +1,426 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/hockeypuck/conflux.v2/recon"
+	log "gopkg.in/hockeypuck/logrus.v0"
+
+	"gopkg.in/hockeypuck/hkp.v1/maintenance"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+)
+
+// ErrUnknownPartner is the cause of errors for requests naming a recon
+// partner which is not configured.
+var ErrUnknownPartner = errgo.New("unknown partner")
+
+// admin authenticates requests to the administrative endpoints.
+type admin struct {
+	tokens    [][sha256.Size]byte
+	clientCAs *x509.CertPool
+	reload    func() (recon.PartnerMap, error)
+	mode      *maintenance.Mode
+}
+
+type AdminOption func(*admin)
+
+// AdminTokens authorizes requests bearing any of tokens, as in
+// "Authorization: Bearer <token>".
+func AdminTokens(tokens ...string) AdminOption {
+	return func(a *admin) {
+		for _, token := range tokens {
+			a.tokens = append(a.tokens, sha256.Sum256([]byte(token)))
+		}
+	}
+}
+
+// AdminClientCAs authorizes requests made with a TLS client certificate
+// issued by one of the certificate authorities in pool. The server's TLS
+// configuration must request client certificates.
+func AdminClientCAs(pool *x509.CertPool) AdminOption {
+	return func(a *admin) {
+		a.clientCAs = pool
+	}
+}
+
+// AdminReloadPartners enables reloading recon partners with f, such as by
+// reading them again from a configuration file.
+func AdminReloadPartners(f func() (recon.PartnerMap, error)) AdminOption {
+	return func(a *admin) {
+		a.reload = f
+	}
+}
+
+// AdminMaintenance enables toggling the maintenance mode m.
+func AdminMaintenance(m *maintenance.Mode) AdminOption {
+	return func(a *admin) {
+		a.mode = m
+	}
+}
+
+// configured returns whether any means of authentication is configured.
+func (a *admin) configured() bool {
+	return len(a.tokens) > 0 || a.clientCAs != nil
+}
+
+// authorized returns whether req bears an authorized token or client
+// certificate. If neither tokens nor client CAs are configured, no
+// requests are authorized.
+func (a *admin) authorized(req *http.Request) bool {
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		sum := sha256.Sum256([]byte(strings.TrimPrefix(auth, "Bearer ")))
+		for _, token := range a.tokens {
+			if subtle.ConstantTimeCompare(sum[:], token[:]) == 1 {
+				return true
+			}
+		}
+	}
+	if a.clientCAs != nil && req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		intermediates := x509.NewCertPool()
+		for _, cert := range req.TLS.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := req.TLS.PeerCertificates[0].Verify(x509.VerifyOptions{
+			Roots:         a.clientCAs,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *admin) protect(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		if !a.authorized(req) {
+			log.Warningf("unauthorized admin request %s %s from %s", req.Method, req.URL.Path, req.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h(w, req, ps)
+	}
+}
+
+// RegisterAdmin registers administrative endpoints on router:
+//
+//	GET /admin/ptree/node?prefix=0110    describes a node and its children
+//	GET /admin/ptree/digest?digest=...   shows the path to a digest
+//	GET /admin/stats                     shows recon statistics
+//	GET /admin/recovery                  shows the outstanding recoveries
+//	GET /admin/divergences               lists recovered keys whose digests
+//	                                     changed when merged
+//	GET /admin/partners                  lists the recon partners
+//	POST /admin/partners/reload          reloads the recon partners
+//	POST /admin/recon?partner=...        reconciles with a partner now
+//	GET /admin/blocklist                 lists the digests of deleted keys
+//	POST /admin/block?digest=...         blocks a digest
+//	POST /admin/delete?fingerprint=...   deletes a key and blocks its digest
+//	                                     and fingerprint
+//	GET /admin/maintenance               shows the maintenance mode
+//	POST /admin/maintenance?enabled=...  toggles the maintenance mode, with
+//	                                     an optional message
+//
+// Requests are authenticated with AdminTokens or AdminClientCAs. Without
+// them, every request is refused as unauthorized.
+func (r *Peer) RegisterAdmin(router *httprouter.Router, options ...AdminOption) {
+	a := &admin{}
+	for _, option := range options {
+		option(a)
+	}
+	if !a.configured() {
+		log.Warning("admin endpoints have no tokens or client CAs configured, refusing all requests")
+	}
+	router.GET("/admin/ptree/node", a.protect(r.serveNode))
+	router.GET("/admin/ptree/digest", a.protect(r.serveDigestPath))
+	router.GET("/admin/stats", a.protect(r.serveStats))
+	router.GET("/admin/recovery", a.protect(r.serveRecovery))
+	router.GET("/admin/divergences", a.protect(r.serveDivergences))
+	router.GET("/admin/partners", a.protect(r.servePartners))
+	router.POST("/admin/partners/reload", a.protect(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		r.serveReloadPartners(w, req, a.reload)
+	}))
+	router.POST("/admin/recon", a.protect(r.serveRecon))
+	router.GET("/admin/blocklist", a.protect(r.serveBlocklist))
+	router.POST("/admin/block", a.protect(r.serveBlock))
+	router.POST("/admin/delete", a.protect(r.serveDelete))
+	if a.mode != nil {
+		router.GET("/admin/maintenance", a.protect(a.serveMaintenance))
+		router.POST("/admin/maintenance", a.protect(a.serveSetMaintenance))
+	}
+}
+
+func (a *admin) serveMaintenance(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	writeJSON(w, a.mode.Status())
+}
+
+func (a *admin) serveSetMaintenance(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	enabled, err := strconv.ParseBool(req.FormValue("enabled"))
+	if err != nil {
+		http.Error(w, "invalid or missing parameter: enabled", http.StatusBadRequest)
+		return
+	}
+	if enabled {
+		a.mode.Enable(req.FormValue("message"))
+	} else {
+		a.mode.Disable()
+	}
+	writeJSON(w, a.mode.Status())
+}
+
+func (r *Peer) serveStats(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	writeJSON(w, r.Stats())
+}
+
+// RecoveryResponse describes the recoveries outstanding from each partner.
+type RecoveryResponse struct {
+	// Pending counts the digests queued for recovery, by partner.
+	Pending map[string]int `json:"pending"`
+	// Retrying counts the digests which partners failed to provide and
+	// which will be requested again, by partner.
+	Retrying map[string]int `json:"retrying"`
+}
+
+func (r *Peer) serveRecovery(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	resp := &RecoveryResponse{Pending: map[string]int{}, Retrying: r.retries.retrying()}
+	if r.recovery != nil {
+		for _, partner := range r.recovery.partners() {
+			resp.Pending[partner] = len(r.recovery.items(partner))
+		}
+	}
+	writeJSON(w, resp)
+}
+
+// Partners returns the recon partners, by name.
+func (r *Peer) Partners() recon.PartnerMap {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := recon.PartnerMap{}
+	for name, partner := range r.settings.Partners {
+		result[name] = partner
+	}
+	return result
+}
+
+// SetPartners replaces the recon partners. The recon peer reads its
+// settings without synchronization, so rather than changing them in place,
+// it is replaced with one using a copy of the settings with partners.
+func (r *Peer) SetPartners(partners recon.PartnerMap) error {
+	r.mu.Lock()
+	settings := *r.settings
+	settings.Partners = partners
+	r.settings = &settings
+	r.mu.Unlock()
+	log.Infof("recon partners set to %s", strings.Join(partnerNames(partners), ", "))
+	return errgo.Mask(r.replaceReconciler())
+}
+
+// replaceReconciler replaces the recon peer with one using the current
+// settings, restarting it if it is running.
+func (r *Peer) replaceReconciler() error {
+	r.mu.Lock()
+	old, running := r.peer, r.reconciling()
+	r.mu.Unlock()
+	if old == nil {
+		// Degraded, the recon peer is created with the new settings
+		// once the prefix tree is opened.
+		return nil
+	}
+
+	// The old recon peer is stopped without r.mu held, as it may be
+	// waiting for handleRecovery, and must release its listener before
+	// its replacement starts.
+	if running {
+		err := old.Stop()
+		if err != nil {
+			log.Errorf("error stopping recon: %v", errgo.Details(err))
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.peer != old {
+		// Replaced meanwhile, such as by a prefix tree rebuild, which
+		// used the new settings.
+		return nil
+	}
+	peer, err := r.newReconciler(r.ptree)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	r.peer = peer
+	close(r.reconfigured)
+	r.reconfigured = make(chan struct{})
+	if running && r.reconciling() {
+		r.peer.Start()
+	}
+	return nil
+}
+
+func partnerNames(partners recon.PartnerMap) []string {
+	var result []string
+	for name := range partners {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (r *Peer) servePartners(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	writeJSON(w, r.Partners())
+}
+
+func (r *Peer) serveReloadPartners(w http.ResponseWriter, req *http.Request, reload func() (recon.PartnerMap, error)) {
+	if reload == nil {
+		http.Error(w, "reloading partners is not configured", http.StatusNotImplemented)
+		return
+	}
+	partners, err := reload()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = r.SetPartners(partners)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, partners)
+}
+
+// reconDialTimeout limits how long ReconcileWith waits to connect.
+const reconDialTimeout = 30 * time.Second
+
+// initiator is implemented by reconcilers which can reconcile with a given
+// partner on demand, such as the SKS prefix tree reconciler.
+type initiator interface {
+	InitiateRecon(conn net.Conn) error
+}
+
+// defaultReconciler returns the SKS prefix tree reconciler, or nil while
+// degraded.
+func (r *Peer) defaultReconciler() Reconciler {
+	r.mu.Lock()
+	rc := r.peer
+	r.mu.Unlock()
+	if m, ok := rc.(*multiReconciler); ok {
+		rc = m.reconcilers[0]
+	}
+	return rc
+}
+
+// ReconcileWith reconciles with the named partner now, rather than waiting
+// for it to be chosen by gossip. Keys found missing are recovered as usual.
+func (r *Peer) ReconcileWith(name string) error {
+	partner, ok := r.Partners()[name]
+	if !ok {
+		return errgo.WithCausef(nil, ErrUnknownPartner, "unknown partner %q", name)
+	}
+	init, ok := r.defaultReconciler().(initiator)
+	if !ok {
+		return errgo.New("recon is unavailable")
+	}
+	conn, err := r.dialPartner(name, partner)
+	if err != nil {
+		return errgo.Notef(err, "cannot connect to partner %q", name)
+	}
+	host, _, _ := net.SplitHostPort(partner.ReconAddr)
+	hc := newHandshakeConn(conn, func(remote *recon.Config) error {
+		return r.checkPartnerConfig(host, []string{name}, remote)
+	})
+	err = init.InitiateRecon(hc)
+	if mismatch := hc.mismatch(); mismatch != nil {
+		return errgo.Mask(mismatch, errgo.Any)
+	}
+	return errgo.Mask(err)
+}
+
+func (r *Peer) serveRecon(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	name := req.FormValue("partner")
+	if name == "" {
+		http.Error(w, "missing required parameter: partner", http.StatusBadRequest)
+		return
+	}
+	err := r.ReconcileWith(name)
+	if errgo.Cause(err) == ErrUnknownPartner {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	log.Infof("reconciled with %q on request", name)
+	writeJSON(w, map[string]string{"partner": name})
+}
+
+func (r *Peer) serveBlocklist(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	writeJSON(w, r.Blocked())
+}
+
+func (r *Peer) serveBlock(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	digest := strings.ToLower(req.FormValue("digest"))
+	if _, err := DigestZp(digest); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err := r.Block(digest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("blocked digest %s", digest)
+	writeJSON(w, r.Blocked())
+}
+
+// DeleteResponse is the response to a key deletion request.
+type DeleteResponse struct {
+	Fingerprint string `json:"fingerprint"`
+	Digest      string `json:"digest"`
+}
+
+func (r *Peer) serveDelete(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	fp := strings.ToLower(strings.TrimPrefix(req.FormValue("fingerprint"), "0x"))
+	if fp == "" {
+		http.Error(w, "missing required parameter: fingerprint", http.StatusBadRequest)
+		return
+	}
+	digest, err := r.DeleteKey(req.Context(), fp)
+	if errgo.Cause(err) == storage.ErrKeyNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("deleted key %s (%s)", fp, digest)
+	writeJSON(w, &DeleteResponse{Fingerprint: fp, Digest: digest})
+}
@@ -0,0 +1,174 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"gopkg.in/hockeypuck/hkp.v1/notify"
+	log "gopkg.in/hockeypuck/logrus.v0"
+)
+
+// anomalyCheckInterval is how often load statistics are checked for
+// anomalies.
+var anomalyCheckInterval = time.Hour
+
+// AnomalyThresholds configures detection of anomalies in load statistics.
+type AnomalyThresholds struct {
+	// SpikeFactor is how many times the median hourly insertions over the
+	// preceding day an hour's insertions must exceed to be a spike, such as
+	// from a flooding attack.
+	SpikeFactor float64
+	// MinSpike is the fewest insertions in an hour considered a spike.
+	MinSpike int
+	// IdleHours is how many consecutive hours without any insertions or
+	// updates indicate that recon has stalled.
+	IdleHours int
+	// RecoveryErrorBurst is how many recovery errors between checks
+	// indicate a problem with recon partners.
+	RecoveryErrorBurst int
+}
+
+// DefaultAnomalyThresholds are suitable for a server in the public pool.
+var DefaultAnomalyThresholds = AnomalyThresholds{
+	SpikeFactor:        10,
+	MinSpike:           1000,
+	IdleHours:          6,
+	RecoveryErrorBurst: 50,
+}
+
+// Anomaly kinds.
+const (
+	AnomalySpike         = "insert spike"
+	AnomalyStall         = "stalled"
+	AnomalyRecoveryBurst = "recovery errors"
+)
+
+// Anomaly describes unusual activity detected in load statistics.
+type Anomaly struct {
+	Kind    string
+	Hour    time.Time
+	Message string
+}
+
+// AnomalyDetection checks load statistics hourly for anomalies, sending n an
+// alert for each one found.
+func AnomalyDetection(n notify.Notifier, th AnomalyThresholds) PeerOption {
+	return func(p *Peer) error {
+		p.anomalies = &anomalyDetector{notifier: n, th: th}
+		return nil
+	}
+}
+
+type anomalyDetector struct {
+	notifier notify.Notifier
+	th       AnomalyThresholds
+
+	started    time.Time
+	lastErrors int
+	stalled    bool
+}
+
+func (r *Peer) detectAnomalies() error {
+	d := r.anomalies
+	d.started = r.clock.Now().UTC()
+	d.lastErrors = r.Stats().RecoveryErrors
+	ticker := r.clock.NewTicker(anomalyCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.t.Dying():
+			return nil
+		case <-ticker.C():
+			for _, a := range d.check(r.Stats(), r.clock.Now().UTC()) {
+				log.Warningf("anomaly detected: %s", a.Message)
+				err := d.notifier.Notify("Keyserver anomaly: "+a.Kind, a.Message)
+				if err != nil {
+					log.Warningf("cannot send anomaly alert: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// check returns the anomalies in stats for the last complete hour before
+// now.
+func (d *anomalyDetector) check(stats *Stats, now time.Time) []Anomaly {
+	var result []Anomaly
+	hour := now.Truncate(time.Hour).Add(-time.Hour)
+	hourly := func(t time.Time) LoadStat {
+		if ls, ok := stats.Hourly[t]; ok {
+			return *ls
+		}
+		return LoadStat{}
+	}
+
+	// Compare the last hour's insertions with the median of the day before.
+	var baseline []int
+	for i := 1; i <= 24; i++ {
+		baseline = append(baseline, hourly(hour.Add(-time.Duration(i)*time.Hour)).Inserted)
+	}
+	sort.Ints(baseline)
+	median := baseline[len(baseline)/2]
+	if median < 1 {
+		median = 1
+	}
+	inserted := hourly(hour).Inserted
+	if inserted >= d.th.MinSpike && float64(inserted) > d.th.SpikeFactor*float64(median) {
+		result = append(result, Anomaly{
+			Kind: AnomalySpike,
+			Hour: hour,
+			Message: fmt.Sprintf("%d keys inserted in the hour from %s, against a median of %d",
+				inserted, hour.Format(time.RFC3339), median),
+		})
+	}
+
+	// Look for sustained inactivity, once the server has been up long
+	// enough to tell.
+	if d.th.IdleHours > 0 && !hour.Add(-time.Duration(d.th.IdleHours-1)*time.Hour).Before(d.started.Truncate(time.Hour)) {
+		idle := true
+		for i := 0; i < d.th.IdleHours; i++ {
+			ls := hourly(hour.Add(-time.Duration(i) * time.Hour))
+			if ls.Inserted+ls.Updated > 0 {
+				idle = false
+				break
+			}
+		}
+		if idle && !d.stalled {
+			result = append(result, Anomaly{
+				Kind:    AnomalyStall,
+				Hour:    hour,
+				Message: fmt.Sprintf("no keys inserted or updated in the last %d hours", d.th.IdleHours),
+			})
+		}
+		d.stalled = idle
+	}
+
+	errors := stats.RecoveryErrors - d.lastErrors
+	d.lastErrors = stats.RecoveryErrors
+	if d.th.RecoveryErrorBurst > 0 && errors >= d.th.RecoveryErrorBurst {
+		result = append(result, Anomaly{
+			Kind:    AnomalyRecoveryBurst,
+			Hour:    hour,
+			Message: fmt.Sprintf("%d key recovery errors since the last check", errors),
+		})
+	}
+	return result
+}
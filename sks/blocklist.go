@@ -0,0 +1,292 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/errgo.v1"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+	log "gopkg.in/hockeypuck/logrus.v0"
+	"gopkg.in/hockeypuck/openpgp.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/metrics"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+)
+
+// BlocklistFilename returns the path of the digest blocklist for the prefix
+// tree at path.
+func BlocklistFilename(path string) string {
+	dir, base := filepath.Dir(path), filepath.Base(path)
+	return filepath.Join(dir, "."+base+".blocklist")
+}
+
+// blocklist persists the digests and fingerprints of keys which have been
+// deleted, so that they are kept out of the prefix tree and are not
+// recovered again from recon partners which still have them. Keys are
+// blocked by fingerprint as well as digest, since any change to a key, such
+// as a new signature, changes its digest.
+type blocklist struct {
+	path   string
+	sealer *sealer
+
+	mu           sync.Mutex
+	digests      map[string]bool
+	fingerprints map[string]bool
+}
+
+// blocklistFile is the format of the blocklist file. Blocklists written
+// before fingerprints were blocked hold only an array of digests.
+type blocklistFile struct {
+	Digests      []string `json:"digests"`
+	Fingerprints []string `json:"fingerprints"`
+}
+
+// openBlocklist reads the blocklist at path. If sealer is not nil, the
+// blocklist is encrypted.
+func openBlocklist(path string, sealer *sealer) (*blocklist, error) {
+	b := &blocklist{path: path, sealer: sealer, digests: map[string]bool{}, fingerprints: map[string]bool{}}
+	var buf json.RawMessage
+	var err error
+	if sealer != nil {
+		err = sealer.readJSON(path, &buf)
+	} else {
+		buf, err = ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			return b, nil
+		}
+	}
+	var f blocklistFile
+	if err == nil && len(buf) > 0 {
+		if trimmed := bytes.TrimSpace(buf); len(trimmed) > 0 && trimmed[0] == '[' {
+			err = json.Unmarshal(trimmed, &f.Digests)
+		} else {
+			err = json.Unmarshal(trimmed, &f)
+		}
+	}
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read blocklist %q", path)
+	}
+	for _, digest := range f.Digests {
+		b.digests[digest] = true
+	}
+	for _, rfp := range f.Fingerprints {
+		b.fingerprints[rfp] = true
+	}
+	return b, nil
+}
+
+// add blocks digests, returning those which were not already blocked.
+func (b *blocklist) add(digests ...string) ([]string, error) {
+	return b.addTo(b.digests, digests)
+}
+
+// addFingerprints blocks the keys with the given RFingerprints.
+func (b *blocklist) addFingerprints(rfps ...string) error {
+	_, err := b.addTo(b.fingerprints, rfps)
+	return errgo.Mask(err)
+}
+
+// addTo adds values to set and writes the blocklist, returning those which
+// were not already blocked.
+func (b *blocklist) addTo(set map[string]bool, values []string) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var added []string
+	for _, value := range values {
+		value = strings.ToLower(value)
+		if !set[value] {
+			set[value] = true
+			added = append(added, value)
+		}
+	}
+	if len(added) == 0 {
+		return nil, nil
+	}
+	err := b.write()
+	if err != nil {
+		for _, value := range added {
+			delete(set, value)
+		}
+		return nil, errgo.Mask(err)
+	}
+	return added, nil
+}
+
+// write replaces the blocklist file, so that a crash while writing leaves
+// the previous blocklist intact.
+func (b *blocklist) write() error {
+	f := blocklistFile{Digests: sortedSet(b.digests), Fingerprints: sortedSet(b.fingerprints)}
+	tmp := b.path + ".tmp"
+	var err error
+	if b.sealer != nil {
+		err = b.sealer.writeJSON(tmp, &f)
+	} else {
+		var buf []byte
+		buf, err = json.Marshal(&f)
+		if err == nil {
+			err = ioutil.WriteFile(tmp, buf, 0600)
+		}
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(os.Rename(tmp, b.path))
+}
+
+func sortedSet(set map[string]bool) []string {
+	result := []string{}
+	for value := range set {
+		result = append(result, value)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// list returns the blocked digests, sorted.
+func (b *blocklist) list() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return sortedSet(b.digests)
+}
+
+// has returns whether digest is blocked.
+func (b *blocklist) has(digest string) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.digests[strings.ToLower(digest)]
+}
+
+// hasKey returns whether key is blocked, by its digest or fingerprint.
+func (b *blocklist) hasKey(key *openpgp.PrimaryKey) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.digests[strings.ToLower(key.MD5)] || b.fingerprints[strings.ToLower(key.RFingerprint)]
+}
+
+// filterItems returns the items whose digests are not blocked.
+func (b *blocklist) filterItems(items []*cf.Zp) []*cf.Zp {
+	var result []*cf.Zp
+	for _, z := range items {
+		if !b.has(hex.EncodeToString(hashqueryElement(z))) {
+			result = append(result, z)
+		}
+	}
+	return result
+}
+
+// filterKeys returns the keys which are not blocked.
+func (b *blocklist) filterKeys(keys []*openpgp.PrimaryKey) []*openpgp.PrimaryKey {
+	var result []*openpgp.PrimaryKey
+	for _, key := range keys {
+		if b.hasKey(key) {
+			log.Debugf("refusing blocked key %s (%s)", key.Fingerprint(), key.MD5)
+			continue
+		}
+		result = append(result, key)
+	}
+	return result
+}
+
+// Block adds digests to the blocklist and removes them from the prefix
+// tree, so that keys with these digests are neither advertised to nor
+// recovered from recon partners.
+func (r *Peer) Block(digests ...string) error {
+	if r.blocklist == nil {
+		return errgo.New("cannot block digests on a read-only peer")
+	}
+	added, err := r.blocklist.add(digests...)
+	if err != nil {
+		return errgo.Notef(err, "cannot update blocklist")
+	}
+	for _, digest := range added {
+		err = r.applyChange(storage.KeyRemoved{Digest: digest})
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+// Blocked returns the blocked digests, sorted.
+func (r *Peer) Blocked() []string {
+	if r.blocklist == nil {
+		return nil
+	}
+	return r.blocklist.list()
+}
+
+// KeyBlocked returns whether key has been deleted, by its fingerprint or
+// digest, so that it should not be stored again.
+func (r *Peer) KeyBlocked(key *openpgp.PrimaryKey) bool {
+	return r.blocklist.hasKey(key)
+}
+
+// DeleteKey deletes the key with the given fingerprint from storage, which
+// must implement storage.Deleter, and blocks its digest and fingerprint so
+// that it is not recovered again from recon partners, even once changed.
+// It returns the digest deleted.
+func (r *Peer) DeleteKey(ctx context.Context, fingerprint string) (string, error) {
+	rfp := openpgp.Reverse(strings.ToLower(strings.TrimPrefix(fingerprint, "0x")))
+	keys, err := storage.FetchKeysContext(ctx, r.storage, []string{rfp})
+	if err != nil {
+		return "", errgo.Mask(err, errgo.Any)
+	}
+	var digest string
+	for _, key := range keys {
+		if key.RFingerprint == rfp {
+			digest = key.MD5
+		}
+	}
+	if digest == "" {
+		return "", errgo.WithCausef(nil, storage.ErrKeyNotFound, "key %q not found", fingerprint)
+	}
+	// Block the key first, so that a recovery in progress cannot restore
+	// it once it is deleted.
+	err = r.Block(digest)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	err = r.blocklist.addFingerprints(rfp)
+	if err != nil {
+		return "", errgo.Notef(err, "cannot update blocklist")
+	}
+	change, err := storage.DeleteKey(r.storage, rfp)
+	if err != nil {
+		metrics.StorageError("delete")
+		return "", errgo.Mask(err, errgo.Any)
+	}
+	metrics.KeyChanged(SourceAdmin, change)
+	return digest, nil
+}
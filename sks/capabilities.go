@@ -0,0 +1,135 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	log "gopkg.in/hockeypuck/logrus.v0"
+
+	"gopkg.in/hockeypuck/hkp.v1/clock"
+)
+
+// CapabilitiesPath is the path, relative to a partner's base path, of the
+// optional endpoint describing how it accepts hashquery requests.
+const CapabilitiesPath = "/pks/capabilities"
+
+// capabilitiesTTL is how long probed or learned partner capabilities are
+// cached before being probed again.
+const capabilitiesTTL = time.Hour
+
+// Capabilities describes how a partner accepts hashquery requests. The zero
+// value describes a partner of unknown capabilities, to which uncompressed,
+// plain HTTP requests of the configured chunk size are made.
+type Capabilities struct {
+	// Compression indicates the partner accepts gzip-encoded hashquery
+	// requests.
+	Compression bool `json:"compression"`
+	// MaxChunkSize is the most keys the partner will return in a single
+	// hashquery, if limited.
+	MaxChunkSize int `json:"maxChunkSize,omitempty"`
+	// HKPS indicates the partner serves hashquery requests over HTTPS.
+	HKPS bool `json:"hkps"`
+	// Reconcilers lists the reconciliation schemes the partner supports,
+	// if it supports alternatives to the default.
+	Reconcilers []string `json:"reconcilers,omitempty"`
+	// Transports holds the addresses at which the partner accepts recon
+	// over alternatives to TCP, by transport name, as with ReconTransport.
+	Transports map[string]string `json:"transports,omitempty"`
+}
+
+type capabilityEntry struct {
+	caps    Capabilities
+	expires time.Time
+}
+
+// capabilityCache caches partner capabilities by HKP address, until they
+// expire by clock.
+type capabilityCache struct {
+	mu      sync.Mutex
+	entries map[string]capabilityEntry
+	clock   clock.Clock
+}
+
+func (c *capabilityCache) get(hkpAddr string) (Capabilities, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[hkpAddr]
+	if !ok || c.clock.Now().After(entry.expires) {
+		return Capabilities{}, false
+	}
+	return entry.caps, true
+}
+
+func (c *capabilityCache) set(hkpAddr string, caps Capabilities) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = map[string]capabilityEntry{}
+	}
+	c.entries[hkpAddr] = capabilityEntry{caps: caps, expires: c.clock.Now().Add(capabilitiesTTL)}
+}
+
+// capabilities returns the cached capabilities of the partner at hkpAddr,
+// probing its capabilities endpoint if they are not known.
+func (r *Peer) capabilities(hkpAddr string) Capabilities {
+	if caps, ok := r.caps.get(hkpAddr); ok {
+		return caps
+	}
+	caps, err := r.probeCapabilities(hkpAddr)
+	if err != nil {
+		log.Debugf("cannot probe capabilities of %q, using defaults: %v", hkpAddr, err)
+	}
+	r.caps.set(hkpAddr, caps)
+	return caps
+}
+
+func (r *Peer) probeCapabilities(hkpAddr string) (Capabilities, error) {
+	var caps Capabilities
+	resp, err := r.client.Get(r.partnerURL(r.partnerScheme(hkpAddr, false), hkpAddr, CapabilitiesPath))
+	if err != nil {
+		return caps, errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return caps, errgo.Newf("unexpected status %q", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&caps)
+	if err != nil {
+		return Capabilities{}, errgo.Mask(err)
+	}
+	return caps, nil
+}
+
+// limitChunkSize records that the partner at hkpAddr rejected a hashquery
+// for n keys as too large.
+func (r *Peer) limitChunkSize(hkpAddr string, n int) Capabilities {
+	caps := r.capabilities(hkpAddr)
+	caps.MaxChunkSize = n / 2
+	if caps.MaxChunkSize < 1 {
+		caps.MaxChunkSize = 1
+	}
+	log.Infof("partner %q rejected hashquery of %d keys, limiting to %d", hkpAddr, n, caps.MaxChunkSize)
+	r.caps.set(hkpAddr, caps)
+	return caps
+}
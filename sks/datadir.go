@@ -0,0 +1,146 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"os"
+	"path/filepath"
+
+	"gopkg.in/errgo.v1"
+
+	log "gopkg.in/hockeypuck/logrus.v0"
+)
+
+// Layout locates the files a Peer keeps on disk.
+type Layout struct {
+	// PTree is the prefix tree directory.
+	PTree string
+	// Stats is the load statistics file.
+	Stats string
+	// Journal is the digest write-ahead journal.
+	Journal string
+	// Recovery is the queue of digests outstanding from recoveries in
+	// progress.
+	Recovery string
+	// Blocklist is the list of digests of deleted keys.
+	Blocklist string
+	// Lock is the advisory lock file guarding the prefix tree.
+	Lock string
+	// Quarantine is the directory for keys held back from storage.
+	Quarantine string
+	// Cache is the directory for local caches.
+	Cache string
+}
+
+// LegacyLayout returns the layout used when a Peer is created with only a
+// prefix tree path: its other files are hidden dotfiles alongside the prefix
+// tree, such as ".ptree.stats".
+func LegacyLayout(ptreePath string) *Layout {
+	dir, base := filepath.Dir(ptreePath), filepath.Base(ptreePath)
+	return &Layout{
+		PTree:      ptreePath,
+		Stats:      StatsFilename(ptreePath),
+		Journal:    JournalFilename(ptreePath),
+		Recovery:   RecoveryFilename(ptreePath),
+		Blocklist:  BlocklistFilename(ptreePath),
+		Lock:       LockFilename(ptreePath),
+		Quarantine: filepath.Join(dir, "."+base+".quarantine"),
+		Cache:      filepath.Join(dir, "."+base+".cache"),
+	}
+}
+
+// DataDirLayout returns a layout keeping all of a Peer's files in dir.
+func DataDirLayout(dir string) *Layout {
+	return &Layout{
+		PTree:      filepath.Join(dir, "ptree"),
+		Stats:      filepath.Join(dir, "stats.json"),
+		Journal:    filepath.Join(dir, "journal"),
+		Recovery:   filepath.Join(dir, "recovery.json"),
+		Blocklist:  filepath.Join(dir, "blocklist.json"),
+		Lock:       filepath.Join(dir, "lock"),
+		Quarantine: filepath.Join(dir, "quarantine"),
+		Cache:      filepath.Join(dir, "cache"),
+	}
+}
+
+// DataDir keeps all of the peer's files in dir, creating it if necessary,
+// rather than alongside the prefix tree path given to NewPeer, which is
+// ignored.
+func DataDir(dir string) PeerOption {
+	return func(p *Peer) error {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		p.layout = DataDirLayout(dir)
+		return nil
+	}
+}
+
+// Relocate moves a peer's files from one layout to another, such as from
+// the LegacyLayout of an existing prefix tree to a DataDirLayout. The peer
+// must not be running; the prefix tree lock is held while files are moved.
+// Files missing from the old layout are skipped, but Relocate refuses to
+// overwrite any existing file in the new layout.
+func Relocate(from, to *Layout) error {
+	moves := [][2]string{
+		{from.PTree, to.PTree},
+		{from.Stats, to.Stats},
+		{from.Journal, to.Journal},
+		{from.Recovery, to.Recovery},
+		{from.Blocklist, to.Blocklist},
+		{from.Quarantine, to.Quarantine},
+		{from.Cache, to.Cache},
+	}
+	for _, move := range moves {
+		if _, err := os.Stat(move[0]); err == nil {
+			if _, err := os.Stat(move[1]); err == nil {
+				return errgo.Newf("cannot relocate %q: %q already exists", move[0], move[1])
+			}
+		}
+	}
+
+	err := os.MkdirAll(filepath.Dir(to.Lock), 0755)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	lock, err := lockFilename(from.Lock, false)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(ErrPrefixTreeLocked))
+	}
+	defer func() {
+		lock.Close()
+		os.Remove(from.Lock)
+	}()
+
+	for _, move := range moves {
+		if _, err := os.Stat(move[0]); os.IsNotExist(err) {
+			continue
+		}
+		err = os.MkdirAll(filepath.Dir(move[1]), 0755)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		log.Infof("relocating %q to %q", move[0], move[1])
+		err = os.Rename(move[0], move[1])
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/notify"
+	log "gopkg.in/hockeypuck/logrus.v0"
+)
+
+// maxDigestPartners is the number of partners listed in an activity digest.
+const maxDigestPartners = 5
+
+// ActivityDigest sends n a summary of server activity at the given interval,
+// typically hourly: keys inserted and updated, recovery errors, rejected
+// keys and the partners most keys were recovered from.
+func ActivityDigest(n notify.Notifier, interval time.Duration) PeerOption {
+	return func(p *Peer) error {
+		if interval <= 0 {
+			return errgo.Newf("invalid digest interval %v", interval)
+		}
+		p.digest = n
+		p.digestEvery = interval
+		return nil
+	}
+}
+
+func (r *Peer) sendDigests() error {
+	prev := r.Stats()
+	from := r.clock.Now().UTC().Truncate(time.Hour)
+	ticker := r.clock.NewTicker(r.digestEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.t.Dying():
+			return nil
+		case <-ticker.C():
+			cur := r.Stats()
+			to := r.clock.Now().UTC().Truncate(time.Hour)
+			subject, body := summarize(prev, cur, from, to)
+			err := r.digest.Notify(subject, body)
+			if err != nil {
+				log.Warningf("cannot send activity digest: %v", err)
+			}
+			prev, from = cur, to
+		}
+	}
+}
+
+type partnerActivity struct {
+	partner string
+	LoadStat
+}
+
+// summarize describes the activity between the prev and cur snapshots of
+// stats. Keys inserted and updated are counted from the hourly statistics
+// in [from, to).
+func summarize(prev, cur *Stats, from, to time.Time) (string, string) {
+	var inserted, updated int
+	for t, ls := range cur.Hourly {
+		if !t.Before(from) && t.Before(to) {
+			inserted += ls.Inserted
+			updated += ls.Updated
+		}
+	}
+
+	var partners []partnerActivity
+	for source, ls := range cur.Sources {
+		if !strings.HasPrefix(source, "recon:") {
+			continue
+		}
+		pa := partnerActivity{partner: strings.TrimPrefix(source, "recon:"), LoadStat: *ls}
+		if prevLs, ok := prev.Sources[source]; ok {
+			pa.Inserted -= prevLs.Inserted
+			pa.Updated -= prevLs.Updated
+		}
+		if pa.Inserted+pa.Updated > 0 {
+			partners = append(partners, pa)
+		}
+	}
+	sort.Slice(partners, func(i, j int) bool {
+		ni, nj := partners[i].Inserted+partners[i].Updated, partners[j].Inserted+partners[j].Updated
+		if ni != nj {
+			return ni > nj
+		}
+		return partners[i].partner < partners[j].partner
+	})
+	if len(partners) > maxDigestPartners {
+		partners = partners[:maxDigestPartners]
+	}
+
+	subject := fmt.Sprintf("Keyserver activity from %s to %s",
+		from.Format(time.RFC3339), to.Format(time.RFC3339))
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "Keys inserted: %d\n", inserted)
+	fmt.Fprintf(&body, "Keys updated: %d\n", updated)
+	fmt.Fprintf(&body, "Total keys: %d\n", cur.Total)
+	fmt.Fprintf(&body, "Recovery errors: %d\n", cur.RecoveryErrors-prev.RecoveryErrors)
+	fmt.Fprintf(&body, "Rejected keys: %d\n", cur.Rejected-prev.Rejected)
+	fmt.Fprintf(&body, "Mismatched keys: %d\n", cur.Mismatched-prev.Mismatched)
+	fmt.Fprintf(&body, "Diverged keys: %d\n", cur.Diverged-prev.Diverged)
+	if cur.Degraded != "" {
+		fmt.Fprintf(&body, "Degraded: %s\n", cur.Degraded)
+	}
+	if len(partners) > 0 {
+		fmt.Fprintf(&body, "Top partners:\n")
+		for _, pa := range partners {
+			fmt.Fprintf(&body, "  %s: %d inserted, %d updated\n", pa.partner, pa.Inserted, pa.Updated)
+		}
+	}
+	return subject, body.String()
+}
@@ -0,0 +1,149 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/errgo.v1"
+	log "gopkg.in/hockeypuck/logrus.v0"
+	"gopkg.in/hockeypuck/openpgp.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/metrics"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+)
+
+// maxDivergences is the number of recent divergences reported by
+// Divergences.
+const maxDivergences = 1000
+
+// Divergence describes a key recovered from a recon partner whose digest,
+// once merged with the key stored, differs from the digest requested. The
+// partner's digest is then never in the prefix tree, so unless it is
+// blocked, the key is recovered again every recon round.
+type Divergence struct {
+	// Remote is the partner the key was recovered from.
+	Remote string `json:"remote"`
+	// Fingerprint is the fingerprint of the key.
+	Fingerprint string `json:"fingerprint"`
+	// Requested is the digest requested from the partner.
+	Requested string `json:"requested"`
+	// Stored is the digest of the key as stored, if known.
+	Stored string `json:"stored,omitempty"`
+	// Time is when the key was merged.
+	Time time.Time `json:"time"`
+}
+
+// verifyDigests checks that keys recovered from remoteAddr, once merged
+// into storage with the given changes, are stored with the digests which
+// were requested. Digests stored but missing from the prefix tree are
+// inserted. Digests which diverged are recorded and blocked, so that they
+// are not recovered again.
+func (r *Peer) verifyDigests(ctx context.Context, remoteAddr string, keys []*openpgp.PrimaryKey, changes []storage.KeyChange) {
+	var diverged []string
+	for i, change := range changes {
+		if i >= len(keys) {
+			break
+		}
+		key := keys[i]
+		requested := strings.ToLower(key.MD5)
+		var stored string
+		switch change := change.(type) {
+		case storage.KeyAdded:
+			stored = change.Digest
+		case storage.KeyReplaced:
+			stored = change.NewDigest
+		case storage.KeyNotChanged:
+			// No digests were inserted, so the prefix tree should
+			// already hold the stored digest.
+			storedKeys, err := storage.FetchKeysContext(ctx, r.storage, []string{key.RFingerprint})
+			if err != nil || len(storedKeys) == 0 {
+				log.Warningf("cannot verify digest of key %s from %q: %v", key.Fingerprint(), remoteAddr, err)
+				continue
+			}
+			stored = storedKeys[0].MD5
+			if strings.EqualFold(stored, requested) {
+				r.restoreDigest(requested)
+				continue
+			}
+		default:
+			continue
+		}
+		if strings.EqualFold(stored, requested) {
+			continue
+		}
+
+		log.Warningf("key %s from %q merged with digest %s rather than %s requested",
+			key.Fingerprint(), remoteAddr, stored, requested)
+		r.stats.UpdateDiverged()
+		metrics.DigestDiverged()
+		r.recordDivergence(Divergence{
+			Remote:      remoteAddr,
+			Fingerprint: key.Fingerprint(),
+			Requested:   requested,
+			Stored:      strings.ToLower(stored),
+			Time:        r.clock.Now(),
+		})
+		diverged = append(diverged, requested)
+	}
+	if len(diverged) > 0 && r.blocklist != nil {
+		_, err := r.blocklist.add(diverged...)
+		if err != nil {
+			log.Warningf("cannot block diverged digests: %v", err)
+		}
+	}
+}
+
+// restoreDigest inserts a digest which is stored into the prefix tree, if
+// it is missing.
+func (r *Peer) restoreDigest(digest string) {
+	_, found, err := r.DigestPath(digest)
+	if err != nil || found || r.blocklist.has(digest) {
+		return
+	}
+	log.Warningf("digest %s is stored but missing from the prefix tree, inserting it", digest)
+	err = r.applyChange(storage.KeyAdded{Digest: digest})
+	if err != nil {
+		log.Errorf("cannot insert digest %s: %v", digest, errgo.Details(err))
+	}
+}
+
+func (r *Peer) recordDivergence(d Divergence) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.divergences = append(r.divergences, d)
+	if n := len(r.divergences) - maxDivergences; n > 0 {
+		r.divergences = append([]Divergence(nil), r.divergences[n:]...)
+	}
+}
+
+// Divergences returns the most recent keys recovered whose digests diverged
+// once merged, oldest first.
+func (r *Peer) Divergences() []Divergence {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Divergence{}, r.divergences...)
+}
+
+func (r *Peer) serveDivergences(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	writeJSON(w, r.Divergences())
+}
@@ -0,0 +1,279 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/metrics"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+	log "gopkg.in/hockeypuck/logrus.v0"
+	"gopkg.in/hockeypuck/openpgp.v1"
+)
+
+// DumpStats reports the progress of loading a keydump.
+type DumpStats struct {
+	// Files is the number of dump files, and FilesDone the number loaded.
+	Files     int
+	FilesDone int
+
+	Keys      int
+	Inserted  int
+	Updated   int
+	Unchanged int
+	Rejected  int
+
+	Elapsed time.Duration
+}
+
+// dumpLoader loads keydump files into storage.
+type dumpLoader struct {
+	st        storage.Storage
+	workers   int
+	batchSize int
+	parseMode storage.ParseMode
+	progress  func(DumpStats)
+	filter    func([]*openpgp.PrimaryKey) []*openpgp.PrimaryKey
+	changed   func(storage.KeyChange)
+
+	start time.Time
+	mu    sync.Mutex
+	stats DumpStats
+}
+
+type DumpOption func(*dumpLoader)
+
+// DumpWorkers sets how many dump files are loaded at once. The default is
+// the number of CPUs.
+func DumpWorkers(n int) DumpOption {
+	return func(l *dumpLoader) {
+		if n > 0 {
+			l.workers = n
+		}
+	}
+}
+
+// DumpBatchSize sets how many keys are upserted into storage at a time. The
+// default is 100.
+func DumpBatchSize(n int) DumpOption {
+	return func(l *dumpLoader) {
+		if n > 0 {
+			l.batchSize = n
+		}
+	}
+}
+
+// DumpParseMode sets how keys containing unparseable packets are handled.
+// The default is storage.ParsePermissive, as SKS dumps contain many such
+// keys whose digests must be kept to reconcile with other keyservers.
+func DumpParseMode(m storage.ParseMode) DumpOption {
+	return func(l *dumpLoader) {
+		l.parseMode = m
+	}
+}
+
+// DumpProgress registers f to be called with the progress of the load after
+// each batch of keys is stored. Calls are serialized.
+func DumpProgress(f func(DumpStats)) DumpOption {
+	return func(l *dumpLoader) {
+		l.progress = f
+	}
+}
+
+// LoadDump loads the keys in the SKS keydump files matching *.pgp in dir
+// into st, several files at a time, and returns the final statistics.
+//
+// The prefix tree is populated from the key changes st notifies, so a Peer
+// for st should be created with NewPeer before loading, as Peer.LoadDump
+// does. Loading a dump into a new server is much faster than recovering
+// millions of keys from recon partners.
+func LoadDump(dir string, st storage.Storage, options ...DumpOption) (*DumpStats, error) {
+	l := &dumpLoader{
+		st:        st,
+		workers:   runtime.NumCPU(),
+		batchSize: 100,
+	}
+	for _, option := range options {
+		option(l)
+	}
+	return l.load(dir)
+}
+
+// LoadDump loads an SKS keydump into storage and the prefix tree, like the
+// LoadDump function. Keys blocked from recon are skipped, and the changes
+// made are counted in the peer's statistics as SourceLoad.
+func (r *Peer) LoadDump(dir string, options ...DumpOption) (*DumpStats, error) {
+	l := &dumpLoader{
+		st:        r.storage,
+		workers:   runtime.NumCPU(),
+		batchSize: 100,
+		parseMode: r.parseMode,
+		filter:    r.blocklist.filterKeys,
+		changed: func(change storage.KeyChange) {
+			r.stats.UpdateSource(SourceLoad, change)
+		},
+	}
+	for _, option := range options {
+		option(l)
+	}
+	return l.load(dir)
+}
+
+func (l *dumpLoader) load(dir string) (*DumpStats, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pgp"))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(files) == 0 {
+		return nil, errgo.Newf("no keydump files found in %q", dir)
+	}
+	sort.Strings(files)
+	l.start = time.Now()
+	l.stats.Files = len(files)
+
+	paths := make(chan string)
+	errs := make(chan error, len(files))
+	var wg sync.WaitGroup
+	for i := 0; i < l.workers && i < len(files); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				err := l.loadFile(path)
+				if err != nil {
+					errs <- errgo.Notef(err, "cannot load %q", path)
+				}
+			}
+		}()
+	}
+	for _, path := range files {
+		paths <- path
+	}
+	close(paths)
+	wg.Wait()
+	close(errs)
+
+	stats := l.report(nil, false)
+	log.Infof("loaded %d keys from %d dump files in %v: inserted=%d updated=%d unchanged=%d rejected=%d",
+		stats.Keys, stats.FilesDone, stats.Elapsed, stats.Inserted, stats.Updated, stats.Unchanged, stats.Rejected)
+	if err, ok := <-errs; ok {
+		return stats, err
+	}
+	return stats, nil
+}
+
+func (l *dumpLoader) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer f.Close()
+
+	var batch []*openpgp.PrimaryKey
+	var rejected int
+	flush := func() error {
+		if len(batch) == 0 && rejected == 0 {
+			return nil
+		}
+		keys := batch
+		if l.filter != nil {
+			keys = l.filter(keys)
+		}
+		changes, err := storage.UpsertKeys(l.st, keys)
+		if err != nil {
+			metrics.StorageError("upsert")
+			return errgo.Mask(err)
+		}
+		l.add(len(batch), rejected, changes)
+		batch, rejected = nil, 0
+		return nil
+	}
+	for readKey := range openpgp.ReadKeys(bufio.NewReader(f)) {
+		if readKey.Error != nil {
+			log.Debugf("skipping unreadable key in %q: %v", path, readKey.Error)
+			rejected++
+			continue
+		}
+		if err := l.parseMode.Check(readKey.PrimaryKey); err != nil {
+			log.Debugf("skipping key in %q: %v", path, err)
+			rejected++
+			continue
+		}
+		batch = append(batch, readKey.PrimaryKey)
+		if len(batch) >= l.batchSize {
+			if err := flush(); err != nil {
+				return errgo.Mask(err)
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return errgo.Mask(err)
+	}
+	l.report(nil, true)
+	return nil
+}
+
+// add counts the keys read and the changes made in storing them, and
+// reports progress.
+func (l *dumpLoader) add(keys, rejected int, changes []storage.KeyChange) {
+	l.report(func(s *DumpStats) {
+		s.Keys += keys + rejected
+		s.Rejected += rejected
+		for _, change := range changes {
+			switch change.(type) {
+			case storage.KeyAdded:
+				s.Inserted++
+			case storage.KeyReplaced:
+				s.Updated++
+			case storage.KeyNotChanged:
+				s.Unchanged++
+			}
+			metrics.KeyChanged(SourceLoad, change)
+			if l.changed != nil {
+				l.changed(change)
+			}
+		}
+	}, false)
+}
+
+// report applies update to the statistics, marks a file done if fileDone is
+// set, and passes the statistics to the progress function.
+func (l *dumpLoader) report(update func(*DumpStats), fileDone bool) *DumpStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if update != nil {
+		update(&l.stats)
+	}
+	if fileDone {
+		l.stats.FilesDone++
+	}
+	l.stats.Elapsed = time.Since(l.start)
+	stats := l.stats
+	if l.progress != nil && (update != nil || fileDone) {
+		l.progress(stats)
+	}
+	return &stats
+}
@@ -0,0 +1,145 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/cryptoprovider"
+)
+
+// KeyProvider returns a 256-bit key for encrypting local files at rest.
+// Implementations may read a key file, as KeyFile does, or obtain a data
+// key from a key management service.
+type KeyProvider func() ([]byte, error)
+
+// KeyFile returns a KeyProvider reading a key from path, either as 32 raw
+// bytes or 64 hexadecimal digits.
+func KeyFile(path string) KeyProvider {
+	return func() ([]byte, error) {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if trimmed := bytes.TrimSpace(buf); len(trimmed) == 2*32 {
+			key, err := hex.DecodeString(string(trimmed))
+			if err == nil {
+				return key, nil
+			}
+		}
+		if len(buf) != 32 {
+			return nil, errgo.Newf("key file %q must contain a 256-bit key", path)
+		}
+		return buf, nil
+	}
+}
+
+// EncryptAtRest encrypts the files the peer keeps outside of the prefix
+// tree, such as the digest journal and load statistics, with the key from kp
+// using the authenticated cipher of the peer's crypto provider, AES-256-GCM
+// by default. Existing unencrypted files are not readable once
+// encryption is enabled, and are discarded with a warning.
+//
+// The prefix tree itself is stored by conflux's leveldb backend, which does
+// not support encryption; use filesystem or volume encryption for it.
+func EncryptAtRest(kp KeyProvider) PeerOption {
+	return func(p *Peer) error {
+		key, err := kp()
+		if err != nil {
+			return errgo.Notef(err, "cannot get encryption key")
+		}
+		if len(key) != 32 {
+			return errgo.Newf("encryption key must be 256 bits, got %d", 8*len(key))
+		}
+		p.atRestKey = key
+		return nil
+	}
+}
+
+// sealer encrypts and authenticates local files.
+type sealer struct {
+	aead cipher.AEAD
+}
+
+func newSealer(provider cryptoprovider.Provider, key []byte) (*sealer, error) {
+	aead, err := provider.AEAD(key)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &sealer{aead: aead}, nil
+}
+
+// seal returns plaintext encrypted under a random nonce, which is prepended.
+func (s *sealer) seal(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return s.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (s *sealer) open(sealed []byte) ([]byte, error) {
+	n := s.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, errgo.New("encrypted data too short")
+	}
+	plaintext, err := s.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return plaintext, nil
+}
+
+// readJSON decrypts and decodes the JSON file at path into v. A missing file
+// leaves v unchanged.
+func (s *sealer) readJSON(path string, v interface{}) error {
+	sealed, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errgo.Mask(err)
+	}
+	buf, err := s.open(sealed)
+	if err != nil {
+		return errgo.Notef(err, "cannot decrypt %q", path)
+	}
+	return errgo.Mask(json.Unmarshal(buf, v))
+}
+
+// writeJSON encodes v as JSON and writes it encrypted to path.
+func (s *sealer) writeJSON(path string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	sealed, err := s.seal(buf)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(ioutil.WriteFile(path, sealed, 0600))
+}
@@ -0,0 +1,75 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"context"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/tomb.v2"
+)
+
+// CheckPrefixTree returns why the prefix tree is unavailable, or nil if it
+// is open and its root can be read. Its signature matches hkp.HealthCheck.
+func (r *Peer) CheckPrefixTree(ctx context.Context) error {
+	if r.t.Err() != tomb.ErrStillAlive {
+		return errgo.New("prefix tree is closed")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ptree == nil || r.degraded != nil {
+		return errgo.Notef(r.degraded, "prefix tree unavailable")
+	}
+	_, err := r.ptree.Root()
+	if err != nil {
+		return errgo.Notef(err, "cannot read prefix tree root")
+	}
+	return nil
+}
+
+// CheckRecon returns why recon is not running, or nil if it is, or if it is
+// disabled because the prefix tree is read-only, or the peer is a standby
+// which has not yet acquired the recon lease. Recon is also considered
+// unhealthy when every configured partner has mismatched prefix tree
+// parameters, as it can never succeed. Its signature matches
+// hkp.HealthCheck.
+func (r *Peer) CheckRecon(ctx context.Context) error {
+	if r.readOnly {
+		return nil
+	}
+	if r.t.Err() != tomb.ErrStillAlive {
+		return errgo.New("recon is stopped")
+	}
+	r.mu.Lock()
+	peer, degraded, partners := r.peer, r.degraded, len(r.settings.Partners)
+	var lost error
+	if r.standby != nil {
+		lost = r.standby.lost
+	}
+	r.mu.Unlock()
+	if lost != nil {
+		return lost
+	}
+	if peer == nil {
+		return errgo.Notef(degraded, "recon is waiting for the prefix tree")
+	}
+	if mismatched := len(r.MismatchedPartners()); partners > 0 && mismatched >= partners {
+		return errgo.Newf("all %d recon partners have mismatched prefix trees", partners)
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/errgo.v1"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+	"gopkg.in/hockeypuck/conflux.v2/recon"
+)
+
+// NodeInfo describes a prefix tree node for diagnostics.
+type NodeInfo struct {
+	// Prefix is the node's key as a string of binary digits. The root's
+	// prefix is empty.
+	Prefix string `json:"prefix"`
+	// Size is the number of elements in the node's subtree.
+	Size int  `json:"size"`
+	Leaf bool `json:"leaf"`
+	// Children summarizes the node's children, if it is not a leaf.
+	Children []*NodeInfo `json:"children,omitempty"`
+	// Elements contains the digests in a leaf, when requested.
+	Elements []string `json:"elements,omitempty"`
+}
+
+func formatPrefix(bs *cf.Bitstring) string {
+	if bs == nil {
+		return ""
+	}
+	buf := make([]byte, bs.BitLen())
+	for i := range buf {
+		buf[i] = '0' + byte(bs.Get(i))
+	}
+	return string(buf)
+}
+
+func parsePrefix(s string) (*cf.Bitstring, error) {
+	bs := cf.NewBitstring(len(s))
+	for i, c := range s {
+		switch c {
+		case '0':
+			bs.Clear(i)
+		case '1':
+			bs.Set(i)
+		default:
+			return nil, errgo.Newf("invalid prefix %q: must be binary digits", s)
+		}
+	}
+	return bs, nil
+}
+
+func newNodeInfo(node recon.PrefixNode, elements bool) (*NodeInfo, error) {
+	info := &NodeInfo{
+		Prefix: formatPrefix(node.Key()),
+		Size:   node.Size(),
+		Leaf:   node.IsLeaf(),
+	}
+	if info.Leaf {
+		if elements {
+			zs, err := node.Elements()
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			for _, z := range zs {
+				info.Elements = append(info.Elements, strings.ToLower(z.FullKeyString()))
+			}
+		}
+		return info, nil
+	}
+	children, err := node.Children()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	for _, child := range children {
+		info.Children = append(info.Children, &NodeInfo{
+			Prefix: formatPrefix(child.Key()),
+			Size:   child.Size(),
+			Leaf:   child.IsLeaf(),
+		})
+	}
+	return info, nil
+}
+
+// Node describes the prefix tree node with the given prefix, a string of
+// binary digits. The root node has an empty prefix.
+func (r *Peer) Node(prefix string) (*NodeInfo, error) {
+	bs, err := parsePrefix(prefix)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ptree == nil {
+		return nil, errgo.Notef(r.degraded, "prefix tree unavailable")
+	}
+	var node recon.PrefixNode
+	if prefix == "" {
+		node, err = r.ptree.Root()
+	} else {
+		node, err = r.ptree.Node(bs)
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return newNodeInfo(node, true)
+}
+
+// DigestPath describes the nodes from the root of the prefix tree down to the
+// leaf where the given key digest belongs, and whether it is present there.
+func (r *Peer) DigestPath(digest string) ([]*NodeInfo, bool, error) {
+	z, err := DigestZp(digest)
+	if err != nil {
+		return nil, false, errgo.Notef(err, "bad digest %q", digest)
+	}
+	bs := cf.NewZpBitstring(z)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ptree == nil {
+		return nil, false, errgo.Notef(r.degraded, "prefix tree unavailable")
+	}
+	node, err := r.ptree.Root()
+	if err != nil {
+		return nil, false, errgo.Mask(err)
+	}
+	var path []*NodeInfo
+	for {
+		info, err := newNodeInfo(node, false)
+		if err != nil {
+			return nil, false, errgo.Mask(err)
+		}
+		path = append(path, info)
+		if node.IsLeaf() {
+			break
+		}
+		children, err := node.Children()
+		if err != nil {
+			return nil, false, errgo.Mask(err)
+		}
+		var next recon.PrefixNode
+		for _, child := range children {
+			if hasPrefix(bs, child.Key()) {
+				next = child
+				break
+			}
+		}
+		if next == nil {
+			return nil, false, errgo.Newf("no child of %q contains digest %q", info.Prefix, digest)
+		}
+		node = next
+	}
+
+	elements, err := node.Elements()
+	if err != nil {
+		return nil, false, errgo.Mask(err)
+	}
+	for _, element := range elements {
+		if element.Cmp(z) == 0 {
+			return path, true, nil
+		}
+	}
+	return path, false, nil
+}
+
+func hasPrefix(bs, prefix *cf.Bitstring) bool {
+	if prefix.BitLen() > bs.BitLen() {
+		return false
+	}
+	for i := 0; i < prefix.BitLen(); i++ {
+		if bs.Get(i) != prefix.Get(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// DigestPathResponse is the response to a prefix tree digest path request.
+type DigestPathResponse struct {
+	Digest string      `json:"digest"`
+	Found  bool        `json:"found"`
+	Path   []*NodeInfo `json:"path"`
+}
+
+func (r *Peer) serveNode(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	info, err := r.Node(req.URL.Query().Get("prefix"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, info)
+}
+
+func (r *Peer) serveDigestPath(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	digest := strings.ToLower(req.URL.Query().Get("digest"))
+	path, found, err := r.DigestPath(digest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, &DigestPathResponse{Digest: digest, Found: found, Path: path})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(v)
+}
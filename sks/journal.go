@@ -0,0 +1,271 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/hockeypuck/conflux.v2/recon"
+	log "gopkg.in/hockeypuck/logrus.v0"
+)
+
+// JournalFilename returns the path of the digest journal for the prefix tree
+// at path.
+func JournalFilename(path string) string {
+	dir, base := filepath.Dir(path), filepath.Base(path)
+	return filepath.Join(dir, "."+base+".journal")
+}
+
+const (
+	// journalSyncInterval is how often mutations written to the journal
+	// are synced to disk.
+	journalSyncInterval = time.Second
+
+	// journalCheckpointInterval is how often the journal is checkpointed
+	// while recon is running.
+	journalCheckpointInterval = 5 * time.Minute
+)
+
+// PrefixTreeFlusher may be implemented by prefix tree backends which buffer
+// writes, so that the digest journal is only checkpointed once they are
+// durable. Backends which do not implement it are assumed to have written
+// every mutation applied to them, as conflux's leveldb backend does to its
+// own log.
+type PrefixTreeFlusher interface {
+	Flush() error
+}
+
+// journal is a write-ahead log of digest insertions and removals. Each
+// mutation is written to the journal before it is applied to the prefix
+// tree, and synced to disk in batches every journalSyncInterval. The journal
+// is truncated at checkpoints, once the mutations it holds have been applied
+// to the prefix tree and flushed, and once the prefix tree is closed
+// cleanly. After a crash, the mutations in the journal are replayed so that
+// the prefix tree does not drift out of sync with storage.
+type journal struct {
+	f      *os.File
+	sealer *sealer
+	// dirty is set when mutations have been written but not synced.
+	dirty bool
+}
+
+// openJournal opens the journal at path. If sealer is not nil, entries are
+// encrypted.
+func openJournal(path string, sealer *sealer) (*journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &journal{f: f, sealer: sealer}, nil
+}
+
+// journalEntry is a digest mutation. Entries are recorded one per line as
+// "+digest" for insertions and "-digest" for removals.
+type journalEntry struct {
+	Digest string
+	Insert bool
+}
+
+func (e journalEntry) String() string {
+	if e.Insert {
+		return "+" + e.Digest
+	}
+	return "-" + e.Digest
+}
+
+func (j *journal) append(entries ...journalEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	w := bufio.NewWriter(j.f)
+	for _, entry := range entries {
+		if j.sealer == nil {
+			fmt.Fprintln(w, entry)
+			continue
+		}
+		sealed, err := j.sealer.seal([]byte(entry.String()))
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		fmt.Fprintln(w, base64.StdEncoding.EncodeToString(sealed))
+	}
+	j.dirty = true
+	return errgo.Mask(w.Flush())
+}
+
+// sync syncs the mutations written since the last sync to disk.
+func (j *journal) sync() error {
+	if !j.dirty {
+		return nil
+	}
+	err := j.f.Sync()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	j.dirty = false
+	return nil
+}
+
+func (j *journal) entries() ([]journalEntry, error) {
+	_, err := j.f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var result []journalEntry
+	scanner := bufio.NewScanner(j.f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if j.sealer != nil && line != "" {
+			line = j.openEntry(line)
+		}
+		if len(line) < 2 {
+			// Partially written entry at the time of a crash.
+			continue
+		}
+		switch line[0] {
+		case '+':
+			result = append(result, journalEntry{Digest: line[1:], Insert: true})
+		case '-':
+			result = append(result, journalEntry{Digest: line[1:]})
+		default:
+			log.Warningf("ignoring invalid journal entry %q", line)
+		}
+	}
+	return result, errgo.Mask(scanner.Err())
+}
+
+// openEntry decrypts an encrypted journal entry. Entries which cannot be
+// decrypted, such as one partially written at the time of a crash, are
+// returned empty.
+func (j *journal) openEntry(line string) string {
+	sealed, err := base64.StdEncoding.DecodeString(line)
+	if err == nil {
+		var buf []byte
+		buf, err = j.sealer.open(sealed)
+		if err == nil {
+			return string(buf)
+		}
+	}
+	log.Warningf("ignoring journal entry which cannot be decrypted: %v", err)
+	return ""
+}
+
+func (j *journal) truncate() error {
+	err := j.f.Truncate(0)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	_, err = j.f.Seek(0, io.SeekStart)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	j.dirty = true
+	return errgo.Mask(j.sync())
+}
+
+// Close syncs and closes the journal.
+func (j *journal) Close() error {
+	err := j.sync()
+	if err != nil {
+		j.f.Close()
+		return errgo.Mask(err)
+	}
+	return j.f.Close()
+}
+
+// maintainJournal syncs the digest journal every journalSyncInterval, and
+// checkpoints it every journalCheckpointInterval.
+func (r *Peer) maintainJournal() error {
+	ticker := r.clock.NewTicker(journalSyncInterval)
+	defer ticker.Stop()
+	checkpointed := r.clock.Now()
+	for {
+		select {
+		case <-r.t.Dying():
+			return nil
+		case <-ticker.C():
+		}
+		var err error
+		r.mu.Lock()
+		if r.clock.Now().Sub(checkpointed) >= journalCheckpointInterval {
+			err = r.checkpointJournal()
+			checkpointed = r.clock.Now()
+		} else {
+			err = r.journal.sync()
+		}
+		r.mu.Unlock()
+		if err != nil {
+			log.Errorf("digest journal: %v", errgo.Details(err))
+		}
+	}
+}
+
+// checkpointJournal flushes the prefix tree, so that the mutations in the
+// journal, which have all been applied to it, are durable, and truncates the
+// journal. While degraded, the journal holds the queued mutations and is
+// only synced. r.mu must be held.
+func (r *Peer) checkpointJournal() error {
+	if r.peer == nil {
+		return errgo.Mask(r.journal.sync())
+	}
+	if f, ok := r.ptree.(PrefixTreeFlusher); ok {
+		err := f.Flush()
+		if err != nil {
+			return errgo.Notef(err, "cannot flush prefix tree")
+		}
+	}
+	return errgo.Mask(r.journal.truncate())
+}
+
+// replayJournal applies the mutations left in the journal by an unclean
+// shutdown to ptree, then truncates the journal. Mutations which were
+// already applied before the crash fail harmlessly.
+func replayJournal(j *journal, ptree recon.PrefixTree) error {
+	entries, err := j.entries()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if len(entries) > 0 {
+		log.Infof("replaying %d digest journal entries", len(entries))
+	}
+	for _, entry := range entries {
+		z, err := DigestZp(entry.Digest)
+		if err != nil {
+			log.Warningf("bad digest %q in journal: %v", entry.Digest, err)
+			continue
+		}
+		if entry.Insert {
+			err = ptree.Insert(z)
+		} else {
+			err = ptree.Remove(z)
+		}
+		if err != nil {
+			log.Debugf("journal entry %v: %v", entry, err)
+		}
+	}
+	return errgo.Mask(j.truncate())
+}
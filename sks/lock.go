@@ -0,0 +1,64 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/errgo.v1"
+)
+
+// ErrPrefixTreeLocked is the cause of the error returned when opening a
+// prefix tree which is already open in another process.
+var ErrPrefixTreeLocked = errors.New("prefix tree is in use by another process")
+
+// LockFilename returns the path of the advisory lock file for the prefix tree
+// at path.
+func LockFilename(path string) string {
+	dir, base := filepath.Dir(path), filepath.Base(path)
+	return filepath.Join(dir, "."+base+".lock")
+}
+
+// ReadOnly opens the prefix tree for inspection only. A read-only peer
+// shares the prefix tree with other read-only peers, but not with a peer
+// which may modify it. It does not track storage changes, replay the digest
+// journal or take part in recon.
+func ReadOnly() PeerOption {
+	return func(p *Peer) error {
+		p.readOnly = true
+		return nil
+	}
+}
+
+// lockFilename acquires the advisory prefix tree lock fn, shared if readOnly
+// is set and exclusive otherwise. The lock is released by closing the
+// returned file.
+func lockFilename(fn string, readOnly bool) (*os.File, error) {
+	f, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot open prefix tree lock %q", fn)
+	}
+	err = lockFile(f, readOnly)
+	if err != nil {
+		f.Close()
+		return nil, errgo.WithCausef(err, ErrPrefixTreeLocked, "cannot lock prefix tree with %q", fn)
+	}
+	return f, nil
+}
@@ -0,0 +1,32 @@
+//go:build windows || plan9
+// +build windows plan9
+
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"os"
+
+	log "gopkg.in/hockeypuck/logrus.v0"
+)
+
+func lockFile(f *os.File, shared bool) error {
+	log.Warningf("prefix tree locking is not supported on this platform")
+	return nil
+}
@@ -0,0 +1,334 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/hockeypuck/conflux.v2/recon"
+	log "gopkg.in/hockeypuck/logrus.v0"
+)
+
+// PTreeMismatchError indicates that a recon partner's prefix tree parameters
+// differ from ours, which makes reconciliation with it impossible.
+type PTreeMismatchError struct {
+	Partner          string
+	BitQuantum       int
+	MBar             int
+	RemoteBitQuantum int
+	RemoteMBar       int
+}
+
+func (e *PTreeMismatchError) Error() string {
+	return fmt.Sprintf("recon partner %s uses prefix tree parameters bitquantum=%d mbar=%d, "+
+		"but this server uses bitquantum=%d mbar=%d; both servers must be configured "+
+		"with identical prefix tree parameters to reconcile, skipping partner",
+		e.Partner, e.RemoteBitQuantum, e.RemoteMBar, e.BitQuantum, e.MBar)
+}
+
+// CheckPartnerConfig returns a *PTreeMismatchError if the recon
+// configuration advertised by partner is incompatible with settings.
+func CheckPartnerConfig(settings *recon.Settings, partner string, remote *recon.Config) error {
+	if remote == nil {
+		return nil
+	}
+	if remote.BitQuantum != settings.BitQuantum || remote.MBar != settings.MBar {
+		return &PTreeMismatchError{
+			Partner:          partner,
+			BitQuantum:       settings.BitQuantum,
+			MBar:             settings.MBar,
+			RemoteBitQuantum: remote.BitQuantum,
+			RemoteMBar:       remote.MBar,
+		}
+	}
+	return nil
+}
+
+// partnerHost identifies a partner by the host of its remote address, since
+// the port differs between connections.
+func partnerHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// mismatchedPartners records partners skipped because of incompatible
+// prefix tree parameters.
+type mismatchedPartners struct {
+	mu sync.Mutex
+	// partners holds the mismatches found, by host.
+	partners map[string]*PTreeMismatchError
+	// names holds the hosts of the partners left out of gossip, by name.
+	names map[string]string
+}
+
+// update records whether the partners with the given names at host are
+// mismatched, as err, returning whether the partners left out of gossip
+// changed. The error is logged the first time it is seen for each host.
+func (m *mismatchedPartners) update(host string, names []string, err error) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	changed := false
+	if err == nil {
+		delete(m.partners, host)
+		for name, h := range m.names {
+			if h == host {
+				delete(m.names, name)
+				changed = true
+			}
+		}
+		return changed
+	}
+	if _, ok := m.partners[host]; !ok {
+		log.Errorf("%v", err)
+		if m.partners == nil {
+			m.partners = map[string]*PTreeMismatchError{}
+			m.names = map[string]string{}
+		}
+	}
+	m.partners[host] = err.(*PTreeMismatchError)
+	for _, name := range names {
+		if _, ok := m.names[name]; !ok {
+			m.names[name] = host
+			changed = true
+		}
+	}
+	return changed
+}
+
+// excluded returns whether the named partner is left out of gossip.
+func (m *mismatchedPartners) excluded(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.names[name]
+	return ok
+}
+
+// checkPartnerConfig returns a *PTreeMismatchError if the recon
+// configuration sent by the partner at host is incompatible, and leaves the
+// partners at host out of gossip until it is compatible again. If names is
+// nil, the partners at host are looked up.
+func (r *Peer) checkPartnerConfig(host string, names []string, remote *recon.Config) error {
+	r.mu.Lock()
+	settings := r.settings
+	r.mu.Unlock()
+	err := CheckPartnerConfig(settings, host, remote)
+	if names == nil {
+		names = r.partnersAt(host)
+	}
+	if r.mismatched.update(host, names, err) {
+		// The reconciler is replaced in the background, as it may be
+		// waiting for the caller.
+		r.t.Go(func() error {
+			err := r.replaceReconciler()
+			if err != nil {
+				log.Errorf("cannot update recon partners: %v", errgo.Details(err))
+			}
+			return nil
+		})
+	}
+	return err
+}
+
+// partnersAt returns the names of the partners whose recon address is at
+// host.
+func (r *Peer) partnersAt(host string) []string {
+	ip := net.ParseIP(host)
+	var names []string
+	for name, partner := range r.Partners() {
+		partnerHost, _, err := net.SplitHostPort(partner.ReconAddr)
+		if err != nil {
+			continue
+		}
+		if partnerHost == host {
+			names = append(names, name)
+			continue
+		}
+		addrs, err := net.LookupHost(partnerHost)
+		if err != nil {
+			log.Debugf("cannot resolve partner %q: %v", name, err)
+			continue
+		}
+		for _, addr := range addrs {
+			if ip != nil && ip.Equal(net.ParseIP(addr)) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// handshakeConn passes through a recon connection, parsing the first
+// message the partner sends, which is its recon configuration, as conflux
+// reads it. This detects mismatched prefix tree parameters during the
+// handshake, rather than from the failed exchange which follows.
+type handshakeConn struct {
+	net.Conn
+	pw     *io.PipeWriter
+	result chan error
+}
+
+// newHandshakeConn returns conn, calling check with the configuration
+// the partner sends on it.
+func newHandshakeConn(conn net.Conn, check func(*recon.Config) error) *handshakeConn {
+	pr, pw := io.Pipe()
+	hc := &handshakeConn{Conn: conn, pw: pw, result: make(chan error, 1)}
+	go func() {
+		msg, err := recon.ReadMsg(pr)
+		// Stop copying what is read once the configuration is parsed.
+		pr.Close()
+		if config, ok := msg.(*recon.Config); ok && err == nil {
+			hc.result <- check(config)
+			return
+		}
+		hc.result <- nil
+	}()
+	return hc
+}
+
+func (c *handshakeConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		// Fails without blocking once the configuration is parsed.
+		c.pw.Write(p[:n])
+	}
+	if err != nil {
+		c.pw.CloseWithError(err)
+	}
+	return n, err
+}
+
+func (c *handshakeConn) Close() error {
+	c.pw.Close()
+	return c.Conn.Close()
+}
+
+// mismatch closes the connection and returns the error found checking the
+// partner's configuration, if any.
+func (c *handshakeConn) mismatch() error {
+	c.Close()
+	return <-c.result
+}
+
+func (m *mismatchedPartners) list() []*PTreeMismatchError {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var hosts []string
+	for host := range m.partners {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	var result []*PTreeMismatchError
+	for _, host := range hosts {
+		result = append(result, m.partners[host])
+	}
+	return result
+}
+
+// PartnerPaths sets the base path, such as "/hkp", under which partners
+// serve HKP requests, for partners behind path-rewriting reverse proxies.
+// Paths are keyed by the partner's HKP address (host:port) or by host alone.
+func PartnerPaths(paths map[string]string) PeerOption {
+	return func(p *Peer) error {
+		p.partnerPaths = map[string]string{}
+		for k, v := range paths {
+			v = strings.Trim(v, "/")
+			if v != "" {
+				v = "/" + v
+			}
+			p.partnerPaths[k] = v
+		}
+		return nil
+	}
+}
+
+// HTTPSPartners sets the partners, given by HKP address (host:port) or by
+// host alone, which are always contacted over HTTPS, including when probing
+// their capabilities. Other partners are contacted over HTTPS only if they
+// advertise it in their capabilities.
+func HTTPSPartners(partners ...string) PeerOption {
+	return func(p *Peer) error {
+		p.httpsPartners = map[string]bool{}
+		for _, partner := range partners {
+			p.httpsPartners[partner] = true
+		}
+		return nil
+	}
+}
+
+// HTTPClient sets the client used for requests to recon partners, so that
+// TLS, timeouts, proxies and dialers may be configured. The default client
+// times out requests after DefaultRequestTimeout.
+func HTTPClient(client *http.Client) PeerOption {
+	return func(p *Peer) error {
+		if client == nil {
+			return errgo.New("nil HTTP client")
+		}
+		p.client = client
+		return nil
+	}
+}
+
+// DefaultRequestTimeout limits the duration of requests to recon partners
+// made with the default HTTP client.
+const DefaultRequestTimeout = 5 * time.Minute
+
+// partnerScheme returns the URL scheme for requests to the partner with the
+// given HKP address.
+func (r *Peer) partnerScheme(hkpAddr string, hkps bool) string {
+	if hkps || r.httpsPartners[hkpAddr] {
+		return "https"
+	}
+	if host, _, err := net.SplitHostPort(hkpAddr); err == nil && r.httpsPartners[host] {
+		return "https"
+	}
+	return "http"
+}
+
+// hashqueryURL returns the URL for hashquery requests to the partner with the
+// given HKP address, over HTTPS if hkps is set.
+func (r *Peer) hashqueryURL(hkpAddr string, hkps bool) string {
+	return r.partnerURL(r.partnerScheme(hkpAddr, hkps), hkpAddr, "/pks/hashquery")
+}
+
+// partnerURL returns the URL for the given endpoint of the partner with the
+// given HKP address, under its configured base path.
+func (r *Peer) partnerURL(scheme, hkpAddr, endpoint string) string {
+	path, ok := r.partnerPaths[hkpAddr]
+	if !ok {
+		if host, _, err := net.SplitHostPort(hkpAddr); err == nil {
+			path = r.partnerPaths[host]
+		}
+	}
+	return fmt.Sprintf("%s://%s%s%s", scheme, hkpAddr, path, endpoint)
+}
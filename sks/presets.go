@@ -0,0 +1,127 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"sort"
+	"time"
+
+	"gopkg.in/hockeypuck/conflux.v2/recon"
+)
+
+// sksPTreeConfig are the prefix tree parameters used by SKS. All members of
+// a recon network must use identical prefix tree parameters.
+var sksPTreeConfig = recon.PTreeConfig{
+	ThreshMult: 10,
+	BitQuantum: 2,
+	MBar:       5,
+}
+
+// Preset is a named, coherent set of recon and recovery settings for a
+// common kind of deployment.
+type Preset struct {
+	Name string
+
+	PTreeConfig                 recon.PTreeConfig
+	GossipIntervalSecs          int
+	MaxOutstandingReconRequests int
+
+	// RequestChunkSize is the number of keys requested from a partner in
+	// each hashquery.
+	RequestChunkSize int
+	// RequestTimeout limits the duration of each hashquery.
+	RequestTimeout time.Duration
+}
+
+var presets = map[string]*Preset{
+	// A modest server mirroring the public SKS network, gossiping less often
+	// and recovering keys in small batches to limit load.
+	"small-mirror": {
+		Name:                        "small-mirror",
+		PTreeConfig:                 sksPTreeConfig,
+		GossipIntervalSecs:          120,
+		MaxOutstandingReconRequests: 10,
+		RequestChunkSize:            50,
+		RequestTimeout:              2 * time.Minute,
+	},
+
+	// A well-provisioned member of the public SKS pool.
+	"full-pool-member": {
+		Name:                        "full-pool-member",
+		PTreeConfig:                 sksPTreeConfig,
+		GossipIntervalSecs:          60,
+		MaxOutstandingReconRequests: 100,
+		RequestChunkSize:            100,
+		RequestTimeout:              5 * time.Minute,
+	},
+
+	// A closed network of servers on fast, reliable links. The larger mbar
+	// recovers bigger differences per recon round, but is incompatible with
+	// SKS, so every member of the federation must use this preset.
+	"private-federation": {
+		Name: "private-federation",
+		PTreeConfig: recon.PTreeConfig{
+			ThreshMult: 10,
+			BitQuantum: 2,
+			MBar:       8,
+		},
+		GossipIntervalSecs:          30,
+		MaxOutstandingReconRequests: 20,
+		RequestChunkSize:            250,
+		RequestTimeout:              time.Minute,
+	},
+}
+
+// LookupPreset returns the preset with the given name.
+func LookupPreset(name string) (*Preset, bool) {
+	p, ok := presets[name]
+	return p, ok
+}
+
+// PresetNames returns the names of all available presets.
+func PresetNames() []string {
+	var names []string
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Settings returns recon settings configured by the preset. Network
+// addresses and partners must still be configured by the caller.
+func (p *Preset) Settings() *recon.Settings {
+	s := recon.DefaultSettings()
+	s.PTreeConfig = p.PTreeConfig
+	s.GossipIntervalSecs = p.GossipIntervalSecs
+	s.MaxOutstandingReconRequests = p.MaxOutstandingReconRequests
+	return s
+}
+
+// WithPreset configures key recovery as described by the preset. It should
+// be used along with the recon settings returned by p.Settings.
+func WithPreset(p *Preset) PeerOption {
+	return func(peer *Peer) error {
+		peer.chunkSize = p.RequestChunkSize
+		// Keep any transport configured with HTTPClient.
+		client := *peer.client
+		client.Timeout = p.RequestTimeout
+		peer.client = &client
+		return nil
+	}
+}
@@ -0,0 +1,125 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"os"
+	"sort"
+	"sync"
+
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/hockeypuck/conflux.v2/recon"
+	"gopkg.in/hockeypuck/conflux.v2/recon/leveldb"
+	log "gopkg.in/hockeypuck/logrus.v0"
+)
+
+// PrefixTreeFactory opens the prefix tree stored at path, creating it if
+// necessary.
+type PrefixTreeFactory func(path string, s *recon.Settings) (recon.PrefixTree, error)
+
+const (
+	// DefaultPrefixTree is the name of the prefix tree backend used unless
+	// another is selected with the PrefixTreeBackend option.
+	DefaultPrefixTree = "leveldb"
+
+	// MemoryPrefixTree is the name of a prefix tree backend which keeps
+	// the tree in memory, ignoring its path. It is intended for tests.
+	MemoryPrefixTree = "memory"
+)
+
+var (
+	ptreeBackendsMu sync.Mutex
+	ptreeBackends   = map[string]PrefixTreeFactory{}
+)
+
+func init() {
+	RegisterPrefixTree(DefaultPrefixTree, newLevelDBPrefixTree)
+	RegisterPrefixTree(MemoryPrefixTree, newMemPrefixTree)
+}
+
+// RegisterPrefixTree makes a prefix tree backend available by name, such as
+// from the init function of a package implementing one on BoltDB. It panics
+// if f is nil or the name is already registered.
+func RegisterPrefixTree(name string, f PrefixTreeFactory) {
+	ptreeBackendsMu.Lock()
+	defer ptreeBackendsMu.Unlock()
+	if f == nil {
+		panic("sks: RegisterPrefixTree factory is nil")
+	}
+	if _, ok := ptreeBackends[name]; ok {
+		panic("sks: RegisterPrefixTree called twice for " + name)
+	}
+	ptreeBackends[name] = f
+}
+
+// PrefixTreeBackends returns the names of the registered prefix tree
+// backends, in sorted order.
+func PrefixTreeBackends() []string {
+	ptreeBackendsMu.Lock()
+	defer ptreeBackendsMu.Unlock()
+	var names []string
+	for name := range ptreeBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// OpenPrefixTree opens the prefix tree at path with the named backend.
+func OpenPrefixTree(backend, path string, s *recon.Settings) (recon.PrefixTree, error) {
+	ptreeBackendsMu.Lock()
+	f, ok := ptreeBackends[backend]
+	ptreeBackendsMu.Unlock()
+	if !ok {
+		return nil, errgo.Newf("unknown prefix tree backend %q", backend)
+	}
+	return f(path, s)
+}
+
+// PrefixTreeBackend selects the named prefix tree backend, which must be
+// registered. The default is DefaultPrefixTree.
+func PrefixTreeBackend(name string) PeerOption {
+	return func(p *Peer) error {
+		ptreeBackendsMu.Lock()
+		_, ok := ptreeBackends[name]
+		ptreeBackendsMu.Unlock()
+		if !ok {
+			return errgo.Newf("unknown prefix tree backend %q", name)
+		}
+		p.ptreeBackend = name
+		return nil
+	}
+}
+
+func newLevelDBPrefixTree(path string, s *recon.Settings) (recon.PrefixTree, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		log.Debugf("creating prefix tree at: %q", path)
+		err = os.MkdirAll(path, 0755)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	return leveldb.New(s.PTreeConfig, path)
+}
+
+func newMemPrefixTree(path string, s *recon.Settings) (recon.PrefixTree, error) {
+	ptree := new(recon.MemPrefixTree)
+	ptree.Init()
+	return ptree, nil
+}
@@ -0,0 +1,155 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"os"
+
+	"gopkg.in/errgo.v1"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+	log "gopkg.in/hockeypuck/logrus.v0"
+)
+
+// RebuildReport describes a prefix tree rebuilt from storage.
+type RebuildReport struct {
+	// Elements is the number of storage digests in the rebuilt prefix tree.
+	Elements int
+}
+
+// VerifyPrefixTree compares the prefix tree with the digests in storage
+// without changing it, reporting corrupt nodes and the elements which would be
+// removed or inserted to repair it.
+func (r *Peer) VerifyPrefixTree() (*ScrubReport, error) {
+	return r.Scrub(false)
+}
+
+// RebuildPrefixTree replaces the prefix tree with one derived from the digests
+// in storage. This recovers a prefix tree too corrupt to open, which leaves
+// the peer degraded, or beyond what Scrub can repair.
+//
+// The new prefix tree is built alongside the old one and swapped into place
+// once complete, so a failed rebuild leaves the old one intact. Recon must not
+// be running on the prefix tree; a degraded peer starts recon once rebuilt.
+func (r *Peer) RebuildPrefixTree() (*RebuildReport, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.readOnly {
+		return nil, errgo.New("cannot rebuild a read-only prefix tree")
+	}
+	if r.reconciling() && r.peer != nil {
+		return nil, errgo.New("cannot rebuild the prefix tree while recon is running")
+	}
+
+	digests, err := storageDigests(r.storage, r.blocklist)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	tmpPath := r.path + ".rebuild"
+	err = os.RemoveAll(tmpPath)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	err = r.buildPrefixTree(tmpPath, digests)
+	if err != nil {
+		os.RemoveAll(tmpPath)
+		return nil, errgo.Notef(err, "cannot build prefix tree")
+	}
+
+	if r.ptree != nil {
+		err = r.ptree.Close()
+		if err != nil {
+			log.Warningf("error closing prefix tree: %v", errgo.Details(err))
+		}
+		r.ptree, r.peer = nil, nil
+	}
+	// Backends without on-disk state are rebuilt in place once reopened.
+	_, err = os.Stat(tmpPath)
+	inPlace := os.IsNotExist(err)
+	if !inPlace {
+		err = swapDir(tmpPath, r.path)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot replace prefix tree")
+		}
+	}
+
+	// Storage already reflects journaled and queued digest changes.
+	err = r.journal.truncate()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	r.pending = map[string]bool{}
+	err = r.openPrefixTree()
+	if err != nil {
+		r.degraded = err
+		return nil, errgo.Notef(err, "cannot open rebuilt prefix tree")
+	}
+	if inPlace {
+		for _, z := range digests {
+			err = r.ptree.Insert(z)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+		}
+	}
+	log.Infof("rebuilt prefix tree with %d elements", len(digests))
+	r.degraded = nil
+	if r.reconciling() {
+		r.startRecon()
+	}
+	return &RebuildReport{Elements: len(digests)}, nil
+}
+
+// buildPrefixTree creates a prefix tree at path containing digests.
+func (r *Peer) buildPrefixTree(path string, digests map[string]*cf.Zp) error {
+	ptree, err := OpenPrefixTree(r.ptreeBackend, path, r.settings)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	err = ptree.Create()
+	if err != nil {
+		ptree.Close()
+		return errgo.Mask(err)
+	}
+	for _, z := range digests {
+		err = ptree.Insert(z)
+		if err != nil {
+			ptree.Close()
+			return errgo.Mask(err)
+		}
+	}
+	return errgo.Mask(ptree.Close())
+}
+
+// swapDir replaces dst with src, removing the old contents of dst.
+func swapDir(src, dst string) error {
+	old := dst + ".old"
+	err := os.RemoveAll(old)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	err = os.Rename(dst, old)
+	if err != nil && !os.IsNotExist(err) {
+		return errgo.Mask(err)
+	}
+	err = os.Rename(src, dst)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(os.RemoveAll(old))
+}
@@ -18,7 +18,11 @@
 package sks
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -26,6 +30,8 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/errgo.v1"
@@ -33,7 +39,11 @@ import (
 
 	cf "gopkg.in/hockeypuck/conflux.v2"
 	"gopkg.in/hockeypuck/conflux.v2/recon"
-	"gopkg.in/hockeypuck/conflux.v2/recon/leveldb"
+	"gopkg.in/hockeypuck/hkp.v1/clock"
+	"gopkg.in/hockeypuck/hkp.v1/cryptoprovider"
+	"gopkg.in/hockeypuck/hkp.v1/events"
+	"gopkg.in/hockeypuck/hkp.v1/metrics"
+	"gopkg.in/hockeypuck/hkp.v1/notify"
 	"gopkg.in/hockeypuck/hkp.v1/storage"
 	log "gopkg.in/hockeypuck/logrus.v0"
 	"gopkg.in/hockeypuck/openpgp.v1"
@@ -41,99 +51,435 @@ import (
 
 const requestChunkSize = 100
 
-const maxKeyRecoveryAttempts = 10
-
-type keyRecoveryCounter map[string]int
+// degradedRetryInterval is how often opening the prefix tree is retried
+// while the peer is running in degraded mode.
+var degradedRetryInterval = time.Minute
 
 type Peer struct {
-	peer     *recon.Peer
 	storage  storage.Storage
 	settings *recon.Settings
+
+	// mu guards the settings, the prefix tree and recon peer, which are
+	// unavailable while degraded, and the digest changes queued in the
+	// meantime.
+	mu       sync.Mutex
+	peer     Reconciler
 	ptree    recon.PrefixTree
+	degraded error
+	pending  map[string]bool
+	journal  *journal
+	started  bool
+	// reconfigured is closed when the recon peer is replaced, such as
+	// when the partners are changed.
+	reconfigured chan struct{}
+	// scrubChanged records the elements changed while a scrub lists
+	// storage.
+	scrubChanged map[string]bool
+	// scrubMu serializes scrubs.
+	scrubMu sync.Mutex
+
+	lock      *os.File
+	readOnly  bool
+	recovery  *recoveryQueue
+	writes    *writeQueue
+	blocklist *blocklist
+
+	divergences []Divergence
+
+	path         string
+	ptreeBackend string
+	layout       *Layout
+	stats        *Stats
+	clock        clock.Clock
+
+	crypto    cryptoprovider.Provider
+	atRestKey []byte
+	sealer    *sealer
 
-	path  string
-	stats *Stats
+	parseMode     storage.ParseMode
+	limits        *storage.PacketLimits
+	stripUnhashed bool
+	chunkSize     int
+	concurrency   int
+	chunkDelay    time.Duration
+	maxResponse   int64
+	idleTimeout   time.Duration
+	client        *http.Client
+	partnerPaths  map[string]string
+	httpsPartners map[string]bool
+
+	scrubInterval time.Duration
+	drainTimeout  time.Duration
+	digest        notify.Notifier
+	digestEvery   time.Duration
+	anomalies     *anomalyDetector
+	writeGuard    func() error
+	reconcilers   []namedReconciler
+	transport     *reconTransport
+	standby       *standby
+	events        *events.Bus
+
+	mismatched mismatchedPartners
+	caps       capabilityCache
+	retries    recoveryTracker
 
 	t tomb.Tomb
 }
 
-func NewPrefixTree(path string, s *recon.Settings) (recon.PrefixTree, error) {
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		log.Debugf("creating prefix tree at: %q", path)
-		err = os.MkdirAll(path, 0755)
-		if err != nil {
-			return nil, errgo.Mask(err)
+type PeerOption func(*Peer) error
+
+// KeyParseMode sets how recovered keys containing unparseable packets are
+// handled. The default is storage.ParsePermissive.
+func KeyParseMode(m storage.ParseMode) PeerOption {
+	return func(p *Peer) error {
+		p.parseMode = m
+		return nil
+	}
+}
+
+// KeyPacketLimits enforces limits on the packets of recovered keys, to
+// mitigate certificate flooding. Keys exceeding them are refused, or
+// truncated if l.Mode is storage.LimitTruncate. Either way, the partner's
+// digests of such keys are blocked, so that they are not recovered again.
+func KeyPacketLimits(l storage.PacketLimits) PeerOption {
+	return func(p *Peer) error {
+		p.limits = &l
+		return nil
+	}
+}
+
+// StripUnhashedSubpackets strips the unhashed subpackets which do not
+// identify the issuer from the signatures of recovered keys, with
+// storage.StripUnhashed, before they are merged. The partner's digests of
+// keys which are changed are blocked, as with KeyPacketLimits.
+func StripUnhashedSubpackets() PeerOption {
+	return func(p *Peer) error {
+		p.stripUnhashed = true
+		return nil
+	}
+}
+
+// CryptoProvider sets the provider of cryptographic primitives, such as for
+// encryption at rest. The default is cryptoprovider.Default.
+func CryptoProvider(cp cryptoprovider.Provider) PeerOption {
+	return func(p *Peer) error {
+		p.crypto = cp
+		return nil
+	}
+}
+
+// DefaultDrainTimeout is how long Stop waits by default for a recovery in
+// progress to finish.
+const DefaultDrainTimeout = 30 * time.Second
+
+// DrainTimeout sets how long Stop waits for a recovery in progress to finish
+// requesting and merging its keys before cancelling it. Recoveries not yet
+// started are left to the next recon round.
+func DrainTimeout(d time.Duration) PeerOption {
+	return func(p *Peer) error {
+		p.drainTimeout = d
+		return nil
+	}
+}
+
+// RequestChunkSize sets the number of keys requested from a partner in
+// each hashquery. The default is 100. Partners may advertise or enforce a
+// smaller maximum.
+func RequestChunkSize(n int) PeerOption {
+	return func(p *Peer) error {
+		if n < 1 {
+			return errgo.Newf("invalid request chunk size %d", n)
+		}
+		p.chunkSize = n
+		return nil
+	}
+}
+
+// RequestConcurrency sets how many hashqueries may be made to a partner at
+// once while recovering keys. The default is 1, requesting chunks serially.
+// Higher values speed up an initial sync, at the expense of load on the
+// partner.
+func RequestConcurrency(n int) PeerOption {
+	return func(p *Peer) error {
+		if n < 1 {
+			return errgo.Newf("invalid request concurrency %d", n)
 		}
+		p.concurrency = n
+		return nil
 	}
-	return leveldb.New(s.PTreeConfig, path)
 }
 
-func NewPeer(st storage.Storage, path string, s *recon.Settings) (*Peer, error) {
+// RequestDelay sets how long to wait between requesting chunks from a
+// partner, to limit the load of a long recovery on it. The default is not to
+// wait.
+func RequestDelay(d time.Duration) PeerOption {
+	return func(p *Peer) error {
+		p.chunkDelay = d
+		return nil
+	}
+}
+
+// DefaultMaxResponse limits the size of each hashquery response by default.
+const DefaultMaxResponse = 64 << 20
+
+// MaxResponse limits the size of each hashquery response from recon
+// partners to n bytes. Chunks with larger responses are requested again in
+// smaller pieces.
+func MaxResponse(n int64) PeerOption {
+	return func(p *Peer) error {
+		if n <= 0 {
+			return errgo.Newf("invalid maximum response size %d", n)
+		}
+		p.maxResponse = n
+		return nil
+	}
+}
+
+// DefaultIdleTimeout is how long a recon partner may stop sending a
+// hashquery response by default.
+const DefaultIdleTimeout = time.Minute
+
+// IdleTimeout abandons a hashquery if the partner sends nothing for d. It
+// is extended as data arrives, so unlike the HTTP client's timeout it does
+// not limit how long a large response may take to download.
+func IdleTimeout(d time.Duration) PeerOption {
+	return func(p *Peer) error {
+		p.idleTimeout = d
+		return nil
+	}
+}
+
+// Clock sets the clock by which the peer keeps statistics, schedules
+// background jobs, backs off and expires partner capabilities, such as a
+// clock.Fake in tests. It also timestamps the events of the peer's
+// EventBus. Network timeouts are still measured in real time.
+func Clock(c clock.Clock) PeerOption {
+	return func(p *Peer) error {
+		p.clock = c
+		return nil
+	}
+}
+
+// EventBus receives the key changes which update the prefix tree from b,
+// rather than directly from storage, so that they are buffered. Changes are
+// never dropped: key insertion is held up if the prefix tree falls a full
+// buffer behind.
+func EventBus(b *events.Bus) PeerOption {
+	return func(p *Peer) error {
+		p.events = b
+		return nil
+	}
+}
+
+// WriteGuard registers f to be called before recovering keys from recon
+// partners. If it returns an error, such as from diskspace.Monitor.ReadOnly
+// when disk space is low, recovery is skipped. Several write guards may be
+// registered, and recovery is skipped if any returns an error.
+func WriteGuard(f func() error) PeerOption {
+	return func(p *Peer) error {
+		if prev := p.writeGuard; prev != nil {
+			p.writeGuard = func() error {
+				if err := prev(); err != nil {
+					return err
+				}
+				return f()
+			}
+		} else {
+			p.writeGuard = f
+		}
+		return nil
+	}
+}
+
+// NewPrefixTree opens the prefix tree at path with the default backend.
+func NewPrefixTree(path string, s *recon.Settings) (recon.PrefixTree, error) {
+	return OpenPrefixTree(DefaultPrefixTree, path, s)
+}
+
+// NewPeer returns a new recon peer storing its prefix tree at path. If the
+// prefix tree cannot be opened, the peer runs in degraded mode: recon is
+// disabled and digest changes are queued until the prefix tree becomes
+// available again. An error with cause ErrPrefixTreeLocked is returned if
+// another process has the prefix tree open.
+func NewPeer(st storage.Storage, path string, s *recon.Settings, options ...PeerOption) (*Peer, error) {
 	if s == nil {
 		s = recon.DefaultSettings()
 	}
 
-	ptree, err := NewPrefixTree(path, s)
+	sksPeer := &Peer{
+		storage:      st,
+		settings:     s,
+		path:         path,
+		chunkSize:    requestChunkSize,
+		concurrency:  1,
+		client:       &http.Client{Timeout: DefaultRequestTimeout},
+		crypto:       cryptoprovider.Default,
+		ptreeBackend: DefaultPrefixTree,
+		drainTimeout: DefaultDrainTimeout,
+		maxResponse:  DefaultMaxResponse,
+		idleTimeout:  DefaultIdleTimeout,
+		clock:        clock.Real,
+		reconfigured: make(chan struct{}),
+	}
+	var err error
+	for _, option := range options {
+		err = option(sksPeer)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+
+	if sksPeer.atRestKey != nil {
+		sksPeer.sealer, err = newSealer(sksPeer.crypto, sksPeer.atRestKey)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	if sksPeer.layout == nil {
+		sksPeer.layout = LegacyLayout(path)
+	}
+	sksPeer.path = sksPeer.layout.PTree
+	sksPeer.lock, err = lockFilename(sksPeer.layout.Lock, sksPeer.readOnly)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(ErrPrefixTreeLocked))
+	}
+	if sksPeer.readOnly {
+		err = sksPeer.openPrefixTree()
+		if err != nil {
+			sksPeer.lock.Close()
+			return nil, errgo.Mask(err)
+		}
+		sksPeer.readStats()
+		return sksPeer, nil
+	}
+
+	sksPeer.journal, err = openJournal(sksPeer.layout.Journal, sksPeer.sealer)
 	if err != nil {
+		sksPeer.lock.Close()
 		return nil, errgo.Mask(err)
 	}
-	err = ptree.Create()
+	sksPeer.recovery, err = openRecoveryQueue(sksPeer.layout.Recovery, sksPeer.sealer)
 	if err != nil {
+		log.Warningf("%v, discarding it", err)
+		sksPeer.recovery = &recoveryQueue{
+			path:    sksPeer.layout.Recovery,
+			sealer:  sksPeer.sealer,
+			pending: map[string][]string{},
+		}
+	}
+	// Unlike the recovery queue, the blocklist cannot be discarded, or
+	// deleted keys would be recovered again.
+	sksPeer.blocklist, err = openBlocklist(sksPeer.layout.Blocklist, sksPeer.sealer)
+	if err != nil {
+		sksPeer.lock.Close()
 		return nil, errgo.Mask(err)
 	}
-
-	peer := recon.NewPeer(s, ptree)
-	sksPeer := &Peer{
-		ptree:    ptree,
-		storage:  st,
-		settings: s,
-		peer:     peer,
-		path:     path,
+	err = sksPeer.openPrefixTree()
+	if err != nil {
+		log.Errorf("prefix tree unavailable, running degraded: %v", errgo.Details(err))
+		sksPeer.degraded = err
+		sksPeer.pending = map[string]bool{}
 	}
 	sksPeer.readStats()
-	st.Subscribe(sksPeer.updateDigests)
+	sksPeer.caps.clock = sksPeer.clock
+	if sksPeer.events != nil {
+		sksPeer.events.SetClock(sksPeer.clock)
+		sksPeer.events.Subscribe("recon", events.KeyChangeFunc(sksPeer.updateDigests),
+			events.OnOverflow(events.Block))
+	} else {
+		st.Subscribe(sksPeer.updateDigests)
+	}
 	return sksPeer, nil
 }
 
+func (p *Peer) openPrefixTree() error {
+	if p.readOnly {
+		// Do not create a missing prefix tree.
+		if _, err := os.Stat(p.path); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	ptree, err := OpenPrefixTree(p.ptreeBackend, p.path, p.settings)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	err = ptree.Create()
+	if err != nil {
+		ptree.Close()
+		return errgo.Mask(err)
+	}
+	p.ptree = ptree
+	if p.readOnly {
+		return nil
+	}
+	err = replayJournal(p.journal, ptree)
+	if err != nil {
+		ptree.Close()
+		p.ptree = nil
+		return errgo.Mask(err)
+	}
+	p.peer, err = p.newReconciler(ptree)
+	if err != nil {
+		ptree.Close()
+		p.ptree = nil
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
 func StatsFilename(path string) string {
 	dir, base := filepath.Dir(path), filepath.Base(path)
 	return filepath.Join(dir, "."+base+".stats")
 }
 
 func (p *Peer) readStats() {
-	fn := StatsFilename(p.path)
+	fn := p.layout.Stats
 	stats := NewStats()
-	err := stats.ReadFile(fn)
+	var err error
+	if p.sealer != nil {
+		err = p.sealer.readJSON(fn, stats)
+	} else {
+		err = stats.ReadFile(fn)
+	}
 	if err != nil {
 		log.Warningf("cannot open stats %q: %v", fn, err)
 		stats = NewStats()
 	}
+	stats.clock = p.clock
 
-	root, err := p.ptree.Root()
-	if err != nil {
-		log.Warningf("error accessing prefix tree root: %v", err)
-	} else {
-		stats.Total = root.Size()
+	if p.ptree != nil {
+		root, err := p.ptree.Root()
+		if err != nil {
+			log.Warningf("error accessing prefix tree root: %v", err)
+		} else {
+			stats.Total = root.Size()
+		}
 	}
 
 	p.stats = stats
 }
 
 func (p *Peer) writeStats() {
-	fn := StatsFilename(p.path)
-	err := p.stats.WriteFile(fn)
+	fn := p.layout.Stats
+	var err error
+	if p.sealer != nil {
+		err = p.sealer.writeJSON(fn, p.stats)
+	} else {
+		err = p.stats.WriteFile(fn)
+	}
 	if err != nil {
 		log.Warningf("cannot write stats %q: %v", fn, err)
 	}
 }
 
 func (p *Peer) pruneStats() error {
-	timer := time.NewTimer(time.Hour)
+	timer := p.clock.NewTimer(time.Hour)
+	defer timer.Stop()
 	for {
 		select {
 		case <-p.t.Dying():
 			return nil
-		case <-timer.C:
+		case <-timer.C():
 			p.stats.prune()
 			timer.Reset(time.Hour)
 		}
@@ -141,34 +487,179 @@ func (p *Peer) pruneStats() error {
 }
 
 func (r *Peer) Stats() *Stats {
-	return r.stats.clone()
+	stats := r.stats.clone()
+	r.mu.Lock()
+	if r.degraded != nil {
+		stats.Degraded = r.degraded.Error()
+	}
+	stats.PendingDigests = len(r.pending)
+	r.mu.Unlock()
+	if r.writes != nil {
+		stats.QueuedKeys = r.writes.queued()
+	}
+	if retrying := r.retries.retrying(); len(retrying) > 0 {
+		stats.RetryingDigests = retrying
+	}
+	return stats
+}
+
+// Degraded returns why the prefix tree is unavailable, or nil if recon is
+// operating normally.
+func (r *Peer) Degraded() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.degraded
+}
+
+// UpdatePackets records packets accepted and dropped while storing keys
+// received outside of recon, such as through /pks/add.
+func (r *Peer) UpdatePackets(pc storage.PacketCounts) {
+	r.stats.UpdatePackets(pc)
+}
+
+// UpdateRejected records a key rejected outside of recon, such as a
+// submission to /pks/add refused by policy.
+func (r *Peer) UpdateRejected() {
+	r.stats.UpdateRejected()
+}
+
+// UpdateSource attributes a key change made outside of recon to its source,
+// such as SourceAdd or SourceLoad.
+func (r *Peer) UpdateSource(source string, change storage.KeyChange) {
+	r.stats.UpdateSource(source, change)
+}
+
+// MismatchedPartners returns the recon partners currently being skipped
+// because their prefix tree parameters differ from ours.
+func (r *Peer) MismatchedPartners() []*PTreeMismatchError {
+	return r.mismatched.list()
 }
 
 func (r *Peer) Start() {
-	r.t.Go(r.handleRecovery)
+	if r.readOnly {
+		log.Warning("recon is disabled for a read-only prefix tree")
+		return
+	}
 	r.t.Go(r.pruneStats)
+	r.t.Go(r.maintainJournal)
+	if r.writes != nil {
+		r.writes.start(r)
+	}
+	if r.digest != nil {
+		r.t.Go(r.sendDigests)
+	}
+	if r.anomalies != nil {
+		r.t.Go(r.detectAnomalies)
+	}
+	if r.transport != nil {
+		r.startTransport()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.started = true
+	if r.standby != nil {
+		r.t.Go(r.coordinate)
+	}
+	if r.peer == nil {
+		r.t.Go(r.retryPrefixTree)
+		return
+	}
+	if r.reconciling() {
+		r.startRecon()
+	}
+}
+
+func (r *Peer) startRecon() {
+	r.t.Go(r.handleRecovery)
+	if r.scrubInterval > 0 {
+		r.t.Go(r.scrubPrefixTree)
+	}
 	r.peer.Start()
 }
 
+// retryPrefixTree periodically tries to open the prefix tree while degraded.
+// Once it succeeds, queued digest changes are applied and recon is started,
+// unless the peer is a standby.
+func (r *Peer) retryPrefixTree() error {
+	timer := r.clock.NewTimer(degradedRetryInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-r.t.Dying():
+			return nil
+		case <-timer.C():
+		}
+
+		r.mu.Lock()
+		if r.peer != nil {
+			// The prefix tree was rebuilt, which started recon.
+			r.mu.Unlock()
+			return nil
+		}
+		err := r.openPrefixTree()
+		if err != nil {
+			r.degraded = err
+			r.mu.Unlock()
+			log.Warningf("prefix tree still unavailable: %v", err)
+			timer.Reset(degradedRetryInterval)
+			continue
+		}
+		// Queued changes were journaled, and have been replayed into the
+		// prefix tree when it was opened.
+		log.Infof("prefix tree available, applied %d queued digest changes", len(r.pending))
+		r.degraded = nil
+		r.pending = nil
+		if r.reconciling() {
+			r.startRecon()
+		}
+		r.mu.Unlock()
+		return nil
+	}
+}
+
+// Stop stops recon. A recovery in progress is allowed to finish, within the
+// drain timeout, before the prefix tree is closed.
 func (r *Peer) Stop() {
-	log.Info("recon processing: stopping")
+	defer r.lock.Close()
+	if r.readOnly {
+		err := r.ptree.Close()
+		if err != nil {
+			log.Errorf("error closing prefix tree: %v", errgo.Details(err))
+		}
+		return
+	}
+
+	log.Info("recon processing: draining")
 	r.t.Kill(nil)
 	err := r.t.Wait()
 	if err != nil {
 		log.Error(errgo.Details(err))
 	}
+	if r.writes != nil && r.writes.ctx != nil {
+		r.writes.flush(r.drainTimeout)
+	}
 	log.Info("recon processing: stopped")
 
-	log.Info("recon peer: stopping")
-	err = errgo.Mask(r.peer.Stop())
-	if err != nil {
-		log.Error(errgo.Details(err))
-	}
-	log.Info("recon peer: stopped")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.peer != nil {
+		log.Info("recon peer: stopping")
+		err = errgo.Mask(r.peer.Stop())
+		if err != nil {
+			log.Error(errgo.Details(err))
+		}
+		log.Info("recon peer: stopped")
 
-	err = r.ptree.Close()
+		err = r.ptree.Close()
+		if err != nil {
+			log.Errorf("error closing prefix tree: %v", errgo.Details(err))
+		} else if err = r.journal.truncate(); err != nil {
+			log.Errorf("error truncating digest journal: %v", errgo.Details(err))
+		}
+	}
+	err = r.journal.Close()
 	if err != nil {
-		log.Errorf("error closing prefix tree: %v", errgo.Details(err))
+		log.Errorf("error closing digest journal: %v", errgo.Details(err))
 	}
 
 	r.writeStats()
@@ -185,147 +676,604 @@ func DigestZp(digest string) (*cf.Zp, error) {
 
 func (r *Peer) updateDigests(change storage.KeyChange) error {
 	r.stats.Update(change)
+	return r.applyChange(change)
+}
+
+// applyChange journals the digests inserted and removed by change and
+// applies them to the prefix tree. Blocked digests are removed rather than
+// inserted.
+func (r *Peer) applyChange(change storage.KeyChange) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var entries []journalEntry
 	for _, digest := range change.InsertDigests() {
-		digestZp, err := DigestZp(digest)
-		if err != nil {
-			return errgo.Notef(err, "bad digest %q", digest)
-		}
-		r.peer.Insert(digestZp)
+		entries = append(entries, journalEntry{Digest: digest, Insert: !r.blocklist.has(digest)})
 	}
 	for _, digest := range change.RemoveDigests() {
-		digestZp, err := DigestZp(digest)
+		entries = append(entries, journalEntry{Digest: digest})
+	}
+	err := r.journal.append(entries...)
+	if err != nil {
+		return errgo.Notef(err, "cannot journal digest changes")
+	}
+
+	if r.scrubChanged != nil {
+		for _, entry := range entries {
+			if z, err := DigestZp(entry.Digest); err == nil {
+				r.scrubChanged[z.String()] = true
+			}
+		}
+	}
+	if r.peer == nil {
+		// Degraded, queue changes until the prefix tree is available. Later
+		// changes to the same digest supersede earlier ones.
+		for _, entry := range entries {
+			r.pending[entry.Digest] = entry.Insert
+		}
+		return nil
+	}
+	for _, entry := range entries {
+		err := r.applyDigest(entry.Digest, entry.Insert)
 		if err != nil {
-			return errgo.Notef(err, "bad digest %q", digest)
+			return errgo.Mask(err)
 		}
+	}
+	return nil
+}
+
+func (r *Peer) applyDigest(digest string, insert bool) error {
+	digestZp, err := DigestZp(digest)
+	if err != nil {
+		return errgo.Notef(err, "bad digest %q", digest)
+	}
+	if insert {
+		r.peer.Insert(digestZp)
+	} else {
 		r.peer.Remove(digestZp)
 	}
 	return nil
 }
 
 func (r *Peer) handleRecovery() error {
+	// When stopped, the recovery in progress is given drainTimeout to
+	// finish before its requests and upserts are cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-r.t.Dying():
+		case <-ctx.Done():
+			return
+		}
+		timer := time.NewTimer(r.drainTimeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			log.Warningf("recovery did not drain within %v, abandoning it", r.drainTimeout)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if r.writeGuard == nil || r.writeGuard() == nil {
+		err := r.resumeRecovery(ctx)
+		if errgo.Cause(err) == context.Canceled {
+			return nil
+		}
+	}
 	for {
+		// Accept no more recoveries once stopping, even if some are ready.
 		select {
 		case <-r.t.Dying():
 			return nil
-		case rcvr := <-r.peer.RecoverChan:
-			r.requestRecovered(rcvr)
+		default:
+		}
+		r.mu.Lock()
+		var recovered <-chan *recon.Recover
+		if r.peer != nil {
+			recovered = r.peer.Recovered()
+		}
+		reconfigured := r.reconfigured
+		r.mu.Unlock()
+		select {
+		case <-r.t.Dying():
+			return nil
+		case <-reconfigured:
+		case rcvr := <-recovered:
+			start := time.Now()
+			if r.checkPartnerConfig(partnerHost(rcvr.RemoteAddr), nil, rcvr.RemoteConfig) != nil {
+				metrics.ReconRound(metrics.ResultSkipped, start)
+				continue
+			}
+			if r.writeGuard != nil {
+				if err := r.writeGuard(); err != nil {
+					log.Warningf("skipping recovery from %v: %v", rcvr.RemoteAddr, err)
+					metrics.ReconRound(metrics.ResultSkipped, start)
+					continue
+				}
+			}
+			err := r.requestRecovered(ctx, rcvr)
+			if errgo.Cause(err) == context.Canceled {
+				return nil
+			} else if err != nil {
+				log.Errorf("recovery from %v failed: %v", rcvr.RemoteAddr, err)
+				r.stats.UpdateRecoveryErrors()
+				metrics.ReconRound(metrics.ResultError, start)
+			} else {
+				metrics.ReconRound(metrics.ResultOK, start)
+			}
 		}
 	}
 }
 
-func (r *Peer) requestRecovered(rcvr *recon.Recover) error {
-	items := rcvr.RemoteElements
+func (r *Peer) queueRecovery(remoteAddr string, items []*cf.Zp) {
+	err := r.recovery.set(remoteAddr, items)
+	if err != nil {
+		log.Warningf("cannot update recovery queue: %v", err)
+	}
+}
+
+// errChunkTooLarge is returned when a partner rejects a hashquery request as
+// too large.
+var errChunkTooLarge = errgo.New("hashquery request too large")
+
+func (r *Peer) requestRecovered(ctx context.Context, rcvr *recon.Recover) error {
+	remoteAddr, err := rcvr.HkpAddr()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	// Skip digests which recently failed to recover from this partner.
+	items := r.retries.due(remoteAddr, rcvr.RemoteElements, r.clock.Now())
+	err = r.recoverItems(ctx, remoteAddr, items)
+	if err == nil {
+		r.stats.UpdatePeerRecon(remoteAddr)
+	} else if errgo.Cause(err) != context.Canceled {
+		r.stats.UpdatePeerFailure(remoteAddr)
+	}
+	return errgo.Mask(err, errgo.Any)
+}
+
+// recoverItems requests the keys with the digests in items from the partner
+// at remoteAddr in chunks, several at a time if so configured. The digests
+// not yet requested are kept in the recovery queue, so that they are resumed
+// if the peer stops first.
+func (r *Peer) recoverItems(ctx context.Context, remoteAddr string, items []*cf.Zp) error {
+	caps := r.capabilities(remoteAddr)
+	items = r.blocklist.filterItems(items)
+	r.queueRecovery(remoteAddr, items)
 	var resultErr error
 	for len(items) > 0 {
+		if err := ctx.Err(); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
 		// Chunk requests to keep the hashquery message size and peer load reasonable.
-		chunksize := requestChunkSize
-		if chunksize > len(items) {
-			chunksize = len(items)
+		chunksize := r.chunkSize
+		if caps.MaxChunkSize > 0 && chunksize > caps.MaxChunkSize {
+			chunksize = caps.MaxChunkSize
+		}
+		var chunks [][]*cf.Zp
+		rest := items
+		for len(chunks) < r.concurrency && len(rest) > 0 {
+			n := chunksize
+			if n > len(rest) {
+				n = len(rest)
+			}
+			chunks = append(chunks, rest[:n])
+			rest = rest[n:]
 		}
-		chunk := items[:chunksize]
-		items = items[chunksize:]
 
-		err := r.requestChunk(rcvr, chunk)
-		if err != nil {
-			if resultErr == nil {
-				resultErr = errgo.Mask(err)
-			} else {
-				resultErr = errgo.Notef(resultErr, "%s", errgo.Details(err))
+		results := make([]chunkResult, len(chunks))
+		var wg sync.WaitGroup
+		for i := range chunks {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i].received, results[i].err = r.requestChunk(ctx, remoteAddr, caps, chunks[i])
+			}(i)
+		}
+		wg.Wait()
+		if ctx.Err() != nil {
+			return errgo.Mask(ctx.Err(), errgo.Any)
+		}
+
+		// Chunks the partner found too large are retried in smaller
+		// pieces, before the digests not yet requested.
+		var retry []*cf.Zp
+		for i, chunk := range chunks {
+			err := results[i].err
+			if errgo.Cause(err) == errChunkTooLarge && len(chunk) > 1 {
+				retry = append(retry, chunk...)
+				continue
+			}
+			r.trackRecovery(remoteAddr, chunk, results[i].received)
+			if err != nil {
+				if resultErr == nil {
+					resultErr = errgo.Mask(err)
+				} else {
+					resultErr = errgo.Notef(resultErr, "%s", errgo.Details(err))
+				}
+			}
+		}
+		if len(retry) > 0 {
+			caps = r.limitChunkSize(remoteAddr, chunksize)
+		}
+		items = append(retry, rest...)
+		r.queueRecovery(remoteAddr, items)
+
+		if r.chunkDelay > 0 && len(items) > 0 {
+			select {
+			case <-ctx.Done():
+				return errgo.Mask(ctx.Err(), errgo.Any)
+			case <-r.clock.After(r.chunkDelay):
 			}
 		}
 	}
 	return resultErr
 }
 
-func (r *Peer) requestChunk(rcvr *recon.Recover, chunk []*cf.Zp) error {
-	var remoteAddr string
-	remoteAddr, err := rcvr.HkpAddr()
-	if err != nil {
-		return errgo.Mask(err)
-	}
+// chunkResult is the outcome of requesting a chunk of digests.
+type chunkResult struct {
+	received map[string]bool
+	err      error
+}
+
+// requestChunk requests the keys with the digests in chunk from the partner
+// at remoteAddr, merges them into storage, and returns the digests received.
+func (r *Peer) requestChunk(ctx context.Context, remoteAddr string, caps Capabilities, chunk []*cf.Zp) (map[string]bool, error) {
 	// Make an sks hashquery request
 	hqBuf := bytes.NewBuffer(nil)
-	err = recon.WriteInt(hqBuf, len(chunk))
+	err := recon.WriteInt(hqBuf, len(chunk))
 	if err != nil {
-		return errgo.Mask(err)
+		return nil, errgo.Mask(err)
 	}
+	requested := map[string]bool{}
 	for _, z := range chunk {
-		zb := z.Bytes()
-		zb = recon.PadSksElement(zb)
-		// Hashquery elements are 16 bytes (length_of(P_SKS)-1)
-		zb = zb[:len(zb)-1]
+		zb := hashqueryElement(z)
+		requested[hex.EncodeToString(zb)] = true
 		err = recon.WriteInt(hqBuf, len(zb))
 		if err != nil {
-			return errgo.Mask(err)
+			return nil, errgo.Mask(err)
 		}
 		_, err = hqBuf.Write(zb)
 		if err != nil {
-			return errgo.Mask(err)
+			return nil, errgo.Mask(err)
 		}
 	}
 
-	url := fmt.Sprintf("http://%s/pks/hashquery", remoteAddr)
-	resp, err := http.Post(url, "sks/hashquery", bytes.NewReader(hqBuf.Bytes()))
+	req, err := r.newHashqueryRequest(remoteAddr, caps, hqBuf.Bytes())
 	if err != nil {
-		return errgo.Mask(err)
+		return nil, errgo.Mask(err)
 	}
-
-	// Store response in memory. Connection may timeout if we
-	// read directly from it while loading.
-	var body *bytes.Buffer
-	bodyBuf, err := ioutil.ReadAll(resp.Body)
+	start := time.Now()
+	// Abandon the request if the partner stops sending for longer than the
+	// idle timeout, without limiting how long a large response may take.
+	reqCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	idle := time.AfterFunc(r.idleTimeout, cancel)
+	defer idle.Stop()
+	readErr := func(err error) error {
+		if ctx.Err() != nil {
+			return errgo.Mask(ctx.Err(), errgo.Any)
+		} else if reqCtx.Err() != nil {
+			return errgo.Newf("hashquery to %q idle for more than %v", remoteAddr, r.idleTimeout)
+		}
+		return errgo.Mask(err, errgo.Any)
+	}
+	resp, err := r.client.Do(req.WithContext(reqCtx))
 	if err != nil {
-		return errgo.Mask(err)
+		return nil, readErr(err)
 	}
-	body = bytes.NewBuffer(bodyBuf)
-	resp.Body.Close()
 
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusRequestEntityTooLarge {
+		return nil, errgo.WithCausef(nil, errChunkTooLarge, "error response from %q", remoteAddr)
+	}
 	if resp.StatusCode != http.StatusOK {
-		return errgo.Newf("error response from %q: %v", remoteAddr, string(bodyBuf))
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, errgo.Newf("error response from %q: %v", remoteAddr, string(msg))
 	}
 
+	// Parse the response as it arrives, rather than buffering it whole.
+	// Keys are merged into storage, or queued for merging, once the
+	// response has been read, so that slow writes cannot stall the
+	// connection.
+	body := bufio.NewReader(&limitedBody{
+		r:         &idleBody{r: resp.Body, timer: idle, timeout: r.idleTimeout},
+		remaining: r.maxResponse,
+		max:       r.maxResponse,
+	})
+
 	var nkeys, keyLen int
 	nkeys, err = recon.ReadInt(body)
 	if err != nil {
-		return errgo.Mask(err)
+		return nil, readErr(err)
 	}
 	log.Debugf("hashquery response from %q: %d keys found", remoteAddr, nkeys)
+	metrics.Hashquery(metrics.RoleClient, start, nkeys)
+	r.stats.UpdatePeerHashquery(remoteAddr, time.Since(start))
+	var keys []*openpgp.PrimaryKey
+	received := map[string]bool{}
 	for i := 0; i < nkeys; i++ {
 		keyLen, err = recon.ReadInt(body)
 		if err != nil {
-			return errgo.Mask(err)
+			return nil, readErr(err)
 		}
 		keyBuf := bytes.NewBuffer(nil)
 		_, err = io.CopyN(keyBuf, body, int64(keyLen))
 		if err != nil {
-			return errgo.Mask(err)
+			return nil, readErr(err)
 		}
 		log.Debugf("key# %d: %d bytes", i+1, keyLen)
-		// Merge locally
-		err = r.upsertKeys(keyBuf.Bytes())
+		recovered, digests, err := r.readRecovered(remoteAddr, requested, keyBuf.Bytes())
 		if err != nil {
-			log.Errorf("cannot upsert: %v", err)
+			log.Errorf("cannot merge key from %q: %v", remoteAddr, err)
+			continue
+		}
+		keys = append(keys, recovered...)
+		for _, digest := range digests {
+			received[digest] = true
 		}
 	}
 	// Read last two bytes (CRLF, why?), or SKS will complain.
 	body.Read(make([]byte, 2))
-	return nil
+
+	// Merge locally, in a single transaction if storage supports it.
+	if r.writes != nil {
+		err = r.writes.enqueue(ctx, remoteAddr, keys)
+	} else {
+		err = r.upsertKeys(ctx, remoteAddr, keys)
+	}
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return received, nil
+}
+
+// hashqueryElement returns the hashquery encoding of a digest, 16 bytes
+// (length_of(P_SKS)-1).
+func hashqueryElement(z *cf.Zp) []byte {
+	zb := recon.PadSksElement(z.Bytes())
+	return zb[:len(zb)-1]
+}
+
+// newHashqueryRequest returns a hashquery request for the partner at
+// remoteAddr, adapted to its capabilities.
+func (r *Peer) newHashqueryRequest(remoteAddr string, caps Capabilities, body []byte) (*http.Request, error) {
+	if caps.Compression {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, err := gz.Write(body)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		err = gz.Close()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		body = buf.Bytes()
+	}
+	req, err := http.NewRequest("POST", r.hashqueryURL(remoteAddr, caps.HKPS), bytes.NewReader(body))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	req.Header.Set("Content-Type", "sks/hashquery")
+	if caps.Compression {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	return req, nil
+}
+
+// DigestMismatchError is returned when a partner responds to a hashquery
+// with a key whose digest was not requested, indicating that it is serving
+// mismatched or tampered data.
+type DigestMismatchError struct {
+	Remote      string
+	Fingerprint string
+	Digest      string
+}
+
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf("key %s from %q has digest %s, which was not requested",
+		e.Fingerprint, e.Remote, e.Digest)
+}
+
+// limitedBody reads from r, failing with errChunkTooLarge once more than max
+// bytes have been read, so that the chunk is requested again in smaller
+// pieces.
+type limitedBody struct {
+	r         io.Reader
+	remaining int64
+	max       int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.r.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n, errgo.WithCausef(nil, errChunkTooLarge, "hashquery response exceeds %d bytes", b.max)
+	}
+	return n, err
 }
 
-func (r *Peer) upsertKeys(buf []byte) error {
+// idleBody reads from r, extending the idle timer whenever data arrives.
+type idleBody struct {
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.timeout)
+	}
+	return n, err
+}
+
+// readRecovered parses keys received from remoteAddr in response to a
+// hashquery for the requested digests. Keys whose digest does not match any
+// requested are rejected.
+func (r *Peer) readRecovered(remoteAddr string, requested map[string]bool, buf []byte) ([]*openpgp.PrimaryKey, []string, error) {
+	var result []*openpgp.PrimaryKey
+	var digests []string
 	for readKey := range openpgp.ReadKeys(bytes.NewBuffer(buf)) {
 		if readKey.Error != nil {
-			return errgo.Mask(readKey.Error)
+			return nil, nil, errgo.Mask(readKey.Error)
+		}
+		err := r.parseMode.Check(readKey.PrimaryKey)
+		if err != nil {
+			r.stats.UpdateRejected()
+			return nil, nil, errgo.Mask(err)
 		}
 		// TODO: collect duplicates to replicate SKS hashes?
-		err := openpgp.DropDuplicates(readKey.PrimaryKey)
+		pc, err := storage.DropDuplicates(readKey.PrimaryKey)
 		if err != nil {
-			return errgo.Mask(err)
+			return nil, nil, errgo.Mask(err)
 		}
-		_, err = storage.UpsertKey(r.storage, readKey.PrimaryKey)
+		digest := strings.ToLower(openpgp.SksDigest(readKey.PrimaryKey, md5.New()))
+		if !requested[digest] {
+			r.stats.UpdateMismatched()
+			return nil, nil, errgo.WithCausef(nil, &DigestMismatchError{
+				Remote:      remoteAddr,
+				Fingerprint: readKey.PrimaryKey.Fingerprint(),
+				Digest:      digest,
+			}, "rejected key")
+		}
+		r.stats.UpdatePackets(pc)
+		result = append(result, readKey.PrimaryKey)
+		digests = append(digests, digest)
+	}
+	return result, digests, nil
+}
+
+// sanitizeKeys strips unhashed subpackets from and enforces the packet
+// limits on keys recovered from remoteAddr, returning those which may be
+// stored.
+func (r *Peer) sanitizeKeys(remoteAddr string, keys []*openpgp.PrimaryKey) []*openpgp.PrimaryKey {
+	if r.limits == nil && !r.stripUnhashed {
+		return keys
+	}
+	var result []*openpgp.PrimaryKey
+	var flooded []string
+	for _, key := range keys {
+		digest := strings.ToLower(openpgp.SksDigest(key, md5.New()))
+		var changed bool
+		if r.stripUnhashed {
+			n, err := storage.StripUnhashed(key)
+			if err != nil {
+				log.Warningf("refusing key from %q: %v", remoteAddr, err)
+				r.stats.UpdateRejected()
+				flooded = append(flooded, digest)
+				continue
+			}
+			if n > 0 {
+				metrics.UnhashedStripped(SourceRecon, n)
+				changed = true
+			}
+		}
+		if r.limits != nil {
+			pc, err := r.limits.Enforce(key)
+			if err != nil {
+				log.Warningf("refusing key from %q: %v", remoteAddr, err)
+				r.stats.UpdateRejected()
+				flooded = append(flooded, digest)
+				continue
+			}
+			if pc.Dropped > 0 {
+				log.Infof("truncated key %s from %q, dropping %d packets", key.Fingerprint(), remoteAddr, pc.Dropped)
+				changed = true
+			}
+		}
+		if changed {
+			flooded = append(flooded, digest)
+		}
+		result = append(result, key)
+	}
+	r.blockFlooded(flooded)
+	return result
+}
+
+// blockFlooded blocks the digests of flooded keys, so that they are not
+// recovered again.
+func (r *Peer) blockFlooded(digests []string) {
+	if len(digests) > 0 && r.blocklist != nil {
+		_, err := r.blocklist.add(digests...)
 		if err != nil {
-			return errgo.Mask(err)
+			log.Warningf("cannot block digests of flooded keys: %v", err)
+		}
+	}
+}
+
+// mergeKeys merges keys recovered from remoteAddr into storage, returning
+// those stored along with the change made to each. Packet limits are
+// enforced again on each key as merged with the key stored, since otherwise
+// a key could grow beyond them through many recoveries each within them.
+// Backends merge batches of keys within their own transactions, where the
+// limits cannot be enforced, so keys are then upserted one at a time, and
+// those refused are skipped.
+func (r *Peer) mergeKeys(ctx context.Context, remoteAddr string,
+	keys []*openpgp.PrimaryKey) ([]*openpgp.PrimaryKey, []storage.KeyChange, error) {
+	if r.limits == nil {
+		changes, err := storage.UpsertKeysContext(ctx, r.storage, keys)
+		return keys, changes, err
+	}
+	var stored []*openpgp.PrimaryKey
+	var changes []storage.KeyChange
+	var flooded []string
+	defer func() { r.blockFlooded(flooded) }()
+	for _, key := range keys {
+		var dropped int
+		check := func(merged *openpgp.PrimaryKey) error {
+			pc, err := r.limits.Enforce(merged)
+			dropped = pc.Dropped
+			return err
+		}
+		change, err := storage.UpsertKeyChecked(ctx, r.storage, key, check)
+		if errgo.Cause(err) == storage.ErrLimitExceeded {
+			log.Warningf("refusing key from %q: %v", remoteAddr, err)
+			r.stats.UpdateRejected()
+			flooded = append(flooded, strings.ToLower(key.MD5))
+			continue
+		} else if err != nil {
+			return stored, changes, errgo.Mask(err, errgo.Any)
+		}
+		if dropped > 0 {
+			log.Infof("truncated merged key %s from %q, dropping %d packets",
+				key.Fingerprint(), remoteAddr, dropped)
+			flooded = append(flooded, strings.ToLower(key.MD5))
+		}
+		stored = append(stored, key)
+		changes = append(changes, change)
+	}
+	return stored, changes, nil
+}
+
+// upsertKeys merges keys recovered from remoteAddr into storage, and
+// verifies the digests they are stored with.
+func (r *Peer) upsertKeys(ctx context.Context, remoteAddr string, keys []*openpgp.PrimaryKey) error {
+	keys = r.blocklist.filterKeys(keys)
+	keys = r.sanitizeKeys(remoteAddr, keys)
+	if len(keys) == 0 {
+		return nil
+	}
+	stored, changes, err := r.mergeKeys(ctx, remoteAddr, keys)
+	for _, change := range changes {
+		r.stats.UpdateSource(ReconSource(remoteAddr), change)
+		r.stats.UpdatePeerRecovered(remoteAddr, change)
+		metrics.KeyChanged(SourceRecon, change)
+	}
+	r.verifyDigests(ctx, remoteAddr, stored, changes)
+	if err != nil {
+		if ctx.Err() != nil {
+			return errgo.Mask(err, errgo.Any)
 		}
+		metrics.StorageError("upsert")
+		return errgo.Notef(err, "cannot upsert %d keys from %q", len(keys), remoteAddr)
 	}
 	return nil
 }
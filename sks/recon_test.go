@@ -18,17 +18,40 @@
 package sks
 
 import (
-	"testing"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	stdtesting "testing"
 	"time"
 
 	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
 
+	"github.com/hockeypuck/testing"
+	"github.com/julienschmidt/httprouter"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
 	"gopkg.in/hockeypuck/conflux.v2/recon"
+	"gopkg.in/hockeypuck/hkp.v1/clock"
+	"gopkg.in/hockeypuck/hkp.v1/cryptoprovider"
+	"gopkg.in/hockeypuck/hkp.v1/maintenance"
 	"gopkg.in/hockeypuck/hkp.v1/storage"
 	"gopkg.in/hockeypuck/hkp.v1/storage/mock"
+	"gopkg.in/hockeypuck/openpgp.v1"
 )
 
-func Test(t *testing.T) { gc.TestingT(t) }
+func Test(t *stdtesting.T) { gc.TestingT(t) }
 
 type SksSuite struct {
 	peer *Peer
@@ -67,3 +90,1408 @@ func (s *SksSuite) TestPeerStats(c *gc.C) {
 	c.Assert(s.peer.stats.Daily[thisDay].Inserted, gc.Equals, 1)
 	c.Assert(s.peer.stats.Daily[thisDay].Updated, gc.Equals, 1)
 }
+
+func (s *SksSuite) TestPacketStats(c *gc.C) {
+	s.peer.UpdatePackets(storage.PacketCounts{Accepted: 10, Dropped: 2})
+	s.peer.UpdatePackets(storage.PacketCounts{Accepted: 5})
+	thisDay := time.Now().UTC().Truncate(24 * time.Hour)
+	c.Assert(s.peer.stats.Packets, gc.HasLen, 1)
+	c.Assert(s.peer.stats.Packets[thisDay].Accepted, gc.Equals, 15)
+	c.Assert(s.peer.stats.Packets[thisDay].Dropped, gc.Equals, 2)
+
+	path := filepath.Join(c.MkDir(), "stats")
+	err := s.peer.stats.WriteFile(path)
+	c.Assert(err, gc.IsNil)
+	stats := NewStats()
+	err = stats.ReadFile(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(stats.Packets, gc.HasLen, 1)
+	for k, v := range stats.Packets {
+		c.Assert(k.Equal(thisDay), gc.Equals, true)
+		c.Assert(*v, gc.Equals, PacketStat{Accepted: 15, Dropped: 2})
+	}
+}
+
+func (s *SksSuite) TestPeerStatsByPartner(c *gc.C) {
+	stats := NewStats()
+	stats.UpdatePeerHashquery("pgp.example.com:11371", time.Second)
+	stats.UpdatePeerHashquery("pgp.example.com:11371", 3*time.Second)
+	stats.UpdatePeerRecovered("pgp.example.com:11371", storage.KeyAdded{Digest: "decafbad"})
+	stats.UpdatePeerRecovered("pgp.example.com:11371", storage.KeyNotChanged{})
+	stats.UpdatePeerFailure("pgp.example.com:11371")
+	stats.UpdatePeerRecon("pgp.example.com:11371")
+
+	path := filepath.Join(c.MkDir(), "stats")
+	c.Assert(stats.clone().WriteFile(path), gc.IsNil)
+	stats = NewStats()
+	c.Assert(stats.ReadFile(path), gc.IsNil)
+	c.Assert(stats.Peers, gc.HasLen, 1)
+	ps := stats.Peers["pgp.example.com"]
+	c.Assert(ps, gc.NotNil)
+	c.Assert(ps.Recovered, gc.Equals, 1)
+	c.Assert(ps.Failures, gc.Equals, 1)
+	c.Assert(ps.Hashqueries, gc.Equals, 2)
+	c.Assert(ps.HashqueryLatency, gc.Equals, 2.0)
+	c.Assert(ps.LastRecon.IsZero(), gc.Equals, false)
+	c.Assert(ps.LastFailure.IsZero(), gc.Equals, false)
+}
+
+func (s *SksSuite) TestPresets(c *gc.C) {
+	c.Assert(PresetNames(), gc.DeepEquals, []string{"full-pool-member", "private-federation", "small-mirror"})
+	for _, name := range PresetNames() {
+		p, ok := LookupPreset(name)
+		c.Assert(ok, gc.Equals, true)
+		settings := p.Settings()
+		c.Assert(settings.PTreeConfig, gc.Equals, p.PTreeConfig)
+		c.Assert(settings.GossipIntervalSecs, gc.Equals, p.GossipIntervalSecs)
+
+		peer, err := NewPeer(mock.NewStorage(), c.MkDir(), settings, WithPreset(p))
+		c.Assert(err, gc.IsNil)
+		c.Assert(peer.chunkSize, gc.Equals, p.RequestChunkSize)
+		c.Assert(peer.client.Timeout, gc.Equals, p.RequestTimeout)
+		c.Assert(peer.ptree.Close(), gc.IsNil)
+	}
+	_, ok := LookupPreset("huge")
+	c.Assert(ok, gc.Equals, false)
+}
+
+func (s *SksSuite) TestPTreeMismatch(c *gc.C) {
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 11370}
+	rcvr := &recon.Recover{
+		RemoteAddr: addr,
+		RemoteConfig: &recon.Config{
+			BitQuantum: s.peer.settings.BitQuantum,
+			MBar:       s.peer.settings.MBar + 1,
+		},
+	}
+	c.Assert(s.peer.SetPartners(recon.PartnerMap{
+		"alice": recon.Partner{ReconAddr: "192.0.2.1:11370"},
+		"bob":   recon.Partner{ReconAddr: "192.0.2.2:11370"},
+	}), gc.IsNil)
+	err := s.peer.checkPartnerConfig(partnerHost(rcvr.RemoteAddr), nil, rcvr.RemoteConfig)
+	c.Assert(err, gc.FitsTypeOf, &PTreeMismatchError{})
+	mismatched := s.peer.MismatchedPartners()
+	c.Assert(mismatched, gc.HasLen, 1)
+	c.Assert(mismatched[0].Partner, gc.Equals, "192.0.2.1")
+	c.Assert(mismatched[0].RemoteMBar, gc.Equals, s.peer.settings.MBar+1)
+
+	// Mismatched partners are not gossiped with.
+	s.peer.mu.Lock()
+	gossip := s.peer.gossipSettings()
+	s.peer.mu.Unlock()
+	c.Assert(partnerNames(gossip.Partners), gc.DeepEquals, []string{"bob"})
+
+	// Once the partner is reconfigured, it is no longer skipped.
+	rcvr.RemoteConfig.MBar = s.peer.settings.MBar
+	err = s.peer.checkPartnerConfig(partnerHost(rcvr.RemoteAddr), nil, rcvr.RemoteConfig)
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.peer.MismatchedPartners(), gc.HasLen, 0)
+	c.Assert(s.peer.mismatched.excluded("alice"), gc.Equals, false)
+}
+
+func (s *SksSuite) TestPartnerPaths(c *gc.C) {
+	c.Assert(s.peer.hashqueryURL("192.0.2.1:11371", false), gc.Equals, "http://192.0.2.1:11371/pks/hashquery")
+
+	err := PartnerPaths(map[string]string{
+		"192.0.2.1:11371": "/hkp/",
+		"192.0.2.2":       "keys",
+	})(s.peer)
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.peer.hashqueryURL("192.0.2.1:11371", false), gc.Equals, "http://192.0.2.1:11371/hkp/pks/hashquery")
+	c.Assert(s.peer.hashqueryURL("192.0.2.1:80", false), gc.Equals, "http://192.0.2.1:80/pks/hashquery")
+	c.Assert(s.peer.hashqueryURL("192.0.2.2:11371", false), gc.Equals, "http://192.0.2.2:11371/keys/pks/hashquery")
+	c.Assert(s.peer.hashqueryURL("192.0.2.2:11371", true), gc.Equals, "https://192.0.2.2:11371/keys/pks/hashquery")
+}
+
+func (s *SksSuite) TestDegraded(c *gc.C) {
+	// A regular file where the prefix tree directory should be cannot be
+	// opened as a prefix tree.
+	path := filepath.Join(c.MkDir(), "ptree")
+	err := ioutil.WriteFile(path, []byte("corrupt"), 0644)
+	c.Assert(err, gc.IsNil)
+
+	peer, err := NewPeer(mock.NewStorage(), path, recon.DefaultSettings())
+	c.Assert(err, gc.IsNil)
+	c.Assert(peer.Degraded(), gc.NotNil)
+	c.Assert(peer.CheckPrefixTree(context.Background()), gc.ErrorMatches, "prefix tree unavailable.*")
+	c.Assert(peer.CheckRecon(context.Background()), gc.ErrorMatches, "recon is waiting for the prefix tree.*")
+
+	peer.updateDigests(storage.KeyAdded{"decafbad"})
+	peer.updateDigests(storage.KeyReplaced{"decafbad", "cafebabe"})
+	stats := peer.Stats()
+	c.Assert(stats.Degraded, gc.Not(gc.Equals), "")
+	c.Assert(stats.PendingDigests, gc.Equals, 2)
+	c.Assert(peer.pending, gc.DeepEquals, map[string]bool{"decafbad": false, "cafebabe": true})
+
+	defer func(d time.Duration) { degradedRetryInterval = d }(degradedRetryInterval)
+	degradedRetryInterval = 10 * time.Millisecond
+	c.Assert(os.Remove(path), gc.IsNil)
+	peer.Start()
+	for i := 0; i < 100 && peer.Degraded() != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(peer.Degraded(), gc.IsNil)
+	c.Assert(peer.Stats().PendingDigests, gc.Equals, 0)
+	c.Assert(peer.CheckPrefixTree(context.Background()), gc.IsNil)
+	c.Assert(peer.CheckRecon(context.Background()), gc.IsNil)
+	peer.Stop()
+	c.Assert(peer.CheckRecon(context.Background()), gc.ErrorMatches, "recon is stopped")
+}
+
+func (s *SksSuite) TestScrub(c *gc.C) {
+	report, err := s.peer.Scrub(true)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Nodes, gc.Equals, 1)
+	c.Assert(report.Corrupt, gc.Equals, 0)
+	c.Assert(report.Removed, gc.Equals, 0)
+	c.Assert(report.Inserted, gc.Equals, 0)
+}
+
+func (s *SksSuite) TestScrubWhileChanging(c *gc.C) {
+	// Storage is listed without holding up digest changes, and changes
+	// made meanwhile are not mistaken for corruption.
+	var peer *Peer
+	st := mock.NewStorage(mock.ModifiedSince(func(time.Time) ([]string, error) {
+		peer.updateDigests(storage.KeyAdded{"decafbaddecafbaddecafbaddecafbad"})
+		return nil, nil
+	}))
+	peer, err := NewPeer(st, c.MkDir(), recon.DefaultSettings())
+	c.Assert(err, gc.IsNil)
+	defer peer.Stop()
+	report, err := peer.Scrub(true)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Removed, gc.Equals, 0)
+	c.Assert(report.Inserted, gc.Equals, 0)
+	root, err := peer.ptree.Root()
+	c.Assert(err, gc.IsNil)
+	c.Assert(root.Size(), gc.Equals, 1)
+}
+
+func (s *SksSuite) TestJournal(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "ptree")
+	j, err := openJournal(JournalFilename(path), nil)
+	c.Assert(err, gc.IsNil)
+	err = j.append(journalEntry{Digest: "decafbad", Insert: true}, journalEntry{Digest: "cafebabe"})
+	c.Assert(err, gc.IsNil)
+	// A torn write from a crash is ignored.
+	_, err = j.f.WriteString("+")
+	c.Assert(err, gc.IsNil)
+	entries, err := j.entries()
+	c.Assert(err, gc.IsNil)
+	c.Assert(entries, gc.DeepEquals, []journalEntry{{"decafbad", true}, {"cafebabe", false}})
+	c.Assert(j.Close(), gc.IsNil)
+
+	// Opening the peer replays and truncates the journal.
+	peer, err := NewPeer(mock.NewStorage(), path, recon.DefaultSettings())
+	c.Assert(err, gc.IsNil)
+	entries, err = peer.journal.entries()
+	c.Assert(err, gc.IsNil)
+	c.Assert(entries, gc.HasLen, 0)
+
+	peer.updateDigests(storage.KeyAdded{"decafbad"})
+	entries, err = peer.journal.entries()
+	c.Assert(err, gc.IsNil)
+	c.Assert(entries, gc.DeepEquals, []journalEntry{{"decafbad", true}})
+
+	peer.Stop()
+	info, err := os.Stat(JournalFilename(path))
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Size(), gc.Equals, int64(0))
+}
+
+func (s *SksSuite) TestJournalCheckpoint(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "ptree")
+	peer, err := NewPeer(mock.NewStorage(), path, recon.DefaultSettings())
+	c.Assert(err, gc.IsNil)
+	defer peer.Stop()
+
+	// Mutations are written as they are applied, and synced in batches.
+	peer.updateDigests(storage.KeyAdded{"decafbad"})
+	c.Assert(peer.journal.dirty, gc.Equals, true)
+	entries, err := peer.journal.entries()
+	c.Assert(err, gc.IsNil)
+	c.Assert(entries, gc.HasLen, 1)
+
+	// Checkpoints truncate the journal once the prefix tree has the
+	// mutations.
+	peer.mu.Lock()
+	err = peer.checkpointJournal()
+	peer.mu.Unlock()
+	c.Assert(err, gc.IsNil)
+	c.Assert(peer.journal.dirty, gc.Equals, false)
+	entries, err = peer.journal.entries()
+	c.Assert(err, gc.IsNil)
+	c.Assert(entries, gc.HasLen, 0)
+}
+
+func (s *SksSuite) TestLocking(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "ptree")
+	peer, err := NewPeer(mock.NewStorage(), path, recon.DefaultSettings())
+	c.Assert(err, gc.IsNil)
+
+	_, err = NewPeer(mock.NewStorage(), path, recon.DefaultSettings())
+	c.Assert(errgo.Cause(err), gc.Equals, ErrPrefixTreeLocked)
+	_, err = NewPeer(mock.NewStorage(), path, recon.DefaultSettings(), ReadOnly())
+	c.Assert(errgo.Cause(err), gc.Equals, ErrPrefixTreeLocked)
+
+	c.Assert(peer.ptree.Close(), gc.IsNil)
+	c.Assert(peer.lock.Close(), gc.IsNil)
+
+	// Read-only peers may share the prefix tree with each other, but not
+	// with a writer.
+	ro1, err := NewPeer(mock.NewStorage(), path, recon.DefaultSettings(), ReadOnly())
+	c.Assert(err, gc.IsNil)
+	_, err = NewPeer(mock.NewStorage(), path, recon.DefaultSettings())
+	c.Assert(errgo.Cause(err), gc.Equals, ErrPrefixTreeLocked)
+	_, err = ro1.Scrub(true)
+	c.Assert(err, gc.NotNil)
+	ro1.Stop()
+
+	_, err = NewPeer(mock.NewStorage(), filepath.Join(c.MkDir(), "missing"), recon.DefaultSettings(), ReadOnly())
+	c.Assert(err, gc.NotNil)
+}
+
+func (s *SksSuite) TestInspect(c *gc.C) {
+	root, err := s.peer.Node("")
+	c.Assert(err, gc.IsNil)
+	c.Assert(root.Prefix, gc.Equals, "")
+	c.Assert(root.Size, gc.Equals, 0)
+	c.Assert(root.Leaf, gc.Equals, true)
+
+	_, err = s.peer.Node("012")
+	c.Assert(err, gc.ErrorMatches, `invalid prefix "012".*`)
+
+	path, found, err := s.peer.DigestPath("decafbaddecafbaddecafbaddecafbad")
+	c.Assert(err, gc.IsNil)
+	c.Assert(found, gc.Equals, false)
+	c.Assert(path, gc.HasLen, 1)
+
+	_, _, err = s.peer.DigestPath("not hex")
+	c.Assert(err, gc.NotNil)
+}
+
+func (s *SksSuite) TestUpsertDigestMismatch(c *gc.C) {
+	keys := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")).MustParse()
+	c.Assert(keys, gc.HasLen, 1)
+	var buf bytes.Buffer
+	err := openpgp.WritePackets(&buf, keys[0])
+	c.Assert(err, gc.IsNil)
+
+	_, _, err = s.peer.readRecovered("192.0.2.1:11371", map[string]bool{"decafbaddecafbaddecafbaddecafbad": true}, buf.Bytes())
+	mismatch, ok := errgo.Cause(err).(*DigestMismatchError)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(mismatch.Remote, gc.Equals, "192.0.2.1:11371")
+	c.Assert(mismatch.Fingerprint, gc.Equals, "10fe8cf1b483f7525039aa2a361bc1f023e0dcca")
+	c.Assert(s.peer.Stats().Mismatched, gc.Equals, 1)
+
+	recovered, digests, err := s.peer.readRecovered("192.0.2.1:11371", map[string]bool{mismatch.Digest: true}, buf.Bytes())
+	c.Assert(err, gc.IsNil)
+	c.Assert(recovered, gc.HasLen, 1)
+	c.Assert(digests, gc.DeepEquals, []string{mismatch.Digest})
+	c.Assert(s.peer.Stats().Mismatched, gc.Equals, 1)
+}
+
+type batchStorage struct {
+	*mock.Storage
+	batches [][]*openpgp.PrimaryKey
+}
+
+func (st *batchStorage) UpsertKeys(ctx context.Context, keys []*openpgp.PrimaryKey) ([]storage.KeyChange, error) {
+	st.batches = append(st.batches, keys)
+	var changes []storage.KeyChange
+	for _, key := range keys {
+		changes = append(changes, storage.KeyAdded{Digest: key.MD5})
+	}
+	return changes, nil
+}
+
+func (s *SksSuite) TestUpsertKeysBatch(c *gc.C) {
+	st := &batchStorage{Storage: mock.NewStorage()}
+	peer, err := NewPeer(st, c.MkDir(), recon.DefaultSettings())
+	c.Assert(err, gc.IsNil)
+	defer peer.lock.Close()
+
+	keys := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")).MustParse()
+	keys = append(keys, openpgp.MustReadArmorKeys(testing.MustInput("alice_unsigned.asc")).MustParse()...)
+	err = peer.upsertKeys(context.Background(), "192.0.2.1:11371", keys)
+	c.Assert(err, gc.IsNil)
+	c.Assert(st.batches, gc.HasLen, 1)
+	c.Assert(st.batches[0], gc.HasLen, 2)
+	c.Assert(st.MethodCount("Insert"), gc.Equals, 0)
+	c.Assert(peer.Stats().Sources[ReconSource("192.0.2.1:11371")].Inserted, gc.Equals, 2)
+}
+
+// divergingStorage merges every key into one with a different digest.
+type divergingStorage struct {
+	*mock.Storage
+}
+
+func (st *divergingStorage) UpsertKeys(ctx context.Context, keys []*openpgp.PrimaryKey) ([]storage.KeyChange, error) {
+	var changes []storage.KeyChange
+	for range keys {
+		changes = append(changes, storage.KeyReplaced{
+			OldDigest: "00000000000000000000000000000000",
+			NewDigest: "decafbaddecafbaddecafbaddecafbad",
+		})
+	}
+	return changes, nil
+}
+
+func (s *SksSuite) TestDivergedDigests(c *gc.C) {
+	peer, err := NewPeer(&divergingStorage{Storage: mock.NewStorage()}, c.MkDir(), recon.DefaultSettings())
+	c.Assert(err, gc.IsNil)
+	defer peer.lock.Close()
+
+	keys := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")).MustParse()
+	err = peer.upsertKeys(context.Background(), "192.0.2.1:11371", keys)
+	c.Assert(err, gc.IsNil)
+	c.Assert(peer.Stats().Diverged, gc.Equals, 1)
+	divergences := peer.Divergences()
+	c.Assert(divergences, gc.HasLen, 1)
+	c.Assert(divergences[0].Remote, gc.Equals, "192.0.2.1:11371")
+	c.Assert(divergences[0].Requested, gc.Equals, strings.ToLower(keys[0].MD5))
+	c.Assert(divergences[0].Stored, gc.Equals, "decafbaddecafbaddecafbaddecafbad")
+	c.Assert(peer.Blocked(), gc.DeepEquals, []string{divergences[0].Requested})
+}
+
+func (s *SksSuite) TestWriteQueue(c *gc.C) {
+	st := &batchStorage{Storage: mock.NewStorage()}
+	peer, err := NewPeer(st, c.MkDir(), recon.DefaultSettings(), WriteQueue(1, 1))
+	c.Assert(err, gc.IsNil)
+	defer peer.lock.Close()
+	peer.writes.start(peer)
+
+	keys := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")).MustParse()
+	c.Assert(peer.writes.enqueue(context.Background(), "192.0.2.1:11371", keys), gc.IsNil)
+	c.Assert(peer.writes.enqueue(context.Background(), "192.0.2.1:11371", keys), gc.IsNil)
+	peer.writes.flush(time.Second)
+	c.Assert(st.batches, gc.HasLen, 2)
+	c.Assert(peer.writes.queued(), gc.Equals, 0)
+
+	_, err = NewPeer(st, c.MkDir(), recon.DefaultSettings(), WriteQueue(0, 1))
+	c.Assert(err, gc.NotNil)
+}
+
+func (s *SksSuite) TestCapabilities(c *gc.C) {
+	probes := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hkp"+CapabilitiesPath, func(w http.ResponseWriter, r *http.Request) {
+		probes++
+		w.Write([]byte(`{"compression":true,"maxChunkSize":50,"hkps":true,"reconcilers":["sks","iblt"]}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	// Without a capabilities endpoint, defaults are used.
+	c.Assert(s.peer.capabilities(addr), gc.DeepEquals, Capabilities{})
+
+	err := PartnerPaths(map[string]string{addr: "/hkp"})(s.peer)
+	c.Assert(err, gc.IsNil)
+	s.peer.caps = capabilityCache{}
+	caps := s.peer.capabilities(addr)
+	c.Assert(caps, gc.DeepEquals, Capabilities{
+		Compression: true, MaxChunkSize: 50, HKPS: true, Reconcilers: []string{"sks", "iblt"}})
+	s.peer.capabilities(addr)
+	c.Assert(probes, gc.Equals, 1)
+
+	req, err := s.peer.newHashqueryRequest(addr, caps, []byte("hashquery"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(req.URL.String(), gc.Equals, "https://"+addr+"/hkp/pks/hashquery")
+	c.Assert(req.Header.Get("Content-Encoding"), gc.Equals, "gzip")
+
+	caps = s.peer.limitChunkSize(addr, 50)
+	c.Assert(caps.MaxChunkSize, gc.Equals, 25)
+	c.Assert(s.peer.capabilities(addr).MaxChunkSize, gc.Equals, 25)
+}
+
+func (s *SksSuite) TestRequestChunkDeadline(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Never respond.
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	z, err := DigestZp("decafbaddecafbaddecafbaddecafbad")
+	c.Assert(err, gc.IsNil)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = s.peer.requestChunk(ctx, addr, Capabilities{}, []*cf.Zp{z})
+	c.Assert(errgo.Cause(err), gc.Equals, context.DeadlineExceeded)
+}
+
+func (s *SksSuite) TestRequestChunkLimits(c *gc.C) {
+	release := make(chan bool)
+	stall := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recon.WriteInt(w, 1)
+		recon.WriteInt(w, 1024)
+		if stall {
+			w.(http.Flusher).Flush()
+			<-release
+			return
+		}
+		w.Write(bytes.Repeat([]byte{0}, 1024))
+	}))
+	defer srv.Close()
+	defer close(release)
+	addr := strings.TrimPrefix(srv.URL, "http://")
+	z, err := DigestZp("decafbaddecafbaddecafbaddecafbad")
+	c.Assert(err, gc.IsNil)
+
+	// Responses larger than the maximum are requested in smaller chunks.
+	s.peer.maxResponse = 512
+	_, err = s.peer.requestChunk(context.Background(), addr, Capabilities{}, []*cf.Zp{z})
+	c.Assert(errgo.Cause(err), gc.Equals, errChunkTooLarge)
+
+	// Partners which stop sending are abandoned.
+	s.peer.maxResponse = DefaultMaxResponse
+	s.peer.idleTimeout = 50 * time.Millisecond
+	stall = true
+	_, err = s.peer.requestChunk(context.Background(), addr, Capabilities{}, []*cf.Zp{z})
+	c.Assert(err, gc.ErrorMatches, `hashquery to .* idle for more than 50ms`)
+}
+
+func (s *SksSuite) TestHTTPSPartners(c *gc.C) {
+	var hashqueries int
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/pks/hashquery" {
+			http.NotFound(w, r)
+			return
+		}
+		hashqueries++
+		recon.WriteInt(w, 0)
+		w.Write([]byte("\r\n"))
+	}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "https://")
+	host, _, err := net.SplitHostPort(addr)
+	c.Assert(err, gc.IsNil)
+
+	err = HTTPClient(nil)(s.peer)
+	c.Assert(err, gc.ErrorMatches, "nil HTTP client")
+	err = HTTPClient(srv.Client())(s.peer)
+	c.Assert(err, gc.IsNil)
+	err = HTTPSPartners(host)(s.peer)
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.peer.hashqueryURL(addr, false), gc.Equals, "https://"+addr+"/pks/hashquery")
+	c.Assert(s.peer.hashqueryURL("192.0.2.1:11371", false), gc.Equals, "http://192.0.2.1:11371/pks/hashquery")
+
+	z, err := DigestZp("decafbaddecafbaddecafbaddecafbad")
+	c.Assert(err, gc.IsNil)
+	received, err := s.peer.requestChunk(context.Background(), addr, s.peer.capabilities(addr), []*cf.Zp{z})
+	c.Assert(err, gc.IsNil)
+	c.Assert(received, gc.HasLen, 0)
+	c.Assert(hashqueries, gc.Equals, 1)
+}
+
+// blockingHashqueryServer returns a server which signals started on each
+// hashquery, and responds with no keys once release is closed.
+func blockingHashqueryServer(started, release chan bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/pks/hashquery" {
+			http.NotFound(w, r)
+			return
+		}
+		started <- true
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		recon.WriteInt(w, 0)
+		w.Write([]byte("\r\n"))
+	}))
+}
+
+func (s *SksSuite) recoverFrom(c *gc.C, srv *httptest.Server) *recon.Recover {
+	tcpAddr := srv.Listener.Addr().(*net.TCPAddr)
+	z, err := DigestZp("decafbaddecafbaddecafbaddecafbad")
+	c.Assert(err, gc.IsNil)
+	return &recon.Recover{
+		RemoteAddr: tcpAddr,
+		RemoteConfig: &recon.Config{
+			HTTPPort:   tcpAddr.Port,
+			BitQuantum: s.peer.settings.BitQuantum,
+			MBar:       s.peer.settings.MBar,
+		},
+		RemoteElements: []*cf.Zp{z},
+	}
+}
+
+func (s *SksSuite) TestDrainRecovery(c *gc.C) {
+	started, release := make(chan bool), make(chan bool)
+	srv := blockingHashqueryServer(started, release)
+	defer srv.Close()
+	rcvr := s.recoverFrom(c, srv)
+
+	// A recovery in progress when stopping is finished, but no more are
+	// accepted.
+	fake := &fakeReconciler{recovered: make(chan *recon.Recover)}
+	s.peer.peer = fake
+	s.peer.t.Go(s.peer.handleRecovery)
+	fake.recovered <- rcvr
+	<-started
+	s.peer.t.Kill(nil)
+	select {
+	case fake.recovered <- rcvr:
+		c.Fatalf("recovery accepted while draining")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	c.Assert(s.peer.t.Wait(), gc.IsNil)
+	c.Assert(s.peer.retries.retrying(), gc.HasLen, 1)
+}
+
+func (s *SksSuite) TestDrainTimeout(c *gc.C) {
+	started := make(chan bool)
+	srv := blockingHashqueryServer(started, make(chan bool))
+	defer srv.Close()
+	rcvr := s.recoverFrom(c, srv)
+
+	// A recovery which does not finish within the drain timeout is
+	// abandoned.
+	c.Assert(DrainTimeout(50*time.Millisecond)(s.peer), gc.IsNil)
+	fake := &fakeReconciler{recovered: make(chan *recon.Recover)}
+	s.peer.peer = fake
+	s.peer.t.Go(s.peer.handleRecovery)
+	fake.recovered <- rcvr
+	<-started
+	s.peer.t.Kill(nil)
+	c.Assert(s.peer.t.Wait(), gc.IsNil)
+	c.Assert(s.peer.retries.retrying(), gc.HasLen, 0)
+
+	// The abandoned digests are queued for when the peer restarts.
+	c.Assert(s.peer.recovery.partners(), gc.DeepEquals, []string{srv.Listener.Addr().String()})
+}
+
+func (s *SksSuite) TestRecoverConcurrently(c *gc.C) {
+	started, release := make(chan bool), make(chan bool)
+	srv := blockingHashqueryServer(started, release)
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+	c.Assert(RequestChunkSize(1)(s.peer), gc.IsNil)
+	c.Assert(RequestConcurrency(2)(s.peer), gc.IsNil)
+
+	var items []*cf.Zp
+	for _, digest := range []string{"decafbaddecafbaddecafbaddecafbad", "cafebabecafebabecafebabecafebabe", "deadbeefdeadbeefdeadbeefdeadbeef"} {
+		z, err := DigestZp(digest)
+		c.Assert(err, gc.IsNil)
+		items = append(items, z)
+	}
+	done := make(chan error)
+	go func() { done <- s.peer.recoverItems(context.Background(), addr, items) }()
+
+	// Two chunks are requested at once, leaving the third queued.
+	<-started
+	<-started
+	select {
+	case <-started:
+		c.Fatalf("more concurrent hashqueries than configured")
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.Assert(s.peer.recovery.items(addr), gc.HasLen, 3)
+	close(release)
+	<-started
+	c.Assert(<-done, gc.IsNil)
+	c.Assert(s.peer.recovery.partners(), gc.HasLen, 0)
+	c.Assert(s.peer.retries.retrying(), gc.HasLen, 1)
+
+	c.Assert(RequestConcurrency(0)(s.peer), gc.ErrorMatches, "invalid request concurrency 0")
+}
+
+func (s *SksSuite) TestResumeRecovery(c *gc.C) {
+	started, release := make(chan bool, 1), make(chan bool)
+	close(release)
+	srv := blockingHashqueryServer(started, release)
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	path := filepath.Join(c.MkDir(), "ptree")
+	peer, err := NewPeer(mock.NewStorage(), path, recon.DefaultSettings())
+	c.Assert(err, gc.IsNil)
+	z, err := DigestZp("decafbaddecafbaddecafbaddecafbad")
+	c.Assert(err, gc.IsNil)
+	c.Assert(peer.recovery.set(addr, []*cf.Zp{z}), gc.IsNil)
+	peer.ptree.Close()
+	peer.journal.Close()
+	peer.lock.Close()
+
+	peer, err = NewPeer(mock.NewStorage(), path, recon.DefaultSettings())
+	c.Assert(err, gc.IsNil)
+	defer peer.lock.Close()
+	defer peer.ptree.Close()
+	c.Assert(peer.recovery.partners(), gc.DeepEquals, []string{addr})
+	c.Assert(peer.recovery.items(addr), gc.HasLen, 1)
+	c.Assert(peer.resumeRecovery(context.Background()), gc.IsNil)
+	c.Assert(<-started, gc.Equals, true)
+	c.Assert(peer.recovery.partners(), gc.HasLen, 0)
+
+	_, err = os.Stat(RecoveryFilename(path))
+	c.Assert(err, gc.IsNil)
+	q, err := openRecoveryQueue(RecoveryFilename(path), nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(q.partners(), gc.HasLen, 0)
+}
+
+func (s *SksSuite) TestDeleteKey(c *gc.C) {
+	const digest = "decafbaddecafbaddecafbaddecafbad"
+	const fp = "10fe8cf1b483f7525039aa2a361bc1f023e0dcca"
+	key := &openpgp.PrimaryKey{PublicKey: openpgp.PublicKey{RFingerprint: openpgp.Reverse(fp)}, MD5: digest}
+	st := mock.NewStorage(mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+		return []*openpgp.PrimaryKey{key}, nil
+	}))
+	inTree := func(peer *Peer) bool {
+		_, found, err := peer.DigestPath(digest)
+		c.Assert(err, gc.IsNil)
+		return found
+	}
+
+	path := filepath.Join(c.MkDir(), "ptree")
+	peer, err := NewPeer(st, path, recon.DefaultSettings())
+	c.Assert(err, gc.IsNil)
+	c.Assert(peer.updateDigests(storage.KeyAdded{Digest: digest}), gc.IsNil)
+	c.Assert(inTree(peer), gc.Equals, true)
+
+	deleted, err := peer.DeleteKey(context.Background(), "0x"+strings.ToUpper(fp))
+	c.Assert(err, gc.IsNil)
+	c.Assert(deleted, gc.Equals, digest)
+	c.Assert(st.MethodCount("Delete"), gc.Equals, 1)
+	c.Assert(peer.Blocked(), gc.DeepEquals, []string{digest})
+	c.Assert(inTree(peer), gc.Equals, false)
+
+	// Blocked digests are neither inserted, recovered nor merged again.
+	c.Assert(peer.updateDigests(storage.KeyAdded{Digest: digest}), gc.IsNil)
+	c.Assert(inTree(peer), gc.Equals, false)
+	z, err := DigestZp(digest)
+	c.Assert(err, gc.IsNil)
+	c.Assert(peer.blocklist.filterItems([]*cf.Zp{z}), gc.HasLen, 0)
+	fetches := st.MethodCount("FetchKeys")
+	c.Assert(peer.upsertKeys(context.Background(), "192.0.2.1:11371", []*openpgp.PrimaryKey{key}), gc.IsNil)
+	c.Assert(st.MethodCount("FetchKeys"), gc.Equals, fetches)
+
+	// Nor is the key once changed, such as by a new signature.
+	changed := &openpgp.PrimaryKey{PublicKey: key.PublicKey, MD5: "0123456789abcdef0123456789abcdef"}
+	c.Assert(peer.KeyBlocked(changed), gc.Equals, true)
+	c.Assert(peer.upsertKeys(context.Background(), "192.0.2.1:11371", []*openpgp.PrimaryKey{changed}), gc.IsNil)
+	c.Assert(st.MethodCount("FetchKeys"), gc.Equals, fetches)
+	peer.ptree.Close()
+	peer.journal.Close()
+	peer.lock.Close()
+
+	peer, err = NewPeer(st, path, recon.DefaultSettings())
+	c.Assert(err, gc.IsNil)
+	defer peer.lock.Close()
+	defer peer.ptree.Close()
+	c.Assert(peer.Blocked(), gc.DeepEquals, []string{digest})
+	c.Assert(peer.KeyBlocked(changed), gc.Equals, true)
+	c.Assert(inTree(peer), gc.Equals, false)
+}
+
+func (s *SksSuite) TestBlocklistDigestsOnly(c *gc.C) {
+	// Blocklists written before fingerprints were blocked are still read.
+	const digest = "decafbaddecafbaddecafbaddecafbad"
+	path := filepath.Join(c.MkDir(), "blocklist")
+	c.Assert(ioutil.WriteFile(path, []byte(`["`+digest+`"]`), 0600), gc.IsNil)
+	b, err := openBlocklist(path, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(b.list(), gc.DeepEquals, []string{digest})
+
+	c.Assert(b.addFingerprints("acdc"), gc.IsNil)
+	b, err = openBlocklist(path, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(b.list(), gc.DeepEquals, []string{digest})
+	key := &openpgp.PrimaryKey{PublicKey: openpgp.PublicKey{RFingerprint: "acdc"}}
+	c.Assert(b.hasKey(key), gc.Equals, true)
+}
+
+func (s *SksSuite) TestPrefixTreeBackends(c *gc.C) {
+	c.Assert(PrefixTreeBackends(), gc.DeepEquals, []string{DefaultPrefixTree, MemoryPrefixTree})
+	c.Assert(func() { RegisterPrefixTree(MemoryPrefixTree, newMemPrefixTree) }, gc.PanicMatches,
+		"sks: RegisterPrefixTree called twice for memory")
+
+	_, err := NewPeer(mock.NewStorage(), c.MkDir(), recon.DefaultSettings(), PrefixTreeBackend("bogus"))
+	c.Assert(err, gc.ErrorMatches, `unknown prefix tree backend "bogus"`)
+
+	peer, err := NewPeer(mock.NewStorage(), c.MkDir(), recon.DefaultSettings(), PrefixTreeBackend(MemoryPrefixTree))
+	c.Assert(err, gc.IsNil)
+	c.Assert(peer.Degraded(), gc.IsNil)
+	peer.ptree.Close()
+	peer.lock.Close()
+}
+
+func (s *SksSuite) TestRecoveryRetries(c *gc.C) {
+	z, err := DigestZp("decafbaddecafbaddecafbaddecafbad")
+	c.Assert(err, gc.IsNil)
+	digest := hex.EncodeToString(hashqueryElement(z))
+	c.Assert(digest, gc.Equals, "decafbaddecafbaddecafbaddecafbad")
+
+	var t recoveryTracker
+	now := time.Now()
+	c.Assert(t.due("a", []*cf.Zp{z}, now), gc.HasLen, 1)
+
+	// Failures back off exponentially, per partner.
+	c.Assert(t.failed("a", digest, now), gc.Equals, false)
+	c.Assert(t.due("a", []*cf.Zp{z}, now), gc.HasLen, 0)
+	c.Assert(t.due("b", []*cf.Zp{z}, now), gc.HasLen, 1)
+	c.Assert(t.due("a", []*cf.Zp{z}, now.Add(recoveryBackoff)), gc.HasLen, 1)
+	c.Assert(t.failed("a", digest, now), gc.Equals, false)
+	c.Assert(t.due("a", []*cf.Zp{z}, now.Add(recoveryBackoff)), gc.HasLen, 0)
+	c.Assert(t.due("a", []*cf.Zp{z}, now.Add(2*recoveryBackoff)), gc.HasLen, 1)
+	c.Assert(t.retrying(), gc.DeepEquals, map[string]int{"a": 1})
+
+	// Success forgets past failures.
+	t.succeeded("a", digest)
+	c.Assert(t.due("a", []*cf.Zp{z}, now), gc.HasLen, 1)
+
+	// Digests are dropped after too many failures.
+	for i := 1; i < maxKeyRecoveryAttempts; i++ {
+		c.Assert(t.failed("a", digest, now), gc.Equals, false)
+	}
+	c.Assert(t.failed("a", digest, now), gc.Equals, true)
+	c.Assert(t.due("a", []*cf.Zp{z}, now.Add(365*24*time.Hour)), gc.HasLen, 0)
+	c.Assert(t.retrying(), gc.HasLen, 0)
+}
+
+type fakeReconciler struct {
+	started, stopped bool
+	inserted         int
+	recovered        chan *recon.Recover
+}
+
+func (f *fakeReconciler) Start()                           { f.started = true }
+func (f *fakeReconciler) Stop() error                      { f.stopped = true; return nil }
+func (f *fakeReconciler) Insert(z ...*cf.Zp)               { f.inserted += len(z) }
+func (f *fakeReconciler) Remove(z ...*cf.Zp)               { f.inserted -= len(z) }
+func (f *fakeReconciler) Recovered() <-chan *recon.Recover { return f.recovered }
+
+func (s *SksSuite) TestReconciler(c *gc.C) {
+	fake := &fakeReconciler{recovered: make(chan *recon.Recover)}
+	factory := func(*recon.Settings, recon.PrefixTree) (Reconciler, error) { return fake, nil }
+	peer, err := NewPeer(mock.NewStorage(), filepath.Join(c.MkDir(), "ptree"), recon.DefaultSettings(),
+		WithReconciler("fake", factory))
+	c.Assert(err, gc.IsNil)
+	c.Assert(peer.ReconcilerNames(), gc.DeepEquals, []string{"sks", "fake"})
+
+	_, err = NewPeer(mock.NewStorage(), c.MkDir(), recon.DefaultSettings(),
+		WithReconciler("fake", factory), WithReconciler("fake", factory))
+	c.Assert(err, gc.ErrorMatches, `duplicate reconciler "fake"`)
+	_, err = NewPeer(mock.NewStorage(), c.MkDir(), recon.DefaultSettings(), WithReconciler("sks", factory))
+	c.Assert(err, gc.ErrorMatches, `reconciler "sks" is reserved`)
+
+	m, ok := peer.peer.(*multiReconciler)
+	c.Assert(ok, gc.Equals, true)
+	m.Start()
+	c.Assert(fake.started, gc.Equals, true)
+	peer.updateDigests(storage.KeyAdded{"decafbad"})
+	c.Assert(fake.inserted, gc.Equals, 1)
+
+	rcvr := &recon.Recover{}
+	fake.recovered <- rcvr
+	c.Assert(<-m.Recovered(), gc.Equals, rcvr)
+	c.Assert(m.Stop(), gc.IsNil)
+	c.Assert(fake.stopped, gc.Equals, true)
+}
+
+func (s *SksSuite) TestSourceStats(c *gc.C) {
+	s.peer.UpdateSource(SourceAdd, storage.KeyAdded{"decafbad"})
+	s.peer.UpdateSource(SourceAdd, storage.KeyReplaced{"decafbad", "cafebabe"})
+	s.peer.UpdateSource(SourceLoad, storage.KeyAdded{"deadbeef"})
+	s.peer.UpdateSource(ReconSource("192.0.2.1:11371"), storage.KeyAdded{"f00f"})
+	s.peer.UpdateSource(SourceLoad, storage.KeyNotChanged{})
+
+	stats := s.peer.Stats()
+	c.Assert(stats.Sources, gc.DeepEquals, map[string]*LoadStat{
+		"add":             {Inserted: 1, Updated: 1},
+		"load":            {Inserted: 1},
+		"recon:192.0.2.1": {Inserted: 1},
+	})
+
+	path := filepath.Join(c.MkDir(), "stats.json")
+	c.Assert(s.peer.stats.WriteFile(path), gc.IsNil)
+	stats = NewStats()
+	c.Assert(stats.ReadFile(path), gc.IsNil)
+	c.Assert(stats.Sources["add"], gc.DeepEquals, &LoadStat{Inserted: 1, Updated: 1})
+}
+
+func (s *SksSuite) TestSummarize(c *gc.C) {
+	from := time.Date(2014, 6, 1, 10, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+
+	prev := NewStats()
+	prev.Sources["recon:192.0.2.1"] = &LoadStat{Inserted: 5}
+	prev.RecoveryErrors = 1
+
+	cur := NewStats()
+	cur.Total = 100
+	cur.Hourly[from.Add(-time.Hour)] = &LoadStat{Inserted: 50}
+	cur.Hourly[from] = &LoadStat{Inserted: 7, Updated: 3}
+	cur.Sources["add"] = &LoadStat{Inserted: 1}
+	cur.Sources["recon:192.0.2.1"] = &LoadStat{Inserted: 6, Updated: 2}
+	cur.Sources["recon:192.0.2.2"] = &LoadStat{Inserted: 4}
+	cur.RecoveryErrors = 3
+	cur.Rejected = 1
+
+	subject, body := summarize(prev, cur, from, to)
+	c.Assert(subject, gc.Equals, "Keyserver activity from 2014-06-01T10:00:00Z to 2014-06-01T11:00:00Z")
+	c.Assert(body, gc.Equals, `Keys inserted: 7
+Keys updated: 3
+Total keys: 100
+Recovery errors: 2
+Rejected keys: 1
+Mismatched keys: 0
+Diverged keys: 0
+Top partners:
+  192.0.2.2: 4 inserted, 0 updated
+  192.0.2.1: 1 inserted, 2 updated
+`)
+}
+
+func (s *SksSuite) TestAnomalies(c *gc.C) {
+	now := time.Date(2014, 6, 2, 12, 30, 0, 0, time.UTC)
+	hour := now.Truncate(time.Hour).Add(-time.Hour)
+	d := &anomalyDetector{th: AnomalyThresholds{
+		SpikeFactor: 10, MinSpike: 100, IdleHours: 3, RecoveryErrorBurst: 5,
+	}, started: now.Add(-48 * time.Hour)}
+
+	stats := NewStats()
+	for i := 1; i <= 24; i++ {
+		stats.Hourly[hour.Add(-time.Duration(i)*time.Hour)] = &LoadStat{Inserted: 20}
+	}
+	stats.Hourly[hour] = &LoadStat{Inserted: 150}
+	c.Assert(d.check(stats, now), gc.HasLen, 0)
+	stats.Hourly[hour] = &LoadStat{Inserted: 201}
+	anomalies := d.check(stats, now)
+	c.Assert(anomalies, gc.HasLen, 1)
+	c.Assert(anomalies[0].Kind, gc.Equals, AnomalySpike)
+
+	// Stalls are reported once until activity resumes.
+	stats = NewStats()
+	anomalies = d.check(stats, now)
+	c.Assert(anomalies, gc.HasLen, 1)
+	c.Assert(anomalies[0].Kind, gc.Equals, AnomalyStall)
+	c.Assert(d.check(stats, now), gc.HasLen, 0)
+
+	stats.Hourly[hour] = &LoadStat{Updated: 1}
+	stats.RecoveryErrors = 5
+	anomalies = d.check(stats, now)
+	c.Assert(anomalies, gc.HasLen, 1)
+	c.Assert(anomalies[0].Kind, gc.Equals, AnomalyRecoveryBurst)
+	c.Assert(d.check(stats, now), gc.HasLen, 0)
+
+	// A recently started server is not considered stalled.
+	d = &anomalyDetector{th: d.th, started: now.Add(-time.Hour)}
+	c.Assert(d.check(NewStats(), now), gc.HasLen, 0)
+}
+
+func (s *SksSuite) TestRelocate(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "ptree")
+	peer, err := NewPeer(mock.NewStorage(), path, recon.DefaultSettings())
+	c.Assert(err, gc.IsNil)
+	peer.writeStats()
+	legacy := LegacyLayout(path)
+	c.Assert(legacy.Stats, gc.Equals, StatsFilename(path))
+
+	dataDir := c.MkDir()
+	err = Relocate(legacy, DataDirLayout(dataDir))
+	c.Assert(errgo.Cause(err), gc.Equals, ErrPrefixTreeLocked)
+
+	c.Assert(peer.ptree.Close(), gc.IsNil)
+	c.Assert(peer.lock.Close(), gc.IsNil)
+	err = Relocate(legacy, DataDirLayout(dataDir))
+	c.Assert(err, gc.IsNil)
+	for _, fn := range []string{legacy.PTree, legacy.Stats, legacy.Journal, legacy.Lock} {
+		_, err = os.Stat(fn)
+		c.Assert(os.IsNotExist(err), gc.Equals, true, gc.Commentf("%s", fn))
+	}
+	for _, fn := range []string{"ptree", "stats.json", "journal"} {
+		_, err = os.Stat(filepath.Join(dataDir, fn))
+		c.Assert(err, gc.IsNil, gc.Commentf("%s", fn))
+	}
+
+	peer, err = NewPeer(mock.NewStorage(), "", recon.DefaultSettings(), DataDir(dataDir))
+	c.Assert(err, gc.IsNil)
+	c.Assert(peer.path, gc.Equals, filepath.Join(dataDir, "ptree"))
+	c.Assert(peer.Degraded(), gc.IsNil)
+
+	// Relocating over existing files is refused.
+	err = Relocate(DataDirLayout(dataDir), DataDirLayout(dataDir))
+	c.Assert(err, gc.ErrorMatches, "cannot relocate .*: .* already exists")
+}
+
+func (s *SksSuite) TestEncryptAtRest(c *gc.C) {
+	keyFile := filepath.Join(c.MkDir(), "key")
+	err := ioutil.WriteFile(keyFile, []byte(strings.Repeat("2a", 32)+"\n"), 0600)
+	c.Assert(err, gc.IsNil)
+
+	dataDir := c.MkDir()
+	peer, err := NewPeer(mock.NewStorage(), "", recon.DefaultSettings(),
+		DataDir(dataDir), EncryptAtRest(KeyFile(keyFile)))
+	c.Assert(err, gc.IsNil)
+	peer.updateDigests(storage.KeyAdded{"decafbad"})
+	peer.writeStats()
+
+	for _, fn := range []string{"journal", "stats.json"} {
+		buf, err := ioutil.ReadFile(filepath.Join(dataDir, fn))
+		c.Assert(err, gc.IsNil)
+		c.Assert(len(buf) > 0, gc.Equals, true)
+		c.Assert(bytes.Contains(buf, []byte("decafbad")), gc.Equals, false)
+		c.Assert(bytes.Contains(buf, []byte("Hourly")), gc.Equals, false)
+	}
+	entries, err := peer.journal.entries()
+	c.Assert(err, gc.IsNil)
+	c.Assert(entries, gc.DeepEquals, []journalEntry{{"decafbad", true}})
+
+	stats := NewStats()
+	c.Assert(peer.sealer.readJSON(filepath.Join(dataDir, "stats.json"), stats), gc.IsNil)
+	c.Assert(stats.Hourly, gc.HasLen, 1)
+
+	other, err := newSealer(cryptoprovider.Default, bytes.Repeat([]byte{1}, 32))
+	c.Assert(err, gc.IsNil)
+	c.Assert(other.readJSON(filepath.Join(dataDir, "stats.json"), stats), gc.NotNil)
+
+	_, err = NewPeer(mock.NewStorage(), "", recon.DefaultSettings(), DataDir(c.MkDir()),
+		EncryptAtRest(func() ([]byte, error) { return []byte("short"), nil }))
+	c.Assert(err, gc.ErrorMatches, "encryption key must be 256 bits, got 40")
+}
+
+func (s *SksSuite) TestAdminAuth(c *gc.C) {
+	r := httprouter.New()
+	s.peer.RegisterAdmin(r, AdminTokens("s3cret"))
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	get := func(path, token string) int {
+		req, err := http.NewRequest("GET", srv.URL+path, nil)
+		c.Assert(err, gc.IsNil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, gc.IsNil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	c.Assert(get("/admin/stats", ""), gc.Equals, http.StatusUnauthorized)
+	c.Assert(get("/admin/stats", "wrong"), gc.Equals, http.StatusUnauthorized)
+	c.Assert(get("/admin/stats", "s3cret"), gc.Equals, http.StatusOK)
+	c.Assert(get("/admin/recovery", "s3cret"), gc.Equals, http.StatusOK)
+
+	req, err := http.NewRequest("POST", srv.URL+"/admin/recon?partner=nobody", nil)
+	c.Assert(err, gc.IsNil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, gc.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusNotFound)
+
+	c.Assert(s.peer.SetPartners(recon.PartnerMap{"alice": recon.Partner{}}), gc.IsNil)
+	c.Assert(s.peer.Partners(), gc.HasLen, 1)
+
+	// Without tokens or client CAs, all requests are refused.
+	r = httprouter.New()
+	s.peer.RegisterAdmin(r)
+	open := httptest.NewServer(r)
+	defer open.Close()
+	resp, err = http.Get(open.URL + "/admin/stats")
+	c.Assert(err, gc.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusUnauthorized)
+}
+
+func (s *SksSuite) TestAdminMaintenance(c *gc.C) {
+	var m maintenance.Mode
+	r := httprouter.New()
+	s.peer.RegisterAdmin(r, AdminTokens("s3cret"), AdminMaintenance(&m))
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	do := func(method, path string) (int, maintenance.Status) {
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		c.Assert(err, gc.IsNil)
+		req.Header.Set("Authorization", "Bearer s3cret")
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, gc.IsNil)
+		defer resp.Body.Close()
+		var st maintenance.Status
+		if resp.StatusCode == http.StatusOK {
+			c.Assert(json.NewDecoder(resp.Body).Decode(&st), gc.IsNil)
+		}
+		return resp.StatusCode, st
+	}
+	code, st := do("GET", "/admin/maintenance")
+	c.Assert(code, gc.Equals, http.StatusOK)
+	c.Assert(st.Enabled, gc.Equals, false)
+
+	code, _ = do("POST", "/admin/maintenance")
+	c.Assert(code, gc.Equals, http.StatusBadRequest)
+
+	code, st = do("POST", "/admin/maintenance?enabled=true&message=back+soon")
+	c.Assert(code, gc.Equals, http.StatusOK)
+	c.Assert(st.Enabled, gc.Equals, true)
+	c.Assert(st.Message, gc.Equals, "back soon")
+	c.Assert(m.ReadOnly(), gc.ErrorMatches, "back soon")
+
+	code, st = do("POST", "/admin/maintenance?enabled=false")
+	c.Assert(code, gc.Equals, http.StatusOK)
+	c.Assert(st.Enabled, gc.Equals, false)
+	c.Assert(m.ReadOnly(), gc.IsNil)
+}
+
+func (s *SksSuite) TestStandby(c *gc.C) {
+	leases := mock.NewLeases()
+	settings := recon.DefaultSettings()
+	settings.ReconAddr = "127.0.0.1:0"
+	newPeer := func(holder string) *Peer {
+		peer, err := NewPeer(mock.NewStorage(mock.SharedLeases(leases)), c.MkDir(), settings,
+			PrefixTreeBackend(MemoryPrefixTree), Standby(holder, 60*time.Millisecond))
+		c.Assert(err, gc.IsNil)
+		return peer
+	}
+	waitActive := func(peer *Peer, active bool) {
+		for i := 0; i < 100 && peer.Active() != active; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.Assert(peer.Active(), gc.Equals, active)
+	}
+
+	alice, bob := newPeer("alice"), newPeer("bob")
+	alice.Start()
+	waitActive(alice, true)
+	bob.Start()
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(bob.Active(), gc.Equals, false)
+	c.Assert(bob.CheckRecon(context.Background()), gc.IsNil)
+	c.Assert(leases.Holder(ReconLease), gc.Equals, "alice")
+
+	// The standby takes over once the active peer releases the lease.
+	alice.Stop()
+	waitActive(bob, true)
+	c.Assert(leases.Holder(ReconLease), gc.Equals, "bob")
+
+	// Storage errors do not stop recon.
+	leases.SetError(errgo.New("storage unavailable"))
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(bob.Active(), gc.Equals, true)
+	leases.SetError(nil)
+
+	// An active peer which loses the lease stops recon.
+	c.Assert(leases.ReleaseLease(ReconLease, "bob"), gc.IsNil)
+	held, err := leases.AcquireLease(ReconLease, "mallory", time.Hour)
+	c.Assert(err, gc.IsNil)
+	c.Assert(held, gc.Equals, true)
+	waitActive(bob, false)
+	c.Assert(bob.CheckRecon(context.Background()), gc.ErrorMatches, "recon lease lost")
+	bob.Stop()
+	c.Assert(leases.Holder(ReconLease), gc.Equals, "mallory")
+}
+
+func (s *SksSuite) TestLoadDump(c *gc.C) {
+	dir := c.MkDir()
+	_, err := LoadDump(dir, mock.NewStorage())
+	c.Assert(err, gc.ErrorMatches, "no keydump files found in .*")
+
+	keys := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")).MustParse()
+	for i := 0; i < 3; i++ {
+		var buf bytes.Buffer
+		for _, key := range keys {
+			c.Assert(openpgp.WritePackets(&buf, key), gc.IsNil)
+		}
+		err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("sks-dump-%04d.pgp", i)), buf.Bytes(), 0644)
+		c.Assert(err, gc.IsNil)
+	}
+
+	var progress []DumpStats
+	st := mock.NewStorage()
+	stats, err := LoadDump(dir, st, DumpWorkers(2), DumpProgress(func(ds DumpStats) {
+		progress = append(progress, ds)
+	}))
+	c.Assert(err, gc.IsNil)
+	c.Assert(stats.Files, gc.Equals, 3)
+	c.Assert(stats.FilesDone, gc.Equals, 3)
+	c.Assert(stats.Keys, gc.Equals, 3*len(keys))
+	c.Assert(stats.Inserted, gc.Equals, 3*len(keys))
+	c.Assert(st.MethodCount("Insert"), gc.Equals, 3*len(keys))
+	c.Assert(progress[len(progress)-1].FilesDone, gc.Equals, 3)
+}
+
+func (s *SksSuite) TestRebuildPrefixTree(c *gc.C) {
+	const digest = "decafbaddecafbaddecafbaddecafbad"
+	const stale = "cafebabecafebabecafebabecafebabe"
+	key := &openpgp.PrimaryKey{MD5: digest}
+	st := mock.NewStorage(
+		mock.ModifiedSince(func(time.Time) ([]string, error) {
+			return []string{"accd0e320f1cb163a2aa9305257f384b1fc8ef01"}, nil
+		}),
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return []*openpgp.PrimaryKey{key}, nil
+		}))
+	inTree := func(peer *Peer, digest string) bool {
+		_, found, err := peer.DigestPath(digest)
+		c.Assert(err, gc.IsNil)
+		return found
+	}
+
+	path := filepath.Join(c.MkDir(), "ptree")
+	peer, err := NewPeer(st, path, recon.DefaultSettings())
+	c.Assert(err, gc.IsNil)
+	c.Assert(peer.updateDigests(storage.KeyAdded{Digest: stale}), gc.IsNil)
+
+	report, err := peer.VerifyPrefixTree()
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Removed, gc.Equals, 1)
+	c.Assert(report.Inserted, gc.Equals, 1)
+	c.Assert(inTree(peer, stale), gc.Equals, true)
+
+	rebuilt, err := peer.RebuildPrefixTree()
+	c.Assert(err, gc.IsNil)
+	c.Assert(rebuilt.Elements, gc.Equals, 1)
+	c.Assert(inTree(peer, digest), gc.Equals, true)
+	c.Assert(inTree(peer, stale), gc.Equals, false)
+	_, err = os.Stat(path + ".rebuild")
+	c.Assert(os.IsNotExist(err), gc.Equals, true)
+
+	report, err = peer.VerifyPrefixTree()
+	c.Assert(err, gc.IsNil)
+	c.Assert(*report, gc.DeepEquals, ScrubReport{Nodes: report.Nodes})
+
+	// A live prefix tree is repaired with Scrub instead.
+	peer.Start()
+	defer peer.Stop()
+	_, err = peer.RebuildPrefixTree()
+	c.Assert(err, gc.ErrorMatches, "cannot rebuild the prefix tree while recon is running")
+}
+
+func (s *SksSuite) TestCapabilitiesExpire(c *gc.C) {
+	clk := clock.NewFake(time.Date(2026, 3, 10, 12, 30, 0, 0, time.UTC))
+	peer, err := NewPeer(mock.NewStorage(), c.MkDir(), recon.DefaultSettings(), Clock(clk))
+	c.Assert(err, gc.IsNil)
+	defer peer.Stop()
+	peer.caps.set("192.0.2.1:11371", Capabilities{Compression: true})
+	caps, ok := peer.caps.get("192.0.2.1:11371")
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(caps.Compression, gc.Equals, true)
+
+	clk.Advance(capabilitiesTTL + time.Second)
+	_, ok = peer.caps.get("192.0.2.1:11371")
+	c.Assert(ok, gc.Equals, false)
+}
+
+func (s *SksSuite) TestStatsRetention(c *gc.C) {
+	now := time.Date(2026, 3, 10, 12, 30, 0, 0, time.UTC)
+	clk := clock.NewFake(now)
+	stats := NewStats()
+	stats.clock = clk
+	stats.Update(storage.KeyAdded{Digest: "decafbad"})
+	stats.UpdatePeerFailure("pgp.example.com:11371")
+	c.Assert(stats.Peers["pgp.example.com"].LastFailure, gc.Equals, now)
+
+	clk.Advance(25 * time.Hour)
+	stats.Update(storage.KeyAdded{Digest: "cafebabe"})
+	stats.prune()
+	c.Assert(stats.Hourly, gc.HasLen, 1)
+	c.Assert(stats.Daily, gc.HasLen, 2)
+
+	clk.Advance(7 * 24 * time.Hour)
+	stats.prune()
+	c.Assert(stats.Hourly, gc.HasLen, 0)
+	c.Assert(stats.Daily, gc.HasLen, 0)
+	c.Assert(stats.Total, gc.Equals, 2)
+}
+
+// fakeTransport records the addresses dialed, connecting over a pipe.
+type fakeTransport struct {
+	dialed []string
+}
+
+func (t *fakeTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	t.dialed = append(t.dialed, addr)
+	conn, _ := net.Pipe()
+	return conn, nil
+}
+
+func (t *fakeTransport) Listen(addr string) (net.Listener, error) {
+	return nil, errgo.New("not listening")
+}
+
+func (s *SksSuite) TestReconTransport(c *gc.C) {
+	_, err := NewPeer(mock.NewStorage(), c.MkDir(), recon.DefaultSettings(), ReconTransport("quic", &fakeTransport{}, ":11372"))
+	c.Assert(err, gc.ErrorMatches, `recon transport "quic" has no partners`)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gc.IsNil)
+	defer ln.Close()
+	settings := *recon.DefaultSettings()
+	settings.Partners = recon.PartnerMap{
+		"far":  recon.Partner{HTTPAddr: "far.example.com:11371", ReconAddr: "127.0.0.1:11370"},
+		"near": recon.Partner{HTTPAddr: "near.example.com:11371", ReconAddr: ln.Addr().String()},
+	}
+	t := &fakeTransport{}
+	peer, err := NewPeer(mock.NewStorage(), c.MkDir(), &settings, ReconTransport("quic", t, ":11372", "far"))
+	c.Assert(err, gc.IsNil)
+
+	// Partners using the transport are not gossiped with by conflux.
+	peer.mu.Lock()
+	gossip := peer.gossipSettings()
+	peer.mu.Unlock()
+	c.Assert(partnerNames(gossip.Partners), gc.DeepEquals, []string{"near"})
+	c.Assert(peer.Partners(), gc.HasLen, 2)
+
+	// The transport is used with partners advertising it.
+	peer.caps.set("far.example.com:11371", Capabilities{Transports: map[string]string{"quic": "far.example.com:11372"}})
+	conn, err := peer.dialPartner("far", settings.Partners["far"])
+	c.Assert(err, gc.IsNil)
+	conn.Close()
+	c.Assert(t.dialed, gc.DeepEquals, []string{"far.example.com:11372"})
+
+	// Other partners are reconciled with over TCP.
+	conn, err = peer.dialPartner("near", settings.Partners["near"])
+	c.Assert(err, gc.IsNil)
+	conn.Close()
+	c.Assert(t.dialed, gc.HasLen, 1)
+
+	c.Assert(peer.transportPartner("127.0.0.1"), gc.Equals, true)
+	c.Assert(peer.transportPartner("192.0.2.1"), gc.Equals, false)
+}
+
+// pipeNetwork is an in-memory Transport, connecting dialers to listeners
+// over pipes. Connections appear to come from the address set with
+// setFrom.
+type pipeNetwork struct {
+	mu        sync.Mutex
+	listeners map[string]*pipeListener
+	from      net.Addr
+	dialed    []string
+}
+
+func newPipeNetwork() *pipeNetwork {
+	n := &pipeNetwork{listeners: map[string]*pipeListener{}}
+	n.setFrom("127.0.0.1")
+	return n
+}
+
+func (n *pipeNetwork) setFrom(host string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.from = &net.TCPAddr{IP: net.ParseIP(host), Port: 40000}
+}
+
+func (n *pipeNetwork) listening(addr string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, ok := n.listeners[addr]
+	return ok
+}
+
+func (n *pipeNetwork) dials() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]string(nil), n.dialed...)
+}
+
+func (n *pipeNetwork) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	n.mu.Lock()
+	l, ok := n.listeners[addr]
+	from := n.from
+	n.dialed = append(n.dialed, addr)
+	n.mu.Unlock()
+	if !ok {
+		return nil, errgo.Newf("nothing listening at %q", addr)
+	}
+	client, server := net.Pipe()
+	select {
+	case l.conns <- &pipeConn{Conn: server, remote: from}:
+		return client, nil
+	case <-l.closed:
+		return nil, errgo.Newf("listener at %q closed", addr)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (n *pipeNetwork) Listen(addr string) (net.Listener, error) {
+	l := &pipeListener{addr: pipeAddr(addr), conns: make(chan net.Conn), closed: make(chan struct{})}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.listeners[addr] = l
+	return l, nil
+}
+
+type pipeListener struct {
+	addr   pipeAddr
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errgo.New("listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return l.addr
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// pipeConn is a pipe with the remote address of its dialer.
+type pipeConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (s *SksSuite) TestReconOverTransport(c *gc.C) {
+	network := newPipeNetwork()
+	newPeer := func(name, partner string) *Peer {
+		settings := *recon.DefaultSettings()
+		settings.ReconAddr = "127.0.0.1:0"
+		settings.Partners = recon.PartnerMap{
+			partner: recon.Partner{HTTPAddr: partner + ".example.com:11371", ReconAddr: "127.0.0.1:11370"},
+		}
+		peer, err := NewPeer(mock.NewStorage(), c.MkDir(), &settings,
+			PrefixTreeBackend(MemoryPrefixTree), ReconTransport("pipe", network, name, partner))
+		c.Assert(err, gc.IsNil)
+		return peer
+	}
+	alice, bob := newPeer("alice", "bob"), newPeer("bob", "alice")
+	alice.Start()
+	defer alice.Stop()
+	bob.Start()
+	defer bob.Stop()
+	for i := 0; i < 100 && !(alice.Active() && bob.Active() && network.listening("bob")); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(network.listening("bob"), gc.Equals, true)
+
+	// Partners reconcile over the transport they advertise.
+	alice.caps.set("bob.example.com:11371", Capabilities{Transports: map[string]string{"pipe": "bob"}})
+	c.Assert(alice.ReconcileWith("bob"), gc.IsNil)
+	c.Assert(network.dials(), gc.DeepEquals, []string{"bob"})
+
+	// Connections from hosts which are not partners are closed unread.
+	network.setFrom("192.0.2.1")
+	conn, err := network.Dial(context.Background(), "bob")
+	c.Assert(err, gc.IsNil)
+	defer conn.Close()
+	c.Assert(conn.SetReadDeadline(time.Now().Add(5*time.Second)), gc.IsNil)
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, gc.Equals, io.EOF)
+}
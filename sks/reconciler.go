@@ -0,0 +1,206 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"sync"
+
+	"gopkg.in/errgo.v1"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+	"gopkg.in/hockeypuck/conflux.v2/recon"
+	log "gopkg.in/hockeypuck/logrus.v0"
+)
+
+// Reconciler is a set reconciliation scheme, which finds the key digests held
+// by recon partners that are missing locally. The Peer keeps each reconciler
+// informed of local digest changes, and requests the keys for digests it
+// recovers from partners by hashquery.
+type Reconciler interface {
+	// Start starts reconciling with partners.
+	Start()
+	// Stop stops reconciling with partners.
+	Stop() error
+	// Insert adds local key digests to the reconciled set.
+	Insert(z ...*cf.Zp)
+	// Remove removes local key digests from the reconciled set.
+	Remove(z ...*cf.Zp)
+	// Recovered returns a channel which receives the digests held by a
+	// partner that are missing locally.
+	Recovered() <-chan *recon.Recover
+}
+
+// ReconcilerFactory returns a new Reconciler. The prefix tree is maintained
+// by the default reconciler; others may read it, but must keep any state of
+// their own elsewhere.
+type ReconcilerFactory func(s *recon.Settings, ptree recon.PrefixTree) (Reconciler, error)
+
+// DefaultReconciler is the name of the SKS prefix tree reconciler, which is
+// always used.
+const DefaultReconciler = "sks"
+
+type namedReconciler struct {
+	name    string
+	factory ReconcilerFactory
+}
+
+// WithReconciler adds an alternative reconciliation scheme, such as one based
+// on invertible Bloom lookup tables, which runs alongside the default SKS
+// prefix tree reconciler. Each reconciler negotiates with the partners which
+// support it, for example by consulting their advertised Capabilities.
+func WithReconciler(name string, f ReconcilerFactory) PeerOption {
+	return func(p *Peer) error {
+		if name == DefaultReconciler {
+			return errgo.Newf("reconciler %q is reserved", name)
+		}
+		for _, nr := range p.reconcilers {
+			if nr.name == name {
+				return errgo.Newf("duplicate reconciler %q", name)
+			}
+		}
+		p.reconcilers = append(p.reconcilers, namedReconciler{name: name, factory: f})
+		return nil
+	}
+}
+
+// ReconcilerNames returns the names of the reconciliation schemes used by
+// the peer, for advertising in Capabilities.
+func (r *Peer) ReconcilerNames() []string {
+	names := []string{DefaultReconciler}
+	for _, nr := range r.reconcilers {
+		names = append(names, nr.name)
+	}
+	return names
+}
+
+type ptreeReconciler struct {
+	*recon.Peer
+}
+
+func (r *ptreeReconciler) Recovered() <-chan *recon.Recover {
+	return r.RecoverChan
+}
+
+// gossipSettings returns the settings of the SKS prefix tree reconciler:
+// the peer's settings, without the partners reconciled with over a
+// transport, nor those with mismatched prefix tree parameters, so that they
+// are not chosen for gossip. r.mu must be held.
+func (r *Peer) gossipSettings() *recon.Settings {
+	settings := *r.settings
+	settings.Partners = recon.PartnerMap{}
+	for name, partner := range r.settings.Partners {
+		if r.transport != nil && r.transport.partners[name] {
+			continue
+		}
+		if r.mismatched.excluded(name) {
+			log.Warningf("not gossiping with partner %q, which has mismatched prefix tree parameters", name)
+			continue
+		}
+		settings.Partners[name] = partner
+	}
+	return &settings
+}
+
+// newReconciler returns the default reconciler, combined with any
+// alternatives configured.
+func (p *Peer) newReconciler(ptree recon.PrefixTree) (Reconciler, error) {
+	var result Reconciler = &ptreeReconciler{recon.NewPeer(p.gossipSettings(), ptree)}
+	if len(p.reconcilers) == 0 {
+		return result, nil
+	}
+	m := &multiReconciler{
+		reconcilers: []Reconciler{result},
+		recovered:   make(chan *recon.Recover),
+	}
+	for _, nr := range p.reconcilers {
+		rc, err := nr.factory(p.settings, ptree)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot create reconciler %q", nr.name)
+		}
+		m.reconcilers = append(m.reconcilers, rc)
+	}
+	return m, nil
+}
+
+// multiReconciler runs several reconcilers together, merging the digests
+// they recover.
+type multiReconciler struct {
+	reconcilers []Reconciler
+	recovered   chan *recon.Recover
+	done        chan struct{}
+	wg          sync.WaitGroup
+}
+
+func (m *multiReconciler) Start() {
+	m.done = make(chan struct{})
+	for _, rc := range m.reconcilers {
+		rc.Start()
+		m.wg.Add(1)
+		go m.forward(rc.Recovered())
+	}
+}
+
+func (m *multiReconciler) forward(ch <-chan *recon.Recover) {
+	defer m.wg.Done()
+	for {
+		select {
+		case <-m.done:
+			return
+		case rcvr, ok := <-ch:
+			if !ok {
+				return
+			}
+			select {
+			case m.recovered <- rcvr:
+			case <-m.done:
+				return
+			}
+		}
+	}
+}
+
+func (m *multiReconciler) Stop() error {
+	if m.done != nil {
+		close(m.done)
+		m.wg.Wait()
+	}
+	var result error
+	for _, rc := range m.reconcilers {
+		err := rc.Stop()
+		if err != nil && result == nil {
+			result = errgo.Mask(err)
+		}
+	}
+	return result
+}
+
+func (m *multiReconciler) Insert(z ...*cf.Zp) {
+	for _, rc := range m.reconcilers {
+		rc.Insert(z...)
+	}
+}
+
+func (m *multiReconciler) Remove(z ...*cf.Zp) {
+	for _, rc := range m.reconcilers {
+		rc.Remove(z...)
+	}
+}
+
+func (m *multiReconciler) Recovered() <-chan *recon.Recover {
+	return m.recovered
+}
@@ -0,0 +1,162 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"gopkg.in/errgo.v1"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+	log "gopkg.in/hockeypuck/logrus.v0"
+)
+
+// RecoveryFilename returns the path of the recovery queue for the prefix
+// tree at path.
+func RecoveryFilename(path string) string {
+	dir, base := filepath.Dir(path), filepath.Base(path)
+	return filepath.Join(dir, "."+base+".recovery")
+}
+
+// recoveryQueue persists the digests outstanding from recoveries in
+// progress, keyed by partner HKP address, so that a recovery interrupted by
+// a crash or a drain timeout is resumed when the peer is next started,
+// rather than waiting for a recon round to find the digests again.
+type recoveryQueue struct {
+	path   string
+	sealer *sealer
+
+	mu      sync.Mutex
+	pending map[string][]string
+}
+
+// openRecoveryQueue reads the recovery queue at path. If sealer is not nil,
+// the queue is encrypted.
+func openRecoveryQueue(path string, sealer *sealer) (*recoveryQueue, error) {
+	q := &recoveryQueue{path: path, sealer: sealer, pending: map[string][]string{}}
+	var err error
+	if sealer != nil {
+		err = sealer.readJSON(path, &q.pending)
+	} else {
+		var buf []byte
+		buf, err = ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			return q, nil
+		} else if err == nil {
+			err = json.Unmarshal(buf, &q.pending)
+		}
+	}
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read recovery queue %q", path)
+	}
+	return q, nil
+}
+
+// set records the digests outstanding from the partner at hkpAddr,
+// replacing any recorded before. An empty list removes the partner.
+func (q *recoveryQueue) set(hkpAddr string, items []*cf.Zp) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(items) == 0 {
+		if _, ok := q.pending[hkpAddr]; !ok {
+			return nil
+		}
+		delete(q.pending, hkpAddr)
+	} else {
+		digests := make([]string, len(items))
+		for i, z := range items {
+			digests[i] = hex.EncodeToString(hashqueryElement(z))
+		}
+		q.pending[hkpAddr] = digests
+	}
+	return errgo.Mask(q.write())
+}
+
+// write replaces the queue file, so that a crash while writing leaves the
+// previous queue intact.
+func (q *recoveryQueue) write() error {
+	tmp := q.path + ".tmp"
+	var err error
+	if q.sealer != nil {
+		err = q.sealer.writeJSON(tmp, q.pending)
+	} else {
+		var buf []byte
+		buf, err = json.Marshal(q.pending)
+		if err == nil {
+			err = ioutil.WriteFile(tmp, buf, 0600)
+		}
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(os.Rename(tmp, q.path))
+}
+
+// partners returns the HKP addresses of partners with outstanding digests.
+func (q *recoveryQueue) partners() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var result []string
+	for hkpAddr := range q.pending {
+		result = append(result, hkpAddr)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// items returns the digests outstanding from the partner at hkpAddr.
+// Invalid digests are logged and skipped.
+func (q *recoveryQueue) items(hkpAddr string) []*cf.Zp {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var result []*cf.Zp
+	for _, digest := range q.pending[hkpAddr] {
+		z, err := DigestZp(digest)
+		if err != nil {
+			log.Warningf("bad digest %q in recovery queue: %v", digest, err)
+			continue
+		}
+		result = append(result, z)
+	}
+	return result
+}
+
+// resumeRecovery requests the digests left in the recovery queue when the
+// peer last stopped.
+func (r *Peer) resumeRecovery(ctx context.Context) error {
+	for _, remoteAddr := range r.recovery.partners() {
+		items := r.recovery.items(remoteAddr)
+		log.Infof("resuming recovery of %d keys from %q", len(items), remoteAddr)
+		err := r.recoverItems(ctx, remoteAddr, items)
+		if ctx.Err() != nil {
+			return errgo.Mask(ctx.Err(), errgo.Any)
+		} else if err != nil {
+			log.Errorf("resumed recovery from %q failed: %v", remoteAddr, err)
+			r.stats.UpdateRecoveryErrors()
+			r.stats.UpdatePeerFailure(remoteAddr)
+		}
+	}
+	return nil
+}
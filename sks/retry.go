@@ -0,0 +1,143 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"encoding/hex"
+	"sync"
+	"time"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+
+	"gopkg.in/hockeypuck/hkp.v1/metrics"
+	log "gopkg.in/hockeypuck/logrus.v0"
+)
+
+// maxKeyRecoveryAttempts is how many times recovering a digest from a
+// partner may fail before it is dropped.
+const maxKeyRecoveryAttempts = 10
+
+var (
+	// recoveryBackoff is how long to wait before retrying a digest whose
+	// recovery failed. It doubles with each further failure, up to
+	// maxRecoveryBackoff.
+	recoveryBackoff    = time.Minute
+	maxRecoveryBackoff = 6 * time.Hour
+)
+
+type recoveryAttempt struct {
+	failures int
+	next     time.Time
+}
+
+// recoveryTracker tracks failures to recover digests from each partner.
+// Recon rediscovers the digests still missing each round, so failed digests
+// are retried by skipping them until their backoff has elapsed.
+type recoveryTracker struct {
+	mu       sync.Mutex
+	attempts map[string]map[string]*recoveryAttempt
+	dropped  map[string]map[string]bool
+}
+
+// due returns the digests which may be requested from partner at now.
+func (t *recoveryTracker) due(partner string, digests []*cf.Zp, now time.Time) []*cf.Zp {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var result []*cf.Zp
+	for _, z := range digests {
+		digest := hex.EncodeToString(hashqueryElement(z))
+		if t.dropped[partner][digest] {
+			continue
+		}
+		if a, ok := t.attempts[partner][digest]; ok && now.Before(a.next) {
+			continue
+		}
+		result = append(result, z)
+	}
+	return result
+}
+
+// succeeded forgets past failures to recover digest from partner.
+func (t *recoveryTracker) succeeded(partner, digest string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.attempts[partner], digest)
+}
+
+// failed records a failure to recover digest from partner at now, and
+// returns whether the digest has now been dropped.
+func (t *recoveryTracker) failed(partner, digest string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.attempts == nil {
+		t.attempts = map[string]map[string]*recoveryAttempt{}
+		t.dropped = map[string]map[string]bool{}
+	}
+	if t.attempts[partner] == nil {
+		t.attempts[partner] = map[string]*recoveryAttempt{}
+	}
+	a, ok := t.attempts[partner][digest]
+	if !ok {
+		a = &recoveryAttempt{}
+		t.attempts[partner][digest] = a
+	}
+	a.failures++
+	if a.failures >= maxKeyRecoveryAttempts {
+		delete(t.attempts[partner], digest)
+		if t.dropped[partner] == nil {
+			t.dropped[partner] = map[string]bool{}
+		}
+		t.dropped[partner][digest] = true
+		return true
+	}
+	backoff := recoveryBackoff << uint(a.failures-1)
+	if backoff > maxRecoveryBackoff || backoff <= 0 {
+		backoff = maxRecoveryBackoff
+	}
+	a.next = now.Add(backoff)
+	return false
+}
+
+// retrying returns the number of digests awaiting retry from each partner.
+func (t *recoveryTracker) retrying() map[string]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	result := map[string]int{}
+	for partner, attempts := range t.attempts {
+		if len(attempts) > 0 {
+			result[partner] = len(attempts)
+		}
+	}
+	return result
+}
+
+// trackRecovery records which digests in chunk were received from partner.
+func (r *Peer) trackRecovery(partner string, chunk []*cf.Zp, received map[string]bool) {
+	now := r.clock.Now()
+	for _, z := range chunk {
+		digest := hex.EncodeToString(hashqueryElement(z))
+		if received[digest] {
+			r.retries.succeeded(partner, digest)
+		} else if r.retries.failed(partner, digest, now) {
+			log.Warningf("dropping digest %s after %d failed attempts to recover it from %q",
+				digest, maxKeyRecoveryAttempts, partner)
+			r.stats.UpdateDroppedDigests()
+			metrics.DigestDropped()
+		}
+	}
+}
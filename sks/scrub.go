@@ -0,0 +1,279 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+	"gopkg.in/hockeypuck/conflux.v2/recon"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+	log "gopkg.in/hockeypuck/logrus.v0"
+)
+
+// ScrubInterval enables a background job which scrubs the prefix tree at the
+// given interval, repairing any corruption found. Scrubbing is disabled by
+// default.
+func ScrubInterval(d time.Duration) PeerOption {
+	return func(p *Peer) error {
+		if d < 0 {
+			return errgo.Newf("invalid scrub interval %v", d)
+		}
+		p.scrubInterval = d
+		return nil
+	}
+}
+
+// ScrubReport describes the outcome of scrubbing the prefix tree.
+type ScrubReport struct {
+	// Nodes is the number of prefix tree nodes checked.
+	Nodes int
+	// Corrupt is the number of nodes whose size or sample values do not
+	// match their contents, or which could not be read.
+	Corrupt int
+	// Unreadable is the number of nodes which could not be read. Their
+	// elements are restored from storage on repair.
+	Unreadable int
+	// Removed is the number of elements removed from the prefix tree,
+	// either because they were in a corrupt subtree or because they are not
+	// in storage.
+	Removed int
+	// Inserted is the number of digests in storage which were missing from
+	// the prefix tree.
+	Inserted int
+}
+
+// Scrub checks every node of the prefix tree for consistency and compares its
+// elements with the keys in storage. A leaf's sample values are a checksum of
+// its elements, and an interior node's are the product of its children's, so
+// corruption can be localized to a subtree.
+//
+// If repair is set, the elements of corrupt subtrees are removed and every
+// digest in storage missing from the prefix tree is inserted. Corruption
+// which survives repair requires the prefix tree to be rebuilt.
+//
+// Storage is listed before the prefix tree is locked, so that digest changes
+// are applied meanwhile; those changed while it is listed are left alone.
+func (r *Peer) Scrub(repair bool) (*ScrubReport, error) {
+	r.scrubMu.Lock()
+	defer r.scrubMu.Unlock()
+
+	r.mu.Lock()
+	ptree := r.ptree
+	if ptree == nil {
+		r.mu.Unlock()
+		return nil, errgo.Notef(r.degraded, "prefix tree unavailable")
+	}
+	if repair && r.readOnly {
+		r.mu.Unlock()
+		return nil, errgo.New("cannot repair a read-only prefix tree")
+	}
+	r.scrubChanged = map[string]bool{}
+	r.mu.Unlock()
+
+	digests, err := storageDigests(r.storage, r.blocklist)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changed := r.scrubChanged
+	r.scrubChanged = nil
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if r.ptree != ptree {
+		return nil, errgo.New("prefix tree replaced while scrubbing")
+	}
+
+	root, err := r.ptree.Root()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	s := &scrubber{
+		points:   r.ptree.Points(),
+		report:   &ScrubReport{},
+		healthy:  map[string]bool{},
+		suspect:  map[string]*cf.Zp{},
+		elements: map[string]*cf.Zp{},
+	}
+	s.checkNode(root)
+
+	var remove, insert []*cf.Zp
+	for k, z := range s.suspect {
+		delete(s.healthy, k)
+		if !changed[k] {
+			remove = append(remove, z)
+		}
+	}
+	for k := range s.healthy {
+		if _, ok := digests[k]; !ok && !changed[k] {
+			z, err := s.element(k)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			remove = append(remove, z)
+		}
+	}
+	for k, z := range digests {
+		if !s.healthy[k] && !changed[k] {
+			insert = append(insert, z)
+		}
+	}
+	s.report.Removed, s.report.Inserted = len(remove), len(insert)
+
+	if repair && (len(remove) > 0 || len(insert) > 0) {
+		log.Warningf("prefix tree scrub: repairing %d corrupt nodes, removing %d and inserting %d elements",
+			s.report.Corrupt, len(remove), len(insert))
+		r.peer.Remove(remove...)
+		r.peer.Insert(insert...)
+	}
+	return s.report, nil
+}
+
+func (r *Peer) scrubPrefixTree() error {
+	timer := r.clock.NewTimer(r.scrubInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-r.t.Dying():
+			return nil
+		case <-timer.C():
+			report, err := r.Scrub(true)
+			if err != nil {
+				log.Errorf("prefix tree scrub failed: %v", errgo.Details(err))
+			} else {
+				log.Infof("prefix tree scrub: %+v", report)
+			}
+			timer.Reset(r.scrubInterval)
+		}
+	}
+}
+
+type scrubber struct {
+	points []*cf.Zp
+	report *ScrubReport
+
+	// healthy contains the elements of consistent leaves.
+	healthy map[string]bool
+	// suspect contains the elements of corrupt subtrees.
+	suspect map[string]*cf.Zp
+	// elements indexes every element seen by its key.
+	elements map[string]*cf.Zp
+}
+
+func (s *scrubber) element(k string) (*cf.Zp, error) {
+	z, ok := s.elements[k]
+	if !ok {
+		return nil, errgo.Newf("unknown element %q", k)
+	}
+	return z, nil
+}
+
+// checkNode checks node and its descendants, returning all the elements in
+// the subtree which could be read. A node which cannot be read is corrupt,
+// and so are its ancestors, as their contents no longer match.
+func (s *scrubber) checkNode(node recon.PrefixNode) []*cf.Zp {
+	s.report.Nodes++
+	var elements []*cf.Zp
+	var children []recon.PrefixNode
+	var err error
+	if node.IsLeaf() {
+		elements, err = node.Elements()
+	} else {
+		children, err = node.Children()
+	}
+	if err != nil {
+		log.Warningf("prefix tree scrub: cannot read node: %v", errgo.Details(err))
+		s.report.Corrupt++
+		s.report.Unreadable++
+		return nil
+	}
+	if node.IsLeaf() {
+		for _, z := range elements {
+			k := z.String()
+			s.elements[k] = z
+			s.healthy[k] = true
+		}
+	}
+	for _, child := range children {
+		elements = append(elements, s.checkNode(child)...)
+	}
+
+	if !s.consistent(node, children, elements) {
+		s.report.Corrupt++
+		for _, z := range elements {
+			s.suspect[z.String()] = z
+		}
+	}
+	return elements
+}
+
+// consistent returns whether the size and sample values of node match its
+// contents.
+func (s *scrubber) consistent(node recon.PrefixNode, children []recon.PrefixNode, elements []*cf.Zp) bool {
+	if node.Size() != len(elements) {
+		return false
+	}
+	svalues := node.SValues()
+	if len(svalues) != len(s.points) {
+		return false
+	}
+	for _, child := range children {
+		if len(child.SValues()) != len(s.points) {
+			return false
+		}
+	}
+	for i, point := range s.points {
+		expect := cf.Zi(cf.P_SKS, 1)
+		if node.IsLeaf() {
+			for _, z := range elements {
+				expect.Mul(expect, cf.Z(cf.P_SKS).Sub(point, z))
+			}
+		} else {
+			for _, child := range children {
+				expect.Mul(expect, child.SValues()[i])
+			}
+		}
+		if expect.Cmp(svalues[i]) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// storageDigests returns the prefix tree elements for every key in storage
+// whose digest is not blocked.
+func storageDigests(st storage.Storage, b *blocklist) (map[string]*cf.Zp, error) {
+	digests, err := storage.Digests(st)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	result := map[string]*cf.Zp{}
+	for _, digest := range digests {
+		if b.has(digest) {
+			continue
+		}
+		z, err := DigestZp(digest)
+		if err != nil {
+			return nil, errgo.Notef(err, "bad digest %q", digest)
+		}
+		result[z.String()] = z
+	}
+	return result, nil
+}
@@ -0,0 +1,216 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"time"
+
+	"gopkg.in/errgo.v1"
+	log "gopkg.in/hockeypuck/logrus.v0"
+
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+)
+
+// ReconLease is the name of the lease held by the active peer of servers
+// sharing storage.
+const ReconLease = "recon"
+
+// DefaultLeaseTTL is how long the recon lease is held by default without
+// being renewed.
+const DefaultLeaseTTL = 30 * time.Second
+
+// standby coordinates which of the servers sharing storage runs recon.
+type standby struct {
+	leaser storage.Leaser
+	holder string
+	ttl    time.Duration
+
+	// active is set while this peer holds the lease and runs recon.
+	active bool
+	// lost is why this peer stopped running recon, if it lost the lease.
+	lost error
+}
+
+// Standby runs the peer as one of a redundant pair (or more) of servers
+// sharing storage, only one of which, the active peer, runs recon at a time
+// so that partners are not gossiped with twice and no two prefix trees
+// conflict. The others keep their prefix trees up to date as standbys until
+// they acquire the recon lease from storage, which must implement
+// storage.Leaser, identifying themselves as holder.
+//
+// The active peer renews the lease every third of ttl. A standby acquiring
+// it once it expires scrubs its prefix tree against storage, renewing the
+// lease meanwhile, before starting recon. Storage errors are retried, as the
+// other servers cannot acquire the lease from storage they cannot reach
+// either. An active peer whose lease is acquired by another stops recon,
+// and reports that it has done so through CheckRecon, until it is restarted
+// as a standby.
+func Standby(holder string, ttl time.Duration) PeerOption {
+	return func(p *Peer) error {
+		leaser, ok := p.storage.(storage.Leaser)
+		if !ok {
+			return errgo.New("storage does not support leases")
+		}
+		if holder == "" {
+			return errgo.New("standby requires a lease holder name")
+		}
+		if ttl <= 0 {
+			ttl = DefaultLeaseTTL
+		}
+		p.standby = &standby{leaser: leaser, holder: holder, ttl: ttl}
+		return nil
+	}
+}
+
+// Active returns whether the peer runs recon: it is started, and either not
+// a standby or holding the recon lease.
+func (r *Peer) Active() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reconciling()
+}
+
+// reconciling returns whether recon should run. r.mu must be held.
+func (r *Peer) reconciling() bool {
+	return r.started && (r.standby == nil || r.standby.active)
+}
+
+// coordinate acquires and renews the recon lease, starting recon once it is
+// acquired and stopping it if it is lost.
+func (r *Peer) coordinate() error {
+	sb := r.standby
+	ticker := r.clock.NewTicker(sb.ttl / 3)
+	defer ticker.Stop()
+	for {
+		r.mu.Lock()
+		active, ready := sb.active, r.peer != nil
+		r.mu.Unlock()
+
+		// A peer without its prefix tree stands by, so that another may
+		// take over.
+		if active || ready {
+			held, err := sb.leaser.AcquireLease(ReconLease, sb.holder, sb.ttl)
+			switch {
+			case err != nil:
+				// The lease is not known to be held by another, so it
+				// is tried again on the next tick.
+				log.Warningf("cannot acquire recon lease: %v", errgo.Details(err))
+			case active && !held:
+				r.demote(errgo.New("recon lease lost"))
+				return nil
+			case !active && held:
+				r.promote()
+			}
+		}
+
+		select {
+		case <-r.t.Dying():
+			r.mu.Lock()
+			active = sb.active
+			r.mu.Unlock()
+			if active {
+				err := sb.leaser.ReleaseLease(ReconLease, sb.holder)
+				if err != nil {
+					log.Warningf("cannot release recon lease: %v", errgo.Details(err))
+				}
+			}
+			return nil
+		case <-ticker.C():
+		}
+	}
+}
+
+// promote starts recon once the recon lease is acquired, after bringing the
+// prefix tree up to date with the keys the previous active peer stored.
+func (r *Peer) promote() {
+	log.Infof("acquired recon lease as %q, scrubbing prefix tree", r.standby.holder)
+	release := r.holdLease()
+	report, err := r.Scrub(true)
+	lost := release()
+	if err != nil {
+		log.Errorf("prefix tree scrub failed: %v", errgo.Details(err))
+	} else {
+		log.Infof("prefix tree scrub: %+v", report)
+	}
+	if lost {
+		log.Warningf("recon lease lost while scrubbing the prefix tree, standing by")
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.peer == nil {
+		return
+	}
+	select {
+	case <-r.t.Dying():
+		return
+	default:
+	}
+	r.standby.active = true
+	r.startRecon()
+	log.Infof("recon started as the active peer")
+}
+
+// holdLease renews the recon lease every third of its ttl in the
+// background, until the returned function is called, which returns whether
+// the lease was acquired by another meanwhile.
+func (r *Peer) holdLease() func() bool {
+	sb := r.standby
+	done, lost := make(chan struct{}), make(chan bool, 1)
+	go func() {
+		ticker := r.clock.NewTicker(sb.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				lost <- false
+				return
+			case <-ticker.C():
+			}
+			held, err := sb.leaser.AcquireLease(ReconLease, sb.holder, sb.ttl)
+			if err != nil {
+				log.Warningf("cannot renew recon lease: %v", errgo.Details(err))
+				continue
+			}
+			if !held {
+				lost <- true
+				return
+			}
+		}
+	}()
+	return func() bool {
+		close(done)
+		return <-lost
+	}
+}
+
+// demote stops recon after the recon lease is lost.
+func (r *Peer) demote(err error) {
+	log.Errorf("stopping recon: %v", errgo.Details(err))
+	r.mu.Lock()
+	r.standby.active = false
+	r.standby.lost = err
+	peer := r.peer
+	r.mu.Unlock()
+	if peer != nil {
+		if err := peer.Stop(); err != nil {
+			log.Errorf("error stopping recon: %v", errgo.Details(err))
+		}
+	}
+}
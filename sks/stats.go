@@ -19,11 +19,13 @@ package sks
 
 import (
 	"encoding/json"
+	"net"
 	"os"
 	"sync"
 	"time"
 
 	"gopkg.in/errgo.v1"
+	"gopkg.in/hockeypuck/hkp.v1/clock"
 	"gopkg.in/hockeypuck/hkp.v1/storage"
 )
 
@@ -58,18 +60,108 @@ func (m LoadStatMap) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+func (ls *LoadStat) update(kc storage.KeyChange) {
+	switch kc.(type) {
+	case storage.KeyAdded:
+		ls.Inserted++
+	case storage.KeyReplaced:
+		ls.Updated++
+	}
+}
+
 func (m LoadStatMap) update(t time.Time, kc storage.KeyChange) {
 	ls, ok := m[t]
 	if !ok {
 		ls = &LoadStat{}
 		m[t] = ls
 	}
-	switch kc.(type) {
-	case storage.KeyAdded:
-		ls.Inserted++
-	case storage.KeyReplaced:
-		ls.Updated++
+	ls.update(kc)
+}
+
+// Sources of key changes attributed in Stats.Sources. Keys recovered from
+// recon partners are attributed to ReconSource(partner), or to SourceRecon
+// where partners are not distinguished.
+const (
+	SourceAdd   = "add"
+	SourceLoad  = "load"
+	SourceRecon = "recon"
+	SourceAdmin = "admin"
+)
+
+// ReconSource returns the source attributed to keys recovered from the recon
+// partner at the given HKP address.
+func ReconSource(hkpAddr string) string {
+	return SourceRecon + ":" + peerName(hkpAddr)
+}
+
+// PeerStat describes the history of recon with a partner.
+type PeerStat struct {
+	// LastRecon is when keys were last successfully recovered from the
+	// partner after a recon round.
+	LastRecon time.Time
+	// LastFailure is when recon or recovery with the partner last failed.
+	LastFailure time.Time
+	// Recovered counts keys inserted and updated from the partner.
+	Recovered int
+	// Failures counts failed attempts to recover keys from the partner.
+	Failures int
+	// Hashqueries counts hashquery requests made to the partner, and
+	// HashqueryLatency is their average latency until the response began,
+	// in seconds.
+	Hashqueries      int
+	HashqueryLatency float64
+}
+
+// peerName returns the name by which the recon partner at the given HKP
+// address is known in Stats.Peers: its host, as in ReconSource.
+func peerName(hkpAddr string) string {
+	if host, _, err := net.SplitHostPort(hkpAddr); err == nil {
+		return host
 	}
+	return hkpAddr
+}
+
+// PacketStat counts packets accepted into storage and dropped by
+// filtering, such as duplicate removal.
+type PacketStat struct {
+	Accepted int
+	Dropped  int
+}
+
+type PacketStatMap map[time.Time]*PacketStat
+
+func (m PacketStatMap) MarshalJSON() ([]byte, error) {
+	doc := map[string]*PacketStat{}
+	for k, v := range m {
+		doc[k.Format(time.RFC3339)] = v
+	}
+	return json.Marshal(&doc)
+}
+
+func (m PacketStatMap) UnmarshalJSON(b []byte) error {
+	doc := map[string]*PacketStat{}
+	err := json.Unmarshal(b, &doc)
+	if err != nil {
+		return err
+	}
+	for k, v := range doc {
+		t, err := time.Parse(time.RFC3339, k)
+		if err != nil {
+			return err
+		}
+		m[t] = v
+	}
+	return nil
+}
+
+func (m PacketStatMap) update(t time.Time, pc storage.PacketCounts) {
+	ps, ok := m[t]
+	if !ok {
+		ps = &PacketStat{}
+		m[t] = ps
+	}
+	ps.Accepted += pc.Accepted
+	ps.Dropped += pc.Dropped
 }
 
 type Stats struct {
@@ -78,18 +170,64 @@ type Stats struct {
 	mu     sync.Mutex
 	Hourly LoadStatMap
 	Daily  LoadStatMap
+
+	// Packets counts accepted and dropped packets by day.
+	Packets PacketStatMap
+
+	// Sources counts keys inserted and updated by where they came from.
+	Sources map[string]*LoadStat `json:",omitempty"`
+
+	// Mismatched counts keys rejected from recon partners because their
+	// digests did not match those requested.
+	Mismatched int `json:",omitempty"`
+	// Diverged counts keys recovered from recon partners which were
+	// stored with digests other than those requested, once merged.
+	Diverged int `json:",omitempty"`
+	// Rejected counts keys refused by policy, such as the key parse mode.
+	Rejected int `json:",omitempty"`
+	// RecoveryErrors counts failed attempts to recover keys from recon
+	// partners.
+	RecoveryErrors int `json:",omitempty"`
+	// DroppedDigests counts digests no longer requested from a partner
+	// after repeatedly failing to recover them.
+	DroppedDigests int `json:",omitempty"`
+	// Peers describes recon with each partner, by host.
+	Peers map[string]*PeerStat `json:",omitempty"`
+
+	// RetryingDigests counts digests awaiting retry, by partner.
+	RetryingDigests map[string]int `json:",omitempty"`
+
+	// Degraded reports why the prefix tree is unavailable, if it is.
+	Degraded string `json:",omitempty"`
+	// PendingDigests counts digest changes queued while degraded.
+	PendingDigests int `json:",omitempty"`
+	// QueuedKeys counts recovered keys waiting to be merged into storage.
+	QueuedKeys int `json:",omitempty"`
+
+	clock clock.Clock
 }
 
 func NewStats() *Stats {
 	return &Stats{
-		Hourly: LoadStatMap{},
-		Daily:  LoadStatMap{},
+		Hourly:  LoadStatMap{},
+		Daily:   LoadStatMap{},
+		Packets: PacketStatMap{},
+		Sources: map[string]*LoadStat{},
+		Peers:   map[string]*PeerStat{},
 	}
 }
 
+// now returns the current time by the clock of the peer keeping s.
+func (s *Stats) now() time.Time {
+	if s.clock == nil {
+		return time.Now().UTC()
+	}
+	return s.clock.Now().UTC()
+}
+
 func (s *Stats) prune() {
-	yesterday := time.Now().UTC().Add(-24 * time.Hour)
-	lastWeek := time.Now().UTC().Add(-24 * 7 * time.Hour)
+	yesterday := s.now().Add(-24 * time.Hour)
+	lastWeek := s.now().Add(-24 * 7 * time.Hour)
 	s.mu.Lock()
 	for k := range s.Hourly {
 		if k.Before(yesterday) {
@@ -101,26 +239,157 @@ func (s *Stats) prune() {
 			delete(s.Daily, k)
 		}
 	}
+	for k := range s.Packets {
+		if k.Before(lastWeek) {
+			delete(s.Packets, k)
+		}
+	}
 	s.mu.Unlock()
 }
 
 func (s *Stats) Update(kc storage.KeyChange) {
 	s.mu.Lock()
-	s.Hourly.update(time.Now().UTC().Truncate(time.Hour), kc)
-	s.Daily.update(time.Now().UTC().Truncate(24*time.Hour), kc)
+	s.Hourly.update(s.now().Truncate(time.Hour), kc)
+	s.Daily.update(s.now().Truncate(24*time.Hour), kc)
 	switch kc.(type) {
 	case storage.KeyAdded:
 		s.Total++
+	case storage.KeyRemoved:
+		s.Total--
 	}
 	s.mu.Unlock()
 }
 
+// UpdatePackets records packets accepted and dropped while storing a key.
+func (s *Stats) UpdatePackets(pc storage.PacketCounts) {
+	s.mu.Lock()
+	s.Packets.update(s.now().Truncate(24*time.Hour), pc)
+	s.mu.Unlock()
+}
+
+// UpdateSource attributes a key change to the source it came from.
+func (s *Stats) UpdateSource(source string, kc storage.KeyChange) {
+	s.mu.Lock()
+	if s.Sources == nil {
+		s.Sources = map[string]*LoadStat{}
+	}
+	ls, ok := s.Sources[source]
+	if !ok {
+		ls = &LoadStat{}
+		s.Sources[source] = ls
+	}
+	ls.update(kc)
+	s.mu.Unlock()
+}
+
+// UpdateMismatched records a key rejected because its digest did not match
+// the one requested.
+func (s *Stats) UpdateMismatched() {
+	s.mu.Lock()
+	s.Mismatched++
+	s.mu.Unlock()
+}
+
+// UpdateDiverged records a recovered key stored with a digest other than
+// the one requested.
+func (s *Stats) UpdateDiverged() {
+	s.mu.Lock()
+	s.Diverged++
+	s.mu.Unlock()
+}
+
+// UpdateRejected records a key refused by policy.
+func (s *Stats) UpdateRejected() {
+	s.mu.Lock()
+	s.Rejected++
+	s.mu.Unlock()
+}
+
+// UpdateDroppedDigests records a digest dropped after repeated failures to
+// recover it.
+func (s *Stats) UpdateDroppedDigests() {
+	s.mu.Lock()
+	s.DroppedDigests++
+	s.mu.Unlock()
+}
+
+// UpdateRecoveryErrors records a failed attempt to recover keys from a recon
+// partner.
+func (s *Stats) UpdateRecoveryErrors() {
+	s.mu.Lock()
+	s.RecoveryErrors++
+	s.mu.Unlock()
+}
+
+// peer returns the statistics of the partner at hkpAddr. s.mu must be held.
+func (s *Stats) peer(hkpAddr string) *PeerStat {
+	if s.Peers == nil {
+		s.Peers = map[string]*PeerStat{}
+	}
+	name := peerName(hkpAddr)
+	ps, ok := s.Peers[name]
+	if !ok {
+		ps = &PeerStat{}
+		s.Peers[name] = ps
+	}
+	return ps
+}
+
+// UpdatePeerRecon records keys successfully recovered from the partner at
+// hkpAddr.
+func (s *Stats) UpdatePeerRecon(hkpAddr string) {
+	s.mu.Lock()
+	s.peer(hkpAddr).LastRecon = s.now()
+	s.mu.Unlock()
+}
+
+// UpdatePeerFailure records a failed attempt to recover keys from the
+// partner at hkpAddr.
+func (s *Stats) UpdatePeerFailure(hkpAddr string) {
+	s.mu.Lock()
+	ps := s.peer(hkpAddr)
+	ps.Failures++
+	ps.LastFailure = s.now()
+	s.mu.Unlock()
+}
+
+// UpdatePeerRecovered records a key change recovered from the partner at
+// hkpAddr.
+func (s *Stats) UpdatePeerRecovered(hkpAddr string, kc storage.KeyChange) {
+	switch kc.(type) {
+	case storage.KeyAdded, storage.KeyReplaced:
+	default:
+		return
+	}
+	s.mu.Lock()
+	s.peer(hkpAddr).Recovered++
+	s.mu.Unlock()
+}
+
+// UpdatePeerHashquery records the latency of a hashquery request to the
+// partner at hkpAddr.
+func (s *Stats) UpdatePeerHashquery(hkpAddr string, latency time.Duration) {
+	s.mu.Lock()
+	ps := s.peer(hkpAddr)
+	ps.Hashqueries++
+	ps.HashqueryLatency += (latency.Seconds() - ps.HashqueryLatency) / float64(ps.Hashqueries)
+	s.mu.Unlock()
+}
+
 func (s *Stats) clone() *Stats {
 	s.mu.Lock()
 	result := &Stats{
-		Total:  s.Total,
-		Hourly: LoadStatMap{},
-		Daily:  LoadStatMap{},
+		Total:          s.Total,
+		Hourly:         LoadStatMap{},
+		Daily:          LoadStatMap{},
+		Packets:        PacketStatMap{},
+		Sources:        map[string]*LoadStat{},
+		Peers:          map[string]*PeerStat{},
+		Mismatched:     s.Mismatched,
+		Diverged:       s.Diverged,
+		Rejected:       s.Rejected,
+		RecoveryErrors: s.RecoveryErrors,
+		DroppedDigests: s.DroppedDigests,
 	}
 	for k, v := range s.Hourly {
 		result.Hourly[k] = v
@@ -128,6 +397,17 @@ func (s *Stats) clone() *Stats {
 	for k, v := range s.Daily {
 		result.Daily[k] = v
 	}
+	for k, v := range s.Packets {
+		result.Packets[k] = v
+	}
+	for k, v := range s.Sources {
+		ls := *v
+		result.Sources[k] = &ls
+	}
+	for k, v := range s.Peers {
+		ps := *v
+		result.Peers[k] = &ps
+	}
 	s.mu.Unlock()
 	return result
 }
@@ -0,0 +1,225 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/hockeypuck/conflux.v2/recon"
+	log "gopkg.in/hockeypuck/logrus.v0"
+)
+
+// Transport carries the recon exchange over an alternative to TCP, such as
+// streams of a QUIC connection, which recover from packet loss better than
+// TCP over lossy, long-distance links. Connections must be reliable,
+// ordered byte streams, and their remote addresses must identify the
+// partner's host.
+type Transport interface {
+	// Dial connects to a partner at its address for the transport.
+	Dial(ctx context.Context, addr string) (net.Conn, error)
+	// Listen accepts connections from partners at addr.
+	Listen(addr string) (net.Listener, error)
+}
+
+// reconTransport is an alternative transport and the partners which may
+// reconcile over it.
+type reconTransport struct {
+	name      string
+	transport Transport
+	addr      string
+	partners  map[string]bool
+}
+
+// defaultGossipInterval is how often partners are reconciled with over a
+// transport, if the settings do not say.
+const defaultGossipInterval = time.Minute
+
+// ReconTransport is an experimental option which reconciles with the named
+// partners over t rather than TCP, accepting connections from them at addr.
+//
+// The transport is negotiated with each partner every time it is chosen
+// for gossip: if its Capabilities list an address for the transport under
+// name, it is reconciled with over t at that address, and otherwise over
+// TCP at its recon address. Partners named here are left out of the
+// partners gossiped with by conflux, and should also name this server, so
+// that they do not reconcile over TCP in return.
+func ReconTransport(name string, t Transport, addr string, partners ...string) PeerOption {
+	return func(p *Peer) error {
+		if name == "" || t == nil {
+			return errgo.New("recon transport requires a name and a transport")
+		}
+		if len(partners) == 0 {
+			return errgo.Newf("recon transport %q has no partners", name)
+		}
+		p.transport = &reconTransport{name: name, transport: t, addr: addr, partners: map[string]bool{}}
+		for _, partner := range partners {
+			p.transport.partners[partner] = true
+		}
+		return nil
+	}
+}
+
+// acceptor is implemented by reconcilers which can reconcile with a partner
+// over a connection it made, such as the SKS prefix tree reconciler.
+type acceptor interface {
+	Accept(conn net.Conn) error
+}
+
+// dialPartner connects to the named partner for recon, over the transport
+// negotiated with it.
+func (r *Peer) dialPartner(name string, partner recon.Partner) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), reconDialTimeout)
+	defer cancel()
+	if rt := r.transport; rt != nil && rt.partners[name] {
+		if addr, ok := r.capabilities(partner.HTTPAddr).Transports[rt.name]; ok {
+			conn, err := rt.transport.Dial(ctx, addr)
+			if err != nil {
+				return nil, errgo.Notef(err, "cannot connect over %s", rt.name)
+			}
+			return conn, nil
+		}
+		log.Debugf("partner %q does not accept recon over %s, using TCP", name, rt.name)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", partner.ReconAddr)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return conn, nil
+}
+
+// startTransport accepts recon over the transport and gossips over it in
+// the background.
+func (r *Peer) startTransport() {
+	ln, err := r.transport.transport.Listen(r.transport.addr)
+	if err != nil {
+		log.Errorf("cannot accept recon over %s at %q: %v", r.transport.name, r.transport.addr, err)
+	} else {
+		r.t.Go(func() error {
+			return r.serveTransport(ln)
+		})
+	}
+	r.t.Go(r.gossipTransport)
+}
+
+func (r *Peer) serveTransport(ln net.Listener) error {
+	go func() {
+		<-r.t.Dying()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-r.t.Dying():
+				return nil
+			default:
+			}
+			log.Warningf("cannot accept recon over %s: %v", r.transport.name, err)
+			select {
+			case <-r.t.Dying():
+				return nil
+			case <-r.clock.After(time.Second):
+			}
+			continue
+		}
+		r.t.Go(func() error {
+			r.acceptTransport(conn)
+			return nil
+		})
+	}
+}
+
+// acceptTransport reconciles over conn, if it was made by a partner which
+// may use the transport while this peer is running recon.
+func (r *Peer) acceptTransport(conn net.Conn) {
+	defer conn.Close()
+	host := partnerHost(conn.RemoteAddr())
+	if !r.transportPartner(host) {
+		log.Warningf("refused recon over %s from %v, not a partner", r.transport.name, conn.RemoteAddr())
+		return
+	}
+	if !r.Active() {
+		return
+	}
+	a, ok := r.defaultReconciler().(acceptor)
+	if !ok {
+		log.Warningf("refused recon over %s from %v, recon is unavailable", r.transport.name, conn.RemoteAddr())
+		return
+	}
+	hc := newHandshakeConn(conn, func(remote *recon.Config) error {
+		return r.checkPartnerConfig(host, nil, remote)
+	})
+	err := a.Accept(hc)
+	// Mismatches are logged once found.
+	if mismatch := hc.mismatch(); mismatch == nil && err != nil {
+		log.Errorf("recon over %s with %v failed: %v", r.transport.name, conn.RemoteAddr(), errgo.Details(err))
+	}
+}
+
+// transportPartner returns whether host is that of a partner which may use
+// the transport.
+func (r *Peer) transportPartner(host string) bool {
+	for _, name := range r.partnersAt(host) {
+		if r.transport.partners[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// gossipTransport periodically reconciles with a random partner which may
+// use the transport, while this peer is running recon.
+func (r *Peer) gossipTransport() error {
+	r.mu.Lock()
+	interval := time.Duration(r.settings.GossipIntervalSecs) * time.Second
+	r.mu.Unlock()
+	if interval <= 0 {
+		interval = defaultGossipInterval
+	}
+	ticker := r.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.t.Dying():
+			return nil
+		case <-ticker.C():
+		}
+		if !r.Active() {
+			continue
+		}
+		var names []string
+		for name := range r.Partners() {
+			if r.transport.partners[name] && !r.mismatched.excluded(name) {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			continue
+		}
+		name := names[rand.Intn(len(names))]
+		err := r.ReconcileWith(name)
+		if err != nil {
+			log.Errorf("recon with %q failed: %v", name, errgo.Details(err))
+		}
+	}
+}
@@ -0,0 +1,140 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sks
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	log "gopkg.in/hockeypuck/logrus.v0"
+	"gopkg.in/hockeypuck/openpgp.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/metrics"
+)
+
+// WriteQueue merges recovered keys into storage in the background, with the
+// given number of workers, rather than while reading hashquery responses.
+// Up to size responses may be queued; once the queue is full, reading
+// further responses waits for it, so that recovery cannot outrun storage.
+// Keys still queued when the peer is stopped are merged within its drain
+// timeout.
+//
+// Digests are counted as recovered once their keys are queued. Keys which
+// then fail to merge are found again by a later recon round.
+func WriteQueue(size, workers int) PeerOption {
+	return func(p *Peer) error {
+		if size <= 0 || workers <= 0 {
+			return errgo.Newf("invalid write queue size %d with %d workers", size, workers)
+		}
+		p.writes = &writeQueue{batches: make(chan *writeBatch, size), workers: workers}
+		return nil
+	}
+}
+
+// writeBatch is the keys recovered from a partner by one hashquery.
+type writeBatch struct {
+	remoteAddr string
+	keys       []*openpgp.PrimaryKey
+}
+
+// writeQueue holds recovered keys until they are merged into storage.
+type writeQueue struct {
+	batches chan *writeBatch
+	workers int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu    sync.Mutex
+	depth int
+}
+
+// start starts the workers merging keys queued for r.
+func (q *writeQueue) start(r *Peer) {
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			for b := range q.batches {
+				q.update(-len(b.keys))
+				err := r.upsertKeys(q.ctx, b.remoteAddr, b.keys)
+				if err != nil {
+					log.Errorf("cannot merge %d queued keys from %q: %v", len(b.keys), b.remoteAddr, err)
+					r.stats.UpdateRecoveryErrors()
+				}
+			}
+		}()
+	}
+}
+
+// enqueue queues keys recovered from remoteAddr, waiting for room in the
+// queue until ctx is done.
+func (q *writeQueue) enqueue(ctx context.Context, remoteAddr string, keys []*openpgp.PrimaryKey) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	q.update(len(keys))
+	select {
+	case q.batches <- &writeBatch{remoteAddr: remoteAddr, keys: keys}:
+		return nil
+	case <-ctx.Done():
+		q.update(-len(keys))
+		return errgo.Mask(ctx.Err(), errgo.Any)
+	}
+}
+
+func (q *writeQueue) update(delta int) {
+	q.mu.Lock()
+	q.depth += delta
+	depth := q.depth
+	q.mu.Unlock()
+	metrics.WriteQueueDepth(depth)
+}
+
+// queued returns the number of keys waiting to be merged, including those
+// waiting for room in the queue.
+func (q *writeQueue) queued() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.depth
+}
+
+// flush merges the keys still queued, cancelling merges which have not
+// finished after timeout. Nothing may be queued once flushing starts.
+func (q *writeQueue) flush(timeout time.Duration) {
+	close(q.batches)
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		log.Warningf("write queue did not drain within %v, abandoning %d keys", timeout, q.queued())
+		q.cancel()
+		<-done
+	}
+	q.cancel()
+}
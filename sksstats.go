@@ -0,0 +1,210 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"html/template"
+	"net"
+	"sort"
+	"time"
+
+	"gopkg.in/hockeypuck/conflux.v2/recon"
+
+	"gopkg.in/hockeypuck/hkp.v1/sks"
+)
+
+// SKSStatsInfo describes the keyserver on its SKS-compatible stats page.
+type SKSStatsInfo struct {
+	Hostname string
+	Nodename string
+	Software string
+	Version  string
+	Contact  string
+
+	// HTTPAddr and ReconAddr are the addresses on which the keyserver
+	// serves HKP and recon.
+	HTTPAddr  string
+	ReconAddr string
+}
+
+// SKSStatsPeer is a recon partner listed on the stats page.
+type SKSStatsPeer struct {
+	Name      string        `json:"name"`
+	HTTPAddr  string        `json:"httpAddr"`
+	ReconAddr string        `json:"reconAddr"`
+	Stats     *sks.PeerStat `json:"stats,omitempty"`
+}
+
+// Membership returns the recon address of the partner as written in an SKS
+// membership file, such as "keys.example.com 11370".
+func (p *SKSStatsPeer) Membership() string {
+	if host, port, err := net.SplitHostPort(p.ReconAddr); err == nil {
+		return host + " " + port
+	}
+	return p.ReconAddr
+}
+
+// SKSLoadStat counts the keys inserted and updated in an hour or a day.
+type SKSLoadStat struct {
+	Time     time.Time `json:"time"`
+	Inserted int       `json:"inserted"`
+	Updated  int       `json:"updated"`
+}
+
+// SKSStatsResponse is the SKS-compatible stats page, served as HTML in the
+// layout expected by SKS servers and pool monitors, or as JSON.
+type SKSStatsResponse struct {
+	Timestamp time.Time `json:"timestamp"`
+	Hostname  string    `json:"hostname"`
+	Nodename  string    `json:"nodename"`
+	Software  string    `json:"software"`
+	Version   string    `json:"version"`
+	Contact   string    `json:"server_contact,omitempty"`
+	HTTPAddr  string    `json:"httpAddr"`
+	ReconAddr string    `json:"reconAddr"`
+
+	Peers []SKSStatsPeer `json:"peers"`
+
+	// Banner is an operator notice shown above the statistics.
+	Banner string `json:"banner,omitempty"`
+
+	Total  int           `json:"numkeys"`
+	Hourly []SKSLoadStat `json:"hourly"`
+	Daily  []SKSLoadStat `json:"daily"`
+}
+
+// HTTPPort returns the port of HTTPAddr, as shown on SKS stats pages.
+func (s *SKSStatsResponse) HTTPPort() string {
+	return addrPort(s.HTTPAddr)
+}
+
+// ReconPort returns the port of ReconAddr, as shown on SKS stats pages.
+func (s *SKSStatsResponse) ReconPort() string {
+	return addrPort(s.ReconAddr)
+}
+
+func addrPort(addr string) string {
+	if _, port, err := net.SplitHostPort(addr); err == nil {
+		return port
+	}
+	return addr
+}
+
+// SKSStats serves op=stats from the statistics and recon partners of peer,
+// as an HTML page laid out like that of SKS, or as JSON with options=mr or
+// options=json. A template given with StatsTemplate is executed with an
+// SKSStatsResponse instead of the built-in page.
+func SKSStats(peer *sks.Peer, info SKSStatsInfo) HandlerOption {
+	return func(h *Handler) error {
+		h.statsFunc = func() (interface{}, error) {
+			resp := NewSKSStatsResponse(info, peer.Stats(), peer.Partners())
+			resp.Banner = h.bannerText()
+			return resp, nil
+		}
+		if h.statsTemplate == nil {
+			h.statsTemplate = sksStatsTemplate
+		}
+		return nil
+	}
+}
+
+// NewSKSStatsResponse returns the stats page of the keyserver described by
+// info, with stats and recon partners. The software defaults to Hockeypuck.
+func NewSKSStatsResponse(info SKSStatsInfo, stats *sks.Stats, partners recon.PartnerMap) *SKSStatsResponse {
+	if info.Software == "" {
+		info.Software = "Hockeypuck"
+	}
+	resp := &SKSStatsResponse{
+		Timestamp: time.Now().UTC(),
+		Hostname:  info.Hostname,
+		Nodename:  info.Nodename,
+		Software:  info.Software,
+		Version:   info.Version,
+		Contact:   info.Contact,
+		HTTPAddr:  info.HTTPAddr,
+		ReconAddr: info.ReconAddr,
+		Total:     stats.Total,
+		Hourly:    sksLoadStats(stats.Hourly),
+		Daily:     sksLoadStats(stats.Daily),
+	}
+	for name, partner := range partners {
+		peer := SKSStatsPeer{Name: name, HTTPAddr: partner.HTTPAddr, ReconAddr: partner.ReconAddr}
+		host := partner.HTTPAddr
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		peer.Stats = stats.Peers[host]
+		resp.Peers = append(resp.Peers, peer)
+	}
+	sort.Slice(resp.Peers, func(i, j int) bool {
+		return resp.Peers[i].Name < resp.Peers[j].Name
+	})
+	return resp
+}
+
+// sksLoadStats returns m ordered from the most recent, as on SKS stats pages.
+func sksLoadStats(m sks.LoadStatMap) []SKSLoadStat {
+	var result []SKSLoadStat
+	for t, ls := range m {
+		result = append(result, SKSLoadStat{Time: t, Inserted: ls.Inserted, Updated: ls.Updated})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Time.After(result[j].Time)
+	})
+	return result
+}
+
+var sksStatsTemplate = template.Must(template.New("sks-stats").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>SKS OpenPGP Keyserver statistics</title>
+<meta http-equiv="Content-Type" content="text/html; charset=utf-8" />
+</head>
+<body>
+{{if .Banner}}<p class="banner">{{.Banner}}</p>
+{{end}}<h1>SKS OpenPGP Keyserver statistics</h1>
+<p>Taken at {{.Timestamp.Format "2006-01-02 15:04:05 MST"}}</p>
+<h2>Settings</h2>
+<table summary="Keyserver Settings">
+<tr><td>Hostname:</td><td>{{.Hostname}}</td></tr>
+<tr><td>Nodename:</td><td>{{.Nodename}}</td></tr>
+<tr><td>Software:</td><td>{{.Software}}</td></tr>
+<tr><td>Version:</td><td>{{.Version}}</td></tr>
+{{if .Contact}}<tr><td>Server contact:</td><td>{{.Contact}}</td></tr>
+{{end}}<tr><td>HTTP port:</td><td>{{.HTTPPort}}</td></tr>
+<tr><td>Recon port:</td><td>{{.ReconPort}}</td></tr>
+</table>
+<h2>Gossip Peers</h2>
+<table summary="Gossip Peers">
+{{range .Peers}}<tr><td>{{.Membership}}</td></tr>
+{{end}}</table>
+<h2>Statistics</h2>
+<p>Total number of keys: {{.Total}}</p>
+<h3>Keys loaded in the last 24 hours</h3>
+<table summary="Statistics">
+<tr><td>Hour</td><td>New Keys</td><td>Updated Keys</td></tr>
+{{range .Hourly}}<tr><td>{{.Time.Format "2006-01-02 15"}}</td><td>{{.Inserted}}</td><td>{{.Updated}}</td></tr>
+{{end}}</table>
+<h3>Keys loaded in the last 7 days</h3>
+<table summary="Statistics">
+<tr><td>Day</td><td>New Keys</td><td>Updated Keys</td></tr>
+{{range .Daily}}<tr><td>{{.Time.Format "2006-01-02"}}</td><td>{{.Inserted}}</td><td>{{.Updated}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
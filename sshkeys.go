@@ -0,0 +1,220 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/openpgp/packet"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/errgo.v1"
+
+	log "gopkg.in/hockeypuck/logrus.v0"
+	"gopkg.in/hockeypuck/openpgp.v1"
+)
+
+const (
+	// sigSubKeyBinding and sigSubKeyRevocation are the OpenPGP signature
+	// types binding and revoking subkeys (RFC 4880, Section 5.2.1).
+	sigSubKeyBinding    = 0x18
+	sigSubKeyRevocation = 0x28
+
+	// subpacketKeyFlags is the key flags signature subpacket type, and
+	// keyFlagAuthenticate the flag marking keys usable for authentication
+	// (RFC 4880, Section 5.2.3.21).
+	subpacketKeyFlags   = 27
+	keyFlagAuthenticate = 0x20
+
+	// pubKeyAlgoEdDSA is the EdDSA public key algorithm, which is not
+	// supported by golang.org/x/crypto/openpgp.
+	pubKeyAlgoEdDSA = 22
+)
+
+// ed25519OID identifies the Ed25519 curve in EdDSA public keys.
+var ed25519OID = []byte{0x2b, 0x06, 0x01, 0x04, 0x01, 0xda, 0x47, 0x0f, 0x01}
+
+// ExportSSHKeys serves the authentication subkeys of keys as OpenSSH
+// public keys at /pks/ssh, so that hosts can provision SSH access from
+// keys on the keyserver.
+func ExportSSHKeys() HandlerOption {
+	return func(h *Handler) error {
+		h.sshKeys = true
+		return nil
+	}
+}
+
+// SSHKeys responds with the keys matching the search parameter, as in
+// /pks/lookup, in OpenSSH authorized_keys format. Each line holds a current
+// authentication subkey, commented with its OpenPGP fingerprint.
+func (h *Handler) SSHKeys(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	lang := h.localizer.Negotiate(r.Header.Get("Accept-Language"))
+	l := &Lookup{
+		Op:        OperationGet,
+		Search:    r.FormValue("search"),
+		Lang:      lang,
+		localizer: h.localizer,
+		ClientIP:  h.ClientIP(r),
+	}
+	if l.Search == "" {
+		h.localizedError(w, lang, http.StatusBadRequest, errgo.New("missing required parameter: search"))
+		return
+	}
+	keys, err := h.keys(l)
+	if td, ok := withheld(err); ok {
+		h.writeTakedown(w, l, td)
+		return
+	} else if err != nil {
+		h.localizedError(w, lang, http.StatusInternalServerError, errgo.Mask(err))
+		return
+	}
+
+	var buf bytes.Buffer
+	now := time.Now()
+	for _, key := range keys {
+		for _, subKey := range AuthenticationSubKeys(key, now) {
+			pub, err := SSHPublicKey(&subKey.PublicKey)
+			if err != nil {
+				log.Debugf("cannot export subkey %s as SSH key: %v", subKey.Fingerprint(), err)
+				continue
+			}
+			line := bytes.TrimSuffix(ssh.MarshalAuthorizedKey(pub), []byte("\n"))
+			buf.Write(line)
+			buf.WriteString(" openpgp:0x" + subKey.Fingerprint() + "\n")
+		}
+	}
+	if buf.Len() == 0 {
+		h.localizedError(w, lang, http.StatusNotFound, errgo.New("not found"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(buf.Bytes())
+}
+
+// AuthenticationSubKeys returns the subkeys of key whose latest binding
+// signature by key carries the authentication key flag, and which are
+// neither revoked nor expired as of now. Signatures are not verified; keys
+// in storage were checked when they were merged.
+func AuthenticationSubKeys(key *openpgp.PrimaryKey, now time.Time) []*openpgp.SubKey {
+	var result []*openpgp.SubKey
+	for _, subKey := range key.SubKeys {
+		if !subKey.Expiration.IsZero() && subKey.Expiration.Before(now) {
+			continue
+		}
+		var binding *openpgp.Signature
+		revoked := false
+		for _, sig := range subKey.Signatures {
+			if sig.RIssuerKeyID != key.RKeyID {
+				continue
+			}
+			switch sig.SigType {
+			case sigSubKeyRevocation:
+				revoked = true
+			case sigSubKeyBinding:
+				if binding == nil || sig.Creation.After(binding.Creation) {
+					binding = sig
+				}
+			}
+		}
+		if revoked || binding == nil || !canAuthenticate(binding) {
+			continue
+		}
+		result = append(result, subKey)
+	}
+	return result
+}
+
+// canAuthenticate returns whether the hashed key flags of a version 4
+// signature include the authentication flag.
+func canAuthenticate(sig *openpgp.Signature) bool {
+	op, err := packet.NewOpaqueReader(bytes.NewReader(sig.Packet.Packet)).Next()
+	if err != nil {
+		return false
+	}
+	body := op.Contents
+	if len(body) < 6 || body[0] != 4 {
+		return false
+	}
+	hashedLen := int(body[4])<<8 | int(body[5])
+	if len(body) < 6+hashedLen {
+		return false
+	}
+	subpackets, err := packet.OpaqueSubpackets(body[6 : 6+hashedLen])
+	if err != nil {
+		return false
+	}
+	for _, sp := range subpackets {
+		if sp.SubType&0x7f == subpacketKeyFlags && len(sp.Contents) > 0 {
+			return sp.Contents[0]&keyFlagAuthenticate != 0
+		}
+	}
+	return false
+}
+
+// SSHPublicKey returns the OpenSSH form of an RSA, DSA, ECDSA or Ed25519
+// OpenPGP public key.
+func SSHPublicKey(pk *openpgp.PublicKey) (ssh.PublicKey, error) {
+	if pk.Algorithm == pubKeyAlgoEdDSA {
+		pub, err := ed25519PublicKey(pk.Packet.Packet)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return ssh.NewPublicKey(pub)
+	}
+	p, err := packet.Read(bytes.NewReader(pk.Packet.Packet))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	pub, ok := p.(*packet.PublicKey)
+	if !ok {
+		return nil, errgo.Newf("unexpected %T packet", p)
+	}
+	sshPub, err := ssh.NewPublicKey(pub.PublicKey)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return sshPub, nil
+}
+
+// ed25519PublicKey parses the Ed25519 key in a version 4 EdDSA public key
+// packet (draft-ietf-openpgp-rfc4880bis, Section 13.3).
+func ed25519PublicKey(buf []byte) (ed25519.PublicKey, error) {
+	op, err := packet.NewOpaqueReader(bytes.NewReader(buf)).Next()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	body := op.Contents
+	// Version, creation time and algorithm.
+	if len(body) < 7 || body[0] != 4 || body[5] != pubKeyAlgoEdDSA {
+		return nil, errgo.New("not a version 4 EdDSA public key")
+	}
+	oidLen := int(body[6])
+	body = body[7:]
+	if len(body) < oidLen || !bytes.Equal(body[:oidLen], ed25519OID) {
+		return nil, errgo.New("unsupported EdDSA curve")
+	}
+	// The point is an MPI holding 0x40 followed by the 32 byte key.
+	body = body[oidLen:]
+	if len(body) < 2+1+ed25519.PublicKeySize || body[2] != 0x40 {
+		return nil, errgo.New("invalid Ed25519 point")
+	}
+	return ed25519.PublicKey(body[3 : 3+ed25519.PublicKeySize]), nil
+}
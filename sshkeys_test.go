@@ -0,0 +1,102 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	gc "gopkg.in/check.v1"
+
+	"gopkg.in/hockeypuck/openpgp.v1"
+)
+
+type SSHKeysSuite struct{}
+
+var _ = gc.Suite(&SSHKeysSuite{})
+
+// newPacket returns a new-format OpenPGP packet with a short body.
+func newPacket(tag byte, body []byte) []byte {
+	return append([]byte{0xc0 | tag, byte(len(body))}, body...)
+}
+
+func ed25519Packet(pub ed25519.PublicKey) []byte {
+	body := []byte{4, 0x5f, 0x5e, 0x10, 0x00, pubKeyAlgoEdDSA, byte(len(ed25519OID))}
+	body = append(body, ed25519OID...)
+	body = append(body, 0x01, 0x07, 0x40)
+	body = append(body, pub...)
+	return newPacket(6, body)
+}
+
+func bindingPacket(flags byte) []byte {
+	hashed := []byte{2, subpacketKeyFlags, flags}
+	body := []byte{4, sigSubKeyBinding, pubKeyAlgoEdDSA, 8, 0, byte(len(hashed))}
+	body = append(body, hashed...)
+	body = append(body, 0, 0, 0xab, 0xcd)
+	return newPacket(2, body)
+}
+
+func sshSubKey(c *gc.C, flags byte, sigTypes ...int) (*openpgp.SubKey, ed25519.PublicKey) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	c.Assert(err, gc.IsNil)
+	subKey := &openpgp.SubKey{PublicKey: openpgp.PublicKey{
+		Packet:    openpgp.Packet{Tag: 14, Packet: ed25519Packet(pub)},
+		Algorithm: pubKeyAlgoEdDSA,
+	}}
+	for _, sigType := range sigTypes {
+		subKey.Signatures = append(subKey.Signatures, &openpgp.Signature{
+			Packet:       openpgp.Packet{Tag: 2, Packet: bindingPacket(flags)},
+			SigType:      sigType,
+			RIssuerKeyID: "0123456789abcdef",
+		})
+	}
+	return subKey, pub
+}
+
+func (s *SSHKeysSuite) TestSSHPublicKey(c *gc.C) {
+	subKey, pub := sshSubKey(c, keyFlagAuthenticate)
+	sshPub, err := SSHPublicKey(&subKey.PublicKey)
+	c.Assert(err, gc.IsNil)
+	c.Assert(sshPub.Type(), gc.Equals, ssh.KeyAlgoED25519)
+	want, err := ssh.NewPublicKey(pub)
+	c.Assert(err, gc.IsNil)
+	c.Assert(bytes.Equal(sshPub.Marshal(), want.Marshal()), gc.Equals, true)
+
+	subKey.Packet.Packet[9] = 0
+	_, err = SSHPublicKey(&subKey.PublicKey)
+	c.Assert(err, gc.ErrorMatches, "unsupported EdDSA curve")
+}
+
+func (s *SSHKeysSuite) TestAuthenticationSubKeys(c *gc.C) {
+	auth, _ := sshSubKey(c, keyFlagAuthenticate, sigSubKeyBinding)
+	sign, _ := sshSubKey(c, 0x02, sigSubKeyBinding)
+	revoked, _ := sshSubKey(c, keyFlagAuthenticate, sigSubKeyBinding, sigSubKeyRevocation)
+	expired, _ := sshSubKey(c, keyFlagAuthenticate, sigSubKeyBinding)
+	expired.Expiration = time.Now().Add(-time.Hour)
+	key := &openpgp.PrimaryKey{
+		PublicKey: openpgp.PublicKey{RKeyID: "0123456789abcdef"},
+		SubKeys:   []*openpgp.SubKey{auth, sign, revoked, expired},
+	}
+	c.Assert(AuthenticationSubKeys(key, time.Now()), gc.DeepEquals, []*openpgp.SubKey{auth})
+
+	// Binding signatures by other keys are ignored.
+	key.RKeyID = "fedcba9876543210"
+	c.Assert(AuthenticationSubKeys(key, time.Now()), gc.HasLen, 0)
+}
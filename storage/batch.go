@@ -0,0 +1,68 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"context"
+
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/hockeypuck/openpgp.v1"
+)
+
+// BatchUpserter may be implemented by storage backends which can upsert many
+// keys in a single transaction, such as when recovering keys from recon
+// partners. Implementations notify subscribers of the changes after the
+// transaction commits, as Insert and Update do.
+type BatchUpserter interface {
+	// UpsertKeys merges keys into storage like UpsertKey, returning the
+	// change made for each. If an error is returned, no keys are changed.
+	UpsertKeys(ctx context.Context, keys []*openpgp.PrimaryKey) ([]KeyChange, error)
+}
+
+// UpsertKeys merges keys into storage, in a single transaction if st
+// implements BatchUpserter.
+func UpsertKeys(st Storage, keys []*openpgp.PrimaryKey) ([]KeyChange, error) {
+	return UpsertKeysContext(context.Background(), st, keys)
+}
+
+// UpsertKeysContext is like UpsertKeys, but stops with an error whose cause
+// is ctx.Err() if ctx is done first. If st does not implement BatchUpserter,
+// keys are upserted one at a time, and the changes made before any error
+// are returned along with it.
+func UpsertKeysContext(ctx context.Context, st Storage, keys []*openpgp.PrimaryKey) ([]KeyChange, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if bu, ok := st.(BatchUpserter); ok {
+		changes, err := bu.UpsertKeys(ctx, keys)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		return changes, nil
+	}
+	var changes []KeyChange
+	for _, key := range keys {
+		change, err := UpsertKeyContext(ctx, st, key)
+		if err != nil {
+			return changes, errgo.Mask(err, errgo.Any)
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
@@ -0,0 +1,383 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package cache provides a storage.Storage decorator which caches the keys
+// fetched and the key IDs resolved, so that popular keys served by lookups
+// are not read from the underlying storage every time.
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/hockeypuck/openpgp.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/clock"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+)
+
+// Storage caches the results of FetchKeys, FetchKeyrings and Resolve on an
+// underlying storage.Storage, which it otherwise passes through to.
+//
+// Cached keys are dropped when the underlying storage notifies that they
+// have been replaced or removed, and key IDs resolved to them along with
+// them. Resolved key IDs are otherwise only dropped when they expire, so
+// that they may miss keys added since they were cached, such as a new key
+// with a colliding short key ID, until then.
+type Storage struct {
+	storage.Storage
+
+	ttl time.Duration
+
+	mu    sync.Mutex
+	clock clock.Clock
+	// keyrings holds the cached keyrings, by RFingerprint.
+	keyrings *lru
+	// digests holds the RFingerprints of the cached keyrings, by digest.
+	digests map[string]string
+	// resolved holds the RFingerprints resolved, by key IDs.
+	resolved *lru
+	// gen counts the changes notified, so that results fetched while keys
+	// were changing are not cached.
+	gen uint64
+
+	hits, misses int
+}
+
+var (
+	_ storage.Deleter      = (*Storage)(nil)
+	_ storage.DigestLister = (*Storage)(nil)
+)
+
+// New returns a Storage which caches up to size keyrings fetched from st,
+// and up to size resolved key IDs, for up to ttl. If ttl is zero, they do
+// not expire.
+func New(st storage.Storage, size int, ttl time.Duration) (*Storage, error) {
+	if size <= 0 {
+		return nil, errgo.Newf("invalid cache size %d", size)
+	}
+	if ttl < 0 {
+		return nil, errgo.Newf("invalid cache TTL %v", ttl)
+	}
+	s := &Storage{
+		Storage:  st,
+		ttl:      ttl,
+		clock:    clock.Real,
+		keyrings: newLRU(size),
+		digests:  map[string]string{},
+		resolved: newLRU(size),
+	}
+	st.Subscribe(s.invalidate)
+	return s, nil
+}
+
+// SetClock sets the clock by which cached results expire.
+func (s *Storage) SetClock(c clock.Clock) {
+	s.mu.Lock()
+	s.clock = c
+	s.mu.Unlock()
+}
+
+// Stats returns the number of keyrings and resolved key IDs which were
+// found in the cache, and the number which were not.
+func (s *Storage) Stats() (hits, misses int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hits, s.misses
+}
+
+// keyring is a cached keyring. Keys are cached serialized, so that callers
+// may modify those fetched, such as by merging into them, without changing
+// those cached.
+type keyring struct {
+	packets      []byte
+	md5, sha256  string
+	ctime, mtime time.Time
+}
+
+func newKeyring(kr *storage.Keyring) (*keyring, error) {
+	var buf bytes.Buffer
+	err := openpgp.WritePackets(&buf, kr.PrimaryKey)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &keyring{
+		packets: buf.Bytes(),
+		md5:     kr.MD5,
+		sha256:  kr.SHA256,
+		ctime:   kr.CTime,
+		mtime:   kr.MTime,
+	}, nil
+}
+
+func (c *keyring) keyring() (*storage.Keyring, error) {
+	for readKey := range openpgp.ReadKeys(bytes.NewReader(c.packets)) {
+		if readKey.Error != nil {
+			return nil, errgo.Mask(readKey.Error)
+		}
+		key := readKey.PrimaryKey
+		key.MD5 = c.md5
+		key.SHA256 = c.sha256
+		return &storage.Keyring{PrimaryKey: key, CTime: c.ctime, MTime: c.mtime}, nil
+	}
+	return nil, errgo.Newf("cached key %q is empty", c.md5)
+}
+
+// expires returns when results cached now expire, or the zero time if they
+// do not. s.mu must be held.
+func (s *Storage) expires() time.Time {
+	if s.ttl == 0 {
+		return time.Time{}
+	}
+	return s.clock.Now().Add(s.ttl)
+}
+
+// Resolve implements storage.Queryer. Key IDs which resolve to no keys are
+// not cached.
+func (s *Storage) Resolve(keyIDs []string) ([]string, error) {
+	query := strings.ToLower(strings.Join(keyIDs, ","))
+	s.mu.Lock()
+	if v, ok := s.resolved.get(query, s.clock.Now()); ok {
+		s.hits++
+		s.mu.Unlock()
+		return append([]string(nil), v.([]string)...), nil
+	}
+	s.misses++
+	gen := s.gen
+	s.mu.Unlock()
+
+	rfps, err := s.Storage.Resolve(keyIDs)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if len(rfps) == 0 {
+		return rfps, nil
+	}
+	s.mu.Lock()
+	if s.gen == gen {
+		s.resolved.add(query, append([]string(nil), rfps...), s.expires())
+	}
+	s.mu.Unlock()
+	return rfps, nil
+}
+
+// FetchKeys implements storage.Queryer.
+func (s *Storage) FetchKeys(rfps []string) ([]*openpgp.PrimaryKey, error) {
+	keyrings, err := s.FetchKeyrings(rfps)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	var result []*openpgp.PrimaryKey
+	for _, kr := range keyrings {
+		result = append(result, kr.PrimaryKey)
+	}
+	return result, nil
+}
+
+// FetchKeyrings implements storage.Queryer.
+func (s *Storage) FetchKeyrings(rfps []string) ([]*storage.Keyring, error) {
+	found := map[string]*storage.Keyring{}
+	var misses []string
+	s.mu.Lock()
+	now := s.clock.Now()
+	for _, rfp := range rfps {
+		rfp = strings.ToLower(rfp)
+		v, ok := s.keyrings.get(rfp, now)
+		if !ok {
+			misses = append(misses, rfp)
+			continue
+		}
+		kr, err := v.(*keyring).keyring()
+		if err != nil {
+			s.mu.Unlock()
+			return nil, errgo.Mask(err)
+		}
+		found[rfp] = kr
+	}
+	s.hits += len(found)
+	s.misses += len(misses)
+	gen := s.gen
+	s.mu.Unlock()
+
+	if len(misses) > 0 {
+		fetched, err := s.Storage.FetchKeyrings(misses)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		cached := make([]*keyring, len(fetched))
+		for i, kr := range fetched {
+			cached[i], err = newKeyring(kr)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			found[strings.ToLower(kr.RFingerprint)] = kr
+		}
+		s.mu.Lock()
+		if s.gen == gen {
+			expires := s.expires()
+			for i, kr := range fetched {
+				rfp := strings.ToLower(kr.RFingerprint)
+				s.keyrings.add(rfp, cached[i], expires)
+				s.digests[strings.ToLower(kr.MD5)] = rfp
+			}
+			s.pruneDigests()
+		}
+		s.mu.Unlock()
+	}
+
+	var result []*storage.Keyring
+	for _, rfp := range rfps {
+		if kr, ok := found[strings.ToLower(rfp)]; ok {
+			result = append(result, kr)
+		}
+	}
+	return result, nil
+}
+
+// pruneDigests drops the digests of keyrings evicted from the cache. s.mu
+// must be held.
+func (s *Storage) pruneDigests() {
+	if len(s.digests) <= s.keyrings.size {
+		return
+	}
+	for digest, rfp := range s.digests {
+		if v, ok := s.keyrings.peek(rfp); !ok || !strings.EqualFold(v.(*keyring).md5, digest) {
+			delete(s.digests, digest)
+		}
+	}
+}
+
+// Delete implements storage.Deleter, if the underlying storage does.
+func (s *Storage) Delete(rfps []string) (int, error) {
+	d, ok := s.Storage.(storage.Deleter)
+	if !ok {
+		return 0, errgo.New("storage does not support deleting keys")
+	}
+	n, err := d.Delete(rfps)
+	return n, errgo.Mask(err, errgo.Any)
+}
+
+// Digests implements storage.DigestLister. Digests are listed from the
+// underlying storage, as the cache holds only some of the keys.
+func (s *Storage) Digests() ([]string, error) {
+	digests, err := storage.Digests(s.Storage)
+	return digests, errgo.Mask(err, errgo.Any)
+}
+
+// invalidate drops the cached keys which have been replaced or removed,
+// and the key IDs resolved to them.
+func (s *Storage) invalidate(change storage.KeyChange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gen++
+	for _, digest := range change.RemoveDigests() {
+		digest = strings.ToLower(digest)
+		rfp, ok := s.digests[digest]
+		if !ok {
+			continue
+		}
+		delete(s.digests, digest)
+		s.keyrings.remove(rfp)
+		s.resolved.removeFunc(func(v interface{}) bool {
+			for _, resolved := range v.([]string) {
+				if strings.EqualFold(resolved, rfp) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	return nil
+}
+
+// lru is a least-recently-used cache of values which may expire.
+type lru struct {
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type lruEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+func newLRU(size int) *lru {
+	return &lru{
+		size:    size,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// get returns the value cached for key, unless it has expired by now.
+func (c *lru) get(key string, now time.Time) (interface{}, bool) {
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*lruEntry)
+	if !entry.expires.IsZero() && !now.Before(entry.expires) {
+		c.order.Remove(e)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return entry.value, true
+}
+
+// peek returns the value cached for key, whether or not it has expired,
+// without marking it as used.
+func (c *lru) peek(key string) (interface{}, bool) {
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	return e.Value.(*lruEntry).value, true
+}
+
+// add caches value for key until expires, evicting the least recently used
+// if full.
+func (c *lru) add(key string, value interface{}, expires time.Time) {
+	c.remove(key)
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value, expires: expires})
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back().Value.(*lruEntry).key)
+	}
+}
+
+func (c *lru) remove(key string) {
+	if e, ok := c.entries[key]; ok {
+		c.order.Remove(e)
+		delete(c.entries, key)
+	}
+}
+
+// removeFunc removes the values for which f returns true.
+func (c *lru) removeFunc(f func(interface{}) bool) {
+	for key, e := range c.entries {
+		if f(e.Value.(*lruEntry).value) {
+			c.order.Remove(e)
+			delete(c.entries, key)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package cache
+
+import (
+	stdtesting "testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/hockeypuck/testing"
+	"gopkg.in/hockeypuck/openpgp.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/clock"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+	"gopkg.in/hockeypuck/hkp.v1/storage/mem"
+	"gopkg.in/hockeypuck/hkp.v1/storage/mock"
+	"gopkg.in/hockeypuck/hkp.v1/storage/storagetest"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+var _ = gc.Suite(&storagetest.Suite{
+	NewStorage: func(c *gc.C) storage.Storage {
+		st, err := New(mem.NewStorage(), 10, time.Minute)
+		c.Assert(err, gc.IsNil)
+		return st
+	},
+})
+
+type CacheSuite struct{}
+
+var _ = gc.Suite(&CacheSuite{})
+
+func (s *CacheSuite) TestNew(c *gc.C) {
+	_, err := New(mock.NewStorage(), 0, time.Minute)
+	c.Assert(err, gc.ErrorMatches, "invalid cache size 0")
+	_, err = New(mock.NewStorage(), 1, -time.Minute)
+	c.Assert(err, gc.ErrorMatches, "invalid cache TTL -1m0s")
+}
+
+func (s *CacheSuite) TestResolve(c *gc.C) {
+	resolved := map[string][]string{
+		"23e0dcca": {"accd0e320f1cb163a2aa9305257f384b1fc8ef01"},
+		"deadbeef": {"feebdaed00000000000000000000000000000000"},
+	}
+	m := mock.NewStorage(mock.Resolve(func(keyIDs []string) ([]string, error) {
+		return resolved[keyIDs[0]], nil
+	}))
+	st, err := New(m, 1, time.Minute)
+	c.Assert(err, gc.IsNil)
+	fake := clock.NewFake(time.Now())
+	st.SetClock(fake)
+
+	for i := 0; i < 2; i++ {
+		rfps, err := st.Resolve([]string{"23e0dcca"})
+		c.Assert(err, gc.IsNil)
+		c.Assert(rfps, gc.DeepEquals, resolved["23e0dcca"])
+	}
+	c.Assert(m.MethodCount("Resolve"), gc.Equals, 1)
+
+	// Key IDs which resolve to nothing are not cached.
+	for i := 0; i < 2; i++ {
+		rfps, err := st.Resolve([]string{"00000000"})
+		c.Assert(err, gc.IsNil)
+		c.Assert(rfps, gc.HasLen, 0)
+	}
+	c.Assert(m.MethodCount("Resolve"), gc.Equals, 3)
+
+	// Resolved key IDs expire.
+	fake.Advance(time.Minute)
+	_, err = st.Resolve([]string{"23e0dcca"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(m.MethodCount("Resolve"), gc.Equals, 4)
+
+	// The least recently used are evicted.
+	_, err = st.Resolve([]string{"deadbeef"})
+	c.Assert(err, gc.IsNil)
+	_, err = st.Resolve([]string{"23e0dcca"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(m.MethodCount("Resolve"), gc.Equals, 6)
+
+	hits, misses := st.Stats()
+	c.Assert(hits, gc.Equals, 1)
+	c.Assert(misses, gc.Equals, 6)
+}
+
+func (s *CacheSuite) TestInvalidate(c *gc.C) {
+	m := mem.NewStorage()
+	keys := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")).MustParse()
+	c.Assert(keys, gc.HasLen, 1)
+	_, err := m.Insert(keys)
+	c.Assert(err, gc.IsNil)
+	st, err := New(m, 10, 0)
+	c.Assert(err, gc.IsNil)
+
+	rfps, err := st.Resolve([]string{keys[0].KeyID()})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{keys[0].RFingerprint})
+	fetched, err := st.FetchKeys(rfps)
+	c.Assert(err, gc.IsNil)
+	c.Assert(fetched, gc.HasLen, 1)
+
+	// Keys fetched from the cache are copies.
+	fetched[0].UserIDs = nil
+	fetched, err = st.FetchKeys(rfps)
+	c.Assert(err, gc.IsNil)
+	c.Assert(fetched[0].UserIDs, gc.HasLen, len(keys[0].UserIDs))
+	hits, misses := st.Stats()
+	c.Assert(hits, gc.Equals, 1)
+	c.Assert(misses, gc.Equals, 2)
+
+	_, err = storage.DeleteKey(st, keys[0].RFingerprint)
+	c.Assert(err, gc.IsNil)
+	rfps, err = st.Resolve([]string{keys[0].KeyID()})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+	fetched, err = st.FetchKeys([]string{keys[0].RFingerprint})
+	c.Assert(err, gc.IsNil)
+	c.Assert(fetched, gc.HasLen, 0)
+}
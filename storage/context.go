@@ -0,0 +1,104 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"context"
+
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/hockeypuck/openpgp.v1"
+)
+
+// ContextQueryer may be implemented by storage backends which can cancel
+// lookups when their context is done.
+type ContextQueryer interface {
+	MatchMD5Context(context.Context, []string) ([]string, error)
+	FetchKeysContext(context.Context, []string) ([]*openpgp.PrimaryKey, error)
+}
+
+// ContextUpdater may be implemented by storage backends which can cancel
+// writes when their context is done.
+type ContextUpdater interface {
+	InsertContext(context.Context, []*openpgp.PrimaryKey) (int, error)
+	UpdateContext(ctx context.Context, pubkey *openpgp.PrimaryKey, priorMD5 string) error
+}
+
+// MatchMD5Context is like q.MatchMD5, but returns ctx.Err() if ctx is done
+// first. The lookup itself is only cancelled if q implements ContextQueryer.
+func MatchMD5Context(ctx context.Context, q Queryer, digests []string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if cq, ok := q.(ContextQueryer); ok {
+		return cq.MatchMD5Context(ctx, digests)
+	}
+	return q.MatchMD5(digests)
+}
+
+// FetchKeysContext is like q.FetchKeys, but returns ctx.Err() if ctx is done
+// first. The fetch itself is only cancelled if q implements ContextQueryer.
+func FetchKeysContext(ctx context.Context, q Queryer, rfps []string) ([]*openpgp.PrimaryKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if cq, ok := q.(ContextQueryer); ok {
+		return cq.FetchKeysContext(ctx, rfps)
+	}
+	return q.FetchKeys(rfps)
+}
+
+// InsertContext is like u.Insert, but returns ctx.Err() if ctx is done first.
+// The insert itself is only cancelled if u implements ContextUpdater.
+func InsertContext(ctx context.Context, u Updater, keys []*openpgp.PrimaryKey) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, errgo.Mask(err, errgo.Any)
+	}
+	if cu, ok := u.(ContextUpdater); ok {
+		return cu.InsertContext(ctx, keys)
+	}
+	return u.Insert(keys)
+}
+
+// UpdateContext is like u.Update, but returns ctx.Err() if ctx is done first.
+// The update itself is only cancelled if u implements ContextUpdater.
+func UpdateContext(ctx context.Context, u Updater, pubkey *openpgp.PrimaryKey, priorMD5 string) error {
+	if err := ctx.Err(); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if cu, ok := u.(ContextUpdater); ok {
+		return cu.UpdateContext(ctx, pubkey, priorMD5)
+	}
+	return u.Update(pubkey, priorMD5)
+}
+
+// Pinger may be implemented by storage backends which can check their
+// connection to the database cheaply.
+type Pinger interface {
+	Ping(context.Context) error
+}
+
+// Ping checks that q is reachable. If q does not implement Pinger, a lookup
+// of a digest no key has is made instead.
+func Ping(ctx context.Context, q Queryer) error {
+	if p, ok := q.(Pinger); ok {
+		return errgo.Mask(p.Ping(ctx), errgo.Any)
+	}
+	_, err := MatchMD5Context(ctx, q, []string{"00000000000000000000000000000000"})
+	return errgo.Mask(err, errgo.Any)
+}
@@ -0,0 +1,66 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// DigestLister may be implemented by storage backends which can list the
+// digests of the stored keys without fetching them.
+type DigestLister interface {
+	// Digests returns the MD5 digests of every stored key, calculated
+	// using the "SKS method".
+	Digests() ([]string, error)
+}
+
+// digestChunkSize is how many keys are fetched at a time by Digests, from
+// storage which cannot list digests.
+const digestChunkSize = 100
+
+// Digests returns the MD5 digests of every key in q. They are listed if q
+// implements DigestLister, and otherwise read from every key, fetched a
+// chunk at a time.
+func Digests(q Queryer) ([]string, error) {
+	if dl, ok := q.(DigestLister); ok {
+		digests, err := dl.Digests()
+		return digests, errgo.Mask(err, errgo.Any)
+	}
+	rfps, err := q.ModifiedSince(time.Time{})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var result []string
+	for len(rfps) > 0 {
+		n := digestChunkSize
+		if n > len(rfps) {
+			n = len(rfps)
+		}
+		keys, err := q.FetchKeys(rfps[:n])
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		rfps = rfps[n:]
+		for _, key := range keys {
+			result = append(result, key.MD5)
+		}
+	}
+	return result, nil
+}
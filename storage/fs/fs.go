@@ -0,0 +1,550 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package fs provides an implementation of storage.Storage which keeps one
+// armored key per file, for small deployments, such as air-gapped ones, and
+// so that the keys stored may be inspected, and backed up with tools such as
+// rsync.
+//
+// Keys are stored beneath the keys directory, in a fanout by the first
+// characters of their RFingerprints:
+//
+//	keys/01/23/0123456789abcdef0123456789abcdef01234567.asc
+//
+// The digests, keywords and timestamps of the stored keys are indexed in
+// index.json, which is rebuilt from the key files if it is missing, such as
+// when it is deleted after restoring them from a backup.
+package fs
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	log "gopkg.in/hockeypuck/logrus.v0"
+	"gopkg.in/hockeypuck/openpgp.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/clock"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+)
+
+const (
+	keysDir   = "keys"
+	indexFile = "index.json"
+	keySuffix = ".asc"
+
+	// fanout is the number of characters of the RFingerprint in each of
+	// the fanout directories, and fanoutDepth the number of them.
+	fanout      = 2
+	fanoutDepth = 2
+)
+
+// Storage is a storage.Storage which keeps keys in files beneath a
+// directory. The zero value is not usable; use Open.
+type Storage struct {
+	dir string
+
+	mu sync.RWMutex
+	// keys holds the index entries of the stored keys, by RFingerprint.
+	keys map[string]*entry
+	// digests holds the RFingerprints of the stored keys, by digest.
+	digests map[string]string
+	clock   clock.Clock
+
+	listenerMu sync.RWMutex
+	listeners  []func(storage.KeyChange) error
+}
+
+var (
+	_ storage.Storage      = (*Storage)(nil)
+	_ storage.Deleter      = (*Storage)(nil)
+	_ storage.DigestLister = (*Storage)(nil)
+)
+
+// entry indexes a stored key.
+type entry struct {
+	MD5    string `json:"md5"`
+	SHA256 string `json:"sha256,omitempty"`
+	// RFingerprints holds the RFingerprints of the primary key and its
+	// subkeys, by which it is resolved.
+	RFingerprints []string `json:"rfingerprints"`
+	// Keywords holds the lower-cased user IDs, for keyword search.
+	Keywords []string `json:"keywords,omitempty"`
+
+	CTime time.Time `json:"ctime"`
+	MTime time.Time `json:"mtime"`
+}
+
+// Open returns a Storage keeping keys beneath dir, which is created if it
+// does not exist.
+func Open(dir string) (*Storage, error) {
+	err := os.MkdirAll(filepath.Join(dir, keysDir), 0755)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	s := &Storage{
+		dir:     dir,
+		keys:    map[string]*entry{},
+		digests: map[string]string{},
+		clock:   clock.Real,
+	}
+	err = s.load()
+	if os.IsNotExist(errgo.Cause(err)) {
+		log.Infof("rebuilding key index in %q", dir)
+		err = s.rebuild()
+		if err == nil {
+			err = s.writeIndex()
+		}
+	}
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot open key storage in %q", dir)
+	}
+	return s, nil
+}
+
+// SetClock sets the clock by which keys are timestamped when they are
+// inserted and updated.
+func (s *Storage) SetClock(c clock.Clock) {
+	s.mu.Lock()
+	s.clock = c
+	s.mu.Unlock()
+}
+
+// Len returns the number of keys stored.
+func (s *Storage) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.keys)
+}
+
+// Close implements io.Closer. The index is written as keys are changed, so
+// there is nothing to do.
+func (s *Storage) Close() error {
+	return nil
+}
+
+// path returns the path of the file storing the key with rfp.
+func (s *Storage) path(rfp string) string {
+	elems := []string{s.dir, keysDir}
+	for i := 0; i < fanoutDepth && len(rfp) >= (i+1)*fanout; i++ {
+		elems = append(elems, rfp[i*fanout:(i+1)*fanout])
+	}
+	return filepath.Join(append(elems, rfp+keySuffix)...)
+}
+
+// load reads the index.
+func (s *Storage) load() error {
+	buf, err := ioutil.ReadFile(filepath.Join(s.dir, indexFile))
+	if err != nil {
+		return errgo.Mask(err, os.IsNotExist)
+	}
+	var keys map[string]*entry
+	err = json.Unmarshal(buf, &keys)
+	if err != nil {
+		return errgo.Notef(err, "invalid index")
+	}
+	for rfp, e := range keys {
+		s.keys[rfp] = e
+		s.digests[strings.ToLower(e.MD5)] = rfp
+	}
+	return nil
+}
+
+// rebuild indexes the key files.
+func (s *Storage) rebuild() error {
+	return filepath.Walk(filepath.Join(s.dir, keysDir), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if info.IsDir() || !strings.HasSuffix(path, keySuffix) {
+			return nil
+		}
+		key, err := readKey(path)
+		if err != nil {
+			return errgo.Notef(err, "cannot read %q", path)
+		}
+		rfp := strings.ToLower(key.RFingerprint)
+		if path != s.path(rfp) {
+			return errgo.Newf("%q does not contain key %q", path, rfp)
+		}
+		e := newEntry(key, info.ModTime())
+		s.keys[rfp] = e
+		s.digests[strings.ToLower(e.MD5)] = rfp
+		return nil
+	})
+}
+
+// writeIndex replaces the index, so that a crash while writing leaves the
+// previous index intact. s.mu must be held.
+func (s *Storage) writeIndex() error {
+	buf, err := json.Marshal(s.keys)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	path := filepath.Join(s.dir, indexFile)
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, buf, 0644)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(os.Rename(tmp, path))
+}
+
+func newEntry(key *openpgp.PrimaryKey, now time.Time) *entry {
+	e := &entry{
+		MD5:           key.MD5,
+		SHA256:        key.SHA256,
+		RFingerprints: []string{strings.ToLower(key.RFingerprint)},
+		CTime:         now,
+		MTime:         now,
+	}
+	for _, subKey := range key.SubKeys {
+		e.RFingerprints = append(e.RFingerprints, strings.ToLower(subKey.RFingerprint))
+	}
+	for _, uid := range key.UserIDs {
+		e.Keywords = append(e.Keywords, strings.ToLower(uid.Keywords))
+	}
+	return e
+}
+
+// readKey reads the key armored in the file at path.
+func readKey(path string) (*openpgp.PrimaryKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer f.Close()
+	readKeys, err := openpgp.ReadArmorKeys(f)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var key *openpgp.PrimaryKey
+	for readKey := range readKeys {
+		if readKey.Error != nil {
+			return nil, errgo.Mask(readKey.Error)
+		}
+		if key != nil {
+			return nil, errgo.New("more than one key")
+		}
+		key = readKey.PrimaryKey
+	}
+	if key == nil {
+		return nil, errgo.New("no key")
+	}
+	return key, nil
+}
+
+// writeKey replaces the file storing key, so that a crash while writing
+// leaves the previous key intact.
+func (s *Storage) writeKey(key *openpgp.PrimaryKey) error {
+	var buf bytes.Buffer
+	err := openpgp.WriteArmoredPackets(&buf, []*openpgp.PrimaryKey{key})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	path := s.path(strings.ToLower(key.RFingerprint))
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, buf.Bytes(), 0644)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(os.Rename(tmp, path))
+}
+
+// Digests implements storage.DigestLister.
+func (s *Storage) Digests() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := make([]string, 0, len(s.keys))
+	for _, e := range s.keys {
+		result = append(result, e.MD5)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// MatchMD5 implements storage.Queryer.
+func (s *Storage) MatchMD5(digests []string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var result []string
+	for _, digest := range digests {
+		if rfp, ok := s.digests[strings.ToLower(digest)]; ok {
+			result = append(result, rfp)
+		}
+	}
+	return result, nil
+}
+
+// Resolve implements storage.Queryer. Key IDs are matched against the
+// RFingerprints of primary keys and their subkeys.
+func (s *Storage) Resolve(keyIDs []string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.match(func(e *entry) bool {
+		for _, keyID := range keyIDs {
+			keyID = strings.ToLower(keyID)
+			for _, rfp := range e.RFingerprints {
+				if strings.HasPrefix(rfp, keyID) {
+					return true
+				}
+			}
+		}
+		return false
+	}), nil
+}
+
+// MatchKeyword implements storage.Queryer. Keys match if any of their user
+// IDs contains every search term, ignoring case.
+func (s *Storage) MatchKeyword(search []string) ([]string, error) {
+	if len(search) == 0 {
+		return nil, nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.match(func(e *entry) bool {
+		for _, keyword := range e.Keywords {
+			if containsAll(keyword, search) {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+func containsAll(s string, terms []string) bool {
+	for _, term := range terms {
+		if !strings.Contains(s, strings.ToLower(term)) {
+			return false
+		}
+	}
+	return true
+}
+
+// ModifiedSince implements storage.Queryer.
+func (s *Storage) ModifiedSince(t time.Time) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.match(func(e *entry) bool {
+		return e.MTime.After(t)
+	}), nil
+}
+
+// match returns the RFingerprints of the keys matching f, in order. s.mu
+// must be held.
+func (s *Storage) match(f func(*entry) bool) []string {
+	var result []string
+	for rfp, e := range s.keys {
+		if f(e) {
+			result = append(result, rfp)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// FetchKeys implements storage.Queryer.
+func (s *Storage) FetchKeys(rfps []string) ([]*openpgp.PrimaryKey, error) {
+	keyrings, err := s.FetchKeyrings(rfps)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var result []*openpgp.PrimaryKey
+	for _, kr := range keyrings {
+		result = append(result, kr.PrimaryKey)
+	}
+	return result, nil
+}
+
+// FetchKeyrings implements storage.Queryer.
+func (s *Storage) FetchKeyrings(rfps []string) ([]*storage.Keyring, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var result []*storage.Keyring
+	for _, rfp := range rfps {
+		rfp = strings.ToLower(rfp)
+		e, ok := s.keys[rfp]
+		if !ok {
+			continue
+		}
+		key, err := readKey(s.path(rfp))
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot read key %q", rfp)
+		}
+		key.MD5 = e.MD5
+		key.SHA256 = e.SHA256
+		result = append(result, &storage.Keyring{PrimaryKey: key, CTime: e.CTime, MTime: e.MTime})
+	}
+	return result, nil
+}
+
+// Insert implements storage.Inserter. Keys already stored are returned as
+// duplicates in a storage.InsertError.
+func (s *Storage) Insert(keys []*openpgp.PrimaryKey) (int, error) {
+	var insertErr storage.InsertError
+	var changes []storage.KeyChange
+	s.mu.Lock()
+	now := s.clock.Now()
+	for _, key := range keys {
+		rfp := strings.ToLower(key.RFingerprint)
+		if _, ok := s.keys[rfp]; ok {
+			insertErr.Duplicates = append(insertErr.Duplicates, key)
+			continue
+		}
+		err := s.writeKey(key)
+		if err != nil {
+			insertErr.Errors = append(insertErr.Errors, err)
+			continue
+		}
+		s.keys[rfp] = newEntry(key, now)
+		s.digests[strings.ToLower(key.MD5)] = rfp
+		changes = append(changes, storage.KeyAdded{Digest: key.MD5})
+	}
+	var err error
+	if len(changes) > 0 {
+		err = s.writeIndex()
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return len(changes), errgo.Mask(err)
+	}
+
+	err = s.notifyAll(changes)
+	if err != nil {
+		return len(changes), errgo.Mask(err)
+	}
+	if len(insertErr.Duplicates) > 0 || len(insertErr.Errors) > 0 {
+		return len(changes), insertErr
+	}
+	return len(changes), nil
+}
+
+// Update implements storage.Updater.
+func (s *Storage) Update(key *openpgp.PrimaryKey, priorMD5 string) error {
+	s.mu.Lock()
+	rfp := strings.ToLower(key.RFingerprint)
+	prior, ok := s.keys[rfp]
+	if !ok {
+		s.mu.Unlock()
+		return storage.ErrKeyNotFound
+	}
+	if !strings.EqualFold(prior.MD5, priorMD5) {
+		s.mu.Unlock()
+		return errgo.Newf("key %q has digest %q, not %q", key.Fingerprint(), prior.MD5, priorMD5)
+	}
+	err := s.writeKey(key)
+	if err != nil {
+		s.mu.Unlock()
+		return errgo.Mask(err)
+	}
+	e := newEntry(key, s.clock.Now())
+	e.CTime = prior.CTime
+	delete(s.digests, strings.ToLower(prior.MD5))
+	s.keys[rfp] = e
+	s.digests[strings.ToLower(e.MD5)] = rfp
+	err = s.writeIndex()
+	s.mu.Unlock()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+
+	return errgo.Mask(s.Notify(storage.KeyReplaced{OldDigest: priorMD5, NewDigest: key.MD5}), errgo.Any)
+}
+
+// Delete implements storage.Deleter.
+func (s *Storage) Delete(rfps []string) (int, error) {
+	var changes []storage.KeyChange
+	s.mu.Lock()
+	for _, rfp := range rfps {
+		rfp = strings.ToLower(rfp)
+		e, ok := s.keys[rfp]
+		if !ok {
+			continue
+		}
+		err := os.Remove(s.path(rfp))
+		if err != nil && !os.IsNotExist(err) {
+			s.mu.Unlock()
+			return len(changes), errgo.Mask(err)
+		}
+		delete(s.keys, rfp)
+		delete(s.digests, strings.ToLower(e.MD5))
+		changes = append(changes, storage.KeyRemoved{Digest: e.MD5})
+	}
+	var err error
+	if len(changes) > 0 {
+		err = s.writeIndex()
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return len(changes), errgo.Mask(err)
+	}
+	return len(changes), errgo.Mask(s.notifyAll(changes), errgo.Any)
+}
+
+// Subscribe implements storage.Notifier.
+func (s *Storage) Subscribe(f func(storage.KeyChange) error) {
+	s.listenerMu.Lock()
+	s.listeners = append(s.listeners, f)
+	s.listenerMu.Unlock()
+}
+
+// Notify implements storage.Notifier. Subscribers are called in the order
+// they subscribed, until one fails.
+func (s *Storage) Notify(change storage.KeyChange) error {
+	s.listenerMu.RLock()
+	listeners := s.listeners
+	s.listenerMu.RUnlock()
+	for _, f := range listeners {
+		err := f(change)
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+	}
+	return nil
+}
+
+func (s *Storage) notifyAll(changes []storage.KeyChange) error {
+	for _, change := range changes {
+		err := s.Notify(change)
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+	}
+	return nil
+}
+
+// RenotifyAll implements storage.Notifier.
+func (s *Storage) RenotifyAll() error {
+	s.mu.RLock()
+	var changes []storage.KeyChange
+	for _, rfp := range s.match(func(*entry) bool { return true }) {
+		changes = append(changes, storage.KeyAdded{Digest: s.keys[rfp].MD5})
+	}
+	s.mu.RUnlock()
+	return errgo.Mask(s.notifyAll(changes), errgo.Any)
+}
@@ -0,0 +1,97 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	stdtesting "testing"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/hockeypuck/testing"
+	"gopkg.in/hockeypuck/openpgp.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+	"gopkg.in/hockeypuck/hkp.v1/storage/storagetest"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+var _ = gc.Suite(&storagetest.Suite{
+	NewStorage: func(c *gc.C) storage.Storage {
+		st, err := Open(c.MkDir())
+		c.Assert(err, gc.IsNil)
+		return st
+	},
+})
+
+type FSSuite struct{}
+
+var _ = gc.Suite(&FSSuite{})
+
+func (s *FSSuite) TestPath(c *gc.C) {
+	st, err := Open(c.MkDir())
+	c.Assert(err, gc.IsNil)
+	c.Assert(st.path("acc0ffee"), gc.Equals, filepath.Join(st.dir, "keys", "ac", "c0", "acc0ffee.asc"))
+	c.Assert(st.path("acc"), gc.Equals, filepath.Join(st.dir, "keys", "ac", "acc.asc"))
+	_, err = os.Stat(filepath.Join(st.dir, "index.json"))
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *FSSuite) TestReopen(c *gc.C) {
+	dir := c.MkDir()
+	st, err := Open(dir)
+	c.Assert(err, gc.IsNil)
+	keys := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")).MustParse()
+	c.Assert(keys, gc.HasLen, 1)
+	_, err = st.Insert(keys)
+	c.Assert(err, gc.IsNil)
+	_, err = os.Stat(st.path(keys[0].RFingerprint))
+	c.Assert(err, gc.IsNil)
+
+	check := func(st *Storage) {
+		c.Assert(st.Len(), gc.Equals, 1)
+		rfps, err := st.MatchMD5([]string{keys[0].MD5})
+		c.Assert(err, gc.IsNil)
+		c.Assert(rfps, gc.DeepEquals, []string{keys[0].RFingerprint})
+		rfps, err = st.MatchKeyword([]string{"alice"})
+		c.Assert(err, gc.IsNil)
+		c.Assert(rfps, gc.DeepEquals, []string{keys[0].RFingerprint})
+		fetched, err := st.FetchKeys(rfps)
+		c.Assert(err, gc.IsNil)
+		c.Assert(fetched, gc.HasLen, 1)
+		c.Assert(fetched[0].MD5, gc.Equals, keys[0].MD5)
+	}
+	st, err = Open(dir)
+	c.Assert(err, gc.IsNil)
+	check(st)
+
+	// Without the index, it is rebuilt from the key files.
+	err = os.Remove(filepath.Join(dir, "index.json"))
+	c.Assert(err, gc.IsNil)
+	st, err = Open(dir)
+	c.Assert(err, gc.IsNil)
+	check(st)
+
+	n, err := st.Delete([]string{keys[0].RFingerprint})
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	_, err = os.Stat(st.path(keys[0].RFingerprint))
+	c.Assert(os.IsNotExist(err), gc.Equals, true)
+}
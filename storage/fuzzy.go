@@ -0,0 +1,163 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"strings"
+	"unicode"
+)
+
+// FuzzyOptions controls approximate keyword matching.
+type FuzzyOptions struct {
+	// MaxDistance is the largest edit distance at which a search word
+	// matches a word of a user ID. If zero, it depends on the length of the
+	// search word: exact for up to two characters, one edit for up to five,
+	// and two edits for longer words.
+	MaxDistance int
+
+	// Phonetic also matches words which sound alike, by their Soundex codes.
+	Phonetic bool
+}
+
+// FuzzyMatcher may be implemented by storage backends which can match
+// keywords approximately, tolerating common misspellings of names.
+type FuzzyMatcher interface {
+	// MatchFuzzy returns the RFingerprints of keys with user IDs which
+	// approximately match the search keywords, as decided by
+	// FuzzyOptions.Match.
+	MatchFuzzy(search []string, opts FuzzyOptions) ([]string, error)
+}
+
+// Match returns whether every word of search approximately matches some word
+// of text.
+func (o FuzzyOptions) Match(search, text string) bool {
+	searchWords, textWords := fuzzyWords(search), fuzzyWords(text)
+	if len(searchWords) == 0 {
+		return false
+	}
+	for _, sw := range searchWords {
+		if !o.matchWord(sw, textWords) {
+			return false
+		}
+	}
+	return true
+}
+
+func (o FuzzyOptions) matchWord(word string, text []string) bool {
+	max := o.MaxDistance
+	if max <= 0 {
+		switch n := len([]rune(word)); {
+		case n <= 2:
+			max = 0
+		case n <= 5:
+			max = 1
+		default:
+			max = 2
+		}
+	}
+	for _, tw := range text {
+		if strings.HasPrefix(tw, word) || EditDistance(word, tw) <= max {
+			return true
+		}
+		if o.Phonetic && Soundex(word) == Soundex(tw) {
+			return true
+		}
+	}
+	return false
+}
+
+// fuzzyWords splits s into lowercase words of letters and digits.
+func fuzzyWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// EditDistance returns the Levenshtein distance between a and b: the number
+// of single character insertions, deletions and substitutions needed to
+// change one into the other.
+func EditDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// soundexCodes maps consonants to their Soundex digits.
+var soundexCodes = map[rune]byte{
+	'b': '1', 'f': '1', 'p': '1', 'v': '1',
+	'c': '2', 'g': '2', 'j': '2', 'k': '2', 'q': '2', 's': '2', 'x': '2', 'z': '2',
+	'd': '3', 't': '3',
+	'l': '4',
+	'm': '5', 'n': '5',
+	'r': '6',
+}
+
+// Soundex returns the American Soundex code of word, such as "R163" for
+// both "Robert" and "Rupert", or "" if word does not start with an ASCII
+// letter.
+func Soundex(word string) string {
+	word = strings.ToLower(word)
+	if word == "" || word[0] < 'a' || word[0] > 'z' {
+		return ""
+	}
+	code := []byte{word[0] - 'a' + 'A'}
+	last := soundexCodes[rune(word[0])]
+	for _, r := range word[1:] {
+		digit, ok := soundexCodes[r]
+		switch {
+		case ok && digit != last:
+			code = append(code, digit)
+			if len(code) == 4 {
+				return string(code)
+			}
+		case r == 'h' || r == 'w':
+			// Consonants separated by h or w are coded once.
+			continue
+		}
+		last = digit
+	}
+	for len(code) < 4 {
+		code = append(code, '0')
+	}
+	return string(code)
+}
@@ -0,0 +1,37 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"time"
+)
+
+// Leaser may be implemented by storage backends shared by several servers,
+// so that they can agree which of them performs a task, such as
+// reconciling with recon partners, that only one should.
+type Leaser interface {
+	// AcquireLease acquires the lease name for holder until ttl from now,
+	// or renews it if holder already holds it. It returns whether holder
+	// holds the lease; it does not if another holder's lease has not yet
+	// expired.
+	AcquireLease(name, holder string, ttl time.Duration) (bool, error)
+
+	// ReleaseLease releases the lease name if it is held by holder, so
+	// that another may acquire it without waiting for it to expire.
+	ReleaseLease(name, holder string) error
+}
@@ -0,0 +1,271 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/hockeypuck/openpgp.v1"
+)
+
+// ErrLimitExceeded is the cause of errors refusing keys which exceed
+// PacketLimits.
+var ErrLimitExceeded = errgo.New("key exceeds packet limits")
+
+// LimitMode selects what is done with keys exceeding PacketLimits.
+type LimitMode int
+
+const (
+	// LimitReject refuses such keys.
+	LimitReject = LimitMode(iota)
+
+	// LimitTruncate drops the excess packets and keeps the rest of the
+	// key. Keys which are still too large are refused.
+	LimitTruncate
+)
+
+func ParseLimitMode(s string) (LimitMode, bool) {
+	switch s {
+	case "", "reject":
+		return LimitReject, true
+	case "truncate":
+		return LimitTruncate, true
+	}
+	return LimitReject, false
+}
+
+func (m LimitMode) String() string {
+	if m == LimitTruncate {
+		return "truncate"
+	}
+	return "reject"
+}
+
+// PacketLimits bounds the packets of keys submitted or recovered, so that
+// certificates flooded with signatures, user IDs or subkeys do not poison
+// storage or recon. Limits which are zero are not enforced. Limits apply to
+// each key as it is received, and again to the key as merged with the key
+// stored, with UpsertKeyChecked, so that a key cannot grow beyond them
+// through many submissions each within them.
+type PacketLimits struct {
+	// MaxUIDSigs is the maximum number of third-party signatures on each
+	// user ID or user attribute. When truncating, the most recent are
+	// kept.
+	MaxUIDSigs int
+
+	// MaxUserIDs is the maximum number of user IDs. When truncating,
+	// those with self-signatures are kept first.
+	MaxUserIDs int
+
+	// MaxSubKeys is the maximum number of subkeys. When truncating, the
+	// most recently created are kept.
+	MaxSubKeys int
+
+	// MaxKeySize is the maximum size of a key, in bytes, as stored. When
+	// truncating, every third-party signature is dropped from a key which
+	// is still too large.
+	MaxKeySize int
+
+	// MaxNotations is the maximum number of notations on each signature,
+	// and MaxNotationSize the maximum size of the name and value of each,
+	// in bytes. Notations may carry arbitrary data, so are otherwise an
+	// easy way to smuggle large blobs into a key. When truncating, unhashed
+	// notations exceeding the limits are removed, and signatures with
+	// hashed notations exceeding them are dropped.
+	MaxNotations    int
+	MaxNotationSize int
+
+	Mode LimitMode
+}
+
+// Enforce checks key against the limits. In LimitTruncate mode, excess
+// packets are dropped from key, its digests are updated, and the packets
+// kept and dropped are returned. Otherwise, or if key cannot be truncated
+// to fit, an error with cause ErrLimitExceeded is returned.
+func (l *PacketLimits) Enforce(key *openpgp.PrimaryKey) (PacketCounts, error) {
+	before := CountPackets(key)
+	if l.Mode != LimitTruncate {
+		if err := l.check(key); err != nil {
+			return PacketCounts{}, errgo.Mask(err, errgo.Is(ErrLimitExceeded))
+		}
+		return PacketCounts{Accepted: before}, nil
+	}
+
+	if l.limitsNotations() {
+		if err := l.limitKeyNotations(key); err != nil {
+			return PacketCounts{}, errgo.Mask(err)
+		}
+	}
+	if l.MaxUserIDs > 0 && len(key.UserIDs) > l.MaxUserIDs {
+		sort.SliceStable(key.UserIDs, func(i, j int) bool {
+			return hasSelfSig(key, key.UserIDs[i].Signatures) && !hasSelfSig(key, key.UserIDs[j].Signatures)
+		})
+		key.UserIDs = key.UserIDs[:l.MaxUserIDs]
+	}
+	if l.MaxSubKeys > 0 && len(key.SubKeys) > l.MaxSubKeys {
+		sort.SliceStable(key.SubKeys, func(i, j int) bool {
+			return key.SubKeys[i].Creation.After(key.SubKeys[j].Creation)
+		})
+		key.SubKeys = key.SubKeys[:l.MaxSubKeys]
+	}
+	if l.MaxUIDSigs > 0 {
+		for _, uid := range key.UserIDs {
+			uid.Signatures = limitThirdPartySigs(key, uid.Signatures, l.MaxUIDSigs)
+		}
+		for _, uat := range key.UserAttributes {
+			uat.Signatures = limitThirdPartySigs(key, uat.Signatures, l.MaxUIDSigs)
+		}
+	}
+	size, err := KeySize(key)
+	if err != nil {
+		return PacketCounts{}, errgo.Mask(err)
+	}
+	if l.MaxKeySize > 0 && size > l.MaxKeySize {
+		for _, uid := range key.UserIDs {
+			uid.Signatures = limitThirdPartySigs(key, uid.Signatures, 0)
+		}
+		for _, uat := range key.UserAttributes {
+			uat.Signatures = limitThirdPartySigs(key, uat.Signatures, 0)
+		}
+	}
+	if err := l.check(key); err != nil {
+		return PacketCounts{}, errgo.Mask(err, errgo.Is(ErrLimitExceeded))
+	}
+
+	after := CountPackets(key)
+	if after < before {
+		key.MD5 = openpgp.SksDigest(key, md5.New())
+		key.SHA256 = openpgp.SksDigest(key, sha256.New())
+	}
+	return PacketCounts{Accepted: after, Dropped: before - after}, nil
+}
+
+// check returns an error if key exceeds any of the limits.
+func (l *PacketLimits) check(key *openpgp.PrimaryKey) error {
+	if l.MaxUserIDs > 0 && len(key.UserIDs) > l.MaxUserIDs {
+		return errgo.WithCausef(nil, ErrLimitExceeded,
+			"key %q has %d user IDs, more than the %d allowed", key.Fingerprint(), len(key.UserIDs), l.MaxUserIDs)
+	}
+	if l.MaxSubKeys > 0 && len(key.SubKeys) > l.MaxSubKeys {
+		return errgo.WithCausef(nil, ErrLimitExceeded,
+			"key %q has %d subkeys, more than the %d allowed", key.Fingerprint(), len(key.SubKeys), l.MaxSubKeys)
+	}
+	if l.MaxUIDSigs > 0 {
+		for _, uid := range key.UserIDs {
+			if n := countThirdPartySigs(key, uid.Signatures); n > l.MaxUIDSigs {
+				return errgo.WithCausef(nil, ErrLimitExceeded,
+					"key %q has %d third-party signatures on a user ID, more than the %d allowed",
+					key.Fingerprint(), n, l.MaxUIDSigs)
+			}
+		}
+		for _, uat := range key.UserAttributes {
+			if n := countThirdPartySigs(key, uat.Signatures); n > l.MaxUIDSigs {
+				return errgo.WithCausef(nil, ErrLimitExceeded,
+					"key %q has %d third-party signatures on a user attribute, more than the %d allowed",
+					key.Fingerprint(), n, l.MaxUIDSigs)
+			}
+		}
+	}
+	if l.limitsNotations() {
+		for _, sigs := range signatureLists(key) {
+			for _, sig := range *sigs {
+				if err := l.checkNotations(sig.Packet.Packet); err != nil {
+					return errgo.NoteMask(err, fmt.Sprintf("key %q", key.Fingerprint()), errgo.Is(ErrLimitExceeded))
+				}
+			}
+		}
+	}
+	if l.MaxKeySize > 0 {
+		size, err := KeySize(key)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if size > l.MaxKeySize {
+			return errgo.WithCausef(nil, ErrLimitExceeded,
+				"key %q is %d bytes, more than the %d allowed", key.Fingerprint(), size, l.MaxKeySize)
+		}
+	}
+	return nil
+}
+
+func isSelfSig(key *openpgp.PrimaryKey, sig *openpgp.Signature) bool {
+	return sig.RIssuerKeyID == key.RKeyID
+}
+
+func hasSelfSig(key *openpgp.PrimaryKey, sigs []*openpgp.Signature) bool {
+	for _, sig := range sigs {
+		if isSelfSig(key, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+func countThirdPartySigs(key *openpgp.PrimaryKey, sigs []*openpgp.Signature) int {
+	var n int
+	for _, sig := range sigs {
+		if !isSelfSig(key, sig) {
+			n++
+		}
+	}
+	return n
+}
+
+// limitThirdPartySigs returns sigs with all self-signatures, and at most the
+// n most recent third-party signatures.
+func limitThirdPartySigs(key *openpgp.PrimaryKey, sigs []*openpgp.Signature, n int) []*openpgp.Signature {
+	if countThirdPartySigs(key, sigs) <= n {
+		return sigs
+	}
+	var result, thirdParty []*openpgp.Signature
+	for _, sig := range sigs {
+		if isSelfSig(key, sig) {
+			result = append(result, sig)
+		} else {
+			thirdParty = append(thirdParty, sig)
+		}
+	}
+	sort.SliceStable(thirdParty, func(i, j int) bool {
+		return thirdParty[i].Creation.After(thirdParty[j].Creation)
+	})
+	return append(result, thirdParty[:n]...)
+}
+
+// KeySize returns the size of key in bytes, as stored.
+func KeySize(key *openpgp.PrimaryKey) (int, error) {
+	var cw countingWriter
+	err := openpgp.WritePackets(&cw, key)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	return cw.n, nil
+}
+
+type countingWriter struct {
+	n int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += len(p)
+	return len(p), nil
+}
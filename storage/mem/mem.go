@@ -0,0 +1,382 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package mem provides an implementation of storage.Storage which keeps keys
+// in memory, for tests, demonstrations and small deployments which do not
+// need them to persist. Keys are stored serialized, so that those fetched
+// may be modified without changing those stored.
+package mem
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/hockeypuck/openpgp.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/clock"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+)
+
+// Storage is an in-memory storage.Storage. The zero value is not usable;
+// use NewStorage.
+type Storage struct {
+	mu sync.RWMutex
+	// keys holds the stored keys, by RFingerprint.
+	keys map[string]*record
+	// digests holds the RFingerprints of the stored keys, by digest.
+	digests map[string]string
+	clock   clock.Clock
+
+	listenerMu sync.RWMutex
+	listeners  []func(storage.KeyChange) error
+}
+
+var (
+	_ storage.Storage      = (*Storage)(nil)
+	_ storage.Deleter      = (*Storage)(nil)
+	_ storage.DigestLister = (*Storage)(nil)
+)
+
+// record is a stored key.
+type record struct {
+	packets []byte
+	md5     string
+	sha256  string
+	// rfps holds the RFingerprints of the primary key and its subkeys,
+	// by which it is resolved.
+	rfps []string
+	// keywords holds the lower-cased user IDs, for keyword search.
+	keywords []string
+
+	ctime, mtime time.Time
+}
+
+// NewStorage returns an empty Storage.
+func NewStorage() *Storage {
+	return &Storage{
+		keys:    map[string]*record{},
+		digests: map[string]string{},
+		clock:   clock.Real,
+	}
+}
+
+// SetClock sets the clock by which keys are timestamped when they are
+// inserted and updated.
+func (s *Storage) SetClock(c clock.Clock) {
+	s.mu.Lock()
+	s.clock = c
+	s.mu.Unlock()
+}
+
+// Len returns the number of keys stored.
+func (s *Storage) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.keys)
+}
+
+// Close implements io.Closer. Keys remain available after Close.
+func (s *Storage) Close() error {
+	return nil
+}
+
+func newRecord(key *openpgp.PrimaryKey, now time.Time) (*record, error) {
+	var buf bytes.Buffer
+	err := openpgp.WritePackets(&buf, key)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	rec := &record{
+		packets: buf.Bytes(),
+		md5:     key.MD5,
+		sha256:  key.SHA256,
+		rfps:    []string{strings.ToLower(key.RFingerprint)},
+		ctime:   now,
+		mtime:   now,
+	}
+	for _, subKey := range key.SubKeys {
+		rec.rfps = append(rec.rfps, strings.ToLower(subKey.RFingerprint))
+	}
+	for _, uid := range key.UserIDs {
+		rec.keywords = append(rec.keywords, strings.ToLower(uid.Keywords))
+	}
+	return rec, nil
+}
+
+// key returns the key stored in rec.
+func (rec *record) key() (*openpgp.PrimaryKey, error) {
+	for readKey := range openpgp.ReadKeys(bytes.NewReader(rec.packets)) {
+		if readKey.Error != nil {
+			return nil, errgo.Mask(readKey.Error)
+		}
+		key := readKey.PrimaryKey
+		key.MD5 = rec.md5
+		key.SHA256 = rec.sha256
+		return key, nil
+	}
+	return nil, errgo.Newf("stored key %q is empty", rec.rfps[0])
+}
+
+// Digests implements storage.DigestLister.
+func (s *Storage) Digests() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := make([]string, 0, len(s.keys))
+	for _, rec := range s.keys {
+		result = append(result, rec.md5)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// MatchMD5 implements storage.Queryer.
+func (s *Storage) MatchMD5(digests []string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var result []string
+	for _, digest := range digests {
+		if rfp, ok := s.digests[strings.ToLower(digest)]; ok {
+			result = append(result, rfp)
+		}
+	}
+	return result, nil
+}
+
+// Resolve implements storage.Queryer. Key IDs are matched against the
+// RFingerprints of primary keys and their subkeys.
+func (s *Storage) Resolve(keyIDs []string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.match(func(rec *record) bool {
+		for _, keyID := range keyIDs {
+			keyID = strings.ToLower(keyID)
+			for _, rfp := range rec.rfps {
+				if strings.HasPrefix(rfp, keyID) {
+					return true
+				}
+			}
+		}
+		return false
+	}), nil
+}
+
+// MatchKeyword implements storage.Queryer. Keys match if any of their user
+// IDs contains every search term, ignoring case.
+func (s *Storage) MatchKeyword(search []string) ([]string, error) {
+	if len(search) == 0 {
+		return nil, nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.match(func(rec *record) bool {
+		for _, keyword := range rec.keywords {
+			if containsAll(keyword, search) {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+func containsAll(s string, terms []string) bool {
+	for _, term := range terms {
+		if !strings.Contains(s, strings.ToLower(term)) {
+			return false
+		}
+	}
+	return true
+}
+
+// ModifiedSince implements storage.Queryer.
+func (s *Storage) ModifiedSince(t time.Time) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.match(func(rec *record) bool {
+		return rec.mtime.After(t)
+	}), nil
+}
+
+// match returns the RFingerprints of the keys matching f, in order. s.mu
+// must be held.
+func (s *Storage) match(f func(*record) bool) []string {
+	var result []string
+	for rfp, rec := range s.keys {
+		if f(rec) {
+			result = append(result, rfp)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// FetchKeys implements storage.Queryer.
+func (s *Storage) FetchKeys(rfps []string) ([]*openpgp.PrimaryKey, error) {
+	keyrings, err := s.FetchKeyrings(rfps)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var result []*openpgp.PrimaryKey
+	for _, kr := range keyrings {
+		result = append(result, kr.PrimaryKey)
+	}
+	return result, nil
+}
+
+// FetchKeyrings implements storage.Queryer.
+func (s *Storage) FetchKeyrings(rfps []string) ([]*storage.Keyring, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var result []*storage.Keyring
+	for _, rfp := range rfps {
+		rec, ok := s.keys[strings.ToLower(rfp)]
+		if !ok {
+			continue
+		}
+		key, err := rec.key()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		result = append(result, &storage.Keyring{PrimaryKey: key, CTime: rec.ctime, MTime: rec.mtime})
+	}
+	return result, nil
+}
+
+// Insert implements storage.Inserter. Keys already stored are returned as
+// duplicates in a storage.InsertError.
+func (s *Storage) Insert(keys []*openpgp.PrimaryKey) (int, error) {
+	var insertErr storage.InsertError
+	var changes []storage.KeyChange
+	s.mu.Lock()
+	now := s.clock.Now()
+	for _, key := range keys {
+		rfp := strings.ToLower(key.RFingerprint)
+		if _, ok := s.keys[rfp]; ok {
+			insertErr.Duplicates = append(insertErr.Duplicates, key)
+			continue
+		}
+		rec, err := newRecord(key, now)
+		if err != nil {
+			insertErr.Errors = append(insertErr.Errors, err)
+			continue
+		}
+		s.keys[rfp] = rec
+		s.digests[strings.ToLower(rec.md5)] = rfp
+		changes = append(changes, storage.KeyAdded{Digest: key.MD5})
+	}
+	s.mu.Unlock()
+
+	err := s.notifyAll(changes)
+	if err != nil {
+		return len(changes), errgo.Mask(err)
+	}
+	if len(insertErr.Duplicates) > 0 || len(insertErr.Errors) > 0 {
+		return len(changes), insertErr
+	}
+	return len(changes), nil
+}
+
+// Update implements storage.Updater.
+func (s *Storage) Update(key *openpgp.PrimaryKey, priorMD5 string) error {
+	s.mu.Lock()
+	rfp := strings.ToLower(key.RFingerprint)
+	prior, ok := s.keys[rfp]
+	if !ok {
+		s.mu.Unlock()
+		return storage.ErrKeyNotFound
+	}
+	if !strings.EqualFold(prior.md5, priorMD5) {
+		s.mu.Unlock()
+		return errgo.Newf("key %q has digest %q, not %q", key.Fingerprint(), prior.md5, priorMD5)
+	}
+	rec, err := newRecord(key, s.clock.Now())
+	if err != nil {
+		s.mu.Unlock()
+		return errgo.Mask(err)
+	}
+	rec.ctime = prior.ctime
+	delete(s.digests, strings.ToLower(prior.md5))
+	s.keys[rfp] = rec
+	s.digests[strings.ToLower(rec.md5)] = rfp
+	s.mu.Unlock()
+
+	return errgo.Mask(s.Notify(storage.KeyReplaced{OldDigest: priorMD5, NewDigest: key.MD5}), errgo.Any)
+}
+
+// Delete implements storage.Deleter.
+func (s *Storage) Delete(rfps []string) (int, error) {
+	var changes []storage.KeyChange
+	s.mu.Lock()
+	for _, rfp := range rfps {
+		rfp = strings.ToLower(rfp)
+		rec, ok := s.keys[rfp]
+		if !ok {
+			continue
+		}
+		delete(s.keys, rfp)
+		delete(s.digests, strings.ToLower(rec.md5))
+		changes = append(changes, storage.KeyRemoved{Digest: rec.md5})
+	}
+	s.mu.Unlock()
+	return len(changes), errgo.Mask(s.notifyAll(changes), errgo.Any)
+}
+
+// Subscribe implements storage.Notifier.
+func (s *Storage) Subscribe(f func(storage.KeyChange) error) {
+	s.listenerMu.Lock()
+	s.listeners = append(s.listeners, f)
+	s.listenerMu.Unlock()
+}
+
+// Notify implements storage.Notifier. Subscribers are called in the order
+// they subscribed, until one fails.
+func (s *Storage) Notify(change storage.KeyChange) error {
+	s.listenerMu.RLock()
+	listeners := s.listeners
+	s.listenerMu.RUnlock()
+	for _, f := range listeners {
+		err := f(change)
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+	}
+	return nil
+}
+
+func (s *Storage) notifyAll(changes []storage.KeyChange) error {
+	for _, change := range changes {
+		err := s.Notify(change)
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+	}
+	return nil
+}
+
+// RenotifyAll implements storage.Notifier.
+func (s *Storage) RenotifyAll() error {
+	s.mu.RLock()
+	var changes []storage.KeyChange
+	for _, rfp := range s.match(func(*record) bool { return true }) {
+		changes = append(changes, storage.KeyAdded{Digest: s.keys[rfp].md5})
+	}
+	s.mu.RUnlock()
+	return errgo.Mask(s.notifyAll(changes), errgo.Any)
+}
@@ -0,0 +1,84 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package mem
+
+import (
+	stdtesting "testing"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/hockeypuck/testing"
+	"gopkg.in/hockeypuck/openpgp.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+	"gopkg.in/hockeypuck/hkp.v1/storage/storagetest"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+var _ = gc.Suite(&storagetest.Suite{
+	NewStorage: func(c *gc.C) storage.Storage { return NewStorage() },
+})
+
+type MemSuite struct{}
+
+var _ = gc.Suite(&MemSuite{})
+
+func (s *MemSuite) TestDelete(c *gc.C) {
+	st := NewStorage()
+	var changes []storage.KeyChange
+	st.Subscribe(func(kc storage.KeyChange) error {
+		changes = append(changes, kc)
+		return nil
+	})
+	keys := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")).MustParse()
+	c.Assert(keys, gc.HasLen, 1)
+	n, err := st.Insert(keys)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+
+	change, err := storage.DeleteKey(st, keys[0].RFingerprint)
+	c.Assert(err, gc.IsNil)
+	c.Assert(change, gc.Equals, storage.KeyRemoved{Digest: keys[0].MD5})
+	c.Assert(st.Len(), gc.Equals, 0)
+	rfps, err := st.MatchMD5([]string{keys[0].MD5})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+	c.Assert(changes, gc.DeepEquals, []storage.KeyChange{
+		storage.KeyAdded{Digest: keys[0].MD5},
+		storage.KeyRemoved{Digest: keys[0].MD5},
+	})
+}
+
+func (s *MemSuite) TestFetchedKeysAreCopies(c *gc.C) {
+	st := NewStorage()
+	keys := openpgp.MustReadArmorKeys(testing.MustInput("alice_unsigned.asc")).MustParse()
+	c.Assert(keys, gc.HasLen, 1)
+	_, err := st.Insert(keys)
+	c.Assert(err, gc.IsNil)
+
+	fetched, err := st.FetchKeys([]string{keys[0].RFingerprint})
+	c.Assert(err, gc.IsNil)
+	c.Assert(fetched, gc.HasLen, 1)
+	fetched[0].MD5 = "00000000000000000000000000000000"
+	fetched[0].UserIDs = nil
+	refetched, err := st.FetchKeys([]string{keys[0].RFingerprint})
+	c.Assert(err, gc.IsNil)
+	c.Assert(refetched[0].MD5, gc.Equals, keys[0].MD5)
+	c.Assert(refetched[0].UserIDs, gc.HasLen, len(keys[0].UserIDs))
+}
@@ -18,6 +18,7 @@
 package mock
 
 import (
+	"sync"
 	"time"
 
 	"gopkg.in/hockeypuck/openpgp.v1"
@@ -56,6 +57,8 @@ type fetchKeyringsFunc func([]string) ([]*storage.Keyring, error)
 type insertFunc func([]*openpgp.PrimaryKey) (int, error)
 type updateFunc func(*openpgp.PrimaryKey, string) error
 type renotifyAllFunc func() error
+type deleteFunc func([]string) (int, error)
+type matchFuzzyFunc func([]string, storage.FuzzyOptions) ([]string, error)
 
 type Storage struct {
 	Recorder
@@ -69,6 +72,9 @@ type Storage struct {
 	insert        insertFunc
 	update        updateFunc
 	renotifyAll   renotifyAllFunc
+	delete        deleteFunc
+	matchFuzzy    matchFuzzyFunc
+	leases        *Leases
 
 	notified []func(storage.KeyChange) error
 }
@@ -91,9 +97,17 @@ func FetchKeyrings(f fetchKeyringsFunc) Option {
 func Insert(f insertFunc) Option           { return func(m *Storage) { m.insert = f } }
 func Update(f updateFunc) Option           { return func(m *Storage) { m.update = f } }
 func RenotifyAll(f renotifyAllFunc) Option { return func(m *Storage) { m.renotifyAll = f } }
+func Delete(f deleteFunc) Option           { return func(m *Storage) { m.delete = f } }
+func MatchFuzzy(f matchFuzzyFunc) Option {
+	return func(m *Storage) { m.matchFuzzy = f }
+}
+
+// SharedLeases uses l for the leases of the storage, so that several mock
+// storages can share them, as servers sharing a database would.
+func SharedLeases(l *Leases) Option { return func(m *Storage) { m.leases = l } }
 
 func NewStorage(options ...Option) *Storage {
-	m := &Storage{}
+	m := &Storage{leases: NewLeases()}
 	for _, option := range options {
 		option(m)
 	}
@@ -163,6 +177,20 @@ func (m *Storage) Update(key *openpgp.PrimaryKey, lastMD5 string) error {
 	}
 	return nil
 }
+func (m *Storage) Delete(rfps []string) (int, error) {
+	m.record("Delete", rfps)
+	if m.delete != nil {
+		return m.delete(rfps)
+	}
+	return 0, nil
+}
+func (m *Storage) MatchFuzzy(s []string, opts storage.FuzzyOptions) ([]string, error) {
+	m.record("MatchFuzzy", s, opts)
+	if m.matchFuzzy != nil {
+		return m.matchFuzzy(s, opts)
+	}
+	return nil, nil
+}
 func (m *Storage) Subscribe(f func(storage.KeyChange) error) {
 	m.notified = append(m.notified, f)
 }
@@ -182,3 +210,67 @@ func (m *Storage) RenotifyAll() error {
 	}
 	return nil
 }
+
+type heldLease struct {
+	holder  string
+	expires time.Time
+}
+
+// Leases implements storage.Leaser in memory. Lease calls are not recorded,
+// as they are typically made from background goroutines.
+type Leases struct {
+	mu   sync.Mutex
+	held map[string]heldLease
+	err  error
+}
+
+func NewLeases() *Leases {
+	return &Leases{held: map[string]heldLease{}}
+}
+
+func (l *Leases) AcquireLease(name, holder string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return false, l.err
+	}
+	now := time.Now()
+	if lease, ok := l.held[name]; ok && lease.holder != holder && now.Before(lease.expires) {
+		return false, nil
+	}
+	l.held[name] = heldLease{holder: holder, expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (l *Leases) ReleaseLease(name, holder string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if lease, ok := l.held[name]; ok && lease.holder == holder {
+		delete(l.held, name)
+	}
+	return nil
+}
+
+// SetError makes AcquireLease fail with err, or succeed again if err is nil.
+func (l *Leases) SetError(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.err = err
+}
+
+// Holder returns the holder of the lease name, or "" if it is not held.
+func (l *Leases) Holder(name string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if lease, ok := l.held[name]; ok && time.Now().Before(lease.expires) {
+		return lease.holder
+	}
+	return ""
+}
+
+func (m *Storage) AcquireLease(name, holder string, ttl time.Duration) (bool, error) {
+	return m.leases.AcquireLease(name, holder, ttl)
+}
+func (m *Storage) ReleaseLease(name, holder string) error {
+	return m.leases.ReleaseLease(name, holder)
+}
@@ -18,9 +18,14 @@
 package mock_test
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/hockeypuck/openpgp.v1"
 
 	"gopkg.in/hockeypuck/hkp.v1/storage"
 	"gopkg.in/hockeypuck/hkp.v1/storage/mock"
@@ -41,3 +46,70 @@ func (*MockSuite) TestMatchMD5(c *gc.C) {
 	c.Assert(err, gc.IsNil)
 	c.Assert(m.Calls, gc.HasLen, 1)
 }
+
+func (*MockSuite) TestUpsertKeyContextCancelled(c *gc.C) {
+	m := mock.NewStorage()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := storage.UpsertKeyContext(ctx, m, &openpgp.PrimaryKey{})
+	c.Assert(errgo.Cause(err), gc.Equals, context.Canceled)
+	c.Assert(m.Calls, gc.HasLen, 0)
+}
+
+func (*MockSuite) TestUpsertKeysFallback(c *gc.C) {
+	m := mock.NewStorage(mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+		return nil, storage.ErrKeyNotFound
+	}))
+	changes, err := storage.UpsertKeys(m, []*openpgp.PrimaryKey{{MD5: "a"}, {MD5: "b"}})
+	c.Assert(err, gc.IsNil)
+	c.Assert(changes, gc.DeepEquals, []storage.KeyChange{
+		storage.KeyAdded{Digest: "a"}, storage.KeyAdded{Digest: "b"}})
+	c.Assert(m.MethodCount("Insert"), gc.Equals, 2)
+}
+
+func floodedKey() *openpgp.PrimaryKey {
+	day := func(d int) time.Time { return time.Date(2019, 6, d, 0, 0, 0, 0, time.UTC) }
+	selfSig := &openpgp.Signature{RIssuerKeyID: "self", Creation: day(1)}
+	key := &openpgp.PrimaryKey{PublicKey: openpgp.PublicKey{RKeyID: "self"}}
+	uid := &openpgp.UserID{Keywords: "alice", Signatures: []*openpgp.Signature{selfSig}}
+	for d := 1; d <= 5; d++ {
+		uid.Signatures = append(uid.Signatures, &openpgp.Signature{RIssuerKeyID: "flooder", Creation: day(d)})
+	}
+	key.UserIDs = []*openpgp.UserID{{Keywords: "unsigned"}, uid}
+	for d := 1; d <= 3; d++ {
+		key.SubKeys = append(key.SubKeys, &openpgp.SubKey{PublicKey: openpgp.PublicKey{Creation: day(d)}})
+	}
+	return key
+}
+
+func (*MockSuite) TestPacketLimits(c *gc.C) {
+	limits := storage.PacketLimits{MaxUIDSigs: 2, MaxUserIDs: 1, MaxSubKeys: 2}
+	_, err := limits.Enforce(floodedKey())
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrLimitExceeded)
+	c.Assert(err, gc.ErrorMatches, `key ".*" has 2 user IDs, more than the 1 allowed`)
+
+	limits.Mode = storage.LimitTruncate
+	key := floodedKey()
+	before := storage.CountPackets(key)
+	pc, err := limits.Enforce(key)
+	c.Assert(err, gc.IsNil)
+	c.Assert(pc.Dropped, gc.Equals, before-storage.CountPackets(key))
+	c.Assert(pc.Accepted, gc.Equals, storage.CountPackets(key))
+
+	// The self-signed user ID, its self-signature and the most recent
+	// third-party signatures, and the newest subkeys are kept.
+	c.Assert(key.UserIDs, gc.HasLen, 1)
+	sigs := key.UserIDs[0].Signatures
+	c.Assert(sigs, gc.HasLen, 3)
+	c.Assert(sigs[0].RIssuerKeyID, gc.Equals, "self")
+	c.Assert(sigs[1].Creation.Day(), gc.Equals, 5)
+	c.Assert(sigs[2].Creation.Day(), gc.Equals, 4)
+	c.Assert(key.SubKeys, gc.HasLen, 2)
+	c.Assert(key.SubKeys[0].Creation.Day(), gc.Equals, 3)
+
+	mode, ok := storage.ParseLimitMode("truncate")
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(mode, gc.Equals, storage.LimitTruncate)
+	_, ok = storage.ParseLimitMode("shrug")
+	c.Assert(ok, gc.Equals, false)
+}
@@ -0,0 +1,167 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"golang.org/x/crypto/openpgp/packet"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/hockeypuck/openpgp.v1"
+)
+
+// subpacketNotation is the notation data signature subpacket type (RFC 4880,
+// Section 5.2.3.16).
+const subpacketNotation = 20
+
+// notationSize returns the size of the name and value of a notation
+// subpacket.
+func notationSize(sub *packet.OpaqueSubpacket) int {
+	if len(sub.Contents) < 8 {
+		return 0
+	}
+	return len(sub.Contents) - 8
+}
+
+func isNotation(sub *packet.OpaqueSubpacket) bool {
+	return sub.SubType&0x7f == subpacketNotation
+}
+
+// limitsNotations returns whether any notation limits are enforced.
+func (l *PacketLimits) limitsNotations() bool {
+	return l.MaxNotations > 0 || l.MaxNotationSize > 0
+}
+
+// checkNotations returns an error with cause ErrLimitExceeded if the
+// signature packet in buf has more or larger notations than allowed.
+func (l *PacketLimits) checkNotations(buf []byte) error {
+	sp, err := parseSubpackets(buf)
+	if err != nil || sp == nil {
+		return errgo.Mask(err)
+	}
+	var n int
+	for _, sub := range append(sp.hashed, sp.unhashed...) {
+		if !isNotation(sub) {
+			continue
+		}
+		n++
+		if l.MaxNotationSize > 0 && notationSize(sub) > l.MaxNotationSize {
+			return errgo.WithCausef(nil, ErrLimitExceeded,
+				"signature has a notation of %d bytes, more than the %d allowed", notationSize(sub), l.MaxNotationSize)
+		}
+	}
+	if l.MaxNotations > 0 && n > l.MaxNotations {
+		return errgo.WithCausef(nil, ErrLimitExceeded,
+			"signature has %d notations, more than the %d allowed", n, l.MaxNotations)
+	}
+	return nil
+}
+
+// trimNotations returns the signature packet in buf without the unhashed
+// notations exceeding the limits, and whether any were removed. Notations
+// in the hashed area cannot be removed without invalidating the signature,
+// so if those exceed the limits, the signature must be dropped, and false
+// is returned for keep.
+func (l *PacketLimits) trimNotations(buf []byte) (result []byte, keep, changed bool, _ error) {
+	sp, err := parseSubpackets(buf)
+	if err != nil {
+		return nil, false, false, errgo.Mask(err)
+	}
+	if sp == nil {
+		return buf, true, false, nil
+	}
+	var n int
+	for _, sub := range sp.hashed {
+		if !isNotation(sub) {
+			continue
+		}
+		n++
+		if l.MaxNotationSize > 0 && notationSize(sub) > l.MaxNotationSize {
+			return nil, false, false, nil
+		}
+	}
+	if l.MaxNotations > 0 && n > l.MaxNotations {
+		return nil, false, false, nil
+	}
+	var kept []*packet.OpaqueSubpacket
+	for _, sub := range sp.unhashed {
+		if isNotation(sub) {
+			if l.MaxNotationSize > 0 && notationSize(sub) > l.MaxNotationSize {
+				continue
+			}
+			if l.MaxNotations > 0 && n >= l.MaxNotations {
+				continue
+			}
+			n++
+		}
+		kept = append(kept, sub)
+	}
+	if len(kept) == len(sp.unhashed) {
+		return buf, true, false, nil
+	}
+	result, err = sp.withUnhashed(kept)
+	if err != nil {
+		return nil, false, false, errgo.Mask(err)
+	}
+	return result, true, true, nil
+}
+
+// limitKeyNotations drops the signatures of key with hashed notations
+// exceeding the limits, and removes the unhashed notations which do. Key
+// is replaced in place by its trimmed form, with its digests updated.
+func (l *PacketLimits) limitKeyNotations(key *openpgp.PrimaryKey) error {
+	var changed bool
+	for _, sigs := range signatureLists(key) {
+		var kept []*openpgp.Signature
+		for _, sig := range *sigs {
+			buf, keep, rewritten, err := l.trimNotations(sig.Packet.Packet)
+			if err != nil {
+				return errgo.Notef(err, "cannot limit notations of key %q", key.Fingerprint())
+			}
+			if !keep {
+				changed = true
+				continue
+			}
+			if rewritten {
+				sig.Packet.Packet = buf
+				changed = true
+			}
+			kept = append(kept, sig)
+		}
+		*sigs = kept
+	}
+	if !changed {
+		return nil
+	}
+	return errgo.Mask(reread(key))
+}
+
+// signatureLists returns the lists of signatures on key and its user IDs,
+// user attributes and subkeys.
+func signatureLists(key *openpgp.PrimaryKey) []*[]*openpgp.Signature {
+	result := []*[]*openpgp.Signature{&key.Signatures}
+	for _, uid := range key.UserIDs {
+		result = append(result, &uid.Signatures)
+	}
+	for _, uat := range key.UserAttributes {
+		result = append(result, &uat.Signatures)
+	}
+	for _, subKey := range key.SubKeys {
+		result = append(result, &subKey.Signatures)
+	}
+	return result
+}
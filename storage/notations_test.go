@@ -0,0 +1,68 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	gc "gopkg.in/check.v1"
+)
+
+// notation returns a notation data subpacket with the given name and value.
+func notation(name, value string) []byte {
+	sub := []byte{byte(9 + len(name) + len(value)), subpacketNotation, 0x80, 0, 0, 0,
+		0, byte(len(name)), 0, byte(len(value))}
+	return append(append(sub, name...), value...)
+}
+
+func (s *StorageSuite) TestTrimNotations(c *gc.C) {
+	creation := []byte{5, 2, 0x5d, 0x00, 0x00, 0x00}
+	issuer := []byte{9, subpacketIssuer, 1, 2, 3, 4, 5, 6, 7, 8}
+	small := notation("a@example.com", "x")
+	large := notation("b@example.com", "0123456789abcdef")
+	l := &PacketLimits{MaxNotations: 1, MaxNotationSize: 16}
+
+	// Unhashed notations exceeding the limits are removed.
+	unhashed := append(append(append([]byte{}, issuer...), large...), small...)
+	unhashed = append(unhashed, small...)
+	buf := signaturePacket(creation, unhashed)
+	c.Assert(l.checkNotations(buf), gc.ErrorMatches, "signature has a notation of 29 bytes.*")
+	trimmed, keep, changed, err := l.trimNotations(buf)
+	c.Assert(err, gc.IsNil)
+	c.Assert(keep, gc.Equals, true)
+	c.Assert(changed, gc.Equals, true)
+	c.Assert(trimmed, gc.DeepEquals, signaturePacket(creation, append(append([]byte{}, issuer...), small...)))
+	c.Assert(l.checkNotations(trimmed), gc.IsNil)
+
+	// Signatures within the limits are unchanged.
+	_, keep, changed, err = l.trimNotations(trimmed)
+	c.Assert(err, gc.IsNil)
+	c.Assert(keep, gc.Equals, true)
+	c.Assert(changed, gc.Equals, false)
+
+	// Signatures whose hashed notations exceed the limits are dropped.
+	buf = signaturePacket(append(append([]byte{}, creation...), large...), issuer)
+	c.Assert(l.checkNotations(buf), gc.NotNil)
+	_, keep, _, err = l.trimNotations(buf)
+	c.Assert(err, gc.IsNil)
+	c.Assert(keep, gc.Equals, false)
+
+	buf = signaturePacket(append(append(append([]byte{}, creation...), small...), small...), issuer)
+	c.Assert(l.checkNotations(buf), gc.ErrorMatches, "signature has 2 notations, more than the 1 allowed")
+	_, keep, _, err = l.trimNotations(buf)
+	c.Assert(err, gc.IsNil)
+	c.Assert(keep, gc.Equals, false)
+}
@@ -0,0 +1,76 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"strings"
+	"time"
+)
+
+// Shapes of search queries, by the type of term searched for.
+const (
+	ShapeFingerprint = "fingerprint"
+	ShapeLongKeyID   = "long_keyid"
+	ShapeShortKeyID  = "short_keyid"
+	ShapeMD5         = "md5"
+	ShapeEmail       = "email"
+	ShapeKeyword     = "keyword"
+)
+
+// QueryStat describes how a search query was executed.
+type QueryStat struct {
+	// Shape is the type of term searched for, such as ShapeKeyword.
+	Shape string
+
+	// Index is the index the backend used, or empty if it is not known.
+	Index string
+
+	// Rows is the number of rows scanned, or the number of matches if the
+	// backend cannot tell.
+	Rows int
+
+	Duration time.Duration
+}
+
+// QueryObserver may be implemented by storage backends which can report how
+// they execute search queries, such as from the database's query planner.
+type QueryObserver interface {
+	// ObserveQueries registers f to be called with the statistics of each
+	// Resolve, MatchMD5 and MatchKeyword query.
+	ObserveQueries(f func(QueryStat))
+}
+
+// KeywordShape returns the shape of a keyword search for term.
+func KeywordShape(term string) string {
+	if strings.Contains(term, "@") {
+		return ShapeEmail
+	}
+	return ShapeKeyword
+}
+
+// KeyIDShape returns the shape of a search for the given key ID, fingerprint
+// or reversed fingerprint.
+func KeyIDShape(keyID string) string {
+	switch len(keyID) {
+	case 8:
+		return ShapeShortKeyID
+	case 16:
+		return ShapeLongKeyID
+	}
+	return ShapeFingerprint
+}
@@ -0,0 +1,335 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	log "gopkg.in/hockeypuck/logrus.v0"
+	"gopkg.in/hockeypuck/openpgp.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/events"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+)
+
+// reconnectInterval is how long a client waits before reconnecting to a
+// server's event stream.
+var reconnectInterval = 5 * time.Second
+
+// Client is a storage backend served by a remote Server.
+type Client struct {
+	// URL is the URL of the server, such as "http://storage:11371".
+	URL string
+
+	// Token is sent to the server as a bearer token, if set.
+	Token string
+
+	// Client makes requests to the server. If nil, http.DefaultClient is
+	// used.
+	Client *http.Client
+
+	// Reconnected is called, if set, when the event stream is reconnected
+	// after it was lost. Key changes made while disconnected are not
+	// notified, so subscribers which must see all of them should reconcile,
+	// for example by scrubbing a prefix tree.
+	Reconnected func()
+
+	mu       sync.Mutex
+	handlers []func(storage.KeyChange) error
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+var (
+	_ storage.Storage        = (*Client)(nil)
+	_ storage.ContextQueryer = (*Client)(nil)
+	_ storage.ContextUpdater = (*Client)(nil)
+	_ storage.Deleter        = (*Client)(nil)
+)
+
+// call makes a storage request to the server.
+func (c *Client) call(ctx context.Context, op string, req *request) (*response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	respBody, err := c.do(ctx, "POST", "/storage/"+op, bytes.NewReader(body))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer respBody.Close()
+	var resp response
+	err = json.NewDecoder(respBody).Decode(&resp)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid %s response", op)
+	}
+	if err := resp.err(); err != nil {
+		return nil, errgo.Mask(err, storage.IsNotFound)
+	}
+	return &resp, nil
+}
+
+// do makes a request to path on the server, and returns the response body
+// if it succeeded.
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader) (io.ReadCloser, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.URL, "/")+path, body)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, errgo.Newf("%s %s: %s: %s", method, req.URL.Path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp.Body, nil
+}
+
+func (c *Client) rfingerprints(ctx context.Context, op string, args []string) ([]string, error) {
+	resp, err := c.call(ctx, op, &request{Args: args})
+	if err != nil {
+		return nil, errgo.Mask(err, storage.IsNotFound)
+	}
+	return resp.RFingerprints, nil
+}
+
+// MatchMD5 implements storage.Queryer.
+func (c *Client) MatchMD5(digests []string) ([]string, error) {
+	return c.MatchMD5Context(context.Background(), digests)
+}
+
+// MatchMD5Context implements storage.ContextQueryer.
+func (c *Client) MatchMD5Context(ctx context.Context, digests []string) ([]string, error) {
+	return c.rfingerprints(ctx, "matchmd5", digests)
+}
+
+// Resolve implements storage.Queryer.
+func (c *Client) Resolve(keyids []string) ([]string, error) {
+	return c.rfingerprints(context.Background(), "resolve", keyids)
+}
+
+// MatchKeyword implements storage.Queryer.
+func (c *Client) MatchKeyword(keywords []string) ([]string, error) {
+	return c.rfingerprints(context.Background(), "matchkeyword", keywords)
+}
+
+// ModifiedSince implements storage.Queryer.
+func (c *Client) ModifiedSince(t time.Time) ([]string, error) {
+	resp, err := c.call(context.Background(), "modifiedsince", &request{Since: t})
+	if err != nil {
+		return nil, errgo.Mask(err, storage.IsNotFound)
+	}
+	return resp.RFingerprints, nil
+}
+
+// FetchKeys implements storage.Queryer.
+func (c *Client) FetchKeys(rfps []string) ([]*openpgp.PrimaryKey, error) {
+	return c.FetchKeysContext(context.Background(), rfps)
+}
+
+// FetchKeysContext implements storage.ContextQueryer.
+func (c *Client) FetchKeysContext(ctx context.Context, rfps []string) ([]*openpgp.PrimaryKey, error) {
+	resp, err := c.call(ctx, "fetchkeys", &request{Args: rfps})
+	if err != nil {
+		return nil, errgo.Mask(err, storage.IsNotFound)
+	}
+	keys, err := decodeKeys(resp.Keys)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return keys, nil
+}
+
+// FetchKeyrings implements storage.Queryer.
+func (c *Client) FetchKeyrings(rfps []string) ([]*storage.Keyring, error) {
+	resp, err := c.call(context.Background(), "fetchkeyrings", &request{Args: rfps})
+	if err != nil {
+		return nil, errgo.Mask(err, storage.IsNotFound)
+	}
+	var result []*storage.Keyring
+	for _, wk := range resp.Keys {
+		key, err := wk.decode()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		result = append(result, &storage.Keyring{PrimaryKey: key, CTime: wk.CTime, MTime: wk.MTime})
+	}
+	return result, nil
+}
+
+// Insert implements storage.Updater.
+func (c *Client) Insert(keys []*openpgp.PrimaryKey) (int, error) {
+	return c.InsertContext(context.Background(), keys)
+}
+
+// InsertContext implements storage.ContextUpdater.
+func (c *Client) InsertContext(ctx context.Context, keys []*openpgp.PrimaryKey) (int, error) {
+	wks, err := encodeKeys(keys)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	resp, err := c.call(ctx, "insert", &request{Keys: wks})
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	return resp.N, nil
+}
+
+// Update implements storage.Updater.
+func (c *Client) Update(key *openpgp.PrimaryKey, priorMD5 string) error {
+	return c.UpdateContext(context.Background(), key, priorMD5)
+}
+
+// UpdateContext implements storage.ContextUpdater.
+func (c *Client) UpdateContext(ctx context.Context, key *openpgp.PrimaryKey, priorMD5 string) error {
+	wk, err := encodeKey(key)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	_, err = c.call(ctx, "update", &request{Keys: []*wireKey{wk}, PriorMD5: priorMD5})
+	return errgo.Mask(err, storage.IsNotFound)
+}
+
+// Delete implements storage.Deleter. It fails if the server's storage does
+// not support deleting keys.
+func (c *Client) Delete(digests []string) (int, error) {
+	resp, err := c.call(context.Background(), "delete", &request{Args: digests})
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	return resp.N, nil
+}
+
+// Subscribe implements storage.Notifier. Key changes made on the server,
+// including those made by other clients, are streamed to f, starting when
+// the first subscriber is added.
+func (c *Client) Subscribe(f func(storage.KeyChange) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers = append(c.handlers, f)
+	if c.done == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		c.cancel, c.done = cancel, make(chan struct{})
+		go c.stream(ctx)
+	}
+}
+
+// Notify implements storage.Notifier. Changes are only notified to this
+// client's subscribers; those made through the client are notified to all
+// clients by the server.
+func (c *Client) Notify(change storage.KeyChange) error {
+	c.mu.Lock()
+	handlers := append([]func(storage.KeyChange) error(nil), c.handlers...)
+	c.mu.Unlock()
+	for _, f := range handlers {
+		err := f(change)
+		if err != nil {
+			log.Errorf("notify failed: %v", errgo.Details(err))
+		}
+	}
+	return nil
+}
+
+// RenotifyAll implements storage.Notifier, by having the server notify all
+// of its keys to every client.
+func (c *Client) RenotifyAll() error {
+	_, err := c.call(context.Background(), "renotify", &request{})
+	return errgo.Mask(err)
+}
+
+// Close stops streaming key changes from the server.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	cancel, done := c.cancel, c.done
+	c.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+	return nil
+}
+
+// stream notifies subscribers of key changes streamed from the server,
+// reconnecting whenever the stream is lost, until ctx is done.
+func (c *Client) stream(ctx context.Context) {
+	defer close(c.done)
+	for connected := false; ; {
+		err := c.readEvents(ctx, func() {
+			if connected && c.Reconnected != nil {
+				c.Reconnected()
+			}
+			connected = true
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		log.Warningf("remote storage event stream lost: %v", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconnectInterval):
+		}
+	}
+}
+
+// readEvents reads key changes from the server's event stream until it is
+// lost, calling connected once it is established.
+func (c *Client) readEvents(ctx context.Context, connected func()) error {
+	body, err := c.do(ctx, "GET", "/storage/events", nil)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer body.Close()
+	connected()
+	r := bufio.NewReader(body)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return errgo.New("closed by server")
+		} else if err != nil {
+			return errgo.Mask(err)
+		}
+		var ev events.Event
+		err = json.Unmarshal(line, &ev)
+		if err != nil {
+			return errgo.Notef(err, "invalid event")
+		}
+		c.Notify(ev.KeyChange())
+	}
+}
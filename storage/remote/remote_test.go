@@ -0,0 +1,195 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+	"gopkg.in/hockeypuck/hkp.v1/storage/mem"
+	"gopkg.in/hockeypuck/hkp.v1/storage/mock"
+	"gopkg.in/hockeypuck/hkp.v1/storage/storagetest"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+var _ = gc.Suite(&storagetest.Suite{
+	NewStorage: func(c *gc.C) storage.Storage { return newTestClient(c) },
+})
+
+// testClient is a Client of a Server for in-memory storage, which it stops
+// when closed.
+type testClient struct {
+	*Client
+	httpSrv *httptest.Server
+}
+
+func newTestClient(c *gc.C) *testClient {
+	srv := NewServer(mem.NewStorage(), Tokens("secret"))
+	r := httprouter.New()
+	srv.Register(r)
+	httpSrv := httptest.NewServer(r)
+	tc := &testClient{Client: &Client{URL: httpSrv.URL, Token: "secret"}, httpSrv: httpSrv}
+	// Key changes are only streamed once the event stream is connected.
+	tc.Subscribe(func(storage.KeyChange) error { return nil })
+	waitStreams(c, srv)
+	return tc
+}
+
+func (tc *testClient) Close() error {
+	err := tc.Client.Close()
+	tc.httpSrv.Close()
+	return err
+}
+
+// waitStreams waits for a client to connect to the event stream of srv.
+func waitStreams(c *gc.C, srv *Server) {
+	for i := 0; ; i++ {
+		srv.mu.Lock()
+		n := len(srv.streams)
+		srv.mu.Unlock()
+		if n > 0 {
+			return
+		}
+		c.Assert(i < 100, gc.Equals, true, gc.Commentf("event stream not connected"))
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type RemoteSuite struct {
+	storage *mock.Storage
+	srv     *Server
+	httpSrv *httptest.Server
+	client  *Client
+}
+
+var _ = gc.Suite(&RemoteSuite{})
+
+func (s *RemoteSuite) SetUpTest(c *gc.C) {
+	s.storage = mock.NewStorage(
+		mock.MatchMD5(func(digests []string) ([]string, error) {
+			if digests[0] == "missing" {
+				return nil, errgo.WithCausef(nil, storage.ErrKeyNotFound, "")
+			}
+			return []string{"rfp-" + digests[0]}, nil
+		}),
+		mock.ModifiedSince(func(t time.Time) ([]string, error) {
+			return []string{t.UTC().Format(time.RFC3339)}, nil
+		}),
+		mock.Delete(func(digests []string) (int, error) {
+			return len(digests), nil
+		}),
+	)
+	s.srv = NewServer(s.storage, Tokens("secret"))
+	r := httprouter.New()
+	s.srv.Register(r)
+	s.httpSrv = httptest.NewServer(r)
+	s.client = &Client{URL: s.httpSrv.URL, Token: "secret"}
+}
+
+func (s *RemoteSuite) TearDownTest(c *gc.C) {
+	s.client.Close()
+	s.httpSrv.Close()
+}
+
+func (s *RemoteSuite) TestQuery(c *gc.C) {
+	rfps, err := s.client.MatchMD5([]string{"abc"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{"rfp-abc"})
+
+	since := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	rfps, err = s.client.ModifiedSince(since)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{"2026-01-02T03:04:05Z"})
+
+	n, err := s.client.Delete([]string{"a", "b"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 2)
+	c.Assert(s.storage.MethodCount("MatchMD5"), gc.Equals, 1)
+	c.Assert(s.storage.MethodCount("Delete"), gc.Equals, 1)
+}
+
+func (s *RemoteSuite) TestNotFound(c *gc.C) {
+	_, err := s.client.MatchMD5([]string{"missing"})
+	c.Assert(storage.IsNotFound(errgo.Cause(err)), gc.Equals, true)
+}
+
+func (s *RemoteSuite) TestUnauthorized(c *gc.C) {
+	s.client.Token = "wrong"
+	_, err := s.client.MatchMD5([]string{"abc"})
+	c.Assert(err, gc.ErrorMatches, `.*401 Unauthorized.*`)
+	c.Assert(s.storage.MethodCount("MatchMD5"), gc.Equals, 0)
+}
+
+func (s *RemoteSuite) TestNoTokens(c *gc.C) {
+	// Storage is not served without tokens, unless explicitly insecure.
+	for _, insecure := range []bool{false, true} {
+		var options []ServerOption
+		if insecure {
+			options = append(options, Insecure())
+		}
+		r := httprouter.New()
+		NewServer(s.storage, options...).Register(r)
+		srv := httptest.NewServer(r)
+		client := &Client{URL: srv.URL}
+		_, err := client.Delete([]string{"a"})
+		if insecure {
+			c.Assert(err, gc.IsNil)
+		} else {
+			c.Assert(err, gc.ErrorMatches, `.*401 Unauthorized.*`)
+		}
+		srv.Close()
+	}
+	c.Assert(s.storage.MethodCount("Delete"), gc.Equals, 1)
+}
+
+func (s *RemoteSuite) TestMaxRequest(c *gc.C) {
+	r := httprouter.New()
+	NewServer(s.storage, Tokens("secret"), MaxRequest(64)).Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	client := &Client{URL: srv.URL, Token: "secret"}
+	_, err := client.MatchMD5([]string{strings.Repeat("a", 64)})
+	c.Assert(err, gc.ErrorMatches, `.*400 Bad Request.*`)
+	c.Assert(s.storage.MethodCount("MatchMD5"), gc.Equals, 0)
+}
+
+func (s *RemoteSuite) TestNotify(c *gc.C) {
+	changes := make(chan storage.KeyChange, 1)
+	s.client.Subscribe(func(change storage.KeyChange) error {
+		changes <- change
+		return nil
+	})
+	waitStreams(c, s.srv)
+
+	err := s.storage.Notify(storage.KeyReplaced{OldDigest: "old", NewDigest: "new"})
+	c.Assert(err, gc.IsNil)
+	select {
+	case change := <-changes:
+		c.Assert(change, gc.DeepEquals, storage.KeyReplaced{OldDigest: "old", NewDigest: "new"})
+	case <-time.After(5 * time.Second):
+		c.Fatal("key change not notified")
+	}
+}
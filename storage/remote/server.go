@@ -0,0 +1,312 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/errgo.v1"
+	log "gopkg.in/hockeypuck/logrus.v0"
+
+	"gopkg.in/hockeypuck/hkp.v1/events"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+)
+
+// streamBuffer is the number of key change events buffered for each client
+// streaming them. A client which falls further behind is disconnected, and
+// must reconcile what it missed, such as by scrubbing its prefix tree.
+var streamBuffer = 1000
+
+// DefaultMaxRequest limits the size of each request body by default.
+const DefaultMaxRequest = 64 << 20
+
+// Server serves a storage backend to remote clients.
+type Server struct {
+	storage    storage.Storage
+	tokens     [][sha256.Size]byte
+	insecure   bool
+	maxRequest int64
+
+	mu      sync.Mutex
+	streams map[chan events.Event]bool
+}
+
+// ServerOption configures a Server.
+type ServerOption func(*Server)
+
+// Tokens requires requests to bear one of the given tokens in an
+// "Authorization: Bearer" header. Without them, every request is refused
+// unless the server is Insecure.
+func Tokens(tokens ...string) ServerOption {
+	return func(s *Server) {
+		for _, token := range tokens {
+			s.tokens = append(s.tokens, sha256.Sum256([]byte(token)))
+		}
+	}
+}
+
+// Insecure serves storage to anyone who can reach the server when no
+// tokens are configured. It should only be used on a trusted network.
+func Insecure() ServerOption {
+	return func(s *Server) {
+		s.insecure = true
+	}
+}
+
+// MaxRequest limits the size of each request body to n bytes. The default
+// is DefaultMaxRequest.
+func MaxRequest(n int64) ServerOption {
+	return func(s *Server) {
+		s.maxRequest = n
+	}
+}
+
+// NewServer returns a Server for st.
+func NewServer(st storage.Storage, options ...ServerOption) *Server {
+	s := &Server{storage: st, maxRequest: DefaultMaxRequest, streams: map[chan events.Event]bool{}}
+	for _, option := range options {
+		option(s)
+	}
+	st.Subscribe(s.notify)
+	return s
+}
+
+// Register serves storage requests on r under /storage/. Requests are
+// refused unless tokens are configured or the server is Insecure.
+func (s *Server) Register(r *httprouter.Router) {
+	if len(s.tokens) == 0 && !s.insecure {
+		log.Warning("remote storage has no tokens configured, refusing all requests")
+	}
+	r.POST("/storage/matchmd5", s.call(s.rfingerprints(s.storage.MatchMD5)))
+	r.POST("/storage/resolve", s.call(s.rfingerprints(s.storage.Resolve)))
+	r.POST("/storage/matchkeyword", s.call(s.rfingerprints(s.storage.MatchKeyword)))
+	r.POST("/storage/modifiedsince", s.call(s.modifiedSince))
+	r.POST("/storage/fetchkeys", s.call(s.fetchKeys))
+	r.POST("/storage/fetchkeyrings", s.call(s.fetchKeyrings))
+	r.POST("/storage/insert", s.call(s.insert))
+	r.POST("/storage/update", s.call(s.update))
+	r.POST("/storage/delete", s.call(s.delete))
+	r.POST("/storage/renotify", s.call(s.renotify))
+	r.GET("/storage/events", s.authorize(s.events))
+}
+
+func (s *Server) call(h func(*request) *response) httprouter.Handle {
+	return s.authorize(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		var req request
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.maxRequest)).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp := h(&req)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+func (s *Server) authorize(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if !s.authorized(r) {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h(w, r, ps)
+	}
+}
+
+// authorized returns whether r bears one of the tokens, or may be served
+// without one.
+func (s *Server) authorized(r *http.Request) bool {
+	if len(s.tokens) == 0 {
+		return s.insecure
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	sum := sha256.Sum256([]byte(strings.TrimPrefix(auth, "Bearer ")))
+	for _, token := range s.tokens {
+		if subtle.ConstantTimeCompare(sum[:], token[:]) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func errorResponse(err error) *response {
+	log.Debugf("remote storage request failed: %v", errgo.Details(err))
+	return &response{Error: err.Error(), NotFound: storage.IsNotFound(errgo.Cause(err))}
+}
+
+func (s *Server) rfingerprints(f func([]string) ([]string, error)) func(*request) *response {
+	return func(req *request) *response {
+		rfps, err := f(req.Args)
+		if err != nil {
+			return errorResponse(err)
+		}
+		return &response{RFingerprints: rfps}
+	}
+}
+
+func (s *Server) modifiedSince(req *request) *response {
+	rfps, err := s.storage.ModifiedSince(req.Since)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return &response{RFingerprints: rfps}
+}
+
+func (s *Server) fetchKeys(req *request) *response {
+	keys, err := s.storage.FetchKeys(req.Args)
+	if err != nil {
+		return errorResponse(err)
+	}
+	wks, err := encodeKeys(keys)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return &response{Keys: wks}
+}
+
+func (s *Server) fetchKeyrings(req *request) *response {
+	keyrings, err := s.storage.FetchKeyrings(req.Args)
+	if err != nil {
+		return errorResponse(err)
+	}
+	wks := []*wireKey{}
+	for _, kr := range keyrings {
+		wk, err := encodeKey(kr.PrimaryKey)
+		if err != nil {
+			return errorResponse(err)
+		}
+		wk.CTime, wk.MTime = kr.CTime, kr.MTime
+		wks = append(wks, wk)
+	}
+	return &response{Keys: wks}
+}
+
+func (s *Server) insert(req *request) *response {
+	keys, err := decodeKeys(req.Keys)
+	if err != nil {
+		return errorResponse(err)
+	}
+	n, err := s.storage.Insert(keys)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return &response{N: n}
+}
+
+func (s *Server) update(req *request) *response {
+	if len(req.Keys) != 1 {
+		return errorResponse(errgo.New("update requires one key"))
+	}
+	key, err := req.Keys[0].decode()
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = s.storage.Update(key, req.PriorMD5)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return &response{}
+}
+
+func (s *Server) delete(req *request) *response {
+	d, ok := s.storage.(storage.Deleter)
+	if !ok {
+		return errorResponse(errgo.New("storage does not support deleting keys"))
+	}
+	n, err := d.Delete(req.Args)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return &response{N: n}
+}
+
+func (s *Server) renotify(req *request) *response {
+	err := s.storage.RenotifyAll()
+	if err != nil {
+		return errorResponse(err)
+	}
+	return &response{}
+}
+
+// notify sends a key change to the clients streaming them.
+func (s *Server) notify(change storage.KeyChange) error {
+	ev := events.NewEvent(change)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.streams {
+		select {
+		case ch <- ev:
+		default:
+			log.Warningf("remote storage client fell behind, disconnecting it")
+			delete(s.streams, ch)
+			close(ch)
+		}
+	}
+	return nil
+}
+
+// events streams key changes to the client as JSON, one per line, until it
+// disconnects.
+func (s *Server) events(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ch := make(chan events.Event, streamBuffer)
+	s.mu.Lock()
+	s.streams[ch] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		if s.streams[ch] {
+			delete(s.streams, ch)
+			close(ch)
+		}
+		s.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := enc.Encode(&ev); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
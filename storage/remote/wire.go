@@ -0,0 +1,121 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package remote serves a storage backend over HTTP, and provides a client
+// implementing storage.Storage with it, so that a workload such as the recon
+// peer can run in its own process, isolated from and scaled independently of
+// the query frontends sharing the storage.
+//
+// Requests and responses are JSON. Keys are carried as their binary OpenPGP
+// packets, and key changes are streamed to clients as events.Event values,
+// one JSON object per line.
+package remote
+
+import (
+	"bytes"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/hockeypuck/openpgp.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+)
+
+// wireKey is a key, or a keyring record, as sent over the wire.
+type wireKey struct {
+	Packets []byte    `json:"packets"`
+	MD5     string    `json:"md5"`
+	SHA256  string    `json:"sha256,omitempty"`
+	CTime   time.Time `json:"ctime,omitempty"`
+	MTime   time.Time `json:"mtime,omitempty"`
+}
+
+func encodeKey(key *openpgp.PrimaryKey) (*wireKey, error) {
+	var buf bytes.Buffer
+	err := openpgp.WritePackets(&buf, key)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &wireKey{Packets: buf.Bytes(), MD5: key.MD5, SHA256: key.SHA256}, nil
+}
+
+func encodeKeys(keys []*openpgp.PrimaryKey) ([]*wireKey, error) {
+	result := []*wireKey{}
+	for _, key := range keys {
+		wk, err := encodeKey(key)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		result = append(result, wk)
+	}
+	return result, nil
+}
+
+func (wk *wireKey) decode() (*openpgp.PrimaryKey, error) {
+	for readKey := range openpgp.ReadKeys(bytes.NewReader(wk.Packets)) {
+		if readKey.Error != nil {
+			return nil, errgo.Mask(readKey.Error)
+		}
+		key := readKey.PrimaryKey
+		key.MD5, key.SHA256 = wk.MD5, wk.SHA256
+		return key, nil
+	}
+	return nil, errgo.New("no key in response")
+}
+
+func decodeKeys(wks []*wireKey) ([]*openpgp.PrimaryKey, error) {
+	var result []*openpgp.PrimaryKey
+	for _, wk := range wks {
+		key, err := wk.decode()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		result = append(result, key)
+	}
+	return result, nil
+}
+
+// request is the body of a storage request. Only the fields used by the
+// operation are set.
+type request struct {
+	Args     []string   `json:"args,omitempty"`
+	Since    time.Time  `json:"since,omitempty"`
+	Keys     []*wireKey `json:"keys,omitempty"`
+	PriorMD5 string     `json:"priorMD5,omitempty"`
+}
+
+// response is the body of a storage response.
+type response struct {
+	RFingerprints []string   `json:"rfingerprints,omitempty"`
+	Keys          []*wireKey `json:"keys,omitempty"`
+	N             int        `json:"n,omitempty"`
+
+	Error    string `json:"error,omitempty"`
+	NotFound bool   `json:"notFound,omitempty"`
+}
+
+// err returns the error reported by resp, if any. Keys not found are
+// reported as storage.ErrKeyNotFound itself, as storage.IsNotFound expects.
+func (resp *response) err() error {
+	switch {
+	case resp.NotFound:
+		return storage.ErrKeyNotFound
+	case resp.Error != "":
+		return errgo.New(resp.Error)
+	}
+	return nil
+}
@@ -18,11 +18,15 @@
 package storage
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"net/mail"
+	"strings"
 	"time"
 
+	"golang.org/x/net/idna"
 	"gopkg.in/errgo.v1"
 
 	"gopkg.in/hockeypuck/openpgp.v1"
@@ -96,6 +100,14 @@ type Updater interface {
 	Update(pubkey *openpgp.PrimaryKey, priorMD5 string) error
 }
 
+// Deleter may be implemented by storage backends which can delete keys.
+type Deleter interface {
+	// Delete deletes the keys with the given RFingerprints, returning the
+	// number deleted. Implementations notify subscribers with KeyRemoved
+	// changes, as Insert and Update notify them of their changes.
+	Delete([]string) (int, error)
+}
+
 type Notifier interface {
 	// Subscribe registers a key change callback function.
 	Subscribe(func(KeyChange) error)
@@ -146,6 +158,24 @@ func (kr KeyReplaced) String() string {
 	return fmt.Sprintf("key %q replaced %q", kr.NewDigest, kr.OldDigest)
 }
 
+// KeyRemoved reports that a key was deleted from storage, such as for a
+// takedown request.
+type KeyRemoved struct {
+	Digest string
+}
+
+func (kr KeyRemoved) InsertDigests() []string {
+	return nil
+}
+
+func (kr KeyRemoved) RemoveDigests() []string {
+	return []string{kr.Digest}
+}
+
+func (kr KeyRemoved) String() string {
+	return fmt.Sprintf("key %q removed", kr.Digest)
+}
+
 type KeyNotChanged struct{}
 
 func (knc KeyNotChanged) InsertDigests() []string { return nil }
@@ -173,6 +203,134 @@ func Duplicates(err error) []*openpgp.PrimaryKey {
 	return insertErr.Duplicates
 }
 
+// PacketCounts reports how many OpenPGP packets in submitted key material
+// were accepted into storage and how many were dropped by filtering.
+type PacketCounts struct {
+	Accepted int
+	Dropped  int
+}
+
+// Packets returns all OpenPGP packets comprising key.
+func Packets(key *openpgp.PrimaryKey) []*openpgp.Packet {
+	var result []*openpgp.Packet
+	addSigs := func(sigs []*openpgp.Signature) {
+		for _, sig := range sigs {
+			result = append(result, &sig.Packet)
+		}
+	}
+	addPublicKey := func(pk *openpgp.PublicKey) {
+		result = append(result, &pk.Packet)
+		addSigs(pk.Signatures)
+		result = append(result, pk.Others...)
+	}
+
+	addPublicKey(&key.PublicKey)
+	for _, uid := range key.UserIDs {
+		result = append(result, &uid.Packet)
+		addSigs(uid.Signatures)
+		result = append(result, uid.Others...)
+	}
+	for _, uat := range key.UserAttributes {
+		result = append(result, &uat.Packet)
+		addSigs(uat.Signatures)
+		result = append(result, uat.Others...)
+	}
+	for _, subKey := range key.SubKeys {
+		addPublicKey(&subKey.PublicKey)
+	}
+	return result
+}
+
+// CountPackets returns the number of OpenPGP packets comprising key.
+func CountPackets(key *openpgp.PrimaryKey) int {
+	return len(Packets(key))
+}
+
+// DropDuplicates removes duplicate packets from key like
+// openpgp.DropDuplicates, reporting how many packets were dropped.
+func DropDuplicates(key *openpgp.PrimaryKey) (PacketCounts, error) {
+	before := CountPackets(key)
+	err := openpgp.DropDuplicates(key)
+	if err != nil {
+		return PacketCounts{}, errgo.Mask(err)
+	}
+	after := CountPackets(key)
+	return PacketCounts{Accepted: after, Dropped: before - after}, nil
+}
+
+// ParseMode selects how keys containing packets which could not be parsed
+// are handled when they are submitted or recovered.
+type ParseMode int
+
+const (
+	// ParsePermissive accepts such keys, carrying unparsed packets opaquely
+	// so that digests remain compatible with other keyservers. Unparsed
+	// packets are stored and served byte-identically to how they were
+	// received.
+	ParsePermissive = ParseMode(iota)
+
+	// ParseStrict rejects keys containing any unparsed packet.
+	ParseStrict
+)
+
+func ParseParseMode(s string) (ParseMode, bool) {
+	switch s {
+	case "", "permissive":
+		return ParsePermissive, true
+	case "strict":
+		return ParseStrict, true
+	}
+	return ParsePermissive, false
+}
+
+func (m ParseMode) String() string {
+	if m == ParseStrict {
+		return "strict"
+	}
+	return "permissive"
+}
+
+// Check returns an error if key is not acceptable in this parse mode.
+func (m ParseMode) Check(key *openpgp.PrimaryKey) error {
+	if m != ParseStrict {
+		return nil
+	}
+	if unparsed := UnparsedPackets(key); len(unparsed) > 0 {
+		return errgo.Newf("key %q contains %d unparseable packets", key.Fingerprint(), len(unparsed))
+	}
+	return nil
+}
+
+// UnparsedPackets returns all packets in key which could not be parsed.
+func UnparsedPackets(key *openpgp.PrimaryKey) []*openpgp.Packet {
+	var result []*openpgp.Packet
+	for _, pkt := range Packets(key) {
+		if !pkt.Parsed {
+			result = append(result, pkt)
+		}
+	}
+	return result
+}
+
+// missingPackets returns the packets in want which do not appear, byte for
+// byte, among the unparsed packets of key.
+func missingPackets(want []*openpgp.Packet, key *openpgp.PrimaryKey) []*openpgp.Packet {
+	if len(want) == 0 {
+		return nil
+	}
+	have := map[string]bool{}
+	for _, pkt := range UnparsedPackets(key) {
+		have[string(pkt.Packet)] = true
+	}
+	var result []*openpgp.Packet
+	for _, pkt := range want {
+		if !have[string(pkt.Packet)] {
+			result = append(result, pkt)
+		}
+	}
+	return result
+}
+
 func firstMatch(results []*openpgp.PrimaryKey, match string) (*openpgp.PrimaryKey, error) {
 	for _, key := range results {
 		if key.RFingerprint == match {
@@ -183,36 +341,206 @@ func firstMatch(results []*openpgp.PrimaryKey, match string) (*openpgp.PrimaryKe
 }
 
 func UpsertKey(storage Storage, pubkey *openpgp.PrimaryKey) (kc KeyChange, err error) {
+	return UpsertKeyContext(context.Background(), storage, pubkey)
+}
+
+// UpsertKeyContext is like UpsertKey, but stops with an error whose cause is
+// ctx.Err() if ctx is done before the key is stored.
+func UpsertKeyContext(ctx context.Context, storage Storage, pubkey *openpgp.PrimaryKey) (kc KeyChange, err error) {
+	return UpsertKeyChecked(ctx, storage, pubkey, nil)
+}
+
+// UpsertKeyChecked is like UpsertKeyContext, but first calls check, if not
+// nil, with the key as it would be stored, merged with any key stored
+// already. check may modify the key, such as to drop excess packets. If it
+// returns an error, nothing is stored, and the error is returned with its
+// cause.
+func UpsertKeyChecked(ctx context.Context, storage Storage, pubkey *openpgp.PrimaryKey,
+	check func(*openpgp.PrimaryKey) error) (kc KeyChange, err error) {
 	var lastKey *openpgp.PrimaryKey
-	lastKeys, err := storage.FetchKeys([]string{pubkey.RFingerprint})
+	lastKeys, err := FetchKeysContext(ctx, storage, []string{pubkey.RFingerprint})
 	if err == nil {
 		// match primary fingerprint -- someone might have reused a subkey somewhere
 		lastKey, err = firstMatch(lastKeys, pubkey.RFingerprint)
 	}
 	if IsNotFound(err) {
-		_, err = storage.Insert([]*openpgp.PrimaryKey{pubkey})
+		if check != nil {
+			err = check(pubkey)
+			if err != nil {
+				return nil, errgo.Mask(err, errgo.Any)
+			}
+		}
+		_, err = InsertContext(ctx, storage, []*openpgp.PrimaryKey{pubkey})
 		if err != nil {
-			return nil, errgo.Mask(err)
+			return nil, errgo.Mask(err, errgo.Any)
 		}
 		return KeyAdded{Digest: pubkey.MD5}, nil
 	} else if err != nil {
-		return nil, errgo.Mask(err)
+		return nil, errgo.Mask(err, errgo.Any)
 	}
 
 	if pubkey.UUID != lastKey.UUID {
 		return nil, errgo.Newf("upsert key %q lookup failed, found mismatch %q", pubkey.UUID, lastKey.UUID)
 	}
 	lastMD5 := lastKey.MD5
+	opaque := UnparsedPackets(pubkey)
 	err = openpgp.Merge(lastKey, pubkey)
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	if missing := missingPackets(opaque, lastKey); len(missing) > 0 {
+		// Refuse to store a key which would no longer round-trip
+		// byte-identically to its submitter and peers.
+		return nil, errgo.Newf("merge of key %q dropped %d unparsed packets", pubkey.Fingerprint(), len(missing))
+	}
+	if check != nil {
+		err = check(lastKey)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+	}
 	if lastMD5 != lastKey.MD5 {
-		err = storage.Update(lastKey, lastMD5)
+		err = UpdateContext(ctx, storage, lastKey, lastMD5)
 		if err != nil {
-			return nil, errgo.Mask(err)
+			return nil, errgo.Mask(err, errgo.Any)
 		}
 		return KeyReplaced{OldDigest: lastMD5, NewDigest: lastKey.MD5}, nil
 	}
 	return KeyNotChanged{}, nil
 }
+
+// DeleteKey deletes the key with the given RFingerprint from storage, which
+// must implement Deleter, and returns the change made.
+func DeleteKey(st Storage, rfp string) (KeyChange, error) {
+	d, ok := st.(Deleter)
+	if !ok {
+		return nil, errgo.New("storage does not support deleting keys")
+	}
+	keys, err := st.FetchKeys([]string{rfp})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	key, err := firstMatch(keys, rfp)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	_, err = d.Delete([]string{rfp})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return KeyRemoved{Digest: key.MD5}, nil
+}
+
+// scanChunkSize is the number of keys fetched at a time by ForEachKey.
+const scanChunkSize = 100
+
+// ForEachKey calls f with every key in storage, fetching them in chunks.
+func ForEachKey(q Queryer, f func(*openpgp.PrimaryKey)) error {
+	rfps, err := q.ModifiedSince(time.Time{})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for len(rfps) > 0 {
+		n := scanChunkSize
+		if n > len(rfps) {
+			n = len(rfps)
+		}
+		keys, err := q.FetchKeys(rfps[:n])
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		rfps = rfps[n:]
+		for _, key := range keys {
+			f(key)
+		}
+	}
+	return nil
+}
+
+// EmailAddress returns the email address in a user ID, such as
+// "Alice <alice@example.com>", normalized by NormalizeEmail, or "" if there
+// is none.
+func EmailAddress(uid string) string {
+	var email string
+	if addr, err := mail.ParseAddress(uid); err == nil {
+		email = addr.Address
+	} else if i, j := strings.LastIndex(uid, "<"), strings.LastIndex(uid, ">"); i >= 0 && j > i {
+		email = uid[i+1 : j]
+	} else {
+		email = uid
+	}
+	email = strings.ToLower(strings.TrimSpace(email))
+	at := strings.LastIndex(email, "@")
+	if at < 0 || at == len(email)-1 {
+		return ""
+	}
+	return NormalizeEmail(email)
+}
+
+// EmailDomain returns the domain of the email address in a user ID, such as
+// "Alice <alice@example.com>", normalized by NormalizeDomain, or "" if there
+// is none.
+func EmailDomain(uid string) string {
+	email := EmailAddress(uid)
+	if email == "" {
+		return ""
+	}
+	return email[strings.LastIndex(email, "@")+1:]
+}
+
+// NormalizeEmail returns email with its local part lower-cased and its domain
+// normalized by NormalizeDomain, so that addresses at internationalized
+// domains compare equal whether written in Unicode or punycode.
+func NormalizeEmail(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+	return email[:at+1] + NormalizeDomain(email[at+1:])
+}
+
+// NormalizeDomain returns domain lower-cased and in Unicode form, with any
+// punycode ("xn--") labels decoded. Domains which are not valid IDNs are only
+// lower-cased.
+func NormalizeDomain(domain string) string {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	if u, err := idna.ToUnicode(domain); err == nil {
+		domain = strings.ToLower(u)
+	}
+	return domain
+}
+
+// EmailSearches returns the keyword searches equivalent to search. If it
+// contains an email address at an internationalized domain, the search is
+// followed by its counterpart with the domain in the other form, Unicode or
+// punycode, since user IDs may be written with either.
+func EmailSearches(search string) []string {
+	at := strings.LastIndex(search, "@")
+	if at < 0 {
+		return []string{search}
+	}
+	end := strings.IndexAny(search[at:], "> \t")
+	if end < 0 {
+		end = len(search)
+	} else {
+		end += at
+	}
+	domain := search[at+1 : end]
+	var alt string
+	if u := NormalizeDomain(domain); u != strings.ToLower(domain) {
+		alt = u
+	} else if a, err := idna.ToASCII(u); err == nil && a != u {
+		alt = a
+	}
+	if alt == "" {
+		return []string{search}
+	}
+	return []string{search, search[:at+1] + alt + search[end:]}
+}
+
+// UserIDContains returns whether the user ID uid contains search, ignoring
+// case and the form of internationalized email domains.
+func UserIDContains(uid, search string) bool {
+	return DefaultUIDPipeline.Contains(uid, search)
+}
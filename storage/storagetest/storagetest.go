@@ -0,0 +1,294 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package storagetest provides a conformance test suite for implementations
+// of storage.Storage. Backend authors can register it with gocheck:
+//
+//	var _ = gc.Suite(&storagetest.Suite{
+//		NewStorage: func(c *gc.C) storage.Storage { ... },
+//	})
+package storagetest
+
+import (
+	"sync"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/hockeypuck/testing"
+	"gopkg.in/hockeypuck/openpgp.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+)
+
+// Suite exercises the storage.Storage contract relied upon by the hkp
+// handlers and the sks recon peer, and the storage.Deleter contract if the
+// backend implements it.
+type Suite struct {
+	// NewStorage returns a new, empty storage backend. It is called before
+	// each test.
+	NewStorage func(c *gc.C) storage.Storage
+
+	storage storage.Storage
+
+	mu      sync.Mutex
+	changes []storage.KeyChange
+}
+
+func (s *Suite) SetUpTest(c *gc.C) {
+	s.storage = s.NewStorage(c)
+	s.changes = nil
+	s.storage.Subscribe(func(kc storage.KeyChange) error {
+		s.mu.Lock()
+		s.changes = append(s.changes, kc)
+		s.mu.Unlock()
+		return nil
+	})
+}
+
+func (s *Suite) TearDownTest(c *gc.C) {
+	c.Assert(s.storage.Close(), gc.IsNil)
+}
+
+// notifyTimeout is how long the suite waits for the notifications
+// expected, as backends may notify subscribers asynchronously.
+const notifyTimeout = 5 * time.Second
+
+// notified returns the key changes notified, once there are at least n of
+// them or notifyTimeout has passed.
+func (s *Suite) notified(n int) []storage.KeyChange {
+	deadline := time.Now().Add(notifyTimeout)
+	for {
+		s.mu.Lock()
+		changes := append([]storage.KeyChange(nil), s.changes...)
+		s.mu.Unlock()
+		if len(changes) >= n || time.Now().After(deadline) {
+			return changes
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func mustKey(c *gc.C, name string) *openpgp.PrimaryKey {
+	keys := openpgp.MustReadArmorKeys(testing.MustInput(name)).MustParse()
+	c.Assert(keys, gc.HasLen, 1)
+	err := openpgp.DropDuplicates(keys[0])
+	c.Assert(err, gc.IsNil)
+	return keys[0]
+}
+
+func (s *Suite) insert(c *gc.C, name string) *openpgp.PrimaryKey {
+	key := mustKey(c, name)
+	n, err := s.storage.Insert([]*openpgp.PrimaryKey{key})
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	return key
+}
+
+func (s *Suite) TestInsertNotifies(c *gc.C) {
+	key := s.insert(c, "alice_signed.asc")
+	c.Assert(s.notified(1), gc.DeepEquals, []storage.KeyChange{storage.KeyAdded{Digest: key.MD5}})
+}
+
+func (s *Suite) TestInsertDuplicate(c *gc.C) {
+	s.insert(c, "alice_signed.asc")
+	n, err := s.storage.Insert([]*openpgp.PrimaryKey{mustKey(c, "alice_signed.asc")})
+	if err != nil {
+		c.Assert(storage.Duplicates(err), gc.HasLen, 1)
+	}
+	c.Assert(n, gc.Equals, 0)
+	c.Assert(s.notified(1), gc.HasLen, 1)
+}
+
+func (s *Suite) TestMatchMD5(c *gc.C) {
+	key := s.insert(c, "alice_signed.asc")
+	rfps, err := s.storage.MatchMD5([]string{key.MD5})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{key.RFingerprint})
+
+	rfps, err = s.storage.MatchMD5([]string{"00000000000000000000000000000000"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+}
+
+func (s *Suite) TestResolve(c *gc.C) {
+	key := s.insert(c, "alice_signed.asc")
+	for _, rkeyID := range []string{
+		key.RFingerprint,
+		key.RFingerprint[:16],
+		key.RFingerprint[:8],
+	} {
+		rfps, err := s.storage.Resolve([]string{rkeyID})
+		c.Assert(err, gc.IsNil)
+		c.Assert(rfps, gc.DeepEquals, []string{key.RFingerprint}, gc.Commentf("%s", rkeyID))
+	}
+}
+
+func (s *Suite) TestMatchKeyword(c *gc.C) {
+	key := s.insert(c, "alice_signed.asc")
+	rfps, err := s.storage.MatchKeyword([]string{"alice"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{key.RFingerprint})
+}
+
+func (s *Suite) TestFetchKeys(c *gc.C) {
+	key := s.insert(c, "alice_signed.asc")
+	keys, err := s.storage.FetchKeys([]string{key.RFingerprint})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].RFingerprint, gc.Equals, key.RFingerprint)
+	c.Assert(keys[0].MD5, gc.Equals, key.MD5)
+}
+
+func (s *Suite) TestFetchKeysNotFound(c *gc.C) {
+	keys, err := s.storage.FetchKeys([]string{"10fe8cf1b483f7525039aa2a361bc1f023e0dcca"})
+	if err != nil {
+		c.Assert(storage.IsNotFound(err), gc.Equals, true)
+	}
+	c.Assert(keys, gc.HasLen, 0)
+}
+
+func (s *Suite) TestFetchKeyrings(c *gc.C) {
+	before := time.Now().Add(-time.Second)
+	key := s.insert(c, "alice_signed.asc")
+	keyrings, err := s.storage.FetchKeyrings([]string{key.RFingerprint})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keyrings, gc.HasLen, 1)
+	c.Assert(keyrings[0].MD5, gc.Equals, key.MD5)
+	c.Assert(keyrings[0].CTime.After(before), gc.Equals, true)
+	c.Assert(keyrings[0].MTime.After(before), gc.Equals, true)
+}
+
+func (s *Suite) TestModifiedSince(c *gc.C) {
+	before := time.Now().Add(-time.Second)
+	key := s.insert(c, "alice_signed.asc")
+	rfps, err := s.storage.ModifiedSince(before)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{key.RFingerprint})
+
+	rfps, err = s.storage.ModifiedSince(time.Now().Add(time.Hour))
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+}
+
+func (s *Suite) TestDigests(c *gc.C) {
+	digests, err := storage.Digests(s.storage)
+	c.Assert(err, gc.IsNil)
+	c.Assert(digests, gc.HasLen, 0)
+
+	key := s.insert(c, "alice_signed.asc")
+	digests, err = storage.Digests(s.storage)
+	c.Assert(err, gc.IsNil)
+	c.Assert(digests, gc.DeepEquals, []string{key.MD5})
+}
+
+func (s *Suite) TestUpsertKey(c *gc.C) {
+	unsigned := mustKey(c, "alice_unsigned.asc")
+	kc, err := storage.UpsertKey(s.storage, unsigned)
+	c.Assert(err, gc.IsNil)
+	c.Assert(kc, gc.Equals, storage.KeyAdded{Digest: unsigned.MD5})
+
+	kc, err = storage.UpsertKey(s.storage, mustKey(c, "alice_unsigned.asc"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(kc, gc.Equals, storage.KeyNotChanged{})
+
+	signed := mustKey(c, "alice_signed.asc")
+	kc, err = storage.UpsertKey(s.storage, signed)
+	c.Assert(err, gc.IsNil)
+	replaced, ok := kc.(storage.KeyReplaced)
+	c.Assert(ok, gc.Equals, true, gc.Commentf("%v", kc))
+	c.Assert(replaced.OldDigest, gc.Equals, unsigned.MD5)
+
+	keys, err := s.storage.FetchKeys([]string{signed.RFingerprint})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].MD5, gc.Equals, replaced.NewDigest)
+
+	c.Assert(s.notified(2), gc.DeepEquals, []storage.KeyChange{
+		storage.KeyAdded{Digest: unsigned.MD5},
+		replaced,
+	})
+}
+
+func (s *Suite) TestUpdateStaleDigest(c *gc.C) {
+	s.insert(c, "alice_unsigned.asc")
+	signed := mustKey(c, "alice_signed.asc")
+	err := s.storage.Update(signed, "00000000000000000000000000000000")
+	c.Assert(err, gc.NotNil)
+	c.Assert(s.notified(1), gc.HasLen, 1)
+}
+
+func (s *Suite) deleter(c *gc.C) storage.Deleter {
+	d, ok := s.storage.(storage.Deleter)
+	if !ok {
+		c.Skip("storage does not support deleting keys")
+	}
+	return d
+}
+
+func (s *Suite) TestDelete(c *gc.C) {
+	d := s.deleter(c)
+	key := s.insert(c, "alice_signed.asc")
+	n, err := d.Delete([]string{key.RFingerprint})
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	c.Assert(s.notified(2), gc.DeepEquals, []storage.KeyChange{
+		storage.KeyAdded{Digest: key.MD5},
+		storage.KeyRemoved{Digest: key.MD5},
+	})
+
+	rfps, err := s.storage.MatchMD5([]string{key.MD5})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+	rfps, err = s.storage.Resolve([]string{key.RFingerprint[:16]})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+	rfps, err = s.storage.ModifiedSince(time.Time{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+	keys, err := s.storage.FetchKeys([]string{key.RFingerprint})
+	if err != nil {
+		c.Assert(storage.IsNotFound(err), gc.Equals, true)
+	}
+	c.Assert(keys, gc.HasLen, 0)
+
+	// A deleted key may be inserted again.
+	s.insert(c, "alice_signed.asc")
+	c.Assert(s.notified(3), gc.HasLen, 3)
+}
+
+func (s *Suite) TestDeleteMissing(c *gc.C) {
+	d := s.deleter(c)
+	key := s.insert(c, "alice_signed.asc")
+	n, err := d.Delete([]string{"10fe8cf1b483f7525039aa2a361bc1f023e0dcca"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+	c.Assert(s.notified(1), gc.DeepEquals, []storage.KeyChange{storage.KeyAdded{Digest: key.MD5}})
+	rfps, err := s.storage.MatchMD5([]string{key.MD5})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{key.RFingerprint})
+}
+
+func (s *Suite) TestRenotifyAll(c *gc.C) {
+	key := s.insert(c, "alice_signed.asc")
+	err := s.storage.RenotifyAll()
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.notified(2), gc.DeepEquals, []storage.KeyChange{
+		storage.KeyAdded{Digest: key.MD5},
+		storage.KeyAdded{Digest: key.MD5},
+	})
+}
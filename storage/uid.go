@@ -0,0 +1,137 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"net/mail"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// UIDStep is a step in normalizing user IDs and keyword searches.
+type UIDStep func(string) string
+
+// UIDPipeline normalizes user IDs for indexing, and keyword searches for
+// querying, by applying its steps in order. The same pipeline should be used
+// for both, so that searches match user IDs consistently.
+type UIDPipeline []UIDStep
+
+// DefaultUIDPipeline only folds case.
+var DefaultUIDPipeline = UIDPipeline{FoldCase}
+
+// UIDNormalizing may be implemented by storage backends whose keyword index
+// can be built with a configurable UIDPipeline.
+type UIDNormalizing interface {
+	// SetUIDPipeline sets the pipeline with which user IDs are indexed.
+	SetUIDPipeline(p UIDPipeline)
+}
+
+var uidSteps = map[string]UIDStep{
+	"fold-case":      FoldCase,
+	"whitespace":     CollapseWhitespace,
+	"strip-comments": StripComments,
+	"rfc2822":        ParseRFC2822,
+}
+
+// ParseUIDPipeline returns the pipeline of the named steps, in order:
+// "fold-case" for FoldCase, "whitespace" for CollapseWhitespace,
+// "strip-comments" for StripComments and "rfc2822" for ParseRFC2822.
+func ParseUIDPipeline(names ...string) (UIDPipeline, error) {
+	var p UIDPipeline
+	for _, name := range names {
+		step, ok := uidSteps[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, errgo.Newf("unknown user ID normalization step %q", name)
+		}
+		p = append(p, step)
+	}
+	return p, nil
+}
+
+// Normalize returns s with every step of the pipeline applied.
+func (p UIDPipeline) Normalize(s string) string {
+	for _, step := range p {
+		s = step(s)
+	}
+	return s
+}
+
+// Contains returns whether the user ID uid contains search once both are
+// normalized, regardless of the form of internationalized email domains.
+func (p UIDPipeline) Contains(uid, search string) bool {
+	uid = p.Normalize(uid)
+	for _, s := range EmailSearches(search) {
+		if strings.Contains(uid, p.Normalize(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// FoldCase lower-cases s.
+func FoldCase(s string) string {
+	return strings.ToLower(s)
+}
+
+// CollapseWhitespace trims s and replaces each run of whitespace within it
+// with a single space.
+func CollapseWhitespace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// StripComments removes parenthesized comments, such as the "(work)" in
+// "Alice (work) <alice@example.com>". Parentheses within the angle brackets
+// of an email address are kept.
+func StripComments(s string) string {
+	var b strings.Builder
+	depth, inAddr := 0, false
+	for _, r := range s {
+		switch {
+		case inAddr:
+			inAddr = r != '>'
+		case r == '(':
+			depth++
+			continue
+		case r == ')' && depth > 0:
+			depth--
+			continue
+		case depth > 0:
+			continue
+		case r == '<':
+			inAddr = true
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// ParseRFC2822 rewrites s as "Name <address>", or just the address if it
+// has no name, if it parses as an RFC 2822 address. This removes quoting and
+// comments, so that `"Alice" <alice@example.com>` and
+// "Alice <alice@example.com>" are equivalent. Other strings are unchanged.
+func ParseRFC2822(s string) string {
+	addr, err := mail.ParseAddress(s)
+	if err != nil {
+		return s
+	}
+	if addr.Name == "" {
+		return addr.Address
+	}
+	return addr.Name + " <" + addr.Address + ">"
+}
@@ -0,0 +1,202 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"bytes"
+
+	"golang.org/x/crypto/openpgp/packet"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/hockeypuck/openpgp.v1"
+)
+
+// Unhashed signature subpacket types which are kept by StripUnhashed (RFC
+// 4880, Section 5.2.3.1, and RFC 9580, Section 5.2.3.35).
+const (
+	subpacketIssuer            = 16
+	subpacketEmbeddedSignature = 32
+	subpacketIssuerFingerprint = 33
+)
+
+// StripUnhashed removes the unhashed subpackets from the version 4
+// signatures of key, other than those identifying the issuer and embedded
+// signatures, which are commonly unhashed. Unhashed subpackets are not
+// covered by the signature, so anyone may append garbage to them, altering
+// the key's digest without invalidating it.
+//
+// Key is replaced in place by its stripped form, with its digests updated.
+// The number of signatures changed is returned.
+func StripUnhashed(key *openpgp.PrimaryKey) (int, error) {
+	var n int
+	strip := func(sigs []*openpgp.Signature) error {
+		for _, sig := range sigs {
+			buf, changed, err := stripUnhashed(sig.Packet.Packet)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			if changed {
+				sig.Packet.Packet = buf
+				n++
+			}
+		}
+		return nil
+	}
+	err := strip(key.Signatures)
+	for _, uid := range key.UserIDs {
+		if err == nil {
+			err = strip(uid.Signatures)
+		}
+	}
+	for _, uat := range key.UserAttributes {
+		if err == nil {
+			err = strip(uat.Signatures)
+		}
+	}
+	for _, subKey := range key.SubKeys {
+		if err == nil {
+			err = strip(subKey.Signatures)
+		}
+	}
+	if err != nil {
+		return 0, errgo.Notef(err, "cannot strip unhashed subpackets from key %q", key.Fingerprint())
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	err = reread(key)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	return n, nil
+}
+
+// reread replaces key by the key read back from its packets, so that its
+// packet identities and digests are those of any rewritten signatures.
+func reread(key *openpgp.PrimaryKey) error {
+	var buf bytes.Buffer
+	err := openpgp.WritePackets(&buf, key)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for readKey := range openpgp.ReadKeys(&buf) {
+		if readKey.Error != nil {
+			return errgo.Mask(readKey.Error)
+		}
+		*key = *readKey.PrimaryKey
+		return nil
+	}
+	return errgo.Newf("key %q is empty once rewritten", key.Fingerprint())
+}
+
+// sigSubpackets is a version 4 signature packet split into its hashed and
+// unhashed subpacket areas.
+type sigSubpackets struct {
+	tag                    uint8
+	body                   []byte
+	hashedEnd, unhashedEnd int
+	hashed, unhashed       []*packet.OpaqueSubpacket
+}
+
+// parseSubpackets parses the signature packet in buf. Nil is returned for
+// signatures other than version 4, which have no subpackets.
+func parseSubpackets(buf []byte) (*sigSubpackets, error) {
+	op, err := packet.NewOpaqueReader(bytes.NewReader(buf)).Next()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	body := op.Contents
+	if len(body) < 6 || body[0] != 4 {
+		return nil, nil
+	}
+	hashedEnd := 6 + (int(body[4])<<8 | int(body[5]))
+	if len(body) < hashedEnd+2 {
+		return nil, errgo.New("truncated hashed subpackets")
+	}
+	unhashedEnd := hashedEnd + 2 + (int(body[hashedEnd])<<8 | int(body[hashedEnd+1]))
+	if len(body) < unhashedEnd {
+		return nil, errgo.New("truncated unhashed subpackets")
+	}
+	hashed, err := packet.OpaqueSubpackets(body[6:hashedEnd])
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	unhashed, err := packet.OpaqueSubpackets(body[hashedEnd+2 : unhashedEnd])
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &sigSubpackets{
+		tag:         op.Tag,
+		body:        body,
+		hashedEnd:   hashedEnd,
+		unhashedEnd: unhashedEnd,
+		hashed:      hashed,
+		unhashed:    unhashed,
+	}, nil
+}
+
+// withUnhashed returns the signature packet with its unhashed subpackets
+// replaced by those given.
+func (sp *sigSubpackets) withUnhashed(unhashed []*packet.OpaqueSubpacket) ([]byte, error) {
+	var area bytes.Buffer
+	for _, sub := range unhashed {
+		err := sub.Serialize(&area)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	var contents bytes.Buffer
+	contents.Write(sp.body[:sp.hashedEnd])
+	contents.Write([]byte{byte(area.Len() >> 8), byte(area.Len())})
+	contents.Write(area.Bytes())
+	contents.Write(sp.body[sp.unhashedEnd:])
+	var result bytes.Buffer
+	err := (&packet.OpaquePacket{Tag: sp.tag, Contents: contents.Bytes()}).Serialize(&result)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return result.Bytes(), nil
+}
+
+// stripUnhashed returns the signature packet in buf without the unhashed
+// subpackets which are not kept, and whether any were removed. Signatures
+// other than version 4 are returned unchanged.
+func stripUnhashed(buf []byte) ([]byte, bool, error) {
+	sp, err := parseSubpackets(buf)
+	if err != nil {
+		return nil, false, errgo.Mask(err)
+	}
+	if sp == nil {
+		return buf, false, nil
+	}
+	var kept []*packet.OpaqueSubpacket
+	for _, sub := range sp.unhashed {
+		switch sub.SubType & 0x7f {
+		case subpacketIssuer, subpacketEmbeddedSignature, subpacketIssuerFingerprint:
+			kept = append(kept, sub)
+		}
+	}
+	if len(kept) == len(sp.unhashed) {
+		return buf, false, nil
+	}
+	result, err := sp.withUnhashed(kept)
+	if err != nil {
+		return nil, false, errgo.Mask(err)
+	}
+	return result, true, nil
+}
@@ -0,0 +1,68 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/crypto/openpgp/packet"
+	gc "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type StorageSuite struct{}
+
+var _ = gc.Suite(&StorageSuite{})
+
+// signaturePacket returns a version 4 signature packet with the given
+// subpacket areas.
+func signaturePacket(hashed, unhashed []byte) []byte {
+	var body bytes.Buffer
+	body.Write([]byte{4, 0x13, 1, 8, byte(len(hashed) >> 8), byte(len(hashed))})
+	body.Write(hashed)
+	body.Write([]byte{byte(len(unhashed) >> 8), byte(len(unhashed))})
+	body.Write(unhashed)
+	body.Write([]byte{0xca, 0xfe, 0, 8, 0xff})
+	var buf bytes.Buffer
+	(&packet.OpaquePacket{Tag: 2, Contents: body.Bytes()}).Serialize(&buf)
+	return buf.Bytes()
+}
+
+func (s *StorageSuite) TestStripUnhashed(c *gc.C) {
+	creation := []byte{5, 2, 0x5d, 0x00, 0x00, 0x00}
+	issuer := []byte{9, subpacketIssuer, 1, 2, 3, 4, 5, 6, 7, 8}
+	garbage := []byte{6, 20, 'j', 'u', 'n', 'k', '!'}
+
+	buf := signaturePacket(creation, append(append([]byte{}, issuer...), garbage...))
+	stripped, changed, err := stripUnhashed(buf)
+	c.Assert(err, gc.IsNil)
+	c.Assert(changed, gc.Equals, true)
+	c.Assert(stripped, gc.DeepEquals, signaturePacket(creation, issuer))
+
+	stripped, changed, err = stripUnhashed(signaturePacket(creation, issuer))
+	c.Assert(err, gc.IsNil)
+	c.Assert(changed, gc.Equals, false)
+	c.Assert(stripped, gc.DeepEquals, signaturePacket(creation, issuer))
+
+	truncated := signaturePacket(creation, issuer)
+	truncated[len(truncated)-16] = 0xff
+	_, _, err = stripUnhashed(truncated)
+	c.Assert(err, gc.NotNil)
+}
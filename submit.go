@@ -0,0 +1,113 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// SubmitError is the cause of errors returned by Handler.Submit when a
+// submission is refused.
+type SubmitError struct {
+	// Status is the HTTP status with which /pks/add responded.
+	Status int
+	// Message explains why the submission was refused.
+	Message string
+}
+
+func (e *SubmitError) Error() string {
+	return fmt.Sprintf("submission refused: %s", e.Message)
+}
+
+// Temporary returns whether the submission may succeed if retried, such as
+// after a storage failure.
+func (e *SubmitError) Temporary() bool {
+	return e.Status >= http.StatusInternalServerError || e.Status == http.StatusTooManyRequests
+}
+
+// Submit submits keytext as if it were posted to /pks/add, so that keys
+// received through other channels, such as email, pass through the same
+// policies, limits and notifications. Refused submissions return an error
+// with a *SubmitError cause.
+func (h *Handler) Submit(ctx context.Context, keytext string) (*AddResponse, error) {
+	body := url.Values{"keytext": []string{keytext}}.Encode()
+	r, err := http.NewRequest("POST", h.pathPrefix+"/pks/add", strings.NewReader(body))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	r = r.WithContext(ctx)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := &submitResponse{header: http.Header{}}
+	h.Add(w, r, nil)
+	if w.status != http.StatusOK {
+		return nil, errgo.WithCausef(nil, &SubmitError{
+			Status:  w.status,
+			Message: strings.TrimSpace(w.body.String()),
+		}, "")
+	}
+	var result AddResponse
+	err = json.Unmarshal(w.body.Bytes(), &result)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &result, nil
+}
+
+// submitResponse records the response to a submission.
+type submitResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *submitResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *submitResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *submitResponse) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+// String summarizes the keys changed by a submission, one per line.
+func (r *AddResponse) String() string {
+	var lines []string
+	for _, group := range []struct {
+		label string
+		fps   []string
+	}{{"inserted", r.Inserted}, {"updated", r.Updated}, {"ignored", r.Ignored}} {
+		for _, fp := range group.fps {
+			lines = append(lines, group.label+" "+fp)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,239 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+
+	log "gopkg.in/hockeypuck/logrus.v0"
+	"gopkg.in/hockeypuck/openpgp.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/sks"
+)
+
+// Takedown describes a key withheld for legal reasons, such as a court
+// order.
+type Takedown struct {
+	// Fingerprint identifies the key withheld. Digest may be given
+	// instead, or as well, to withhold the key from recon partners.
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Digest      string `json:"digest,omitempty"`
+
+	// Reason is a machine-readable reason code, such as "court-order" or
+	// "gdpr-erasure".
+	Reason string `json:"reason"`
+
+	// Authority is a URL identifying who demanded the takedown, sent as a
+	// blocked-by link as described in RFC 7725.
+	Authority string `json:"authority,omitempty"`
+
+	// Message is shown to clients requesting the key.
+	Message string `json:"message,omitempty"`
+}
+
+// TakedownResponse is the machine-readable response to a lookup of a key
+// which has been taken down.
+type TakedownResponse struct {
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Reason      string `json:"reason"`
+	Authority   string `json:"authority,omitempty"`
+	Message     string `json:"message,omitempty"`
+}
+
+// LoadTakedowns reads takedowns from a JSON file containing an array of
+// Takedown objects.
+func LoadTakedowns(path string) ([]Takedown, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	var result []Takedown
+	err = json.Unmarshal(buf, &result)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot parse takedowns in %q", path)
+	}
+	return result, nil
+}
+
+// TakedownDigests returns the SKS digests of takedowns, which should be
+// blocked from recon with sks.Peer.Block so that they are not gossiped.
+func TakedownDigests(takedowns []Takedown) []string {
+	var result []string
+	for _, td := range takedowns {
+		if td.Digest != "" {
+			result = append(result, strings.ToLower(td.Digest))
+		}
+	}
+	return result
+}
+
+// takedowns indexes withheld keys by fingerprint and digest.
+type takedowns struct {
+	fingerprints map[string]*Takedown
+	digests      map[string]*Takedown
+}
+
+// Takedowns responds to lookups of the given keys with 451 Unavailable For
+// Legal Reasons rather than serving them, and omits them from keyword
+// searches and hashquery responses.
+func Takedowns(list []Takedown) HandlerOption {
+	return func(h *Handler) error {
+		t := &takedowns{
+			fingerprints: map[string]*Takedown{},
+			digests:      map[string]*Takedown{},
+		}
+		for i := range list {
+			td := &list[i]
+			if td.Reason == "" {
+				return errgo.Newf("takedown of %q requires a reason", td.Fingerprint+td.Digest)
+			}
+			fp := strings.ToLower(strings.Replace(strings.TrimPrefix(td.Fingerprint, "0x"), " ", "", -1))
+			digest := strings.ToLower(td.Digest)
+			if fp == "" && digest == "" {
+				return errgo.New("takedown requires a fingerprint or digest")
+			}
+			if fp != "" {
+				t.fingerprints[fp] = td
+			}
+			if digest != "" {
+				t.digests[digest] = td
+			}
+		}
+		h.takedowns = t
+		return nil
+	}
+}
+
+// DeletedKeys refuses submissions of keys deleted from peer with
+// sks.Peer.DeleteKey, which are blocked by fingerprint, so that they cannot
+// come back through /pks/add even with another signature or user ID.
+func DeletedKeys(peer *sks.Peer) HandlerOption {
+	return func(h *Handler) error {
+		h.deleted = peer
+		return nil
+	}
+}
+
+// match returns the takedown of the key identified by the search of l,
+// which is matched without consulting storage, as the key may have been
+// deleted.
+func (t *takedowns) match(l *Lookup) *Takedown {
+	if t == nil {
+		return nil
+	}
+	if l.Op == OperationHGet {
+		return t.digests[strings.ToLower(l.Search)]
+	}
+	if !strings.HasPrefix(l.Search, "0x") {
+		return nil
+	}
+	keyID := strings.ToLower(l.Search[2:])
+	if len(keyID) < shortKeyIDLen {
+		return nil
+	}
+	for fp, td := range t.fingerprints {
+		if strings.HasSuffix(fp, keyID) {
+			return td
+		}
+	}
+	return nil
+}
+
+// key returns the takedown of key, if any.
+func (t *takedowns) key(key *openpgp.PrimaryKey) *Takedown {
+	if t == nil {
+		return nil
+	}
+	if td, ok := t.fingerprints[key.Fingerprint()]; ok {
+		return td
+	}
+	return t.digests[strings.ToLower(key.MD5)]
+}
+
+// filter returns keys without those taken down, and the first takedown
+// which applied.
+func (t *takedowns) filter(keys []*openpgp.PrimaryKey) ([]*openpgp.PrimaryKey, *Takedown) {
+	if t == nil {
+		return keys, nil
+	}
+	var result []*openpgp.PrimaryKey
+	var first *Takedown
+	for _, key := range keys {
+		if td := t.key(key); td != nil {
+			if first == nil {
+				first = td
+			}
+			continue
+		}
+		result = append(result, key)
+	}
+	return result, first
+}
+
+// withheldError is the cause of errors returned when every key matching a
+// lookup has been taken down.
+type withheldError struct {
+	takedown *Takedown
+}
+
+func (e *withheldError) Error() string {
+	return fmt.Sprintf("withheld for legal reasons: %s", e.takedown.Reason)
+}
+
+// withheld returns the takedown causing err, if any.
+func withheld(err error) (*Takedown, bool) {
+	if e, ok := errgo.Cause(err).(*withheldError); ok {
+		return e.takedown, true
+	}
+	return nil, false
+}
+
+// writeTakedown responds with 451 Unavailable For Legal Reasons, as JSON for
+// machine-readable lookups.
+func (h *Handler) writeTakedown(w http.ResponseWriter, l *Lookup, td *Takedown) {
+	log.Infof("%s %q withheld for legal reasons: %s", l.Op, l.Search, td.Reason)
+	if td.Authority != "" {
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"blocked-by\"", td.Authority))
+	}
+	if l.Options[OptionMachineReadable] || l.Options[OptionJSON] {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnavailableForLegalReasons)
+		json.NewEncoder(w).Encode(&TakedownResponse{
+			Fingerprint: td.Fingerprint,
+			Reason:      td.Reason,
+			Authority:   td.Authority,
+			Message:     td.Message,
+		})
+		return
+	}
+	if l.Lang != "" {
+		w.Header().Set("Content-Language", l.Lang)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusUnavailableForLegalReasons)
+	fmt.Fprintln(w, h.localizer.Translate(l.Lang, http.StatusText(http.StatusUnavailableForLegalReasons)))
+	if td.Message != "" {
+		fmt.Fprintln(w, td.Message)
+	}
+}
@@ -0,0 +1,336 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/metrics"
+	"gopkg.in/hockeypuck/hkp.v1/notify"
+	"gopkg.in/hockeypuck/hkp.v1/sks"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+	"gopkg.in/hockeypuck/hkp.v1/vks"
+	"gopkg.in/hockeypuck/openpgp.v1"
+)
+
+// verifyMailInterval is how often verification emails may be sent to each
+// address, so that the verification endpoints cannot be used to flood a
+// mailbox.
+const verifyMailInterval = 10 * time.Minute
+
+// verifier strips unverified user IDs from served keys, and verifies email
+// addresses like Hagrid, the keys.openpgp.org keyserver.
+type verifier struct {
+	store  vks.Store
+	tokens *vks.Tokens
+	mailer notify.Mailer
+	certs  vks.CertStore
+	mailed *intervalLimiter
+}
+
+// VerifyingKeyserver runs the server as a verifying keyserver. Keys are
+// served only with the user IDs whose email addresses have been confirmed
+// by their owners, and without user attributes, while full keys are still
+// stored and reconciled with recon partners. Keys may be uploaded and email
+// addresses verified with the Hagrid-compatible VKS endpoints
+// /vks/v1/upload and /vks/v1/request-verify; verification emails are sent
+// with mailer, linking to /vks/v1/verify. Each address is sent at most one
+// verification email every ten minutes, and the endpoints may be rate
+// limited with EndpointVKS.
+func VerifyingKeyserver(store vks.Store, tokens *vks.Tokens, mailer notify.Mailer) HandlerOption {
+	return func(h *Handler) error {
+		h.verifier = &verifier{
+			store:  store,
+			tokens: tokens,
+			mailer: mailer,
+			mailed: newIntervalLimiter(verifyMailInterval),
+		}
+		return nil
+	}
+}
+
+// mayMail returns whether a verification email may be sent to email at now.
+func (v *verifier) mayMail(email string, now time.Time) bool {
+	ok, _ := v.mailed.allow(email, now)
+	return ok
+}
+
+// strip returns keys with only their verified user IDs. Keys found by a
+// keyword search are omitted unless the search matches a verified user ID,
+// so that unverified addresses cannot be used to find keys.
+func (v *verifier) strip(l *Lookup, keys []*openpgp.PrimaryKey) ([]*openpgp.PrimaryKey, error) {
+	search := strings.ToLower(l.Search)
+	byID := strings.HasPrefix(search, "0x") || l.Op == OperationHGet
+	var result []*openpgp.PrimaryKey
+	for _, key := range keys {
+		verified, err := v.verified(key)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		stripped := *key
+		stripped.UserIDs = nil
+		stripped.UserAttributes = nil
+		matched := byID
+		for _, uid := range key.UserIDs {
+			if !verified[storage.EmailAddress(uid.Keywords)] {
+				continue
+			}
+			stripped.UserIDs = append(stripped.UserIDs, uid)
+			if l.matchesUserID(uid.Keywords) {
+				matched = true
+			}
+		}
+		if matched {
+			result = append(result, &stripped)
+		}
+	}
+	return result, nil
+}
+
+func (v *verifier) verified(key *openpgp.PrimaryKey) (map[string]bool, error) {
+	addrs, err := v.store.VerifiedAddresses(key.Fingerprint())
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	result := map[string]bool{}
+	for _, addr := range addrs {
+		result[storage.NormalizeEmail(addr)] = true
+	}
+	return result, nil
+}
+
+// status returns the verification status of each email address in the user
+// IDs of key.
+func (v *verifier) status(key *openpgp.PrimaryKey) (map[string]string, error) {
+	verified, err := v.verified(key)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	result := map[string]string{}
+	for _, uid := range key.UserIDs {
+		email := storage.EmailAddress(uid.Keywords)
+		if email == "" {
+			continue
+		}
+		switch _, revoked := uid.SelfSigs(key).RevokedSince(); {
+		case revoked:
+			result[email] = vks.StatusRevoked
+		case verified[email]:
+			result[email] = vks.StatusPublished
+		default:
+			result[email] = vks.StatusUnpublished
+		}
+	}
+	return result, nil
+}
+
+func writeVKSResponse(w http.ResponseWriter, key *openpgp.PrimaryKey, status map[string]string, token string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&vks.UploadResponse{
+		KeyFpr: strings.ToUpper(key.Fingerprint()),
+		Status: status,
+		Token:  token,
+	})
+}
+
+// VKSUpload stores the single key uploaded as in Hagrid's /vks/v1/upload,
+// and responds with the status of its email addresses and a token for
+// requesting their verification.
+func (h *Handler) VKSUpload(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if h.refuseMirrored(w, r, "") {
+		return
+	}
+	if h.writeGuard != nil {
+		if err := h.writeGuard(); err != nil {
+			h.writeRefused(w, "", err)
+			return
+		}
+	}
+	var req vks.UploadRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxKeyfileSize)).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errgo.Mask(err))
+		return
+	}
+	keydata, err := DecodeKeytext(req.Keytext)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errgo.Mask(err))
+		return
+	}
+	counted, ok := h.reserveQuota(w, r, "", len(keydata))
+	if !ok {
+		return
+	}
+	var key *openpgp.PrimaryKey
+	for readKey := range openpgp.ReadKeys(bytes.NewBuffer(keydata)) {
+		if readKey.Error != nil {
+			httpError(w, http.StatusBadRequest, errgo.Mask(readKey.Error))
+			return
+		}
+		if key != nil {
+			httpError(w, http.StatusBadRequest, errgo.New("expected a single key"))
+			return
+		}
+		key = readKey.PrimaryKey
+	}
+	if key == nil {
+		httpError(w, http.StatusBadRequest, errgo.New("no key found"))
+		return
+	}
+	err = h.parseMode.Check(key)
+	if err != nil {
+		if h.rejectFunc != nil {
+			h.rejectFunc(err)
+		}
+		httpError(w, http.StatusBadRequest, errgo.Mask(err))
+		return
+	}
+	pc, err := storage.DropDuplicates(key)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, errgo.Mask(err))
+		return
+	}
+	err = h.checkPolicy(key, r, &pc)
+	if err != nil {
+		h.refuseKey(w, r, err)
+		return
+	}
+	if h.packetFunc != nil {
+		h.packetFunc(pc)
+	}
+	change, ok := h.upsertKey(w, r, "", key)
+	if !ok {
+		return
+	}
+	counted(1)
+	metrics.KeyChanged(sks.SourceAdd, change)
+	if h.freshness != nil {
+		h.freshness.added(change)
+	}
+	if h.changeFunc != nil {
+		h.changeFunc(change)
+	}
+
+	status, err := h.verifier.status(key)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, errgo.Mask(err))
+		return
+	}
+	token, err := h.verifier.tokens.Issue(vks.TokenUpload, key.Fingerprint(), "", time.Now())
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, errgo.Mask(err))
+		return
+	}
+	writeVKSResponse(w, key, status, token)
+}
+
+// VKSRequestVerify sends verification emails to the unpublished addresses
+// requested of the key uploaded with the given token, as in Hagrid's
+// /vks/v1/request-verify.
+func (h *Handler) VKSRequestVerify(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req vks.VerifyRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errgo.Mask(err))
+		return
+	}
+	now := time.Now()
+	tok, err := h.verifier.tokens.Check(req.Token, vks.TokenUpload, now)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errgo.Mask(err))
+		return
+	}
+	keys, err := storage.FetchKeysContext(r.Context(), h.storage, []string{openpgp.Reverse(tok.Fingerprint)})
+	if err != nil && !storage.IsNotFound(err) {
+		metrics.StorageError("fetch")
+		httpError(w, http.StatusInternalServerError, errgo.Mask(err))
+		return
+	}
+	var key *openpgp.PrimaryKey
+	for _, k := range keys {
+		if k.Fingerprint() == tok.Fingerprint {
+			key = k
+		}
+	}
+	if key == nil {
+		httpError(w, http.StatusNotFound, errgo.Newf("key %s not found", tok.Fingerprint))
+		return
+	}
+	status, err := h.verifier.status(key)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, errgo.Mask(err))
+		return
+	}
+
+	baseURL := h.proxies.BaseURL(r, h.pathPrefix)
+	for _, addr := range req.Addresses {
+		email := strings.ToLower(addr)
+		if status[email] != vks.StatusUnpublished {
+			continue
+		}
+		if !h.verifier.mayMail(email, now) {
+			// A verification email was sent recently.
+			status[email] = vks.StatusPending
+			continue
+		}
+		token, err := h.verifier.tokens.Issue(vks.TokenVerify, key.Fingerprint(), email, now)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, errgo.Mask(err))
+			return
+		}
+		link := *baseURL
+		link.Path += "/vks/v1/verify"
+		link.RawQuery = url.Values{"token": {token}}.Encode()
+		err = h.verifier.mailer.Mail([]string{email}, "Verify "+email+" for your OpenPGP key",
+			fmt.Sprintf("To publish %s with your OpenPGP key %s on %s, visit:\n\n%s\n\n"+
+				"If you did not request this, you can ignore this message.\n",
+				email, strings.ToUpper(key.Fingerprint()), baseURL.Host, link.String()))
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, errgo.Notef(err, "cannot send verification email"))
+			return
+		}
+		status[email] = vks.StatusPending
+	}
+	writeVKSResponse(w, key, status, req.Token)
+}
+
+// VKSVerify confirms the email address and key of a token sent in a
+// verification email.
+func (h *Handler) VKSVerify(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tok, err := h.verifier.tokens.Check(r.FormValue("token"), vks.TokenVerify, time.Now())
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errgo.Mask(err))
+		return
+	}
+	err = h.verifier.store.SetVerified(tok.Fingerprint, tok.Email)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, errgo.Mask(err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "%s is now published with key %s.\n", tok.Email, strings.ToUpper(tok.Fingerprint))
+}
@@ -0,0 +1,190 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package vks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// Status of a user ID's email address on a verifying keyserver, as
+// reported by the VKS API.
+const (
+	StatusUnpublished = "unpublished"
+	StatusPending     = "pending"
+	StatusPublished   = "published"
+	StatusRevoked     = "revoked"
+)
+
+// UploadRequest is the body of a request to /vks/v1/upload.
+type UploadRequest struct {
+	Keytext string `json:"keytext"`
+}
+
+// UploadResponse is the response to an upload or verification request. The
+// token authorizes verification requests for the uploaded key.
+type UploadResponse struct {
+	KeyFpr string            `json:"key_fpr"`
+	Status map[string]string `json:"status"`
+	Token  string            `json:"token"`
+}
+
+// VerifyRequest is the body of a request to /vks/v1/request-verify.
+type VerifyRequest struct {
+	Token     string   `json:"token"`
+	Addresses []string `json:"addresses"`
+}
+
+// Store records the email addresses whose owners have confirmed that they
+// belong to a key. It satisfies reminder.Verifier.
+type Store interface {
+	// VerifiedAddresses returns the verified addresses of the key with
+	// the given fingerprint.
+	VerifiedAddresses(fingerprint string) ([]string, error)
+	// SetVerified records that email has been verified for the key with
+	// the given fingerprint.
+	SetVerified(fingerprint, email string) error
+}
+
+// MemoryStore is a Store and CertStore which keeps verified addresses and
+// certificates in memory, for testing and small deployments.
+type MemoryStore struct {
+	mu       sync.Mutex
+	verified map[string]map[string]bool
+	certs    map[string][]byte
+	bound    map[string]map[string]bool
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{verified: map[string]map[string]bool{}}
+}
+
+func (s *MemoryStore) VerifiedAddresses(fingerprint string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result []string
+	for email := range s.verified[strings.ToLower(fingerprint)] {
+		result = append(result, email)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func (s *MemoryStore) SetVerified(fingerprint, email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fp := strings.ToLower(fingerprint)
+	if s.verified[fp] == nil {
+		s.verified[fp] = map[string]bool{}
+	}
+	s.verified[fp][strings.ToLower(email)] = true
+	return nil
+}
+
+// Kinds of tokens.
+const (
+	// TokenUpload authorizes verification requests for an uploaded key.
+	TokenUpload = "upload"
+	// TokenVerify confirms an email address for a key when followed from
+	// a verification email.
+	TokenVerify = "verify"
+)
+
+// DefaultTokenTTL is how long tokens remain valid by default.
+const DefaultTokenTTL = 24 * time.Hour
+
+// ErrInvalidToken is the cause of errors returned for tokens which are
+// malformed, forged, expired or of the wrong kind.
+var ErrInvalidToken = errgo.New("invalid or expired token")
+
+// Token is the content of a token.
+type Token struct {
+	Kind        string `json:"k"`
+	Fingerprint string `json:"f"`
+	Email       string `json:"e,omitempty"`
+	Expires     int64  `json:"x"`
+}
+
+// Tokens issues and checks stateless tokens, authenticated with HMAC-SHA256
+// under a server secret, so that no pending verifications need be stored.
+type Tokens struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+// NewTokens returns Tokens authenticated with secret, which should be at
+// least 32 random bytes, and valid for ttl.
+func NewTokens(secret []byte, ttl time.Duration) *Tokens {
+	return &Tokens{secret: secret, ttl: ttl}
+}
+
+// Issue returns a token of the given kind for fingerprint and email, valid
+// from now for the configured TTL.
+func (t *Tokens) Issue(kind, fingerprint, email string, now time.Time) (string, error) {
+	buf, err := json.Marshal(&Token{
+		Kind:        kind,
+		Fingerprint: strings.ToLower(fingerprint),
+		Email:       strings.ToLower(email),
+		Expires:     now.Add(t.ttl).Unix(),
+	})
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	payload := base64.RawURLEncoding.EncodeToString(buf)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(t.mac(payload)), nil
+}
+
+// Check returns the content of token, if it is authentic, of the given kind
+// and not expired as of now. Otherwise, an error with cause ErrInvalidToken
+// is returned.
+func (t *Tokens) Check(token, kind string, now time.Time) (*Token, error) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return nil, errgo.WithCausef(nil, ErrInvalidToken, "invalid %s token", kind)
+	}
+	payload := token[:i]
+	mac, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil || !hmac.Equal(mac, t.mac(payload)) {
+		return nil, errgo.WithCausef(nil, ErrInvalidToken, "invalid %s token", kind)
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errgo.WithCausef(nil, ErrInvalidToken, "invalid %s token", kind)
+	}
+	var result Token
+	err = json.Unmarshal(buf, &result)
+	if err != nil || result.Kind != kind || now.Unix() > result.Expires {
+		return nil, errgo.WithCausef(nil, ErrInvalidToken, "invalid %s token", kind)
+	}
+	return &result, nil
+}
+
+func (t *Tokens) mac(payload string) []byte {
+	h := hmac.New(sha256.New, t.secret)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
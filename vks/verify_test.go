@@ -0,0 +1,65 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package vks
+
+import (
+	"strings"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+)
+
+func (s *VKSSuite) TestTokens(c *gc.C) {
+	now := time.Now()
+	tokens := NewTokens([]byte(strings.Repeat("k", 32)), time.Hour)
+	token, err := tokens.Issue(TokenVerify, "10FE8CF1B483F7525039AA2A361BC1F023E0DCCA", "Alice@Example.com", now)
+	c.Assert(err, gc.IsNil)
+
+	tok, err := tokens.Check(token, TokenVerify, now.Add(time.Minute))
+	c.Assert(err, gc.IsNil)
+	c.Assert(tok.Fingerprint, gc.Equals, "10fe8cf1b483f7525039aa2a361bc1f023e0dcca")
+	c.Assert(tok.Email, gc.Equals, "alice@example.com")
+
+	for i, check := range []func() error{
+		func() error { _, err := tokens.Check(token, TokenUpload, now); return err },
+		func() error { _, err := tokens.Check(token, TokenVerify, now.Add(2*time.Hour)); return err },
+		func() error { _, err := tokens.Check("x"+token, TokenVerify, now); return err },
+		func() error { _, err := tokens.Check("garbage", TokenVerify, now); return err },
+		func() error {
+			other := NewTokens([]byte(strings.Repeat("o", 32)), time.Hour)
+			_, err := other.Check(token, TokenVerify, now)
+			return err
+		},
+	} {
+		c.Check(errgo.Cause(check()), gc.Equals, ErrInvalidToken, gc.Commentf("check %d", i))
+	}
+}
+
+func (s *VKSSuite) TestMemoryStore(c *gc.C) {
+	st := NewMemoryStore()
+	addrs, err := st.VerifiedAddresses("10FE8CF1B483F7525039AA2A361BC1F023E0DCCA")
+	c.Assert(err, gc.IsNil)
+	c.Assert(addrs, gc.HasLen, 0)
+
+	c.Assert(st.SetVerified("10FE8CF1B483F7525039AA2A361BC1F023E0DCCA", "Bob@example.com"), gc.IsNil)
+	c.Assert(st.SetVerified("10fe8cf1b483f7525039aa2a361bc1f023e0dcca", "alice@example.com"), gc.IsNil)
+	addrs, err = st.VerifiedAddresses("10fe8cf1b483f7525039aa2a361bc1f023e0dcca")
+	c.Assert(err, gc.IsNil)
+	c.Assert(addrs, gc.DeepEquals, []string{"alice@example.com", "bob@example.com"})
+}
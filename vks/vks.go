@@ -0,0 +1,312 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package vks imports keys from verifying keyservers, such as
+// keys.openpgp.org, which serve the VKS API implemented by Hagrid. Such
+// keyservers only publish user IDs whose email addresses have been verified,
+// and do not take part in recon, so the Bridge periodically refreshes local
+// keys at configured domains from them.
+package vks
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/tomb.v2"
+
+	"gopkg.in/hockeypuck/hkp.v1/metrics"
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+	log "gopkg.in/hockeypuck/logrus.v0"
+	"gopkg.in/hockeypuck/openpgp.v1"
+)
+
+const (
+	// DefaultURL is the base URL of keys.openpgp.org.
+	DefaultURL = "https://keys.openpgp.org"
+
+	// DefaultInterval is how often a Bridge imports keys by default.
+	DefaultInterval = 24 * time.Hour
+
+	// Source identifies key changes made by a Bridge in metrics.
+	Source = "vks"
+)
+
+// ErrNotFound is the cause of errors returned when the verifying keyserver
+// has no key matching a query.
+var ErrNotFound = errgo.New("not found")
+
+// Client queries a keyserver with the VKS API.
+type Client struct {
+	url    string
+	client *http.Client
+}
+
+// NewClient returns a Client querying the keyserver at baseURL, such as
+// DefaultURL. If client is nil, a client with a one minute timeout is used.
+func NewClient(baseURL string, client *http.Client) *Client {
+	if client == nil {
+		client = &http.Client{Timeout: time.Minute}
+	}
+	return &Client{
+		url:    strings.TrimSuffix(baseURL, "/"),
+		client: client,
+	}
+}
+
+// ByFingerprint returns the key with the given fingerprint.
+func (c *Client) ByFingerprint(ctx context.Context, fingerprint string) ([]*openpgp.PrimaryKey, error) {
+	fp := strings.ToUpper(strings.TrimPrefix(strings.ToLower(fingerprint), "0x"))
+	return c.get(ctx, "/vks/v1/by-fingerprint/"+url.PathEscape(fp))
+}
+
+// ByEmail returns the key with a verified user ID for email.
+func (c *Client) ByEmail(ctx context.Context, email string) ([]*openpgp.PrimaryKey, error) {
+	return c.get(ctx, "/vks/v1/by-email/"+url.PathEscape(email))
+}
+
+func (c *Client) get(ctx context.Context, path string) ([]*openpgp.PrimaryKey, error) {
+	req, err := http.NewRequest("GET", c.url+path, nil)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, errgo.Mask(ctx.Err(), errgo.Any)
+		}
+		return nil, errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, errgo.WithCausef(nil, ErrNotFound, "%s%s", c.url, path)
+	default:
+		return nil, errgo.Newf("%s%s responded %q", c.url, path, resp.Status)
+	}
+
+	readKeys, err := openpgp.ReadArmorKeys(resp.Body)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var keys []*openpgp.PrimaryKey
+	for readKey := range readKeys {
+		if readKey.Error != nil {
+			return nil, errgo.Mask(readKey.Error)
+		}
+		keys = append(keys, readKey.PrimaryKey)
+	}
+	return keys, nil
+}
+
+// Result summarizes an import.
+type Result struct {
+	// Fetched counts the keys received from the verifying keyserver.
+	Fetched   int `json:"fetched"`
+	Inserted  int `json:"inserted"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+
+	// NotFound counts queries for which the verifying keyserver had no key,
+	// and Failed counts queries which failed.
+	NotFound int `json:"notFound"`
+	Failed   int `json:"failed"`
+
+	// Started and Finished are when the import ran.
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+func (r *Result) String() string {
+	return fmt.Sprintf("fetched=%d inserted=%d updated=%d unchanged=%d notfound=%d failed=%d",
+		r.Fetched, r.Inserted, r.Updated, r.Unchanged, r.NotFound, r.Failed)
+}
+
+// Bridge periodically imports keys from a verifying keyserver into storage.
+// Local keys with user IDs at the configured domains are refreshed by
+// fingerprint, and keys for the configured email addresses are imported
+// whether or not they are already known.
+type Bridge struct {
+	client   *Client
+	storage  storage.Storage
+	domains  map[string]bool
+	emails   []string
+	interval time.Duration
+
+	mu     sync.Mutex
+	latest *Result
+
+	t tomb.Tomb
+}
+
+// NewBridge returns a Bridge importing keys at domains from c into st.
+func NewBridge(c *Client, st storage.Storage, domains []string) *Bridge {
+	b := &Bridge{
+		client:   c,
+		storage:  st,
+		domains:  map[string]bool{},
+		interval: DefaultInterval,
+	}
+	for _, domain := range domains {
+		b.domains[storage.NormalizeDomain(domain)] = true
+	}
+	return b
+}
+
+// SetInterval sets how often keys are imported once started.
+func (b *Bridge) SetInterval(d time.Duration) {
+	b.interval = d
+}
+
+// SetEmails sets email addresses whose keys are imported even if no local
+// key has a user ID for them.
+func (b *Bridge) SetEmails(emails []string) {
+	b.emails = emails
+}
+
+// Run imports keys now. Queries which fail are counted in the result;
+// an error is returned only if storage fails or ctx is done.
+func (b *Bridge) Run(ctx context.Context) (*Result, error) {
+	result := &Result{Started: time.Now().UTC()}
+	var fingerprints []string
+	err := storage.ForEachKey(b.storage, func(key *openpgp.PrimaryKey) {
+		for _, uid := range key.UserIDs {
+			if b.domains[storage.EmailDomain(uid.Keywords)] {
+				fingerprints = append(fingerprints, key.Fingerprint())
+				return
+			}
+		}
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	seen := map[string]bool{}
+	for _, fp := range fingerprints {
+		keys, err := b.client.ByFingerprint(ctx, fp)
+		err = b.merge(ctx, result, seen, keys, err)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+	}
+	for _, email := range b.emails {
+		keys, err := b.client.ByEmail(ctx, email)
+		err = b.merge(ctx, result, seen, keys, err)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+	}
+	result.Finished = time.Now().UTC()
+
+	log.Infof("import from %s: %v", b.client.url, result)
+	b.mu.Lock()
+	b.latest = result
+	b.mu.Unlock()
+	return result, nil
+}
+
+// merge stores keys fetched from the verifying keyserver, or counts the
+// error with which fetching them failed.
+func (b *Bridge) merge(ctx context.Context, result *Result, seen map[string]bool, keys []*openpgp.PrimaryKey, fetchErr error) error {
+	if ctx.Err() != nil {
+		return errgo.Mask(ctx.Err(), errgo.Any)
+	}
+	switch {
+	case errgo.Cause(fetchErr) == ErrNotFound:
+		result.NotFound++
+		return nil
+	case fetchErr != nil:
+		log.Warningf("import from %s failed: %v", b.client.url, fetchErr)
+		result.Failed++
+		return nil
+	}
+	for _, key := range keys {
+		if seen[key.RFingerprint] {
+			continue
+		}
+		seen[key.RFingerprint] = true
+		result.Fetched++
+		_, err := storage.DropDuplicates(key)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		change, err := storage.UpsertKeyContext(ctx, b.storage, key)
+		if err != nil {
+			metrics.StorageError("upsert")
+			return errgo.Mask(err, errgo.Any)
+		}
+		metrics.KeyChanged(Source, change)
+		switch change.(type) {
+		case storage.KeyAdded:
+			result.Inserted++
+		case storage.KeyReplaced:
+			result.Updated++
+		default:
+			result.Unchanged++
+		}
+	}
+	return nil
+}
+
+// Latest returns the result of the latest import, or nil if none has
+// completed yet.
+func (b *Bridge) Latest() *Result {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.latest
+}
+
+// Start imports keys in the background immediately and then periodically
+// until Stop is called.
+func (b *Bridge) Start() {
+	b.t.Go(b.run)
+}
+
+func (b *Bridge) run() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-b.t.Dying()
+		cancel()
+	}()
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		_, err := b.Run(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Errorf("import from %s failed: %v", b.client.url, err)
+		}
+		select {
+		case <-b.t.Dying():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop stops importing keys.
+func (b *Bridge) Stop() {
+	b.t.Kill(nil)
+	b.t.Wait()
+}
@@ -0,0 +1,101 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package vks
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	stdtesting "testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/hockeypuck/testing"
+	"gopkg.in/hockeypuck/openpgp.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/storage/mock"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type VKSSuite struct{}
+
+var _ = gc.Suite(&VKSSuite{})
+
+func (s *VKSSuite) TestBridge(c *gc.C) {
+	armored, err := ioutil.ReadAll(testing.MustInput("alice_signed.asc"))
+	c.Assert(err, gc.IsNil)
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if r.URL.Path != "/vks/v1/by-fingerprint/10FE8CF1B483F7525039AA2A361BC1F023E0DCCA" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pgp-keys")
+		w.Write(armored)
+	}))
+	defer srv.Close()
+
+	st := mock.NewStorage(
+		mock.ModifiedSince(func(time.Time) ([]string, error) {
+			return []string{"accd0e320f1cb163a2aa9305257f384b1fc8ef01"}, nil
+		}),
+		mock.FetchKeys(func(rfps []string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")).MustParse(), nil
+		}),
+	)
+
+	b := NewBridge(NewClient(srv.URL+"/", nil), st, []string{"Example.com"})
+	b.SetEmails([]string{"bob@example.org"})
+	c.Assert(b.Latest(), gc.IsNil)
+	result, err := b.Run(context.Background())
+	c.Assert(err, gc.IsNil)
+	c.Assert(paths, gc.DeepEquals, []string{
+		"/vks/v1/by-fingerprint/10FE8CF1B483F7525039AA2A361BC1F023E0DCCA",
+		"/vks/v1/by-email/bob@example.org",
+	})
+	c.Assert(result.Fetched, gc.Equals, 1)
+	c.Assert(result.Unchanged, gc.Equals, 1)
+	c.Assert(result.NotFound, gc.Equals, 1)
+	c.Assert(result.Failed, gc.Equals, 0)
+	c.Assert(b.Latest(), gc.Equals, result)
+
+	// Other domains are not refreshed.
+	paths = nil
+	_, err = NewBridge(NewClient(srv.URL, nil), st, []string{"example.net"}).Run(context.Background())
+	c.Assert(err, gc.IsNil)
+	c.Assert(paths, gc.HasLen, 0)
+}
+
+func (s *VKSSuite) TestClientNotFound(c *gc.C) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	_, err := NewClient(srv.URL, nil).ByEmail(context.Background(), "alice@example.com")
+	c.Assert(errgo.Cause(err), gc.Equals, ErrNotFound)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+	defer failing.Close()
+	_, err = NewClient(failing.URL, nil).ByFingerprint(context.Background(), "0x10fe8cf1b483f7525039aa2a361bc1f023e0dcca")
+	c.Assert(err, gc.ErrorMatches, `.*/vks/v1/by-fingerprint/10FE8CF1B483F7525039AA2A361BC1F023E0DCCA responded "429 Too Many Requests"`)
+}
@@ -0,0 +1,110 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package vks
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// TokenCertificate confirms an email address for an X.509 certificate when
+// followed from a verification email.
+const TokenCertificate = "x509"
+
+// CertUploadResponse is the response to an X.509 certificate upload, with
+// the status of each email address in its subject alternative names.
+type CertUploadResponse struct {
+	CertFpr string            `json:"cert_fpr"`
+	Status  map[string]string `json:"status"`
+}
+
+// CertStore stores X.509 certificates, and the email addresses whose owners
+// have confirmed that they belong to them.
+type CertStore interface {
+	// AddCertificate stores the DER-encoded certificate, unbound to any
+	// email address.
+	AddCertificate(der []byte) error
+	// Certificate returns the DER-encoded certificate with the given
+	// fingerprint, or nil if there is none.
+	Certificate(fingerprint string) ([]byte, error)
+	// BindCertificate records that email has been verified for the
+	// certificate with the given fingerprint.
+	BindCertificate(fingerprint, email string) error
+	// Certificates returns the DER-encoded certificates bound to email.
+	Certificates(email string) ([][]byte, error)
+}
+
+// CertificateFingerprint returns the hex SHA-256 fingerprint of a
+// DER-encoded certificate.
+func CertificateFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *MemoryStore) AddCertificate(der []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.certs == nil {
+		s.certs = map[string][]byte{}
+	}
+	s.certs[CertificateFingerprint(der)] = append([]byte(nil), der...)
+	return nil
+}
+
+func (s *MemoryStore) Certificate(fingerprint string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.certs[strings.ToLower(fingerprint)], nil
+}
+
+func (s *MemoryStore) BindCertificate(fingerprint, email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fp := strings.ToLower(fingerprint)
+	if _, ok := s.certs[fp]; !ok {
+		return errgo.Newf("certificate %s not found", fp)
+	}
+	addr := strings.ToLower(email)
+	if s.bound == nil {
+		s.bound = map[string]map[string]bool{}
+	}
+	if s.bound[addr] == nil {
+		s.bound[addr] = map[string]bool{}
+	}
+	s.bound[addr][fp] = true
+	return nil
+}
+
+func (s *MemoryStore) Certificates(email string) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var fps []string
+	for fp := range s.bound[strings.ToLower(email)] {
+		fps = append(fps, fp)
+	}
+	sort.Strings(fps)
+	var result [][]byte
+	for _, fp := range fps {
+		result = append(result, s.certs[fp])
+	}
+	return result, nil
+}
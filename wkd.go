@@ -0,0 +1,170 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+	"gopkg.in/hockeypuck/openpgp.v1"
+)
+
+// wkdPath is where the Web Key Directory is served, for both the direct
+// method, such as /.well-known/openpgpkey/hu/<hash>, and the advanced
+// method, such as /.well-known/openpgpkey/<domain>/hu/<hash>.
+const wkdPath = "/.well-known/openpgpkey/"
+
+const zbase32Alphabet = "ybndrfg8ejkmcpqxot1uwisza345h769"
+
+// zbase32 encodes buf in z-base-32, as used by the Web Key Directory.
+func zbase32(buf []byte) string {
+	var result []byte
+	var acc, bits uint
+	for _, b := range buf {
+		acc = acc<<8 | uint(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			result = append(result, zbase32Alphabet[(acc>>bits)&0x1f])
+		}
+	}
+	if bits > 0 {
+		result = append(result, zbase32Alphabet[(acc<<(5-bits))&0x1f])
+	}
+	return string(result)
+}
+
+// WKDHash returns the Web Key Directory hash of the local part of an email
+// address: the z-base-32 encoded SHA-1 digest of the local part, with only
+// its ASCII letters lowercased, as the protocol specifies. Non-ASCII
+// characters are hashed as given, in UTF-8.
+func WKDHash(localPart string) string {
+	sum := sha1.Sum([]byte(asciiLower(localPart)))
+	return zbase32(sum[:])
+}
+
+// asciiLower returns s with its ASCII upper-case letters lowercased.
+func asciiLower(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+// WebKeyDirectory serves keys from storage by the Web Key Directory
+// protocol, so that mail clients may discover them without HKP. Only
+// addresses at the given domains are served; if none are given, the domain
+// is that by which the server was reached. Internationalized domains may be
+// given, and reached, in either Unicode or punycode form.
+//
+// Keys are looked up by the local part given in the l parameter of the
+// request, which must match the hash in its path. Served keys carry only
+// the user IDs with the requested address.
+func WebKeyDirectory(domains ...string) HandlerOption {
+	return func(h *Handler) error {
+		h.wkdDomains = map[string]bool{}
+		for _, domain := range domains {
+			h.wkdDomains[storage.NormalizeDomain(domain)] = true
+		}
+		return nil
+	}
+}
+
+// wkdRequest returns the domain of a Web Key Directory request and the
+// remainder of its path, which is either "policy" or "hu/<hash>".
+func (h *Handler) wkdRequest(r *http.Request) (domain, rest string) {
+	rest = strings.TrimPrefix(r.URL.Path, wkdPath)
+	if rest == "policy" || strings.HasPrefix(rest, "hu/") {
+		host := h.proxies.BaseURL(r, "").Host
+		if hostOnly, _, err := net.SplitHostPort(host); err == nil {
+			host = hostOnly
+		}
+		return storage.NormalizeDomain(host), rest
+	}
+	i := strings.Index(rest, "/")
+	if i < 0 {
+		return "", ""
+	}
+	return storage.NormalizeDomain(rest[:i]), rest[i+1:]
+}
+
+// WKD serves the Web Key Directory policy file and keys.
+func (h *Handler) WKD(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	domain, rest := h.wkdRequest(r)
+	if domain == "" || (len(h.wkdDomains) > 0 && !h.wkdDomains[domain]) {
+		httpError(w, http.StatusNotFound, errgo.Newf("domain %q not served", domain))
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if rest == "policy" {
+		w.Header().Set("Content-Type", "text/plain")
+		return
+	}
+	hash := strings.TrimPrefix(rest, "hu/")
+	local := r.FormValue("l")
+	if hash == rest || local == "" || WKDHash(local) != hash {
+		httpError(w, http.StatusNotFound, errgo.New("not found"))
+		return
+	}
+
+	email := storage.NormalizeEmail(local + "@" + domain)
+	l := &Lookup{Op: OperationGet, Search: email, ClientIP: h.ClientIP(r)}
+	keys, err := h.keys(l)
+	if td, ok := withheld(err); ok {
+		h.writeTakedown(w, l, td)
+		return
+	} else if err != nil {
+		httpError(w, http.StatusInternalServerError, errgo.Mask(err))
+		return
+	}
+	var buf bytes.Buffer
+	for _, key := range keys {
+		served := *key
+		served.UserIDs = nil
+		served.UserAttributes = nil
+		for _, uid := range key.UserIDs {
+			if storage.EmailAddress(uid.Keywords) == email {
+				served.UserIDs = append(served.UserIDs, uid)
+			}
+		}
+		if len(served.UserIDs) == 0 {
+			continue
+		}
+		err = openpgp.WritePackets(&buf, &served)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, errgo.Mask(err))
+			return
+		}
+	}
+	if buf.Len() == 0 {
+		httpError(w, http.StatusNotFound, errgo.Newf("no key found for %s", email))
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,109 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/julienschmidt/httprouter"
+	gc "gopkg.in/check.v1"
+
+	"gopkg.in/hockeypuck/openpgp.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/storage"
+)
+
+type WKDSuite struct{}
+
+var _ = gc.Suite(&WKDSuite{})
+
+func (s *WKDSuite) TestWKDHash(c *gc.C) {
+	// Example from draft-koch-openpgp-webkey-service.
+	c.Assert(WKDHash("Joe.Doe"), gc.Equals, "iy9q119eutrkn8s1mk4r39qejnbu3n5q")
+	// Only ASCII letters are lowercased.
+	c.Assert(WKDHash("Jürgen"), gc.Equals, WKDHash("jürgen"))
+	c.Assert(WKDHash("JÜRGEN"), gc.Not(gc.Equals), WKDHash("jürgen"))
+	c.Assert(zbase32([]byte{0xf0, 0xbf, 0xc7}), gc.Equals, "6n9hq")
+	c.Assert(zbase32(nil), gc.Equals, "")
+}
+
+func (s *WKDSuite) TestIDN(c *gc.C) {
+	c.Assert(storage.NormalizeDomain("XN--BCHER-KVA.de."), gc.Equals, "bücher.de")
+	c.Assert(storage.NormalizeEmail("Jürgen@xn--bcher-kva.DE"), gc.Equals, "jürgen@bücher.de")
+	c.Assert(storage.EmailAddress("Jürgen <jurgen@xn--bcher-kva.de>"), gc.Equals, "jurgen@bücher.de")
+	c.Assert(storage.EmailDomain("Jürgen <jurgen@bücher.de>"), gc.Equals, "bücher.de")
+
+	c.Assert(storage.EmailSearches("alice@example.com"), gc.DeepEquals, []string{"alice@example.com"})
+	c.Assert(storage.EmailSearches("alice@bücher.de"), gc.DeepEquals,
+		[]string{"alice@bücher.de", "alice@xn--bcher-kva.de"})
+	c.Assert(storage.EmailSearches("<alice@xn--bcher-kva.de>"), gc.DeepEquals,
+		[]string{"<alice@xn--bcher-kva.de>", "<alice@bücher.de>"})
+	c.Assert(storage.UserIDContains("Alice <alice@xn--bcher-kva.de>", "ALICE@bücher.de"), gc.Equals, true)
+	c.Assert(storage.UserIDContains("Alice <alice@bücher.de>", "alice@xn--bcher-kva.de"), gc.Equals, true)
+	c.Assert(storage.UserIDContains("Alice <alice@example.com>", "alice@bücher.de"), gc.Equals, false)
+}
+
+func (s *HandlerSuite) TestWKD(c *gc.C) {
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, WebKeyDirectory("example.com"))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	get := func(path string) (*http.Response, []byte) {
+		res, err := http.Get(srv.URL + path)
+		c.Assert(err, gc.IsNil)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		c.Assert(err, gc.IsNil)
+		return res, body
+	}
+
+	res, _ := get("/.well-known/openpgpkey/example.com/policy")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	res, _ = get("/.well-known/openpgpkey/example.org/policy")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+
+	hash := WKDHash("alice")
+	res, body := get("/.well-known/openpgpkey/example.com/hu/" + hash + "?l=alice")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(res.Header.Get("Content-Type"), gc.Equals, "application/octet-stream")
+	c.Assert(res.Header.Get("Access-Control-Allow-Origin"), gc.Equals, "*")
+	var keys []*openpgp.PrimaryKey
+	for readKey := range openpgp.ReadKeys(bytes.NewReader(body)) {
+		c.Assert(readKey.Error, gc.IsNil)
+		keys = append(keys, readKey.PrimaryKey)
+	}
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].ShortID(), gc.Equals, "23e0dcca")
+	c.Assert(keys[0].UserIDs, gc.HasLen, 1)
+	c.Assert(keys[0].UserIDs[0].Keywords, gc.Equals, "alice <alice@example.com>")
+
+	// The local part must match the hash, and addresses at other domains
+	// are not served.
+	res, _ = get("/.well-known/openpgpkey/example.com/hu/" + hash + "?l=bob")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+	res, _ = get("/.well-known/openpgpkey/example.com/hu/" + hash)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+	res, _ = get("/.well-known/openpgpkey/hu/" + hash + "?l=alice")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+}
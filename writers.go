@@ -18,16 +18,20 @@
 package hkp
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"gopkg.in/errgo.v1"
 	"gopkg.in/hockeypuck/hkp.v1/jsonhkp"
+	"gopkg.in/hockeypuck/hkp.v1/proof"
 	"gopkg.in/hockeypuck/openpgp.v1"
 )
 
@@ -35,13 +39,42 @@ type IndexFormat interface {
 	Write(w http.ResponseWriter, l *Lookup, keys []*openpgp.PrimaryKey) error
 }
 
-type JSONFormat struct{}
+// RevokedCertifiers reports which certifying keys have been revoked, such
+// as a sigindex.Index does.
+type RevokedCertifiers interface {
+	// RevokedCertifier returns when the key with the given long key ID
+	// was revoked, if it is known to have been.
+	RevokedCertifier(keyID string) (time.Time, bool)
+}
+
+// JSONFormat writes keys as JSON. If Proofs is set, the identity proofs
+// claimed by each key are verified and included. If Certifiers is set,
+// third-party signatures by revoked keys are flagged.
+type JSONFormat struct {
+	Proofs     *proof.Checker
+	Certifiers RevokedCertifiers
 
-var jsonFormat = &JSONFormat{}
+	freshness *freshness
+}
 
-func (*JSONFormat) Write(w http.ResponseWriter, _ *Lookup, keys []*openpgp.PrimaryKey) error {
+func (f *JSONFormat) Write(w http.ResponseWriter, _ *Lookup, keys []*openpgp.PrimaryKey) error {
 	w.Header().Set("Content-Type", "application/json")
 	wireKeys := jsonhkp.NewPrimaryKeys(keys)
+	if f.Proofs != nil {
+		for i, key := range keys {
+			wireKeys[i].Proofs = checkProofs(f.Proofs, key)
+		}
+	}
+	if f.Certifiers != nil {
+		for _, wireKey := range wireKeys {
+			flagRevokedCertifiers(f.Certifiers, wireKey)
+		}
+	}
+	if f.freshness != nil {
+		for i, key := range keys {
+			wireKeys[i].Updated, wireKeys[i].UpdateSource = f.freshness.describe(key)
+		}
+	}
 	out, err := json.MarshalIndent(wireKeys, "", "\t")
 	if err != nil {
 		return errgo.Mask(err)
@@ -50,6 +83,115 @@ func (*JSONFormat) Write(w http.ResponseWriter, _ *Lookup, keys []*openpgp.Prima
 	return err
 }
 
+// MRJSONFormat writes the metadata of keys as JSON, without their packets.
+// It is selected with options=mr,json, for clients such as web frontends
+// which would otherwise parse the machine-readable index format. If Proofs
+// is set, the identity proofs claimed by each key are verified and included.
+// If Certifiers is set, the revoked third parties which certified each key
+// are listed.
+type MRJSONFormat struct {
+	Proofs     *proof.Checker
+	Certifiers RevokedCertifiers
+
+	freshness *freshness
+}
+
+func (f *MRJSONFormat) Write(w http.ResponseWriter, _ *Lookup, keys []*openpgp.PrimaryKey) error {
+	w.Header().Set("Content-Type", "application/json")
+	metas := jsonhkp.NewKeyMetadata(keys, time.Now())
+	if f.Proofs != nil || f.Certifiers != nil || f.freshness != nil {
+		byFingerprint := map[string]*openpgp.PrimaryKey{}
+		for _, key := range keys {
+			byFingerprint[key.Fingerprint()] = key
+		}
+		for _, meta := range metas {
+			key, ok := byFingerprint[meta.Fingerprint]
+			if !ok {
+				continue
+			}
+			if f.Proofs != nil {
+				meta.Proofs = checkProofs(f.Proofs, key)
+			}
+			if f.Certifiers != nil {
+				meta.RevokedCertifiers = revokedCertifiers(f.Certifiers, key)
+			}
+			if f.freshness != nil {
+				meta.Updated, meta.UpdateSource = f.freshness.describe(key)
+			}
+		}
+	}
+	out, err := json.MarshalIndent(metas, "", "\t")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// checkProofs returns the verification status of the identity proofs
+// claimed by key, as far as they have been verified.
+func checkProofs(c *proof.Checker, key *openpgp.PrimaryKey) []*jsonhkp.Proof {
+	var result []*jsonhkp.Proof
+	for _, r := range c.Check(context.Background(), key) {
+		p := &jsonhkp.Proof{
+			URI:      r.URI,
+			Verified: r.Verified,
+		}
+		if !r.Checked.IsZero() {
+			p.Checked = r.Checked.UTC().Format(time.RFC3339)
+		}
+		if r.Err != nil {
+			p.Error = r.Err.Error()
+		}
+		result = append(result, p)
+	}
+	return result
+}
+
+// flagRevokedCertifiers flags the third-party signatures on key which were
+// issued by revoked keys.
+func flagRevokedCertifiers(rc RevokedCertifiers, key *jsonhkp.PrimaryKey) {
+	for _, sig := range key.AllSignatures() {
+		if sig.IssuerKeyID == "" || strings.EqualFold(sig.IssuerKeyID, key.LongKeyID) {
+			continue
+		}
+		if revokedAt, ok := rc.RevokedCertifier(sig.IssuerKeyID); ok {
+			sig.IssuerRevoked = true
+			if !revokedAt.IsZero() {
+				sig.IssuerRevocation = revokedAt.UTC().Format(time.RFC3339)
+			}
+		}
+	}
+}
+
+// revokedCertifiers returns the long key IDs of the revoked keys which
+// certified key, in order.
+func revokedCertifiers(rc RevokedCertifiers, key *openpgp.PrimaryKey) []string {
+	seen := map[string]bool{}
+	var result []string
+	check := func(sigs []*openpgp.Signature) {
+		for _, sig := range sigs {
+			keyID := strings.ToLower(sig.IssuerKeyID())
+			if keyID == "" || keyID == strings.ToLower(key.KeyID()) || seen[keyID] {
+				continue
+			}
+			seen[keyID] = true
+			if _, ok := rc.RevokedCertifier(keyID); ok {
+				result = append(result, keyID)
+			}
+		}
+	}
+	check(key.Signatures)
+	for _, uid := range key.UserIDs {
+		check(uid.Signatures)
+	}
+	for _, uat := range key.UserAttributes {
+		check(uat.Signatures)
+	}
+	sort.Strings(result)
+	return result
+}
+
 type MRFormat struct{}
 
 var mrFormat = &MRFormat{}
@@ -115,11 +257,23 @@ func NewHTMLFormat(path string, extra []string) (*HTMLFormat, error) {
 	return f, nil
 }
 
+// htmlPage is the data passed to index HTML templates.
+type htmlPage struct {
+	Keys  []*jsonhkp.PrimaryKey
+	Query *Lookup
+}
+
+// T translates msg into the language negotiated for the page, as in
+// {{.T "Search results for %q" .Query.Search}}.
+func (p *htmlPage) T(msg string, args ...interface{}) string {
+	return p.Query.T(msg, args...)
+}
+
 func (f *HTMLFormat) Write(w http.ResponseWriter, l *Lookup, keys []*openpgp.PrimaryKey) error {
 	w.Header().Set("Content-Type", "text/html")
+	if l.Lang != "" {
+		w.Header().Set("Content-Language", l.Lang)
+	}
 	wireKeys := jsonhkp.NewPrimaryKeys(keys)
-	return errgo.Mask(f.t.Execute(w, struct {
-		Keys  []*jsonhkp.PrimaryKey
-		Query *Lookup
-	}{wireKeys, l}))
+	return errgo.Mask(f.t.Execute(w, &htmlPage{Keys: wireKeys, Query: l}))
 }
@@ -0,0 +1,221 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/hockeypuck/hkp.v1/vks"
+)
+
+// maxCertificateSize limits the size of an uploaded X.509 certificate.
+const maxCertificateSize = 1 << 20
+
+// X509Certificates stores and serves X.509 certificates, such as S/MIME
+// certificates, under the same verified email addresses as OpenPGP keys.
+// It must follow VerifyingKeyserver, whose tokens and mailer are used to
+// verify the addresses in uploaded certificates.
+//
+// Certificates are uploaded in PEM or DER form to /x509/v1/upload, which
+// sends a verification email to each address in their subject alternative
+// names, linking to /x509/v1/verify. Verified certificates are served by
+// /x509/v1/lookup?email=.
+func X509Certificates(certs vks.CertStore) HandlerOption {
+	return func(h *Handler) error {
+		if h.verifier == nil {
+			return errgo.New("X.509 certificates require a verifying keyserver")
+		}
+		h.verifier.certs = certs
+		return nil
+	}
+}
+
+// certBound returns whether the certificate with fingerprint fp is bound to
+// email.
+func (v *verifier) certBound(email, fp string) (bool, error) {
+	certs, err := v.certs.Certificates(email)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	for _, der := range certs {
+		if vks.CertificateFingerprint(der) == fp {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func readCertificate(body []byte) (*x509.Certificate, error) {
+	der := body
+	if block, _ := pem.Decode(body); block != nil {
+		if block.Type != "CERTIFICATE" {
+			return nil, errgo.Newf("unexpected PEM block %q", block.Type)
+		}
+		der = block.Bytes
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return cert, nil
+}
+
+// X509Upload stores the uploaded certificate and sends a verification email
+// to each of its email addresses which is not yet bound to it.
+func (h *Handler) X509Upload(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if h.refuseMirrored(w, r, "") {
+		return
+	}
+	if h.writeGuard != nil {
+		if err := h.writeGuard(); err != nil {
+			h.writeRefused(w, "", err)
+			return
+		}
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxCertificateSize))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errgo.Mask(err))
+		return
+	}
+	cert, err := readCertificate(bytes.TrimSpace(body))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errgo.Mask(err))
+		return
+	}
+	counted, ok := h.reserveQuota(w, r, "", len(body))
+	if !ok {
+		return
+	}
+	now := time.Now()
+	if now.After(cert.NotAfter) {
+		httpError(w, http.StatusBadRequest, errgo.New("certificate has expired"))
+		return
+	}
+	if len(cert.EmailAddresses) == 0 {
+		httpError(w, http.StatusBadRequest, errgo.New("certificate has no email addresses"))
+		return
+	}
+	err = h.verifier.certs.AddCertificate(cert.Raw)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, errgo.Mask(err))
+		return
+	}
+	counted(1)
+
+	fp := vks.CertificateFingerprint(cert.Raw)
+	baseURL := h.proxies.BaseURL(r, h.pathPrefix)
+	status := map[string]string{}
+	for _, addr := range cert.EmailAddresses {
+		email := strings.ToLower(addr)
+		bound, err := h.verifier.certBound(email, fp)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, errgo.Mask(err))
+			return
+		}
+		if bound {
+			status[email] = vks.StatusPublished
+			continue
+		}
+		if !h.verifier.mayMail(email, now) {
+			// A verification email was sent recently.
+			status[email] = vks.StatusPending
+			continue
+		}
+		token, err := h.verifier.tokens.Issue(vks.TokenCertificate, fp, email, now)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, errgo.Mask(err))
+			return
+		}
+		link := *baseURL
+		link.Path += "/x509/v1/verify"
+		link.RawQuery = url.Values{"token": {token}}.Encode()
+		err = h.verifier.mailer.Mail([]string{email}, "Verify "+email+" for your X.509 certificate",
+			fmt.Sprintf("To publish %s with your X.509 certificate %s on %s, visit:\n\n%s\n\n"+
+				"If you did not request this, you can ignore this message.\n",
+				email, strings.ToUpper(fp), baseURL.Host, link.String()))
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, errgo.Notef(err, "cannot send verification email"))
+			return
+		}
+		status[email] = vks.StatusPending
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&vks.CertUploadResponse{
+		CertFpr: strings.ToUpper(fp),
+		Status:  status,
+	})
+}
+
+// X509Verify binds the email address of a token sent in a verification
+// email to its certificate.
+func (h *Handler) X509Verify(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tok, err := h.verifier.tokens.Check(r.FormValue("token"), vks.TokenCertificate, time.Now())
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errgo.Mask(err))
+		return
+	}
+	err = h.verifier.certs.BindCertificate(tok.Fingerprint, tok.Email)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, errgo.Mask(err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "%s is now published with certificate %s.\n", tok.Email, strings.ToUpper(tok.Fingerprint))
+}
+
+// X509Lookup responds with the unexpired certificates bound to the address
+// given by the email parameter, PEM encoded.
+func (h *Handler) X509Lookup(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	email := strings.ToLower(strings.TrimSpace(r.FormValue("email")))
+	if email == "" {
+		httpError(w, http.StatusBadRequest, errgo.New("missing required parameter: email"))
+		return
+	}
+	certs, err := h.verifier.certs.Certificates(email)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, errgo.Mask(err))
+		return
+	}
+	now := time.Now()
+	var buf bytes.Buffer
+	for _, der := range certs {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil || now.After(cert.NotAfter) {
+			continue
+		}
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	if buf.Len() == 0 {
+		httpError(w, http.StatusNotFound, errgo.Newf("no certificates found for %s", email))
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(buf.Bytes())
+}